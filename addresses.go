@@ -0,0 +1,87 @@
+package user
+
+import (
+	"context"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/user/dbOperations"
+)
+
+// The labels an address is commonly given. Any other label is a custom
+// one.
+const (
+	AddressHome = "home"
+	AddressWork = "work"
+)
+
+// maxLabel is the longest label an address can have, in characters.
+const maxLabel = 64
+
+// validAddress trims the label of a and drops repeated types, and reports
+// whether its label and types are ones an address can have.
+func validAddress(a *dbOperations.Address) bool {
+	a.Label = strings.TrimSpace(a.Label)
+	if utf8.RuneCountInString(a.Label) > maxLabel {
+		return false
+	}
+	var types []string
+	for _, t := range a.Types {
+		if !contains(dbOperations.AddressTypes, t) {
+			return false
+		}
+		if !contains(types, t) {
+			types = append(types, t)
+		}
+	}
+	a.Types = types
+	return true
+}
+
+// DefaultsStore points users at their default addresses.
+// *dbOperations.Mongo implements it.
+type DefaultsStore interface {
+	SetDefaultAddresses(userid, shipping, billing string, version int64) (int64, error)
+	GetUser(id string) (dbOperations.User, error)
+	AppendEvent(e *dbOperations.Event) error
+}
+
+// DefaultsEndpoints mounts the endpoint setting the default addresses of a
+// customer.
+func DefaultsEndpoints(e Endpoints, st DefaultsStore) Endpoints {
+	e.DefaultsPutEndpoint = MakeDefaultsPutEndpoint(st)
+	return e
+}
+
+// MakeDefaultsPutEndpoint returns an endpoint setting the default shipping
+// and billing addresses of a customer, and answering with the customer.
+func MakeDefaultsPutEndpoint(st DefaultsStore) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(defaultsRequest)
+		err := req.IfMatch.apply(func(version int64) error {
+			_, err := st.SetDefaultAddresses(req.UserID, req.Shipping, req.Billing, version)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		u, err := st.GetUser(req.UserID)
+		if err != nil {
+			return nil, err
+		}
+		e, err := NewEvent(EventUserUpdated, u.UserID, u.EventPayload())
+		if err == nil {
+			e.Actor = actorFor(ctx, request)
+			err = st.AppendEvent(&e)
+		}
+		return u, err
+	}
+}
+
+type defaultsRequest struct {
+	UserID   string  `json:"-"`
+	Shipping string  `json:"shipping"`
+	Billing  string  `json:"billing"`
+	IfMatch  ifMatch `json:"-"`
+}
@@ -0,0 +1,147 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/user/dbOperations"
+)
+
+func TestValidAddress(t *testing.T) {
+	a := dbOperations.Address{Label: "  work ", Types: []string{"billing", "billing"}}
+	if !validAddress(&a) || a.Label != "work" || !reflect.DeepEqual(a.Types, []string{"billing"}) {
+		t.Errorf("expected the address to be cleaned up, got %+v", a)
+	}
+	for _, a := range []dbOperations.Address{
+		{Types: []string{"postal"}},
+		{Label: strings.Repeat("x", maxLabel+1)},
+	} {
+		if validAddress(&a) {
+			t.Errorf("expected %+v to be refused", a)
+		}
+	}
+	if a := (dbOperations.Address{Types: []string{"billing"}}); a.Serves(dbOperations.AddressShipping) || !a.Serves(dbOperations.AddressBilling) {
+		t.Error("expected a billing address to serve billing only")
+	}
+	if !(dbOperations.Address{}).Serves(dbOperations.AddressShipping) {
+		t.Error("expected an address without types to serve everything")
+	}
+}
+
+func TestDefaultsEndpoint(t *testing.T) {
+	svc := newStubService()
+	e, st := newTestEndpoints(svc)
+	router := MakeHTTPHandler(context.Background(), e, log.NewNopLogger())
+	do := func(method, path, body, ifMatch string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if ifMatch != "" {
+			r.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do("POST", "/addresses", `{"userID": "`+testUserID+`", "city": "Geneva", "label": "work", "types": ["billing"]}`, "")
+	var post postResponse
+	json.NewDecoder(w.Body).Decode(&post)
+	if w.Code != http.StatusOK || svc.addresses[post.ID].Label != "work" {
+		t.Fatalf("expected the labelled address to be added, got %d: %+v", w.Code, svc.addresses[post.ID])
+	}
+	if w := do("POST", "/addresses", `{"userID": "`+testUserID+`", "types": ["postal"]}`, ""); w.Code != http.StatusBadRequest {
+		t.Errorf("expected unknown types to be refused, got %d", w.Code)
+	}
+
+	w = do("PUT", "/customers/"+testUserID+"/defaults", `{"billing": "`+post.ID+`"}`, `"3"`)
+	var u dbOperations.User
+	json.NewDecoder(w.Body).Decode(&u)
+	if w.Code != http.StatusOK || u.DefaultBilling != post.ID || w.Header().Get("ETag") != `"4"` {
+		t.Errorf("expected the default to be set, got %d: %+v", w.Code, u)
+	}
+	var got map[string]interface{}
+	json.NewDecoder(do("GET", "/customers/"+testUserID, "", "").Body).Decode(&got)
+	if got["defaultBillingAddress"] != post.ID {
+		t.Errorf("expected the customer to show its default, got %v", got)
+	}
+	if len(svc.events) != 1 || svc.events[0].Type != EventUserUpdated {
+		t.Errorf("expected an update event, got %+v", svc.events)
+	}
+	if last := st.entries[len(st.entries)-1]; last.Action != "user.defaults" || last.Target != testUserID {
+		t.Errorf("expected the change to be audited, got %+v", last)
+	}
+
+	for _, c := range []struct {
+		body, ifMatch string
+		code          int
+	}{
+		{`{"shipping": "` + post.ID + `"}`, "", http.StatusBadRequest},
+		{`{"shipping": "57a98d98e4b00679b4a830ff"}`, "", http.StatusNotFound},
+		{`{"shipping": "57a98d98e4b00679b4a830b0"}`, `"3"`, http.StatusPreconditionFailed},
+		{`{"shipping": `, "", http.StatusBadRequest},
+	} {
+		if w := do("PUT", "/customers/"+testUserID+"/defaults", c.body, c.ifMatch); w.Code != c.code {
+			t.Errorf("%s: expected %d, got %d", c.body, c.code, w.Code)
+		}
+	}
+}
+
+func TestBulkAddressDefaults(t *testing.T) {
+	data := "username,street,label,types,default\n" +
+		"alice,Main St,home,,shipping\n" +
+		"alice,Side St,work,\"billing\",billing\n"
+	r, err := NewBulkReader(strings.NewReader(data), FormatCSV, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := b.user()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.DefaultShipping == "" || u.DefaultShipping != u.Addresses[0].ID || u.DefaultBilling != u.Addresses[1].ID || u.Addresses[1].Label != "work" {
+		t.Errorf("expected the defaults to name their addresses, got %+v", u)
+	}
+	exported := bulkUserFrom(u, false)
+	if !reflect.DeepEqual(exported.Addresses[0].Default, []string{"shipping"}) || !reflect.DeepEqual(exported.Addresses[1].Types, []string{"billing"}) {
+		t.Errorf("expected the defaults and types to be exported, got %+v", exported.Addresses)
+	}
+
+	for _, addrs := range [][]BulkAddress{
+		{{Default: []string{"shipping"}}, {Default: []string{"shipping"}}},
+		{{Types: []string{"billing"}, Default: []string{"shipping"}}},
+		{{Default: []string{"postal"}}},
+		{{Types: []string{"postal"}}},
+	} {
+		if _, err := (BulkUser{Username: "bob", Addresses: addrs}).user(); err == nil {
+			t.Errorf("expected %+v to be refused", addrs)
+		}
+	}
+}
+
+func TestDeleteAddressOfUser(t *testing.T) {
+	st := newCountingStore()
+	svc := NewUserService(st, log.NewNopLogger())
+	u := dbOperations.User{Username: "alice"}
+	if err := st.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	a := dbOperations.Address{Street: "Main Street"}
+	if err := st.CreateAddress(&a, u.UserID); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.DeleteAddress(a.ID, u.UserID, "alice", 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := st.addresses[a.ID]; got.DeletedAt == nil || got.DeletedFrom != u.UserID {
+		t.Errorf("expected the address to be deleted from its user, got %+v", got)
+	}
+}
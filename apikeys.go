@@ -0,0 +1,308 @@
+package user
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/user/dbOperations"
+	mgo "gopkg.in/mgo.v2"
+)
+
+// The scopes an API key can be given.
+const (
+	ScopeCustomersRead  = "customers:read"
+	ScopeCustomersWrite = "customers:write"
+	ScopeAddressesRead  = "addresses:read"
+	ScopeAddressesWrite = "addresses:write"
+)
+
+var apiKeyScopes = []string{ScopeCustomersRead, ScopeCustomersWrite, ScopeAddressesRead, ScopeAddressesWrite}
+
+const (
+	// apiKeyPrefix starts every API key, so leaked keys are easy to spot.
+	apiKeyPrefix = "usk_"
+	// apiKeyVisible is how much of a key is kept to tell keys apart.
+	apiKeyVisible = len(apiKeyPrefix) + 8
+	// apiKeyTouchInterval is how often the last use of a key is recorded,
+	// so that busy keys do not write on every request.
+	apiKeyTouchInterval = time.Minute
+	// apiKeyRotationGrace is how long a rotated key keeps working by
+	// default, for its callers to switch to the new one.
+	apiKeyRotationGrace = 24 * time.Hour
+)
+
+// APIKeyStore keeps the API keys. *dbOperations.Mongo implements it.
+type APIKeyStore interface {
+	CreateAPIKey(k *dbOperations.APIKey) error
+	GetAPIKeys() ([]dbOperations.APIKey, error)
+	GetAPIKey(id string) (dbOperations.APIKey, error)
+	GetAPIKeyByHash(hash string) (dbOperations.APIKey, error)
+	ExpireAPIKey(id string, at time.Time) error
+	TouchAPIKey(id string, at time.Time) error
+	DeleteAPIKey(id string) error
+}
+
+// APIKeyAuthenticator authenticates the API keys in st, sent as
+// "Authorization: ApiKey <key>". The principal is limited to the scopes of
+// the key.
+type APIKeyAuthenticator struct {
+	Store APIKeyStore
+}
+
+// Authenticate implements Authenticator.
+func (a APIKeyAuthenticator) Authenticate(authorization string) (Principal, bool, error) {
+	key, ok := credentials(authorization, "ApiKey")
+	if !ok {
+		return Principal{}, false, nil
+	}
+	k, err := a.Store.GetAPIKeyByHash(hashToken(key))
+	if err == mgo.ErrNotFound {
+		return Principal{}, false, ErrUnauthorized
+	}
+	if err != nil {
+		return Principal{}, false, err
+	}
+	now := time.Now()
+	if k.ExpiresAt != nil && now.After(*k.ExpiresAt) {
+		return Principal{}, false, ErrUnauthorized
+	}
+	if k.LastUsedAt == nil || now.Sub(*k.LastUsedAt) > apiKeyTouchInterval {
+		// Recording the use is best effort; it does not fail the request.
+		a.Store.TouchAPIKey(k.ID, now.UTC())
+	}
+	return Principal{ID: "apikey:" + k.ID, Scopes: k.Scopes}, true, nil
+}
+
+// APIKeyEndpoints mounts the admin-only endpoints managing API keys, and
+// limits API keys and access tokens calling the customer and address
+// endpoints to their scopes, and access tokens to their own user. Other
+// principals need to be admins. Unless anonymous is set, those endpoints
+// also need credentials.
+// It should be applied after DefaultsEndpoints, PreferencesEndpoints,
+// PolicyEndpoints and PhoneVerificationEndpoints, and before
+// AuditEndpoints.
+func APIKeyEndpoints(e Endpoints, st APIKeyStore, anonymous bool) Endpoints {
+	// Principals limited to a user may only make requests userOf finds
+	// to be about that user, unless userOf is nil.
+	limited := func(scope string, userOf func(request interface{}) string) endpoint.Middleware {
+		m := RequireScope(scope)
+		if userOf != nil {
+			m = endpoint.Chain(m, RequireUser(userOf))
+		}
+		if anonymous {
+			return m
+		}
+		return endpoint.Chain(requireCredentials, m)
+	}
+	scoped := func(scope string) endpoint.Middleware {
+		return limited(scope, requestUser)
+	}
+	e.UserGetEndpoint = scoped(ScopeCustomersRead)(e.UserGetEndpoint)
+	e.UserPostEndpoint = limited(ScopeCustomersWrite, noUser)(e.UserPostEndpoint)
+	e.UserPutEndpoint = scoped(ScopeCustomersWrite)(e.UserPutEndpoint)
+	// Addresses are looked up by their own id, not their user's.
+	e.AddressGetEndpoint = limited(ScopeAddressesRead, noUser)(e.AddressGetEndpoint)
+	e.AddressPostEndpoint = scoped(ScopeAddressesWrite)(e.AddressPostEndpoint)
+	// Validating an address is about no user's records.
+	e.AddressValidateEndpoint = limited(ScopeAddressesRead, nil)(e.AddressValidateEndpoint)
+	if e.DefaultsPutEndpoint != nil {
+		e.DefaultsPutEndpoint = scoped(ScopeCustomersWrite)(e.DefaultsPutEndpoint)
+	}
+	if e.PreferencesGetEndpoint != nil {
+		e.PreferencesGetEndpoint = scoped(ScopeCustomersRead)(e.PreferencesGetEndpoint)
+		e.PreferencesPatchEndpoint = scoped(ScopeCustomersWrite)(e.PreferencesPatchEndpoint)
+	}
+	if e.ConsentsGetEndpoint != nil {
+		e.ConsentsGetEndpoint = scoped(ScopeCustomersRead)(e.ConsentsGetEndpoint)
+		e.ConsentPostEndpoint = scoped(ScopeCustomersWrite)(e.ConsentPostEndpoint)
+		e.ConsentDeleteEndpoint = scoped(ScopeCustomersWrite)(e.ConsentDeleteEndpoint)
+	}
+	if e.PhoneVerifyEndpoint != nil {
+		e.PhoneVerifyEndpoint = scoped(ScopeCustomersWrite)(e.PhoneVerifyEndpoint)
+		e.PhoneConfirmEndpoint = scoped(ScopeCustomersWrite)(e.PhoneConfirmEndpoint)
+	}
+	deleteUser := scoped(ScopeCustomersWrite)(e.DeleteEndpoint)
+	deleteAddress := scoped(ScopeAddressesWrite)(e.DeleteEndpoint)
+	e.DeleteEndpoint = func(ctx context.Context, request interface{}) (interface{}, error) {
+		if request.(deleteRequest).AddID != "" {
+			return deleteAddress(ctx, request)
+		}
+		return deleteUser(ctx, request)
+	}
+
+	admin := RequireRole(RoleAdmin)
+	e.APIKeyPostEndpoint = admin(MakeAPIKeyPostEndpoint(st))
+	e.APIKeysGetEndpoint = admin(MakeAPIKeysGetEndpoint(st))
+	e.APIKeyRotateEndpoint = admin(MakeAPIKeyRotateEndpoint(st))
+	e.APIKeyDeleteEndpoint = admin(MakeAPIKeyDeleteEndpoint(st))
+	return e
+}
+
+// requestUser returns the user a request to a scoped endpoint is about.
+func requestUser(request interface{}) string {
+	switch req := request.(type) {
+	case GetRequest:
+		return req.ID
+	case userPutRequest:
+		return req.User.UserID
+	case addressPostRequest:
+		return req.UserID
+	case deleteRequest:
+		return req.UserID
+	case defaultsRequest:
+		return req.UserID
+	case preferencesRequest:
+		return req.UserID
+	case consentRequest:
+		return req.UserID
+	case phoneRequest:
+		return req.UserID
+	}
+	return ""
+}
+
+// noUser is for requests about no single user, or about a user the
+// request does not name.
+func noUser(interface{}) string { return "" }
+
+// requireCredentials refuses anonymous callers.
+func requireCredentials(next endpoint.Endpoint) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		if _, ok := PrincipalFrom(ctx); !ok {
+			return nil, ErrUnauthorized
+		}
+		return next(ctx, request)
+	}
+}
+
+// MakeAPIKeyPostEndpoint returns an endpoint creating an API key. The key
+// is only returned here.
+func MakeAPIKeyPostEndpoint(st APIKeyStore) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(apiKeyPostRequest)
+		if req.Name == "" || len(req.Scopes) == 0 || (req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now())) {
+			return nil, ErrInvalidRequest
+		}
+		for _, scope := range req.Scopes {
+			if !contains(apiKeyScopes, scope) {
+				return nil, ErrInvalidRequest
+			}
+		}
+		return createAPIKey(st, dbOperations.APIKey{
+			Name:      req.Name,
+			Owner:     req.Owner,
+			Scopes:    req.Scopes,
+			ExpiresAt: req.ExpiresAt,
+			CreatedBy: actorFor(ctx, request),
+		})
+	}
+}
+
+// createAPIKey generates the key for k and stores it.
+func createAPIKey(st APIKeyStore, k dbOperations.APIKey) (apiKeyPostResponse, error) {
+	secret, err := randomToken()
+	if err != nil {
+		return apiKeyPostResponse{}, err
+	}
+	key := apiKeyPrefix + secret
+	k.Prefix = key[:apiKeyVisible]
+	k.Hash = hashToken(key)
+	k.CreatedAt = time.Now().UTC()
+	if k.ExpiresAt != nil {
+		at := k.ExpiresAt.UTC()
+		k.ExpiresAt = &at
+	}
+	if err := st.CreateAPIKey(&k); err != nil {
+		return apiKeyPostResponse{}, err
+	}
+	return apiKeyPostResponse{APIKey: k, Key: key}, nil
+}
+
+// MakeAPIKeysGetEndpoint returns an endpoint listing API keys.
+func MakeAPIKeysGetEndpoint(st APIKeyStore) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		keys, err := st.GetAPIKeys()
+		return EmbedStruct{apiKeysResponse{Keys: keys}}, err
+	}
+}
+
+// MakeAPIKeyRotateEndpoint returns an endpoint replacing an API key with
+// a new one of the same name, owner and scopes. The old key keeps working
+// for the grace period, so its callers can switch without downtime. A key
+// that expires gets the same lifetime again, unless an expiry is given.
+func MakeAPIKeyRotateEndpoint(st APIKeyStore) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(apiKeyRotateRequest)
+		grace := apiKeyRotationGrace
+		if req.GraceSeconds != nil {
+			grace = time.Duration(*req.GraceSeconds) * time.Second
+		}
+		now := time.Now()
+		if grace < 0 || (req.ExpiresAt != nil && !req.ExpiresAt.After(now)) {
+			return nil, ErrInvalidRequest
+		}
+		old, err := st.GetAPIKey(req.ID)
+		if err == dbOperations.ErrInvalidHexID {
+			return nil, mgo.ErrNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		expires := req.ExpiresAt
+		if expires == nil && old.ExpiresAt != nil {
+			at := now.Add(old.ExpiresAt.Sub(old.CreatedAt))
+			expires = &at
+		}
+		k, err := createAPIKey(st, dbOperations.APIKey{
+			Name:        old.Name,
+			Owner:       old.Owner,
+			Scopes:      old.Scopes,
+			ExpiresAt:   expires,
+			CreatedBy:   actorFor(ctx, request),
+			RotatedFrom: old.ID,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return k, st.ExpireAPIKey(old.ID, now.Add(grace).UTC())
+	}
+}
+
+// MakeAPIKeyDeleteEndpoint returns an endpoint revoking an API key right
+// away.
+func MakeAPIKeyDeleteEndpoint(st APIKeyStore) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		err := st.DeleteAPIKey(request.(apiKeyRequest).ID)
+		if err == dbOperations.ErrInvalidHexID {
+			err = mgo.ErrNotFound
+		}
+		return statusResponse{Status: err == nil}, err
+	}
+}
+
+type apiKeyPostRequest struct {
+	Name      string     `json:"name"`
+	Owner     string     `json:"owner"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+type apiKeyPostResponse struct {
+	dbOperations.APIKey
+	Key string `json:"key"`
+}
+
+type apiKeyRequest struct {
+	ID string
+}
+
+type apiKeyRotateRequest struct {
+	ID           string     `json:"-"`
+	GraceSeconds *int64     `json:"graceSeconds"`
+	ExpiresAt    *time.Time `json:"expiresAt"`
+}
+
+type apiKeysResponse struct {
+	Keys []dbOperations.APIKey `json:"apikey"`
+}
@@ -0,0 +1,269 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/user/dbOperations"
+	mgo "gopkg.in/mgo.v2"
+)
+
+// memAPIKeys is an in-memory APIKeyStore.
+type memAPIKeys struct {
+	keys []dbOperations.APIKey
+}
+
+func (m *memAPIKeys) CreateAPIKey(k *dbOperations.APIKey) error {
+	k.ID = fmt.Sprintf("57a98d98e4b00679b4a831%02x", len(m.keys))
+	m.keys = append(m.keys, *k)
+	return nil
+}
+
+func (m *memAPIKeys) GetAPIKeys() ([]dbOperations.APIKey, error) {
+	return append([]dbOperations.APIKey{}, m.keys...), nil
+}
+
+func (m *memAPIKeys) find(id string) *dbOperations.APIKey {
+	for i := range m.keys {
+		if m.keys[i].ID == id {
+			return &m.keys[i]
+		}
+	}
+	return nil
+}
+
+func (m *memAPIKeys) GetAPIKey(id string) (dbOperations.APIKey, error) {
+	if k := m.find(id); k != nil {
+		return *k, nil
+	}
+	return dbOperations.APIKey{}, mgo.ErrNotFound
+}
+
+func (m *memAPIKeys) GetAPIKeyByHash(hash string) (dbOperations.APIKey, error) {
+	for _, k := range m.keys {
+		if k.Hash == hash {
+			return k, nil
+		}
+	}
+	return dbOperations.APIKey{}, mgo.ErrNotFound
+}
+
+func (m *memAPIKeys) ExpireAPIKey(id string, at time.Time) error {
+	k := m.find(id)
+	if k == nil {
+		return mgo.ErrNotFound
+	}
+	if k.ExpiresAt == nil || k.ExpiresAt.After(at) {
+		k.ExpiresAt = &at
+	}
+	return nil
+}
+
+func (m *memAPIKeys) TouchAPIKey(id string, at time.Time) error {
+	if k := m.find(id); k != nil {
+		k.LastUsedAt = &at
+	}
+	return nil
+}
+
+func (m *memAPIKeys) DeleteAPIKey(id string) error {
+	for i, k := range m.keys {
+		if k.ID == id {
+			m.keys = append(m.keys[:i], m.keys[i+1:]...)
+			return nil
+		}
+	}
+	return mgo.ErrNotFound
+}
+
+func TestAPIKeys(t *testing.T) {
+	e, st := newTestEndpoints(newStubService())
+	router := MakeHTTPHandler(context.Background(), e, log.NewNopLogger())
+	do := func(method, path, authorization, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", authorization)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	create := func(body string) apiKeyPostResponse {
+		w := do("POST", "/apikeys", "Bearer "+testAdminToken, body)
+		var k apiKeyPostResponse
+		json.NewDecoder(w.Body).Decode(&k)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("expected the key to be created, got %d", w.Code)
+		}
+		return k
+	}
+
+	k := create(`{"name": "orders", "owner": "team-orders", "scopes": ["customers:read"]}`)
+	if !strings.HasPrefix(k.Key, "usk_") || !strings.HasPrefix(k.Key, k.Prefix) || len(k.Prefix) != 12 || k.CreatedBy != "admin" {
+		t.Errorf("unexpected key %+v", k)
+	}
+	for _, body := range []string{
+		`{"name": "orders"}`,
+		`{"name": "orders", "scopes": ["customers:delete"]}`,
+		`{"scopes": ["customers:read"]}`,
+		`{"name": "orders", "scopes": ["customers:read"], "expiresAt": "2001-01-01T00:00:00Z"}`,
+	} {
+		if w := do("POST", "/apikeys", "Bearer "+testAdminToken, body); w.Code != http.StatusBadRequest {
+			t.Errorf("expected %s to be refused, got %d", body, w.Code)
+		}
+	}
+	w := do("GET", "/apikeys", "Bearer "+testAdminToken, "")
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), k.Key) || !strings.Contains(w.Body.String(), k.Prefix) {
+		t.Errorf("expected the keys to be listed by prefix only, got %d: %s", w.Code, w.Body)
+	}
+
+	// The key is limited to its scopes.
+	key := "ApiKey " + k.Key
+	if w := do("GET", "/customers/"+testUserID, key, ""); w.Code != http.StatusOK {
+		t.Errorf("expected the key to read customers, got %d", w.Code)
+	}
+	for _, r := range []struct{ method, path string }{
+		{"GET", "/addresses"},
+		{"POST", "/customers"},
+		{"DELETE", "/customers/" + testUserID},
+		{"DELETE", "/customers/" + testUserID + "/addresses/57a98d98e4b00679b4a830b0"},
+		{"GET", "/apikeys"},
+		{"GET", "/deleted/customers"},
+	} {
+		if w := do(r.method, r.path, key, `{}`); w.Code != http.StatusForbidden {
+			t.Errorf("expected %s %s to be forbidden, got %d", r.method, r.path, w.Code)
+		}
+	}
+	if w := do("GET", "/customers", "ApiKey usk_unknown", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected an unknown key to be refused, got %d", w.Code)
+	}
+
+	// The rotated key keeps working for the grace period.
+	w = do("POST", "/apikeys/"+k.ID+"/rotate", "Bearer "+testAdminToken, "")
+	var rotated apiKeyPostResponse
+	json.NewDecoder(w.Body).Decode(&rotated)
+	if w.Code != http.StatusCreated || rotated.Key == k.Key || rotated.RotatedFrom != k.ID || rotated.Name != "orders" {
+		t.Fatalf("unexpected rotation %d: %+v", w.Code, rotated)
+	}
+	for _, key := range []string{k.Key, rotated.Key} {
+		if w := do("GET", "/customers", "ApiKey "+key, ""); w.Code != http.StatusOK {
+			t.Errorf("expected both keys to work during the grace period, got %d", w.Code)
+		}
+	}
+	if w := do("POST", "/apikeys/"+rotated.ID+"/rotate", "Bearer "+testAdminToken, `{"graceSeconds": 0}`); w.Code != http.StatusCreated {
+		t.Errorf("expected the key to be rotated again, got %d", w.Code)
+	}
+	if w := do("GET", "/customers", "ApiKey "+rotated.Key, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the key rotated without grace to stop working, got %d", w.Code)
+	}
+	if w := do("POST", "/apikeys/57a98d98e4b00679b4a831ff/rotate", "Bearer "+testAdminToken, ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected an unknown key not to be found, got %d", w.Code)
+	}
+
+	if w := do("DELETE", "/apikeys/"+k.ID, "Bearer "+testAdminToken, ""); w.Code != http.StatusOK {
+		t.Errorf("expected the key to be revoked, got %d", w.Code)
+	}
+	if w := do("GET", "/customers", key, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the revoked key to be refused, got %d", w.Code)
+	}
+
+	var actions []string
+	for _, entry := range st.entries {
+		if strings.HasPrefix(entry.Action, "apikey.") && entry.Outcome == outcomeSuccess {
+			actions = append(actions, entry.Action)
+		}
+	}
+	if strings.Join(actions, " ") != "apikey.create apikey.rotate apikey.rotate apikey.revoke" {
+		t.Errorf("unexpected audit entries %v", actions)
+	}
+}
+
+func TestAPIKeyLastUsed(t *testing.T) {
+	keys := &memAPIKeys{}
+	k, err := createAPIKey(keys, dbOperations.APIKey{Name: "shipping", Scopes: []string{ScopeAddressesRead}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := APIKeyAuthenticator{keys}
+	p, ok, err := a.Authenticate("ApiKey " + k.Key)
+	if !ok || err != nil || p.ID != "apikey:"+k.ID || !p.HasScope(ScopeAddressesRead) || p.HasScope(ScopeCustomersRead) {
+		t.Fatalf("unexpected principal %+v: %v", p, err)
+	}
+	used := keys.keys[0].LastUsedAt
+	if used == nil {
+		t.Fatal("expected the use to be recorded")
+	}
+	a.Authenticate("ApiKey " + k.Key)
+	if keys.keys[0].LastUsedAt != used {
+		t.Error("expected uses within a minute not to be recorded again")
+	}
+
+	past := time.Now().Add(-time.Second)
+	keys.keys[0].ExpiresAt = &past
+	if _, _, err := a.Authenticate("ApiKey " + k.Key); err != ErrUnauthorized {
+		t.Errorf("expected an expired key to be refused, got %v", err)
+	}
+	if _, ok, err := a.Authenticate("Bearer " + k.Key); ok || err != nil {
+		t.Error("expected other schemes to be left to other authenticators")
+	}
+}
+
+func TestAPIKeysWithoutAnonymousAccess(t *testing.T) {
+	keys := &memAPIKeys{}
+	e := APIKeyEndpoints(MakeEndpoints(newStubService()), keys, false)
+	e = AuthenticateEndpoints(e, Authenticators{testTokens, APIKeyAuthenticator{keys}})
+	router := MakeHTTPHandler(context.Background(), e, log.NewNopLogger())
+	k, _ := createAPIKey(keys, dbOperations.APIKey{Name: "orders", Scopes: []string{ScopeCustomersRead}})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/customers", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected anonymous callers to be refused, got %d", w.Code)
+	}
+	for _, authorization := range []string{"ApiKey " + k.Key, "Bearer " + testAdminToken} {
+		r := httptest.NewRequest("GET", "/customers", nil)
+		r.Header.Set("Authorization", authorization)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("expected %s to be let through, got %d", strings.Fields(authorization)[0], w.Code)
+		}
+	}
+}
+
+func TestAccessTokensLimitedToTheirUser(t *testing.T) {
+	e, _ := newTestEndpoints(newStubService())
+	router := MakeHTTPHandler(context.Background(), e, log.NewNopLogger())
+	do := func(method, path, authorization string) int {
+		r := httptest.NewRequest(method, path, nil)
+		r.Header.Set("Authorization", authorization)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w.Code
+	}
+	own, other := "Bearer "+testAccessToken(testUserID), "Bearer "+testAccessToken("57a98d98e4b00679b4a830b1")
+	for _, c := range []struct {
+		method, path, authorization string
+		code                        int
+	}{
+		{"GET", "/customers/" + testUserID, own, http.StatusOK},
+		{"GET", "/customers/" + testUserID + "/addresses", own, http.StatusOK},
+		{"GET", "/customers/" + testUserID, other, http.StatusForbidden},
+		{"GET", "/customers/" + testUserID + "/addresses", other, http.StatusForbidden},
+		{"DELETE", "/customers/" + testUserID, other, http.StatusForbidden},
+		{"GET", "/customers", own, http.StatusForbidden},
+		{"GET", "/addresses", own, http.StatusForbidden},
+		// Principals without scopes need to be admins.
+		{"GET", "/customers/" + testUserID, "Bearer " + testSupportToken, http.StatusForbidden},
+		{"GET", "/customers/" + testUserID, "Bearer " + testAdminToken, http.StatusOK},
+	} {
+		if code := do(c.method, c.path, c.authorization); code != c.code {
+			t.Errorf("%s %s: expected %d, got %d", c.method, c.path, c.code, code)
+		}
+	}
+}
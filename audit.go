@@ -0,0 +1,381 @@
+package user
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/user/dbOperations"
+)
+
+const (
+	outcomeSuccess = "success"
+	outcomeFailure = "failure"
+)
+
+// AuditLog stores the audit trail. *dbOperations.Mongo implements it.
+type AuditLog interface {
+	AppendAudit(e *dbOperations.AuditEntry) error
+	GetAudit(f dbOperations.AuditFilter) ([]dbOperations.AuditEntry, int, error)
+}
+
+// describeFunc names the action an endpoint call performed and the user it
+// was performed on.
+type describeFunc func(request, response interface{}) (action, target, addrID string)
+
+// AuditEndpoints records every login attempt, every data changing call and
+// every data subject request in al, and mounts the admin-only audit
+// endpoint. It should be applied after DataSubjectEndpoints,
+// DefaultsEndpoints, PreferencesEndpoints, PolicyEndpoints,
+// PhoneVerificationEndpoints, RestoreEndpoints, BulkEndpoints,
+// SCIMEndpoints, WebhookEndpoints, OIDCEndpoints, IdentityEndpoints and
+// APIKeyEndpoints.
+func AuditEndpoints(e Endpoints, al AuditLog, logger log.Logger) Endpoints {
+	e.LoginEndpoint = auditMiddleware(al, logger, describeLogin)(e.LoginEndpoint)
+	e.RegisterEndpoint = auditMiddleware(al, logger, describeRegister)(e.RegisterEndpoint)
+	e.UserPostEndpoint = auditMiddleware(al, logger, describeUserPost)(e.UserPostEndpoint)
+	e.UserPutEndpoint = auditMiddleware(al, logger, describeUserPut)(e.UserPutEndpoint)
+	e.AddressPostEndpoint = auditMiddleware(al, logger, describeAddressPost)(e.AddressPostEndpoint)
+	e.DeleteEndpoint = auditMiddleware(al, logger, describeDelete)(e.DeleteEndpoint)
+	if e.ExportEndpoint != nil {
+		e.ExportEndpoint = auditMiddleware(al, logger, describeDataSubject("user.export"))(e.ExportEndpoint)
+		e.ErasurePostEndpoint = auditMiddleware(al, logger, describeDataSubject("user.erasure.request"))(e.ErasurePostEndpoint)
+		e.ErasureDeleteEndpoint = auditMiddleware(al, logger, describeDataSubject("user.erasure.cancel"))(e.ErasureDeleteEndpoint)
+	}
+	if e.DefaultsPutEndpoint != nil {
+		e.DefaultsPutEndpoint = auditMiddleware(al, logger, describeDefaults)(e.DefaultsPutEndpoint)
+	}
+	if e.PreferencesPatchEndpoint != nil {
+		e.PreferencesPatchEndpoint = auditMiddleware(al, logger, describePreferences)(e.PreferencesPatchEndpoint)
+	}
+	if e.PolicyPostEndpoint != nil {
+		e.PolicyPostEndpoint = auditMiddleware(al, logger, describePolicyPost)(e.PolicyPostEndpoint)
+		e.ConsentPostEndpoint = auditMiddleware(al, logger, describeConsent("user.consent.accept"))(e.ConsentPostEndpoint)
+		e.ConsentDeleteEndpoint = auditMiddleware(al, logger, describeConsent("user.consent.withdraw"))(e.ConsentDeleteEndpoint)
+	}
+	if e.PhoneVerifyEndpoint != nil {
+		e.PhoneVerifyEndpoint = auditMiddleware(al, logger, describePhone("user.phone.verify"))(e.PhoneVerifyEndpoint)
+		e.PhoneConfirmEndpoint = auditMiddleware(al, logger, describePhone("user.phone.confirm"))(e.PhoneConfirmEndpoint)
+	}
+	if e.RestoreUserEndpoint != nil {
+		e.RestoreUserEndpoint = auditMiddleware(al, logger, describeRestore("user.restore"))(e.RestoreUserEndpoint)
+		e.RestoreAddressEndpoint = auditMiddleware(al, logger, describeRestore("address.restore"))(e.RestoreAddressEndpoint)
+	}
+	if e.BulkImportEndpoint != nil {
+		e.BulkImportEndpoint = auditMiddleware(al, logger, describeBulk("users.import"))(e.BulkImportEndpoint)
+		e.BulkExportEndpoint = auditMiddleware(al, logger, describeBulk("users.export"))(e.BulkExportEndpoint)
+	}
+	if e.SCIMUserPostEndpoint != nil {
+		e.SCIMUserPostEndpoint = auditMiddleware(al, logger, describeSCIM("user.create"))(e.SCIMUserPostEndpoint)
+		e.SCIMUserPutEndpoint = auditMiddleware(al, logger, describeSCIM("user.update"))(e.SCIMUserPutEndpoint)
+		e.SCIMUserPatchEndpoint = auditMiddleware(al, logger, describeSCIM("user.update"))(e.SCIMUserPatchEndpoint)
+		e.SCIMUserDeleteEndpoint = auditMiddleware(al, logger, describeSCIM("user.delete"))(e.SCIMUserDeleteEndpoint)
+	}
+	if e.WebhookPostEndpoint != nil {
+		e.WebhookPostEndpoint = auditMiddleware(al, logger, describeWebhook("webhook.create"))(e.WebhookPostEndpoint)
+		e.WebhookDeleteEndpoint = auditMiddleware(al, logger, describeWebhook("webhook.delete"))(e.WebhookDeleteEndpoint)
+	}
+	if e.OIDCLoginEndpoint != nil {
+		e.OIDCLoginEndpoint = auditMiddleware(al, logger, describeOIDCLogin)(e.OIDCLoginEndpoint)
+		e.OIDCClientPostEndpoint = auditMiddleware(al, logger, describeOAuthClient("oauth.client.register"))(e.OIDCClientPostEndpoint)
+		e.OIDCClientDeleteEndpoint = auditMiddleware(al, logger, describeOAuthClient("oauth.client.delete"))(e.OIDCClientDeleteEndpoint)
+	}
+	if e.ExternalCallbackEndpoint != nil {
+		e.ExternalCallbackEndpoint = auditMiddleware(al, logger, describeExternalLogin)(e.ExternalCallbackEndpoint)
+		e.IdentityDeleteEndpoint = auditMiddleware(al, logger, describeUnlink)(e.IdentityDeleteEndpoint)
+	}
+	if e.APIKeyPostEndpoint != nil {
+		e.APIKeyPostEndpoint = auditMiddleware(al, logger, describeAPIKey("apikey.create"))(e.APIKeyPostEndpoint)
+		e.APIKeyRotateEndpoint = auditMiddleware(al, logger, describeAPIKey("apikey.rotate"))(e.APIKeyRotateEndpoint)
+		e.APIKeyDeleteEndpoint = auditMiddleware(al, logger, describeAPIKey("apikey.revoke"))(e.APIKeyDeleteEndpoint)
+	}
+	if e.TenantPutEndpoint != nil {
+		e.TenantPutEndpoint = auditMiddleware(al, logger, describeTenant("tenant.save"))(e.TenantPutEndpoint)
+		e.TenantDeleteEndpoint = auditMiddleware(al, logger, describeTenant("tenant.delete"))(e.TenantDeleteEndpoint)
+	}
+	e.AuditGetEndpoint = RequireRole(RoleAdmin)(MakeAuditGetEndpoint(al))
+	return e
+}
+
+func auditMiddleware(al AuditLog, logger log.Logger, describe describeFunc) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			response, err := next(ctx, request)
+			ri := RequestInfoFrom(ctx)
+			entry := dbOperations.AuditEntry{
+				Time:      time.Now(),
+				Actor:     actorFor(ctx, request),
+				Outcome:   outcomeSuccess,
+				ClientIP:  ri.ClientIP,
+				UserAgent: ri.UserAgent,
+				RequestID: ri.RequestID,
+			}
+			entry.Action, entry.Target, entry.AddressID = describe(request, response)
+			if err != nil {
+				entry.Outcome = outcomeFailure
+				entry.Error = err.Error()
+			}
+			if aerr := al.AppendAudit(&entry); aerr != nil {
+				logger.Log("audit", entry.Action, "target", entry.Target, "err", aerr)
+			}
+			return response, err
+		}
+	}
+}
+
+// actorFor is the authenticated principal, or the username a caller
+// claims when logging in or registering.
+func actorFor(ctx context.Context, request interface{}) string {
+	if p, ok := PrincipalFrom(ctx); ok {
+		return p.ID
+	}
+	switch req := request.(type) {
+	case loginRequest:
+		return req.Username
+	case registerRequest:
+		return req.Username
+	case authorizeRequest:
+		if req.Username != "" {
+			return req.Username
+		}
+	}
+	return "anonymous"
+}
+
+func describeLogin(request, response interface{}) (string, string, string) {
+	req := request.(loginRequest)
+	if resp, ok := response.(userResponse); ok && resp.User.UserID != "" {
+		return "login", resp.User.UserID, ""
+	}
+	return "login", req.Username, ""
+}
+
+func describeRegister(request, response interface{}) (string, string, string) {
+	if resp, ok := response.(postResponse); ok && resp.ID != "" {
+		return "user.register", resp.ID, ""
+	}
+	return "user.register", request.(registerRequest).Username, ""
+}
+
+func describeUserPost(request, response interface{}) (string, string, string) {
+	if resp, ok := response.(postResponse); ok && resp.ID != "" {
+		return "user.create", resp.ID, ""
+	}
+	return "user.create", request.(dbOperations.User).Username, ""
+}
+
+func describeUserPut(request, _ interface{}) (string, string, string) {
+	return "user.update", request.(userPutRequest).User.UserID, ""
+}
+
+func describeAddressPost(request, response interface{}) (string, string, string) {
+	req := request.(addressPostRequest)
+	resp, _ := response.(postResponse)
+	return "address.create", req.UserID, resp.ID
+}
+
+func describeDelete(request, _ interface{}) (string, string, string) {
+	req := request.(deleteRequest)
+	if req.AddID != "" {
+		return "address.delete", req.UserID, req.AddID
+	}
+	return "user.delete", req.UserID, ""
+}
+
+func describeDefaults(request, _ interface{}) (string, string, string) {
+	return "user.defaults", request.(defaultsRequest).UserID, ""
+}
+
+func describePreferences(request, _ interface{}) (string, string, string) {
+	return "user.preferences", request.(preferencesRequest).UserID, ""
+}
+
+func describePolicyPost(request, _ interface{}) (string, string, string) {
+	p := request.(dbOperations.Policy)
+	return "policy.publish", p.Name + ":" + p.Version, ""
+}
+
+func describeConsent(action string) describeFunc {
+	return func(request, _ interface{}) (string, string, string) {
+		return action, request.(consentRequest).UserID, ""
+	}
+}
+
+func describePhone(action string) describeFunc {
+	return func(request, _ interface{}) (string, string, string) {
+		return action, request.(phoneRequest).UserID, ""
+	}
+}
+
+func describeDataSubject(action string) describeFunc {
+	return func(request, _ interface{}) (string, string, string) {
+		return action, request.(dataSubjectRequest).UserID, ""
+	}
+}
+
+// describeBulk names no target, as a bulk call touches many users.
+func describeBulk(action string) describeFunc {
+	return func(_, _ interface{}) (string, string, string) {
+		return action, "", ""
+	}
+}
+
+// describeRestore names the restored address's user as the target once it
+// is known.
+func describeRestore(action string) describeFunc {
+	return func(request, response interface{}) (string, string, string) {
+		req := request.(restoreRequest)
+		resp, _ := response.(restoreResponse)
+		if action == "user.restore" {
+			return action, req.ID, ""
+		}
+		return action, resp.UserID, req.ID
+	}
+}
+
+// describeOIDCLogin records logins through the OpenID Connect provider and
+// the consents given there, naming the user once they are known.
+func describeOIDCLogin(request, response interface{}) (string, string, string) {
+	req := request.(authorizeRequest)
+	action := "oidc.login"
+	if req.Ticket != "" {
+		action = "oidc.consent"
+	}
+	switch resp := response.(type) {
+	case *oidcPage:
+		if resp.userID != "" {
+			return action, resp.userID, ""
+		}
+	case oidcRedirect:
+		if resp.userID != "" {
+			return action, resp.userID, ""
+		}
+	}
+	return action, req.Username, ""
+}
+
+// describeExternalLogin records logins through identity providers and the
+// accounts linked through them, naming the user once they are known.
+func describeExternalLogin(_, response interface{}) (string, string, string) {
+	switch resp := response.(type) {
+	case *oidcPage:
+		if resp.name == "linked" {
+			return "identity.link", resp.userID, ""
+		}
+		return "oidc.login", resp.userID, ""
+	case oidcRedirect:
+		return "oidc.login", resp.userID, ""
+	}
+	return "oidc.login", "", ""
+}
+
+// describeTenant names the tenant as the target.
+func describeTenant(action string) describeFunc {
+	return func(request, _ interface{}) (string, string, string) {
+		return action, request.(tenantRequest).ID, ""
+	}
+}
+
+func describeUnlink(request, _ interface{}) (string, string, string) {
+	return "identity.unlink", request.(identityRequest).UserID, ""
+}
+
+// describeSCIM names the provisioned user as the target, taking its id from
+// the response for users created over SCIM.
+func describeSCIM(action string) describeFunc {
+	return func(request, response interface{}) (string, string, string) {
+		switch req := request.(type) {
+		case scimPatchRequest:
+			return action, req.ID, ""
+		case scimUserRequest:
+			if req.ID != "" {
+				return action, req.ID, ""
+			}
+			if su, ok := response.(scimUser); ok {
+				return action, su.ID, ""
+			}
+			return action, req.User.UserName, ""
+		}
+		return action, "", ""
+	}
+}
+
+// MakeAuditGetEndpoint returns an endpoint listing audit entries.
+func MakeAuditGetEndpoint(al AuditLog) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(auditGetRequest)
+		f := req.AuditFilter
+		f.Skip = req.Page * req.Size
+		f.Limit = req.Size
+		entries, total, err := al.GetAudit(f)
+		return auditResponse{
+			Embed: auditEntries{Entries: entries},
+			Page: page{
+				Size:          req.Size,
+				Number:        req.Page,
+				TotalElements: total,
+			},
+		}, err
+	}
+}
+
+type auditGetRequest struct {
+	dbOperations.AuditFilter
+	Page int
+	Size int
+}
+
+type auditEntries struct {
+	Entries []dbOperations.AuditEntry `json:"audit"`
+}
+
+type auditResponse struct {
+	Embed auditEntries `json:"_embedded"`
+	Page  page         `json:"page"`
+}
+
+type page struct {
+	Size          int `json:"size"`
+	Number        int `json:"number"`
+	TotalElements int `json:"totalElements"`
+}
+
+// describeAPIKey names the key an API key call was about as the target;
+// for a rotation that is the key being replaced.
+// describeWebhook names the subscription as the target, taking its id from
+// the response for subscriptions created.
+func describeWebhook(action string) describeFunc {
+	return func(request, response interface{}) (string, string, string) {
+		if req, ok := request.(webhookRequest); ok {
+			return action, req.ID, ""
+		}
+		resp, _ := response.(webhookPostResponse)
+		return action, resp.ID, ""
+	}
+}
+
+// describeOAuthClient names the client as the target, taking its id from
+// the response for clients registered.
+func describeOAuthClient(action string) describeFunc {
+	return func(request, response interface{}) (string, string, string) {
+		if req, ok := request.(clientRequest); ok {
+			return action, req.ID, ""
+		}
+		resp, _ := response.(clientPostResponse)
+		return action, resp.ID, ""
+	}
+}
+
+func describeAPIKey(action string) describeFunc {
+	return func(request, response interface{}) (string, string, string) {
+		switch req := request.(type) {
+		case apiKeyRequest:
+			return action, req.ID, ""
+		case apiKeyRotateRequest:
+			return action, req.ID, ""
+		}
+		resp, _ := response.(apiKeyPostResponse)
+		return action, resp.ID, ""
+	}
+}
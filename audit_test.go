@@ -0,0 +1,186 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/user/dbOperations"
+)
+
+func newAuditTestRouter() (http.Handler, *memDataSubjects) {
+	e, al := newTestEndpoints(newStubService())
+	return MakeHTTPHandler(context.Background(), e, log.NewNopLogger()), al
+}
+
+func TestAuditRecordsCalls(t *testing.T) {
+	router, al := newAuditTestRouter()
+	proxies, _ := ParseTrustedProxies("192.0.2.1, 10.0.0.0/8")
+	router = proxies.Handler(router)
+
+	do := func(r *http.Request) {
+		r.Header.Set("User-Agent", "audit-test")
+		r.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.1")
+		r.Header.Set("X-Request-ID", "req-"+r.Method)
+		router.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	r := httptest.NewRequest("GET", "/login", nil)
+	r.SetBasicAuth("eve", "wrong")
+	do(r)
+	do(httptest.NewRequest("POST", "/register", strings.NewReader(`{"username":"mallory","password":"pass"}`)))
+	do(httptest.NewRequest("DELETE", "/customers/57a98d98e4b00679b4a830af", nil))
+
+	want := []struct{ actor, action, target, outcome, requestID string }{
+		{"eve", "login", "eve", outcomeFailure, "req-GET"},
+		{"mallory", "user.register", "57a98d98e4b00679b4a830b1", outcomeSuccess, "req-POST"},
+		{"anonymous", "user.delete", "57a98d98e4b00679b4a830af", outcomeSuccess, "req-DELETE"},
+	}
+	if len(al.entries) != len(want) {
+		t.Fatalf("expected %d entries, got %d", len(want), len(al.entries))
+	}
+	for i, w := range want {
+		e := al.entries[i]
+		if e.Actor != w.actor || e.Action != w.action || e.Target != w.target || e.Outcome != w.outcome {
+			t.Errorf("entry %d: got %s %s %s %s", i, e.Actor, e.Action, e.Target, e.Outcome)
+		}
+		if e.ClientIP != "203.0.113.7" || e.UserAgent != "audit-test" || e.RequestID != w.requestID {
+			t.Errorf("entry %d: unexpected request info %q %q %q", i, e.ClientIP, e.UserAgent, e.RequestID)
+		}
+	}
+	if err := dbOperations.VerifyAuditChain(al.entries); err != nil {
+		t.Error(err)
+	}
+	al.entries[0].Tenant = "other"
+	if err := dbOperations.VerifyAuditChain(al.entries); err == nil {
+		t.Error("expected moving an entry to another tenant to be detected")
+	}
+	al.entries[0].Tenant = ""
+	al.entries[1].Actor = "someone else"
+	if err := dbOperations.VerifyAuditChain(al.entries); err == nil {
+		t.Error("expected tampering to be detected")
+	}
+}
+
+func TestAuditRecordsClientAndWebhookChanges(t *testing.T) {
+	router, al := newAuditTestRouter()
+	do := func(method, path, body string) string {
+		r := adminRequest(method, path)
+		r.Body = ioutil.NopCloser(strings.NewReader(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		var created struct {
+			ID       string `json:"id"`
+			ClientID string `json:"client_id"`
+		}
+		json.NewDecoder(w.Body).Decode(&created)
+		return created.ID + created.ClientID
+	}
+	client := do("POST", "/oauth2/clients", `{"client_name": "shop", "redirect_uris": ["https://shop.example/cb"]}`)
+	do("DELETE", "/oauth2/clients/"+client, "")
+	hook := do("POST", "/webhooks", `{"url": "https://example.com/hook"}`)
+	do("DELETE", "/webhooks/"+hook, "")
+
+	want := []struct{ action, target string }{
+		{"oauth.client.register", client},
+		{"oauth.client.delete", client},
+		{"webhook.create", hook},
+		{"webhook.delete", hook},
+	}
+	if len(al.entries) != len(want) {
+		t.Fatalf("expected %d entries, got %+v", len(want), al.entries)
+	}
+	for i, w := range want {
+		e := al.entries[i]
+		if e.Action != w.action || e.Target != w.target || e.Target == "" || e.Actor != "admin" || e.Outcome != outcomeSuccess {
+			t.Errorf("entry %d: expected %s on %q, got %+v", i, w.action, w.target, e)
+		}
+	}
+}
+
+func TestTrustedProxiesClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies("192.0.2.1, 10.0.0.0/8,2001:db8::1")
+	if err != nil || len(proxies) != 3 {
+		t.Fatalf("unexpected proxies %v: %v", proxies, err)
+	}
+	for _, c := range []struct {
+		remote    string
+		forwarded []string
+		want      string
+	}{
+		{"203.0.113.7:1234", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"192.0.2.1:1234", nil, "192.0.2.1"},
+		{"192.0.2.1:1234", []string{"198.51.100.1, 203.0.113.7"}, "203.0.113.7"},
+		{"192.0.2.1:1234", []string{"198.51.100.1", "203.0.113.7, 10.0.0.2"}, "203.0.113.7"},
+		{"[2001:db8::1]:1234", []string{"10.0.0.2, 10.0.0.3"}, "10.0.0.2"},
+		{"192.0.2.1:1234", []string{"203.0.113.7, unknown"}, "192.0.2.1"},
+	} {
+		if got := proxies.clientIP(c.remote, c.forwarded); got != c.want {
+			t.Errorf("%s forwarding %v: expected %s, got %s", c.remote, c.forwarded, c.want, got)
+		}
+	}
+	if _, err := ParseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("expected an invalid network to be refused")
+	}
+}
+
+func TestAuditGetRequiresAdmin(t *testing.T) {
+	router, _ := newAuditTestRouter()
+	for auth, code := range map[string]int{
+		"":                         http.StatusUnauthorized,
+		"Bearer wrong":             http.StatusUnauthorized,
+		"Bearer " + testAdminToken: http.StatusOK,
+	} {
+		r := httptest.NewRequest("GET", "/audit", nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != code {
+			t.Errorf("%q: expected %d, got %d", auth, code, w.Code)
+		}
+	}
+}
+
+func TestAuditGetFilterAndPage(t *testing.T) {
+	router, al := newAuditTestRouter()
+	for _, actor := range []string{"eve", "bob", "eve", "eve"} {
+		al.AppendAudit(&dbOperations.AuditEntry{Actor: actor, Action: "login", Outcome: outcomeSuccess})
+	}
+
+	get := func(query string) auditResponse {
+		r := httptest.NewRequest("GET", "/audit"+query, nil)
+		r.Header.Set("Authorization", "Bearer "+testAdminToken)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", query, w.Code)
+		}
+		var resp auditResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := get("?actor=eve&size=2&page=1")
+	if resp.Page.TotalElements != 3 || len(resp.Embed.Entries) != 1 {
+		t.Errorf("unexpected page %+v with %d entries", resp.Page, len(resp.Embed.Entries))
+	}
+	if resp.Embed.Entries[0].Seq != 1 {
+		t.Errorf("expected oldest eve entry last, got seq %d", resp.Embed.Entries[0].Seq)
+	}
+
+	r := httptest.NewRequest("GET", "/audit?size=0", nil)
+	r.Header.Set("Authorization", "Bearer "+testAdminToken)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for bad size, got %d", w.Code)
+	}
+}
@@ -0,0 +1,318 @@
+package user
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// RoleAdmin may use the administrative endpoints.
+	RoleAdmin = "admin"
+	// RoleProvisioner may provision users over SCIM.
+	RoleProvisioner = "provisioner"
+	// RoleSupport may search customers.
+	RoleSupport = "support"
+)
+
+var (
+	ErrForbidden = errors.New("Forbidden")
+)
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	ID    string
+	Roles []string
+	// Scopes limit what an API key or a user's access token may do. Other
+	// principals have none, and only admins among them may use the scoped
+	// endpoints.
+	Scopes []string
+	// User, when set, is the only user whose records the principal may use
+	// the scoped endpoints on.
+	User string
+}
+
+// HasRole reports whether the principal holds any of roles.
+func (p Principal) HasRole(roles ...string) bool {
+	for _, have := range p.Roles {
+		for _, want := range roles {
+			if have == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// HasScope reports whether the principal is limited by scopes, and holds
+// scope.
+func (p Principal) HasScope(scope string) bool {
+	return p.Scopes != nil && contains(p.Scopes, scope)
+}
+
+// Authenticator resolves the principal behind the credentials of an
+// Authorization header. It returns ok false for schemes it does not handle,
+// and ErrUnauthorized for credentials it handles but rejects.
+type Authenticator interface {
+	Authenticate(authorization string) (p Principal, ok bool, err error)
+}
+
+// Authenticators tries each Authenticator in turn.
+type Authenticators []Authenticator
+
+// Authenticate implements Authenticator.
+func (as Authenticators) Authenticate(authorization string) (Principal, bool, error) {
+	for _, a := range as {
+		p, ok, err := a.Authenticate(authorization)
+		if ok || err != nil {
+			return p, ok, err
+		}
+	}
+	return Principal{}, false, nil
+}
+
+// TokenAuthenticator authenticates static bearer tokens, such as the admin
+// token given on the command line.
+type TokenAuthenticator map[string]Principal
+
+// Authenticate implements Authenticator.
+func (ta TokenAuthenticator) Authenticate(authorization string) (Principal, bool, error) {
+	token, ok := credentials(authorization, "Bearer")
+	if !ok {
+		return Principal{}, false, nil
+	}
+	for t, p := range ta {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return p, true, nil
+		}
+	}
+	return Principal{}, false, ErrUnauthorized
+}
+
+func credentials(authorization, scheme string) (string, bool) {
+	if len(authorization) <= len(scheme) || !strings.EqualFold(authorization[:len(scheme)+1], scheme+" ") {
+		return "", false
+	}
+	return strings.TrimSpace(authorization[len(scheme)+1:]), true
+}
+
+// RequestInfo is what the transport knows about the caller of a request.
+// Route is the method and route template, "GET /customers/{id}/export",
+// or the gRPC method.
+type RequestInfo struct {
+	ClientIP      string
+	UserAgent     string
+	RequestID     string
+	Authorization string
+	Route         string
+}
+
+type contextKey int
+
+const (
+	requestInfoKey contextKey = iota
+	principalKey
+	ifNoneMatchKey
+	rateLimitKey
+	clientIPKey
+)
+
+// RequestInfoFrom returns the RequestInfo the transport stored in ctx.
+func RequestInfoFrom(ctx context.Context) RequestInfo {
+	ri, _ := ctx.Value(requestInfoKey).(RequestInfo)
+	return ri
+}
+
+// PrincipalFrom returns the authenticated principal in ctx, if any.
+func PrincipalFrom(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey).(Principal)
+	return p, ok
+}
+
+func withRequestInfo(ctx context.Context, ri RequestInfo) context.Context {
+	if ri.RequestID == "" {
+		ri.RequestID = newRequestID()
+	}
+	return context.WithValue(ctx, requestInfoKey, ri)
+}
+
+// TrustedProxies are the networks of the proxies in front of the service.
+// Only requests they pass on can tell the client address in their
+// X-Forwarded-For header; anyone else could claim any address there.
+type TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies parses a comma separated list of addresses and CIDR
+// networks, such as "10.0.0.0/8,192.0.2.10".
+func ParseTrustedProxies(s string) (TrustedProxies, error) {
+	var ps TrustedProxies
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if !strings.Contains(f, "/") {
+			ip := net.ParseIP(f)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid proxy address %q", f)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			f = fmt.Sprintf("%s/%d", f, bits)
+		}
+		_, n, err := net.ParseCIDR(f)
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, n)
+	}
+	return ps, nil
+}
+
+func (ps TrustedProxies) contains(addr string) bool {
+	ip := net.ParseIP(addr)
+	for _, n := range ps {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the client address of a request from remote forwarded
+// for the given X-Forwarded-For values. Walking back from the proxy that
+// connected, it is the first address that is not a trusted proxy.
+func (ps TrustedProxies) clientIP(remote string, forwarded []string) string {
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	if !ps.contains(remote) {
+		return remote
+	}
+	hops := strings.Split(strings.Join(forwarded, ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		remote = hop
+		if !ps.contains(hop) {
+			break
+		}
+	}
+	return remote
+}
+
+// Handler returns a handler storing the client address of every request
+// for the transport to put in its RequestInfo.
+func (ps TrustedProxies) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := ps.clientIP(r.RemoteAddr, r.Header["X-Forwarded-For"])
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey, ip)))
+	})
+}
+
+// populateRequestInfo is a RequestFunc storing the caller's RequestInfo.
+// The client address is the connection's, or the one TrustedProxies
+// found.
+func populateRequestInfo(ctx context.Context, r *http.Request) context.Context {
+	ip, ok := ctx.Value(clientIPKey).(string)
+	if !ok {
+		ip = TrustedProxies(nil).clientIP(r.RemoteAddr, nil)
+	}
+	route := r.Method + " " + r.URL.Path
+	if current := mux.CurrentRoute(r); current != nil {
+		if tmpl, err := current.GetPathTemplate(); err == nil {
+			route = r.Method + " " + tmpl
+		}
+	}
+	return withRequestInfo(ctx, RequestInfo{
+		ClientIP:      ip,
+		UserAgent:     r.UserAgent(),
+		RequestID:     r.Header.Get("X-Request-ID"),
+		Authorization: r.Header.Get("Authorization"),
+		Route:         route,
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return fmt.Sprintf("%x", b)
+}
+
+// Authenticate returns a middleware that stores the principal behind the
+// request's credentials in the context. Requests without credentials pass
+// through anonymously; requests with bad credentials are rejected.
+func Authenticate(a Authenticator) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			p, ok, err := a.Authenticate(RequestInfoFrom(ctx).Authorization)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				ctx = context.WithValue(ctx, principalKey, p)
+			}
+			return next(ctx, request)
+		}
+	}
+}
+
+// RequireRole returns a middleware that only lets principals holding one
+// of roles through. It relies on Authenticate having run first.
+func RequireRole(roles ...string) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			p, ok := PrincipalFrom(ctx)
+			if !ok {
+				return nil, ErrUnauthorized
+			}
+			if !p.HasRole(roles...) {
+				return nil, ErrForbidden
+			}
+			return next(ctx, request)
+		}
+	}
+}
+
+// RequireScope returns a middleware that only lets principals through if
+// they hold scope or are admins. Anonymous callers are left to the
+// endpoint. It relies on Authenticate having run first.
+func RequireScope(scope string) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			if p, ok := PrincipalFrom(ctx); ok && !p.HasScope(scope) && !p.HasRole(RoleAdmin) {
+				return nil, ErrForbidden
+			}
+			return next(ctx, request)
+		}
+	}
+}
+
+// RequireUser returns a middleware that only lets principals limited to a
+// user through for requests about that user, as userOf names it. userOf
+// returns "" for requests about no single user, which such principals may
+// not make. It relies on Authenticate having run first.
+func RequireUser(userOf func(request interface{}) string) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			if p, ok := PrincipalFrom(ctx); ok && p.User != "" && p.User != userOf(request) {
+				return nil, ErrForbidden
+			}
+			return next(ctx, request)
+		}
+	}
+}
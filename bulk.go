@@ -0,0 +1,675 @@
+package user
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"reflect"
+	"strings"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/user/dbOperations"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The formats users are imported and exported in.
+const (
+	// FormatCSV has one row per address, repeating the user's fields;
+	// consecutive rows of the same username are one user.
+	FormatCSV = "csv"
+	// FormatNDJSON has one BulkUser per line.
+	FormatNDJSON = "ndjson"
+)
+
+var bulkContentTypes = map[string]string{
+	FormatCSV:    "text/csv",
+	FormatNDJSON: "application/x-ndjson",
+}
+
+// BulkContentType returns the media type of format.
+func BulkContentType(format string) string {
+	return bulkContentTypes[format]
+}
+
+const (
+	// importBatch is how many users an import writes at once, and how
+	// often it reports a checkpoint.
+	importBatch = 500
+	// maxReportedErrors caps the errors an ImportReport lists; all of them
+	// are counted.
+	maxReportedErrors = 1000
+)
+
+// bulkColumns are the fields of a CSV import or export, in the order an
+// export writes them.
+var bulkColumns = []string{
+	"id", "username", "email", "firstName", "lastName", "phone",
+	"password", "passwordHash", "passwordSalt", "passwordScheme",
+	"street", "number", "city", "postcode", "country", "extraInfo",
+	"label", "types", "default",
+}
+
+// passwordHashSizes are the lengths of the hex hashes of each scheme.
+var passwordHashSizes = map[string]int{
+	PasswordSHA256: 64,
+	PasswordSHA1:   40,
+	PasswordMD5:    32,
+}
+
+// BulkUser is a user with its addresses, as imported and exported. A user
+// is imported with either a plain Password or a PasswordHash, in
+// PasswordScheme, sha256 if empty, with its PasswordSalt. The ids are
+// only exported.
+type BulkUser struct {
+	ID             string        `json:"id,omitempty"`
+	Username       string        `json:"username"`
+	Email          string        `json:"email,omitempty"`
+	FirstName      string        `json:"firstName,omitempty"`
+	LastName       string        `json:"lastName,omitempty"`
+	Phone          string        `json:"phone,omitempty"`
+	Password       string        `json:"password,omitempty"`
+	PasswordHash   string        `json:"passwordHash,omitempty"`
+	PasswordSalt   string        `json:"passwordSalt,omitempty"`
+	PasswordScheme string        `json:"passwordScheme,omitempty"`
+	Addresses      []BulkAddress `json:"addresses,omitempty"`
+}
+
+// BulkAddress is an address of a BulkUser. Default lists the types the
+// address is the user's default for; in CSV, it and Types are comma
+// separated in their cell.
+type BulkAddress struct {
+	ID        string   `json:"id,omitempty"`
+	Street    string   `json:"street,omitempty"`
+	Number    string   `json:"number,omitempty"`
+	City      string   `json:"city,omitempty"`
+	PostCode  string   `json:"postcode,omitempty"`
+	Country   string   `json:"country,omitempty"`
+	ExtraInfo string   `json:"extraInfo,omitempty"`
+	Label     string   `json:"label,omitempty"`
+	Types     []string `json:"types,omitempty"`
+	Default   []string `json:"default,omitempty"`
+}
+
+// user validates b and returns the user to store.
+func (b BulkUser) user() (dbOperations.User, error) {
+	u := dbOperations.User{
+		Username:  strings.TrimSpace(b.Username),
+		Email:     strings.TrimSpace(b.Email),
+		FirstName: b.FirstName,
+		LastName:  b.LastName,
+		Phone:     b.Phone,
+		Addresses: make([]dbOperations.Address, 0, len(b.Addresses)),
+	}
+	if u.Username == "" {
+		return u, errors.New("username is required")
+	}
+	if u.Email != "" {
+		if a, err := mail.ParseAddress(u.Email); err != nil || a.Address != u.Email {
+			return u, fmt.Errorf("email %q is invalid", u.Email)
+		}
+	}
+	switch {
+	case b.Password != "" && b.PasswordHash != "":
+		return u, errors.New("password and passwordHash cannot both be given")
+	case b.Password != "":
+		SetPassword(&u, b.Password)
+	case b.PasswordHash != "":
+		scheme := b.PasswordScheme
+		if scheme == "" {
+			scheme = PasswordSHA256
+		}
+		size, ok := passwordHashSizes[scheme]
+		if !ok {
+			return u, fmt.Errorf("password scheme %q is not supported", scheme)
+		}
+		if _, err := hex.DecodeString(b.PasswordHash); err != nil || len(b.PasswordHash) != size {
+			return u, fmt.Errorf("passwordHash is not a hex %s hash", scheme)
+		}
+		if scheme == PasswordSHA256 && b.PasswordSalt == "" {
+			return u, errors.New("passwordSalt is required for sha256")
+		}
+		u.Password, u.Salt = strings.ToLower(b.PasswordHash), b.PasswordSalt
+		if scheme != PasswordSHA256 {
+			u.PasswordScheme = scheme
+		}
+	default:
+		// Users imported without a password cannot log in with one.
+		random, err := randomToken()
+		if err != nil {
+			return u, err
+		}
+		SetPassword(&u, random)
+	}
+	defaults := map[string]*string{
+		dbOperations.AddressShipping: &u.DefaultShipping,
+		dbOperations.AddressBilling:  &u.DefaultBilling,
+	}
+	for i, a := range b.Addresses {
+		addr := dbOperations.Address{
+			Street:    a.Street,
+			Number:    a.Number,
+			City:      a.City,
+			PostCode:  a.PostCode,
+			Country:   a.Country,
+			ExtraInfo: a.ExtraInfo,
+			Label:     a.Label,
+			Types:     a.Types,
+		}
+		if !validAddress(&addr) {
+			return u, fmt.Errorf("address %d has an invalid label or types", i+1)
+		}
+		for _, typ := range a.Default {
+			current, ok := defaults[typ]
+			switch {
+			case !ok:
+				return u, fmt.Errorf("address %d is the default for unknown type %q", i+1, typ)
+			case *current != "":
+				return u, fmt.Errorf("address %d is a second default %s address", i+1, typ)
+			case !addr.Serves(typ):
+				return u, fmt.Errorf("address %d is the default %s address but not used for %s", i+1, typ, typ)
+			}
+			// The address is given its id now for the user to name it.
+			if addr.ID == "" {
+				addr.ID = bson.NewObjectId().Hex()
+			}
+			*current = addr.ID
+		}
+		u.Addresses = append(u.Addresses, addr)
+	}
+	return u, nil
+}
+
+// bulkUserFrom returns u as exported, with its password hash if passwords
+// is set.
+func bulkUserFrom(u dbOperations.User, passwords bool) BulkUser {
+	b := BulkUser{
+		ID:        u.UserID,
+		Username:  u.Username,
+		Email:     u.Email,
+		FirstName: u.FirstName,
+		LastName:  u.LastName,
+		Phone:     u.Phone,
+	}
+	if passwords {
+		b.PasswordHash, b.PasswordSalt, b.PasswordScheme = u.Password, u.Salt, u.PasswordScheme
+		if b.PasswordScheme == "" {
+			b.PasswordScheme = PasswordSHA256
+		}
+	}
+	for _, a := range u.Addresses {
+		ba := BulkAddress{
+			ID:        a.ID,
+			Street:    a.Street,
+			Number:    a.Number,
+			City:      a.City,
+			PostCode:  a.PostCode,
+			Country:   a.Country,
+			ExtraInfo: a.ExtraInfo,
+			Label:     a.Label,
+			Types:     a.Types,
+		}
+		if a.ID != "" && a.ID == u.DefaultShipping {
+			ba.Default = append(ba.Default, dbOperations.AddressShipping)
+		}
+		if a.ID != "" && a.ID == u.DefaultBilling {
+			ba.Default = append(ba.Default, dbOperations.AddressBilling)
+		}
+		b.Addresses = append(b.Addresses, ba)
+	}
+	return b
+}
+
+// ImportError is a user that was not imported, and why. Record is its
+// position in the import, counting from 1.
+type ImportError struct {
+	Record   int    `json:"record"`
+	Username string `json:"username,omitempty"`
+	Reason   string `json:"error"`
+}
+
+func (e ImportError) Error() string {
+	if e.Username == "" {
+		return fmt.Sprintf("record %d: %s", e.Record, e.Reason)
+	}
+	return fmt.Sprintf("record %d (%s): %s", e.Record, e.Username, e.Reason)
+}
+
+// BulkReader reads the users of an import one by one. Next returns io.EOF
+// after the last user, and an ImportError for a user it cannot read, after
+// which it goes on with the next one.
+type BulkReader interface {
+	Next() (BulkUser, error)
+}
+
+// NewBulkReader returns a reader of users in format. A CSV import starts
+// with a header naming its columns; columns maps the names of a header to
+// the BulkUser fields, as in "E-Mail=email", and columns named after a
+// field need no mapping. Other columns are ignored.
+func NewBulkReader(r io.Reader, format string, columns map[string]string) (BulkReader, error) {
+	switch format {
+	case FormatCSV:
+		return newCSVReader(r, columns)
+	case FormatNDJSON:
+		return &ndjsonReader{r: bufio.NewReader(r)}, nil
+	}
+	return nil, fmt.Errorf("format %q is not supported", format)
+}
+
+// ParseColumns reads a column mapping such as "E-Mail=email,Vorname=firstName".
+func ParseColumns(s string) (map[string]string, error) {
+	columns := map[string]string{}
+	if s == "" {
+		return columns, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		i := strings.LastIndex(pair, "=")
+		if i < 1 || !contains(bulkColumns, pair[i+1:]) {
+			return nil, fmt.Errorf("column mapping %q is not <column>=<field> with a known field", pair)
+		}
+		columns[pair[:i]] = pair[i+1:]
+	}
+	return columns, nil
+}
+
+type ndjsonReader struct {
+	r *bufio.Reader
+}
+
+func (n *ndjsonReader) Next() (BulkUser, error) {
+	for {
+		line, err := n.r.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) == 0 {
+			if err != nil {
+				return BulkUser{}, err
+			}
+			continue
+		}
+		if err != nil && err != io.EOF {
+			return BulkUser{}, err
+		}
+		var b BulkUser
+		if err := json.Unmarshal(line, &b); err != nil {
+			return BulkUser{}, ImportError{Reason: "invalid JSON: " + err.Error()}
+		}
+		return b, nil
+	}
+}
+
+type csvReader struct {
+	r *csv.Reader
+	// fields are the BulkUser fields of the columns, empty for those that
+	// are ignored.
+	fields []string
+	// next is the row read ahead to tell where a user ends.
+	next    []string
+	nextErr error
+}
+
+func newCSVReader(r io.Reader, columns map[string]string) (*csvReader, error) {
+	c := &csvReader{r: csv.NewReader(r)}
+	header, err := c.r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading the CSV header: %v", err)
+	}
+	for _, name := range header {
+		field, ok := columns[name]
+		if !ok && contains(bulkColumns, name) {
+			field = name
+		}
+		c.fields = append(c.fields, field)
+	}
+	if !contains(c.fields, "username") {
+		return nil, errors.New("the CSV has no username column")
+	}
+	return c, nil
+}
+
+func (c *csvReader) Next() (BulkUser, error) {
+	row, err := c.next, c.nextErr
+	c.next, c.nextErr = nil, nil
+	if row == nil && err == nil {
+		row, err = c.read()
+	}
+	if err != nil {
+		return BulkUser{}, err
+	}
+	b := c.user(row)
+	for {
+		row, err := c.read()
+		if err != nil {
+			if err != io.EOF {
+				c.nextErr = err
+			}
+			return b, nil
+		}
+		next := c.user(row)
+		if next.Username != b.Username {
+			c.next = row
+			return b, nil
+		}
+		b.Addresses = append(b.Addresses, next.Addresses...)
+	}
+}
+
+// read returns the next row, or an ImportError for a malformed one.
+func (c *csvReader) read() ([]string, error) {
+	row, err := c.r.Read()
+	if perr, ok := err.(*csv.ParseError); ok {
+		return nil, ImportError{Reason: perr.Error()}
+	}
+	return row, err
+}
+
+// user returns the user of row, with the address of row if it has one.
+func (c *csvReader) user(row []string) BulkUser {
+	var b BulkUser
+	var a BulkAddress
+	var types, defaults string
+	fields := map[string]*string{
+		"username": &b.Username, "email": &b.Email, "firstName": &b.FirstName,
+		"lastName": &b.LastName, "phone": &b.Phone, "password": &b.Password,
+		"passwordHash": &b.PasswordHash, "passwordSalt": &b.PasswordSalt,
+		"passwordScheme": &b.PasswordScheme, "street": &a.Street, "number": &a.Number,
+		"city": &a.City, "postcode": &a.PostCode, "country": &a.Country, "extraInfo": &a.ExtraInfo,
+		"label": &a.Label, "types": &types, "default": &defaults,
+	}
+	for i, value := range row {
+		if p, ok := fields[c.fields[i]]; ok {
+			*p = value
+		}
+	}
+	a.Types, a.Default = splitCell(types), splitCell(defaults)
+	if !reflect.DeepEqual(a, BulkAddress{}) {
+		b.Addresses = []BulkAddress{a}
+	}
+	return b
+}
+
+// splitCell returns the comma separated values of a CSV cell, or nil if it
+// is empty.
+func splitCell(cell string) []string {
+	var values []string
+	for _, v := range strings.Split(cell, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// BulkWriter writes the users of an export one by one.
+type BulkWriter interface {
+	Write(b BulkUser) error
+	// Flush writes out what is buffered.
+	Flush() error
+}
+
+// NewBulkWriter returns a writer of users in format.
+func NewBulkWriter(w io.Writer, format string) (BulkWriter, error) {
+	switch format {
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		return &csvWriter{w: cw}, cw.Write(bulkColumns)
+	case FormatNDJSON:
+		return ndjsonWriter{json.NewEncoder(w)}, nil
+	}
+	return nil, fmt.Errorf("format %q is not supported", format)
+}
+
+type ndjsonWriter struct {
+	enc *json.Encoder
+}
+
+func (n ndjsonWriter) Write(b BulkUser) error { return n.enc.Encode(b) }
+func (n ndjsonWriter) Flush() error           { return nil }
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func (c *csvWriter) Write(b BulkUser) error {
+	addrs := b.Addresses
+	if len(addrs) == 0 {
+		addrs = []BulkAddress{{}}
+	}
+	for _, a := range addrs {
+		err := c.w.Write([]string{
+			b.ID, b.Username, b.Email, b.FirstName, b.LastName, b.Phone,
+			b.Password, b.PasswordHash, b.PasswordSalt, b.PasswordScheme,
+			a.Street, a.Number, a.City, a.PostCode, a.Country, a.ExtraInfo,
+			a.Label, strings.Join(a.Types, ","), strings.Join(a.Default, ","),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *csvWriter) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// BulkStore imports and exports users in bulk. *dbOperations.Mongo
+// implements it.
+type BulkStore interface {
+	ImportUsers(users []dbOperations.User) ([]error, error)
+	UsernamesTaken(names []string) (map[string]bool, error)
+	ExportUsers(fn func(dbOperations.User) error) error
+}
+
+// ImportOptions tune an import.
+type ImportOptions struct {
+	// DryRun validates the users, and checks their usernames are free,
+	// without importing them.
+	DryRun bool
+	// Skip is how many users to pass over, to resume an import from a
+	// checkpoint.
+	Skip int
+	// OnError, if set, is called with every user that is not imported.
+	OnError func(ImportError)
+	// OnCheckpoint, if set, is called after every batch with the number of
+	// users done. Resuming with that as Skip goes on after the batch.
+	OnCheckpoint func(checkpoint int)
+}
+
+// ImportReport is the outcome of an import. Errors lists the first users
+// that were not imported.
+type ImportReport struct {
+	DryRun     bool          `json:"dryRun"`
+	Skipped    int           `json:"skipped"`
+	Imported   int           `json:"imported"`
+	Failed     int           `json:"failed"`
+	Checkpoint int           `json:"checkpoint"`
+	Errors     []ImportError `json:"errors"`
+}
+
+// ImportUsers reads users from r and imports them into st in batches,
+// carrying on past users that are invalid or whose username is taken.
+// Imports emit no domain events, so a migration does not flood the
+// webhook subscribers.
+func ImportUsers(st BulkStore, r BulkReader, opt ImportOptions) (ImportReport, error) {
+	report := ImportReport{DryRun: opt.DryRun, Errors: make([]ImportError, 0)}
+	fail := func(e ImportError) {
+		report.Failed++
+		if len(report.Errors) < maxReportedErrors {
+			report.Errors = append(report.Errors, e)
+		}
+		if opt.OnError != nil {
+			opt.OnError(e)
+		}
+	}
+	seen := map[string]bool{}
+	var batch []dbOperations.User
+	var records []int
+	flush := func() error {
+		if len(batch) > 0 {
+			errs, err := importBatchTo(st, batch, opt.DryRun)
+			if err != nil {
+				return err
+			}
+			for i, err := range errs {
+				if err != nil {
+					fail(ImportError{Record: records[i], Username: batch[i].Username, Reason: err.Error()})
+				} else {
+					report.Imported++
+				}
+			}
+			batch, records = batch[:0], records[:0]
+		}
+		report.Checkpoint = report.Skipped + report.Imported + report.Failed
+		if opt.OnCheckpoint != nil {
+			opt.OnCheckpoint(report.Checkpoint)
+		}
+		return nil
+	}
+	for record := 1; ; record++ {
+		b, err := r.Next()
+		ierr, invalid := err.(ImportError)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && !invalid {
+			return report, err
+		}
+		if record <= opt.Skip {
+			report.Skipped++
+			continue
+		}
+		if invalid {
+			ierr.Record = record
+			fail(ierr)
+			continue
+		}
+		u, err := b.user()
+		if err == nil && seen[u.Username] {
+			err = errors.New("username appears more than once")
+		}
+		if err != nil {
+			fail(ImportError{Record: record, Username: b.Username, Reason: err.Error()})
+			continue
+		}
+		seen[u.Username] = true
+		batch, records = append(batch, u), append(records, record)
+		if len(batch) == importBatch {
+			if err := flush(); err != nil {
+				return report, err
+			}
+		}
+	}
+	return report, flush()
+}
+
+// importBatchTo imports batch into st, or only checks its usernames are
+// free on a dry run, and returns the error of each user.
+func importBatchTo(st BulkStore, batch []dbOperations.User, dryRun bool) ([]error, error) {
+	if !dryRun {
+		errs, err := st.ImportUsers(batch)
+		for i, err := range errs {
+			if mgo.IsDup(err) {
+				errs[i] = errUsernameTaken
+			}
+		}
+		return errs, err
+	}
+	names := make([]string, len(batch))
+	for i, u := range batch {
+		names[i] = u.Username
+	}
+	taken, err := st.UsernamesTaken(names)
+	if err != nil {
+		return nil, err
+	}
+	errs := make([]error, len(batch))
+	for i, u := range batch {
+		if taken[u.Username] {
+			errs[i] = errUsernameTaken
+		}
+	}
+	return errs, nil
+}
+
+var errUsernameTaken = errors.New("username is taken")
+
+// ExportUsers writes every user of st with their addresses to w, and
+// returns how many it wrote. Password hashes are only written if
+// passwords is set, to move users to another instance of the service.
+func ExportUsers(st BulkStore, w BulkWriter, passwords bool) (int, error) {
+	n := 0
+	err := st.ExportUsers(func(u dbOperations.User) error {
+		n++
+		return w.Write(bulkUserFrom(u, passwords))
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, w.Flush()
+}
+
+// BulkEndpoints mounts the admin-only endpoints importing and exporting
+// users in bulk.
+func BulkEndpoints(e Endpoints, st BulkStore) Endpoints {
+	admin := RequireRole(RoleAdmin)
+	e.BulkImportEndpoint = admin(MakeBulkImportEndpoint(st))
+	e.BulkExportEndpoint = admin(MakeBulkExportEndpoint(st))
+	return e
+}
+
+// MakeBulkImportEndpoint returns an endpoint importing the users in the
+// body of the request.
+func MakeBulkImportEndpoint(st BulkStore) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(bulkImportRequest)
+		r, err := NewBulkReader(req.Body, req.Format, req.Columns)
+		if err != nil {
+			return nil, ErrInvalidRequest
+		}
+		return ImportUsers(st, r, ImportOptions{DryRun: req.DryRun, Skip: req.Skip})
+	}
+}
+
+// MakeBulkExportEndpoint returns an endpoint exporting every user. The
+// users are written as the response is, so an export of any size is not
+// held in memory.
+func MakeBulkExportEndpoint(st BulkStore) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(bulkExportRequest)
+		if _, ok := bulkContentTypes[req.Format]; !ok {
+			return nil, ErrInvalidRequest
+		}
+		return bulkExportResponse{Format: req.Format, write: func(w io.Writer) error {
+			bw, err := NewBulkWriter(w, req.Format)
+			if err == nil {
+				_, err = ExportUsers(st, bw, req.Passwords)
+			}
+			return err
+		}}, nil
+	}
+}
+
+type bulkImportRequest struct {
+	Format  string
+	Columns map[string]string
+	DryRun  bool
+	Skip    int
+	Body    io.Reader
+}
+
+type bulkExportRequest struct {
+	Format    string
+	Passwords bool
+}
+
+type bulkExportResponse struct {
+	Format string
+	write  func(w io.Writer) error
+}
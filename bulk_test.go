@@ -0,0 +1,223 @@
+package user
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/user/dbOperations"
+)
+
+func (s *stubService) ImportUsers(users []dbOperations.User) ([]error, error) {
+	errs := make([]error, len(users))
+	for i, u := range users {
+		if _, err := s.PostUser(dbOperations.User{Username: u.Username}); err != nil {
+			errs[i] = err
+			continue
+		}
+		delete(s.users, "57a98d98e4b00679b4a830b1")
+		u.UserID = fmt.Sprintf("57a98d98e4b00679b4a8%04x", 0x4000+len(s.users))
+		for j := range u.Addresses {
+			u.Addresses[j].ID = fmt.Sprintf("57a98d98e4b00679b4a8%04x", 0x8000+len(s.addresses))
+			s.addresses[u.Addresses[j].ID] = u.Addresses[j]
+		}
+		s.users[u.UserID] = u
+		users[i] = u
+	}
+	return errs, nil
+}
+
+func (s *stubService) UsernamesTaken(names []string) (map[string]bool, error) {
+	taken := map[string]bool{}
+	for _, u := range s.users {
+		if contains(names, u.Username) {
+			taken[u.Username] = true
+		}
+	}
+	return taken, nil
+}
+
+func (s *stubService) ExportUsers(fn func(dbOperations.User) error) error {
+	users, _ := s.GetUsers()
+	sort.Slice(users, func(i, j int) bool { return users[i].UserID < users[j].UserID })
+	for _, u := range users {
+		if err := fn(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestImportCSV(t *testing.T) {
+	svc := newStubService()
+	data := "Login,E-Mail,street,city,passwordHash,passwordScheme,Notes\n" +
+		"alice,alice@example.com,Main St,Bern," + md5Hex("wonderland") + ",md5,vip\n" +
+		"alice,alice@example.com,Side St,Basel," + md5Hex("wonderland") + ",md5,vip\n" +
+		"eve,eve@example.com,,,,,\n" +
+		"bob,not an address,,,,,\n" +
+		"carol,,,,abc,md5,\n" +
+		"dave,,,\n" +
+		"erin,,,,,,\n"
+	columns, err := ParseColumns("Login=username,E-Mail=email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewBulkReader(strings.NewReader(data), FormatCSV, columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reported []ImportError
+	report, err := ImportUsers(svc, r, ImportOptions{OnError: func(e ImportError) { reported = append(reported, e) }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Imported != 2 || report.Failed != 4 || report.Checkpoint != 6 || len(report.Errors) != 4 || len(reported) != 4 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	for _, want := range []struct {
+		record   int
+		username string
+		reason   string
+	}{
+		{3, "bob", "email"},
+		{5, "", "wrong number of fields"},
+		{2, "eve", "username is taken"},
+		{4, "carol", "not a hex md5 hash"},
+	} {
+		found := false
+		for _, e := range report.Errors {
+			if e.Record == want.record && e.Username == want.username && strings.Contains(e.Reason, want.reason) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("expected record %d to fail with %q, got %+v", want.record, want.reason, report.Errors)
+		}
+	}
+
+	var alice dbOperations.User
+	for _, u := range svc.users {
+		if u.Username == "alice" {
+			alice = u
+		}
+	}
+	if alice.Email != "alice@example.com" || len(alice.Addresses) != 2 || alice.Addresses[1].City != "Basel" {
+		t.Errorf("unexpected imported user %+v", alice)
+	}
+	if alice.PasswordScheme != PasswordMD5 || !checkPassword(alice, "wonderland") || checkPassword(alice, "looking-glass") {
+		t.Errorf("expected the legacy hash to be kept, got %+v", alice)
+	}
+}
+
+func TestImportDryRunAndResume(t *testing.T) {
+	data := `{"username": "alice", "password": "wonderland"}
+{"username": "eve"}
+not json
+
+{"username": "bob", "addresses": [{"city": "Bern"}]}
+`
+	svc := newStubService()
+	r, _ := NewBulkReader(strings.NewReader(data), FormatNDJSON, nil)
+	report, err := ImportUsers(svc, r, ImportOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.DryRun || report.Imported != 2 || report.Failed != 2 || len(svc.users) != 1 {
+		t.Errorf("expected a dry run to only report, got %+v with %d users", report, len(svc.users))
+	}
+
+	var checkpoints []int
+	r, _ = NewBulkReader(strings.NewReader(data), FormatNDJSON, nil)
+	report, err = ImportUsers(svc, r, ImportOptions{Skip: 3, OnCheckpoint: func(n int) { checkpoints = append(checkpoints, n) }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Skipped != 3 || report.Imported != 1 || report.Failed != 0 || len(svc.users) != 2 {
+		t.Errorf("expected the import to resume at bob, got %+v", report)
+	}
+	if len(checkpoints) != 1 || checkpoints[0] != 4 {
+		t.Errorf("unexpected checkpoints %v", checkpoints)
+	}
+}
+
+func TestBulkEndpoints(t *testing.T) {
+	e, _ := newTestEndpoints(newStubService())
+	router := MakeHTTPHandler(context.Background(), e, log.NewNopLogger())
+	do := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	r := httptest.NewRequest("POST", "/bulk/customers?columns=Login%3Dusername", strings.NewReader("Login,city\nalice,Bern\nalice,Basel\nbob,\n"))
+	r.Header.Set("Content-Type", "text/csv; charset=utf-8")
+	if w := do(r); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected anonymous imports to be refused, got %d", w.Code)
+	}
+	r = httptest.NewRequest("POST", "/bulk/customers?columns=Login%3Dusername", strings.NewReader("Login,city\nalice,Bern\nalice,Basel\nbob,\n"))
+	r.Header.Set("Authorization", "Bearer "+testAdminToken)
+	r.Header.Set("Content-Type", "text/csv")
+	w := do(r)
+	var report ImportReport
+	json.NewDecoder(w.Body).Decode(&report)
+	if w.Code != http.StatusOK || report.Imported != 2 || report.Failed != 0 {
+		t.Fatalf("expected two users to be imported, got %d: %+v", w.Code, report)
+	}
+
+	w = do(adminRequest("GET", "/bulk/customers?format=csv"))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/csv" {
+		t.Fatalf("unexpected export %d: %v", w.Code, w.Header())
+	}
+	export := w.Body.String()
+	if !strings.HasPrefix(export, "id,username,") || strings.Count(export, ",alice,") != 2 || strings.Contains(export, PasswordSHA256) {
+		t.Errorf("unexpected export %s", export)
+	}
+
+	// An export with passwords imports into another instance.
+	w = do(adminRequest("GET", "/bulk/customers?passwords=true"))
+	if w.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("expected NDJSON by default, got %v", w.Header())
+	}
+	other := newStubService()
+	delete(other.users, testUserID)
+	reader, _ := NewBulkReader(w.Body, FormatNDJSON, nil)
+	report, err := ImportUsers(other, reader, ImportOptions{})
+	if err != nil || report.Failed != 1 || report.Imported != 2 {
+		t.Fatalf("expected all but eve, whose stub password is no hash, to be imported, got %+v: %v", report, err)
+	}
+	for _, u := range other.users {
+		if u.Username == "alice" && len(u.Addresses) != 2 {
+			t.Errorf("expected alice's addresses to move along, got %+v", u)
+		}
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	u := dbOperations.User{}
+	SetPassword(&u, "secret")
+	if !checkPassword(u, "secret") || checkPassword(u, "guess") {
+		t.Error("expected the service's own scheme to be checked")
+	}
+	if checkPassword(dbOperations.User{Password: "a3d2d8d3f4e3ab4d2d9ab0ed07b8e2efa68cd9ab", PasswordScheme: PasswordSHA1}, "secret") {
+		t.Error("expected a wrong sha1 hash to be refused")
+	}
+	if checkPassword(dbOperations.User{Password: md5Hex("secret"), PasswordScheme: "crypt"}, "secret") {
+		t.Error("expected unknown schemes to be refused")
+	}
+	if _, err := (BulkUser{Username: "x", PasswordHash: md5Hex("secret")}).user(); err == nil {
+		t.Error("expected an md5 hash to be refused as sha256")
+	}
+}
@@ -0,0 +1,379 @@
+package user
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/gob"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/user/dbOperations"
+	mgo "gopkg.in/mgo.v2"
+)
+
+// CacheBackend holds encoded values for a time. A backend shared by the
+// instances of the service, such as Redis or memcached, can stand in for
+// the in-process LRUCache; it sees users with their password hashes and
+// decrypted fields, so it must be trusted like the database.
+type CacheBackend interface {
+	// Get returns the value of key, and false if it is missing or expired.
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte, ttl time.Duration)
+	Delete(keys ...string)
+}
+
+// LRUCache is an in-process CacheBackend holding up to size values,
+// dropping the least recently used ones first. A size of 0 holds nothing.
+type LRUCache struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List
+	items map[string]*list.Element
+	now   func() time.Time
+}
+
+type lruEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// NewLRUCache returns an empty LRUCache of size values.
+func NewLRUCache(size int) *LRUCache {
+	return &LRUCache{size: size, order: list.New(), items: map[string]*list.Element{}, now: time.Now}
+}
+
+func (c *LRUCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*lruEntry)
+	if !c.now().Before(e.expires) {
+		c.order.Remove(el)
+		delete(c.items, key)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return e.value, true
+}
+
+func (c *LRUCache) Set(key string, value []byte, ttl time.Duration) {
+	if c.size <= 0 || ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := &lruEntry{key: key, value: value, expires: c.now().Add(ttl)}
+	if el, ok := c.items[key]; ok {
+		el.Value = e
+		c.order.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.order.PushFront(e)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry).key)
+	}
+}
+
+func (c *LRUCache) Delete(keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		if el, ok := c.items[key]; ok {
+			c.order.Remove(el)
+			delete(c.items, key)
+		}
+	}
+}
+
+// Len returns how many values c holds, expired ones included.
+func (c *LRUCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// PrefixCache returns a CacheBackend keeping its values in b under keys
+// starting with prefix, so that the stores of several tenants can share
+// one backend without seeing each other's entries.
+func PrefixCache(b CacheBackend, prefix string) CacheBackend {
+	return prefixCache{b: b, prefix: prefix}
+}
+
+type prefixCache struct {
+	b      CacheBackend
+	prefix string
+}
+
+func (c prefixCache) Get(key string) ([]byte, bool) {
+	return c.b.Get(c.prefix + key)
+}
+
+func (c prefixCache) Set(key string, value []byte, ttl time.Duration) {
+	c.b.Set(c.prefix+key, value, ttl)
+}
+
+func (c prefixCache) Delete(keys ...string) {
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = c.prefix + key
+	}
+	c.b.Delete(prefixed...)
+}
+
+// CacheableStore is the database CachedStore reads through: the store of
+// the service and the stores of the other endpoints writing users and
+// addresses.
+type CacheableStore interface {
+	UserStore
+	SCIMStore
+	DeletedStore
+	DataSubjectStore
+	BulkStore
+	DefaultsStore
+	PhoneStore
+	PreferencesStore
+	PolicyStore
+}
+
+// CacheStats counts the reads of a CachedStore, and the entries it
+// dropped because of writes.
+type CacheStats struct {
+	Hits          int64 `json:"hits"`
+	Misses        int64 `json:"misses"`
+	Invalidations int64 `json:"invalidations"`
+}
+
+// CachedStore reads users and addresses by id through a cache, and drops
+// what every write through it changes. Users and addresses that are not
+// found are cached too, for a shorter time. Writes that bypass it, such as
+// userctl's, show once the entries expire. Users by name, which is how
+// they log in, are always read from the database, so that a password reset
+// or deletion made elsewhere holds at once.
+type CachedStore struct {
+	CacheableStore
+	stats CacheStats
+	// epoch grows with every invalidation, so that a value read before
+	// one is not cached after it.
+	epoch       uint64
+	cache       CacheBackend
+	ttl         time.Duration
+	negativeTTL time.Duration
+}
+
+// NewCachedStore caches what is read from st in cache, for ttl, or for
+// negativeTTL if it is not found.
+func NewCachedStore(st CacheableStore, cache CacheBackend, ttl, negativeTTL time.Duration) *CachedStore {
+	return &CachedStore{CacheableStore: st, cache: cache, ttl: ttl, negativeTTL: negativeTTL}
+}
+
+// Stats returns the counts so far.
+func (c *CachedStore) Stats() CacheStats {
+	return CacheStats{
+		Hits:          atomic.LoadInt64(&c.stats.Hits),
+		Misses:        atomic.LoadInt64(&c.stats.Misses),
+		Invalidations: atomic.LoadInt64(&c.stats.Invalidations),
+	}
+}
+
+func userKey(id string) string    { return "user:" + id }
+func addressKey(id string) string { return "address:" + id }
+
+// get decodes the value of key into v. Values that were not found are
+// cached as empty and returned as mgo.ErrNotFound.
+func (c *CachedStore) get(key string, v interface{}) (bool, error) {
+	b, ok := c.cache.Get(key)
+	if ok && len(b) == 0 {
+		atomic.AddInt64(&c.stats.Hits, 1)
+		return true, mgo.ErrNotFound
+	}
+	if ok && gob.NewDecoder(bytes.NewReader(b)).Decode(v) == nil {
+		atomic.AddInt64(&c.stats.Hits, 1)
+		return true, nil
+	}
+	atomic.AddInt64(&c.stats.Misses, 1)
+	return false, nil
+}
+
+// put caches v, or that it was not found if err says so, unless an
+// invalidation happened since epoch.
+func (c *CachedStore) put(key string, v interface{}, err error, epoch uint64) {
+	var b []byte
+	ttl := c.ttl
+	switch err {
+	case nil:
+		var buf bytes.Buffer
+		if gob.NewEncoder(&buf).Encode(v) != nil {
+			return
+		}
+		b = buf.Bytes()
+	case mgo.ErrNotFound:
+		b, ttl = []byte{}, c.negativeTTL
+	default:
+		return
+	}
+	if atomic.LoadUint64(&c.epoch) == epoch {
+		c.cache.Set(key, b, ttl)
+	}
+}
+
+// read decodes key into v, or on a miss calls load to fill v and caches
+// the outcome.
+func (c *CachedStore) read(key string, v interface{}, load func() error) error {
+	if hit, err := c.get(key, v); hit {
+		return err
+	}
+	epoch := atomic.LoadUint64(&c.epoch)
+	err := load()
+	c.put(key, v, err, epoch)
+	return err
+}
+
+// invalidate drops keys, and keeps reads in flight from caching what they
+// found before.
+func (c *CachedStore) invalidate(keys ...string) {
+	atomic.AddUint64(&c.epoch, 1)
+	atomic.AddInt64(&c.stats.Invalidations, int64(len(keys)))
+	c.cache.Delete(keys...)
+}
+
+// invalidateRecord drops the user id and all its addresses, deleted or
+// not.
+func (c *CachedStore) invalidateRecord(id string, u dbOperations.User) {
+	keys := []string{userKey(id)}
+	for _, a := range u.Addresses {
+		keys = append(keys, addressKey(a.ID))
+	}
+	c.invalidate(keys...)
+}
+
+func (c *CachedStore) GetUser(id string) (dbOperations.User, error) {
+	var u dbOperations.User
+	err := c.read(userKey(id), &u, func() (err error) {
+		u, err = c.CacheableStore.GetUser(id)
+		return err
+	})
+	if u.Addresses == nil {
+		u.Addresses = make([]dbOperations.Address, 0)
+	}
+	return u, err
+}
+
+func (c *CachedStore) GetAddress(id string) (dbOperations.Address, error) {
+	var a dbOperations.Address
+	err := c.read(addressKey(id), &a, func() (err error) {
+		a, err = c.CacheableStore.GetAddress(id)
+		return err
+	})
+	return a, err
+}
+
+// PopulateAddressesForUser reads the addresses missing from the cache in
+// one go.
+func (c *CachedStore) PopulateAddressesForUser(u *dbOperations.User) error {
+	found := map[string]dbOperations.Address{}
+	var missing []dbOperations.Address
+	for _, a := range u.Addresses {
+		var cached dbOperations.Address
+		hit, err := c.get(addressKey(a.ID), &cached)
+		switch {
+		case !hit:
+			missing = append(missing, a)
+		case err == nil:
+			found[a.ID] = cached
+		}
+	}
+	if len(missing) > 0 {
+		epoch := atomic.LoadUint64(&c.epoch)
+		loaded := dbOperations.User{Addresses: missing}
+		if err := c.CacheableStore.PopulateAddressesForUser(&loaded); err != nil {
+			return err
+		}
+		for _, a := range loaded.Addresses {
+			found[a.ID] = a
+			c.put(addressKey(a.ID), a, nil, epoch)
+		}
+		for _, a := range missing {
+			if _, ok := found[a.ID]; !ok {
+				c.put(addressKey(a.ID), nil, mgo.ErrNotFound, epoch)
+			}
+		}
+	}
+	addrs := make([]dbOperations.Address, 0, len(found))
+	for _, a := range u.Addresses {
+		if f, ok := found[a.ID]; ok {
+			addrs = append(addrs, f)
+		}
+	}
+	u.Addresses = addrs
+	return nil
+}
+
+func (c *CachedStore) UpdateUser(u *dbOperations.User, version int64) error {
+	err := c.CacheableStore.UpdateUser(u, version)
+	c.invalidate(userKey(u.UserID))
+	return err
+}
+
+func (c *CachedStore) DeleteUser(id, by string, version int64) error {
+	u, _ := c.GetUser(id)
+	err := c.CacheableStore.DeleteUser(id, by, version)
+	c.invalidateRecord(id, u)
+	return err
+}
+
+func (c *CachedStore) CreateAddress(a *dbOperations.Address, userid string) error {
+	err := c.CacheableStore.CreateAddress(a, userid)
+	c.invalidate(userKey(userid))
+	return err
+}
+
+func (c *CachedStore) DeleteAddress(userid, addid, by string, version int64) error {
+	err := c.CacheableStore.DeleteAddress(userid, addid, by, version)
+	c.invalidate(userKey(userid), addressKey(addid))
+	return err
+}
+
+func (c *CachedStore) SetDefaultAddresses(userid, shipping, billing string, version int64) (int64, error) {
+	v, err := c.CacheableStore.SetDefaultAddresses(userid, shipping, billing, version)
+	c.invalidate(userKey(userid))
+	return v, err
+}
+
+func (c *CachedStore) UpdatePreferences(userid string, p dbOperations.Preferences, attributes map[string]interface{}, version int64) (int64, error) {
+	v, err := c.CacheableStore.UpdatePreferences(userid, p, attributes, version)
+	c.invalidate(userKey(userid))
+	return v, err
+}
+
+func (c *CachedStore) ConfirmPhone(userid, codeHash string) (int64, error) {
+	v, err := c.CacheableStore.ConfirmPhone(userid, codeHash)
+	c.invalidate(userKey(userid))
+	return v, err
+}
+
+func (c *CachedStore) RestoreUser(id string) error {
+	u, _ := c.CacheableStore.GetUserRecord(id)
+	err := c.CacheableStore.RestoreUser(id)
+	c.invalidateRecord(id, u)
+	return err
+}
+
+func (c *CachedStore) RestoreAddress(id string) (string, error) {
+	userid, err := c.CacheableStore.RestoreAddress(id)
+	c.invalidate(userKey(userid), addressKey(id))
+	return userid, err
+}
+
+func (c *CachedStore) EraseUser(e *dbOperations.Erasure) error {
+	u, _ := c.CacheableStore.GetUserRecord(e.UserID)
+	err := c.CacheableStore.EraseUser(e)
+	c.invalidateRecord(e.UserID, u)
+	return err
+}
@@ -0,0 +1,422 @@
+package user
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/user/dbOperations"
+	mgo "gopkg.in/mgo.v2"
+)
+
+// countingStore keeps users and addresses in memory the way Mongo does, and
+// counts the reads that reach it.
+type countingStore struct {
+	CacheableStore
+	users     map[string]dbOperations.User
+	addresses map[string]dbOperations.Address
+	owners    map[string]string
+	reads     map[string]int
+	events    []dbOperations.Event
+	next      int
+}
+
+func newCountingStore() *countingStore {
+	return &countingStore{
+		users:     map[string]dbOperations.User{},
+		addresses: map[string]dbOperations.Address{},
+		owners:    map[string]string{},
+		reads:     map[string]int{},
+	}
+}
+
+func (s *countingStore) id() string {
+	s.next++
+	return fmt.Sprintf("%024d", s.next)
+}
+
+func (s *countingStore) record(id string) (dbOperations.User, bool) {
+	u, ok := s.users[id]
+	if !ok {
+		return u, false
+	}
+	u.Addresses = make([]dbOperations.Address, 0)
+	for aid, owner := range s.owners {
+		if owner == id {
+			u.Addresses = append(u.Addresses, dbOperations.Address{ID: aid})
+		}
+	}
+	return u, true
+}
+
+func (s *countingStore) GetUser(id string) (dbOperations.User, error) {
+	s.reads["GetUser"]++
+	u, ok := s.record(id)
+	if !ok || u.DeletedAt != nil {
+		return dbOperations.User{}, mgo.ErrNotFound
+	}
+	return u, nil
+}
+
+func (s *countingStore) GetUserRecord(id string) (dbOperations.User, error) {
+	u, ok := s.record(id)
+	if !ok {
+		return u, mgo.ErrNotFound
+	}
+	return u, s.PopulateAddressesForUser(&u)
+}
+
+func (s *countingStore) GetUserWithName(name string) (dbOperations.User, error) {
+	s.reads["GetUserWithName"]++
+	for _, u := range s.users {
+		if u.Username == name && u.DeletedAt == nil {
+			u.Addresses = make([]dbOperations.Address, 0)
+			return u, nil
+		}
+	}
+	return dbOperations.User{}, mgo.ErrNotFound
+}
+
+func (s *countingStore) CreateUser(u *dbOperations.User) error {
+	for _, o := range s.users {
+		if o.Username == u.Username {
+			return fmt.Errorf("username %s taken", u.Username)
+		}
+	}
+	u.UserID = s.id()
+	s.users[u.UserID] = *u
+	return nil
+}
+
+func (s *countingStore) UpdateUser(u *dbOperations.User, version int64) error {
+	if _, ok := s.users[u.UserID]; !ok {
+		return mgo.ErrNotFound
+	}
+	s.users[u.UserID] = *u
+	return nil
+}
+
+func (s *countingStore) DeleteUser(id, by string, version int64) error {
+	u, ok := s.users[id]
+	if !ok {
+		return mgo.ErrNotFound
+	}
+	now := time.Now()
+	u.DeletedAt = &now
+	s.users[id] = u
+	return nil
+}
+
+func (s *countingStore) RestoreUser(id string) error {
+	u, ok := s.users[id]
+	if !ok {
+		return mgo.ErrNotFound
+	}
+	u.DeletedAt = nil
+	s.users[id] = u
+	return nil
+}
+
+func (s *countingStore) EraseUser(e *dbOperations.Erasure) error {
+	for aid, owner := range s.owners {
+		if owner == e.UserID {
+			delete(s.addresses, aid)
+			delete(s.owners, aid)
+		}
+	}
+	delete(s.users, e.UserID)
+	return nil
+}
+
+func (s *countingStore) ImportUsers(users []dbOperations.User) ([]error, error) {
+	errs := make([]error, len(users))
+	for i := range users {
+		errs[i] = s.CreateUser(&users[i])
+	}
+	return errs, nil
+}
+
+func (s *countingStore) PopulateAddressesForUser(u *dbOperations.User) error {
+	s.reads["PopulateAddressesForUser"]++
+	addrs := make([]dbOperations.Address, 0)
+	for _, a := range u.Addresses {
+		if full, ok := s.addresses[a.ID]; ok && full.DeletedAt == nil {
+			addrs = append(addrs, full)
+		}
+	}
+	u.Addresses = addrs
+	return nil
+}
+
+func (s *countingStore) CreateAddress(a *dbOperations.Address, userid string) error {
+	a.ID = s.id()
+	s.addresses[a.ID] = *a
+	s.owners[a.ID] = userid
+	return nil
+}
+
+func (s *countingStore) GetAddress(id string) (dbOperations.Address, error) {
+	s.reads["GetAddress"]++
+	a, ok := s.addresses[id]
+	if !ok || a.DeletedAt != nil {
+		return dbOperations.Address{}, mgo.ErrNotFound
+	}
+	return a, nil
+}
+
+func (s *countingStore) DeleteAddress(userid, addid, by string, version int64) error {
+	a, ok := s.addresses[addid]
+	if !ok || s.owners[addid] != userid {
+		return mgo.ErrNotFound
+	}
+	now := time.Now()
+	a.DeletedAt, a.DeletedFrom = &now, userid
+	s.addresses[addid] = a
+	delete(s.owners, addid)
+	return nil
+}
+
+func (s *countingStore) AppendEvent(e *dbOperations.Event) error {
+	s.events = append(s.events, *e)
+	return nil
+}
+
+func (s *countingStore) RestoreAddress(id string) (string, error) {
+	a, ok := s.addresses[id]
+	if !ok {
+		return "", mgo.ErrNotFound
+	}
+	s.owners[id] = a.DeletedFrom
+	a.DeletedAt, a.DeletedFrom = nil, ""
+	s.addresses[id] = a
+	return s.owners[id], nil
+}
+
+func newTestCachedStore(t *testing.T) (*CachedStore, *countingStore, dbOperations.User, dbOperations.Address) {
+	st := newCountingStore()
+	u := dbOperations.User{Username: "alice", FirstName: "Alice", Password: "hash", Salt: "salt"}
+	a := dbOperations.Address{Street: "Main St", City: "Zurich"}
+	if err := st.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.CreateAddress(&a, u.UserID); err != nil {
+		t.Fatal(err)
+	}
+	return NewCachedStore(st, NewLRUCache(100), time.Minute, time.Minute), st, u, a
+}
+
+func TestCachedStoreReadsThrough(t *testing.T) {
+	c, st, u, a := newTestCachedStore(t)
+	for i := 0; i < 3; i++ {
+		got, err := c.GetUser(u.UserID)
+		if err != nil || got.FirstName != "Alice" || got.Password != "hash" || len(got.Addresses) != 1 {
+			t.Fatalf("unexpected user %+v: %v", got, err)
+		}
+		if err := c.PopulateAddressesForUser(&got); err != nil || len(got.Addresses) != 1 || got.Addresses[0].Street != "Main St" {
+			t.Fatalf("unexpected addresses %+v: %v", got.Addresses, err)
+		}
+		byName, err := c.GetUserWithName("alice")
+		if err != nil || byName.UserID != u.UserID || byName.Salt != "salt" || len(byName.Addresses) != 0 {
+			t.Fatalf("unexpected user by name %+v: %v", byName, err)
+		}
+		if got, err := c.GetAddress(a.ID); err != nil || got.City != "Zurich" {
+			t.Fatalf("unexpected address %+v: %v", got, err)
+		}
+		if _, err := c.GetUser("unknown"); err != mgo.ErrNotFound {
+			t.Fatalf("expected ErrNotFound, got %v", err)
+		}
+		if _, err := c.GetUserWithName("bob"); err != mgo.ErrNotFound {
+			t.Fatalf("expected ErrNotFound, got %v", err)
+		}
+	}
+	want := map[string]int{"GetUser": 2, "GetUserWithName": 6, "PopulateAddressesForUser": 1}
+	for name, n := range want {
+		if st.reads[name] != n {
+			t.Errorf("expected %d %s reads, got %d", n, name, st.reads[name])
+		}
+	}
+	if st.reads["GetAddress"] != 0 {
+		t.Errorf("expected the populated address to be cached, got %d reads", st.reads["GetAddress"])
+	}
+	if s := c.Stats(); s.Misses != 3 || s.Hits != 9 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+// TestCachedStoreWrites warms the cache before every write and checks that
+// the reads after it see the write.
+func TestCachedStoreWrites(t *testing.T) {
+	c, _, u, a := newTestCachedStore(t)
+	warm := func() {
+		for _, id := range []string{u.UserID, "unknown"} {
+			if got, err := c.GetUser(id); err == nil {
+				c.PopulateAddressesForUser(&got)
+			}
+		}
+		for _, name := range []string{"alice", "alicia", "bob", "carol"} {
+			c.GetUserWithName(name)
+		}
+		c.GetAddress(a.ID)
+	}
+	addresses := func() []dbOperations.Address {
+		got, err := c.GetUser(u.UserID)
+		if err != nil {
+			return nil
+		}
+		c.PopulateAddressesForUser(&got)
+		return got.Addresses
+	}
+
+	warm()
+	if err := c.CreateUser(&dbOperations.User{Username: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetUserWithName("bob"); err != nil {
+		t.Errorf("expected the created user by name, got %v", err)
+	}
+
+	warm()
+	renamed := u
+	renamed.Username, renamed.LastName = "alicia", "Smith"
+	if err := c.UpdateUser(&renamed, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.GetUser(u.UserID); err != nil || got.LastName != "Smith" {
+		t.Errorf("expected the updated user, got %+v: %v", got, err)
+	}
+	if got, err := c.GetUserWithName("alicia"); err != nil || got.LastName != "Smith" {
+		t.Errorf("expected the user by its new name, got %+v: %v", got, err)
+	}
+	if _, err := c.GetUserWithName("alice"); err != mgo.ErrNotFound {
+		t.Errorf("expected the former name to be gone, got %v", err)
+	}
+
+	warm()
+	b := dbOperations.Address{Street: "Side St"}
+	if err := c.CreateAddress(&b, u.UserID); err != nil {
+		t.Fatal(err)
+	}
+	if got := addresses(); len(got) != 2 {
+		t.Errorf("expected the created address, got %+v", got)
+	}
+
+	warm()
+	if err := c.DeleteAddress(u.UserID, a.ID, "test", 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := addresses(); len(got) != 1 || got[0].ID != b.ID {
+		t.Errorf("expected the address to be deleted, got %+v", got)
+	}
+	if _, err := c.GetAddress(a.ID); err != mgo.ErrNotFound {
+		t.Errorf("expected the deleted address to be gone, got %v", err)
+	}
+
+	warm()
+	if userid, err := c.RestoreAddress(a.ID); err != nil || userid != u.UserID {
+		t.Fatalf("unexpected restore to %q: %v", userid, err)
+	}
+	if got := addresses(); len(got) != 2 {
+		t.Errorf("expected the address to be restored, got %+v", got)
+	}
+
+	warm()
+	if err := c.DeleteUser(u.UserID, "test", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetUser(u.UserID); err != mgo.ErrNotFound {
+		t.Errorf("expected the deleted user to be gone, got %v", err)
+	}
+	if _, err := c.GetUserWithName("alicia"); err != mgo.ErrNotFound {
+		t.Errorf("expected the deleted user to be gone by name, got %v", err)
+	}
+
+	warm()
+	if err := c.RestoreUser(u.UserID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetUserWithName("alicia"); err != nil {
+		t.Errorf("expected the restored user by name, got %v", err)
+	}
+
+	warm()
+	if errs, err := c.ImportUsers([]dbOperations.User{{Username: "carol"}}); err != nil || errs[0] != nil {
+		t.Fatal(errs, err)
+	}
+	if _, err := c.GetUserWithName("carol"); err != nil {
+		t.Errorf("expected the imported user by name, got %v", err)
+	}
+
+	warm()
+	if err := c.EraseUser(&dbOperations.Erasure{UserID: u.UserID}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetUser(u.UserID); err != mgo.ErrNotFound {
+		t.Errorf("expected the erased user to be gone, got %v", err)
+	}
+	if _, err := c.GetAddress(a.ID); err != mgo.ErrNotFound {
+		t.Errorf("expected the erased address to be gone, got %v", err)
+	}
+	if c.Stats().Invalidations == 0 {
+		t.Error("expected the invalidations to be counted")
+	}
+}
+
+func TestCachedStoreLogin(t *testing.T) {
+	c, st, u, _ := newTestCachedStore(t)
+	SetPassword(&u, "secret")
+	st.users[u.UserID] = u
+	svc := NewUserService(c, log.NewNopLogger())
+	for i := 0; i < 2; i++ {
+		got, err := svc.Login("alice", "secret")
+		if err != nil || len(got.Addresses) != 0 {
+			t.Fatalf("unexpected login %+v: %v", got, err)
+		}
+	}
+	// userctl and other instances write behind the cache's back.
+	SetPassword(&u, "changed")
+	if err := st.UpdateUser(&u, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.Login("alice", "secret"); err == nil {
+		t.Error("expected the former password to be refused")
+	}
+	if _, err := svc.Login("alice", "changed"); err != nil {
+		t.Errorf("expected the new password, got %v", err)
+	}
+	if err := st.DeleteUser(u.UserID, "userctl", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.Login("alice", "changed"); err == nil {
+		t.Error("expected a deleted user to be refused")
+	}
+}
+
+func TestLRUCache(t *testing.T) {
+	c := NewLRUCache(2)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	c.Set("a", []byte("1"), time.Minute)
+	c.Set("b", []byte("2"), time.Second)
+	c.Get("a")
+	c.Set("c", []byte("3"), time.Minute)
+	if _, ok := c.Get("b"); ok {
+		t.Error("expected the least recently used value to be dropped")
+	}
+	if v, ok := c.Get("a"); !ok || string(v) != "1" {
+		t.Errorf("expected a, got %q", v)
+	}
+	now = now.Add(time.Minute)
+	if _, ok := c.Get("c"); ok || c.Len() != 1 {
+		t.Errorf("expected expired values to be dropped, %d left", c.Len())
+	}
+	c.Delete("a")
+	if c.Len() != 0 {
+		t.Error("expected a to be deleted")
+	}
+	off := NewLRUCache(0)
+	off.Set("a", []byte("1"), time.Minute)
+	if _, ok := off.Get("a"); ok {
+		t.Error("expected a cache of size 0 to hold nothing")
+	}
+}
@@ -0,0 +1,340 @@
+// Package client provides a user.Service that talks to a remote user
+// service over its HTTP API.
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/sd"
+	"github.com/go-kit/kit/sd/lb"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/user"
+	"github.com/user/dbOperations"
+)
+
+// Option configures a client.
+type Option func(*config)
+
+type config struct {
+	client       *http.Client
+	retryMax     int
+	retryTimeout time.Duration
+	// authorization is sent with calls that carry no credentials of
+	// their own.
+	authorization string
+	tenant        string
+}
+
+// HTTPClient sets the underlying HTTP client. By default,
+// http.DefaultClient is used.
+func HTTPClient(c *http.Client) Option {
+	return func(cfg *config) { cfg.client = c }
+}
+
+// RetryMax sets how many attempts idempotent calls get before giving up.
+// Defaults to 3.
+func RetryMax(n int) Option {
+	return func(cfg *config) { cfg.retryMax = n }
+}
+
+// RetryTimeout bounds the total time spent on a call, retries included.
+// Defaults to 5 seconds.
+func RetryTimeout(d time.Duration) Option {
+	return func(cfg *config) { cfg.retryTimeout = d }
+}
+
+// APIKey authenticates every call but Login with an API key of the user
+// service. Calls are limited to the scopes of the key.
+func APIKey(key string) Option {
+	return func(cfg *config) { cfg.authorization = "ApiKey " + key }
+}
+
+// BearerToken authenticates every call but Login with a bearer token, such
+// as the admin token of the user service.
+func BearerToken(token string) Option {
+	return func(cfg *config) { cfg.authorization = "Bearer " + token }
+}
+
+// Tenant makes every call for the given tenant of the user service. By
+// default calls are for the tenant the service tells by its host.
+func Tenant(id string) Option {
+	return func(cfg *config) { cfg.tenant = id }
+}
+
+// Endpoints collects one client endpoint per Service method, each
+// balanced and, for idempotent calls, retried.
+type Endpoints struct {
+	LoginEndpoint         endpoint.Endpoint
+	RegisterEndpoint      endpoint.Endpoint
+	PostUserEndpoint      endpoint.Endpoint
+	PutUserEndpoint       endpoint.Endpoint
+	GetUsersEndpoint      endpoint.Endpoint
+	GetUserEndpoint       endpoint.Endpoint
+	PostAddressEndpoint   endpoint.Endpoint
+	GetAddressesEndpoint  endpoint.Endpoint
+	GetAddressEndpoint    endpoint.Endpoint
+	DeleteAddressEndpoint endpoint.Endpoint
+	DeleteUserEndpoint    endpoint.Endpoint
+}
+
+// New returns a Service backed by the user service at instance, e.g.
+// "localhost:8084" or "http://user:8084".
+func New(instance string, options ...Option) (user.Service, error) {
+	tgt, err := parseInstance(instance)
+	if err != nil {
+		return nil, err
+	}
+	return MakeEndpoints(func(f sd.Factory) sd.Endpointer {
+		e, _, _ := f(tgt.String())
+		return sd.FixedEndpointer{e}
+	}, options...), nil
+}
+
+// NewWithInstancer returns a Service that load balances across the user
+// service instances published by instancer, for example a Consul or DNS
+// SRV instancer. Every method follows instancer on its own, so instancer
+// must hand each registered channel its own slice of instances, as the
+// instancers of sd's discovery systems do. Close the returned io.Closer
+// once the Service is no longer used to stop following instancer.
+func NewWithInstancer(instancer sd.Instancer, logger log.Logger, options ...Option) (user.Service, io.Closer) {
+	var es endpointers
+	svc := MakeEndpoints(func(f sd.Factory) sd.Endpointer {
+		e := sd.NewEndpointer(instancer, f, logger)
+		es = append(es, e)
+		return e
+	}, options...)
+	return svc, es
+}
+
+// endpointers are those of a Service made by NewWithInstancer.
+type endpointers []*sd.DefaultEndpointer
+
+// Close deregisters every endpointer from its instancer.
+func (es endpointers) Close() error {
+	for _, e := range es {
+		e.Close()
+	}
+	return nil
+}
+
+// MakeEndpoints builds the client endpoints, using newEndpointer to turn
+// each method's factory into a set of endpoints to balance across.
+func MakeEndpoints(newEndpointer func(sd.Factory) sd.Endpointer, options ...Option) Endpoints {
+	cfg := config{
+		client:       http.DefaultClient,
+		retryMax:     3,
+		retryTimeout: 5 * time.Second,
+	}
+	for _, option := range options {
+		option(&cfg)
+	}
+
+	idempotent := func(method, path string, enc httptransport.EncodeRequestFunc, dec httptransport.DecodeResponseFunc) endpoint.Endpoint {
+		balancer := lb.NewRoundRobin(newEndpointer(factoryFor(method, path, enc, dec, cfg)))
+		return lb.RetryWithCallback(cfg.retryTimeout, balancer, retryCallback(cfg.retryMax))
+	}
+	once := func(method, path string, enc httptransport.EncodeRequestFunc, dec httptransport.DecodeResponseFunc) endpoint.Endpoint {
+		balancer := lb.NewRoundRobin(newEndpointer(factoryFor(method, path, enc, dec, cfg)))
+		return lb.Retry(1, cfg.retryTimeout, balancer)
+	}
+
+	return Endpoints{
+		LoginEndpoint:         idempotent("GET", "/login", encodeLoginRequest, decodeUserResponse),
+		RegisterEndpoint:      once("POST", "/register", httptransport.EncodeJSONRequest, decodePostResponse),
+		PostUserEndpoint:      once("POST", "/customers", encodeUserRequest, decodePostResponse),
+		PutUserEndpoint:       idempotent("PUT", "/customers", encodeUserPutRequest, decodeUserResponse),
+		GetUsersEndpoint:      idempotent("GET", "/customers", encodeGetRequest, decodeUsersResponse),
+		GetUserEndpoint:       idempotent("GET", "/customers", encodeGetRequest, decodeUserResponse),
+		PostAddressEndpoint:   once("POST", "/addresses", httptransport.EncodeJSONRequest, decodePostResponse),
+		GetAddressesEndpoint:  idempotent("GET", "/addresses", encodeGetRequest, decodeAddressesResponse),
+		GetAddressEndpoint:    idempotent("GET", "/addresses", encodeGetRequest, decodeAddressResponse),
+		DeleteAddressEndpoint: idempotent("DELETE", "/customers", encodeDeleteRequest, decodeStatusResponse),
+		DeleteUserEndpoint:    idempotent("DELETE", "/customers", encodeDeleteRequest, decodeStatusResponse),
+	}
+}
+
+// Login implements user.Service.
+func (e Endpoints) Login(username, password string) (dbOperations.User, error) {
+	resp, err := e.LoginEndpoint(context.Background(), loginRequest{Username: username, Password: password})
+	if err != nil {
+		return dbOperations.User{}, unwrap(err)
+	}
+	return resp.(dbOperations.User), nil
+}
+
+// Register implements user.Service.
+func (e Endpoints) Register(username, password, email, firstname, lastname, phone string) (dbOperations.User, error) {
+	u := dbOperations.User{
+		Username:  username,
+		Email:     email,
+		FirstName: firstname,
+		LastName:  lastname,
+		Phone:     phone,
+	}
+	resp, err := e.RegisterEndpoint(context.Background(), registerRequest{
+		Username:  username,
+		Password:  password,
+		Email:     email,
+		FirstName: firstname,
+		LastName:  lastname,
+		Phone:     phone,
+	})
+	if err != nil {
+		return u, unwrap(err)
+	}
+	u.UserID = resp.(string)
+	return u, nil
+}
+
+// PostUser implements user.Service.
+func (e Endpoints) PostUser(u dbOperations.User) (dbOperations.User, error) {
+	resp, err := e.PostUserEndpoint(context.Background(), u)
+	if err != nil {
+		return u, unwrap(err)
+	}
+	u.UserID = resp.(string)
+	return u, nil
+}
+
+// PutUser implements user.Service. As with DeleteUser, by is not sent and
+// a non-zero version is sent as If-Match.
+func (e Endpoints) PutUser(u dbOperations.User, by string, version int64) (dbOperations.User, error) {
+	resp, err := e.PutUserEndpoint(context.Background(), userPutRequest{User: u, Version: version})
+	if err != nil {
+		return u, unwrap(err)
+	}
+	return resp.(dbOperations.User), nil
+}
+
+// GetUsers implements user.Service.
+func (e Endpoints) GetUsers() ([]dbOperations.User, error) {
+	resp, err := e.GetUsersEndpoint(context.Background(), getRequest{})
+	if err != nil {
+		return make([]dbOperations.User, 0), unwrap(err)
+	}
+	return resp.([]dbOperations.User), nil
+}
+
+// GetUser implements user.Service.
+func (e Endpoints) GetUser(id string) (dbOperations.User, error) {
+	resp, err := e.GetUserEndpoint(context.Background(), getRequest{ID: id})
+	if err != nil {
+		return dbOperations.User{}, unwrap(err)
+	}
+	return resp.(dbOperations.User), nil
+}
+
+// PostAddress implements user.Service.
+func (e Endpoints) PostAddress(a dbOperations.Address, userid string) (string, error) {
+	resp, err := e.PostAddressEndpoint(context.Background(), addressPostRequest{Address: a, UserID: userid})
+	if err != nil {
+		return "", unwrap(err)
+	}
+	return resp.(string), nil
+}
+
+// GetAddresses implements user.Service.
+func (e Endpoints) GetAddresses() ([]dbOperations.Address, error) {
+	resp, err := e.GetAddressesEndpoint(context.Background(), getRequest{})
+	if err != nil {
+		return make([]dbOperations.Address, 0), unwrap(err)
+	}
+	return resp.([]dbOperations.Address), nil
+}
+
+// GetAddress implements user.Service.
+func (e Endpoints) GetAddress(id string) (dbOperations.Address, error) {
+	resp, err := e.GetAddressEndpoint(context.Background(), getRequest{ID: id})
+	if err != nil {
+		return dbOperations.Address{}, unwrap(err)
+	}
+	return resp.(dbOperations.Address), nil
+}
+
+// DeleteAddress implements user.Service. The server records the caller
+// it authenticates as the deleter, so by is not sent. A non-zero version
+// is sent as If-Match.
+func (e Endpoints) DeleteAddress(addrid, userid, by string, version int64) error {
+	_, err := e.DeleteAddressEndpoint(context.Background(), deleteRequest{UserID: userid, AddID: addrid, Version: version})
+	return unwrap(err)
+}
+
+// DeleteUser implements user.Service. As with DeleteAddress, by is not
+// sent and version is sent as If-Match.
+func (e Endpoints) DeleteUser(userid, by string, version int64) error {
+	_, err := e.DeleteUserEndpoint(context.Background(), deleteRequest{UserID: userid, Version: version})
+	return unwrap(err)
+}
+
+func factoryFor(method, path string, enc httptransport.EncodeRequestFunc, dec httptransport.DecodeResponseFunc, cfg config) sd.Factory {
+	return func(instance string) (endpoint.Endpoint, io.Closer, error) {
+		tgt, err := parseInstance(instance)
+		if err != nil {
+			return nil, nil, err
+		}
+		tgt.Path = path
+		return httptransport.NewClient(method, tgt, enc, dec,
+			httptransport.SetClient(cfg.client),
+			httptransport.ClientBefore(setAuthorization(cfg.authorization), setTenant(cfg.tenant)),
+		).Endpoint(), nil, nil
+	}
+}
+
+// setAuthorization sends authorization with requests that carry no
+// credentials of their own, as Login does.
+func setAuthorization(authorization string) httptransport.RequestFunc {
+	return func(ctx context.Context, r *http.Request) context.Context {
+		if authorization != "" && r.Header.Get("Authorization") == "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		return ctx
+	}
+}
+
+// setTenant names the tenant of the requests, if any.
+func setTenant(tenant string) httptransport.RequestFunc {
+	return func(ctx context.Context, r *http.Request) context.Context {
+		if tenant != "" {
+			r.Header.Set(user.TenantHeader, tenant)
+		}
+		return ctx
+	}
+}
+
+func parseInstance(instance string) (*url.URL, error) {
+	if !strings.HasPrefix(instance, "http") {
+		instance = "http://" + instance
+	}
+	return url.Parse(instance)
+}
+
+// retryCallback retries transport failures and server errors up to max
+// attempts, but gives up at once on errors the service itself returned,
+// which would only be returned again.
+func retryCallback(max int) lb.Callback {
+	return func(n int, err error) (bool, error) {
+		if e, ok := err.(*Error); ok && e.StatusCode < http.StatusInternalServerError {
+			return false, nil
+		}
+		if isServiceError(err) {
+			return false, nil
+		}
+		return n < max, nil
+	}
+}
+
+// unwrap strips the lb.RetryError added by the balancer, so callers see
+// the same errors a local Service would return.
+func unwrap(err error) error {
+	if re, ok := err.(lb.RetryError); ok {
+		return re.Final
+	}
+	return err
+}
@@ -0,0 +1,354 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/sd"
+	"github.com/user"
+	"github.com/user/dbOperations"
+	mgo "gopkg.in/mgo.v2"
+)
+
+// memService is a minimal in-memory user.Service to serve the real HTTP
+// handler against.
+type memService struct {
+	users     map[string]dbOperations.User
+	addresses map[string]dbOperations.Address
+}
+
+func newMemService() *memService {
+	return &memService{
+		users:     make(map[string]dbOperations.User),
+		addresses: make(map[string]dbOperations.Address),
+	}
+}
+
+func (s *memService) Login(username, password string) (dbOperations.User, error) {
+	for _, u := range s.users {
+		if u.Username == username && u.Password == password {
+			return u, nil
+		}
+	}
+	return dbOperations.User{}, user.ErrUnauthorized
+}
+
+func (s *memService) Register(username, password, email, firstname, lastname, phone string) (dbOperations.User, error) {
+	return s.PostUser(dbOperations.User{Username: username, Password: password, Email: email, FirstName: firstname, LastName: lastname, Phone: phone})
+}
+
+func (s *memService) PostUser(u dbOperations.User) (dbOperations.User, error) {
+	u.UserID = newID(len(s.users))
+	u.Version = 1
+	s.users[u.UserID] = u
+	return u, nil
+}
+
+func (s *memService) PutUser(u dbOperations.User, by string, version int64) (dbOperations.User, error) {
+	cur, ok := s.users[u.UserID]
+	if !ok {
+		return u, mgo.ErrNotFound
+	}
+	if version != 0 && version != cur.Version {
+		return u, dbOperations.ErrVersionConflict
+	}
+	if u.Password == "" {
+		u.Password = cur.Password
+	}
+	u.Version = cur.Version + 1
+	s.users[u.UserID] = u
+	return u, nil
+}
+
+func (s *memService) GetUsers() ([]dbOperations.User, error) {
+	users := make([]dbOperations.User, 0)
+	for _, u := range s.users {
+		users = append(users, u)
+	}
+	return users, nil
+}
+
+func (s *memService) GetUser(id string) (dbOperations.User, error) {
+	if u, ok := s.users[id]; ok {
+		return u, nil
+	}
+	return dbOperations.User{}, mgo.ErrNotFound
+}
+
+func (s *memService) PostAddress(a dbOperations.Address, userid string) (string, error) {
+	u, ok := s.users[userid]
+	if !ok {
+		return "", mgo.ErrNotFound
+	}
+	a.ID = newID(100 + len(s.addresses))
+	a.Version = 1
+	s.addresses[a.ID] = a
+	u.Addresses = append(u.Addresses, a)
+	s.users[userid] = u
+	return a.ID, nil
+}
+
+func (s *memService) GetAddresses() ([]dbOperations.Address, error) {
+	adds := make([]dbOperations.Address, 0)
+	for _, a := range s.addresses {
+		adds = append(adds, a)
+	}
+	return adds, nil
+}
+
+func (s *memService) GetAddress(id string) (dbOperations.Address, error) {
+	if a, ok := s.addresses[id]; ok {
+		return a, nil
+	}
+	return dbOperations.Address{}, mgo.ErrNotFound
+}
+
+func (s *memService) DeleteAddress(addrid, userid, by string, version int64) error {
+	a, ok := s.addresses[addrid]
+	if !ok {
+		return mgo.ErrNotFound
+	}
+	if version != 0 && version != a.Version {
+		return dbOperations.ErrVersionConflict
+	}
+	delete(s.addresses, addrid)
+	return nil
+}
+
+func (s *memService) DeleteUser(userid, by string, version int64) error {
+	u, ok := s.users[userid]
+	if !ok {
+		return mgo.ErrNotFound
+	}
+	if version != 0 && version != u.Version {
+		return dbOperations.ErrVersionConflict
+	}
+	delete(s.users, userid)
+	return nil
+}
+
+func newID(n int) string {
+	return "57a98d98e4b00679b4a8" + string(rune('a'+n/16)) + string(rune('a'+n%16)) + "00"
+}
+
+func newTestServer(svc user.Service) *httptest.Server {
+	return httptest.NewServer(user.MakeHTTPHandler(context.Background(), user.MakeEndpoints(svc), log.NewNopLogger()))
+}
+
+func TestClientRoundTrip(t *testing.T) {
+	srv := newTestServer(newMemService())
+	defer srv.Close()
+	c, err := New(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg, err := c.Register("eve", "secret", "eve@example.com", "Eve", "Smith", "+41")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reg.UserID == "" {
+		t.Fatal("expected user id")
+	}
+	posted, err := c.PostUser(dbOperations.User{Username: "bob", Password: "hunter2", FirstName: "Bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Login("bob", "hunter2"); err != nil {
+		t.Errorf("password must survive PostUser: %v", err)
+	}
+	bob, err := c.GetUser(posted.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob.FirstName = "Robert"
+	if _, err := c.PutUser(bob, "", bob.Version+1); err != dbOperations.ErrVersionConflict {
+		t.Errorf("expected ErrVersionConflict for a stale version, got %v", err)
+	}
+	if bob, err = c.PutUser(bob, "", bob.Version); err != nil || bob.FirstName != "Robert" || bob.Version != 2 {
+		t.Errorf("expected the user updated to version 2, got %+v: %v", bob, err)
+	}
+
+	u, err := c.Login("eve", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.FirstName != "Eve" {
+		t.Errorf("unexpected user %+v", u)
+	}
+	if _, err := c.Login("eve", "wrong"); err != user.ErrUnauthorized {
+		t.Errorf("expected ErrUnauthorized, got %v", err)
+	}
+
+	users, err := c.GetUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 {
+		t.Errorf("expected two users, got %d", len(users))
+	}
+	if _, err := c.GetUser(posted.UserID); err != nil {
+		t.Error(err)
+	}
+	if _, err := c.GetUser("57a98d98e4b00679b4a8ffff"); err != mgo.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	aid, err := c.PostAddress(dbOperations.Address{City: "Bern"}, reg.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := c.GetAddress(aid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.City != "Bern" {
+		t.Errorf("unexpected address %+v", a)
+	}
+	adds, err := c.GetAddresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(adds) != 1 {
+		t.Errorf("expected one address, got %d", len(adds))
+	}
+
+	if a.Version != 1 {
+		t.Errorf("expected the version from the ETag, got %d", a.Version)
+	}
+	if err := c.DeleteAddress(aid, reg.UserID, "", a.Version+1); err != dbOperations.ErrVersionConflict {
+		t.Errorf("expected ErrVersionConflict for a stale version, got %v", err)
+	}
+	if err := c.DeleteAddress(aid, reg.UserID, "", a.Version); err != nil {
+		t.Error(err)
+	}
+	if err := c.DeleteUser(reg.UserID, "", 0); err != nil {
+		t.Error(err)
+	}
+	if _, err := c.GetUser(reg.UserID); err != mgo.ErrNotFound {
+		t.Errorf("expected ErrNotFound after delete, got %v", err)
+	}
+}
+
+func TestClientRetriesIdempotentCalls(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`{"_embedded":{"address":[{"id":"1","city":"Bern"}]}}`))
+	}))
+	defer srv.Close()
+	c, _ := New(srv.URL, RetryMax(3))
+
+	adds, err := c.GetAddresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(adds) != 1 || calls != 3 {
+		t.Errorf("expected success on third attempt, got %d addresses after %d calls", len(adds), calls)
+	}
+
+	atomic.StoreInt32(&calls, 0)
+	_, err = c.PostAddress(dbOperations.Address{}, "1")
+	if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusBadGateway {
+		t.Errorf("expected *Error with 502, got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("non-idempotent call must not be retried, got %d calls", calls)
+	}
+}
+
+func TestClientDoesNotRetryServiceErrors(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"not found","status_code":500}`))
+	}))
+	defer srv.Close()
+	c, _ := New(srv.URL)
+
+	if _, err := c.GetUser("57a98d98e4b00679b4a830af"); err != mgo.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("expected a single call, got %d", calls)
+	}
+}
+
+func TestClientSendsAPIKey(t *testing.T) {
+	var authorization, tenant atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization.Store(r.Header.Get("Authorization"))
+		tenant.Store(r.Header.Get(user.TenantHeader))
+		if r.URL.Path == "/addresses" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error":"Forbidden","status_code":403}`))
+			return
+		}
+		w.Write([]byte(`{"user":{"id":"57a98d98e4b00679b4a830af"}}`))
+	}))
+	defer srv.Close()
+	c, _ := New(srv.URL, APIKey("usk_secret"))
+
+	if _, err := c.GetUser("57a98d98e4b00679b4a830af"); err != nil || authorization.Load() != "ApiKey usk_secret" {
+		t.Errorf("expected the key to be sent, got %v: %v", authorization.Load(), err)
+	}
+	if _, err := c.Login("eve", "secret"); err != nil || authorization.Load() == "ApiKey usk_secret" {
+		t.Errorf("expected login to send the user's credentials, got %v: %v", authorization.Load(), err)
+	}
+	if _, err := c.GetAddresses(); err != user.ErrForbidden {
+		t.Errorf("expected ErrForbidden, got %v", err)
+	}
+
+	c, _ = New(srv.URL, BearerToken("admin-secret"), Tenant("acme"))
+	if _, err := c.GetUser("57a98d98e4b00679b4a830af"); err != nil || authorization.Load() != "Bearer admin-secret" {
+		t.Errorf("expected the token to be sent, got %v: %v", authorization.Load(), err)
+	}
+	if tenant.Load() != "acme" {
+		t.Errorf("expected the tenant to be sent, got %v", tenant.Load())
+	}
+}
+
+func TestClientLoadBalancesInstances(t *testing.T) {
+	var a, b int32
+	handler := func(n *int32) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(n, 1)
+			w.Write([]byte(`{"_embedded":{"customer":[]}}`))
+		})
+	}
+	srvA := httptest.NewServer(handler(&a))
+	defer srvA.Close()
+	srvB := httptest.NewServer(handler(&b))
+	defer srvB.Close()
+
+	c, closer := NewWithInstancer(instancer{srvA.URL, srvB.URL}, log.NewNopLogger())
+	defer closer.Close()
+	for i := 0; i < 4; i++ {
+		if _, err := c.GetUsers(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if a != 2 || b != 2 {
+		t.Errorf("expected calls to be spread evenly, got %d and %d", a, b)
+	}
+}
+
+// instancer is sd.FixedInstancer, but like the instancers of discovery
+// systems it hands every channel its own slice of instances.
+type instancer []string
+
+func (d instancer) Register(ch chan<- sd.Event) {
+	ch <- sd.Event{Instances: append([]string(nil), d...)}
+}
+
+func (d instancer) Deregister(ch chan<- sd.Event) {}
+
+func (d instancer) Stop() {}
@@ -0,0 +1,261 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/user"
+	"github.com/user/dbOperations"
+	mgo "gopkg.in/mgo.v2"
+)
+
+// Error is returned for error responses that do not map onto one of the
+// errors the user service itself defines.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("user service: %d %s", e.StatusCode, e.Message)
+}
+
+// serviceErrors are the errors a local Service returns, keyed by the
+// message encodeError puts on the wire.
+var serviceErrors = map[string]error{
+	user.ErrUnauthorized.Error():            user.ErrUnauthorized,
+	user.ErrForbidden.Error():               user.ErrForbidden,
+	user.ErrInvalidRequest.Error():          user.ErrInvalidRequest,
+	dbOperations.ErrInvalidHexID.Error():    dbOperations.ErrInvalidHexID,
+	mgo.ErrNotFound.Error():                 mgo.ErrNotFound,
+	dbOperations.ErrVersionConflict.Error(): dbOperations.ErrVersionConflict,
+}
+
+func isServiceError(err error) bool {
+	for _, e := range serviceErrors {
+		if err == e {
+			return true
+		}
+	}
+	return false
+}
+
+type loginRequest struct {
+	Username string
+	Password string
+}
+
+type registerRequest struct {
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+	Email     string `json:"email"`
+	FirstName string `json:"firstName"`
+	LastName  string `json:"lastName"`
+	Phone     string `json:"phone"`
+}
+
+type getRequest struct {
+	ID string
+}
+
+type addressPostRequest struct {
+	dbOperations.Address
+	UserID string `json:"userID"`
+}
+
+type userPutRequest struct {
+	User    dbOperations.User
+	Version int64
+}
+
+type deleteRequest struct {
+	UserID  string
+	AddID   string
+	Version int64
+}
+
+func encodeLoginRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(loginRequest)
+	r.SetBasicAuth(req.Username, req.Password)
+	return nil
+}
+
+func encodeGetRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(getRequest)
+	if req.ID != "" {
+		r.URL.Path += "/" + url.PathEscape(req.ID)
+	}
+	return nil
+}
+
+// encodeUserRequest sends the password and email that dbOperations.User
+// leaves out of its JSON form.
+func encodeUserRequest(_ context.Context, r *http.Request, request interface{}) error {
+	u := request.(dbOperations.User)
+	return encodeJSONBody(r, struct {
+		dbOperations.User
+		Password string `json:"password"`
+		Email    string `json:"email"`
+	}{u, u.Password, u.Email})
+}
+
+func encodeUserPutRequest(ctx context.Context, r *http.Request, request interface{}) error {
+	req := request.(userPutRequest)
+	r.URL.Path += "/" + url.PathEscape(req.User.UserID)
+	setIfMatch(r, req.Version)
+	return encodeUserRequest(ctx, r, req.User)
+}
+
+func encodeDeleteRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(deleteRequest)
+	r.URL.Path += "/" + url.PathEscape(req.UserID)
+	if req.AddID != "" {
+		r.URL.Path += "/addresses/" + url.PathEscape(req.AddID)
+	}
+	setIfMatch(r, req.Version)
+	return nil
+}
+
+// setIfMatch makes r conditional on version, unless it is 0.
+func setIfMatch(r *http.Request, version int64) {
+	if version != 0 {
+		r.Header.Set("If-Match", strconv.Quote(strconv.FormatInt(version, 10)))
+	}
+}
+
+func encodeJSONBody(r *http.Request, v interface{}) error {
+	r.Header.Set("Content-Type", "application/json; charset=utf-8")
+	var b bytes.Buffer
+	r.Body = ioutil.NopCloser(&b)
+	return json.NewEncoder(&b).Encode(v)
+}
+
+// decodeUserResponse handles both GET /customers/{id}, which returns the
+// user itself, and GET /login, which wraps it under "user".
+func decodeUserResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if err := errorFrom(r); err != nil {
+		return nil, err
+	}
+	var resp struct {
+		dbOperations.User
+		Wrapped *dbOperations.User `json:"user"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&resp); err != nil {
+		return nil, err
+	}
+	if resp.Wrapped != nil {
+		return *resp.Wrapped, nil
+	}
+	resp.User.Version = versionFrom(r)
+	return resp.User, nil
+}
+
+func decodeUsersResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if err := errorFrom(r); err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Embed struct {
+			Users []dbOperations.User `json:"customer"`
+		} `json:"_embedded"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&resp); err != nil {
+		return nil, err
+	}
+	if resp.Embed.Users == nil {
+		resp.Embed.Users = make([]dbOperations.User, 0)
+	}
+	return resp.Embed.Users, nil
+}
+
+func decodeAddressResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if err := errorFrom(r); err != nil {
+		return nil, err
+	}
+	var a dbOperations.Address
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		return nil, err
+	}
+	a.Version = versionFrom(r)
+	return a, nil
+}
+
+// versionFrom reads the version out of the ETag of a response, or 0 if it
+// has none.
+func versionFrom(r *http.Response) int64 {
+	t, err := strconv.Unquote(r.Header.Get("ETag"))
+	if err != nil {
+		return 0
+	}
+	v, _ := strconv.ParseInt(t, 10, 64)
+	return v
+}
+
+func decodeAddressesResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if err := errorFrom(r); err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Embed struct {
+			Addresses []dbOperations.Address `json:"address"`
+		} `json:"_embedded"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&resp); err != nil {
+		return nil, err
+	}
+	if resp.Embed.Addresses == nil {
+		resp.Embed.Addresses = make([]dbOperations.Address, 0)
+	}
+	return resp.Embed.Addresses, nil
+}
+
+func decodePostResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if err := errorFrom(r); err != nil {
+		return nil, err
+	}
+	var resp struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&resp); err != nil {
+		return nil, err
+	}
+	return resp.ID, nil
+}
+
+func decodeStatusResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if err := errorFrom(r); err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Status bool `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&resp); err != nil {
+		return nil, err
+	}
+	return resp.Status, nil
+}
+
+// errorFrom turns an error response written by encodeError back into the
+// error the service returned, or an *Error when it is not one of ours.
+func errorFrom(r *http.Response) error {
+	if r.StatusCode < 400 {
+		return nil
+	}
+	var body struct {
+		Error string `json:"error"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+	if err, ok := serviceErrors[body.Error]; ok {
+		return err
+	}
+	if body.Error == "" {
+		body.Error = http.StatusText(r.StatusCode)
+	}
+	return &Error{StatusCode: r.StatusCode, Message: body.Error}
+}
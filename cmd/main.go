@@ -4,12 +4,20 @@ package main
 //TODO: HATEOAS
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
 	"flag"
 	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	corelog "log"
 
@@ -18,10 +26,38 @@ import (
 	"github.com/go-kit/kit/log"
 	"github.com/user"
 	db "github.com/user/dbOperations"
+	"github.com/user/pb"
+	"google.golang.org/grpc"
 )
 
 var (
-	port string
+	port         string
+	grpcPort     string
+	adminToken   string
+	scimToken    string
+	supportToken string
+	verifyAudit  bool
+	erasureGrace time.Duration
+	retention    time.Duration
+	eventHook    string
+	relayEvery   time.Duration
+	oidcIssuer   string
+	oidcKey      string
+	oidcPages    string
+	upstreams    string
+	proxies      string
+	anonymous    bool
+	rateLimits   string
+	sharedLimits bool
+	keyfile      string
+	encrypted    string
+	cacheSize    int
+	cacheTTL     time.Duration
+	negativeTTL  time.Duration
+	verifyPhone  bool
+	smsGateway   string
+	smsLog       bool
+	attrSchemas  string
 )
 
 const (
@@ -30,6 +66,32 @@ const (
 
 func init() {
 	flag.StringVar(&port, "port", "8084", "Port on which to run")
+	flag.StringVar(&grpcPort, "grpc-port", "", "Port on which to serve gRPC, disabled when empty")
+	flag.StringVar(&adminToken, "admin-token", os.Getenv("USER_ADMIN_TOKEN"), "Bearer token granting the admin role")
+	flag.StringVar(&scimToken, "scim-token", os.Getenv("USER_SCIM_TOKEN"), "Bearer token of the SCIM provisioning client")
+	flag.StringVar(&supportToken, "support-token", os.Getenv("USER_SUPPORT_TOKEN"), "Bearer token granting the support role, which may search customers")
+	flag.BoolVar(&verifyAudit, "verify-audit", false, "Verify the audit chain and exit")
+	flag.DurationVar(&retention, "deleted-retention", 30*24*time.Hour, "How long deleted users and addresses can be restored before they are purged")
+	flag.StringVar(&eventHook, "event-webhook", os.Getenv("USER_EVENT_WEBHOOK"), "URL every domain event is posted to, besides the webhook subscriptions")
+	flag.DurationVar(&relayEvery, "event-relay-interval", 5*time.Second, "How often the outbox is relayed and webhooks are delivered")
+	flag.StringVar(&oidcIssuer, "oidc-issuer", os.Getenv("USER_OIDC_ISSUER"), "URL the OpenID Connect provider is reached at, http://localhost:<port> when empty")
+	flag.StringVar(&oidcKey, "oidc-key", os.Getenv("USER_OIDC_KEY"), "PEM file of the RSA key signing ID and access tokens, generated at startup when empty")
+	flag.StringVar(&oidcPages, "oidc-templates", "", "File of templates replacing the login, consent, linked and error pages")
+	flag.StringVar(&upstreams, "identity-providers", os.Getenv("USER_IDENTITY_PROVIDERS"), "JSON file of the external identity providers users can log in with")
+	flag.StringVar(&proxies, "trusted-proxies", os.Getenv("USER_TRUSTED_PROXIES"), "Comma separated addresses and networks of the proxies whose X-Forwarded-For tells the client address")
+	flag.BoolVar(&anonymous, "anonymous-access", true, "Let callers without credentials use /customers and /addresses; API keys are limited to their scopes either way")
+	flag.StringVar(&rateLimits, "rate-limits", os.Getenv("USER_RATE_LIMITS"), "JSON file of the rate limits per route and caller, unlimited when empty")
+	flag.BoolVar(&sharedLimits, "rate-limit-shared", false, "Count rate limits in Mongo, shared by all instances, instead of in memory")
+	flag.StringVar(&keyfile, "encryption-keys", os.Getenv("USER_ENCRYPTION_KEYS"), "JSON keyfile of the master keys encrypting personal fields at rest, unencrypted when empty")
+	flag.StringVar(&encrypted, "encrypted-fields", strings.Join(db.DefaultEncryptedFields, ","), "Fields encrypted at rest, as collection.field")
+	flag.IntVar(&cacheSize, "cache-size", 10000, "How many users and addresses are cached in memory, none when 0")
+	flag.DurationVar(&cacheTTL, "cache-ttl", time.Minute, "How long users and addresses are cached; changes made by other instances or userctl show after it")
+	flag.DurationVar(&negativeTTL, "cache-negative-ttl", 10*time.Second, "How long users and addresses that are not found are cached")
+	flag.DurationVar(&erasureGrace, "erasure-grace", 30*24*time.Hour, "How long an erasure request can be cancelled before the user's data is deleted")
+	flag.StringVar(&attrSchemas, "attribute-schemas", os.Getenv("USER_ATTRIBUTE_SCHEMAS"), "JSON file of the custom attributes customers can have, per tenant; none when empty")
+	flag.BoolVar(&verifyPhone, "phone-verification", false, "Let customers verify their phone number with a code sent through -sms-gateway, or logged with -sms-log")
+	flag.StringVar(&smsGateway, "sms-gateway", os.Getenv("USER_SMS_GATEWAY"), "URL of the SMS gateway verification codes are posted to as JSON")
+	flag.BoolVar(&smsLog, "sms-log", false, "Log verification codes, with the phone number, instead of sending them; for local development only")
 }
 
 func main() {
@@ -46,6 +108,13 @@ func main() {
 	}
 	dbconn := false
 	dbm := db.Mongo{}
+	if keyfile != "" {
+		var err error
+		if dbm.Encryption, err = db.LoadFieldEncryption(keyfile, strings.Split(encrypted, ",")); err != nil {
+			logger.Log("encryption-keys", keyfile, "err", err)
+			os.Exit(1)
+		}
+	}
 	for !dbconn {
 		err := dbm.Init()
 		if err != nil {
@@ -54,22 +123,296 @@ func main() {
 			dbconn = true
 		}
 	}
-	var svc user.Service
-	svc = user.NewUserService(&dbm, logger)
-	endpoints := user.MakeEndpoints(svc)
-	router := user.MakeHTTPHandler(ctx, endpoints, logger)
+	if verifyAudit {
+		n, err := dbm.VerifyAudit()
+		if err != nil {
+			logger.Log("audit", "broken", "verified", n, "err", err)
+			os.Exit(1)
+		}
+		logger.Log("audit", "ok", "verified", n)
+		return
+	}
+	tokens := user.TokenAuthenticator{}
+	if adminToken != "" {
+		tokens[adminToken] = user.Principal{ID: "admin", Roles: []string{user.RoleAdmin}}
+	}
+	if scimToken != "" {
+		tokens[scimToken] = user.Principal{ID: "scim", Roles: []string{user.RoleProvisioner}}
+	}
+	if supportToken != "" {
+		tokens[supportToken] = user.Principal{ID: "support", Roles: []string{user.RoleSupport}}
+	}
+	trusted, err := user.ParseTrustedProxies(proxies)
+	if err != nil {
+		logger.Log("trusted-proxies", proxies, "err", err)
+		os.Exit(1)
+	}
+	key, tmpl, err := loadOIDCKey(logger)
+	if err != nil {
+		logger.Log("oidc", "setup", "err", err)
+		os.Exit(1)
+	}
+	var providers []user.IdentityProvider
+	if upstreams != "" {
+		data, err := ioutil.ReadFile(upstreams)
+		if err == nil {
+			providers, err = user.ParseIdentityProviders(data)
+		}
+		if err != nil {
+			logger.Log("identity-providers", upstreams, "err", err)
+			os.Exit(1)
+		}
+	}
+	var sms user.SMSSender = user.HTTPSMSSender{URL: smsGateway}
+	switch {
+	case smsLog && smsGateway != "":
+		logger.Log("sms-log", smsLog, "err", "-sms-log and -sms-gateway exclude each other")
+		os.Exit(1)
+	case smsLog:
+		logger.Log("sms-log", smsLog, "warning", "verification codes are logged, not sent")
+		sms = user.LogSMSSender{Logger: log.With(logger, "component", "sms")}
+	case verifyPhone && smsGateway == "":
+		logger.Log("phone-verification", verifyPhone, "err", "no -sms-gateway to send the codes through")
+		os.Exit(1)
+	}
+	var limits []user.RateLimitRule
+	if rateLimits != "" {
+		data, err := ioutil.ReadFile(rateLimits)
+		if err == nil {
+			limits, err = user.ParseRateLimits(data)
+		}
+		if err != nil {
+			logger.Log("rate-limits", rateLimits, "err", err)
+			os.Exit(1)
+		}
+	}
+	schemas := user.AttributeSchemas{}
+	if attrSchemas != "" {
+		data, err := ioutil.ReadFile(attrSchemas)
+		if err == nil {
+			schemas, err = user.ParseAttributeSchemas(data)
+		}
+		if err == nil {
+			err = dbm.EnsureAttributeIndexes(schemas.Indexed()...)
+		}
+		if err != nil {
+			logger.Log("attribute-schemas", attrSchemas, "err", err)
+			os.Exit(1)
+		}
+	}
+	var buckets user.RateLimitStore = user.NewMemoryRateLimits()
+	if sharedLimits {
+		buckets = &dbm
+	}
+
+	// Every tenant reads through its own cached store, sharing one cache.
+	cache := user.NewLRUCache(cacheSize)
+	var stores sync.Map
+	storeFor := func(tenant string) *user.CachedStore {
+		if st, ok := stores.Load(tenant); ok {
+			return st.(*user.CachedStore)
+		}
+		st, _ := stores.LoadOrStore(tenant, user.NewCachedStore(dbm.ForTenant(tenant), user.PrefixCache(cache, tenant+"\x00"), cacheTTL, negativeTTL))
+		return st.(*user.CachedStore)
+	}
+	var tenants *user.TenantRouter
+	makeEndpoints := func(t db.Tenant) user.Endpoints {
+		tdb := dbm.ForTenant(t.ID)
+		cached := storeFor(t.ID)
+		svc := user.NewUserService(user.NewNormalizingStore(cached, t), logger)
+		provider := user.NewOIDCProvider(oidcIssuerURL(), key, svc, tdb)
+		if tmpl != nil {
+			provider.Templates = tmpl
+		}
+		if t.ID != db.DefaultTenant {
+			provider.Tenant = t.ID
+		}
+		provider.TokenTTL = time.Duration(t.TokenLifetime) * time.Second
+		endpoints := user.MakeEndpoints(svc)
+		endpoints = user.DataSubjectEndpoints(endpoints, cached, erasureGrace)
+		endpoints = user.DefaultsEndpoints(endpoints, cached)
+		endpoints = user.PreferencesEndpoints(endpoints, cached, schemas.For(t.ID))
+		endpoints = user.PolicyEndpoints(endpoints, cached)
+		if verifyPhone {
+			endpoints = user.PhoneVerificationEndpoints(endpoints, cached, sms)
+		}
+		endpoints = user.RestoreEndpoints(endpoints, cached)
+		endpoints = user.BulkEndpoints(endpoints, cached)
+		endpoints = user.WebhookEndpoints(endpoints, tdb)
+		endpoints = user.SCIMEndpoints(endpoints, svc, cached)
+		endpoints = user.TenantPolicyEndpoints(endpoints, t)
+		endpoints = user.OIDCEndpoints(endpoints, provider)
+		endpoints = user.IdentityEndpoints(endpoints, provider, tdb, providers...)
+		endpoints = user.APIKeyEndpoints(endpoints, tdb, anonymous)
+		endpoints = user.HealthEndpoints(endpoints, &dbm)
+		endpoints = user.SearchEndpoints(endpoints, user.NewTextSearch(tdb))
+		if t.ID == db.DefaultTenant {
+			endpoints = user.TenantEndpoints(endpoints, &dbm, func() {
+				if err := tenants.Reload(); err != nil {
+					logger.Log("tenants", "reload", "err", err)
+				}
+			})
+		}
+		endpoints = user.AuditEndpoints(endpoints, tdb, logger)
+		endpoints = user.RateLimitEndpoints(endpoints, buckets, limits, logger)
+		endpoints = user.AuthenticateEndpoints(endpoints, user.Authenticators{provider, tokens, user.APIKeyAuthenticator{Store: tdb}})
+		return user.RateLimitClientEndpoints(endpoints, buckets, limits, logger)
+	}
+	tenants = user.NewTenantRouter(&dbm, func(t db.Tenant) (http.Handler, error) {
+		return user.MakeHTTPHandler(ctx, makeEndpoints(t), logger), nil
+	}, logger)
+	if err := tenants.Reload(); err != nil {
+		logger.Log("tenants", "load", "err", err)
+		os.Exit(1)
+	}
 	// Create and launch the HTTP server.
 	go func() {
 		logger.Log("transport", "HTTP", "port")
-		errc <- http.ListenAndServe(fmt.Sprintf(":%v", port), router)
+		errc <- http.ListenAndServe(fmt.Sprintf(":%v", port), trusted.Handler(tenants))
 	}()
 
+	// Pick up tenants changed by other instances.
+	go func() {
+		for range time.Tick(30 * time.Second) {
+			if err := tenants.Reload(); err != nil {
+				logger.Log("tenants", "reload", "err", err)
+			}
+		}
+	}()
+
+	// Carry out erasures whose grace period has passed, purge deleted
+	// records past their retention, and report how the caches do.
+	go func() {
+		for range time.Tick(time.Hour) {
+			all, err := dbm.GetTenants()
+			if err != nil {
+				logger.Log("tenants", "load", "err", err)
+				continue
+			}
+			for _, t := range all {
+				cached := storeFor(t.ID)
+				if _, err := user.PurgeErasures(cached, logger); err != nil {
+					logger.Log("tenant", t.ID, "erasure", "purge", "err", err)
+				}
+				if _, err := user.PurgeDeleted(cached, retention, logger); err != nil {
+					logger.Log("tenant", t.ID, "deleted", "purge", "err", err)
+				}
+				stats := cached.Stats()
+				logger.Log("tenant", t.ID, "cache", "stats", "hits", stats.Hits, "misses", stats.Misses, "invalidations", stats.Invalidations)
+			}
+		}
+	}()
+
+	// Encrypt records that are not yet under the current master key and
+	// fields, at once so that a rotation takes effect, and then hourly for
+	// those that changed meanwhile.
+	go func() {
+		reencrypt := func() {
+			n, err := dbm.Reencrypt()
+			if n > 0 {
+				logger.Log("encryption", "reencrypted", "records", n)
+			}
+			if err != nil {
+				logger.Log("encryption", "reencrypt", "err", err)
+			}
+		}
+		reencrypt()
+		for range time.Tick(time.Hour) {
+			reencrypt()
+		}
+	}()
+
+	// Index the records written before customers were searched.
+	go func() {
+		n, err := dbm.Reindex()
+		if n > 0 {
+			logger.Log("search", "reindexed", "records", n)
+		}
+		if err != nil {
+			logger.Log("search", "reindex", "err", err)
+		}
+	}()
+
+	// Relay domain events from the outbox to the webhook subscriptions, and
+	// deliver them.
+	go func() {
+		client := &http.Client{Timeout: 10 * time.Second}
+		pub := user.Publishers{user.WebhookPublisher{Store: &dbm}}
+		if eventHook != "" {
+			pub = append(pub, user.HTTPPublisher{URL: eventHook, Client: client})
+		}
+		for range time.Tick(relayEvery) {
+			if _, err := user.RelayEvents(ctx, &dbm, pub, logger); err != nil {
+				logger.Log("events", "relay", "err", err)
+			}
+			if _, err := user.DeliverWebhooks(ctx, &dbm, client, logger); err != nil {
+				logger.Log("webhooks", "deliver", "err", err)
+			}
+		}
+	}()
+
+	// Create and launch the gRPC server.
+	if grpcPort != "" {
+		go func() {
+			logger.Log("transport", "gRPC", "port", grpcPort)
+			ln, err := net.Listen("tcp", fmt.Sprintf(":%v", grpcPort))
+			if err != nil {
+				errc <- err
+				return
+			}
+			s := grpc.NewServer(grpc.UnaryInterceptor(trusted.UnaryServerInterceptor()))
+			// gRPC callers cannot name a tenant, and get the default one.
+			t, err := dbm.GetTenant(db.DefaultTenant)
+			if err != nil {
+				errc <- err
+				return
+			}
+			pb.RegisterUserServer(s, user.MakeGRPCServer(makeEndpoints(t), logger))
+			errc <- s.Serve(ln)
+		}()
+	}
+
 	// Capture interrupts.
 	go func() {
-		c := make(chan os.Signal)
+		c := make(chan os.Signal, 1)
 		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
 		errc <- fmt.Errorf("%s", <-c)
 	}()
 
 	logger.Log("exit", <-errc)
 }
+
+// loadOIDCKey reads the key signing ID and access tokens, and the page
+// templates, from the flags. A generated key does not survive restarts, so
+// tokens issued before one are no longer accepted after it.
+func loadOIDCKey(logger log.Logger) (*rsa.PrivateKey, *template.Template, error) {
+	var key *rsa.PrivateKey
+	if oidcKey != "" {
+		data, err := ioutil.ReadFile(oidcKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		if key, err = user.ParseSigningKey(data); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		var err error
+		if key, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			return nil, nil, err
+		}
+		logger.Log("oidc", "generated signing key", "warning", "tokens are invalidated on restart, set -oidc-key")
+	}
+	if oidcPages == "" {
+		return key, nil, nil
+	}
+	tmpl, err := template.ParseFiles(oidcPages)
+	return key, tmpl, err
+}
+
+// oidcIssuerURL is the URL the OpenID Connect provider is reached at.
+func oidcIssuerURL() string {
+	if oidcIssuer == "" {
+		return "http://localhost:" + port
+	}
+	return oidcIssuer
+}
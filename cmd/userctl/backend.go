@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/user"
+	"github.com/user/client"
+	db "github.com/user/dbOperations"
+)
+
+// actor is recorded as the one making the changes userctl makes on the
+// database. Through the API the server records the caller it
+// authenticates instead.
+const actor = "userctl"
+
+// backend is where userctl operates: the database, or a running instance.
+type backend interface {
+	user.Service
+	// RestoreUser lets a disabled user log in again.
+	RestoreUser(id string) error
+	ResetPassword(id, password string) error
+	Health() ([]user.Health, error)
+	EnsureIndexes() error
+	// Reencrypt encrypts the records not yet under the current master key
+	// and fields, and returns how many it rewrote.
+	Reencrypt() (int, error)
+	// Import reads users from in and imports them, after skipping the
+	// first skip records. checkpoint is called with the records settled
+	// so far.
+	Import(in io.Reader, format, columns string, dryRun bool, skip int, checkpoint func(int)) (user.ImportReport, error)
+	Export(out io.Writer, format string, passwords bool) error
+}
+
+// local operates on the database directly, as the service itself does.
+// db only sees the records of the tenant; all sees every tenant's, for
+// the commands maintaining the whole database.
+type local struct {
+	user.Service
+	db  *db.Mongo
+	all *db.Mongo
+}
+
+func newLocal(tenant string) (*local, error) {
+	dbm := &db.Mongo{}
+	if keyfile != "" {
+		var err error
+		if dbm.Encryption, err = db.LoadFieldEncryption(keyfile, strings.Split(encrypted, ",")); err != nil {
+			return nil, err
+		}
+	}
+	if err := dbm.Init(); err != nil {
+		return nil, err
+	}
+	if tenant == "" {
+		tenant = db.DefaultTenant
+	}
+	scoped := dbm.ForTenant(tenant)
+	return &local{Service: user.NewUserService(scoped, nopLogger), db: scoped, all: dbm}, nil
+}
+
+func (l *local) RestoreUser(id string) error {
+	return l.db.RestoreUser(id)
+}
+
+func (l *local) ResetPassword(id, password string) error {
+	u, err := l.db.GetUser(id)
+	if err != nil {
+		return err
+	}
+	user.SetPassword(&u, password)
+	if err := l.db.UpdateUser(&u, 0); err != nil {
+		return err
+	}
+	e, err := user.NewEvent(user.EventUserUpdated, id, u.EventPayload())
+	if err != nil {
+		return err
+	}
+	e.Actor = actor
+	return l.db.AppendEvent(&e)
+}
+
+func (l *local) Health() ([]user.Health, error) {
+	now := time.Now().UTC()
+	status := user.HealthOK
+	if err := l.db.Ping(); err != nil {
+		status = user.HealthError
+	}
+	return []user.Health{{Service: "user-db", Status: status, Time: now}}, nil
+}
+
+func (l *local) EnsureIndexes() error {
+	return l.all.EnsureIndexes()
+}
+
+func (l *local) Reencrypt() (int, error) {
+	return l.all.Reencrypt()
+}
+
+func (l *local) Import(in io.Reader, format, columns string, dryRun bool, skip int, checkpoint func(int)) (user.ImportReport, error) {
+	mapping, err := user.ParseColumns(columns)
+	if err != nil {
+		return user.ImportReport{}, err
+	}
+	r, err := user.NewBulkReader(in, format, mapping)
+	if err != nil {
+		return user.ImportReport{}, err
+	}
+	return user.ImportUsers(l.db, r, user.ImportOptions{DryRun: dryRun, Skip: skip, OnCheckpoint: checkpoint})
+}
+
+func (l *local) Export(out io.Writer, format string, passwords bool) error {
+	w, err := user.NewBulkWriter(out, format)
+	if err != nil {
+		return err
+	}
+	_, err = user.ExportUsers(l.db, w, passwords)
+	return err
+}
+
+// remote operates through the HTTP API of a running instance, with the
+// admin token, on the given tenant if any.
+type remote struct {
+	user.Service
+	base   string
+	client *http.Client
+	token  string
+	tenant string
+}
+
+func newRemote(instance, token, tenant string) (*remote, error) {
+	if !strings.Contains(instance, "://") {
+		instance = "http://" + instance
+	}
+	hc := &http.Client{Timeout: 10 * time.Second}
+	options := []client.Option{client.HTTPClient(hc)}
+	if token != "" {
+		options = append(options, client.BearerToken(token))
+	}
+	if tenant != "" {
+		options = append(options, client.Tenant(tenant))
+	}
+	svc, err := client.New(instance, options...)
+	if err != nil {
+		return nil, err
+	}
+	return &remote{Service: svc, base: strings.TrimSuffix(instance, "/"), client: hc, token: token, tenant: tenant}, nil
+}
+
+func (r *remote) RestoreUser(id string) error {
+	return r.do("POST", "/customers/"+id+"/restore", "application/json", nil, nil)
+}
+
+// ResetPassword goes through SCIM, the only API replacing a password.
+func (r *remote) ResetPassword(id, password string) error {
+	patch := map[string]interface{}{
+		"schemas": []string{"urn:ietf:params:scim:api:messages:2.0:PatchOp"},
+		"Operations": []map[string]string{
+			{"op": "replace", "path": "password", "value": password},
+		},
+	}
+	return r.do("PATCH", "/scim/v2/Users/"+id, "application/scim+json", patch, nil)
+}
+
+func (r *remote) Health() ([]user.Health, error) {
+	var resp struct {
+		Health []user.Health `json:"health"`
+	}
+	err := r.do("GET", "/health", "", nil, &resp)
+	if e, ok := err.(*remoteError); ok && e.status == http.StatusServiceUnavailable {
+		json.Unmarshal(e.body, &resp)
+		err = nil
+	}
+	return resp.Health, err
+}
+
+// Import sends in as it is read. The service answers once it is done, so
+// the checkpoint is only known at the end.
+func (r *remote) Import(in io.Reader, format, columns string, dryRun bool, skip int, checkpoint func(int)) (user.ImportReport, error) {
+	q := url.Values{"format": {format}, "skip": {strconv.Itoa(skip)}, "dryRun": {strconv.FormatBool(dryRun)}}
+	if columns != "" {
+		q.Set("columns", columns)
+	}
+	var report user.ImportReport
+	resp, err := r.send("POST", "/bulk/customers?"+q.Encode(), user.BulkContentType(format), in)
+	if err != nil {
+		return report, err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return report, err
+	}
+	checkpoint(report.Checkpoint)
+	return report, nil
+}
+
+func (r *remote) Export(out io.Writer, format string, passwords bool) error {
+	q := url.Values{"format": {format}, "passwords": {strconv.FormatBool(passwords)}}
+	resp, err := r.send("GET", "/bulk/customers?"+q.Encode(), "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(out, resp.Body)
+	return err
+}
+
+func (r *remote) EnsureIndexes() error {
+	return fmt.Errorf("indexes can only be created on the database, run without -url")
+}
+
+func (r *remote) Reencrypt() (int, error) {
+	return 0, fmt.Errorf("records can only be re-encrypted on the database, run without -url")
+}
+
+// remoteError is an error answered by the service.
+type remoteError struct {
+	status int
+	body   []byte
+}
+
+func (e *remoteError) Error() string {
+	var body struct {
+		Error  string `json:"error"`
+		Detail string `json:"detail"`
+	}
+	if json.Unmarshal(e.body, &body) == nil && body.Error+body.Detail != "" {
+		return fmt.Sprintf("%d %s", e.status, body.Error+body.Detail)
+	}
+	return fmt.Sprintf("%d %s", e.status, http.StatusText(e.status))
+}
+
+// do sends in, if any, as contentType and reads the answer into out, if
+// any.
+func (r *remote) do(method, path, contentType string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	resp, err := r.send(method, path, contentType, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// send sends body, if any, as contentType and returns the answer unless it
+// is an error. Bulk requests stream for as long as they take, so they are
+// not held to the client's timeout.
+func (r *remote) send(method, path, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, r.base+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+	if r.tenant != "" {
+		req.Header.Set(user.TenantHeader, r.tenant)
+	}
+	hc := r.client
+	if strings.HasPrefix(path, "/bulk/") {
+		unlimited := *r.client
+		unlimited.Timeout = 0
+		hc = &unlimited
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		return nil, &remoteError{status: resp.StatusCode, body: b}
+	}
+	return resp, nil
+}
@@ -0,0 +1,554 @@
+// Command userctl operates the user service: it manages users and their
+// addresses, rotates the signing key and checks health, either on the
+// database directly or through the HTTP API of a running instance.
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/go-kit/kit/log"
+	"github.com/user"
+	db "github.com/user/dbOperations"
+)
+
+var (
+	instance  string
+	token     string
+	format    string
+	keyfile   string
+	encrypted string
+	tenant    string
+)
+
+var nopLogger = log.NewNopLogger()
+
+func init() {
+	flag.StringVar(&instance, "url", os.Getenv("USER_URL"), "User service to operate through its API, e.g. http://user:8084; the database is used directly when empty")
+	flag.StringVar(&token, "token", os.Getenv("USER_ADMIN_TOKEN"), "Admin token of the user service, for -url")
+	flag.StringVar(&tenant, "tenant", os.Getenv("USER_TENANT"), "Tenant whose users to operate on, the default tenant when empty")
+	flag.StringVar(&format, "o", "table", "Output format, table or json")
+	flag.StringVar(&keyfile, "encryption-keys", os.Getenv("USER_ENCRYPTION_KEYS"), "JSON keyfile of the master keys encrypting personal fields, as given to the service")
+	flag.StringVar(&encrypted, "encrypted-fields", strings.Join(db.DefaultEncryptedFields, ","), "Fields encrypted at rest, as given to the service")
+	flag.Usage = usage
+}
+
+// command runs a subcommand with its arguments. Offline commands get no
+// backend.
+type command struct {
+	name, args, help string
+	offline          bool
+	run              func(b backend, args []string) error
+}
+
+// errArgs reports a command called with the wrong arguments.
+var errArgs = errors.New("wrong arguments")
+
+var commands = []command{
+	{"list", "", "List users", false, list},
+	{"search", "<text>", "List users whose username, email or name contains text", false, search},
+	{"create", "-username <name> [-password <pw>] [-email ...] [-first ...] [-last ...] [-phone ...]", "Create a user; a password is generated when none is given", false, create},
+	{"disable", "<user-id>", "Disable a user; it can no longer log in and can be unlocked until it is purged", false, disable},
+	{"unlock", "<user-id>", "Let a disabled user log in again", false, unlock},
+	{"reset-password", "<user-id> [password]", "Replace a user's password; one is generated when none is given", false, resetPassword},
+	{"add-address", "<user-id> [-street ...] [-number ...] [-city ...] [-postcode ...] [-country ...]", "Add an address to a user", false, addAddress},
+	{"remove-address", "<user-id> <address-id>", "Remove an address from a user", false, removeAddress},
+	{"import", "[-format csv|ndjson] [-columns <header=field,...>] [-dry-run] [-checkpoint <file>] <file|->", "Import users and their addresses; with -checkpoint an interrupted import resumes where it stopped", false, importUsers},
+	{"export", "[-format csv|ndjson] [-passwords] [-out <file>]", "Export users and their addresses; -passwords includes the password hashes, to import them elsewhere", false, exportUsers},
+	{"rotate-key", "-out <file>", "Write a new signing key for ID and access tokens", true, rotateKey},
+	{"rotate-master-key", "[-keys <file>] [-retire]", "Add a master key for new data keys, creating the keyfile if needed; -retire drops former keys once reencrypt has moved every record", true, rotateMasterKey},
+	{"reencrypt", "", "Encrypt the records not yet under the current master key and fields", false, reencrypt},
+	{"ensure-indexes", "", "Create the database indexes", false, ensureIndexes},
+	{"health", "", "Print the health of the service and its database", false, health},
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: userctl [flags] <command> [args]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(out, "  %s %s\n    \t%s\n", c.name, c.args, c.help)
+	}
+	fmt.Fprintf(out, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	if format != "table" && format != "json" {
+		fail(fmt.Errorf("unknown output format %q", format))
+	}
+	name, args := flag.Arg(0), flag.Args()[1:]
+	for _, c := range commands {
+		if c.name != name {
+			continue
+		}
+		var b backend
+		var err error
+		switch {
+		case c.offline:
+		case instance != "":
+			b, err = newRemote(instance, token, tenant)
+		default:
+			b, err = newLocal(tenant)
+		}
+		if err == nil {
+			err = c.run(b, args)
+		}
+		if err == errArgs {
+			err = fmt.Errorf("usage: userctl %s %s", c.name, c.args)
+		}
+		if err != nil {
+			fail(err)
+		}
+		return
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+	usage()
+	os.Exit(2)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "userctl:", err)
+	os.Exit(1)
+}
+
+// output writes v as JSON, or as a table of header and the rows of v.
+func output(v interface{}, header []string, rows [][]string) error {
+	if format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+func outputUsers(users []db.User) error {
+	rows := make([][]string, 0, len(users))
+	for _, u := range users {
+		rows = append(rows, []string{u.UserID, u.Username, u.Email, u.FirstName, u.LastName, u.Phone})
+	}
+	return output(users, []string{"ID", "USERNAME", "EMAIL", "FIRST NAME", "LAST NAME", "PHONE"}, rows)
+}
+
+// outputResult writes the outcome of a change.
+func outputResult(v interface{}, message string) error {
+	if format == "json" {
+		return output(v, nil, nil)
+	}
+	_, err := fmt.Println(message)
+	return err
+}
+
+func list(b backend, args []string) error {
+	if len(args) != 0 {
+		return errArgs
+	}
+	users, err := b.GetUsers()
+	if err != nil {
+		return err
+	}
+	return outputUsers(users)
+}
+
+func search(b backend, args []string) error {
+	if len(args) != 1 {
+		return errArgs
+	}
+	users, err := b.GetUsers()
+	if err != nil {
+		return err
+	}
+	text := strings.ToLower(args[0])
+	found := make([]db.User, 0)
+	for _, u := range users {
+		for _, field := range []string{u.Username, u.Email, u.FirstName, u.LastName} {
+			if strings.Contains(strings.ToLower(field), text) {
+				found = append(found, u)
+				break
+			}
+		}
+	}
+	return outputUsers(found)
+}
+
+func create(b backend, args []string) error {
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	var u db.User
+	fs.StringVar(&u.Username, "username", "", "Username")
+	fs.StringVar(&u.Password, "password", "", "Password, generated when empty")
+	fs.StringVar(&u.Email, "email", "", "Email address")
+	fs.StringVar(&u.FirstName, "first", "", "First name")
+	fs.StringVar(&u.LastName, "last", "", "Last name")
+	fs.StringVar(&u.Phone, "phone", "", "Phone number")
+	fs.Parse(args)
+	if u.Username == "" || fs.NArg() != 0 {
+		return errArgs
+	}
+	generated := u.Password == ""
+	if generated {
+		var err error
+		if u.Password, err = newPassword(); err != nil {
+			return err
+		}
+	}
+	password := u.Password
+	created, err := b.PostUser(u)
+	if err != nil {
+		return err
+	}
+	result := map[string]string{"id": created.UserID}
+	message := "created user " + created.UserID
+	if generated {
+		result["password"] = password
+		message += " with password " + password
+	}
+	return outputResult(result, message)
+}
+
+func disable(b backend, args []string) error {
+	if len(args) != 1 {
+		return errArgs
+	}
+	if err := b.DeleteUser(args[0], actor, 0); err != nil {
+		return err
+	}
+	return outputResult(map[string]string{"id": args[0]}, "disabled user "+args[0])
+}
+
+func unlock(b backend, args []string) error {
+	if len(args) != 1 {
+		return errArgs
+	}
+	if err := b.RestoreUser(args[0]); err != nil {
+		return err
+	}
+	return outputResult(map[string]string{"id": args[0]}, "unlocked user "+args[0])
+}
+
+func resetPassword(b backend, args []string) error {
+	if len(args) != 1 && len(args) != 2 {
+		return errArgs
+	}
+	result := map[string]string{"id": args[0]}
+	message := "reset the password of user " + args[0]
+	var password string
+	if len(args) == 2 {
+		password = args[1]
+	} else {
+		var err error
+		if password, err = newPassword(); err != nil {
+			return err
+		}
+		result["password"] = password
+		message += " to " + password
+	}
+	if err := b.ResetPassword(args[0], password); err != nil {
+		return err
+	}
+	return outputResult(result, message)
+}
+
+func addAddress(b backend, args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return errArgs
+	}
+	userid := args[0]
+	fs := flag.NewFlagSet("add-address", flag.ExitOnError)
+	var a db.Address
+	fs.StringVar(&a.Street, "street", "", "Street")
+	fs.StringVar(&a.Number, "number", "", "House number")
+	fs.StringVar(&a.City, "city", "", "City")
+	fs.StringVar(&a.PostCode, "postcode", "", "Post code")
+	fs.StringVar(&a.Country, "country", "", "Country")
+	fs.StringVar(&a.ExtraInfo, "extra", "", "Extra information")
+	fs.Parse(args[1:])
+	if fs.NArg() != 0 {
+		return errArgs
+	}
+	id, err := b.PostAddress(a, userid)
+	if err != nil {
+		return err
+	}
+	return outputResult(map[string]string{"id": id, "userId": userid}, "added address "+id+" to user "+userid)
+}
+
+func removeAddress(b backend, args []string) error {
+	if len(args) != 2 {
+		return errArgs
+	}
+	if err := b.DeleteAddress(args[1], args[0], actor, 0); err != nil {
+		return err
+	}
+	return outputResult(map[string]string{"id": args[1], "userId": args[0]}, "removed address "+args[1]+" from user "+args[0])
+}
+
+func ensureIndexes(b backend, args []string) error {
+	if len(args) != 0 {
+		return errArgs
+	}
+	if err := b.EnsureIndexes(); err != nil {
+		return err
+	}
+	return outputResult(map[string]bool{"status": true}, "indexes are in place")
+}
+
+func health(b backend, args []string) error {
+	if len(args) != 0 {
+		return errArgs
+	}
+	hs, err := b.Health()
+	if err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(hs))
+	healthy := true
+	for _, h := range hs {
+		rows = append(rows, []string{h.Service, h.Status, h.Time.Format("2006-01-02T15:04:05Z07:00")})
+		healthy = healthy && h.Status == user.HealthOK
+	}
+	if err := output(hs, []string{"SERVICE", "STATUS", "TIME"}, rows); err != nil {
+		return err
+	}
+	if !healthy {
+		return errors.New("unhealthy")
+	}
+	return nil
+}
+
+// bulkFormat returns the format of a file by its name, NDJSON unless it
+// ends in .csv.
+func bulkFormat(name string) string {
+	if strings.EqualFold(filepath.Ext(name), ".csv") {
+		return user.FormatCSV
+	}
+	return user.FormatNDJSON
+}
+
+// importUsers keeps the number of records settled in the -checkpoint file
+// while it runs, reads it back to resume, and removes it once the import
+// is through.
+func importUsers(b backend, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	as := fs.String("format", "", "Format of the file, csv or ndjson; taken from its name when empty")
+	columns := fs.String("columns", "", "CSV header names of the fields, e.g. Login=username,E-Mail=email")
+	dryRun := fs.Bool("dry-run", false, "Only validate and report")
+	checkpoint := fs.String("checkpoint", "", "File keeping how far the import got")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errArgs
+	}
+	in := io.Reader(os.Stdin)
+	if name := fs.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	if *as == "" {
+		*as = bulkFormat(fs.Arg(0))
+	}
+	skip := 0
+	if *checkpoint != "" {
+		data, err := ioutil.ReadFile(*checkpoint)
+		if err == nil {
+			if skip, err = strconv.Atoi(strings.TrimSpace(string(data))); err != nil {
+				return fmt.Errorf("checkpoint %s: %v", *checkpoint, err)
+			}
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	var saveErr error
+	save := func(n int) {
+		if *checkpoint != "" && !*dryRun && saveErr == nil {
+			saveErr = ioutil.WriteFile(*checkpoint, []byte(strconv.Itoa(n)+"\n"), 0644)
+		}
+	}
+	report, err := b.Import(in, *as, *columns, *dryRun, skip, save)
+	if err == nil {
+		err = saveErr
+	}
+	if err != nil {
+		return err
+	}
+	if *checkpoint != "" && !*dryRun {
+		if err := os.Remove(*checkpoint); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if format == "json" {
+		return output(report, nil, nil)
+	}
+	if len(report.Errors) > 0 {
+		rows := make([][]string, 0, len(report.Errors))
+		for _, e := range report.Errors {
+			rows = append(rows, []string{strconv.Itoa(e.Record), e.Username, e.Reason})
+		}
+		if err := output(report, []string{"RECORD", "USERNAME", "ERROR"}, rows); err != nil {
+			return err
+		}
+	}
+	verb := "imported"
+	if report.DryRun {
+		verb = "would import"
+	}
+	_, err = fmt.Printf("%s %d users, %d failed, %d skipped\n", verb, report.Imported, report.Failed, report.Skipped)
+	return err
+}
+
+func exportUsers(b backend, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	as := fs.String("format", "", "Format of the export, csv or ndjson; taken from -out when empty")
+	passwords := fs.Bool("passwords", false, "Include the password hashes")
+	out := fs.String("out", "", "File to write, standard output when empty")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errArgs
+	}
+	if *as == "" {
+		*as = bulkFormat(*out)
+	}
+	if *out == "" {
+		return b.Export(os.Stdout, *as, *passwords)
+	}
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := b.Export(f, *as, *passwords); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return outputResult(map[string]string{"file": *out}, "exported users to "+*out)
+}
+
+// rotateKey writes a new signing key to the file given with -out, keeping
+// the key it replaces next to it. The key is a file of the service, not
+// kept in the database; the service picks it up when restarted with
+// -oidc-key, and tokens signed with the old key are no longer accepted.
+func rotateKey(_ backend, args []string) error {
+	fs := flag.NewFlagSet("rotate-key", flag.ExitOnError)
+	out := fs.String("out", os.Getenv("USER_OIDC_KEY"), "PEM file of the signing key")
+	bits := fs.Int("bits", 2048, "Size of the RSA key")
+	fs.Parse(args)
+	if *out == "" || fs.NArg() != 0 {
+		return errArgs
+	}
+	key, err := rsa.GenerateKey(rand.Reader, *bits)
+	if err != nil {
+		return err
+	}
+	if old, err := ioutil.ReadFile(*out); err == nil {
+		if err := ioutil.WriteFile(*out+".previous", old, 0600); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if _, err := user.ParseSigningKey(data); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(*out, data, 0600); err != nil {
+		return err
+	}
+	return outputResult(map[string]string{"key": *out}, "wrote a new signing key to "+*out+", restart the service with -oidc-key "+*out)
+}
+
+// rotateMasterKey adds a master key to the keyfile and makes it current.
+// The service re-encrypts the records under it once restarted. Running
+// reencrypt before every instance is restarted leaves records under a key
+// the instances do not have yet.
+func rotateMasterKey(_ backend, args []string) error {
+	fs := flag.NewFlagSet("rotate-master-key", flag.ExitOnError)
+	file := fs.String("keys", keyfile, "Keyfile to rotate")
+	retire := fs.Bool("retire", false, "Remove the former master keys instead")
+	fs.Parse(args)
+	if *file == "" || fs.NArg() != 0 {
+		return errArgs
+	}
+	var keys *db.Keyring
+	data, err := ioutil.ReadFile(*file)
+	switch {
+	case err == nil:
+		if keys, err = db.ParseKeyring(data); err != nil {
+			return err
+		}
+	case os.IsNotExist(err) && !*retire:
+		if keys, err = db.NewKeyring(); err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+	message := "created " + *file + " with master key " + keys.Current
+	if *retire {
+		for name := range keys.Keys {
+			if name != keys.Current {
+				delete(keys.Keys, name)
+			}
+		}
+		message = "removed the master keys but " + keys.Current + " from " + *file
+	} else if data != nil {
+		name, err := keys.Rotate()
+		if err != nil {
+			return err
+		}
+		message = "added master key " + name + " to " + *file + ", restart the service to re-encrypt the records under it"
+	}
+	if data, err = json.MarshalIndent(keys, "", "  "); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(*file, data, 0600); err != nil {
+		return err
+	}
+	return outputResult(map[string]string{"keys": *file, "current": keys.Current}, message)
+}
+
+func reencrypt(b backend, args []string) error {
+	if len(args) != 0 {
+		return errArgs
+	}
+	n, err := b.Reencrypt()
+	if err != nil {
+		return err
+	}
+	return outputResult(map[string]int{"reencrypted": n}, fmt.Sprintf("re-encrypted %d records", n))
+}
+
+// newPassword returns a random password to hand to a user.
+func newPassword() (string, error) {
+	b := make([]byte, 12)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
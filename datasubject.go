@@ -0,0 +1,224 @@
+package user
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/user/dbOperations"
+)
+
+// DataSubjectStore holds what is needed to answer data subject requests:
+// exporting all data about a user and erasing it. *dbOperations.Mongo
+// implements it.
+type DataSubjectStore interface {
+	AuditLog
+	GetUserRecord(id string) (dbOperations.User, error)
+	CreateErasure(e *dbOperations.Erasure) error
+	GetErasures(userid string) ([]dbOperations.Erasure, error)
+	GetDueErasures(now time.Time) ([]dbOperations.Erasure, error)
+	CancelErasure(userid string) (dbOperations.Erasure, error)
+	EraseUser(e *dbOperations.Erasure) error
+	GetAcceptances(userid string) ([]dbOperations.Acceptance, error)
+	GetConsents(userID string) ([]dbOperations.Consent, error)
+}
+
+// DataSubjectEndpoints mounts the admin-only export and erasure endpoints.
+// Erasures are carried out once grace has passed, by PurgeErasures, or
+// right away if grace is zero. Users with a pending erasure cannot log in.
+func DataSubjectEndpoints(e Endpoints, st DataSubjectStore, grace time.Duration) Endpoints {
+	admin := RequireRole(RoleAdmin)
+	e.LoginEndpoint = refusePendingErasure(st)(e.LoginEndpoint)
+	e.ExportEndpoint = admin(MakeExportEndpoint(st))
+	e.ErasurePostEndpoint = admin(MakeErasurePostEndpoint(st, grace))
+	e.ErasureGetEndpoint = admin(MakeErasureGetEndpoint(st))
+	e.ErasureDeleteEndpoint = admin(MakeErasureDeleteEndpoint(st))
+	return e
+}
+
+// refusePendingErasure fails logins of users who are about to be erased.
+func refusePendingErasure(st DataSubjectStore) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			response, err := next(ctx, request)
+			if err != nil {
+				return response, err
+			}
+			erasures, err := st.GetErasures(response.(userResponse).User.UserID)
+			if err != nil {
+				return nil, err
+			}
+			if len(erasures) > 0 && erasures[0].Status == dbOperations.ErasurePending {
+				return nil, ErrUnauthorized
+			}
+			return response, nil
+		}
+	}
+}
+
+// MakeExportEndpoint returns an endpoint collecting all data held about a
+// user, including what they have deleted but is not yet purged.
+func MakeExportEndpoint(st DataSubjectStore) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(dataSubjectRequest)
+		u, err := st.GetUserRecord(req.UserID)
+		if err != nil {
+			return nil, err
+		}
+		audit, _, err := st.GetAudit(dbOperations.AuditFilter{Subjects: []string{u.UserID, u.Username}})
+		if err != nil {
+			return nil, err
+		}
+		erasures, err := st.GetErasures(req.UserID)
+		if err != nil {
+			return nil, err
+		}
+		acceptances, err := st.GetAcceptances(req.UserID)
+		if err != nil {
+			return nil, err
+		}
+		sessions, err := st.GetConsents(req.UserID)
+		if err != nil {
+			return nil, err
+		}
+		return exportResponse{
+			ExportedAt: time.Now().UTC(),
+			User: exportUser{
+				ID:        u.UserID,
+				Username:  u.Username,
+				Email:     u.Email,
+				FirstName: u.FirstName,
+				LastName:  u.LastName,
+				Phone:     u.Phone,
+
+				Preferences: u.Preferences,
+				Attributes:  u.Attributes,
+			},
+			Addresses:   u.Addresses,
+			Audit:       audit,
+			Erasures:    erasures,
+			Acceptances: acceptances,
+			Sessions:    sessions,
+		}, nil
+	}
+}
+
+// MakeErasurePostEndpoint returns an endpoint scheduling the erasure of a
+// user grace from now. A second request returns the pending receipt.
+func MakeErasurePostEndpoint(st DataSubjectStore, grace time.Duration) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(dataSubjectRequest)
+		if _, err := st.GetUserRecord(req.UserID); err != nil {
+			return nil, err
+		}
+		erasures, err := st.GetErasures(req.UserID)
+		if err != nil {
+			return nil, err
+		}
+		if len(erasures) > 0 && erasures[0].Status == dbOperations.ErasurePending {
+			return erasures[0], nil
+		}
+		now := time.Now().UTC()
+		e := dbOperations.Erasure{
+			UserID:      req.UserID,
+			RequestedBy: actorFor(ctx, request),
+			RequestedAt: now,
+			EraseAfter:  now.Add(grace),
+			Status:      dbOperations.ErasurePending,
+		}
+		if err := st.CreateErasure(&e); err != nil {
+			return nil, err
+		}
+		if grace <= 0 {
+			err = st.EraseUser(&e)
+		}
+		return e, err
+	}
+}
+
+// MakeErasureGetEndpoint returns an endpoint listing a user's erasure
+// receipts, which remain after the user is gone.
+func MakeErasureGetEndpoint(st DataSubjectStore) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(dataSubjectRequest)
+		erasures, err := st.GetErasures(req.UserID)
+		return EmbedStruct{erasuresResponse{Erasures: erasures}}, err
+	}
+}
+
+// MakeErasureDeleteEndpoint returns an endpoint cancelling a pending
+// erasure.
+func MakeErasureDeleteEndpoint(st DataSubjectStore) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(dataSubjectRequest)
+		return st.CancelErasure(req.UserID)
+	}
+}
+
+// PurgeErasures carries out the erasures whose grace period has passed
+// and records each in the audit log. It returns the number carried out.
+func PurgeErasures(st DataSubjectStore, logger log.Logger) (int, error) {
+	due, err := st.GetDueErasures(time.Now())
+	if err != nil {
+		return 0, err
+	}
+	for i := range due {
+		e := &due[i]
+		entry := dbOperations.AuditEntry{
+			Time:    time.Now(),
+			Actor:   "system",
+			Action:  "user.erase",
+			Target:  e.Pseudonym(),
+			Outcome: outcomeSuccess,
+		}
+		err := st.EraseUser(e)
+		if err != nil {
+			entry.Outcome = outcomeFailure
+			entry.Error = err.Error()
+		}
+		if aerr := st.AppendAudit(&entry); aerr != nil {
+			logger.Log("audit", entry.Action, "target", entry.Target, "err", aerr)
+		}
+		if err != nil {
+			return i, err
+		}
+		logger.Log("erasure", e.ID, "addresses", e.AddressesRemoved, "audit", e.AuditEntriesAnonymised)
+	}
+	return len(due), nil
+}
+
+type dataSubjectRequest struct {
+	UserID string
+}
+
+// exportUser is User with the fields it hides from JSON that belong to the
+// user. The password hash and salt are not part of an export.
+type exportUser struct {
+	ID        string `json:"id"`
+	Username  string `json:"username"`
+	Email     string `json:"email"`
+	FirstName string `json:"firstName"`
+	LastName  string `json:"lastName"`
+	Phone     string `json:"phone"`
+
+	Preferences dbOperations.Preferences `json:"preferences"`
+	Attributes  map[string]interface{}   `json:"attributes,omitempty"`
+}
+
+type exportResponse struct {
+	ExportedAt  time.Time                 `json:"exportedAt"`
+	User        exportUser                `json:"user"`
+	Addresses   []dbOperations.Address    `json:"addresses"`
+	Audit       []dbOperations.AuditEntry `json:"audit"`
+	Erasures    []dbOperations.Erasure    `json:"erasures"`
+	Acceptances []dbOperations.Acceptance `json:"acceptances"`
+	// Sessions are the relying parties the user signed in to through the
+	// OIDC provider, with the scopes granted. The tokens issued are not
+	// kept, and there are no other sessions.
+	Sessions []dbOperations.Consent `json:"sessions"`
+}
+
+type erasuresResponse struct {
+	Erasures []dbOperations.Erasure `json:"erasure"`
+}
@@ -0,0 +1,165 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/user/dbOperations"
+)
+
+const testUserID = "57a98d98e4b00679b4a830af"
+
+func adminRequest(method, path string) *http.Request {
+	r := httptest.NewRequest(method, path, nil)
+	r.Header.Set("Authorization", "Bearer "+testAdminToken)
+	return r
+}
+
+func TestExport(t *testing.T) {
+	svc := newStubService()
+	svc.users[testUserID] = func(u dbOperations.User) dbOperations.User {
+		u.Email = "eve@example.com"
+		return u
+	}(svc.users[testUserID])
+	e, st := newTestEndpoints(svc)
+	router := MakeHTTPHandler(context.Background(), e, log.NewNopLogger())
+	st.consents[testUserID+" shop"] = dbOperations.Consent{UserID: testUserID, ClientID: "shop", Scope: []string{"openid"}, GrantedAt: time.Now()}
+
+	login := httptest.NewRequest("GET", "/login", nil)
+	login.SetBasicAuth("eve", "secret")
+	router.ServeHTTP(httptest.NewRecorder(), login)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("GET", "/customers/"+testUserID+"/export"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if cd := w.Header().Get("Content-Disposition"); !strings.Contains(cd, "attachment") {
+		t.Errorf("expected a download, got %q", cd)
+	}
+	var export exportResponse
+	if err := json.NewDecoder(w.Body).Decode(&export); err != nil {
+		t.Fatal(err)
+	}
+	if export.User.Email != "eve@example.com" || len(export.Addresses) != 1 || len(export.Sessions) != 1 {
+		t.Errorf("unexpected export %+v", export)
+	}
+	// The login, and the export itself is only recorded once it is done.
+	if len(export.Audit) != 1 || export.Audit[0].Action != "login" {
+		t.Errorf("expected the login in the export, got %+v", export.Audit)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/customers/"+testUserID+"/export", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a token, got %d", w.Code)
+	}
+}
+
+func TestErasure(t *testing.T) {
+	svc := newStubService()
+	e, st := newTestEndpoints(svc)
+	router := MakeHTTPHandler(context.Background(), e, log.NewNopLogger())
+	loginCode := func() int {
+		r := httptest.NewRequest("GET", "/login", nil)
+		r.SetBasicAuth("eve", "secret")
+		r.RemoteAddr = "198.51.100.1:1234"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := loginCode(); code != http.StatusOK {
+		t.Fatalf("expected login to succeed, got %d", code)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("POST", "/customers/"+testUserID+"/erasure"))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", w.Code, w.Body)
+	}
+	var receipt dbOperations.Erasure
+	json.NewDecoder(w.Body).Decode(&receipt)
+	if receipt.Status != dbOperations.ErasurePending || receipt.RequestedBy != "admin" {
+		t.Errorf("unexpected receipt %+v", receipt)
+	}
+	if d := receipt.EraseAfter.Sub(receipt.RequestedAt); d != testErasureGrace {
+		t.Errorf("expected a grace period of %v, got %v", testErasureGrace, d)
+	}
+	if code := loginCode(); code != http.StatusUnauthorized {
+		t.Errorf("expected login to be refused while erasure is pending, got %d", code)
+	}
+
+	// Cancelling restores access; a second cancel has nothing to cancel.
+	for _, code := range []int{http.StatusOK, http.StatusNotFound} {
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, adminRequest("DELETE", "/customers/"+testUserID+"/erasure"))
+		if w.Code != code {
+			t.Errorf("expected %d, got %d", code, w.Code)
+		}
+	}
+	if code := loginCode(); code != http.StatusOK {
+		t.Errorf("expected login to succeed after cancelling, got %d", code)
+	}
+
+	router.ServeHTTP(httptest.NewRecorder(), adminRequest("POST", "/customers/"+testUserID+"/erasure"))
+	if n, _ := PurgeErasures(st, log.NewNopLogger()); n != 0 {
+		t.Errorf("expected nothing due during the grace period, purged %d", n)
+	}
+	st.erasures[1].EraseAfter = time.Now().Add(-time.Second)
+	if n, err := PurgeErasures(st, log.NewNopLogger()); n != 1 || err != nil {
+		t.Fatalf("expected one erasure, purged %d: %v", n, err)
+	}
+
+	if _, ok := svc.users[testUserID]; ok {
+		t.Error("expected the user to be removed")
+	}
+	if len(svc.addresses) != 0 {
+		t.Error("expected the addresses to be removed")
+	}
+	pseudonym := st.erasures[1].Pseudonym()
+	for _, entry := range st.entries {
+		if entry.Actor == "eve" || entry.Target == testUserID || entry.ClientIP == "198.51.100.1" {
+			t.Errorf("entry %d still refers to the user: %+v", entry.Seq, entry)
+		}
+	}
+	if last := st.entries[len(st.entries)-1]; last.Action != "user.erase" || last.Target != pseudonym {
+		t.Errorf("expected the erasure to be audited, got %+v", last)
+	}
+	if err := dbOperations.VerifyAuditChain(st.entries); err != nil {
+		t.Errorf("anonymising broke the audit chain: %v", err)
+	}
+	for i, entry := range st.entries {
+		if entry.Redacted == nil {
+			continue
+		}
+		// A redacted field cannot be replaced, nor its redaction undone.
+		for _, tamper := range []func(e *dbOperations.AuditEntry){
+			func(e *dbOperations.AuditEntry) { e.Actor = "mallory" },
+			func(e *dbOperations.AuditEntry) { e.ClientIP = "192.0.2.66" },
+			func(e *dbOperations.AuditEntry) { e.RedactedIn = 0 },
+		} {
+			entries := append([]dbOperations.AuditEntry(nil), st.entries...)
+			tamper(&entries[i])
+			if err := dbOperations.VerifyAuditChain(entries); err == nil {
+				t.Errorf("expected tampering with redacted entry %d to be detected", entry.Seq)
+			}
+		}
+		break
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("GET", "/customers/"+testUserID+"/erasure"))
+	var resp struct {
+		Embed erasuresResponse `json:"_embedded"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	if len(resp.Embed.Erasures) != 2 || resp.Embed.Erasures[0].Status != dbOperations.ErasureCompleted {
+		t.Errorf("unexpected receipts %+v", resp.Embed.Erasures)
+	}
+}
@@ -0,0 +1,180 @@
+package dbOperations
+
+import (
+	"errors"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The types of an address, which are also what a user has a default
+// address for.
+const (
+	AddressShipping = "shipping"
+	AddressBilling  = "billing"
+)
+
+// AddressTypes are the types an address can have.
+var AddressTypes = []string{AddressShipping, AddressBilling}
+
+var (
+	// ErrAddressType is returned when an address is made the default for
+	// what it is not used for.
+	ErrAddressType = errors.New("Address is not of that type")
+)
+
+// Serves reports whether a is used for typ.
+func (a Address) Serves(typ string) bool {
+	if len(a.Types) == 0 {
+		return true
+	}
+	for _, t := range a.Types {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultAddress returns current if it is the id of one of addrs serving
+// typ, or else the id of the first that does, or "" if none does.
+func defaultAddress(current, typ string, addrs []Address) string {
+	first := ""
+	for _, a := range addrs {
+		if !a.Serves(typ) {
+			continue
+		}
+		if a.ID == current {
+			return current
+		}
+		if first == "" {
+			first = a.ID
+		}
+	}
+	return first
+}
+
+// defaultFields are the bson fields of the defaults of a user by type.
+var defaultFields = map[string]string{
+	AddressShipping: "defaultShipping",
+	AddressBilling:  "defaultBilling",
+}
+
+// defaults returns the default of u for each type.
+func defaults(u *User) map[string]*string {
+	return map[string]*string{
+		AddressShipping: &u.DefaultShipping,
+		AddressBilling:  &u.DefaultBilling,
+	}
+}
+
+// liveAddresses returns the live addresses of dbu, in the order they were
+// added, with their ids and types only.
+func liveAddresses(s *mgo.Session, dbu DBUser) ([]Address, error) {
+	var found []DBAddress
+	q := live(bson.M{"_id": bson.M{"$in": dbu.AddressIDs}})
+	if err := s.DB("").C("addresses").Find(q).Select(bson.M{"_id": 1, "types": 1}).All(&found); err != nil {
+		return nil, err
+	}
+	byID := make(map[bson.ObjectId]Address, len(found))
+	for _, dba := range found {
+		dba.Address.ID = dba.ID.Hex()
+		byID[dba.ID] = dba.Address
+	}
+	addrs := make([]Address, 0, len(found))
+	for _, id := range dbu.AddressIDs {
+		if a, ok := byID[id]; ok {
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs, nil
+}
+
+// SetDefaultAddresses makes the addresses with the given ids the user's
+// default for shipping and for billing, leaving a default as it is when
+// its id is empty. If version is not 0, the user must still be at that
+// version. It returns the user's new version. An address the user does
+// not have is reported as mgo.ErrNotFound, one that is not used for what
+// it is made the default for as ErrAddressType.
+func (m *Mongo) SetDefaultAddresses(userid, shipping, billing string, version int64) (int64, error) {
+	if !bson.IsObjectIdHex(userid) {
+		return 0, ErrInvalidHexID
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB("").C("users")
+	var dbu DBUser
+	if err := c.Find(live(m.scope(bson.M{"_id": bson.ObjectIdHex(userid)}))).One(&dbu); err != nil {
+		return 0, err
+	}
+	addrs, err := liveAddresses(s, dbu)
+	if err != nil {
+		return 0, err
+	}
+	set := bson.M{}
+	for typ, id := range map[string]string{AddressShipping: shipping, AddressBilling: billing} {
+		if id == "" {
+			continue
+		}
+		found := false
+		for _, a := range addrs {
+			if a.ID != id {
+				continue
+			}
+			if !a.Serves(typ) {
+				return 0, ErrAddressType
+			}
+			found = true
+		}
+		if !found {
+			return 0, mgo.ErrNotFound
+		}
+		set[defaultFields[typ]] = id
+	}
+	if len(set) == 0 {
+		return dbu.Version, nil
+	}
+	return conditionalUpdate(c, m.scope(bson.M{"_id": dbu.ID}), version, bson.M{"$set": set})
+}
+
+// assignDefaults points each default of the user at one of its live
+// addresses serving it, keeping the default it has if it still does, so
+// that a user with addresses has defaults and a deleted address is no
+// one's default.
+func (m *Mongo) assignDefaults(s *mgo.Session, userid bson.ObjectId) error {
+	c := s.DB("").C("users")
+	var dbu DBUser
+	if err := c.Find(live(m.scope(bson.M{"_id": userid}))).One(&dbu); err != nil {
+		return err
+	}
+	addrs, err := liveAddresses(s, dbu)
+	if err != nil {
+		return err
+	}
+	set, unset := bson.M{}, bson.M{}
+	for typ, current := range defaults(&dbu.User) {
+		switch id := defaultAddress(*current, typ, addrs); {
+		case id == *current:
+		case id == "":
+			unset[defaultFields[typ]] = ""
+		default:
+			set[defaultFields[typ]] = id
+		}
+	}
+	if len(set)+len(unset) == 0 {
+		return nil
+	}
+	update := bson.M{}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	// A user changed meanwhile is left to its next address change.
+	err = c.Update(bson.M{"_id": dbu.ID, "version": dbu.Version}, bump(update))
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
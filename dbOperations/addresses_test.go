@@ -0,0 +1,73 @@
+package dbOperations
+
+import "testing"
+
+func TestDefaultAddress(t *testing.T) {
+	addrs := []Address{
+		{ID: "a", Types: []string{AddressBilling}},
+		{ID: "b"},
+		{ID: "c", Types: []string{AddressShipping}},
+	}
+	for _, c := range []struct {
+		current, typ, want string
+	}{
+		{"", AddressShipping, "b"},
+		{"", AddressBilling, "a"},
+		{"c", AddressShipping, "c"},
+		{"a", AddressShipping, "b"},
+		{"gone", AddressBilling, "a"},
+	} {
+		if got := defaultAddress(c.current, c.typ, addrs); got != c.want {
+			t.Errorf("%s default from %q: expected %q, got %q", c.typ, c.current, c.want, got)
+		}
+	}
+	if got := defaultAddress("a", AddressShipping, addrs[:1]); got != "" {
+		t.Errorf("expected no default without a shipping address, got %q", got)
+	}
+}
+
+func TestSetDefaultAddresses(t *testing.T) {
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	u := User{Username: "defaults"}
+	if err := TestMongo.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	billing := Address{City: "Bern", Label: "work", Types: []string{AddressBilling}}
+	home := Address{City: "Basel", Label: "home"}
+	for _, a := range []*Address{&billing, &home} {
+		if err := TestMongo.CreateAddress(a, u.UserID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := TestMongo.GetUser(u.UserID)
+	if err != nil || got.DefaultBilling != billing.ID || got.DefaultShipping != home.ID {
+		t.Fatalf("expected the first addresses to become the defaults, got %+v: %v", got, err)
+	}
+
+	if _, err := TestMongo.SetDefaultAddresses(u.UserID, billing.ID, "", 0); err != ErrAddressType {
+		t.Errorf("expected a billing address to be refused for shipping, got %v", err)
+	}
+	if _, err := TestMongo.SetDefaultAddresses(u.UserID, "", home.ID, got.Version-1); err != ErrVersionConflict {
+		t.Errorf("expected a stale version to be refused, got %v", err)
+	}
+	v, err := TestMongo.SetDefaultAddresses(u.UserID, "", home.ID, got.Version)
+	if err != nil || v != got.Version+1 {
+		t.Fatalf("expected the default to be set, got version %d: %v", v, err)
+	}
+
+	if err := TestMongo.DeleteAddress(u.UserID, home.ID, "tester", 0); err != nil {
+		t.Fatal(err)
+	}
+	got, _ = TestMongo.GetUser(u.UserID)
+	if got.DefaultBilling != billing.ID || got.DefaultShipping != "" {
+		t.Errorf("expected the defaults to move off the deleted address, got %+v", got)
+	}
+	if _, err := TestMongo.RestoreAddress(home.ID); err != nil {
+		t.Fatal(err)
+	}
+	got, _ = TestMongo.GetUser(u.UserID)
+	if got.DefaultShipping != home.ID {
+		t.Errorf("expected the restored address to be the shipping default again, got %+v", got)
+	}
+}
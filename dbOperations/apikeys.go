@@ -0,0 +1,125 @@
+package dbOperations
+
+import (
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// APIKey lets a backend service call the API with the given scopes. Only
+// the hash of the key is stored; the prefix is kept to tell keys apart.
+type APIKey struct {
+	ID          string     `json:"id" bson:"-"`
+	Name        string     `json:"name" bson:"name"`
+	Owner       string     `json:"owner" bson:"owner"`
+	Prefix      string     `json:"prefix" bson:"prefix"`
+	Hash        string     `json:"-" bson:"hash"`
+	Scopes      []string   `json:"scopes" bson:"scopes"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty" bson:"expiresAt,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt" bson:"createdAt"`
+	CreatedBy   string     `json:"createdBy" bson:"createdBy"`
+	LastUsedAt  *time.Time `json:"lastUsedAt,omitempty" bson:"lastUsedAt,omitempty"`
+	RotatedFrom string     `json:"rotatedFrom,omitempty" bson:"rotatedFrom,omitempty"`
+	// Tenant is the tenant the key calls the API of.
+	Tenant string `json:"-" bson:"tenant"`
+}
+
+// DBAPIKey is a wrapper for APIKey
+type DBAPIKey struct {
+	APIKey `bson:",inline"`
+	ID     bson.ObjectId `bson:"_id"`
+}
+
+// CreateAPIKey stores a new API key
+func (m *Mongo) CreateAPIKey(k *APIKey) error {
+	s := m.Session.Copy()
+	defer s.Close()
+	k.Tenant = m.owner(k.Tenant)
+	dbk := DBAPIKey{APIKey: *k, ID: bson.NewObjectId()}
+	if err := s.DB("").C("apikeys").Insert(dbk); err != nil {
+		return err
+	}
+	k.ID = dbk.ID.Hex()
+	return nil
+}
+
+// GetAPIKeys returns all API keys, oldest first
+func (m *Mongo) GetAPIKeys() ([]APIKey, error) {
+	s := m.Session.Copy()
+	defer s.Close()
+	var dbks []DBAPIKey
+	err := s.DB("").C("apikeys").Find(m.scope(bson.M{})).Sort("createdAt").All(&dbks)
+	keys := make([]APIKey, 0)
+	for _, dbk := range dbks {
+		dbk.APIKey.ID = dbk.ID.Hex()
+		keys = append(keys, dbk.APIKey)
+	}
+	return keys, err
+}
+
+// GetAPIKey returns the API key with the given id
+func (m *Mongo) GetAPIKey(id string) (APIKey, error) {
+	if !bson.IsObjectIdHex(id) {
+		return APIKey{}, ErrInvalidHexID
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	var dbk DBAPIKey
+	err := s.DB("").C("apikeys").Find(m.scope(bson.M{"_id": bson.ObjectIdHex(id)})).One(&dbk)
+	dbk.APIKey.ID = dbk.ID.Hex()
+	return dbk.APIKey, err
+}
+
+// GetAPIKeyByHash returns the API key with the given hash
+func (m *Mongo) GetAPIKeyByHash(hash string) (APIKey, error) {
+	s := m.Session.Copy()
+	defer s.Close()
+	var dbk DBAPIKey
+	err := s.DB("").C("apikeys").Find(m.scope(bson.M{"hash": hash})).One(&dbk)
+	dbk.APIKey.ID = dbk.ID.Hex()
+	return dbk.APIKey, err
+}
+
+// ExpireAPIKey makes the API key with the given id expire at at, unless it
+// expires earlier already
+func (m *Mongo) ExpireAPIKey(id string, at time.Time) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrInvalidHexID
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	err := s.DB("").C("apikeys").Update(m.scope(bson.M{
+		"_id": bson.ObjectIdHex(id),
+		"$or": []bson.M{{"expiresAt": bson.M{"$exists": false}}, {"expiresAt": bson.M{"$gt": at}}},
+	}), bson.M{"$set": bson.M{"expiresAt": at}})
+	if err == mgo.ErrNotFound {
+		// The key is gone, or expires earlier.
+		_, err = m.GetAPIKey(id)
+	}
+	return err
+}
+
+// TouchAPIKey records that the API key with the given id was used at at
+func (m *Mongo) TouchAPIKey(id string, at time.Time) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrInvalidHexID
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	return s.DB("").C("apikeys").Update(m.scope(bson.M{"_id": bson.ObjectIdHex(id)}), bson.M{"$set": bson.M{"lastUsedAt": at}})
+}
+
+// DeleteAPIKey revokes the API key with the given id
+func (m *Mongo) DeleteAPIKey(id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrInvalidHexID
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	return s.DB("").C("apikeys").Remove(m.scope(bson.M{"_id": bson.ObjectIdHex(id)}))
+}
+
+func (m *Mongo) ensureAPIKeyIndexes(s *mgo.Session) error {
+	return s.DB("").C("apikeys").EnsureIndex(mgo.Index{Key: []string{"hash"}, Unique: true, Background: true})
+}
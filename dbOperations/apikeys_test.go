@@ -0,0 +1,39 @@
+package dbOperations
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAPIKeys(t *testing.T) {
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	k := APIKey{Name: "orders", Prefix: "usk_abcdefgh", Hash: "h1", Scopes: []string{"customers:read"}, CreatedAt: time.Now()}
+	if err := TestMongo.CreateAPIKey(&k); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := TestMongo.GetAPIKeyByHash("h1"); err != nil || got.ID != k.ID || got.Name != "orders" {
+		t.Errorf("unexpected key %v: %v", got, err)
+	}
+
+	soon, later := time.Now().Add(time.Hour).UTC(), time.Now().Add(2*time.Hour).UTC()
+	if err := TestMongo.ExpireAPIKey(k.ID, soon); err != nil {
+		t.Error(err)
+	}
+	if err := TestMongo.ExpireAPIKey(k.ID, later); err != nil {
+		t.Error(err)
+	}
+	if got, _ := TestMongo.GetAPIKey(k.ID); got.ExpiresAt == nil || got.ExpiresAt.Sub(soon) > time.Second {
+		t.Errorf("expected the earlier expiry to stay, got %v", got.ExpiresAt)
+	}
+
+	if err := TestMongo.TouchAPIKey(k.ID, soon); err != nil {
+		t.Error(err)
+	}
+	if err := TestMongo.DeleteAPIKey(k.ID); err != nil {
+		t.Error(err)
+	}
+	if keys, err := TestMongo.GetAPIKeys(); err != nil || len(keys) != 0 {
+		t.Errorf("expected no keys, got %v: %v", keys, err)
+	}
+}
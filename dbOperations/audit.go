@@ -0,0 +1,415 @@
+package dbOperations
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	//ErrAuditChainBroken is returned when an audit entry does not match its hash
+	ErrAuditChainBroken = errors.New("Audit chain broken")
+)
+
+// AuditEntry records one security relevant or data changing event. Entries
+// are append only and chained: every entry carries the hash of the previous
+// one, so removing or editing an entry breaks the chain.
+type AuditEntry struct {
+	ID        string    `json:"id" bson:"-"`
+	Seq       int64     `json:"seq" bson:"seq"`
+	Time      time.Time `json:"time" bson:"time"`
+	Actor     string    `json:"actor" bson:"actor"`
+	Action    string    `json:"action" bson:"action"`
+	Target    string    `json:"target" bson:"target"`
+	AddressID string    `json:"addressID,omitempty" bson:"addressID,omitempty"`
+	Outcome   string    `json:"outcome" bson:"outcome"`
+	Error     string    `json:"error,omitempty" bson:"error,omitempty"`
+	ClientIP  string    `json:"clientIP" bson:"clientIP"`
+	UserAgent string    `json:"userAgent" bson:"userAgent"`
+	RequestID string    `json:"requestID" bson:"requestID"`
+	PrevHash  string    `json:"prevHash" bson:"prevHash"`
+	Hash      string    `json:"hash" bson:"hash"`
+	// Redacted holds the digests of personal fields that have since been
+	// anonymised, so that the chain still verifies. RedactedIn is the
+	// sequence number of the entry recording the last redaction, which
+	// vouches for what the fields were replaced with.
+	Redacted   map[string]string `json:"redacted,omitempty" bson:"redacted,omitempty"`
+	RedactedIn int64             `json:"redactedIn,omitempty" bson:"redactedIn,omitempty"`
+	// Redactions, on an entry recording a redaction, are the entries it
+	// redacted as it left them. They are part of its hash.
+	Redactions []AuditRedaction `json:"redactions,omitempty" bson:"redactions,omitempty"`
+	// Tenant is the tenant the request was for. The chain runs across
+	// tenants, and the tenant is part of the hash.
+	Tenant string `json:"-" bson:"tenant"`
+}
+
+// AuditRedaction is the actor and target an entry was left with by a
+// redaction. Its client IP and user agent are left empty.
+type AuditRedaction struct {
+	Seq    int64  `json:"seq" bson:"seq"`
+	Actor  string `json:"actor" bson:"actor"`
+	Target string `json:"target" bson:"target"`
+}
+
+// DBAuditEntry is a wrapper for AuditEntry
+type DBAuditEntry struct {
+	AuditEntry `bson:",inline"`
+	ID         bson.ObjectId `bson:"_id"`
+}
+
+// AuditFilter selects audit entries. Empty fields match everything.
+// Subjects matches entries whose actor or target is any of them.
+type AuditFilter struct {
+	Subjects []string
+	Actor    string
+	Target   string
+	Action   string
+	Outcome  string
+	Since    time.Time
+	Until    time.Time
+	Skip     int
+	Limit    int
+}
+
+// Chain links the entry to prev, the last entry of the chain, and sets its
+// sequence number and hash. prev is nil for the first entry.
+func (e *AuditEntry) Chain(prev *AuditEntry) {
+	e.Seq = 1
+	e.PrevHash = ""
+	if prev != nil {
+		e.Seq = prev.Seq + 1
+		e.PrevHash = prev.Hash
+	}
+	// Mongo keeps milliseconds, so hash what will be read back.
+	e.Time = e.Time.UTC().Truncate(time.Millisecond)
+	e.Hash = e.ComputeHash()
+}
+
+// ComputeHash returns the hash of the entry's content and its link to the
+// previous entry. Personal fields enter the hash as digests, which lets
+// Redact remove them without breaking the chain.
+func (e *AuditEntry) ComputeHash() string {
+	h := sha256.New()
+	for _, f := range []string{
+		e.PrevHash,
+		strconv.FormatInt(e.Seq, 10),
+		e.Time.UTC().Format(time.RFC3339Nano),
+		e.digest("actor", e.Actor),
+		e.Action,
+		e.digest("target", e.Target),
+		e.AddressID,
+		e.Outcome,
+		e.Error,
+		e.digest("clientIP", e.ClientIP),
+		e.digest("userAgent", e.UserAgent),
+		e.RequestID,
+		e.Tenant,
+		e.redactionsDigest(),
+	} {
+		writeField(h, f)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+func (e *AuditEntry) redactionsDigest() string {
+	if len(e.Redactions) == 0 {
+		return ""
+	}
+	h := sha256.New()
+	for _, r := range e.Redactions {
+		writeField(h, strconv.FormatInt(r.Seq, 10))
+		writeField(h, r.Actor)
+		writeField(h, r.Target)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// writeField writes f to w prefixed with its length, so that fields
+// cannot run into each other.
+func writeField(w io.Writer, f string) {
+	io.WriteString(w, strconv.Itoa(len(f)))
+	io.WriteString(w, ":")
+	io.WriteString(w, f)
+}
+
+func (e *AuditEntry) digest(field, value string) string {
+	if d, ok := e.Redacted[field]; ok {
+		return d
+	}
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(value)))
+}
+
+// Redact replaces the actor and target of the entry with pseudonym where
+// they are one of subjects, and clears the client's IP and user agent. The
+// redaction is to be recorded in the chain, see NewAuditRedaction.
+func (e *AuditEntry) Redact(pseudonym string, subjects ...string) {
+	redact := func(field string, value *string, replacement string) {
+		if *value == replacement {
+			return
+		}
+		if e.Redacted == nil {
+			e.Redacted = make(map[string]string)
+		}
+		e.Redacted[field] = e.digest(field, *value)
+		*value = replacement
+	}
+	for _, sub := range subjects {
+		if e.Actor == sub {
+			redact("actor", &e.Actor, pseudonym)
+		}
+		if e.Target == sub {
+			redact("target", &e.Target, pseudonym)
+		}
+	}
+	redact("clientIP", &e.ClientIP, "")
+	redact("userAgent", &e.UserAgent, "")
+}
+
+// NewAuditRedaction returns the entry recording the redaction of entries,
+// made for target, to be appended to the chain. Once it is, each of
+// entries is to be stored as Redact left it, with RedactedIn set to its
+// sequence number.
+func NewAuditRedaction(target string, entries []AuditEntry) AuditEntry {
+	r := AuditEntry{Time: time.Now(), Actor: "system", Action: "audit.redact", Target: target, Outcome: "success"}
+	for _, e := range entries {
+		r.Redactions = append(r.Redactions, AuditRedaction{Seq: e.Seq, Actor: e.Actor, Target: e.Target})
+	}
+	return r
+}
+
+// VerifyAuditChain checks that entries, in sequence order, form an unbroken
+// chain starting at the first entry ever written.
+func VerifyAuditChain(entries []AuditEntry) error {
+	var v auditVerifier
+	for i := range entries {
+		if err := v.next(&entries[i]); err != nil {
+			return err
+		}
+	}
+	return v.done()
+}
+
+// auditVerifier checks entries one after the other. Redacted entries wait
+// in redacted until the entry recording their redaction comes.
+type auditVerifier struct {
+	prev     *AuditEntry
+	redacted map[int64]AuditEntry
+}
+
+func (v *auditVerifier) next(e *AuditEntry) error {
+	broken := fmt.Errorf("%v at entry %d", ErrAuditChainBroken, e.Seq)
+	seq, prevHash := int64(1), ""
+	if v.prev != nil {
+		seq, prevHash = v.prev.Seq+1, v.prev.Hash
+	}
+	if e.Seq != seq || e.PrevHash != prevHash || e.Hash != e.ComputeHash() {
+		return broken
+	}
+	if len(e.Redacted) > 0 || e.RedactedIn != 0 {
+		if e.RedactedIn <= e.Seq {
+			return broken
+		}
+		if v.redacted == nil {
+			v.redacted = make(map[int64]AuditEntry)
+		}
+		v.redacted[e.Seq] = *e
+	}
+	for _, r := range e.Redactions {
+		w, ok := v.redacted[r.Seq]
+		if !ok || w.RedactedIn != e.Seq {
+			// Redacted again since, or left as it was.
+			continue
+		}
+		if w.Actor != r.Actor || w.Target != r.Target || w.ClientIP != "" || w.UserAgent != "" {
+			return fmt.Errorf("%v at entry %d", ErrAuditChainBroken, w.Seq)
+		}
+		delete(v.redacted, r.Seq)
+	}
+	v.prev = e
+	return nil
+}
+
+// done reports a redacted entry that no entry records the redaction of.
+func (v *auditVerifier) done() error {
+	var first int64
+	for seq := range v.redacted {
+		if first == 0 || seq < first {
+			first = seq
+		}
+	}
+	if first != 0 {
+		return fmt.Errorf("%v at entry %d", ErrAuditChainBroken, first)
+	}
+	return nil
+}
+
+// AppendAudit appends an entry to the audit chain
+func (m *Mongo) AppendAudit(e *AuditEntry) error {
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB("").C("audit")
+	e.Tenant = m.owner(e.Tenant)
+	// The unique seq index makes concurrent writers race for the next
+	// link; the loser rereads the tail and tries again.
+	for attempt := 0; ; attempt++ {
+		var last DBAuditEntry
+		err := c.Find(nil).Sort("-seq").One(&last)
+		switch err {
+		case nil:
+			e.Chain(&last.AuditEntry)
+		case mgo.ErrNotFound:
+			e.Chain(nil)
+		default:
+			return err
+		}
+		dbe := DBAuditEntry{AuditEntry: *e, ID: bson.NewObjectId()}
+		err = c.Insert(dbe)
+		if mgo.IsDup(err) && attempt < 10 {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		e.ID = dbe.ID.Hex()
+		return nil
+	}
+}
+
+// GetAudit returns the entries matching f, newest first, and the total
+// number of matching entries
+func (m *Mongo) GetAudit(f AuditFilter) ([]AuditEntry, int, error) {
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB("").C("audit")
+	q := m.scope(auditQuery(f))
+	entries := make([]AuditEntry, 0)
+	total, err := c.Find(q).Count()
+	if err != nil {
+		return entries, 0, err
+	}
+	var dbes []DBAuditEntry
+	err = c.Find(q).Sort("-seq").Skip(f.Skip).Limit(f.Limit).All(&dbes)
+	if err != nil {
+		return entries, 0, err
+	}
+	for _, dbe := range dbes {
+		dbe.AuditEntry.ID = dbe.ID.Hex()
+		entries = append(entries, dbe.AuditEntry)
+	}
+	return entries, total, nil
+}
+
+// AnonymiseAudit redacts every entry about any of subjects, see Redact,
+// records the redaction in the chain and returns the number of entries
+// changed
+func (m *Mongo) AnonymiseAudit(pseudonym string, subjects ...string) (int, error) {
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB("").C("audit")
+	var dbes []DBAuditEntry
+	err := c.Find(m.scope(auditQuery(AuditFilter{Subjects: subjects}))).All(&dbes)
+	if err != nil || len(dbes) == 0 {
+		return 0, err
+	}
+	entries := make([]AuditEntry, len(dbes))
+	for i := range dbes {
+		dbes[i].AuditEntry.Redact(pseudonym, subjects...)
+		entries[i] = dbes[i].AuditEntry
+	}
+	record := NewAuditRedaction(pseudonym, entries)
+	if err := m.AppendAudit(&record); err != nil {
+		return 0, err
+	}
+	for i, dbe := range dbes {
+		err := c.UpdateId(dbe.ID, bson.M{"$set": bson.M{
+			"actor":      dbe.Actor,
+			"target":     dbe.Target,
+			"clientIP":   dbe.ClientIP,
+			"userAgent":  dbe.UserAgent,
+			"redacted":   dbe.Redacted,
+			"redactedIn": record.Seq,
+		}})
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(dbes), nil
+}
+
+func auditQuery(f AuditFilter) bson.M {
+	q := bson.M{}
+	for k, v := range map[string]string{"actor": f.Actor, "target": f.Target, "action": f.Action, "outcome": f.Outcome} {
+		if v != "" {
+			q[k] = v
+		}
+	}
+	if len(f.Subjects) > 0 {
+		q["$or"] = []bson.M{
+			{"actor": bson.M{"$in": f.Subjects}},
+			{"target": bson.M{"$in": f.Subjects}},
+		}
+	}
+	if !f.Since.IsZero() || !f.Until.IsZero() {
+		t := bson.M{}
+		if !f.Since.IsZero() {
+			t["$gte"] = f.Since
+		}
+		if !f.Until.IsZero() {
+			t["$lt"] = f.Until
+		}
+		q["time"] = t
+	}
+	return q
+}
+
+// VerifyAudit walks the whole audit chain and returns the number of entries
+// verified, stopping at the first broken link
+func (m *Mongo) VerifyAudit() (int, error) {
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB("").C("audit")
+	it := c.Find(nil).Sort("seq").Iter()
+	var (
+		n int
+		v auditVerifier
+	)
+	for {
+		var dbe DBAuditEntry
+		if !it.Next(&dbe) {
+			break
+		}
+		e := dbe.AuditEntry
+		if err := v.next(&e); err != nil {
+			it.Close()
+			return n, err
+		}
+		n++
+	}
+	if err := it.Close(); err != nil {
+		return n, err
+	}
+	return n, v.done()
+}
+
+func (m *Mongo) ensureAuditIndexes(s *mgo.Session) error {
+	c := s.DB("").C("audit")
+	err := c.EnsureIndex(mgo.Index{
+		Key:    []string{"seq"},
+		Unique: true,
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range [][]string{{"target", "-seq"}, {"actor", "-seq"}, {"time"}} {
+		if err := c.EnsureIndex(mgo.Index{Key: key, Background: true}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package dbOperations
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestAppendAudit(t *testing.T) {
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	for _, action := range []string{"login", "user.delete"} {
+		err := TestMongo.AppendAudit(&AuditEntry{Time: time.Now(), Actor: "username", Action: action, Outcome: "success"})
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	entries, total, err := TestMongo.GetAudit(AuditFilter{Actor: "username", Limit: 1})
+	if err != nil {
+		t.Error(err)
+	}
+	if total != 2 || len(entries) != 1 || entries[0].Action != "user.delete" {
+		t.Errorf("unexpected audit page %v of %d", entries, total)
+	}
+	n, err := TestMongo.VerifyAudit()
+	if err != nil {
+		t.Error(err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 verified entries, got %d", n)
+	}
+}
+
+func TestAnonymiseAudit(t *testing.T) {
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	err := TestMongo.AppendAudit(&AuditEntry{Time: time.Now(), Actor: "anonymiseme", Action: "login", ClientIP: "192.0.2.1", Outcome: "success"})
+	if err != nil {
+		t.Error(err)
+	}
+	n, err := TestMongo.AnonymiseAudit("erased:1", "anonymiseme")
+	if err != nil {
+		t.Error(err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 anonymised entry, got %d", n)
+	}
+	entries, _, _ := TestMongo.GetAudit(AuditFilter{Actor: "erased:1"})
+	if len(entries) != 1 || entries[0].ClientIP != "" {
+		t.Errorf("unexpected entries %v", entries)
+	}
+	if _, err := TestMongo.VerifyAudit(); err != nil {
+		t.Error(err)
+	}
+	err = TestMongo.Session.DB("").C("audit").Update(bson.M{"actor": "erased:1"}, bson.M{"$set": bson.M{"actor": "erased:2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TestMongo.VerifyAudit(); err == nil {
+		t.Error("expected replacing a redacted actor to break the chain")
+	}
+	TestMongo.Session.DB("").C("audit").Update(bson.M{"actor": "erased:2"}, bson.M{"$set": bson.M{"actor": "erased:1"}})
+}
@@ -0,0 +1,177 @@
+package dbOperations
+
+import (
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// exportBatch is how many users ExportUsers reads the addresses of at once.
+const exportBatch = 500
+
+// ImportUsers inserts users with their addresses in bulk. It returns one
+// error per user, nil for those inserted, which carry their new ids. Users
+// are inserted before their addresses, so a user that is refused, as for a
+// taken username, leaves no addresses behind. Addresses given an id keep
+// it, so that the defaults of a user can name them; a user without
+// defaults gets its first address of each type.
+func (m *Mongo) ImportUsers(users []User) ([]error, error) {
+	s := m.Session.Copy()
+	defer s.Close()
+	errs := make([]error, len(users))
+	dbus := make([]DBUser, len(users))
+	docs := make([]interface{}, len(users))
+	for i, u := range users {
+		dbu := DBUser{User: u, ID: bson.NewObjectId(), AddressIDs: make([]bson.ObjectId, len(u.Addresses))}
+		dbu.Version = 1
+		dbu.Tenant = m.owner(u.Tenant)
+		addrs := make([]Address, len(u.Addresses))
+		for j, a := range u.Addresses {
+			dbu.AddressIDs[j] = bson.NewObjectId()
+			if bson.IsObjectIdHex(a.ID) {
+				dbu.AddressIDs[j] = bson.ObjectIdHex(a.ID)
+			}
+			a.ID = dbu.AddressIDs[j].Hex()
+			addrs[j] = a
+		}
+		for typ, current := range defaults(&dbu.User) {
+			*current = defaultAddress(*current, typ, addrs)
+		}
+		sealed := dbu
+		if err := m.Encryption.sealUser(&sealed); err != nil {
+			return nil, err
+		}
+		dbus[i], docs[i] = dbu, sealed
+	}
+	b := s.DB("").C("users").Bulk()
+	b.Unordered()
+	b.Insert(docs...)
+	if _, err := b.Run(); err != nil {
+		berr, ok := err.(*mgo.BulkError)
+		if !ok {
+			return nil, err
+		}
+		for _, c := range berr.Cases() {
+			if c.Index < 0 {
+				// The server does not tell which users failed.
+				return nil, err
+			}
+			errs[c.Index] = c.Err
+		}
+	}
+
+	var addrs []interface{}
+	for i, dbu := range dbus {
+		if errs[i] != nil {
+			continue
+		}
+		users[i].UserID = dbu.ID.Hex()
+		users[i].DefaultShipping, users[i].DefaultBilling = dbu.DefaultShipping, dbu.DefaultBilling
+		for j, a := range users[i].Addresses {
+			dba := DBAddress{Address: a, ID: dbu.AddressIDs[j]}
+			dba.Version = 1
+			dba.Tenant = dbu.Tenant
+			users[i].Addresses[j].ID = dba.ID.Hex()
+			if err := m.Encryption.sealAddress(&dba); err != nil {
+				return errs, err
+			}
+			addrs = append(addrs, dba)
+		}
+	}
+	if len(addrs) == 0 {
+		return errs, nil
+	}
+	b = s.DB("").C("addresses").Bulk()
+	b.Unordered()
+	b.Insert(addrs...)
+	_, err := b.Run()
+	return errs, err
+}
+
+// UsernamesTaken returns which of names are taken, also by deleted users
+func (m *Mongo) UsernamesTaken(names []string) (map[string]bool, error) {
+	s := m.Session.Copy()
+	defer s.Close()
+	var found []DBUser
+	q := m.Encryption.lookup(m.owner(""), "username", bson.M{"$in": names}, names...)
+	err := s.DB("").C("users").Find(m.scope(q)).Select(bson.M{"username": 1, "blindIndex": 1}).All(&found)
+	indexed := map[string]string{}
+	if m.Encryption.encrypts("users", "username") {
+		for _, name := range names {
+			indexed[m.Encryption.blindIndex(m.owner(""), "username", name)] = name
+		}
+	}
+	taken := make(map[string]bool, len(found))
+	for _, f := range found {
+		if name, ok := indexed[f.BlindIndex["username"]]; ok {
+			taken[name] = true
+		} else {
+			taken[f.Username] = true
+		}
+	}
+	return taken, err
+}
+
+// ExportUsers calls fn with every live user and their live addresses, in
+// the order they were created, stopping at the first error.
+func (m *Mongo) ExportUsers(fn func(User) error) error {
+	s := m.Session.Copy()
+	defer s.Close()
+	it := s.DB("").C("users").Find(live(m.scope(bson.M{}))).Sort("_id").Iter()
+	batch := make([]DBUser, 0, exportBatch)
+	var dbu DBUser
+	for it.Next(&dbu) {
+		batch = append(batch, dbu)
+		dbu = DBUser{}
+		if len(batch) == exportBatch {
+			if err := exportBatchTo(s, m.Encryption, batch, fn); err != nil {
+				it.Close()
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	if err := it.Close(); err != nil {
+		return err
+	}
+	return exportBatchTo(s, m.Encryption, batch, fn)
+}
+
+// exportBatchTo reads the addresses of batch in one query and calls fn
+// with each user, decrypted with e.
+func exportBatchTo(s *mgo.Session, e *FieldEncryption, batch []DBUser, fn func(User) error) error {
+	var ids []bson.ObjectId
+	for _, dbu := range batch {
+		ids = append(ids, dbu.AddressIDs...)
+	}
+	var dbas []DBAddress
+	if len(ids) > 0 {
+		if err := s.DB("").C("addresses").Find(live(bson.M{"_id": bson.M{"$in": ids}})).All(&dbas); err != nil {
+			return err
+		}
+	}
+	addrs := make(map[bson.ObjectId]Address, len(dbas))
+	for _, dba := range dbas {
+		dba.Address.ID = dba.ID.Hex()
+		if err := e.openAddress(&dba); err != nil {
+			return err
+		}
+		addrs[dba.ID] = dba.Address
+	}
+	for _, dbu := range batch {
+		if err := e.openUser(&dbu); err != nil {
+			return err
+		}
+		u := dbu.User
+		u.UserID = dbu.ID.Hex()
+		u.Addresses = make([]Address, 0, len(dbu.AddressIDs))
+		for _, id := range dbu.AddressIDs {
+			if a, ok := addrs[id]; ok {
+				u.Addresses = append(u.Addresses, a)
+			}
+		}
+		if err := fn(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package dbOperations
+
+import (
+	"testing"
+
+	mgo "gopkg.in/mgo.v2"
+)
+
+func TestImportAndExportUsers(t *testing.T) {
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	users := []User{
+		{Username: "bulk-1", Password: "hash", Salt: "salt", PasswordScheme: "md5", Addresses: []Address{{City: "Bern"}, {City: "Basel"}}},
+		{Username: "bulk-1", Addresses: []Address{{City: "Zurich"}}},
+		{Username: "bulk-2", Addresses: []Address{}},
+	}
+	errs, err := TestMongo.ImportUsers(users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs[0] != nil || errs[2] != nil || !mgo.IsDup(errs[1]) {
+		t.Fatalf("expected the second user to be refused as a duplicate, got %v", errs)
+	}
+	if users[0].UserID == "" || users[0].Addresses[1].ID == "" {
+		t.Errorf("expected the imported user to carry its ids, got %+v", users[0])
+	}
+	taken, err := TestMongo.UsernamesTaken([]string{"bulk-1", "bulk-2", "bulk-3"})
+	if err != nil || !taken["bulk-1"] || !taken["bulk-2"] || taken["bulk-3"] {
+		t.Errorf("unexpected taken usernames %v: %v", taken, err)
+	}
+
+	exported := map[string]User{}
+	err = TestMongo.ExportUsers(func(u User) error {
+		exported[u.Username] = u
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := exported["bulk-1"]
+	if u.UserID != users[0].UserID || len(u.Addresses) != 2 || u.Addresses[1].City != "Basel" || u.PasswordScheme != "md5" {
+		t.Errorf("unexpected exported user %+v", u)
+	}
+	if a, err := TestMongo.GetAddress(u.Addresses[0].ID); err != nil || a.City != "Bern" {
+		t.Errorf("expected the imported address, got %+v: %v", a, err)
+	}
+}
@@ -19,6 +19,10 @@ var (
 	db        = "users"
 	//ErrInvalidHexID represents a entity id that is not a valid bson ObjectID
 	ErrInvalidHexID = errors.New("Invalid Id Hex")
+	//ErrDeletedWithUser is returned when restoring an address that was deleted along with its user
+	ErrDeletedWithUser = errors.New("Address was deleted with its user")
+	//ErrUserDeleted is returned when restoring an address of a user who is deleted
+	ErrUserDeleted = errors.New("User of the address is deleted")
 )
 
 func init() { // os.Getenv("MONGO_USER")
@@ -29,6 +33,11 @@ func init() { // os.Getenv("MONGO_USER")
 
 type Mongo struct {
 	Session *mgo.Session
+	// Encryption, if set, encrypts fields of users and addresses at rest.
+	Encryption *FieldEncryption
+	// Tenant, if set, is the only tenant whose records are read and
+	// written.
+	Tenant string
 }
 
 // Init MongoDB
@@ -37,15 +46,14 @@ func (m *Mongo) Init() error {
 	var err error
 	m.Session, err = mgo.DialWithTimeout("127.0.0.1", time.Duration(5)*time.Second)
 	if err != nil {
-		fmt.Println("errrr")
-		return err
+		return fmt.Errorf("cannot connect to mongo: %v", err)
 	}
 	return m.EnsureIndexes()
 }
 
 //CRUD Operations for User
 
-// CreateUser inserts user to MongoDB
+// CreateUser inserts user to MongoDB, along with its UserRegistered event
 func (m *Mongo) CreateUser(u *User) error {
 	s := m.Session.Copy()
 	defer s.Close()
@@ -53,12 +61,23 @@ func (m *Mongo) CreateUser(u *User) error {
 	dbu := NewDBUser()
 	dbu.ID = id
 	dbu.User = *u
+	dbu.Tenant = m.owner(u.Tenant)
+	dbu.Version = 1
+	dbu.User.UserID = dbu.ID.Hex()
+	e, err := m.newEvent(EventUserRegistered, dbu.User.UserID, dbu.Tenant, dbu.User.EventPayload())
+	if err != nil {
+		return err
+	}
+	dbu.PendingEvents = []DBEvent{e}
+	sealed := dbu
+	if err := m.Encryption.sealUser(&sealed); err != nil {
+		return err
+	}
 	c := s.DB("").C("users")
-	_, err := c.UpsertId(dbu.ID, dbu)
+	err = c.Insert(sealed)
 	if err != nil {
 		return err
 	}
-	dbu.User.UserID = dbu.ID.Hex()
 	*u = dbu.User
 	return nil
 }
@@ -72,8 +91,11 @@ func (m *Mongo) GetUser(id string) (User, error) {
 	}
 	c := s.DB("").C("users")
 	dbu := NewDBUser()
-	err := c.FindId(bson.ObjectIdHex(id)).One(&dbu)
+	err := c.Find(live(m.scope(bson.M{"_id": bson.ObjectIdHex(id)}))).One(&dbu)
 	dbu.ConvertObjectsIds()
+	if err == nil {
+		err = m.Encryption.openUser(&dbu)
+	}
 	if err != nil {
 		return User{}, err
 	}
@@ -86,8 +108,11 @@ func (m *Mongo) GetUserWithName(username string) (User, error) {
 	defer s.Close()
 	c := s.DB("").C("users")
 	dbu := NewDBUser()
-	err := c.Find(bson.M{"username": username}).One(&dbu)
+	err := c.Find(live(m.scope(m.Encryption.lookup(m.owner(""), "username", username, username)))).One(&dbu)
 	dbu.User.UserID = dbu.ID.Hex()
+	if err == nil {
+		err = m.Encryption.openUser(&dbu)
+	}
 	return dbu.User, err
 }
 
@@ -97,13 +122,16 @@ func (m *Mongo) GetUsers() ([]User, error) {
 	defer s.Close()
 	var dbusers []DBUser
 	users := make([]User, 0)
-	c := s.DB("").C("customers")
-	err := c.Find(nil).All(&dbusers)
+	c := s.DB("").C("users")
+	err := c.Find(live(m.scope(bson.M{}))).All(&dbusers)
 	if err != nil {
 		return users, err
 	}
 	for _, dbu := range dbusers {
 		dbu.ConvertObjectsIds()
+		if err := m.Encryption.openUser(&dbu); err != nil {
+			return users, err
+		}
 		users = append(users, dbu.User)
 	}
 	return users, nil
@@ -122,59 +150,91 @@ func (m *Mongo) PopulateAddressesForUser(u *User) error {
 	}
 	var dba []DBAddress
 	c := s.DB("").C("addresses")
-	err := c.Find(bson.M{"_id": bson.M{"$in": ids}}).All(&dba)
+	err := c.Find(live(m.scope(bson.M{"_id": bson.M{"$in": ids}}))).All(&dba)
 	if err != nil {
 		return err
 	}
 	adds := make([]Address, 0)
 	for _, a := range dba {
 		a.Address.ID = a.ID.Hex()
+		if err := m.Encryption.openAddress(&a); err != nil {
+			return err
+		}
 		adds = append(adds, a.Address)
 	}
 	u.Addresses = adds
 	return nil
 }
 
-//DeleteUser deletes user with id
-func (m *Mongo) DeleteUser(id string) error {
+// DeleteUser marks user with id and its addresses as deleted by by. If
+// version is not 0, the user must still be at that version
+func (m *Mongo) DeleteUser(id, by string, version int64) error {
 	if !bson.IsObjectIdHex(id) {
 		return ErrInvalidHexID
 	}
 	s := m.Session.Copy()
 	defer s.Close()
 	c := s.DB("").C("users")
-	u, err := m.GetUser(id)
+	dbu := NewDBUser()
+	err := c.Find(live(m.scope(bson.M{"_id": bson.ObjectIdHex(id)}))).One(&dbu)
 	if err != nil {
 		return err
 	}
-	addrIds := make([]bson.ObjectId, 0)
-	for _, a := range u.Addresses {
-		addrIds = append(addrIds, bson.ObjectIdHex(a.ID))
+	e, err := m.newEvent(EventUserDeleted, id, dbu.Tenant, nil)
+	if err != nil {
+		return err
+	}
+	e.Actor = by
+	del := deletion(by)
+	_, err = conditionalUpdate(c, bson.M{"_id": dbu.ID}, version, withEvent(del, e))
+	if err != nil {
+		return err
 	}
 	addrc := s.DB("").C("addresses")
-	addrc.RemoveAll(bson.M{"_id": bson.M{"$in": addrIds}})
-	errc := c.Remove(bson.M{"_id": bson.ObjectIdHex(id)})
-	return errc
+	_, err = addrc.UpdateAll(live(bson.M{"_id": bson.M{"$in": dbu.AddressIDs}}), bump(bson.M{"$set": del["$set"]}))
+	return err
 }
 
 //CRUD Operations for Addresses
 
-//CreateAddress inserts new address and updates user with addr id
+//CreateAddress inserts new address and updates user with addr id. The
+//address belongs to the tenant of the user, and becomes its default for
+//what the user has no default address for yet.
 func (m *Mongo) CreateAddress(addr *Address, userId string) error {
 	s := m.Session.Copy()
 	defer s.Close()
 	if !bson.IsObjectIdHex(userId) {
 		return ErrInvalidHexID
 	}
+	var owner DBUser
+	err := s.DB("").C("users").Find(m.scope(bson.M{"_id": bson.ObjectIdHex(userId)})).Select(bson.M{"tenant": 1}).One(&owner)
+	if err != nil {
+		return err
+	}
 	c := s.DB("").C("addresses")
 	aid := bson.NewObjectId()
 	dbAdr := DBAddress{Address: *addr, ID: aid}
-	_, err := c.UpsertId(dbAdr.ID, dbAdr)
+	dbAdr.Tenant = m.owner(owner.Tenant)
+	dbAdr.Version = 1
+	dbAdr.Address.ID = aid.Hex()
+	e, err := m.newEvent(EventAddressAdded, userId, dbAdr.Tenant, dbAdr.Address.EventPayload())
+	if err != nil {
+		return err
+	}
+	e.AddressID = dbAdr.Address.ID
+	dbAdr.PendingEvents = []DBEvent{e}
+	sealed := dbAdr
+	if err := m.Encryption.sealAddress(&sealed); err != nil {
+		return err
+	}
+	err = c.Insert(sealed)
 	if err != nil {
 		return err
 	}
 	errad := m.addIdToUserAddresses(dbAdr.ID, userId)
-	dbAdr.Address.ID = dbAdr.ID.Hex()
+	if errad == nil {
+		errad = m.assignDefaults(s, owner.ID)
+	}
 	*addr = dbAdr.Address
 	return errad
 }
@@ -188,8 +248,11 @@ func (m *Mongo) GetAddress(id string) (Address, error) {
 	}
 	c := s.DB("").C("addresses")
 	dbAddr := DBAddress{}
-	err := c.FindId(bson.ObjectIdHex(id)).One(&dbAddr)
+	err := c.Find(live(m.scope(bson.M{"_id": bson.ObjectIdHex(id)}))).One(&dbAddr)
 	dbAddr.Address.ID = dbAddr.ID.Hex()
+	if err == nil {
+		err = m.Encryption.openAddress(&dbAddr)
+	}
 	return dbAddr.Address, err
 }
 
@@ -199,10 +262,13 @@ func (m *Mongo) GetAddresses() ([]Address, error) {
 	defer s.Close()
 	c := s.DB("").C("addresses")
 	var dbAdrs []DBAddress
-	err := c.Find(nil).All(&dbAdrs)
+	err := c.Find(live(m.scope(bson.M{}))).All(&dbAdrs)
 	adrs := make([]Address, 0)
 	for _, dbAdr := range dbAdrs {
 		dbAdr.Address.ID = dbAdr.ID.Hex()
+		if err := m.Encryption.openAddress(&dbAdr); err != nil {
+			return adrs, err
+		}
 		adrs = append(adrs, dbAdr.Address)
 	}
 	return adrs, err
@@ -218,57 +284,74 @@ func (m *Mongo) GetAddressesForUser(userid string) ([]Address, error) {
 	}
 	c := s.DB("").C("users")
 	dbu := NewDBUser()
-	errU := c.FindId(bson.ObjectIdHex(userid)).One(&dbu)
+	errU := c.Find(live(m.scope(bson.M{"_id": bson.ObjectIdHex(userid)}))).One(&dbu)
 	if errU != nil {
 		return adds, errU
 	}
 	var dba []DBAddress
 	ac := s.DB("").C("addresses")
-	errA := ac.Find(bson.M{"_id": bson.M{"$in": dbu.AddressIDs}}).All(&dba)
+	errA := ac.Find(live(bson.M{"_id": bson.M{"$in": dbu.AddressIDs}})).All(&dba)
 	if errA != nil {
 		return adds, errA
 	}
 
 	for _, a := range dba {
 		a.Address.ID = a.ID.Hex()
+		if err := m.Encryption.openAddress(&a); err != nil {
+			return adds, err
+		}
 		adds = append(adds, a.Address)
 	}
 	return adds, nil
 }
 
-//DeleteAddress deletes an address for give userid and addr id
-func (m *Mongo) DeleteAddress(userid, addid string) error {
+// DeleteAddress marks an address of a user as deleted by by and detaches it
+// from the user; the address of another user is not found. If version is
+// not 0, the address must still be at that version. Where the address was
+// the user's default, another of its addresses takes over
+func (m *Mongo) DeleteAddress(userid, addid, by string, version int64) error {
 	if !bson.IsObjectIdHex(userid) || !bson.IsObjectIdHex(addid) {
 		return ErrInvalidHexID
 	}
 	s := m.Session.Copy()
 	defer s.Close()
-	err := m.removeIdFromUserAddresses(bson.ObjectIdHex(addid), userid)
+	var owner DBUser
+	err := s.DB("").C("users").Find(live(m.scope(bson.M{"_id": bson.ObjectIdHex(userid), "addresses": bson.ObjectIdHex(addid)}))).Select(bson.M{"tenant": 1}).One(&owner)
+	if err != nil {
+		return err
+	}
+	e, err := m.newEvent(EventAddressRemoved, userid, owner.Tenant, nil)
 	if err != nil {
 		return err
 	}
+	e.AddressID, e.Actor = addid, by
+	del := deletion(by)
+	del["$set"].(bson.M)["deletedFrom"] = userid
 	ac := s.DB("").C("addresses")
-	errR := ac.Remove(bson.M{"_id": bson.ObjectIdHex(addid)})
-	if errR != nil {
-		return errR
+	_, err = conditionalUpdate(ac, m.scope(bson.M{"_id": bson.ObjectIdHex(addid)}), version, withEvent(del, e))
+	if err != nil {
+		return err
 	}
-	return nil
+	if err := m.removeIdFromUserAddresses(bson.ObjectIdHex(addid), userid); err != nil {
+		return err
+	}
+	return m.assignDefaults(s, bson.ObjectIdHex(userid))
 }
 
 func (m *Mongo) addIdToUserAddresses(id bson.ObjectId, userId string) error {
 	s := m.Session.Copy()
 	defer s.Close()
 	c := s.DB("").C("users")
-	return c.Update(bson.M{"_id": bson.ObjectIdHex(userId)},
-		bson.M{"$addToSet": bson.M{"addresses": id}})
+	return c.Update(m.scope(bson.M{"_id": bson.ObjectIdHex(userId)}),
+		bump(bson.M{"$addToSet": bson.M{"addresses": id}}))
 }
 
 func (m *Mongo) removeIdFromUserAddresses(id bson.ObjectId, userId string) error {
 	s := m.Session.Copy()
 	defer s.Close()
 	c := s.DB("").C("users")
-	return c.Update(bson.M{"_id": bson.ObjectIdHex(userId)},
-		bson.M{"$pull": bson.M{"addresses": id}})
+	return c.Update(m.scope(bson.M{"_id": bson.ObjectIdHex(userId)}),
+		bump(bson.M{"$pull": bson.M{"addresses": id}}))
 }
 
 func getURL() url.URL {
@@ -281,23 +364,65 @@ func getURL() url.URL {
 		u := url.UserPassword(mname, mpassword)
 		ur.User = u
 	}
-	fmt.Println(ur.String)
 	return ur
 }
 
-// EnsureIndexes ensures username is unique
+// EnsureIndexes ensures username is unique within each tenant, also among
+// deleted users so they can be restored, and indexes tenants, deletions,
+// the audit log, erasure receipts, the outbox, webhook deliveries, OpenID
+// Connect grants, linked identities, API key hashes, blind indexes and
+// search terms, and expires rate limit buckets
 func (m *Mongo) EnsureIndexes() error {
 	s := m.Session.Copy()
 	defer s.Close()
+	if err := m.ensureTenantIndexes(s); err != nil {
+		return err
+	}
 	i := mgo.Index{
-		Key:        []string{"username"},
+		Key:        []string{"tenant", "username"},
 		Unique:     true,
 		DropDups:   true,
 		Background: true,
 		Sparse:     false,
 	}
 	c := s.DB("").C("users")
-	return c.EnsureIndex(i)
+	if err := c.EnsureIndex(i); err != nil {
+		return err
+	}
+	if err := m.ensureDeletionIndexes(s); err != nil {
+		return err
+	}
+	if err := m.ensureAuditIndexes(s); err != nil {
+		return err
+	}
+	if err := m.ensureErasureIndexes(s); err != nil {
+		return err
+	}
+	if err := m.ensureOutboxIndexes(s); err != nil {
+		return err
+	}
+	if err := m.ensureWebhookIndexes(s); err != nil {
+		return err
+	}
+	if err := m.ensureOIDCIndexes(s); err != nil {
+		return err
+	}
+	if err := m.ensureIdentityIndexes(s); err != nil {
+		return err
+	}
+	if err := m.ensureAPIKeyIndexes(s); err != nil {
+		return err
+	}
+	if err := m.ensureEncryptionIndexes(s); err != nil {
+		return err
+	}
+	if err := m.ensureSearchIndexes(s); err != nil {
+		return err
+	}
+	if err := m.ensurePolicyIndexes(s); err != nil {
+		return err
+	}
+	return m.ensureRateLimitIndexes(s)
 }
 
 //Ping checks db connection
@@ -147,7 +147,7 @@ func TestDeleteAddress(t *testing.T) {
 	if len(TestUser.Addresses) == 0 {
 		t.Error("cant delete something that doesnt exist")
 	}
-	err := TestMongo.DeleteAddress(TestUser.UserID, TestUser.Addresses[0].ID)
+	err := TestMongo.DeleteAddress(TestUser.UserID, TestUser.Addresses[0].ID, "tester", 0)
 	if err != nil {
 		t.Error(err)
 	}
@@ -156,7 +156,7 @@ func TestDeleteAddress(t *testing.T) {
 func TestDeleteUser(t *testing.T) {
 	TestMongo.Session = TestServer.Session()
 	defer TestMongo.Session.Close()
-	err := TestMongo.DeleteUser(TestUser.UserID)
+	err := TestMongo.DeleteUser(TestUser.UserID, "tester", 0)
 	if err != nil {
 		t.Error(err)
 	}
@@ -0,0 +1,492 @@
+package dbOperations
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	//ErrUnknownMasterKey is returned when a record's data key is wrapped with a master key that is not in the keyring
+	ErrUnknownMasterKey = errors.New("Unknown master key")
+	//ErrNoKeyring is returned when reading an encrypted record without field encryption configured
+	ErrNoKeyring = errors.New("Record is encrypted but no keyring is configured")
+)
+
+// encryptedPrefix marks an encrypted field value, followed by the base64
+// of the nonce and the sealed value.
+const encryptedPrefix = "enc:"
+
+// DefaultEncryptedFields are the personal fields of users and addresses,
+// named by collection and bson field.
+var DefaultEncryptedFields = []string{
+	"users.email", "users.firstname", "users.lastname", "users.phone",
+	"addresses.street", "addresses.number", "addresses.city", "addresses.postcode", "addresses.extraInfo",
+}
+
+// blindIndexed are the user fields records are looked up by. When they are
+// encrypted, a keyed hash of their value is kept to look them up with.
+var blindIndexed = []string{"username", "email"}
+
+// Keyring holds the master keys wrapping the data keys of records, and the
+// key of the blind indexes. The keyfile is its JSON, with keys in base64.
+type Keyring struct {
+	// Current names the master key new data keys are wrapped with.
+	Current string `json:"current"`
+	// Keys are the 32 byte master keys by name. Former keys are kept until
+	// Reencrypt has rewrapped every data key wrapped with them.
+	Keys map[string][]byte `json:"keys"`
+	// Index is the 32 byte key of the blind indexes. It is not rotated, as
+	// lookups would fail until every index was rebuilt.
+	Index []byte `json:"index"`
+}
+
+// NewKeyring returns a keyring with a new master key and index key.
+func NewKeyring() (*Keyring, error) {
+	k := &Keyring{Keys: map[string][]byte{}}
+	var err error
+	if k.Index, err = newKey(); err != nil {
+		return nil, err
+	}
+	if _, err = k.Rotate(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// ParseKeyring reads a keyfile.
+func ParseKeyring(data []byte) (*Keyring, error) {
+	k := &Keyring{}
+	if err := json.Unmarshal(data, k); err != nil {
+		return nil, err
+	}
+	if len(k.Index) != 32 {
+		return nil, errors.New("the index key must be 32 bytes")
+	}
+	for name, key := range k.Keys {
+		if len(key) != 32 {
+			return nil, fmt.Errorf("master key %q must be 32 bytes", name)
+		}
+	}
+	if _, ok := k.Keys[k.Current]; !ok {
+		return nil, fmt.Errorf("current master key %q is not in the keyring", k.Current)
+	}
+	return k, nil
+}
+
+// Rotate adds a new master key, named after the time, makes it current
+// and returns its name.
+func (k *Keyring) Rotate() (string, error) {
+	name := time.Now().UTC().Format("20060102T150405Z")
+	for i := 2; k.Keys[name] != nil; i++ {
+		name = fmt.Sprintf("%s-%d", time.Now().UTC().Format("20060102T150405Z"), i)
+	}
+	key, err := newKey()
+	if err != nil {
+		return "", err
+	}
+	k.Keys[name] = key
+	k.Current = name
+	return name, nil
+}
+
+func newKey() ([]byte, error) {
+	key := make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, key)
+	return key, err
+}
+
+// Envelope holds the data key the fields of a record are encrypted with,
+// wrapped with the master key Key.
+type Envelope struct {
+	Key     string `bson:"key"`
+	DataKey []byte `bson:"dataKey"`
+	// Fields are the fields that were configured to be encrypted, so that
+	// Reencrypt picks up records when they change.
+	Fields string `bson:"fields"`
+}
+
+// FieldEncryption encrypts fields of users and addresses with AES-GCM,
+// each record under a data key of its own.
+type FieldEncryption struct {
+	keys *Keyring
+	// fields are the encrypted fields by collection.
+	fields map[string][]string
+}
+
+// NewFieldEncryption encrypts fields, named like DefaultEncryptedFields,
+// with keys.
+func NewFieldEncryption(keys *Keyring, fields []string) (*FieldEncryption, error) {
+	e := &FieldEncryption{keys: keys, fields: map[string][]string{}}
+	known := map[string]map[string]*string{
+		"users":     userFields(&User{}),
+		"addresses": addressFields(&Address{}),
+	}
+	for _, f := range fields {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		parts := strings.SplitN(f, ".", 2)
+		if len(parts) != 2 || known[parts[0]][parts[1]] == nil {
+			return nil, fmt.Errorf("cannot encrypt unknown field %q", f)
+		}
+		if !e.encrypts(parts[0], parts[1]) {
+			e.fields[parts[0]] = append(e.fields[parts[0]], parts[1])
+		}
+	}
+	for _, names := range e.fields {
+		sort.Strings(names)
+	}
+	return e, nil
+}
+
+// LoadFieldEncryption encrypts fields with the keyring in keyfile.
+func LoadFieldEncryption(keyfile string, fields []string) (*FieldEncryption, error) {
+	data, err := ioutil.ReadFile(keyfile)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := ParseKeyring(data)
+	if err != nil {
+		return nil, err
+	}
+	return NewFieldEncryption(keys, fields)
+}
+
+func userFields(u *User) map[string]*string {
+	return map[string]*string{
+		"username":  &u.Username,
+		"email":     &u.Email,
+		"firstname": &u.FirstName,
+		"lastname":  &u.LastName,
+		"phone":     &u.Phone,
+	}
+}
+
+func addressFields(a *Address) map[string]*string {
+	return map[string]*string{
+		"street":    &a.Street,
+		"number":    &a.Number,
+		"city":      &a.City,
+		"postcode":  &a.PostCode,
+		"country":   &a.Country,
+		"extraInfo": &a.ExtraInfo,
+	}
+}
+
+func (e *FieldEncryption) encrypts(collection, field string) bool {
+	if e == nil {
+		return false
+	}
+	for _, f := range e.fields[collection] {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// blindIndex returns the keyed hash field is looked up by for value in
+// tenant, so that the same value hashes apart in each tenant and stays
+// unique per tenant. The default tenant's hashes are those made before
+// there were tenants. Emails are looked up ignoring case.
+func (e *FieldEncryption) blindIndex(tenant, field, value string) string {
+	if field == "email" {
+		value = strings.ToLower(value)
+	}
+	mac := hmac.New(sha256.New, e.keys.Index)
+	if tenant != "" && tenant != DefaultTenant {
+		io.WriteString(mac, tenant+"\x00")
+	}
+	io.WriteString(mac, field+"\x00"+value)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// lookup returns the query for users of tenant whose field matches q, or
+// through its blind index is one of values when the field is encrypted.
+// Users written before the field was encrypted match until they are
+// re-encrypted.
+func (e *FieldEncryption) lookup(tenant, field string, q interface{}, values ...string) bson.M {
+	if !e.encrypts("users", field) {
+		return bson.M{field: q}
+	}
+	hashes := make([]string, len(values))
+	for i, v := range values {
+		hashes[i] = e.blindIndex(tenant, field, v)
+	}
+	return bson.M{"$or": []bson.M{
+		{field: q},
+		{"blindIndex." + field: bson.M{"$in": hashes}},
+	}}
+}
+
+// sealUser encrypts the configured fields of dbu under a new data key and
+// sets its blind indexes and search terms.
+func (e *FieldEncryption) sealUser(dbu *DBUser) error {
+	dbu.Search = e.searchIndex(dbu.Tenant, "users", userFields(&dbu.User))
+	if e == nil {
+		dbu.Envelope, dbu.BlindIndex = nil, nil
+		return nil
+	}
+	fields := userFields(&dbu.User)
+	index := map[string]string{}
+	for _, name := range blindIndexed {
+		if v := *fields[name]; v != "" && e.encrypts("users", name) {
+			index[name] = e.blindIndex(dbu.Tenant, name, v)
+		}
+	}
+	env, err := e.seal("users", fields)
+	if err != nil {
+		return err
+	}
+	dbu.Envelope, dbu.BlindIndex = env, index
+	return nil
+}
+
+// openUser decrypts the encrypted fields of dbu, and tells whether its
+// phone number and email address are verified.
+func (e *FieldEncryption) openUser(dbu *DBUser) error {
+	if err := e.open(dbu.Envelope, userFields(&dbu.User)); err != nil {
+		return err
+	}
+	e.setPhoneVerified(dbu)
+	e.setEmailVerified(dbu)
+	return nil
+}
+
+// sealAddress encrypts the configured fields of dba under a new data key
+// and sets its search terms.
+func (e *FieldEncryption) sealAddress(dba *DBAddress) error {
+	dba.Search = e.searchIndex(dba.Tenant, "addresses", addressFields(&dba.Address))
+	if e == nil {
+		dba.Envelope = nil
+		return nil
+	}
+	env, err := e.seal("addresses", addressFields(&dba.Address))
+	dba.Envelope = env
+	return err
+}
+
+// openAddress decrypts the encrypted fields of dba.
+func (e *FieldEncryption) openAddress(dba *DBAddress) error {
+	return e.open(dba.Envelope, addressFields(&dba.Address))
+}
+
+// seal encrypts the configured fields of collection among fields, leaving
+// empty ones, and returns the envelope of their data key.
+func (e *FieldEncryption) seal(collection string, fields map[string]*string) (*Envelope, error) {
+	dataKey, err := newKey()
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := sealGCM(e.keys.Keys[e.keys.Current], dataKey, []byte(e.keys.Current))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range e.fields[collection] {
+		v := fields[name]
+		if *v == "" {
+			continue
+		}
+		sealed, err := sealGCM(dataKey, []byte(*v), []byte(name))
+		if err != nil {
+			return nil, err
+		}
+		*v = encryptedPrefix + base64.StdEncoding.EncodeToString(sealed)
+	}
+	return &Envelope{Key: e.keys.Current, DataKey: wrapped, Fields: strings.Join(e.fields[collection], ",")}, nil
+}
+
+// open decrypts the encrypted values among fields with the data key of
+// env. Records without an envelope, or without encrypted values, are
+// read as they are.
+func (e *FieldEncryption) open(env *Envelope, fields map[string]*string) error {
+	encrypted := false
+	for _, v := range fields {
+		encrypted = encrypted || strings.HasPrefix(*v, encryptedPrefix)
+	}
+	if env == nil || !encrypted {
+		return nil
+	}
+	if e == nil {
+		return ErrNoKeyring
+	}
+	master, ok := e.keys.Keys[env.Key]
+	if !ok {
+		return ErrUnknownMasterKey
+	}
+	dataKey, err := openGCM(master, env.DataKey, []byte(env.Key))
+	if err != nil {
+		return err
+	}
+	for name, v := range fields {
+		if !strings.HasPrefix(*v, encryptedPrefix) {
+			continue
+		}
+		sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(*v, encryptedPrefix))
+		if err != nil {
+			return err
+		}
+		plain, err := openGCM(dataKey, sealed, []byte(name))
+		if err != nil {
+			return err
+		}
+		*v = string(plain)
+	}
+	return nil
+}
+
+// sealGCM encrypts plain with key, authenticating data, and returns the
+// nonce followed by the ciphertext.
+func sealGCM(key, plain, data []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, data), nil
+}
+
+// openGCM decrypts what sealGCM returned.
+func openGCM(key, sealed, data []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed value is too short")
+	}
+	n := aead.NonceSize()
+	return aead.Open(nil, sealed[:n], sealed[n:], data)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Reencrypt rewrites the users and addresses, deleted or not, that are not
+// encrypted under the current master key with the configured fields, each
+// under a new data key, and returns how many it rewrote. A record that
+// changes meanwhile is left to the next run. Versions are kept, as the
+// records do not change.
+func (m *Mongo) Reencrypt() (int, error) {
+	e := m.Encryption
+	if e == nil {
+		return 0, nil
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	n := 0
+	c := s.DB("").C("users")
+	it := c.Find(e.stale("users")).Iter()
+	var dbu DBUser
+	for it.Next(&dbu) {
+		err := e.openUser(&dbu)
+		if err == nil {
+			err = e.sealUser(&dbu)
+		}
+		if err == nil {
+			set := bson.M{"envelope": dbu.Envelope, "search": dbu.Search}
+			for name, v := range userFields(&dbu.User) {
+				set[name] = *v
+			}
+			update := bson.M{"$set": set}
+			if len(dbu.BlindIndex) > 0 {
+				set["blindIndex"] = dbu.BlindIndex
+			} else {
+				update["$unset"] = bson.M{"blindIndex": ""}
+			}
+			err = rewrite(c, dbu.ID, dbu.Version, update, &n)
+		}
+		if err != nil {
+			it.Close()
+			return n, err
+		}
+		dbu = DBUser{}
+	}
+	if err := it.Close(); err != nil {
+		return n, err
+	}
+	c = s.DB("").C("addresses")
+	it = c.Find(e.stale("addresses")).Iter()
+	var dba DBAddress
+	for it.Next(&dba) {
+		err := e.openAddress(&dba)
+		if err == nil {
+			err = e.sealAddress(&dba)
+		}
+		if err == nil {
+			set := bson.M{"envelope": dba.Envelope, "search": dba.Search}
+			for name, v := range addressFields(&dba.Address) {
+				set[name] = *v
+			}
+			err = rewrite(c, dba.ID, dba.Version, bson.M{"$set": set}, &n)
+		}
+		if err != nil {
+			it.Close()
+			return n, err
+		}
+		dba = DBAddress{}
+	}
+	return n, it.Close()
+}
+
+// stale matches the records of collection Reencrypt rewrites.
+func (e *FieldEncryption) stale(collection string) bson.M {
+	return bson.M{"$or": []bson.M{
+		{"envelope.key": bson.M{"$ne": e.keys.Current}},
+		{"envelope.fields": bson.M{"$ne": strings.Join(e.fields[collection], ",")}},
+	}}
+}
+
+// rewrite applies update to document id if it is still at version, and
+// counts it in n.
+func rewrite(c *mgo.Collection, id bson.ObjectId, version int64, update bson.M, n *int) error {
+	err := c.Update(bson.M{"_id": id, "version": version}, update)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	if err == nil {
+		*n++
+	}
+	return err
+}
+
+func (m *Mongo) ensureEncryptionIndexes(s *mgo.Session) error {
+	c := s.DB("").C("users")
+	for _, field := range blindIndexed {
+		err := c.EnsureIndex(mgo.Index{
+			Key:        []string{"blindIndex." + field},
+			Unique:     field == "username",
+			Sparse:     true,
+			Background: true,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package dbOperations
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func newTestEncryption(t *testing.T, fields ...string) *FieldEncryption {
+	keys, err := NewKeyring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewFieldEncryption(keys, fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestSealAndOpenUser(t *testing.T) {
+	e := newTestEncryption(t, "users.username", "users.email", "users.phone")
+	dbu := DBUser{User: User{Username: "alice", Email: "Alice@Example.com", FirstName: "Alice"}}
+	if err := e.sealUser(&dbu); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(dbu.Username, encryptedPrefix) || !strings.HasPrefix(dbu.Email, encryptedPrefix) {
+		t.Errorf("expected the configured fields to be encrypted, got %+v", dbu.User)
+	}
+	if dbu.FirstName != "Alice" || dbu.Phone != "" {
+		t.Errorf("expected other and empty fields to be left, got %+v", dbu.User)
+	}
+	if dbu.BlindIndex["email"] != e.blindIndex(DefaultTenant, "email", "alice@example.com") || dbu.BlindIndex["username"] == "" {
+		t.Errorf("unexpected blind indexes %v", dbu.BlindIndex)
+	}
+	if err := e.openUser(&dbu); err != nil {
+		t.Fatal(err)
+	}
+	if dbu.Username != "alice" || dbu.Email != "Alice@Example.com" {
+		t.Errorf("expected the fields to be decrypted, got %+v", dbu.User)
+	}
+
+	if err := e.sealUser(&dbu); err != nil {
+		t.Fatal(err)
+	}
+	email := dbu.Email
+	dbu.Email, dbu.Username = dbu.Username, email
+	if err := e.openUser(&dbu); err == nil {
+		t.Error("expected values moved to another field to be refused")
+	}
+	if err := (*FieldEncryption)(nil).openUser(&dbu); err != ErrNoKeyring {
+		t.Errorf("expected ErrNoKeyring, got %v", err)
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	e := newTestEncryption(t, "addresses.street")
+	dba := DBAddress{Address: Address{Street: "Main St"}}
+	if err := e.sealAddress(&dba); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(e.keys)
+	keys, err := ParseKeyring(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := keys.Current
+	if name, err := keys.Rotate(); err != nil || name == old || keys.Current != name {
+		t.Fatalf("expected a new current key, got %q: %v", name, err)
+	}
+	rotated, _ := NewFieldEncryption(keys, []string{"addresses.street"})
+	opened := dba
+	if err := rotated.openAddress(&opened); err != nil || opened.Street != "Main St" {
+		t.Errorf("expected a former key to open the address, got %q: %v", opened.Street, err)
+	}
+	delete(keys.Keys, old)
+	if err := rotated.openAddress(&dba); err != ErrUnknownMasterKey {
+		t.Errorf("expected a retired key to be missing, got %v", err)
+	}
+
+	for _, data := range []string{
+		`{"current": "k", "keys": {"k": "AAAA"}, "index": "AAAA"}`,
+		`{"current": "j", "keys": {}, "index": "` + strings.Repeat("A", 43) + `="}`,
+	} {
+		if _, err := ParseKeyring([]byte(data)); err == nil {
+			t.Errorf("expected %s to be refused", data)
+		}
+	}
+	if _, err := NewFieldEncryption(keys, []string{"users.password"}); err == nil {
+		t.Error("expected unknown fields to be refused")
+	}
+}
+
+func TestEncryptedUsers(t *testing.T) {
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	TestMongo.Encryption = newTestEncryption(t, append(DefaultEncryptedFields, "users.username")...)
+	defer func() {
+		// Encrypting no fields decrypts the records for the other tests.
+		TestMongo.Encryption, _ = NewFieldEncryption(TestMongo.Encryption.keys, nil)
+		if _, err := TestMongo.Reencrypt(); err != nil {
+			t.Error(err)
+		}
+		TestMongo.Encryption = nil
+	}()
+
+	u := User{Username: "secretive", Email: "Secret@Example.com", LastName: "Hidden"}
+	if err := TestMongo.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	if u.Email != "Secret@Example.com" {
+		t.Errorf("expected the caller's user to stay readable, got %+v", u)
+	}
+	a := Address{Street: "Hidden Lane", Country: "CH"}
+	if err := TestMongo.CreateAddress(&a, u.UserID); err != nil {
+		t.Fatal(err)
+	}
+	var raw bson.M
+	TestMongo.Session.DB("").C("users").FindId(bson.ObjectIdHex(u.UserID)).One(&raw)
+	if strings.Contains(raw["email"].(string), "Secret") || strings.Contains(raw["username"].(string), "secretive") {
+		t.Errorf("expected the stored user to be encrypted, got %v", raw)
+	}
+	TestMongo.Session.DB("").C("addresses").FindId(bson.ObjectIdHex(a.ID)).One(&raw)
+	if raw["street"] == "Hidden Lane" || raw["country"] != "CH" {
+		t.Errorf("expected the stored street to be encrypted, got %v", raw)
+	}
+
+	found, err := TestMongo.GetUserWithName("secretive")
+	if err != nil || found.UserID != u.UserID || found.LastName != "Hidden" {
+		t.Errorf("expected the user by name, got %+v: %v", found, err)
+	}
+	byEmail, err := TestMongo.GetUsersWithEmail("secret@example.com")
+	if err != nil || len(byEmail) != 1 || byEmail[0].Username != "secretive" {
+		t.Errorf("expected the user by email, got %+v: %v", byEmail, err)
+	}
+	if err := TestMongo.CreateUser(&User{Username: "secretive"}); err == nil {
+		t.Error("expected the encrypted username to stay unique")
+	}
+	if taken, err := TestMongo.UsernamesTaken([]string{"secretive", "open"}); err != nil || !taken["secretive"] || taken["open"] {
+		t.Errorf("unexpected taken usernames %v: %v", taken, err)
+	}
+	found.Phone = "123"
+	if err := TestMongo.UpdateUser(&found, 0); err != nil {
+		t.Fatal(err)
+	}
+	version := found.Version
+	addrs, err := TestMongo.GetAddressesForUser(u.UserID)
+	if err != nil || len(addrs) != 1 || addrs[0].Street != "Hidden Lane" {
+		t.Errorf("expected the address decrypted, got %+v: %v", addrs, err)
+	}
+
+	if _, err := TestMongo.Encryption.keys.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	n, err := TestMongo.Reencrypt()
+	if err != nil || n < 2 {
+		t.Errorf("expected the user and address to be re-encrypted, got %d: %v", n, err)
+	}
+	TestMongo.Session.DB("").C("users").FindId(bson.ObjectIdHex(u.UserID)).One(&raw)
+	if raw["envelope"].(bson.M)["key"] != TestMongo.Encryption.keys.Current {
+		t.Errorf("expected the user under the new master key, got %v", raw["envelope"])
+	}
+	if n, err := TestMongo.Reencrypt(); err != nil || n != 0 {
+		t.Errorf("expected nothing left to re-encrypt, got %d: %v", n, err)
+	}
+	found, err = TestMongo.GetUser(u.UserID)
+	if err != nil || found.Phone != "123" || found.Version != version {
+		t.Errorf("expected the user unchanged, got %+v: %v", found, err)
+	}
+}
@@ -12,15 +12,38 @@ import (
 
 // User describes specific user fields
 type User struct {
-	UserID    string    `json:"id" bson:"-"`
-	Email     string    `json:"-" bson:"email"`
-	Username  string    `json:"username" bson:"username"`
-	Password  string    `json:"-" bson:"password,omitempty"`
-	FirstName string    `json:"firstName" bson:"firstname"`
-	LastName  string    `json:"lastName" bson:"lastname"`
-	Phone     string    `json:"phone" bson:"phone"`
-	Addresses []Address `json:"-,omitempty" bson:"-"`
-	Salt      string    `json:"-" bson:"salt"`
+	UserID    string     `json:"id" bson:"-"`
+	Email     string     `json:"-" bson:"email"`
+	Username  string     `json:"username" bson:"username"`
+	Password  string     `json:"-" bson:"password,omitempty"`
+	FirstName string     `json:"firstName" bson:"firstname"`
+	LastName  string     `json:"lastName" bson:"lastname"`
+	Phone     string     `json:"phone" bson:"phone"`
+	Addresses []Address  `json:"-,omitempty" bson:"-"`
+	Salt      string     `json:"-" bson:"salt"`
+	DeletedAt *time.Time `json:"deletedAt,omitempty" bson:"deletedAt,omitempty"`
+	DeletedBy string     `json:"deletedBy,omitempty" bson:"deletedBy,omitempty"`
+	// Version grows with every change and is sent as the ETag.
+	Version int64 `json:"-" bson:"version"`
+	// PasswordScheme is the legacy scheme of an imported password hash,
+	// empty for the service's own.
+	PasswordScheme string `json:"-" bson:"passwordScheme,omitempty"`
+	// Tenant is the tenant the user belongs to, see Mongo.ForTenant.
+	Tenant string `json:"-" bson:"tenant"`
+	// DefaultShipping and DefaultBilling are the ids of the addresses
+	// used for each unless another is chosen, see SetDefaultAddresses.
+	DefaultShipping string `json:"defaultShippingAddress,omitempty" bson:"defaultShipping,omitempty"`
+	DefaultBilling  string `json:"defaultBillingAddress,omitempty" bson:"defaultBilling,omitempty"`
+	// PhoneVerified tells whether the phone number was confirmed with a
+	// code sent to it, see ConfirmPhone.
+	PhoneVerified bool `json:"phoneVerified" bson:"-"`
+	// EmailVerified tells whether an identity provider vouched for the
+	// email address, see VerifyEmail.
+	EmailVerified bool `json:"emailVerified" bson:"-"`
+	// Preferences and Attributes, the custom attributes of the tenant,
+	// are read and changed on their own, see UpdatePreferences.
+	Preferences Preferences            `json:"-" bson:"preferences"`
+	Attributes  map[string]interface{} `json:"-" bson:"attributes,omitempty"`
 }
 
 // NewUser returns a new user
@@ -46,12 +69,32 @@ type Address struct {
 	Number    string `json:"number" bson:"number,omitempty"`
 	PostCode  string `json:"postcode" bson:"postcode,omitempty"`
 	ExtraInfo string `json:"extraInfo" bson:"extraInfo,omitempty"`
+	// Label names the address for the user: home, work, or their own.
+	Label string `json:"label,omitempty" bson:"label,omitempty"`
+	// Types are what the address is used for, among AddressShipping and
+	// AddressBilling. An address without types is used for anything.
+	Types     []string   `json:"types,omitempty" bson:"types,omitempty"`
+	DeletedAt *time.Time `json:"deletedAt,omitempty" bson:"deletedAt,omitempty"`
+	DeletedBy string     `json:"deletedBy,omitempty" bson:"deletedBy,omitempty"`
+	// DeletedFrom is the user an address was deleted from on its own, so
+	// restoring it can put it back.
+	DeletedFrom string `json:"deletedFrom,omitempty" bson:"deletedFrom,omitempty"`
+	Version     int64  `json:"-" bson:"version"`
+	// Tenant is the tenant the address belongs to.
+	Tenant string `json:"-" bson:"tenant"`
 }
 
 // DBAddress is a wrapper for Address
 type DBAddress struct {
 	Address `bson:",inline"`
 	ID      bson.ObjectId `bson:"_id"`
+	// Envelope is set when fields of the address are encrypted.
+	Envelope *Envelope `bson:"envelope,omitempty"`
+	// Search holds the terms the address is searched by, by field.
+	Search map[string]string `bson:"search"`
+	// PendingEvents are the events of changes to the address that are
+	// not in the outbox yet.
+	PendingEvents []DBEvent `bson:"pendingEvents,omitempty"`
 }
 
 // DBUser contains User field and bson fields specific to mongoDb
@@ -59,6 +102,19 @@ type DBUser struct {
 	User       `bson:",inline"`
 	ID         bson.ObjectId   `bson:"_id"`
 	AddressIDs []bson.ObjectId `bson:"addresses"`
+	// Envelope is set when fields of the user are encrypted, and
+	// BlindIndex then holds the keyed hashes they are looked up by.
+	Envelope   *Envelope         `bson:"envelope,omitempty"`
+	BlindIndex map[string]string `bson:"blindIndex,omitempty"`
+	// Search holds the terms the user is searched by, by field.
+	Search map[string]string `bson:"search"`
+	// VerifiedPhone is the hash of the phone number last verified, and
+	// VerifiedEmail of the email address.
+	VerifiedPhone string `bson:"verifiedPhone,omitempty"`
+	VerifiedEmail string `bson:"verifiedEmail,omitempty"`
+	// PendingEvents are the events of changes to the user that are not
+	// in the outbox yet.
+	PendingEvents []DBEvent `bson:"pendingEvents,omitempty"`
 }
 
 //NewDBUser returns a new DBUser
@@ -0,0 +1,227 @@
+package dbOperations
+
+import (
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// ErasurePending erasures wait for their grace period to pass.
+	ErasurePending = "pending"
+	// ErasureCompleted erasures have removed the user's data.
+	ErasureCompleted = "completed"
+	// ErasureCancelled erasures were withdrawn during the grace period.
+	ErasureCancelled = "cancelled"
+)
+
+// Erasure is the receipt of a request to erase a user's personal data. It
+// holds no personal data itself and outlives the user it was made for.
+type Erasure struct {
+	ID          string     `json:"id" bson:"-"`
+	UserID      string     `json:"userID" bson:"userID"`
+	RequestedBy string     `json:"requestedBy" bson:"requestedBy"`
+	RequestedAt time.Time  `json:"requestedAt" bson:"requestedAt"`
+	EraseAfter  time.Time  `json:"eraseAfter" bson:"eraseAfter"`
+	Status      string     `json:"status" bson:"status"`
+	CompletedAt *time.Time `json:"completedAt,omitempty" bson:"completedAt,omitempty"`
+	// Counts of what the erasure removed, filled in on completion.
+	AddressesRemoved       int `json:"addressesRemoved" bson:"addressesRemoved"`
+	AuditEntriesAnonymised int `json:"auditEntriesAnonymised" bson:"auditEntriesAnonymised"`
+	// Tenant is the tenant of the user.
+	Tenant string `json:"-" bson:"tenant"`
+}
+
+// Pseudonym is what audit entries refer to the erased user as.
+func (e Erasure) Pseudonym() string {
+	return "erased:" + e.ID
+}
+
+// DBErasure is a wrapper for Erasure
+type DBErasure struct {
+	Erasure `bson:",inline"`
+	ID      bson.ObjectId `bson:"_id"`
+}
+
+// CreateErasure records a new erasure receipt
+func (m *Mongo) CreateErasure(e *Erasure) error {
+	s := m.Session.Copy()
+	defer s.Close()
+	if !bson.IsObjectIdHex(e.UserID) {
+		return ErrInvalidHexID
+	}
+	c := s.DB("").C("erasures")
+	dbe := DBErasure{Erasure: *e, ID: bson.NewObjectId()}
+	dbe.Tenant = m.owner(e.Tenant)
+	if err := c.Insert(dbe); err != nil {
+		return err
+	}
+	e.ID = dbe.ID.Hex()
+	return nil
+}
+
+// GetErasures returns the erasure receipts for a user, newest first
+func (m *Mongo) GetErasures(userid string) ([]Erasure, error) {
+	return m.findErasures(bson.M{"userID": userid}, "-requestedAt")
+}
+
+// GetDueErasures returns the pending erasures whose grace period is over
+func (m *Mongo) GetDueErasures(now time.Time) ([]Erasure, error) {
+	return m.findErasures(bson.M{"status": ErasurePending, "eraseAfter": bson.M{"$lte": now}}, "eraseAfter")
+}
+
+func (m *Mongo) findErasures(q bson.M, sort string) ([]Erasure, error) {
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB("").C("erasures")
+	var dbes []DBErasure
+	err := c.Find(m.scope(q)).Sort(sort).All(&dbes)
+	erasures := make([]Erasure, 0)
+	for _, dbe := range dbes {
+		dbe.Erasure.ID = dbe.ID.Hex()
+		erasures = append(erasures, dbe.Erasure)
+	}
+	return erasures, err
+}
+
+// CancelErasure withdraws the pending erasure of a user
+func (m *Mongo) CancelErasure(userid string) (Erasure, error) {
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB("").C("erasures")
+	var dbe DBErasure
+	_, err := c.Find(m.scope(bson.M{"userID": userid, "status": ErasurePending})).Apply(mgo.Change{
+		Update:    bson.M{"$set": bson.M{"status": ErasureCancelled}},
+		ReturnNew: true,
+	}, &dbe)
+	dbe.Erasure.ID = dbe.ID.Hex()
+	return dbe.Erasure, err
+}
+
+// GetUserRecord returns the user with all its addresses, whether or not
+// they have been deleted
+func (m *Mongo) GetUserRecord(id string) (User, error) {
+	if !bson.IsObjectIdHex(id) {
+		return User{}, ErrInvalidHexID
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	dbu := NewDBUser()
+	err := s.DB("").C("users").Find(m.scope(bson.M{"_id": bson.ObjectIdHex(id)})).One(&dbu)
+	if err != nil {
+		return User{}, err
+	}
+	dbu.User.UserID = dbu.ID.Hex()
+	if err := m.Encryption.openUser(&dbu); err != nil {
+		return User{}, err
+	}
+	var dba []DBAddress
+	err = s.DB("").C("addresses").Find(m.scope(bson.M{"$or": []bson.M{
+		{"_id": bson.M{"$in": dbu.AddressIDs}},
+		{"deletedFrom": id},
+	}})).All(&dba)
+	for _, a := range dba {
+		a.Address.ID = a.ID.Hex()
+		if err := m.Encryption.openAddress(&a); err != nil {
+			return User{}, err
+		}
+		dbu.User.Addresses = append(dbu.User.Addresses, a.Address)
+	}
+	return dbu.User, err
+}
+
+// userData are the collections keeping data about a user besides their
+// record and addresses, with the field naming the user. Erasures and
+// purges remove it along with the user.
+var userData = []struct{ collection, field string }{
+	{"identities", "userID"},
+	{"phone_verifications", "_id"},
+	{"acceptances", "userID"},
+	{"oauth_consents", "userID"},
+	{"oauth_codes", "userID"},
+	{"apikeys", "owner"},
+	// Events and their webhook deliveries, dead or not, carry the
+	// user's data in their payload.
+	{"outbox", "userID"},
+	{"deliveries", "userID"},
+}
+
+// removeUserData removes what userData keeps about the users with the
+// given ids.
+func removeUserData(s *mgo.Session, ids ...string) error {
+	for _, d := range userData {
+		if _, err := s.DB("").C(d.collection).RemoveAll(bson.M{d.field: bson.M{"$in": ids}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EraseUser irreversibly carries out a pending erasure: it removes the user,
+// all their addresses, deleted or not, what userData keeps about them and
+// the API keys owned by their email, anonymises the audit entries about
+// them and the API keys they created, and completes the receipt
+func (m *Mongo) EraseUser(e *Erasure) error {
+	s := m.Session.Copy()
+	defer s.Close()
+	subjects := []string{e.UserID}
+	u, err := m.GetUserRecord(e.UserID)
+	switch err {
+	case nil:
+		subjects = append(subjects, u.Username)
+		ids := make([]bson.ObjectId, 0)
+		for _, a := range u.Addresses {
+			ids = append(ids, bson.ObjectIdHex(a.ID))
+		}
+		if _, err := s.DB("").C("addresses").RemoveAll(bson.M{"_id": bson.M{"$in": ids}}); err != nil {
+			return err
+		}
+		if err := s.DB("").C("users").RemoveId(bson.ObjectIdHex(e.UserID)); err != nil {
+			return err
+		}
+		if err := removeUserData(s, e.UserID); err != nil {
+			return err
+		}
+		if u.Email != "" {
+			if _, err := s.DB("").C("apikeys").RemoveAll(bson.M{"owner": u.Email}); err != nil {
+				return err
+			}
+		}
+		e.AddressesRemoved = len(u.Addresses)
+	case mgo.ErrNotFound:
+		// Purged in the meantime; the audit trail still refers to it.
+	default:
+		return err
+	}
+	// Keys the user created for others stay, no longer naming them.
+	_, err = s.DB("").C("apikeys").UpdateAll(bson.M{"createdBy": e.UserID}, bson.M{"$set": bson.M{"createdBy": e.Pseudonym()}})
+	if err != nil {
+		return err
+	}
+	n, err := m.AnonymiseAudit(e.Pseudonym(), subjects...)
+	if err != nil {
+		return err
+	}
+	e.AuditEntriesAnonymised = n
+	now := time.Now().UTC()
+	e.CompletedAt = &now
+	e.Status = ErasureCompleted
+	c := s.DB("").C("erasures")
+	return c.UpdateId(bson.ObjectIdHex(e.ID), bson.M{"$set": bson.M{
+		"status":                 e.Status,
+		"completedAt":            e.CompletedAt,
+		"addressesRemoved":       e.AddressesRemoved,
+		"auditEntriesAnonymised": e.AuditEntriesAnonymised,
+	}})
+}
+
+func (m *Mongo) ensureErasureIndexes(s *mgo.Session) error {
+	c := s.DB("").C("erasures")
+	for _, key := range [][]string{{"userID", "-requestedAt"}, {"status", "eraseAfter"}} {
+		if err := c.EnsureIndex(mgo.Index{Key: key, Background: true}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package dbOperations
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestEraseUser(t *testing.T) {
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	u := User{Username: "erasure", Email: "erasure@example.com", Addresses: []Address{}}
+	if err := TestMongo.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	if err := TestMongo.CreateAddress(&Address{City: "city"}, u.UserID); err != nil {
+		t.Error(err)
+	}
+	if err := TestMongo.AppendEvent(&Event{Type: "UserUpdated", Time: time.Now(), UserID: u.UserID, Payload: []byte(`{"username":"erasure"}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := TestMongo.EnqueueDelivery(&Delivery{SubscriptionID: "erasure", EventID: "erasure", UserID: u.UserID, CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := TestMongo.SaveConsent(Consent{UserID: u.UserID, ClientID: "erasure", GrantedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := TestMongo.CreateAuthCode(&AuthCode{Hash: "erasure", UserID: u.UserID, ExpiresAt: time.Now().Add(time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	created := APIKey{Name: "created", Owner: "team", Hash: "created", CreatedBy: u.UserID}
+	for _, k := range []*APIKey{{Name: "by id", Owner: u.UserID, Hash: "by id"}, {Name: "by email", Owner: u.Email, Hash: "by email"}, &created} {
+		if err := TestMongo.CreateAPIKey(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e := Erasure{UserID: u.UserID, RequestedAt: time.Now(), EraseAfter: time.Now(), Status: ErasurePending}
+	if err := TestMongo.CreateErasure(&e); err != nil {
+		t.Fatal(err)
+	}
+	due, err := TestMongo.GetDueErasures(time.Now())
+	if err != nil || len(due) != 1 {
+		t.Fatalf("expected one due erasure, got %v: %v", due, err)
+	}
+	if err := TestMongo.EraseUser(&due[0]); err != nil {
+		t.Error(err)
+	}
+	if _, err := TestMongo.GetUser(u.UserID); err == nil {
+		t.Error("expected user to be erased")
+	}
+	for _, name := range []string{"outbox", "deliveries", "oauth_consents", "oauth_codes"} {
+		if n, _ := TestMongo.Session.DB("").C(name).Find(bson.M{"userID": u.UserID}).Count(); n != 0 {
+			t.Errorf("expected the user's %s to be erased, %d left", name, n)
+		}
+	}
+	if n, _ := TestMongo.Session.DB("").C("apikeys").Find(bson.M{"owner": bson.M{"$in": []string{u.UserID, u.Email}}}).Count(); n != 0 {
+		t.Errorf("expected the user's API keys to be erased, %d left", n)
+	}
+	if k, err := TestMongo.GetAPIKey(created.ID); err != nil || k.CreatedBy != e.Pseudonym() {
+		t.Errorf("expected the key the user created to be kept without naming them, got %+v: %v", k, err)
+	}
+	erasures, err := TestMongo.GetErasures(u.UserID)
+	if err != nil || len(erasures) != 1 || erasures[0].Status != ErasureCompleted || erasures[0].AddressesRemoved != 1 {
+		t.Errorf("unexpected receipts %v: %v", erasures, err)
+	}
+	if _, err := TestMongo.CancelErasure(u.UserID); err == nil {
+		t.Error("expected nothing to cancel")
+	}
+}
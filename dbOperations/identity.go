@@ -0,0 +1,165 @@
+package dbOperations
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Identity links an account at an external identity provider to a user.
+// Each external account can be linked to one user, and each user can
+// link one account per provider.
+type Identity struct {
+	UserID   string    `json:"userID" bson:"userID"`
+	Provider string    `json:"provider" bson:"provider"`
+	Subject  string    `json:"subject" bson:"subject"`
+	Email    string    `json:"email,omitempty" bson:"email,omitempty"`
+	LinkedAt time.Time `json:"linkedAt" bson:"linkedAt"`
+	// Created is set when the user was created from this identity, and so
+	// has no password of their own.
+	Created bool `json:"created" bson:"created"`
+	// Tenant is the tenant of the user. An external account can be linked
+	// to one user in each tenant.
+	Tenant string `json:"-" bson:"tenant"`
+}
+
+// ExternalLogin is a login at an external identity provider in progress.
+// It is keyed by the hash of the state sent to the provider, and bound to
+// the browser that started it by the hash of a cookie.
+type ExternalLogin struct {
+	Hash        string    `bson:"_id"`
+	Provider    string    `bson:"provider"`
+	BrowserHash string    `bson:"browserHash"`
+	Verifier    string    `bson:"verifier"`
+	Nonce       string    `bson:"nonce"`
+	Params      string    `bson:"params,omitempty"`
+	LinkUserID  string    `bson:"linkUserID,omitempty"`
+	ExpiresAt   time.Time `bson:"expiresAt"`
+	// Tenant is the tenant the login was started in, and has to finish in.
+	Tenant string `bson:"tenant"`
+}
+
+// LinkIdentity stores a link between an external account and a user
+func (m *Mongo) LinkIdentity(id *Identity) error {
+	s := m.Session.Copy()
+	defer s.Close()
+	id.Tenant = m.owner(id.Tenant)
+	return s.DB("").C("identities").Insert(id)
+}
+
+// GetIdentity returns the link of the given external account
+func (m *Mongo) GetIdentity(provider, subject string) (Identity, error) {
+	s := m.Session.Copy()
+	defer s.Close()
+	var id Identity
+	err := s.DB("").C("identities").Find(m.scope(bson.M{"provider": provider, "subject": subject})).One(&id)
+	return id, err
+}
+
+// GetIdentities returns the external accounts linked to a user, oldest
+// first
+func (m *Mongo) GetIdentities(userid string) ([]Identity, error) {
+	s := m.Session.Copy()
+	defer s.Close()
+	ids := make([]Identity, 0)
+	err := s.DB("").C("identities").Find(m.scope(bson.M{"userID": userid})).Sort("linkedAt").All(&ids)
+	return ids, err
+}
+
+// UnlinkIdentity removes the link of a user to their account at provider
+func (m *Mongo) UnlinkIdentity(userid, provider string) error {
+	s := m.Session.Copy()
+	defer s.Close()
+	return s.DB("").C("identities").Remove(m.scope(bson.M{"userID": userid, "provider": provider}))
+}
+
+// GetUsersWithEmail returns the users with the given email address,
+// ignoring case
+func (m *Mongo) GetUsersWithEmail(email string) ([]User, error) {
+	s := m.Session.Copy()
+	defer s.Close()
+	var dbusers []DBUser
+	users := make([]User, 0)
+	q := m.Encryption.lookup(m.owner(""), "email", bson.RegEx{Pattern: "^" + regexp.QuoteMeta(email) + "$", Options: "i"}, email)
+	err := s.DB("").C("users").Find(live(m.scope(q))).All(&dbusers)
+	for _, dbu := range dbusers {
+		dbu.ConvertObjectsIds()
+		if err := m.Encryption.openUser(&dbu); err != nil {
+			return users, err
+		}
+		users = append(users, dbu.User)
+	}
+	return users, err
+}
+
+// emailHash returns the hash a verified email address of tenant is kept
+// as, keyed like phoneHash.
+func (e *FieldEncryption) emailHash(tenant, email string) string {
+	email = strings.ToLower(email)
+	if e != nil {
+		return e.blindIndex(tenant, "verifiedEmail", email)
+	}
+	h := sha256.New()
+	io.WriteString(h, tenant+"\x00"+email)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// setEmailVerified tells whether the email address of dbu is the one last
+// verified, so that changing it makes it unverified.
+func (e *FieldEncryption) setEmailVerified(dbu *DBUser) {
+	dbu.EmailVerified = dbu.Email != "" && dbu.VerifiedEmail == e.emailHash(dbu.Tenant, dbu.Email)
+}
+
+// VerifyEmail marks the email address of a user verified if it is email,
+// which an identity provider vouched for, and leaves it as it is otherwise
+func (m *Mongo) VerifyEmail(userid, email string) error {
+	u, err := m.GetUser(userid)
+	if err != nil || email == "" || !strings.EqualFold(u.Email, email) {
+		return err
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	_, err = conditionalUpdate(s.DB("").C("users"), m.scope(bson.M{"_id": bson.ObjectIdHex(userid)}), 0,
+		bson.M{"$set": bson.M{"verifiedEmail": m.Encryption.emailHash(u.Tenant, email)}})
+	return err
+}
+
+// CreateExternalLogin stores a login at an external provider in progress
+func (m *Mongo) CreateExternalLogin(l *ExternalLogin) error {
+	s := m.Session.Copy()
+	defer s.Close()
+	l.Tenant = m.owner(l.Tenant)
+	return s.DB("").C("external_logins").Insert(l)
+}
+
+// ConsumeExternalLogin removes and returns the login with the given state
+// hash, so that each callback is only accepted once. Expired logins are
+// returned too; the caller checks ExpiresAt.
+func (m *Mongo) ConsumeExternalLogin(hash string) (ExternalLogin, error) {
+	s := m.Session.Copy()
+	defer s.Close()
+	var l ExternalLogin
+	_, err := s.DB("").C("external_logins").Find(m.scope(bson.M{"_id": hash})).Apply(mgo.Change{Remove: true}, &l)
+	return l, err
+}
+
+func (m *Mongo) ensureIdentityIndexes(s *mgo.Session) error {
+	c := s.DB("").C("identities")
+	for _, key := range [][]string{{"tenant", "provider", "subject"}, {"userID", "provider"}} {
+		if err := c.EnsureIndex(mgo.Index{Key: key, Unique: true, Background: true}); err != nil {
+			return err
+		}
+	}
+	// Logins that were never finished are dropped once they expire.
+	return s.DB("").C("external_logins").EnsureIndex(mgo.Index{
+		Key:         []string{"expiresAt"},
+		Background:  true,
+		ExpireAfter: time.Second,
+	})
+}
@@ -0,0 +1,73 @@
+package dbOperations
+
+import (
+	"testing"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+)
+
+func TestIdentities(t *testing.T) {
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	u := NewUser()
+	u.Username = "linked"
+	u.Email = "Linked@Example.com"
+	if err := TestMongo.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	if users, err := TestMongo.GetUsersWithEmail("linked@example.COM"); err != nil || len(users) != 1 {
+		t.Errorf("expected the email to match regardless of case, got %v: %v", users, err)
+	}
+	if users, _ := TestMongo.GetUsersWithEmail("linked@example.com.evil"); len(users) != 0 {
+		t.Errorf("expected only whole addresses to match, got %v", users)
+	}
+	if users, _ := TestMongo.GetUsersWithEmail("linked@example.com"); len(users) != 1 || users[0].EmailVerified {
+		t.Errorf("expected the address not to be verified yet, got %v", users)
+	}
+	if err := TestMongo.VerifyEmail(u.UserID, "other@example.com"); err != nil {
+		t.Error(err)
+	}
+	if err := TestMongo.VerifyEmail(u.UserID, "linked@example.com"); err != nil {
+		t.Error(err)
+	}
+	if users, _ := TestMongo.GetUsersWithEmail("linked@example.com"); len(users) != 1 || !users[0].EmailVerified {
+		t.Errorf("expected the address to be verified, got %v", users)
+	}
+	u.Email = "changed@example.com"
+	if err := TestMongo.UpdateUser(&u, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := TestMongo.GetUser(u.UserID); got.EmailVerified {
+		t.Error("expected a changed address to be unverified")
+	}
+
+	id := Identity{UserID: u.UserID, Provider: "corp", Subject: "s1", LinkedAt: time.Now()}
+	if err := TestMongo.LinkIdentity(&id); err != nil {
+		t.Fatal(err)
+	}
+	other := Identity{UserID: "57a98d98e4b00679b4a830af", Provider: "corp", Subject: "s1", LinkedAt: time.Now()}
+	if err := TestMongo.LinkIdentity(&other); !mgo.IsDup(err) {
+		t.Errorf("expected an external account to be linked once, got %v", err)
+	}
+	if got, err := TestMongo.GetIdentity("corp", "s1"); err != nil || got.UserID != u.UserID {
+		t.Errorf("unexpected identity %v: %v", got, err)
+	}
+	if err := TestMongo.UnlinkIdentity(u.UserID, "corp"); err != nil {
+		t.Error(err)
+	}
+	if ids, err := TestMongo.GetIdentities(u.UserID); err != nil || len(ids) != 0 {
+		t.Errorf("expected no identities, got %v: %v", ids, err)
+	}
+
+	l := ExternalLogin{Hash: "h1", Provider: "corp", ExpiresAt: time.Now().Add(time.Minute)}
+	if err := TestMongo.CreateExternalLogin(&l); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := TestMongo.ConsumeExternalLogin("h1"); err != nil || got.Provider != "corp" {
+		t.Errorf("unexpected login %v: %v", got, err)
+	}
+	if _, err := TestMongo.ConsumeExternalLogin("h1"); err != mgo.ErrNotFound {
+		t.Errorf("expected a login to be finished once, got %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+package dbOperations
+
+import (
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// OAuthClient is an OpenID Connect relying party. Public clients, such as
+// single page apps, have no secret and authenticate with PKCE alone. The
+// secret is only kept hashed.
+type OAuthClient struct {
+	ID           string    `json:"client_id" bson:"-"`
+	Name         string    `json:"client_name" bson:"name"`
+	RedirectURIs []string  `json:"redirect_uris" bson:"redirectURIs"`
+	AuthMethod   string    `json:"token_endpoint_auth_method" bson:"authMethod"`
+	SecretHash   string    `json:"-" bson:"secretHash,omitempty"`
+	CreatedAt    time.Time `json:"createdAt" bson:"createdAt"`
+	CreatedBy    string    `json:"createdBy" bson:"createdBy"`
+	// Tenant is the tenant whose users the client signs in.
+	Tenant string `json:"-" bson:"tenant"`
+}
+
+// DBOAuthClient is a wrapper for OAuthClient
+type DBOAuthClient struct {
+	OAuthClient `bson:",inline"`
+	ID          bson.ObjectId `bson:"_id"`
+}
+
+// AuthCode is an authorization code waiting to be exchanged for tokens.
+// It is keyed by the hash of the code, so the codes themselves are never
+// stored.
+type AuthCode struct {
+	Hash            string    `bson:"_id"`
+	ClientID        string    `bson:"clientID"`
+	UserID          string    `bson:"userID"`
+	RedirectURI     string    `bson:"redirectURI"`
+	Scope           []string  `bson:"scope"`
+	Nonce           string    `bson:"nonce,omitempty"`
+	Challenge       string    `bson:"challenge"`
+	ChallengeMethod string    `bson:"challengeMethod"`
+	AuthTime        time.Time `bson:"authTime"`
+	ExpiresAt       time.Time `bson:"expiresAt"`
+}
+
+// Consent records the scopes a user granted a client, so they are not
+// asked again.
+type Consent struct {
+	UserID    string    `json:"userID" bson:"userID"`
+	ClientID  string    `json:"clientID" bson:"clientID"`
+	Scope     []string  `json:"scope" bson:"scope"`
+	GrantedAt time.Time `json:"grantedAt" bson:"grantedAt"`
+}
+
+// CreateOAuthClient registers a relying party
+func (m *Mongo) CreateOAuthClient(cl *OAuthClient) error {
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB("").C("oauth_clients")
+	if cl.RedirectURIs == nil {
+		cl.RedirectURIs = make([]string, 0)
+	}
+	cl.Tenant = m.owner(cl.Tenant)
+	dbc := DBOAuthClient{OAuthClient: *cl, ID: bson.NewObjectId()}
+	if err := c.Insert(dbc); err != nil {
+		return err
+	}
+	cl.ID = dbc.ID.Hex()
+	return nil
+}
+
+// GetOAuthClients returns all relying parties, oldest first
+func (m *Mongo) GetOAuthClients() ([]OAuthClient, error) {
+	s := m.Session.Copy()
+	defer s.Close()
+	var dbcs []DBOAuthClient
+	err := s.DB("").C("oauth_clients").Find(m.scope(bson.M{})).Sort("createdAt").All(&dbcs)
+	clients := make([]OAuthClient, 0)
+	for _, dbc := range dbcs {
+		dbc.OAuthClient.ID = dbc.ID.Hex()
+		clients = append(clients, dbc.OAuthClient)
+	}
+	return clients, err
+}
+
+// GetOAuthClient returns the relying party with the given client id
+func (m *Mongo) GetOAuthClient(id string) (OAuthClient, error) {
+	if !bson.IsObjectIdHex(id) {
+		return OAuthClient{}, ErrInvalidHexID
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	var dbc DBOAuthClient
+	err := s.DB("").C("oauth_clients").Find(m.scope(bson.M{"_id": bson.ObjectIdHex(id)})).One(&dbc)
+	dbc.OAuthClient.ID = dbc.ID.Hex()
+	return dbc.OAuthClient, err
+}
+
+// DeleteOAuthClient removes a relying party along with the consents given
+// to it and its pending authorization codes
+func (m *Mongo) DeleteOAuthClient(id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrInvalidHexID
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	if err := s.DB("").C("oauth_clients").Remove(m.scope(bson.M{"_id": bson.ObjectIdHex(id)})); err != nil {
+		return err
+	}
+	if _, err := s.DB("").C("oauth_consents").RemoveAll(bson.M{"clientID": id}); err != nil {
+		return err
+	}
+	_, err := s.DB("").C("oauth_codes").RemoveAll(bson.M{"clientID": id})
+	return err
+}
+
+// CreateAuthCode stores an authorization code
+func (m *Mongo) CreateAuthCode(code *AuthCode) error {
+	s := m.Session.Copy()
+	defer s.Close()
+	return s.DB("").C("oauth_codes").Insert(code)
+}
+
+// ConsumeAuthCode removes and returns the authorization code with the
+// given hash, so that each code can be exchanged only once. Expired codes
+// are returned too; the caller checks ExpiresAt.
+func (m *Mongo) ConsumeAuthCode(hash string) (AuthCode, error) {
+	s := m.Session.Copy()
+	defer s.Close()
+	var code AuthCode
+	_, err := s.DB("").C("oauth_codes").FindId(hash).Apply(mgo.Change{Remove: true}, &code)
+	return code, err
+}
+
+// GetConsent returns the consent a user gave a client
+func (m *Mongo) GetConsent(userID, clientID string) (Consent, error) {
+	s := m.Session.Copy()
+	defer s.Close()
+	var c Consent
+	err := s.DB("").C("oauth_consents").Find(bson.M{"userID": userID, "clientID": clientID}).One(&c)
+	return c, err
+}
+
+// GetConsents returns the consents a user gave, oldest first
+func (m *Mongo) GetConsents(userID string) ([]Consent, error) {
+	s := m.Session.Copy()
+	defer s.Close()
+	consents := make([]Consent, 0)
+	err := s.DB("").C("oauth_consents").Find(bson.M{"userID": userID}).Sort("grantedAt").All(&consents)
+	return consents, err
+}
+
+// SaveConsent stores a consent, replacing the one the user gave the
+// client before
+func (m *Mongo) SaveConsent(c Consent) error {
+	s := m.Session.Copy()
+	defer s.Close()
+	_, err := s.DB("").C("oauth_consents").Upsert(bson.M{"userID": c.UserID, "clientID": c.ClientID}, c)
+	return err
+}
+
+func (m *Mongo) ensureOIDCIndexes(s *mgo.Session) error {
+	err := s.DB("").C("oauth_consents").EnsureIndex(mgo.Index{
+		Key:        []string{"userID", "clientID"},
+		Unique:     true,
+		Background: true,
+	})
+	if err != nil {
+		return err
+	}
+	// Codes that were never exchanged are dropped once they expire.
+	return s.DB("").C("oauth_codes").EnsureIndex(mgo.Index{
+		Key:         []string{"expiresAt"},
+		Background:  true,
+		ExpireAfter: time.Second,
+	})
+}
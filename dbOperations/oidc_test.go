@@ -0,0 +1,50 @@
+package dbOperations
+
+import (
+	"testing"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+)
+
+func TestOIDCGrants(t *testing.T) {
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	cl := OAuthClient{Name: "shop", RedirectURIs: []string{"https://shop.example.com/cb"}, AuthMethod: "none", CreatedAt: time.Now()}
+	if err := TestMongo.CreateOAuthClient(&cl); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := TestMongo.GetOAuthClient(cl.ID); err != nil || got.Name != "shop" {
+		t.Errorf("unexpected client %v: %v", got, err)
+	}
+
+	code := AuthCode{Hash: "h1", ClientID: cl.ID, UserID: "u1", Scope: []string{"openid"}, ExpiresAt: time.Now().Add(time.Minute)}
+	if err := TestMongo.CreateAuthCode(&code); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := TestMongo.ConsumeAuthCode("h1"); err != nil || got.UserID != "u1" {
+		t.Errorf("unexpected code %v: %v", got, err)
+	}
+	if _, err := TestMongo.ConsumeAuthCode("h1"); err != mgo.ErrNotFound {
+		t.Errorf("expected a code to be usable once, got %v", err)
+	}
+
+	for _, scope := range [][]string{{"openid"}, {"openid", "email"}} {
+		if err := TestMongo.SaveConsent(Consent{UserID: "u1", ClientID: cl.ID, Scope: scope, GrantedAt: time.Now()}); err != nil {
+			t.Error(err)
+		}
+	}
+	if c, err := TestMongo.GetConsent("u1", cl.ID); err != nil || len(c.Scope) != 2 {
+		t.Errorf("expected the consent to be replaced, got %v: %v", c, err)
+	}
+	if got, err := TestMongo.GetConsents("u1"); err != nil || len(got) != 1 || got[0].ClientID != cl.ID {
+		t.Errorf("expected the consents of u1, got %v: %v", got, err)
+	}
+
+	if err := TestMongo.DeleteOAuthClient(cl.ID); err != nil {
+		t.Error(err)
+	}
+	if _, err := TestMongo.GetConsent("u1", cl.ID); err != mgo.ErrNotFound {
+		t.Errorf("expected the consent to go with the client, got %v", err)
+	}
+}
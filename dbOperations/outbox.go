@@ -0,0 +1,276 @@
+package dbOperations
+
+import (
+	"encoding/json"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// publishedEventTTL is how long published events stay in the outbox.
+const publishedEventTTL = 7 * 24 * time.Hour
+
+// Events of the changes the store writes along with the change itself.
+const (
+	EventUserRegistered  = "UserRegistered"
+	EventAddressAdded    = "AddressAdded"
+	EventAddressRemoved  = "AddressRemoved"
+	EventUserDeleted     = "UserDeleted"
+	EventUserRestored    = "UserRestored"
+	EventAddressRestored = "AddressRestored"
+)
+
+// eventSources are the collections whose documents keep the events of
+// their changes in pendingEvents until a relay moves them to the outbox.
+var eventSources = []string{"users", "addresses"}
+
+// Event is a domain event waiting in the outbox to be published. Its ID is
+// stable across redeliveries, so consumers can drop duplicates.
+type Event struct {
+	ID        string          `json:"id" bson:"-"`
+	Type      string          `json:"type" bson:"type"`
+	Time      time.Time       `json:"time" bson:"time"`
+	UserID    string          `json:"userID" bson:"userID"`
+	AddressID string          `json:"addressID,omitempty" bson:"addressID,omitempty"`
+	Actor     string          `json:"actor,omitempty" bson:"actor,omitempty"`
+	Payload   json.RawMessage `json:"payload,omitempty" bson:"payload,omitempty"`
+	// Tenant is the tenant of the user.
+	Tenant string `json:"tenant,omitempty" bson:"tenant"`
+	// Delivery state, kept by the relay.
+	Attempts    int        `json:"-" bson:"attempts"`
+	NextAttempt time.Time  `json:"-" bson:"nextAttempt"`
+	PublishedAt *time.Time `json:"-" bson:"publishedAt,omitempty"`
+	LastError   string     `json:"-" bson:"lastError,omitempty"`
+}
+
+// DBEvent is a wrapper for Event
+type DBEvent struct {
+	Event `bson:",inline"`
+	ID    bson.ObjectId `bson:"_id"`
+}
+
+// UserPayload is the payload of the events about a user. Events sit in
+// pendingEvents and the outbox unencrypted and go out to webhooks, so
+// they name the user and the state others react to, and consumers read
+// personal data from the API.
+type UserPayload struct {
+	ID              string     `json:"id"`
+	Version         int64      `json:"version"`
+	PhoneVerified   bool       `json:"phoneVerified"`
+	EmailVerified   bool       `json:"emailVerified"`
+	DefaultShipping string     `json:"defaultShippingAddress,omitempty"`
+	DefaultBilling  string     `json:"defaultBillingAddress,omitempty"`
+	DeletedAt       *time.Time `json:"deletedAt,omitempty"`
+}
+
+// EventPayload returns the payload of the events about u.
+func (u User) EventPayload() UserPayload {
+	return UserPayload{
+		ID:              u.UserID,
+		Version:         u.Version,
+		PhoneVerified:   u.PhoneVerified,
+		EmailVerified:   u.EmailVerified,
+		DefaultShipping: u.DefaultShipping,
+		DefaultBilling:  u.DefaultBilling,
+		DeletedAt:       u.DeletedAt,
+	}
+}
+
+// AddressPayload is the payload of the events about an address, without
+// the parts of it that locate the user.
+type AddressPayload struct {
+	ID      string   `json:"id"`
+	Version int64    `json:"version"`
+	Country string   `json:"country,omitempty"`
+	Types   []string `json:"types,omitempty"`
+}
+
+// EventPayload returns the payload of the events about a.
+func (a Address) EventPayload() AddressPayload {
+	return AddressPayload{ID: a.ID, Version: a.Version, Country: a.Country, Types: a.Types}
+}
+
+// AcceptancePayload is the payload of the events about an acceptance,
+// without the IP and user agent of the request that carried it.
+type AcceptancePayload struct {
+	ID      string    `json:"id"`
+	UserID  string    `json:"userID"`
+	Policy  string    `json:"policy"`
+	Version string    `json:"version"`
+	Action  string    `json:"action"`
+	At      time.Time `json:"at"`
+	Channel string    `json:"channel"`
+}
+
+// EventPayload returns the payload of the events about a.
+func (a Acceptance) EventPayload() AcceptancePayload {
+	return AcceptancePayload{
+		ID: a.ID, UserID: a.UserID, Policy: a.Policy, Version: a.Version,
+		Action: a.Action, At: a.At, Channel: a.Channel,
+	}
+}
+
+// AppendEvent adds an event to the outbox, due for publishing straight away
+func (m *Mongo) AppendEvent(e *Event) error {
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB("").C("outbox")
+	e.Tenant = m.owner(e.Tenant)
+	dbe := DBEvent{Event: *e, ID: bson.NewObjectId()}
+	dbe.NextAttempt = dbe.Time
+	if err := c.Insert(dbe); err != nil {
+		return err
+	}
+	e.ID = dbe.ID.Hex()
+	return nil
+}
+
+// newEvent returns the event of type typ about the user userid, for the
+// write of the change it describes to push onto the pendingEvents of the
+// document it changes. Mongo writes one document atomically, so the change
+// and its event are stored together or not at all.
+func (m *Mongo) newEvent(typ, userid, tenant string, payload interface{}) (DBEvent, error) {
+	e := DBEvent{ID: bson.NewObjectId()}
+	e.Type, e.UserID, e.Tenant = typ, userid, m.owner(tenant)
+	e.Time = time.Now().UTC()
+	e.NextAttempt = e.Time
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return e, err
+		}
+		e.Payload = b
+	}
+	return e, nil
+}
+
+// withEvent adds pushing e onto the document's pending events to update.
+func withEvent(update bson.M, e DBEvent) bson.M {
+	update["$push"] = bson.M{"pendingEvents": e}
+	return update
+}
+
+// drainPendingEvents moves the events written along with changes to the
+// outbox. An event keeps its id and is inserted before it is pulled from
+// its document, so one moved twice by racing relays is only stored once.
+func drainPendingEvents(s *mgo.Session) error {
+	outbox := s.DB("").C("outbox")
+	for _, name := range eventSources {
+		c := s.DB("").C(name)
+		iter := c.Find(bson.M{"pendingEvents._id": bson.M{"$exists": true}}).Select(bson.M{"pendingEvents": 1}).Iter()
+		for {
+			var doc struct {
+				ID     bson.ObjectId `bson:"_id"`
+				Events []DBEvent     `bson:"pendingEvents"`
+			}
+			if !iter.Next(&doc) {
+				break
+			}
+			ids := make([]bson.ObjectId, 0, len(doc.Events))
+			for _, e := range doc.Events {
+				if err := outbox.Insert(e); err != nil && !mgo.IsDup(err) {
+					iter.Close()
+					return err
+				}
+				ids = append(ids, e.ID)
+			}
+			err := c.UpdateId(doc.ID, bson.M{"$pull": bson.M{"pendingEvents": bson.M{"_id": bson.M{"$in": ids}}}})
+			if err != nil {
+				iter.Close()
+				return err
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ClaimEvents returns up to limit unpublished events that are due at now,
+// oldest first, and holds each back from other relays for lease. Events
+// still pending on the documents they were written with are moved to the
+// outbox first.
+func (m *Mongo) ClaimEvents(now time.Time, lease time.Duration, limit int) ([]Event, error) {
+	s := m.Session.Copy()
+	defer s.Close()
+	if err := drainPendingEvents(s); err != nil {
+		return nil, err
+	}
+	c := s.DB("").C("outbox")
+	events := make([]Event, 0)
+	for len(events) < limit {
+		var dbe DBEvent
+		_, err := c.Find(bson.M{"publishedAt": bson.M{"$exists": false}, "nextAttempt": bson.M{"$lte": now}}).
+			Sort("nextAttempt").
+			Apply(mgo.Change{Update: bson.M{"$set": bson.M{"nextAttempt": now.Add(lease)}}}, &dbe)
+		if err == mgo.ErrNotFound {
+			break
+		}
+		if err != nil {
+			return events, err
+		}
+		dbe.Event.ID = dbe.ID.Hex()
+		events = append(events, dbe.Event)
+	}
+	return events, nil
+}
+
+// MarkEventPublished takes a published event out of the relay's way
+func (m *Mongo) MarkEventPublished(id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrInvalidHexID
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB("").C("outbox")
+	return c.UpdateId(bson.ObjectIdHex(id), bson.M{
+		"$set":   bson.M{"publishedAt": time.Now()},
+		"$inc":   bson.M{"attempts": 1},
+		"$unset": bson.M{"lastError": ""},
+	})
+}
+
+// MarkEventFailed records a failed attempt to publish an event and when to retry it
+func (m *Mongo) MarkEventFailed(id string, cause error, retryAt time.Time) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrInvalidHexID
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB("").C("outbox")
+	return c.UpdateId(bson.ObjectIdHex(id), bson.M{
+		"$set": bson.M{"nextAttempt": retryAt, "lastError": cause.Error()},
+		"$inc": bson.M{"attempts": 1},
+	})
+}
+
+func (m *Mongo) ensureOutboxIndexes(s *mgo.Session) error {
+	for _, name := range eventSources {
+		err := s.DB("").C(name).EnsureIndex(mgo.Index{
+			Key:        []string{"pendingEvents._id"},
+			Sparse:     true,
+			Background: true,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	c := s.DB("").C("outbox")
+	err := c.EnsureIndex(mgo.Index{
+		Key:        []string{"publishedAt", "nextAttempt"},
+		Background: true,
+	})
+	if err != nil {
+		return err
+	}
+	// Published events are dropped after a while. Unpublished ones have no
+	// publishedAt and are kept until they go out.
+	return c.EnsureIndex(mgo.Index{
+		Key:         []string{"publishedAt"},
+		Sparse:      true,
+		Background:  true,
+		ExpireAfter: publishedEventTTL,
+	})
+}
@@ -0,0 +1,132 @@
+package dbOperations
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestOutbox(t *testing.T) {
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	now := time.Now()
+	// Hold back the events other tests left behind.
+	TestMongo.ClaimEvents(now, time.Hour, 1000)
+	for _, typ := range []string{"UserRegistered", "UserDeleted"} {
+		if err := TestMongo.AppendEvent(&Event{Type: typ, Time: now, UserID: "57a98d98e4b00679b4a830af"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	events, err := TestMongo.ClaimEvents(now, time.Minute, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Type != "UserRegistered" {
+		t.Fatalf("unexpected events %v", events)
+	}
+	if again, _ := TestMongo.ClaimEvents(now, time.Minute, 10); len(again) != 0 {
+		t.Errorf("expected claimed events to be held back, got %v", again)
+	}
+	if err := TestMongo.MarkEventPublished(events[0].ID); err != nil {
+		t.Error(err)
+	}
+	if err := TestMongo.MarkEventFailed(events[1].ID, errors.New("down"), now); err != nil {
+		t.Error(err)
+	}
+	retried, _ := TestMongo.ClaimEvents(now, time.Minute, 10)
+	if len(retried) != 1 || retried[0].ID != events[1].ID || retried[0].Attempts != 1 || retried[0].LastError != "down" {
+		t.Errorf("expected only the failed event to be retried, got %v", retried)
+	}
+}
+
+func TestPendingEvents(t *testing.T) {
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	TestMongo.ClaimEvents(time.Now(), time.Hour, 1000)
+	u := User{Username: "pendingevents", Addresses: []Address{}}
+	if err := TestMongo.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	a := Address{City: "Zurich"}
+	if err := TestMongo.CreateAddress(&a, u.UserID); err != nil {
+		t.Fatal(err)
+	}
+	TestMongo.DeleteAddress(u.UserID, a.ID, "tester", 0)
+	TestMongo.RestoreAddress(a.ID)
+	TestMongo.DeleteUser(u.UserID, "tester", 0)
+	TestMongo.RestoreUser(u.UserID)
+
+	n, _ := TestMongo.Session.DB("").C("users").Find(bson.M{"pendingEvents.0": bson.M{"$exists": true}}).Count()
+	if n != 1 {
+		t.Errorf("expected the events to wait on the user, got %d users with events", n)
+	}
+	events, err := TestMongo.ClaimEvents(time.Now(), time.Minute, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]Event{}
+	for _, e := range events {
+		got[e.Type] = e
+	}
+	for _, typ := range []string{EventUserRegistered, EventAddressAdded, EventAddressRemoved, EventAddressRestored, EventUserDeleted, EventUserRestored} {
+		if e, ok := got[typ]; !ok || e.UserID != u.UserID || e.Tenant != DefaultTenant {
+			t.Errorf("expected a %s event of the user, got %+v", typ, events)
+		}
+	}
+	if len(events) != 6 || got[EventAddressRemoved].AddressID != a.ID || got[EventUserDeleted].Actor != "tester" {
+		t.Errorf("unexpected events %+v", events)
+	}
+	n, _ = TestMongo.Session.DB("").C("users").Find(bson.M{"pendingEvents.0": bson.M{"$exists": true}}).Count()
+	if n != 0 {
+		t.Errorf("expected the events to be moved to the outbox, %d users still have some", n)
+	}
+}
+
+func TestEventsCarryNoPersonalData(t *testing.T) {
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	TestMongo.ClaimEvents(time.Now(), time.Hour, 1000)
+	u := User{Username: "eventpii", Email: "eventpii@example.com", FirstName: "Evelyn", LastName: "Piiper", Phone: "+41441234567", Addresses: []Address{}}
+	if err := TestMongo.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	a := Address{Country: "CH", City: "Winterthur", Street: "Piistrasse", Number: "42", PostCode: "8400"}
+	if err := TestMongo.CreateAddress(&a, u.UserID); err != nil {
+		t.Fatal(err)
+	}
+	personal := []string{u.Username, u.Email, u.FirstName, u.LastName, u.Phone, a.City, a.Street, a.PostCode}
+	check := func(where string, doc bson.M) {
+		b, err := bson.Marshal(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range personal {
+			if bytes.Contains(b, []byte(p)) {
+				t.Errorf("found %q in %s: %v", p, where, doc)
+			}
+		}
+	}
+	for _, c := range []string{"users", "addresses"} {
+		var doc bson.M
+		TestMongo.Session.DB("").C(c).Find(bson.M{"pendingEvents.userID": u.UserID}).Select(bson.M{"pendingEvents": 1}).One(&doc)
+		if doc == nil {
+			t.Fatalf("expected pending events in %s", c)
+		}
+		check(c, doc)
+	}
+
+	if _, err := TestMongo.ClaimEvents(time.Now(), time.Minute, 10); err != nil {
+		t.Fatal(err)
+	}
+	var docs []bson.M
+	TestMongo.Session.DB("").C("outbox").Find(bson.M{"userID": u.UserID}).All(&docs)
+	if len(docs) != 2 {
+		t.Fatalf("expected the user's two events in the outbox, got %v", docs)
+	}
+	for _, doc := range docs {
+		check("the outbox", doc)
+	}
+}
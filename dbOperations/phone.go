@@ -0,0 +1,121 @@
+package dbOperations
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"io"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	//ErrPhoneCode is returned when confirming a phone number with a code that is wrong, expired or used up
+	ErrPhoneCode = errors.New("Wrong or expired verification code")
+)
+
+// phoneCodeAttempts is how often a verification code can be guessed
+// before it is dropped.
+const phoneCodeAttempts = 5
+
+// PhoneVerification is a code sent to the phone number of a user, waiting
+// to be confirmed. A user has one at a time, kept by their id. The code and
+// the number it was sent to are only kept hashed.
+type PhoneVerification struct {
+	UserID    string    `bson:"_id"`
+	Tenant    string    `bson:"tenant"`
+	PhoneHash string    `bson:"phoneHash"`
+	CodeHash  string    `bson:"codeHash"`
+	Attempts  int       `bson:"attempts"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+// phoneHash returns the hash a verified phone number of tenant is kept as.
+// It is keyed with the blind index key when there is one, as phone numbers
+// are few enough to be guessed from a plain hash; enabling encryption thus
+// makes earlier verifications lapse.
+func (e *FieldEncryption) phoneHash(tenant, phone string) string {
+	if e != nil {
+		return e.blindIndex(tenant, "verifiedPhone", phone)
+	}
+	h := sha256.New()
+	io.WriteString(h, tenant+"\x00"+phone)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// setPhoneVerified tells whether the phone number of dbu is the one last
+// verified, so that changing it makes it unverified.
+func (e *FieldEncryption) setPhoneVerified(dbu *DBUser) {
+	dbu.PhoneVerified = dbu.Phone != "" && dbu.VerifiedPhone == e.phoneHash(dbu.Tenant, dbu.Phone)
+}
+
+// CreatePhoneVerification stores the hash of a code sent to phone, the
+// number of the user, replacing the one sent before.
+func (m *Mongo) CreatePhoneVerification(userid, phone, codeHash string, expiresAt time.Time) error {
+	u, err := m.GetUser(userid)
+	if err != nil {
+		return err
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	v := PhoneVerification{
+		UserID:    userid,
+		Tenant:    u.Tenant,
+		PhoneHash: m.Encryption.phoneHash(u.Tenant, phone),
+		CodeHash:  codeHash,
+		ExpiresAt: expiresAt,
+	}
+	_, err = s.DB("").C("phone_verifications").UpsertId(userid, v)
+	return err
+}
+
+// ConfirmPhone marks the phone number of a user verified if codeHash is
+// the hash of the code sent to it, and returns the user's new version. A
+// code is dropped once it has been used, has expired or has been guessed
+// wrong too often, or if the number changed since it was sent; all of these
+// are ErrPhoneCode.
+func (m *Mongo) ConfirmPhone(userid, codeHash string) (int64, error) {
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB("").C("phone_verifications")
+	var v PhoneVerification
+	err := c.Find(m.scope(bson.M{"_id": userid})).One(&v)
+	if err == mgo.ErrNotFound {
+		return 0, ErrPhoneCode
+	}
+	if err != nil {
+		return 0, err
+	}
+	if subtle.ConstantTimeCompare([]byte(v.CodeHash), []byte(codeHash)) != 1 {
+		if v.Attempts+1 >= phoneCodeAttempts || time.Now().After(v.ExpiresAt) {
+			err = c.RemoveId(userid)
+		} else {
+			err = c.UpdateId(userid, bson.M{"$inc": bson.M{"attempts": 1}})
+		}
+		if err != nil && err != mgo.ErrNotFound {
+			return 0, err
+		}
+		return 0, ErrPhoneCode
+	}
+	if err := c.RemoveId(userid); err != nil {
+		if err == mgo.ErrNotFound {
+			// Confirmed by a concurrent request.
+			return 0, ErrPhoneCode
+		}
+		return 0, err
+	}
+	u, err := m.GetUser(userid)
+	if err != nil {
+		return 0, err
+	}
+	if time.Now().After(v.ExpiresAt) || v.PhoneHash != m.Encryption.phoneHash(u.Tenant, u.Phone) {
+		return 0, ErrPhoneCode
+	}
+	// The hash only verifies the number it was made of, so it can be set
+	// whatever changed since.
+	return conditionalUpdate(s.DB("").C("users"), m.scope(bson.M{"_id": bson.ObjectIdHex(userid)}), 0,
+		bson.M{"$set": bson.M{"verifiedPhone": v.PhoneHash}})
+}
@@ -0,0 +1,70 @@
+package dbOperations
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPhoneVerified(t *testing.T) {
+	for _, e := range []*FieldEncryption{nil, newTestEncryption(t, "users.phone")} {
+		dbu := DBUser{User: User{Phone: "+41446681800", Tenant: "acme"}}
+		dbu.VerifiedPhone = e.phoneHash("acme", "+41446681800")
+		e.setPhoneVerified(&dbu)
+		if !dbu.PhoneVerified {
+			t.Errorf("expected the verified number to be verified")
+		}
+		dbu.Phone = "+41446681801"
+		if e.setPhoneVerified(&dbu); dbu.PhoneVerified {
+			t.Errorf("expected another number to be unverified")
+		}
+		if e.phoneHash("acme", "+41446681800") == e.phoneHash("globex", "+41446681800") {
+			t.Errorf("expected the hashes to differ between tenants")
+		}
+	}
+}
+
+func TestConfirmPhone(t *testing.T) {
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	u := User{Username: "phone", Phone: "+41446681800"}
+	if err := TestMongo.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	expires := time.Now().Add(time.Minute)
+	if err := TestMongo.CreatePhoneVerification(u.UserID, u.Phone, "right", expires); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TestMongo.ConfirmPhone(u.UserID, "wrong"); err != ErrPhoneCode {
+		t.Errorf("expected a wrong code to be refused, got %v", err)
+	}
+	if _, err := TestMongo.ConfirmPhone(u.UserID, "right"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := TestMongo.GetUser(u.UserID)
+	if err != nil || !got.PhoneVerified {
+		t.Fatalf("expected the phone number to be verified, got %+v: %v", got, err)
+	}
+	if _, err := TestMongo.ConfirmPhone(u.UserID, "right"); err != ErrPhoneCode {
+		t.Errorf("expected a used code to be refused, got %v", err)
+	}
+
+	got.Phone = "+41446681801"
+	if err := TestMongo.UpdateUser(&got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ = TestMongo.GetUser(u.UserID); got.PhoneVerified {
+		t.Errorf("expected a new number to be unverified, got %+v", got)
+	}
+
+	TestMongo.CreatePhoneVerification(u.UserID, got.Phone, "right", expires)
+	for i := 0; i < phoneCodeAttempts; i++ {
+		TestMongo.ConfirmPhone(u.UserID, "wrong")
+	}
+	if _, err := TestMongo.ConfirmPhone(u.UserID, "right"); err != ErrPhoneCode {
+		t.Errorf("expected the code to be dropped after too many attempts, got %v", err)
+	}
+	TestMongo.CreatePhoneVerification(u.UserID, got.Phone, "right", time.Now().Add(-time.Second))
+	if _, err := TestMongo.ConfirmPhone(u.UserID, "right"); err != ErrPhoneCode {
+		t.Errorf("expected an expired code to be refused, got %v", err)
+	}
+}
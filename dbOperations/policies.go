@@ -0,0 +1,141 @@
+package dbOperations
+
+import (
+	"errors"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	//ErrPolicyExists is returned when a policy version is published twice
+	ErrPolicyExists = errors.New("Policy version already published")
+)
+
+// What an acceptance record says the user did.
+const (
+	// AcceptanceAccepted records that the user accepted a policy version.
+	AcceptanceAccepted = "accepted"
+	// AcceptanceWithdrawn records that the user withdrew their acceptance
+	// of a policy, whatever its version.
+	AcceptanceWithdrawn = "withdrawn"
+)
+
+// Policy is one published version of a document customers accept, such as
+// the terms of service or the privacy policy. Versions are never changed
+// or removed, so that what a customer accepted can be shown later.
+type Policy struct {
+	ID string `json:"id" bson:"-"`
+	// Name is the document, as in "terms"; Version tells its versions
+	// apart.
+	Name    string `json:"name" bson:"name"`
+	Version string `json:"version" bson:"version"`
+	Title   string `json:"title" bson:"title"`
+	// URL is where the version can be read.
+	URL string `json:"url" bson:"url"`
+	// Mandatory versions must be accepted before logging in again.
+	Mandatory   bool      `json:"mandatory" bson:"mandatory"`
+	PublishedAt time.Time `json:"publishedAt" bson:"publishedAt"`
+	PublishedBy string    `json:"publishedBy" bson:"publishedBy"`
+	// Tenant is the tenant the policy is published for.
+	Tenant string `json:"-" bson:"tenant"`
+}
+
+// DBPolicy is a wrapper for Policy
+type DBPolicy struct {
+	Policy `bson:",inline"`
+	ID     bson.ObjectId `bson:"_id"`
+}
+
+// Acceptance records that a user accepted a policy version, or withdrew
+// their acceptance of a policy, and where they did. Records are only ever
+// added; the latest one of a policy is the user's current decision.
+type Acceptance struct {
+	ID      string    `json:"id" bson:"-"`
+	UserID  string    `json:"userID" bson:"userID"`
+	Policy  string    `json:"policy" bson:"policy"`
+	Version string    `json:"version" bson:"version"`
+	Action  string    `json:"action" bson:"action"`
+	At      time.Time `json:"at" bson:"at"`
+	// IP and UserAgent are those of the request that carried the decision.
+	IP        string `json:"ip" bson:"ip"`
+	UserAgent string `json:"userAgent,omitempty" bson:"userAgent,omitempty"`
+	// Channel is how the decision was made, as in "register" or "login".
+	Channel string `json:"channel" bson:"channel"`
+	// Tenant is the tenant of the user.
+	Tenant string `json:"-" bson:"tenant"`
+}
+
+// DBAcceptance is a wrapper for Acceptance
+type DBAcceptance struct {
+	Acceptance `bson:",inline"`
+	ID         bson.ObjectId `bson:"_id"`
+}
+
+// CreatePolicy publishes a policy version
+func (m *Mongo) CreatePolicy(p *Policy) error {
+	s := m.Session.Copy()
+	defer s.Close()
+	p.Tenant = m.owner(p.Tenant)
+	dbp := DBPolicy{Policy: *p, ID: bson.NewObjectId()}
+	if err := s.DB("").C("policies").Insert(dbp); err != nil {
+		if mgo.IsDup(err) {
+			return ErrPolicyExists
+		}
+		return err
+	}
+	p.ID = dbp.ID.Hex()
+	return nil
+}
+
+// GetPolicies returns every published policy version, by name and then
+// oldest first
+func (m *Mongo) GetPolicies() ([]Policy, error) {
+	s := m.Session.Copy()
+	defer s.Close()
+	var dbps []DBPolicy
+	err := s.DB("").C("policies").Find(m.scope(bson.M{})).Sort("name", "publishedAt").All(&dbps)
+	policies := make([]Policy, 0)
+	for _, dbp := range dbps {
+		dbp.Policy.ID = dbp.ID.Hex()
+		policies = append(policies, dbp.Policy)
+	}
+	return policies, err
+}
+
+// AddAcceptance records a user's decision about a policy
+func (m *Mongo) AddAcceptance(a *Acceptance) error {
+	s := m.Session.Copy()
+	defer s.Close()
+	a.Tenant = m.owner(a.Tenant)
+	dba := DBAcceptance{Acceptance: *a, ID: bson.NewObjectId()}
+	if err := s.DB("").C("acceptances").Insert(dba); err != nil {
+		return err
+	}
+	a.ID = dba.ID.Hex()
+	return nil
+}
+
+// GetAcceptances returns the decisions a user made about policies, oldest
+// first
+func (m *Mongo) GetAcceptances(userid string) ([]Acceptance, error) {
+	s := m.Session.Copy()
+	defer s.Close()
+	var dbas []DBAcceptance
+	err := s.DB("").C("acceptances").Find(m.scope(bson.M{"userID": userid})).Sort("at", "_id").All(&dbas)
+	acceptances := make([]Acceptance, 0)
+	for _, dba := range dbas {
+		dba.Acceptance.ID = dba.ID.Hex()
+		acceptances = append(acceptances, dba.Acceptance)
+	}
+	return acceptances, err
+}
+
+func (m *Mongo) ensurePolicyIndexes(s *mgo.Session) error {
+	i := mgo.Index{Key: []string{"tenant", "name", "version"}, Unique: true, Background: true}
+	if err := s.DB("").C("policies").EnsureIndex(i); err != nil {
+		return err
+	}
+	return s.DB("").C("acceptances").EnsureIndex(mgo.Index{Key: []string{"tenant", "userID", "at"}, Background: true})
+}
@@ -0,0 +1,46 @@
+package dbOperations
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPolicies(t *testing.T) {
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	now := time.Now().UTC()
+	for _, p := range []Policy{
+		{Name: "terms", Version: "1", Mandatory: true, PublishedAt: now.Add(-time.Hour)},
+		{Name: "privacy", Version: "1", Mandatory: true, PublishedAt: now.Add(-time.Hour)},
+		{Name: "terms", Version: "2", PublishedAt: now},
+	} {
+		if err := TestMongo.CreatePolicy(&p); err != nil || p.ID == "" {
+			t.Fatalf("expected %s:%s to be published, got %v", p.Name, p.Version, err)
+		}
+	}
+	if err := TestMongo.CreatePolicy(&Policy{Name: "terms", Version: "2", PublishedAt: now}); err != ErrPolicyExists {
+		t.Errorf("expected a version to be published once, got %v", err)
+	}
+	policies, err := TestMongo.GetPolicies()
+	if err != nil || len(policies) != 3 || policies[0].Name != "privacy" || policies[2].Version != "2" {
+		t.Errorf("expected the policies by name and then oldest first, got %+v: %v", policies, err)
+	}
+	acme := TestMongo.ForTenant("acme")
+	if policies, _ := acme.GetPolicies(); len(policies) != 0 {
+		t.Errorf("expected the policies of another tenant to be apart, got %+v", policies)
+	}
+
+	for _, a := range []Acceptance{
+		{UserID: "u1", Policy: "terms", Version: "1", Action: AcceptanceAccepted, At: now.Add(-time.Minute), IP: "203.0.113.7", Channel: "register"},
+		{UserID: "u2", Policy: "terms", Version: "1", Action: AcceptanceAccepted, At: now},
+		{UserID: "u1", Policy: "terms", Version: "1", Action: AcceptanceWithdrawn, At: now, Channel: "api"},
+	} {
+		if err := TestMongo.AddAcceptance(&a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := TestMongo.GetAcceptances("u1")
+	if err != nil || len(got) != 2 || got[0].IP != "203.0.113.7" || got[1].Action != AcceptanceWithdrawn {
+		t.Errorf("expected the decisions of u1, oldest first, got %+v: %v", got, err)
+	}
+}
@@ -0,0 +1,78 @@
+package dbOperations
+
+import (
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Preferences are how a user likes to be served by the storefront.
+type Preferences struct {
+	// Locale is a BCP 47 language tag, as in "de-CH".
+	Locale string `json:"locale,omitempty" bson:"locale,omitempty"`
+	// Currency is an ISO 4217 currency code, as in "CHF".
+	Currency string `json:"currency,omitempty" bson:"currency,omitempty"`
+	// Timezone is an IANA time zone, as in "Europe/Zurich".
+	Timezone  string          `json:"timezone,omitempty" bson:"timezone,omitempty"`
+	Marketing MarketingOptIns `json:"marketing" bson:"marketing"`
+}
+
+// MarketingOptIns are the channels a user agreed to receive marketing on.
+type MarketingOptIns struct {
+	Email bool `json:"email" bson:"email"`
+	SMS   bool `json:"sms" bson:"sms"`
+	Post  bool `json:"post" bson:"post"`
+}
+
+// UpdatePreferences replaces the preferences and custom attributes of a
+// user if it is still at version, or whatever its version if version is 0,
+// and returns the user's new version.
+func (m *Mongo) UpdatePreferences(userid string, p Preferences, attributes map[string]interface{}, version int64) (int64, error) {
+	if !bson.IsObjectIdHex(userid) {
+		return 0, ErrInvalidHexID
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	update := bson.M{"$set": bson.M{"preferences": p}}
+	if len(attributes) > 0 {
+		update["$set"].(bson.M)["attributes"] = attributes
+	} else {
+		update["$unset"] = bson.M{"attributes": ""}
+	}
+	return conditionalUpdate(s.DB("").C("users"), m.scope(bson.M{"_id": bson.ObjectIdHex(userid)}), version, update)
+}
+
+// GetUsersWithAttribute returns the live users whose custom attribute name
+// is value. Attributes are compared as stored, numbers whatever their type.
+func (m *Mongo) GetUsersWithAttribute(name string, value interface{}) ([]User, error) {
+	s := m.Session.Copy()
+	defer s.Close()
+	var dbusers []DBUser
+	users := make([]User, 0)
+	err := s.DB("").C("users").Find(live(m.scope(bson.M{"attributes." + name: value}))).All(&dbusers)
+	if err != nil {
+		return users, err
+	}
+	for _, dbu := range dbusers {
+		dbu.ConvertObjectsIds()
+		if err := m.Encryption.openUser(&dbu); err != nil {
+			return users, err
+		}
+		users = append(users, dbu.User)
+	}
+	return users, nil
+}
+
+// EnsureAttributeIndexes indexes the custom attributes users are looked up
+// by, within each tenant. Which attributes there are depends on the
+// deployment, so they are not among EnsureIndexes.
+func (m *Mongo) EnsureAttributeIndexes(names ...string) error {
+	s := m.Session.Copy()
+	defer s.Close()
+	for _, name := range names {
+		i := mgo.Index{Key: []string{"tenant", "attributes." + name}, Sparse: true, Background: true}
+		if err := s.DB("").C("users").EnsureIndex(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
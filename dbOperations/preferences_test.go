@@ -0,0 +1,42 @@
+package dbOperations
+
+import "testing"
+
+func TestUpdatePreferences(t *testing.T) {
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	u := User{Username: "preferences"}
+	if err := TestMongo.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	if err := TestMongo.EnsureAttributeIndexes("shoeSize"); err != nil {
+		t.Fatal(err)
+	}
+	p := Preferences{Locale: "de-CH", Currency: "CHF", Marketing: MarketingOptIns{Email: true}}
+	v, err := TestMongo.UpdatePreferences(u.UserID, p, map[string]interface{}{"shoeSize": 42.0, "loyaltyTier": "gold"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TestMongo.UpdatePreferences(u.UserID, p, nil, v-1); err != ErrVersionConflict {
+		t.Errorf("expected a stale version to conflict, got %v", err)
+	}
+	got, err := TestMongo.GetUser(u.UserID)
+	if err != nil || got.Preferences != p || got.Attributes["loyaltyTier"] != "gold" || got.Version != v {
+		t.Errorf("expected the preferences to be stored, got %+v: %v", got, err)
+	}
+
+	found, err := TestMongo.GetUsersWithAttribute("shoeSize", 42)
+	if err != nil || len(found) != 1 || found[0].UserID != u.UserID {
+		t.Errorf("expected the user to be found by its attribute, got %+v: %v", found, err)
+	}
+	if found, _ := TestMongo.GetUsersWithAttribute("shoeSize", 43); len(found) != 0 {
+		t.Errorf("expected no user with another value, got %+v", found)
+	}
+
+	if _, err := TestMongo.UpdatePreferences(u.UserID, Preferences{}, nil, v); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ = TestMongo.GetUser(u.UserID); got.Attributes != nil || got.Preferences != (Preferences{}) {
+		t.Errorf("expected the attributes to be removed, got %+v", got)
+	}
+}
@@ -0,0 +1,80 @@
+package dbOperations
+
+import (
+	"errors"
+	"math"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrRateLimitContention is returned when a token bucket keeps changing
+// under TakeToken, so no token could be taken.
+var ErrRateLimitContention = errors.New("Rate limit bucket contended")
+
+// rateLimitAttempts is how often TakeToken tries to update a bucket that
+// other instances are updating too.
+const rateLimitAttempts = 5
+
+// RateBucket is a token bucket shared by the instances of the service.
+// Once it would be full again it expires, which is the same as full.
+type RateBucket struct {
+	Key       string    `bson:"_id"`
+	Tokens    float64   `bson:"tokens"`
+	Updated   time.Time `bson:"updated"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+// TakeToken takes a token from the bucket key, which holds up to capacity
+// tokens and is refilled at rate tokens a second. It returns the tokens
+// left, and whether one could be taken. Buckets are updated only if they
+// have not changed since they were read, so instances never take the same
+// token twice.
+func (m *Mongo) TakeToken(key string, capacity, rate float64, now time.Time) (float64, bool, error) {
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB("").C("ratelimits")
+	now = now.UTC().Truncate(time.Millisecond)
+	for i := 0; i < rateLimitAttempts; i++ {
+		var b RateBucket
+		err := c.FindId(key).One(&b)
+		if err != nil && err != mgo.ErrNotFound {
+			return 0, false, err
+		}
+		found := err == nil
+		tokens := capacity
+		if found {
+			elapsed := math.Max(now.Sub(b.Updated).Seconds(), 0)
+			tokens = math.Min(capacity, b.Tokens+elapsed*rate)
+		}
+		if tokens < 1 {
+			return tokens, false, nil
+		}
+		tokens--
+		next := RateBucket{
+			Key:       key,
+			Tokens:    tokens,
+			Updated:   now,
+			ExpiresAt: now.Add(time.Duration((capacity - tokens) / rate * float64(time.Second))),
+		}
+		if found {
+			err = c.Update(bson.M{"_id": key, "tokens": b.Tokens, "updated": b.Updated}, next)
+		} else {
+			err = c.Insert(next)
+		}
+		if err == mgo.ErrNotFound || mgo.IsDup(err) {
+			continue
+		}
+		return tokens, err == nil, err
+	}
+	return 0, false, ErrRateLimitContention
+}
+
+func (m *Mongo) ensureRateLimitIndexes(s *mgo.Session) error {
+	return s.DB("").C("ratelimits").EnsureIndex(mgo.Index{
+		Key:         []string{"expiresAt"},
+		Background:  true,
+		ExpireAfter: time.Second,
+	})
+}
@@ -0,0 +1,26 @@
+package dbOperations
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTakeToken(t *testing.T) {
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if left, ok, err := TestMongo.TakeToken("GET /customers ip:203.0.113.7", 2, 1, now); err != nil || !ok || left != float64(1-i) {
+			t.Errorf("take %d: expected a token, got %v %v: %v", i, left, ok, err)
+		}
+	}
+	if _, ok, err := TestMongo.TakeToken("GET /customers ip:203.0.113.7", 2, 1, now); ok || err != nil {
+		t.Errorf("expected the bucket to be empty, got %v: %v", ok, err)
+	}
+	if _, ok, err := TestMongo.TakeToken("GET /customers ip:203.0.113.7", 2, 1, now.Add(time.Second)); !ok || err != nil {
+		t.Errorf("expected the bucket to be refilled, got %v: %v", ok, err)
+	}
+	if _, ok, _ := TestMongo.TakeToken("GET /customers ip:203.0.113.8", 2, 1, now); !ok {
+		t.Error("expected other callers to have their own bucket")
+	}
+}
@@ -0,0 +1,274 @@
+package dbOperations
+
+import (
+	"strings"
+	"unicode"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// SearchPrefix is the length of the shortest prefix a word is found
+	// by, and searchPrefixes that of the longest one indexed.
+	SearchPrefix   = 2
+	searchPrefixes = 12
+	// FuzzyPrefix is how many leading letters of a misspelt word must be
+	// right for it to be found.
+	FuzzyPrefix = 3
+)
+
+// searchFields are the searched fields by bson field, in the order of the
+// text indexes.
+var searchFields = []string{"username", "email", "firstname", "lastname", "phone", "postcode"}
+
+// searchWeights are how much a match in each searched field counts. They
+// are the weights of the text indexes.
+var searchWeights = map[string]int{
+	"username":  4,
+	"email":     4,
+	"lastname":  3,
+	"phone":     3,
+	"firstname": 2,
+	"postcode":  1,
+}
+
+// SearchWeight returns how much a match in the searched field counts.
+func SearchWeight(field string) int {
+	return searchWeights[field]
+}
+
+// SearchToken is a word a field is searched by, and where it stands in the
+// field's value.
+type SearchToken struct {
+	Text       string
+	Start, End int
+}
+
+// SearchTokens splits the value of field into the words it is searched
+// by: its runs of letters and digits, in lowercase. Phones and postcodes
+// are also searched by all their letters and digits run together, as
+// they are written with and without spaces.
+func SearchTokens(field, value string) []SearchToken {
+	var tokens []SearchToken
+	start := -1
+	for i, r := range value + " " {
+		alnum := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if alnum && start < 0 {
+			start = i
+		} else if !alnum && start >= 0 {
+			tokens = append(tokens, SearchToken{Text: strings.ToLower(value[start:i]), Start: start, End: i})
+			start = -1
+		}
+	}
+	if (field == "phone" || field == "postcode") && len(tokens) > 1 {
+		joined := SearchToken{Start: tokens[0].Start, End: tokens[len(tokens)-1].End}
+		for _, t := range tokens {
+			joined.Text += t.Text
+		}
+		tokens = append(tokens, joined)
+	}
+	return tokens
+}
+
+// searchTerms returns the words of value and their prefixes, which the
+// field is indexed by.
+func searchTerms(field, value string) []string {
+	var terms []string
+	seen := map[string]bool{}
+	add := func(term string) {
+		if !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+	for _, t := range SearchTokens(field, value) {
+		r := []rune(t.Text)
+		for n := SearchPrefix; n < len(r) && n <= searchPrefixes; n++ {
+			add(string(r[:n]))
+		}
+		add(t.Text)
+	}
+	return terms
+}
+
+// queryTerms returns the terms a record matching any of words is indexed
+// by: each word, cut to the longest prefix indexed, and the first
+// FuzzyPrefix letters of the words long enough to be misspelt.
+func queryTerms(words []string) []string {
+	var terms []string
+	for _, w := range words {
+		r := []rune(strings.ToLower(w))
+		if len(r) > searchPrefixes {
+			r = r[:searchPrefixes]
+		}
+		terms = append(terms, string(r))
+		if len(r) > FuzzyPrefix {
+			terms = append(terms, string(r[:FuzzyPrefix]))
+		}
+	}
+	return terms
+}
+
+// searchIndex returns the search terms of fields in tenant, by field.
+// Terms of encrypted fields are kept as keyed hashes, so that the index
+// does not give their values away.
+func (e *FieldEncryption) searchIndex(tenant, collection string, fields map[string]*string) map[string]string {
+	index := map[string]string{}
+	for _, name := range searchFields {
+		v, ok := fields[name]
+		if !ok || *v == "" {
+			continue
+		}
+		terms := searchTerms(name, *v)
+		for i, t := range terms {
+			terms[i] = e.searchTerm(tenant, collection, name, t)
+		}
+		index[name] = strings.Join(terms, " ")
+	}
+	return index
+}
+
+// searchTerm returns term as it is indexed for field.
+func (e *FieldEncryption) searchTerm(tenant, collection, field, term string) string {
+	if !e.encrypts(collection, field) {
+		return term
+	}
+	return e.blindIndex(tenant, "search."+field, term)[:16]
+}
+
+// textSearch returns the $text query for records of collection in tenant
+// indexed by any of terms.
+func (e *FieldEncryption) textSearch(tenant, collection string, terms []string) bson.M {
+	var search []string
+	seen := map[string]bool{}
+	for _, name := range searchFields {
+		if (collection == "addresses") != (name == "postcode") {
+			continue
+		}
+		for _, t := range terms {
+			if t = e.searchTerm(tenant, collection, name, t); !seen[t] {
+				seen[t] = true
+				search = append(search, t)
+			}
+		}
+	}
+	return bson.M{"$text": bson.M{"$search": strings.Join(search, " ")}}
+}
+
+// SearchUsers returns up to limit live users, with their live addresses,
+// that have a word starting with one of words, or with its first
+// FuzzyPrefix letters, best matches first. They are candidates only, to
+// be ranked by how well they match.
+func (m *Mongo) SearchUsers(words []string, limit int) ([]User, error) {
+	terms := queryTerms(words)
+	if len(terms) == 0 {
+		return []User{}, nil
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	tenant := m.owner("")
+	score := bson.M{"score": bson.M{"$meta": "textScore"}}
+	var found []DBUser
+	q := live(m.scope(m.Encryption.textSearch(tenant, "users", terms)))
+	if err := s.DB("").C("users").Find(q).Select(score).Sort("$textScore:score").Limit(limit).All(&found); err != nil {
+		return nil, err
+	}
+	var addrs []struct {
+		ID bson.ObjectId `bson:"_id"`
+	}
+	q = live(m.scope(m.Encryption.textSearch(tenant, "addresses", terms)))
+	err := s.DB("").C("addresses").Find(q).Select(bson.M{"_id": 1, "score": score["score"]}).Sort("$textScore:score").Limit(limit).All(&addrs)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) > 0 && len(found) < limit {
+		ids := make([]bson.ObjectId, len(addrs))
+		for i, a := range addrs {
+			ids[i] = a.ID
+		}
+		var byAddress []DBUser
+		q := live(m.scope(bson.M{"addresses": bson.M{"$in": ids}}))
+		if err := s.DB("").C("users").Find(q).Limit(limit - len(found)).All(&byAddress); err != nil {
+			return nil, err
+		}
+		seen := map[bson.ObjectId]bool{}
+		for _, dbu := range found {
+			seen[dbu.ID] = true
+		}
+		for _, dbu := range byAddress {
+			if !seen[dbu.ID] {
+				found = append(found, dbu)
+			}
+		}
+	}
+	users := make([]User, 0, len(found))
+	err = exportBatchTo(s, m.Encryption, found, func(u User) error {
+		users = append(users, u)
+		return nil
+	})
+	return users, err
+}
+
+// Reindex sets the search terms of the users and addresses, deleted or
+// not, written before they were searched, and returns how many it
+// rewrote. Versions are kept, as the records do not change.
+func (m *Mongo) Reindex() (int, error) {
+	s := m.Session.Copy()
+	defer s.Close()
+	n := 0
+	missing := bson.M{"search": bson.M{"$exists": false}}
+	c := s.DB("").C("users")
+	it := c.Find(missing).Iter()
+	var dbu DBUser
+	for it.Next(&dbu) {
+		err := m.Encryption.openUser(&dbu)
+		if err == nil {
+			search := m.Encryption.searchIndex(dbu.Tenant, "users", userFields(&dbu.User))
+			err = rewrite(c, dbu.ID, dbu.Version, bson.M{"$set": bson.M{"search": search}}, &n)
+		}
+		if err != nil {
+			it.Close()
+			return n, err
+		}
+		dbu = DBUser{}
+	}
+	if err := it.Close(); err != nil {
+		return n, err
+	}
+	c = s.DB("").C("addresses")
+	it = c.Find(missing).Iter()
+	var dba DBAddress
+	for it.Next(&dba) {
+		err := m.Encryption.openAddress(&dba)
+		if err == nil {
+			search := m.Encryption.searchIndex(dba.Tenant, "addresses", addressFields(&dba.Address))
+			err = rewrite(c, dba.ID, dba.Version, bson.M{"$set": bson.M{"search": search}}, &n)
+		}
+		if err != nil {
+			it.Close()
+			return n, err
+		}
+		dba = DBAddress{}
+	}
+	return n, it.Close()
+}
+
+// ensureSearchIndexes creates the text indexes of the search terms. They
+// index words as they are, without stemming or stop words.
+func (m *Mongo) ensureSearchIndexes(s *mgo.Session) error {
+	for _, collection := range []string{"users", "addresses"} {
+		i := mgo.Index{DefaultLanguage: "none", Weights: map[string]int{}, Background: true}
+		for _, name := range searchFields {
+			if (collection == "addresses") != (name == "postcode") {
+				continue
+			}
+			i.Key = append(i.Key, "$text:search."+name)
+			i.Weights["search."+name] = searchWeights[name]
+		}
+		if err := s.DB("").C(collection).EnsureIndex(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package dbOperations
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestSearchTokens(t *testing.T) {
+	for _, c := range []struct {
+		field, value string
+		tokens       []string
+	}{
+		{"email", "Alice.Smith@example.com", []string{"alice", "smith", "example", "com"}},
+		{"lastname", "O'Neil-Brown", []string{"o", "neil", "brown"}},
+		{"phone", "+44 (0)7911 123456", []string{"44", "0", "7911", "123456", "4407911123456"}},
+		{"postcode", "SW1A 1AA", []string{"sw1a", "1aa", "sw1a1aa"}},
+		{"lastname", "Müller", []string{"müller"}},
+	} {
+		var got []string
+		for _, tok := range SearchTokens(c.field, c.value) {
+			got = append(got, tok.Text)
+			if strings.ToLower(c.value[tok.Start:tok.End]) != tok.Text && c.field != "phone" && c.field != "postcode" {
+				t.Errorf("%s: token %q is not at %d:%d", c.value, tok.Text, tok.Start, tok.End)
+			}
+		}
+		if !reflect.DeepEqual(got, c.tokens) {
+			t.Errorf("%s: expected %v, got %v", c.value, c.tokens, got)
+		}
+	}
+	if got := searchTerms("lastname", "Smith"); !reflect.DeepEqual(got, []string{"sm", "smi", "smit", "smith"}) {
+		t.Errorf("unexpected terms %v", got)
+	}
+}
+
+func TestSearchIndexEncrypted(t *testing.T) {
+	e := newTestEncryption(t, "users.lastname")
+	u := User{Username: "asmith", LastName: "Smith"}
+	index := e.searchIndex(DefaultTenant, "users", userFields(&u))
+	if index["username"] != "as asm asmi asmit asmith" {
+		t.Errorf("expected plain fields to be indexed as they are, got %q", index["username"])
+	}
+	if strings.Contains(index["lastname"], "smi") || len(strings.Fields(index["lastname"])) != 4 {
+		t.Errorf("expected encrypted fields to be indexed by hashes, got %q", index["lastname"])
+	}
+	q := e.textSearch(DefaultTenant, "users", []string{"smi"})["$text"].(bson.M)
+	if search := q["$search"].(string); !strings.Contains(search, e.searchTerm(DefaultTenant, "users", "lastname", "smi")) {
+		t.Errorf("expected the query to look for the hash, got %q", search)
+	}
+}
+
+func TestSearchUsers(t *testing.T) {
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	acme := TestMongo.ForTenant("acme")
+	u := User{Username: "asmith", FirstName: "Alice", LastName: "Smith"}
+	if err := acme.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	a := Address{PostCode: "SW1A 1AA"}
+	if err := acme.CreateAddress(&a, u.UserID); err != nil {
+		t.Fatal(err)
+	}
+	other := User{Username: "bsmith", LastName: "Smith"}
+	if err := TestMongo.ForTenant("globex").CreateUser(&other); err != nil {
+		t.Fatal(err)
+	}
+	for _, words := range [][]string{{"smi"}, {"smiht"}, {"sw1a"}} {
+		users, err := acme.SearchUsers(words, 10)
+		if err != nil || len(users) != 1 || users[0].UserID != u.UserID {
+			t.Errorf("%v: expected the tenant's user, got %+v: %v", words, users, err)
+		}
+		if len(users) == 1 && (len(users[0].Addresses) != 1 || users[0].Addresses[0].PostCode != "SW1A 1AA") {
+			t.Errorf("%v: expected the user's addresses, got %+v", words, users[0].Addresses)
+		}
+	}
+	if users, err := acme.SearchUsers([]string{"jones"}, 10); err != nil || len(users) != 0 {
+		t.Errorf("expected no users, got %+v: %v", users, err)
+	}
+}
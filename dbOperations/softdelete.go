@@ -0,0 +1,179 @@
+package dbOperations
+
+import (
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// live restricts q to documents that have not been deleted.
+func live(q bson.M) bson.M {
+	q["deletedAt"] = bson.M{"$exists": false}
+	return q
+}
+
+// deleted restricts q to documents that have been deleted.
+func deleted(q bson.M) bson.M {
+	q["deletedAt"] = bson.M{"$exists": true}
+	return q
+}
+
+// deletion is the update marking a document as deleted by by. Mongo keeps
+// milliseconds, so the time is truncated to match what is read back.
+func deletion(by string) bson.M {
+	return bson.M{"$set": bson.M{
+		"deletedAt": time.Now().UTC().Truncate(time.Millisecond),
+		"deletedBy": by,
+	}}
+}
+
+func undeletion() bson.M {
+	return bson.M{"$unset": bson.M{"deletedAt": "", "deletedBy": "", "deletedFrom": ""}}
+}
+
+// GetDeletedUsers returns the deleted users, most recently deleted first
+func (m *Mongo) GetDeletedUsers() ([]User, error) {
+	s := m.Session.Copy()
+	defer s.Close()
+	var dbusers []DBUser
+	users := make([]User, 0)
+	c := s.DB("").C("users")
+	err := c.Find(deleted(m.scope(bson.M{}))).Sort("-deletedAt").All(&dbusers)
+	if err != nil {
+		return users, err
+	}
+	for _, dbu := range dbusers {
+		dbu.ConvertObjectsIds()
+		if err := m.Encryption.openUser(&dbu); err != nil {
+			return users, err
+		}
+		users = append(users, dbu.User)
+	}
+	return users, nil
+}
+
+// GetDeletedAddresses returns the deleted addresses, most recently deleted first
+func (m *Mongo) GetDeletedAddresses() ([]Address, error) {
+	s := m.Session.Copy()
+	defer s.Close()
+	var dbAdrs []DBAddress
+	adrs := make([]Address, 0)
+	c := s.DB("").C("addresses")
+	err := c.Find(deleted(m.scope(bson.M{}))).Sort("-deletedAt").All(&dbAdrs)
+	for _, dbAdr := range dbAdrs {
+		dbAdr.Address.ID = dbAdr.ID.Hex()
+		if err := m.Encryption.openAddress(&dbAdr); err != nil {
+			return adrs, err
+		}
+		adrs = append(adrs, dbAdr.Address)
+	}
+	return adrs, err
+}
+
+// RestoreUser undoes the deletion of a user, along with the addresses deleted with it.
+// Only the user gets a UserRestored event; the addresses come back with it.
+func (m *Mongo) RestoreUser(id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrInvalidHexID
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB("").C("users")
+	dbu := NewDBUser()
+	err := c.Find(deleted(m.scope(bson.M{"_id": bson.ObjectIdHex(id)}))).One(&dbu)
+	if err != nil {
+		return err
+	}
+	e, err := m.newEvent(EventUserRestored, id, dbu.Tenant, nil)
+	if err != nil {
+		return err
+	}
+	err = c.UpdateId(dbu.ID, bump(withEvent(undeletion(), e)))
+	if err != nil {
+		return err
+	}
+	ac := s.DB("").C("addresses")
+	_, err = ac.UpdateAll(bson.M{"_id": bson.M{"$in": dbu.AddressIDs}, "deletedAt": dbu.DeletedAt}, bump(undeletion()))
+	return err
+}
+
+// RestoreAddress undoes the deletion of an address and gives it back to its user, whose id it returns.
+// The user must not be deleted themselves.
+func (m *Mongo) RestoreAddress(id string) (string, error) {
+	if !bson.IsObjectIdHex(id) {
+		return "", ErrInvalidHexID
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB("").C("addresses")
+	dbAdr := DBAddress{}
+	err := c.Find(deleted(m.scope(bson.M{"_id": bson.ObjectIdHex(id)}))).One(&dbAdr)
+	if err != nil {
+		return "", err
+	}
+	if dbAdr.DeletedFrom == "" {
+		return "", ErrDeletedWithUser
+	}
+	n, err := s.DB("").C("users").Find(deleted(m.scope(bson.M{"_id": bson.ObjectIdHex(dbAdr.DeletedFrom)}))).Count()
+	if err != nil {
+		return "", err
+	}
+	if n > 0 {
+		return "", ErrUserDeleted
+	}
+	err = m.addIdToUserAddresses(dbAdr.ID, dbAdr.DeletedFrom)
+	if err != nil {
+		return "", err
+	}
+	e, err := m.newEvent(EventAddressRestored, dbAdr.DeletedFrom, dbAdr.Tenant, nil)
+	if err != nil {
+		return "", err
+	}
+	e.AddressID = id
+	if err := c.UpdateId(dbAdr.ID, bump(withEvent(undeletion(), e))); err != nil {
+		return "", err
+	}
+	return dbAdr.DeletedFrom, m.assignDefaults(s, bson.ObjectIdHex(dbAdr.DeletedFrom))
+}
+
+// PurgeDeleted permanently removes the users and addresses deleted before the given time and returns how many were removed.
+// What userData keeps about the users goes with them, as it does when they are erased.
+func (m *Mongo) PurgeDeleted(before time.Time) (int, error) {
+	s := m.Session.Copy()
+	defer s.Close()
+	var purged []DBUser
+	if err := s.DB("").C("users").Find(m.scope(bson.M{"deletedAt": bson.M{"$lt": before}})).Select(bson.M{"_id": 1}).All(&purged); err != nil {
+		return 0, err
+	}
+	ids := make([]string, 0)
+	for _, dbu := range purged {
+		ids = append(ids, dbu.ID.Hex())
+	}
+	if err := removeUserData(s, ids...); err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, name := range []string{"addresses", "users"} {
+		info, err := s.DB("").C(name).RemoveAll(m.scope(bson.M{"deletedAt": bson.M{"$lt": before}}))
+		if err != nil {
+			return n, err
+		}
+		n += info.Removed
+	}
+	return n, nil
+}
+
+func (m *Mongo) ensureDeletionIndexes(s *mgo.Session) error {
+	for _, name := range []string{"addresses", "users"} {
+		err := s.DB("").C(name).EnsureIndex(mgo.Index{
+			Key:        []string{"deletedAt"},
+			Sparse:     true,
+			Background: true,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package dbOperations
+
+import (
+	"testing"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+)
+
+func TestSoftDeleteAndRestore(t *testing.T) {
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	u := User{Username: "softdelete", Addresses: []Address{}}
+	if err := TestMongo.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	kept, gone := Address{City: "kept"}, Address{City: "gone"}
+	TestMongo.CreateAddress(&kept, u.UserID)
+	TestMongo.CreateAddress(&gone, u.UserID)
+
+	other := User{Username: "softdelete-other", Addresses: []Address{}}
+	if err := TestMongo.CreateUser(&other); err != nil {
+		t.Fatal(err)
+	}
+	if err := TestMongo.DeleteAddress(other.UserID, gone.ID, "tester", 0); err != mgo.ErrNotFound {
+		t.Errorf("expected an address not to be deleted through another user, got %v", err)
+	}
+	if err := TestMongo.DeleteAddress(u.UserID, gone.ID, "tester", 0); err != nil {
+		t.Error(err)
+	}
+	if _, err := TestMongo.GetAddress(gone.ID); err == nil {
+		t.Error("expected deleted address to be hidden")
+	}
+	if err := TestMongo.DeleteUser(u.UserID, "tester", 0); err != nil {
+		t.Error(err)
+	}
+	if _, err := TestMongo.GetUserWithName("softdelete"); err == nil {
+		t.Error("expected deleted user to be hidden")
+	}
+	users, err := TestMongo.GetDeletedUsers()
+	if err != nil || len(users) == 0 || users[0].DeletedBy != "tester" {
+		t.Errorf("unexpected deleted users %v: %v", users, err)
+	}
+	if _, err := TestMongo.RestoreAddress(gone.ID); err != ErrUserDeleted {
+		t.Errorf("expected an address not to be restored to a deleted user, got %v", err)
+	}
+
+	// Restoring the user brings back the address deleted with it only.
+	if err := TestMongo.RestoreUser(u.UserID); err != nil {
+		t.Error(err)
+	}
+	adds, err := TestMongo.GetAddressesForUser(u.UserID)
+	if err != nil || len(adds) != 1 || adds[0].City != "kept" {
+		t.Errorf("unexpected addresses %v: %v", adds, err)
+	}
+	if _, err := TestMongo.RestoreAddress(kept.ID); err == nil {
+		t.Error("expected a live address not to be restorable")
+	}
+	if userid, err := TestMongo.RestoreAddress(gone.ID); err != nil || userid != u.UserID {
+		t.Errorf("expected address to return to %s, got %s: %v", u.UserID, userid, err)
+	}
+
+	TestMongo.AddAcceptance(&Acceptance{UserID: u.UserID, Policy: "terms", Version: "1", Action: AcceptanceAccepted, At: time.Now()})
+	TestMongo.DeleteUser(u.UserID, "tester", 0)
+	n, err := TestMongo.PurgeDeleted(time.Now().Add(time.Second))
+	if err != nil {
+		t.Error(err)
+	}
+	if n < 3 {
+		t.Errorf("expected the user and its addresses to be purged, purged %d", n)
+	}
+	if err := TestMongo.RestoreUser(u.UserID); err == nil {
+		t.Error("expected a purged user not to be restorable")
+	}
+	if got, _ := TestMongo.GetAcceptances(u.UserID); len(got) != 0 {
+		t.Errorf("expected what is kept about the user to be purged with it, got %+v", got)
+	}
+}
@@ -0,0 +1,248 @@
+package dbOperations
+
+import (
+	"errors"
+	"strings"
+	"time"
+	"unicode"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// DefaultTenant owns the records written before there were tenants, and
+// those written without one.
+const DefaultTenant = "default"
+
+var (
+	//ErrTenantNotEmpty is returned when deleting a tenant that still has users
+	ErrTenantNotEmpty = errors.New("Tenant still has users")
+	//ErrHostTaken is returned when a host is given to a second tenant
+	ErrHostTaken = errors.New("Host belongs to another tenant")
+)
+
+// tenantCollections hold the records that belong to a tenant. Consents,
+// authorization codes and rate limit buckets refer to records that do, and
+// are left out.
+var tenantCollections = []string{
+	"users", "addresses", "apikeys", "webhooks", "deliveries", "erasures",
+	"audit", "identities", "external_logins", "oauth_clients", "outbox",
+	"phone_verifications", "policies", "acceptances",
+}
+
+// Tenant is a storefront served by the deployment. Its users and their
+// records are kept apart from those of other tenants, and its usernames
+// only need to be unique among its own users.
+type Tenant struct {
+	ID   string `json:"id" bson:"_id"`
+	Name string `json:"name" bson:"name"`
+	// Hosts are the host names the tenant's requests arrive at, such as
+	// the subdomain of its storefront.
+	Hosts          []string       `json:"hosts,omitempty" bson:"hosts,omitempty"`
+	PasswordPolicy PasswordPolicy `json:"passwordPolicy" bson:"passwordPolicy"`
+	// TokenLifetime is how long the access and ID tokens issued to the
+	// tenant's users are valid, in seconds; the service's default if 0.
+	TokenLifetime int64 `json:"tokenLifetime,omitempty" bson:"tokenLifetime,omitempty"`
+	// AddressValidation is how strictly the tenant's new addresses are
+	// checked: "strict" refuses invalid ones, and "lenient", the default,
+	// stores them as far as they can be normalized.
+	AddressValidation string `json:"addressValidation,omitempty" bson:"addressValidation,omitempty"`
+	// PhoneRegion is the country the phone numbers of the tenant's users
+	// are read in when they have no country code, as an ISO 3166 code.
+	// Without it they need one.
+	PhoneRegion string    `json:"phoneRegion,omitempty" bson:"phoneRegion,omitempty"`
+	CreatedAt   time.Time `json:"createdAt" bson:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt" bson:"updatedAt"`
+}
+
+// PasswordPolicy is what the passwords users choose must meet.
+type PasswordPolicy struct {
+	MinLength     int  `json:"minLength,omitempty" bson:"minLength,omitempty"`
+	RequireUpper  bool `json:"requireUpper,omitempty" bson:"requireUpper,omitempty"`
+	RequireLower  bool `json:"requireLower,omitempty" bson:"requireLower,omitempty"`
+	RequireDigit  bool `json:"requireDigit,omitempty" bson:"requireDigit,omitempty"`
+	RequireSymbol bool `json:"requireSymbol,omitempty" bson:"requireSymbol,omitempty"`
+}
+
+// Allows reports whether password meets the policy.
+func (p PasswordPolicy) Allows(password string) bool {
+	var upper, lower, digit, symbol bool
+	n := 0
+	for _, r := range password {
+		n++
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case !unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+	return n >= p.MinLength && (upper || !p.RequireUpper) && (lower || !p.RequireLower) &&
+		(digit || !p.RequireDigit) && (symbol || !p.RequireSymbol)
+}
+
+// ForTenant returns a Mongo on the same session that only reads and writes
+// the records of tenant. A Mongo with no tenant reads the records of all
+// tenants, and writes to the default tenant.
+func (m *Mongo) ForTenant(tenant string) *Mongo {
+	scoped := *m
+	scoped.Tenant = tenant
+	return &scoped
+}
+
+// scope restricts q to the records of the tenant m is for, if any.
+func (m *Mongo) scope(q bson.M) bson.M {
+	if m.Tenant != "" {
+		q["tenant"] = m.Tenant
+	}
+	return q
+}
+
+// owner returns the tenant a record m writes belongs to: the tenant m is
+// for, or else tenant, the one the record came with, or else the default
+// tenant.
+func (m *Mongo) owner(tenant string) string {
+	switch {
+	case m.Tenant != "":
+		return m.Tenant
+	case tenant != "":
+		return tenant
+	}
+	return DefaultTenant
+}
+
+// SaveTenant creates the tenant t.ID, or replaces its configuration
+func (m *Mongo) SaveTenant(t *Tenant) error {
+	s := m.Session.Copy()
+	defer s.Close()
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	t.Hosts = normalizeHosts(t.Hosts)
+	set := bson.M{
+		"name":              t.Name,
+		"passwordPolicy":    t.PasswordPolicy,
+		"tokenLifetime":     t.TokenLifetime,
+		"addressValidation": t.AddressValidation,
+		"phoneRegion":       t.PhoneRegion,
+		"updatedAt":         now,
+	}
+	update := bson.M{"$set": set, "$setOnInsert": bson.M{"createdAt": now}}
+	if len(t.Hosts) > 0 {
+		set["hosts"] = t.Hosts
+	} else {
+		update["$unset"] = bson.M{"hosts": ""}
+	}
+	var saved Tenant
+	_, err := s.DB("").C("tenants").FindId(t.ID).Apply(mgo.Change{Update: update, Upsert: true, ReturnNew: true}, &saved)
+	if mgo.IsDup(err) {
+		return ErrHostTaken
+	}
+	if err != nil {
+		return err
+	}
+	*t = saved
+	return nil
+}
+
+// GetTenant returns the tenant with the given id. The default tenant
+// exists whether or not it has been configured.
+func (m *Mongo) GetTenant(id string) (Tenant, error) {
+	s := m.Session.Copy()
+	defer s.Close()
+	var t Tenant
+	err := s.DB("").C("tenants").FindId(id).One(&t)
+	if err == mgo.ErrNotFound && id == DefaultTenant {
+		return Tenant{ID: DefaultTenant, Name: "Default"}, nil
+	}
+	return t, err
+}
+
+// GetTenants returns all tenants, the default tenant first
+func (m *Mongo) GetTenants() ([]Tenant, error) {
+	s := m.Session.Copy()
+	defer s.Close()
+	tenants := make([]Tenant, 0)
+	if err := s.DB("").C("tenants").Find(nil).Sort("createdAt").All(&tenants); err != nil {
+		return tenants, err
+	}
+	for i, t := range tenants {
+		if t.ID == DefaultTenant {
+			copy(tenants[1:i+1], tenants[:i])
+			tenants[0] = t
+			return tenants, nil
+		}
+	}
+	return append([]Tenant{{ID: DefaultTenant, Name: "Default"}}, tenants...), nil
+}
+
+// DeleteTenant removes a tenant that has no users left, deleted or not.
+// The configuration of the default tenant is reset instead.
+func (m *Mongo) DeleteTenant(id string) error {
+	s := m.Session.Copy()
+	defer s.Close()
+	if id != DefaultTenant {
+		n, err := s.DB("").C("users").Find(bson.M{"tenant": id}).Count()
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return ErrTenantNotEmpty
+		}
+	}
+	err := s.DB("").C("tenants").RemoveId(id)
+	if err == mgo.ErrNotFound && id == DefaultTenant {
+		return nil
+	}
+	return err
+}
+
+func normalizeHosts(hosts []string) []string {
+	normalized := make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			normalized = append(normalized, h)
+		}
+	}
+	return normalized
+}
+
+// ensureTenantIndexes gives the records written before there were tenants
+// to the default tenant, and makes usernames and linked external accounts
+// unique per tenant instead of across them.
+func (m *Mongo) ensureTenantIndexes(s *mgo.Session) error {
+	for _, name := range tenantCollections {
+		c := s.DB("").C(name)
+		if _, err := c.UpdateAll(bson.M{"tenant": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"tenant": DefaultTenant}}); err != nil {
+			return err
+		}
+		if err := c.EnsureIndex(mgo.Index{Key: []string{"tenant"}, Background: true}); err != nil {
+			return err
+		}
+	}
+	for name, key := range map[string][]string{
+		"users":      {"username"},
+		"identities": {"provider", "subject"},
+	} {
+		if err := dropIndex(s.DB("").C(name), key...); err != nil {
+			return err
+		}
+	}
+	return s.DB("").C("tenants").EnsureIndex(mgo.Index{
+		Key:        []string{"hosts"},
+		Unique:     true,
+		Sparse:     true,
+		Background: true,
+	})
+}
+
+// dropIndex drops the index on key, if there is one.
+func dropIndex(c *mgo.Collection, key ...string) error {
+	err := c.DropIndex(key...)
+	if err != nil && strings.Contains(err.Error(), "not found") {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,141 @@
+package dbOperations
+
+import (
+	"testing"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+)
+
+func TestTenantIsolation(t *testing.T) {
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	acme, globex := TestMongo.ForTenant("acme"), TestMongo.ForTenant("globex")
+
+	// Usernames only need to be unique within a tenant.
+	a := User{Username: "shared", Password: "password"}
+	if err := acme.CreateUser(&a); err != nil {
+		t.Fatal(err)
+	}
+	g := User{Username: "shared", Password: "password"}
+	if err := globex.CreateUser(&g); err != nil {
+		t.Fatal(err)
+	}
+	dup := User{Username: "shared"}
+	if err := acme.CreateUser(&dup); !mgo.IsDup(err) {
+		t.Errorf("expected a duplicate within the tenant to be refused, got %v", err)
+	}
+
+	if u, err := acme.GetUserWithName("shared"); err != nil || u.UserID != a.UserID || u.Tenant != "acme" {
+		t.Errorf("expected the tenant's own user, got %+v: %v", u, err)
+	}
+	if _, err := globex.GetUser(a.UserID); err != mgo.ErrNotFound {
+		t.Errorf("expected another tenant's user to be hidden, got %v", err)
+	}
+	if err := globex.DeleteUser(a.UserID, "test", 0); err != mgo.ErrNotFound {
+		t.Errorf("expected another tenant's user not to be deleted, got %v", err)
+	}
+	addr := Address{Street: "street"}
+	if err := globex.CreateAddress(&addr, a.UserID); err != mgo.ErrNotFound {
+		t.Errorf("expected no address to be added to another tenant's user, got %v", err)
+	}
+	if err := acme.CreateAddress(&addr, a.UserID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := globex.GetAddress(addr.ID); err != mgo.ErrNotFound {
+		t.Errorf("expected another tenant's address to be hidden, got %v", err)
+	}
+	users, err := globex.GetUsers()
+	if err != nil || len(users) != 1 || users[0].UserID != g.UserID {
+		t.Errorf("expected only the tenant's users, got %v: %v", users, err)
+	}
+
+	// Without a tenant every tenant's records are seen, and their events
+	// keep the tenant they belong to.
+	if _, err := TestMongo.GetUser(g.UserID); err != nil {
+		t.Error(err)
+	}
+	if err := TestMongo.DeleteAddress(a.UserID, addr.ID, "test", 0); err != nil {
+		t.Fatal(err)
+	}
+	events, err := TestMongo.ClaimEvents(time.Now(), time.Minute, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var removed *Event
+	for i, e := range events {
+		if e.Type == EventAddressRemoved && e.AddressID == addr.ID {
+			removed = &events[i]
+		}
+	}
+	if removed == nil || removed.Tenant != "acme" {
+		t.Errorf("expected the address removal to be an event of its tenant, got %+v", removed)
+	}
+}
+
+func TestTenants(t *testing.T) {
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	if d, err := TestMongo.GetTenant(DefaultTenant); err != nil || d.ID != DefaultTenant {
+		t.Errorf("expected the default tenant to exist, got %+v: %v", d, err)
+	}
+	shop := Tenant{ID: "shop", Name: "Shop", Hosts: []string{" Shop.Example.com "}, PasswordPolicy: PasswordPolicy{MinLength: 12}}
+	if err := TestMongo.SaveTenant(&shop); err != nil {
+		t.Fatal(err)
+	}
+	if len(shop.Hosts) != 1 || shop.Hosts[0] != "shop.example.com" || shop.CreatedAt.IsZero() {
+		t.Errorf("unexpected tenant %+v", shop)
+	}
+	other := Tenant{ID: "other", Hosts: []string{"shop.example.com"}}
+	if err := TestMongo.SaveTenant(&other); err != ErrHostTaken {
+		t.Errorf("expected ErrHostTaken, got %v", err)
+	}
+	tenants, err := TestMongo.GetTenants()
+	if err != nil || len(tenants) != 2 || tenants[0].ID != DefaultTenant || tenants[1].PasswordPolicy.MinLength != 12 {
+		t.Errorf("unexpected tenants %+v: %v", tenants, err)
+	}
+
+	u := User{Username: "shopper"}
+	if err := TestMongo.ForTenant("shop").CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	if err := TestMongo.DeleteTenant("shop"); err != ErrTenantNotEmpty {
+		t.Errorf("expected ErrTenantNotEmpty, got %v", err)
+	}
+	TestMongo.Session.DB("").C("users").RemoveAll(map[string]string{"tenant": "shop"})
+	if err := TestMongo.DeleteTenant("shop"); err != nil {
+		t.Error(err)
+	}
+	if _, err := TestMongo.GetTenant("shop"); err != mgo.ErrNotFound {
+		t.Errorf("expected the tenant to be gone, got %v", err)
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	p := PasswordPolicy{MinLength: 8, RequireUpper: true, RequireDigit: true, RequireSymbol: true}
+	for password, allowed := range map[string]bool{
+		"Passw0rd!": true,
+		"Pässw0rd!": true,
+		"Pa0!":      false,
+		"passw0rd!": false,
+		"Password!": false,
+		"Passw0rdd": false,
+	} {
+		if p.Allows(password) != allowed {
+			t.Errorf("expected %q allowed to be %v", password, allowed)
+		}
+	}
+	if !(PasswordPolicy{}).Allows("") {
+		t.Error("expected the empty policy to allow anything")
+	}
+}
+
+func TestBlindIndexPerTenant(t *testing.T) {
+	e := newTestEncryption(t, "users.username")
+	if e.blindIndex(DefaultTenant, "username", "alice") != e.blindIndex("", "username", "alice") {
+		t.Error("expected the default tenant to keep the indexes written before there were tenants")
+	}
+	if e.blindIndex("acme", "username", "alice") == e.blindIndex(DefaultTenant, "username", "alice") {
+		t.Error("expected tenants to index the same value differently")
+	}
+}
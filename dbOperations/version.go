@@ -0,0 +1,83 @@
+package dbOperations
+
+import (
+	"errors"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	//ErrVersionConflict is returned by conditional writes when the document has changed since the given version was read
+	ErrVersionConflict = errors.New("Version conflict")
+)
+
+// bump adds incrementing the document's version to update. Every write to a
+// user or address goes through it, so versions only ever grow.
+func bump(update bson.M) bson.M {
+	update["$inc"] = bson.M{"version": 1}
+	return update
+}
+
+// conditionalUpdate applies update to the live document selected by sel if
+// its version is version, or whatever its version if version is 0, and
+// returns the new version. A document that is gone is reported as
+// mgo.ErrNotFound, one that has changed as ErrVersionConflict.
+func conditionalUpdate(c *mgo.Collection, sel bson.M, version int64, update bson.M) (int64, error) {
+	q := live(bson.M{})
+	for k, v := range sel {
+		q[k] = v
+	}
+	if version != 0 {
+		q["version"] = version
+	}
+	var doc struct {
+		Version int64 `bson:"version"`
+	}
+	_, err := c.Find(q).Apply(mgo.Change{Update: bump(update), ReturnNew: true}, &doc)
+	if err == mgo.ErrNotFound && version != 0 {
+		if n, _ := c.Find(live(sel)).Count(); n > 0 {
+			return 0, ErrVersionConflict
+		}
+	}
+	return doc.Version, err
+}
+
+// UpdateUser replaces the profile of a user if it is still at version, or
+// whatever its version if version is 0. The password, salt and password
+// scheme are only replaced when a password is set. On success u carries
+// the new version.
+func (m *Mongo) UpdateUser(u *User, version int64) error {
+	if !bson.IsObjectIdHex(u.UserID) {
+		return ErrInvalidHexID
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	dbu := DBUser{User: *u}
+	dbu.Tenant = m.owner(u.Tenant)
+	if err := m.Encryption.sealUser(&dbu); err != nil {
+		return err
+	}
+	set := bson.M{"search": dbu.Search}
+	for name, v := range userFields(&dbu.User) {
+		set[name] = *v
+	}
+	update := bson.M{"$set": set}
+	if dbu.Envelope != nil {
+		set["envelope"] = dbu.Envelope
+		set["blindIndex"] = dbu.BlindIndex
+	} else {
+		update["$unset"] = bson.M{"envelope": "", "blindIndex": ""}
+	}
+	if u.Password != "" {
+		set["password"] = u.Password
+		set["salt"] = u.Salt
+		set["passwordScheme"] = u.PasswordScheme
+	}
+	v, err := conditionalUpdate(s.DB("").C("users"), m.scope(bson.M{"_id": bson.ObjectIdHex(u.UserID)}), version, update)
+	if err != nil {
+		return err
+	}
+	u.Version = v
+	return nil
+}
@@ -0,0 +1,43 @@
+package dbOperations
+
+import (
+	"testing"
+
+	mgo "gopkg.in/mgo.v2"
+)
+
+func TestVersions(t *testing.T) {
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	u := User{Username: "versioned", Addresses: []Address{}}
+	if err := TestMongo.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	if u.Version != 1 {
+		t.Errorf("expected a new user at version 1, got %d", u.Version)
+	}
+	a := Address{City: "Bern"}
+	TestMongo.CreateAddress(&a, u.UserID)
+	got, _ := TestMongo.GetUser(u.UserID)
+	if got.Version != 2 {
+		t.Errorf("expected adding an address to bump the user to 2, got %d", got.Version)
+	}
+
+	u.FirstName = "Versioned"
+	if err := TestMongo.UpdateUser(&u, 1); err != ErrVersionConflict {
+		t.Errorf("expected a stale update to conflict, got %v", err)
+	}
+	if err := TestMongo.UpdateUser(&u, 2); err != nil || u.Version != 3 {
+		t.Errorf("expected the update to reach version 3, got %d: %v", u.Version, err)
+	}
+
+	if err := TestMongo.DeleteAddress(u.UserID, a.ID, "tester", 5); err != ErrVersionConflict {
+		t.Errorf("expected a stale delete to conflict, got %v", err)
+	}
+	if err := TestMongo.DeleteUser(u.UserID, "tester", 3); err != nil {
+		t.Error(err)
+	}
+	if err := TestMongo.DeleteUser(u.UserID, "tester", 4); err != mgo.ErrNotFound {
+		t.Errorf("expected a deleted user not to be found, got %v", err)
+	}
+}
@@ -0,0 +1,253 @@
+package dbOperations
+
+import (
+	"encoding/json"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// DeliveryPending deliveries are waiting for their next attempt.
+	DeliveryPending = "pending"
+	// DeliveryDelivered deliveries were accepted by the receiver.
+	DeliveryDelivered = "delivered"
+	// DeliveryDead deliveries ran out of attempts and are kept as dead letters.
+	DeliveryDead = "dead"
+)
+
+// Subscription asks for events to be posted to a URL. An empty Events list
+// subscribes to every event type. The secret signs the deliveries and is
+// never sent back after the subscription is created.
+type Subscription struct {
+	ID        string    `json:"id" bson:"-"`
+	URL       string    `json:"url" bson:"url"`
+	Events    []string  `json:"events" bson:"events"`
+	Secret    string    `json:"-" bson:"secret"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+	CreatedBy string    `json:"createdBy" bson:"createdBy"`
+	// Tenant is the tenant whose events the subscription receives.
+	Tenant string `json:"-" bson:"tenant"`
+}
+
+// DBSubscription is a wrapper for Subscription
+type DBSubscription struct {
+	Subscription `bson:",inline"`
+	ID           bson.ObjectId `bson:"_id"`
+}
+
+// Delivery is one event on its way to one subscription, with the log of
+// every attempt made to deliver it.
+type Delivery struct {
+	ID             string            `json:"id" bson:"-"`
+	SubscriptionID string            `json:"subscriptionID" bson:"subscriptionID"`
+	EventID        string            `json:"eventID" bson:"eventID"`
+	EventType      string            `json:"eventType" bson:"eventType"`
+	UserID         string            `json:"userID" bson:"userID"`
+	Payload        json.RawMessage   `json:"payload" bson:"payload"`
+	Status         string            `json:"status" bson:"status"`
+	CreatedAt      time.Time         `json:"createdAt" bson:"createdAt"`
+	NextAttempt    time.Time         `json:"nextAttempt" bson:"nextAttempt"`
+	Attempts       []DeliveryAttempt `json:"attempts" bson:"attempts"`
+	// Tenant is the tenant of the subscription.
+	Tenant string `json:"-" bson:"tenant"`
+}
+
+// DeliveryAttempt is the outcome of one attempt to deliver an event.
+type DeliveryAttempt struct {
+	Time       time.Time `json:"time" bson:"time"`
+	StatusCode int       `json:"statusCode,omitempty" bson:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty" bson:"error,omitempty"`
+	DurationMs int64     `json:"durationMs" bson:"durationMs"`
+}
+
+// DBDelivery is a wrapper for Delivery
+type DBDelivery struct {
+	Delivery `bson:",inline"`
+	ID       bson.ObjectId `bson:"_id"`
+}
+
+// CreateSubscription stores a new webhook subscription
+func (m *Mongo) CreateSubscription(sub *Subscription) error {
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB("").C("webhooks")
+	if sub.Events == nil {
+		sub.Events = make([]string, 0)
+	}
+	sub.Tenant = m.owner(sub.Tenant)
+	dbs := DBSubscription{Subscription: *sub, ID: bson.NewObjectId()}
+	if err := c.Insert(dbs); err != nil {
+		return err
+	}
+	sub.ID = dbs.ID.Hex()
+	return nil
+}
+
+// GetSubscriptions returns all webhook subscriptions, oldest first
+func (m *Mongo) GetSubscriptions() ([]Subscription, error) {
+	return m.findSubscriptions(bson.M{})
+}
+
+// SubscriptionsFor returns the subscriptions that want events of type typ
+func (m *Mongo) SubscriptionsFor(typ string) ([]Subscription, error) {
+	return m.findSubscriptions(bson.M{"$or": []bson.M{
+		{"events": typ},
+		{"events": bson.M{"$size": 0}},
+	}})
+}
+
+func (m *Mongo) findSubscriptions(q bson.M) ([]Subscription, error) {
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB("").C("webhooks")
+	var dbss []DBSubscription
+	err := c.Find(m.scope(q)).Sort("createdAt").All(&dbss)
+	subs := make([]Subscription, 0)
+	for _, dbs := range dbss {
+		dbs.Subscription.ID = dbs.ID.Hex()
+		subs = append(subs, dbs.Subscription)
+	}
+	return subs, err
+}
+
+// GetSubscription returns the webhook subscription with the given id
+func (m *Mongo) GetSubscription(id string) (Subscription, error) {
+	if !bson.IsObjectIdHex(id) {
+		return Subscription{}, ErrInvalidHexID
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	var dbs DBSubscription
+	err := s.DB("").C("webhooks").Find(m.scope(bson.M{"_id": bson.ObjectIdHex(id)})).One(&dbs)
+	dbs.Subscription.ID = dbs.ID.Hex()
+	return dbs.Subscription, err
+}
+
+// DeleteSubscription removes a webhook subscription along with its deliveries
+func (m *Mongo) DeleteSubscription(id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrInvalidHexID
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	if err := s.DB("").C("webhooks").Remove(m.scope(bson.M{"_id": bson.ObjectIdHex(id)})); err != nil {
+		return err
+	}
+	_, err := s.DB("").C("deliveries").RemoveAll(bson.M{"subscriptionID": id})
+	return err
+}
+
+// EnqueueDelivery schedules an event for delivery to a subscription. An
+// event already queued for the subscription is not queued again.
+func (m *Mongo) EnqueueDelivery(d *Delivery) error {
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB("").C("deliveries")
+	dbd := DBDelivery{Delivery: *d, ID: bson.NewObjectId()}
+	dbd.Tenant = m.owner(d.Tenant)
+	dbd.Status = DeliveryPending
+	dbd.NextAttempt = dbd.CreatedAt
+	if dbd.Attempts == nil {
+		dbd.Attempts = make([]DeliveryAttempt, 0)
+	}
+	err := c.Insert(dbd)
+	if mgo.IsDup(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	*d = dbd.Delivery
+	d.ID = dbd.ID.Hex()
+	return nil
+}
+
+// ClaimDeliveries returns up to limit pending deliveries that are due at
+// now and holds each back from other dispatchers for lease
+func (m *Mongo) ClaimDeliveries(now time.Time, lease time.Duration, limit int) ([]Delivery, error) {
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB("").C("deliveries")
+	deliveries := make([]Delivery, 0)
+	for len(deliveries) < limit {
+		var dbd DBDelivery
+		_, err := c.Find(bson.M{"status": DeliveryPending, "nextAttempt": bson.M{"$lte": now}}).
+			Sort("nextAttempt").
+			Apply(mgo.Change{Update: bson.M{"$set": bson.M{"nextAttempt": now.Add(lease)}}}, &dbd)
+		if err == mgo.ErrNotFound {
+			break
+		}
+		if err != nil {
+			return deliveries, err
+		}
+		dbd.Delivery.ID = dbd.ID.Hex()
+		deliveries = append(deliveries, dbd.Delivery)
+	}
+	return deliveries, nil
+}
+
+// RecordDeliveryAttempt logs an attempt to deliver and moves the delivery
+// to status, to be attempted again at next if it is still pending
+func (m *Mongo) RecordDeliveryAttempt(id string, a DeliveryAttempt, status string, next time.Time) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrInvalidHexID
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB("").C("deliveries")
+	return c.UpdateId(bson.ObjectIdHex(id), bson.M{
+		"$set":  bson.M{"status": status, "nextAttempt": next},
+		"$push": bson.M{"attempts": a},
+	})
+}
+
+// DeleteDelivery removes a delivery that can no longer be made
+func (m *Mongo) DeleteDelivery(id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrInvalidHexID
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	return s.DB("").C("deliveries").RemoveId(bson.ObjectIdHex(id))
+}
+
+// GetDeliveries returns the latest deliveries to a subscription, newest first
+func (m *Mongo) GetDeliveries(subscriptionID string, limit int) ([]Delivery, error) {
+	return m.findDeliveries(bson.M{"subscriptionID": subscriptionID}, limit)
+}
+
+// GetDeadDeliveries returns the latest deliveries that ran out of attempts, newest first
+func (m *Mongo) GetDeadDeliveries(limit int) ([]Delivery, error) {
+	return m.findDeliveries(bson.M{"status": DeliveryDead}, limit)
+}
+
+func (m *Mongo) findDeliveries(q bson.M, limit int) ([]Delivery, error) {
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB("").C("deliveries")
+	var dbds []DBDelivery
+	err := c.Find(m.scope(q)).Sort("-createdAt").Limit(limit).All(&dbds)
+	deliveries := make([]Delivery, 0)
+	for _, dbd := range dbds {
+		dbd.Delivery.ID = dbd.ID.Hex()
+		deliveries = append(deliveries, dbd.Delivery)
+	}
+	return deliveries, err
+}
+
+func (m *Mongo) ensureWebhookIndexes(s *mgo.Session) error {
+	c := s.DB("").C("deliveries")
+	indexes := []mgo.Index{
+		{Key: []string{"subscriptionID", "eventID"}, Unique: true, Background: true},
+		{Key: []string{"status", "nextAttempt"}, Background: true},
+		{Key: []string{"subscriptionID", "-createdAt"}, Background: true},
+	}
+	for _, index := range indexes {
+		if err := c.EnsureIndex(index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package dbOperations
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWebhookDeliveries(t *testing.T) {
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	all := Subscription{URL: "http://example.com/all", Secret: "a", CreatedAt: time.Now()}
+	some := Subscription{URL: "http://example.com/some", Events: []string{"UserDeleted"}, Secret: "b", CreatedAt: time.Now()}
+	for _, sub := range []*Subscription{&all, &some} {
+		if err := TestMongo.CreateSubscription(sub); err != nil {
+			t.Fatal(err)
+		}
+	}
+	subs, err := TestMongo.SubscriptionsFor("UserRegistered")
+	if err != nil || len(subs) != 1 || subs[0].ID != all.ID {
+		t.Errorf("unexpected subscriptions %v: %v", subs, err)
+	}
+
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if err := TestMongo.EnqueueDelivery(&Delivery{SubscriptionID: all.ID, EventID: "e1", EventType: "UserRegistered", CreatedAt: now}); err != nil {
+			t.Error(err)
+		}
+	}
+	claimed, err := TestMongo.ClaimDeliveries(now, time.Minute, 10)
+	if err != nil || len(claimed) != 1 {
+		t.Fatalf("expected the delivery to be queued once, got %v: %v", claimed, err)
+	}
+	err = TestMongo.RecordDeliveryAttempt(claimed[0].ID, DeliveryAttempt{Time: now, StatusCode: 500}, DeliveryDead, now)
+	if err != nil {
+		t.Error(err)
+	}
+	dead, _ := TestMongo.GetDeadDeliveries(10)
+	if len(dead) != 1 || len(dead[0].Attempts) != 1 || dead[0].Attempts[0].StatusCode != 500 {
+		t.Errorf("unexpected dead letters %v", dead)
+	}
+
+	if err := TestMongo.EnqueueDelivery(&Delivery{SubscriptionID: all.ID, EventID: "e2", EventType: "UserRegistered", CreatedAt: now}); err != nil {
+		t.Error(err)
+	}
+	claimed, _ = TestMongo.ClaimDeliveries(now, time.Minute, 10)
+	if len(claimed) != 1 {
+		t.Fatalf("expected the second event to be queued, got %v", claimed)
+	}
+	if err := TestMongo.DeleteDelivery(claimed[0].ID); err != nil {
+		t.Error(err)
+	}
+	if log, _ := TestMongo.GetDeliveries(all.ID, 10); len(log) != 1 {
+		t.Errorf("expected only the dead letter to be left, got %v", log)
+	}
+
+	if err := TestMongo.DeleteSubscription(all.ID); err != nil {
+		t.Error(err)
+	}
+	if log, _ := TestMongo.GetDeliveries(all.ID, 10); len(log) != 0 {
+		t.Errorf("expected the deliveries to go with the subscription, got %v", log)
+	}
+}
@@ -2,6 +2,7 @@ package user
 
 import (
 	"context"
+	"reflect"
 
 	"github.com/go-kit/kit/endpoint"
 	"github.com/user/dbOperations"
@@ -13,9 +14,100 @@ type Endpoints struct {
 	RegisterEndpoint    endpoint.Endpoint
 	UserGetEndpoint     endpoint.Endpoint
 	UserPostEndpoint    endpoint.Endpoint
+	UserPutEndpoint     endpoint.Endpoint
 	AddressGetEndpoint  endpoint.Endpoint
 	AddressPostEndpoint endpoint.Endpoint
 	DeleteEndpoint      endpoint.Endpoint
+	AuditGetEndpoint    endpoint.Endpoint
+
+	AddressValidateEndpoint endpoint.Endpoint
+
+	ExportEndpoint        endpoint.Endpoint
+	ErasurePostEndpoint   endpoint.Endpoint
+	ErasureGetEndpoint    endpoint.Endpoint
+	ErasureDeleteEndpoint endpoint.Endpoint
+
+	DeletedUsersEndpoint     endpoint.Endpoint
+	DeletedAddressesEndpoint endpoint.Endpoint
+	RestoreUserEndpoint      endpoint.Endpoint
+	RestoreAddressEndpoint   endpoint.Endpoint
+
+	BulkImportEndpoint endpoint.Endpoint
+	BulkExportEndpoint endpoint.Endpoint
+
+	WebhookPostEndpoint       endpoint.Endpoint
+	WebhooksGetEndpoint       endpoint.Endpoint
+	WebhookDeleteEndpoint     endpoint.Endpoint
+	WebhookDeliveriesEndpoint endpoint.Endpoint
+	DeadLettersEndpoint       endpoint.Endpoint
+
+	SCIMUserPostEndpoint   endpoint.Endpoint
+	SCIMUserGetEndpoint    endpoint.Endpoint
+	SCIMUsersGetEndpoint   endpoint.Endpoint
+	SCIMUserPutEndpoint    endpoint.Endpoint
+	SCIMUserPatchEndpoint  endpoint.Endpoint
+	SCIMUserDeleteEndpoint endpoint.Endpoint
+
+	OIDCDiscoveryEndpoint    endpoint.Endpoint
+	OIDCKeysEndpoint         endpoint.Endpoint
+	OIDCAuthorizeEndpoint    endpoint.Endpoint
+	OIDCLoginEndpoint        endpoint.Endpoint
+	OIDCTokenEndpoint        endpoint.Endpoint
+	OIDCUserInfoEndpoint     endpoint.Endpoint
+	OIDCClientPostEndpoint   endpoint.Endpoint
+	OIDCClientsGetEndpoint   endpoint.Endpoint
+	OIDCClientDeleteEndpoint endpoint.Endpoint
+
+	ExternalLoginEndpoint    endpoint.Endpoint
+	ExternalCallbackEndpoint endpoint.Endpoint
+	IdentitiesGetEndpoint    endpoint.Endpoint
+	IdentityLinkEndpoint     endpoint.Endpoint
+	IdentityDeleteEndpoint   endpoint.Endpoint
+
+	APIKeyPostEndpoint   endpoint.Endpoint
+	APIKeysGetEndpoint   endpoint.Endpoint
+	APIKeyRotateEndpoint endpoint.Endpoint
+	APIKeyDeleteEndpoint endpoint.Endpoint
+
+	HealthEndpoint endpoint.Endpoint
+
+	SearchEndpoint endpoint.Endpoint
+
+	DefaultsPutEndpoint endpoint.Endpoint
+
+	PhoneVerifyEndpoint  endpoint.Endpoint
+	PhoneConfirmEndpoint endpoint.Endpoint
+
+	PreferencesGetEndpoint   endpoint.Endpoint
+	PreferencesPatchEndpoint endpoint.Endpoint
+
+	PoliciesGetEndpoint   endpoint.Endpoint
+	PolicyPostEndpoint    endpoint.Endpoint
+	ConsentsGetEndpoint   endpoint.Endpoint
+	ConsentPostEndpoint   endpoint.Endpoint
+	ConsentDeleteEndpoint endpoint.Endpoint
+
+	TenantsGetEndpoint   endpoint.Endpoint
+	TenantGetEndpoint    endpoint.Endpoint
+	TenantPutEndpoint    endpoint.Endpoint
+	TenantDeleteEndpoint endpoint.Endpoint
+}
+
+// AuthenticateEndpoints resolves the caller of every endpoint with a. It
+// should be applied last, so that it runs before any other middleware.
+func AuthenticateEndpoints(e Endpoints, a Authenticator) Endpoints {
+	return e.wrap(Authenticate(a))
+}
+
+// wrap applies m to every endpoint that is set.
+func (e Endpoints) wrap(m endpoint.Middleware) Endpoints {
+	v := reflect.ValueOf(&e).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if ep, ok := v.Field(i).Interface().(endpoint.Endpoint); ok && ep != nil {
+			v.Field(i).Set(reflect.ValueOf(m(ep)))
+		}
+	}
+	return e
 }
 
 // MakeEndpoints returns an Endpoints structure, where each endpoint is
@@ -26,9 +118,12 @@ func MakeEndpoints(s Service) Endpoints {
 		RegisterEndpoint:    MakeRegisterEndpoint(s),
 		UserGetEndpoint:     MakeUserGetEndpoint(s),
 		UserPostEndpoint:    MakeUserPostEndpoint(s),
+		UserPutEndpoint:     MakeUserPutEndpoint(s),
 		AddressGetEndpoint:  MakeAddressGetEndpoint(s),
 		AddressPostEndpoint: MakeAddressPostEndpoint(s),
 		DeleteEndpoint:      MakeDeleteEndpoint(s),
+
+		AddressValidateEndpoint: MakeAddressValidateEndpoint(),
 	}
 }
 
@@ -77,6 +172,19 @@ func MakeUserPostEndpoint(s Service) endpoint.Endpoint {
 	}
 }
 
+// MakeUserPutEndpoint returns an endpoint via the given service.
+func MakeUserPutEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(userPutRequest)
+		var usr dbOperations.User
+		err = req.IfMatch.apply(func(version int64) (err error) {
+			usr, err = s.PutUser(req.User, actorFor(ctx, request), version)
+			return err
+		})
+		return usr, err
+	}
+}
+
 // MakeAddressGetEndpoint returns an endpoint via the given service.
 func MakeAddressGetEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
@@ -104,13 +212,17 @@ func MakeDeleteEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
 		req := request.(deleteRequest)
 		if req.AddID != "" {
-			err := s.DeleteAddress(req.AddID, req.UserID)
+			err := req.IfMatch.apply(func(version int64) error {
+				return s.DeleteAddress(req.AddID, req.UserID, actorFor(ctx, request), version)
+			})
 			if err == nil {
 				return statusResponse{Status: true}, err
 			}
 			return statusResponse{Status: false}, err
 		}
-		err = s.DeleteUser(req.UserID)
+		err = req.IfMatch.apply(func(version int64) error {
+			return s.DeleteUser(req.UserID, actorFor(ctx, request), version)
+		})
 		if err == nil {
 			return statusResponse{Status: true}, err
 		}
@@ -126,6 +238,8 @@ type GetRequest struct {
 type loginRequest struct {
 	Username string
 	Password string
+	// Accept are the policy versions the user accepts as they log in.
+	Accept []policyRef
 }
 
 type userResponse struct {
@@ -136,6 +250,11 @@ type usersResponse struct {
 	Users []dbOperations.User `json:"customer"`
 }
 
+type userPutRequest struct {
+	User    dbOperations.User
+	IfMatch ifMatch
+}
+
 type addressPostRequest struct {
 	dbOperations.Address
 	UserID string `json:"userID"`
@@ -152,6 +271,8 @@ type registerRequest struct {
 	FirstName string `json:"firstName"`
 	LastName  string `json:"lastName"`
 	Phone     string `json:"phone"`
+	// Accept are the policy versions the user accepts as they register.
+	Accept []policyRef `json:"accept,omitempty"`
 }
 
 type statusResponse struct {
@@ -163,8 +284,9 @@ type postResponse struct {
 }
 
 type deleteRequest struct {
-	UserID string
-	AddID  string
+	UserID  string
+	AddID   string
+	IfMatch ifMatch
 }
 
 type healthRequest struct {
@@ -0,0 +1,80 @@
+package user
+
+import (
+	"net/http"
+
+	"github.com/user/dbOperations"
+	"google.golang.org/grpc/codes"
+	mgo "gopkg.in/mgo.v2"
+)
+
+// errorStatus is the status an error is answered with over each transport.
+type errorStatus struct {
+	HTTP int
+	GRPC codes.Code
+}
+
+var (
+	statusBadRequest = errorStatus{http.StatusBadRequest, codes.InvalidArgument}
+	statusNotFound   = errorStatus{http.StatusNotFound, codes.NotFound}
+	statusConflict   = errorStatus{http.StatusConflict, codes.FailedPrecondition}
+	statusExists     = errorStatus{http.StatusConflict, codes.AlreadyExists}
+	statusInternal   = errorStatus{http.StatusInternalServerError, codes.Internal}
+)
+
+// errorStatuses maps the errors of the service and its stores onto the
+// status encodeError and grpcError answer them with. It is a list rather
+// than a map, as some errors cannot be map keys.
+var errorStatuses = []struct {
+	err    error
+	status errorStatus
+}{
+	{ErrUnauthorized, errorStatus{http.StatusUnauthorized, codes.Unauthenticated}},
+	{ErrInvalidToken, errorStatus{http.StatusUnauthorized, codes.Unauthenticated}},
+	{ErrForbidden, errorStatus{http.StatusForbidden, codes.PermissionDenied}},
+	{ErrRateLimited, errorStatus{http.StatusTooManyRequests, codes.ResourceExhausted}},
+	{dbOperations.ErrRateLimitContention, errorStatus{http.StatusServiceUnavailable, codes.Unavailable}},
+	{ErrInvalidRequest, statusBadRequest},
+	{ErrInvalidPhone, statusBadRequest},
+	{ErrWeakPassword, statusBadRequest},
+	{dbOperations.ErrInvalidHexID, statusBadRequest},
+	{dbOperations.ErrAddressType, statusBadRequest},
+	{dbOperations.ErrPhoneCode, statusBadRequest},
+	{mgo.ErrNotFound, statusNotFound},
+	{ErrUnknownTenant, statusNotFound},
+	{dbOperations.ErrVersionConflict, errorStatus{http.StatusPreconditionFailed, codes.FailedPrecondition}},
+	{dbOperations.ErrDeletedWithUser, statusConflict},
+	{dbOperations.ErrUserDeleted, statusConflict},
+	{dbOperations.ErrTenantNotEmpty, statusConflict},
+	{ErrLastIdentity, statusConflict},
+	{ErrPolicyVersion, statusConflict},
+	{dbOperations.ErrHostTaken, statusExists},
+	{dbOperations.ErrPolicyExists, statusExists},
+	{ErrAlreadyLinked, statusExists},
+	// Only receivers of webhooks verify them.
+	{ErrWebhookSignature, errorStatus{http.StatusUnauthorized, codes.Unauthenticated}},
+	{ErrWebhookExpired, errorStatus{http.StatusUnauthorized, codes.Unauthenticated}},
+	{dbOperations.ErrUnknownMasterKey, statusInternal},
+	{dbOperations.ErrNoKeyring, statusInternal},
+	{dbOperations.ErrAuditChainBroken, statusInternal},
+}
+
+// statusOf returns the status err is answered with. Errors the service
+// does not know are internal.
+func statusOf(err error) errorStatus {
+	switch err.(type) {
+	case AddressError, PreferencesError:
+		return statusBadRequest
+	case ConsentRequiredError:
+		return errorStatus{http.StatusForbidden, codes.FailedPrecondition}
+	}
+	for _, s := range errorStatuses {
+		if err == s.err {
+			return s.status
+		}
+	}
+	if mgo.IsDup(err) {
+		return statusExists
+	}
+	return statusInternal
+}
@@ -0,0 +1,121 @@
+package user
+
+import (
+	"context"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/user/dbOperations"
+	"google.golang.org/grpc/status"
+	mgo "gopkg.in/mgo.v2"
+)
+
+// exportedErrors are the exported errors of the service and its stores,
+// by the name they are declared with.
+var exportedErrors = map[string]error{
+	"ErrUnauthorized":     ErrUnauthorized,
+	"ErrInvalidToken":     ErrInvalidToken,
+	"ErrForbidden":        ErrForbidden,
+	"ErrRateLimited":      ErrRateLimited,
+	"ErrInvalidRequest":   ErrInvalidRequest,
+	"ErrInvalidPhone":     ErrInvalidPhone,
+	"ErrWeakPassword":     ErrWeakPassword,
+	"ErrUnknownTenant":    ErrUnknownTenant,
+	"ErrLastIdentity":     ErrLastIdentity,
+	"ErrAlreadyLinked":    ErrAlreadyLinked,
+	"ErrPolicyVersion":    ErrPolicyVersion,
+	"ErrWebhookSignature": ErrWebhookSignature,
+	"ErrWebhookExpired":   ErrWebhookExpired,
+
+	"dbOperations.ErrInvalidHexID":     dbOperations.ErrInvalidHexID,
+	"dbOperations.ErrAddressType":      dbOperations.ErrAddressType,
+	"dbOperations.ErrPhoneCode":        dbOperations.ErrPhoneCode,
+	"dbOperations.ErrVersionConflict":  dbOperations.ErrVersionConflict,
+	"dbOperations.ErrDeletedWithUser":  dbOperations.ErrDeletedWithUser,
+	"dbOperations.ErrUserDeleted":      dbOperations.ErrUserDeleted,
+	"dbOperations.ErrTenantNotEmpty":   dbOperations.ErrTenantNotEmpty,
+	"dbOperations.ErrHostTaken":        dbOperations.ErrHostTaken,
+	"dbOperations.ErrPolicyExists":     dbOperations.ErrPolicyExists,
+	"dbOperations.ErrUnknownMasterKey": dbOperations.ErrUnknownMasterKey,
+	"dbOperations.ErrNoKeyring":        dbOperations.ErrNoKeyring,
+	"dbOperations.ErrAuditChainBroken": dbOperations.ErrAuditChainBroken,
+
+	"dbOperations.ErrRateLimitContention": dbOperations.ErrRateLimitContention,
+}
+
+// TestErrorStatuses walks every exported Err* of the package and of
+// dbOperations, and checks that each has a status that both transports
+// answer it with.
+func TestErrorStatuses(t *testing.T) {
+	for dir, prefix := range map[string]string{".": "", "dbOperations": "dbOperations."} {
+		for _, name := range declaredErrors(t, dir) {
+			if _, ok := exportedErrors[prefix+name]; !ok {
+				t.Errorf("%s%s is not in exportedErrors", prefix, name)
+			}
+		}
+	}
+
+	errs := []error{
+		mgo.ErrNotFound,
+		&mgo.LastError{Code: 11000},
+		AddressError{{Field: "postcode", Problem: "is not a postcode of CH"}},
+		PreferencesError{Field: "locale", Problem: "is not a language tag"},
+		ConsentRequiredError{},
+	}
+	for name, err := range exportedErrors {
+		listed := false
+		for _, s := range errorStatuses {
+			listed = listed || s.err == err
+		}
+		if !listed {
+			t.Errorf("%s has no status", name)
+		}
+		errs = append(errs, err)
+	}
+	for _, err := range errs {
+		want := statusOf(err)
+		w := httptest.NewRecorder()
+		encodeError(context.Background(), err, w)
+		if w.Code != want.HTTP {
+			t.Errorf("%q: expected HTTP %d, got %d", err, want.HTTP, w.Code)
+		}
+		if got := status.Code(grpcError(err)); got != want.GRPC {
+			t.Errorf("%q: expected %v, got %v", err, want.GRPC, got)
+		}
+	}
+}
+
+// declaredErrors returns the names of the exported Err* variables declared
+// in the non-test files of dir.
+func declaredErrors(t *testing.T, dir string) []string {
+	pkgs, err := parser.ParseDir(token.NewFileSet(), dir, func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, pkg := range pkgs {
+		for _, f := range pkg.Files {
+			for _, decl := range f.Decls {
+				gd, ok := decl.(*ast.GenDecl)
+				if !ok || gd.Tok != token.VAR {
+					continue
+				}
+				for _, spec := range gd.Specs {
+					for _, id := range spec.(*ast.ValueSpec).Names {
+						if id.IsExported() && strings.HasPrefix(id.Name, "Err") {
+							names = append(names, id.Name)
+						}
+					}
+				}
+			}
+		}
+	}
+	return names
+}
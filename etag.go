@@ -0,0 +1,129 @@
+package user
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/user/dbOperations"
+)
+
+// etagFor returns the ETag of a single user, address or preferences
+// response, which is its quoted version.
+func etagFor(response interface{}) (string, bool) {
+	var v int64
+	switch r := response.(type) {
+	case dbOperations.User:
+		v = r.Version
+	case dbOperations.Address:
+		v = r.Version
+	case preferencesResponse:
+		v = r.version
+	default:
+		return "", false
+	}
+	if v == 0 {
+		return "", false
+	}
+	return strconv.Quote(strconv.FormatInt(v, 10)), true
+}
+
+// etagMatches reports whether etag is one of the comma separated tags in
+// header, comparing weakly as RFC 7232 asks of If-None-Match.
+func etagMatches(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || t == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// ifMatch holds the versions listed in an If-Match header. An update or
+// delete conditional on it goes ahead if the record is at any of them; an
+// empty ifMatch lets it go ahead whatever the version.
+type ifMatch []int64
+
+// parseIfMatch reads the versions an update or delete is conditional on
+// from the comma separated tags in header. An absent header or * means any
+// version. A tag that is not a version cannot match any, so it is reported
+// as a conflict. Weak tags are accepted, as SCIM clients send back the W/
+// versions they are given.
+func parseIfMatch(header string) (ifMatch, error) {
+	var versions ifMatch
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		switch t {
+		case "":
+			continue
+		case "*":
+			return nil, nil
+		}
+		t, err := strconv.Unquote(strings.TrimPrefix(t, "W/"))
+		if err != nil {
+			return nil, dbOperations.ErrVersionConflict
+		}
+		v, err := strconv.ParseInt(t, 10, 64)
+		if err != nil || v < 1 {
+			return nil, dbOperations.ErrVersionConflict
+		}
+		versions = append(versions, v)
+	}
+	return versions, nil
+}
+
+// apply calls f with each version of m in turn until one matches, that is
+// until f does not fail with a version conflict. With no versions f is
+// called once with 0, for any version.
+func (m ifMatch) apply(f func(version int64) error) error {
+	if len(m) == 0 {
+		return f(0)
+	}
+	var err error
+	for _, v := range m {
+		if err = f(v); err != dbOperations.ErrVersionConflict {
+			return err
+		}
+	}
+	return err
+}
+
+// at returns current, the version a record was read at, if m lets a change
+// of it go ahead, and a version conflict otherwise.
+func (m ifMatch) at(current int64) (int64, error) {
+	if len(m) == 0 {
+		return current, nil
+	}
+	for _, v := range m {
+		if v == current {
+			return current, nil
+		}
+	}
+	return 0, dbOperations.ErrVersionConflict
+}
+
+// populateIfNoneMatch is a RequestFunc keeping If-None-Match for
+// encodeResponse.
+func populateIfNoneMatch(ctx context.Context, r *http.Request) context.Context {
+	if h := r.Header.Get("If-None-Match"); h != "" {
+		return context.WithValue(ctx, ifNoneMatchKey, h)
+	}
+	return ctx
+}
+
+// writeETag sets the ETag of response and, if the client already has it,
+// answers 304 Not Modified. It reports whether the body should be skipped.
+func writeETag(ctx context.Context, w http.ResponseWriter, response interface{}) bool {
+	etag, ok := etagFor(response)
+	if !ok {
+		return false
+	}
+	w.Header().Set("ETag", etag)
+	if h, _ := ctx.Value(ifNoneMatchKey).(string); h != "" && etagMatches(h, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
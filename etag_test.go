@@ -0,0 +1,99 @@
+package user
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/user/dbOperations"
+)
+
+func TestETags(t *testing.T) {
+	svc := newStubService()
+	e, _ := newTestEndpoints(svc)
+	router := MakeHTTPHandler(context.Background(), e, log.NewNopLogger())
+	do := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do(httptest.NewRequest("GET", "/customers/"+testUserID, nil))
+	if etag := w.Header().Get("ETag"); etag != `"3"` {
+		t.Errorf(`expected ETag "3", got %q`, etag)
+	}
+	for _, inm := range []string{`"3"`, `W/"3"`, `"1", "3"`, `*`} {
+		r := httptest.NewRequest("GET", "/customers/"+testUserID, nil)
+		r.Header.Set("If-None-Match", inm)
+		if w := do(r); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+			t.Errorf("expected 304 for If-None-Match %s, got %d", inm, w.Code)
+		}
+	}
+	r := httptest.NewRequest("GET", "/customers/"+testUserID, nil)
+	r.Header.Set("If-None-Match", `"2"`)
+	if w := do(r); w.Code != http.StatusOK {
+		t.Errorf("expected 200 for a stale If-None-Match, got %d", w.Code)
+	}
+	if w := do(httptest.NewRequest("GET", "/customers", nil)); w.Header().Get("ETag") != "" {
+		t.Error("expected no ETag on a list")
+	}
+
+	for _, im := range []string{`"2"`, `3`} {
+		r = adminRequest("DELETE", "/customers/"+testUserID)
+		r.Header.Set("If-Match", im)
+		if w := do(r); w.Code != http.StatusPreconditionFailed {
+			t.Errorf("expected 412 for If-Match %s, got %d", im, w.Code)
+		}
+	}
+
+	put := func(body, im string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("PUT", "/customers/"+testUserID, strings.NewReader(body))
+		r.Header.Set("If-Match", im)
+		return do(r)
+	}
+	if w := put(`{"username":"eve","firstName":"Evelyn"}`, `"2"`); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("expected 412 for a stale update, got %d", w.Code)
+	}
+	if w := put(`{"firstName":"Evelyn"}`, `"3"`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an update without username, got %d", w.Code)
+	}
+	w = put(`{"username":"eve","firstName":"Evelyn"}`, `"1", W/"3"`)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != `"4"` {
+		t.Errorf("expected the update to match any listed version and answer ETag \"4\", got %d %q: %s", w.Code, w.Header().Get("ETag"), w.Body)
+	}
+	if u := svc.users[testUserID]; u.FirstName != "Evelyn" || u.Password != "secret" {
+		t.Errorf("expected the names updated and the password kept, got %+v", u)
+	}
+
+	r = adminRequest("DELETE", "/customers/"+testUserID)
+	r.Header.Set("If-Match", `"3", "4"`)
+	if w := do(r); w.Code != http.StatusOK {
+		t.Errorf("expected the delete to succeed, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestParseIfMatch(t *testing.T) {
+	for _, c := range []struct {
+		header string
+		want   ifMatch
+		err    error
+	}{
+		{"", nil, nil},
+		{"*", nil, nil},
+		{`"3"`, ifMatch{3}, nil},
+		{`W/"3"`, ifMatch{3}, nil},
+		{`"1", W/"2" ,"3"`, ifMatch{1, 2, 3}, nil},
+		{`"1", *`, nil, nil},
+		{`"1", 2`, nil, dbOperations.ErrVersionConflict},
+		{`"0"`, nil, dbOperations.ErrVersionConflict},
+	} {
+		got, err := parseIfMatch(c.header)
+		if !reflect.DeepEqual(got, c.want) || err != c.err {
+			t.Errorf("parseIfMatch(%q) = %v, %v; expected %v, %v", c.header, got, err, c.want, c.err)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package user
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/user/dbOperations"
+)
+
+// Domain events the service emits. Other services subscribe to them to
+// react to changes of customers. Those about users and addresses are
+// written by the store along with the change they describe.
+const (
+	EventUserRegistered  = dbOperations.EventUserRegistered
+	EventUserUpdated     = "UserUpdated"
+	EventAddressAdded    = dbOperations.EventAddressAdded
+	EventAddressRemoved  = dbOperations.EventAddressRemoved
+	EventUserDeleted     = dbOperations.EventUserDeleted
+	EventUserRestored    = dbOperations.EventUserRestored
+	EventAddressRestored = dbOperations.EventAddressRestored
+	// EventPolicyAccepted and EventPolicyWithdrawn carry the acceptance
+	// recorded, see dbOperations.AcceptancePayload.
+	EventPolicyAccepted  = "PolicyAccepted"
+	EventPolicyWithdrawn = "PolicyWithdrawn"
+)
+
+const (
+	// relayBatch is how many events one relay pass publishes at most.
+	relayBatch = 100
+	// relayLease is how long a claimed event is held back from other
+	// relays. An event whose relay died is retried once it runs out.
+	relayLease = time.Minute
+	// maxRetryDelay caps the exponential backoff between attempts.
+	maxRetryDelay = time.Hour
+)
+
+// Publisher delivers domain events. Publishing the same event twice must
+// be harmless to consumers, which can tell repeats apart by the event ID.
+type Publisher interface {
+	Publish(ctx context.Context, e dbOperations.Event) error
+}
+
+// OutboxStore holds events until they have been published.
+// *dbOperations.Mongo implements it.
+type OutboxStore interface {
+	AppendEvent(e *dbOperations.Event) error
+	ClaimEvents(now time.Time, lease time.Duration, limit int) ([]dbOperations.Event, error)
+	MarkEventPublished(id string) error
+	MarkEventFailed(id string, cause error, retryAt time.Time) error
+}
+
+// NewEvent returns an event of type typ about the user userid. payload,
+// if not nil, is sent along as JSON; it is one of the EventPayload types
+// of dbOperations, which leave personal data out.
+func NewEvent(typ, userid string, payload interface{}) (dbOperations.Event, error) {
+	e := dbOperations.Event{Type: typ, Time: time.Now().UTC(), UserID: userid}
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return e, err
+		}
+		e.Payload = b
+	}
+	return e, nil
+}
+
+// ChannelPublisher publishes events onto a channel, for consumers in the
+// same process and for tests.
+type ChannelPublisher struct {
+	C chan dbOperations.Event
+}
+
+// NewChannelPublisher returns a ChannelPublisher whose channel buffers
+// size events.
+func NewChannelPublisher(size int) *ChannelPublisher {
+	return &ChannelPublisher{C: make(chan dbOperations.Event, size)}
+}
+
+// Publish implements Publisher. It blocks until the event is received or
+// ctx is done.
+func (p *ChannelPublisher) Publish(ctx context.Context, e dbOperations.Event) error {
+	select {
+	case p.C <- e:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// HTTPPublisher posts each event as JSON to a webhook URL. Any response
+// other than 2xx counts as a failure, and the event is retried.
+type HTTPPublisher struct {
+	URL    string
+	Client *http.Client
+}
+
+// Publish implements Publisher.
+func (p HTTPPublisher) Publish(ctx context.Context, e dbOperations.Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", p.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event-ID", e.ID)
+	req.Header.Set("X-Event-Type", e.Type)
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// RelayEvents publishes the events due in the outbox and returns how many
+// went out. Events that fail are retried with exponential backoff until
+// they are published, so every event is delivered at least once.
+func RelayEvents(ctx context.Context, st OutboxStore, pub Publisher, logger log.Logger) (int, error) {
+	now := time.Now()
+	events, err := st.ClaimEvents(now, relayLease, relayBatch)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, e := range events {
+		if err := pub.Publish(ctx, e); err != nil {
+			retryAt := now.Add(retryDelay(e.Attempts))
+			logger.Log("event", e.ID, "type", e.Type, "attempts", e.Attempts+1, "retry", retryAt, "err", err)
+			if err := st.MarkEventFailed(e.ID, err, retryAt); err != nil {
+				return n, err
+			}
+			continue
+		}
+		if err := st.MarkEventPublished(e.ID); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// retryDelay is how long to wait after the given number of failed attempts.
+func retryDelay(attempts int) time.Duration {
+	d := time.Second
+	for i := 0; i < attempts && d < maxRetryDelay; i++ {
+		d *= 2
+	}
+	if d > maxRetryDelay {
+		d = maxRetryDelay
+	}
+	return d
+}
@@ -0,0 +1,130 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/user/dbOperations"
+)
+
+// memOutbox is an in-memory OutboxStore.
+type memOutbox struct {
+	events []dbOperations.Event
+}
+
+func (o *memOutbox) AppendEvent(e *dbOperations.Event) error {
+	e.ID = fmt.Sprintf("event-%d", len(o.events))
+	e.NextAttempt = e.Time
+	o.events = append(o.events, *e)
+	return nil
+}
+
+func (o *memOutbox) ClaimEvents(now time.Time, lease time.Duration, limit int) ([]dbOperations.Event, error) {
+	events := make([]dbOperations.Event, 0)
+	for i, e := range o.events {
+		if e.PublishedAt == nil && !e.NextAttempt.After(now) && len(events) < limit {
+			o.events[i].NextAttempt = now.Add(lease)
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+func (o *memOutbox) MarkEventPublished(id string) error {
+	for i := range o.events {
+		if o.events[i].ID == id {
+			now := time.Now()
+			o.events[i].PublishedAt = &now
+			o.events[i].Attempts++
+		}
+	}
+	return nil
+}
+
+func (o *memOutbox) MarkEventFailed(id string, cause error, retryAt time.Time) error {
+	for i := range o.events {
+		if o.events[i].ID == id {
+			o.events[i].NextAttempt = retryAt
+			o.events[i].LastError = cause.Error()
+			o.events[i].Attempts++
+		}
+	}
+	return nil
+}
+
+func TestRelayEventsToChannel(t *testing.T) {
+	o := &memOutbox{}
+	e, err := NewEvent(EventAddressAdded, testUserID, dbOperations.Address{ID: "a1", City: "Zurich"}.EventPayload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.AppendEvent(&e)
+	pub := NewChannelPublisher(1)
+	if n, err := RelayEvents(context.Background(), o, pub, log.NewNopLogger()); n != 1 || err != nil {
+		t.Fatalf("expected one event relayed, got %d: %v", n, err)
+	}
+	got := <-pub.C
+	var a dbOperations.AddressPayload
+	json.Unmarshal(got.Payload, &a)
+	if got.Type != EventAddressAdded || got.UserID != testUserID || a.ID != "a1" {
+		t.Errorf("unexpected event %+v", got)
+	}
+	if n, _ := RelayEvents(context.Background(), o, pub, log.NewNopLogger()); n != 0 {
+		t.Errorf("expected a published event not to be relayed again, relayed %d", n)
+	}
+}
+
+func TestRelayEventsRetries(t *testing.T) {
+	var received []dbOperations.Event
+	fail := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var e dbOperations.Event
+		json.NewDecoder(r.Body).Decode(&e)
+		if r.Header.Get("X-Event-ID") != e.ID {
+			t.Errorf("expected the event id in X-Event-ID, got %q", r.Header.Get("X-Event-ID"))
+		}
+		received = append(received, e)
+	}))
+	defer srv.Close()
+
+	o := &memOutbox{}
+	e, _ := NewEvent(EventUserDeleted, testUserID, nil)
+	o.AppendEvent(&e)
+	pub := HTTPPublisher{URL: srv.URL}
+	if n, _ := RelayEvents(context.Background(), o, pub, log.NewNopLogger()); n != 0 {
+		t.Errorf("expected nothing published while the webhook fails, got %d", n)
+	}
+	if o.events[0].Attempts != 1 || o.events[0].LastError == "" || !o.events[0].NextAttempt.After(time.Now()) {
+		t.Errorf("expected the failure to be recorded with a retry, got %+v", o.events[0])
+	}
+
+	fail = false
+	if n, _ := RelayEvents(context.Background(), o, pub, log.NewNopLogger()); n != 0 {
+		t.Errorf("expected the retry to wait for its backoff, got %d", n)
+	}
+	o.events[0].NextAttempt = time.Now()
+	if n, err := RelayEvents(context.Background(), o, pub, log.NewNopLogger()); n != 1 || err != nil {
+		t.Errorf("expected the retry to be published, got %d: %v", n, err)
+	}
+	if len(received) != 1 || received[0].ID != e.ID || received[0].Type != EventUserDeleted {
+		t.Errorf("unexpected deliveries %+v", received)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{0: time.Second, 3: 8 * time.Second, 40: maxRetryDelay} {
+		if got := retryDelay(attempts); got != want {
+			t.Errorf("retryDelay(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package user
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+)
+
+// The statuses a Health can have.
+const (
+	HealthOK    = "OK"
+	HealthError = "err"
+)
+
+// Pinger reaches a dependency of the service. *dbOperations.Mongo
+// implements it.
+type Pinger interface {
+	Ping() error
+}
+
+// Health is the status of the service or one of its dependencies.
+type Health struct {
+	Service string    `json:"service"`
+	Status  string    `json:"status"`
+	Time    time.Time `json:"time"`
+}
+
+// HealthEndpoints mounts the endpoint reporting the health of the service
+// and of its database, which is reached through db.
+func HealthEndpoints(e Endpoints, db Pinger) Endpoints {
+	e.HealthEndpoint = MakeHealthEndpoint(db)
+	return e
+}
+
+// MakeHealthEndpoint returns an endpoint reporting the health of the
+// service and of its database.
+func MakeHealthEndpoint(db Pinger) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		now := time.Now().UTC()
+		status := HealthOK
+		if err := db.Ping(); err != nil {
+			status = HealthError
+		}
+		return healthResponse{Health: []Health{
+			{Service: "user", Status: HealthOK, Time: now},
+			{Service: "user-db", Status: status, Time: now},
+		}}, nil
+	}
+}
+
+type healthResponse struct {
+	Health []Health `json:"health"`
+}
+
+// healthy reports whether the service and all its dependencies are OK.
+func (r healthResponse) healthy() bool {
+	for _, h := range r.Health {
+		if h.Status != HealthOK {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,39 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+// pingerFunc is a Pinger calling itself.
+type pingerFunc func() error
+
+func (f pingerFunc) Ping() error { return f() }
+
+func TestHealth(t *testing.T) {
+	for _, c := range []struct {
+		ping   error
+		code   int
+		status string
+	}{
+		{nil, http.StatusOK, HealthOK},
+		{errors.New("no reachable servers"), http.StatusServiceUnavailable, HealthError},
+	} {
+		ping := c.ping
+		e := HealthEndpoints(MakeEndpoints(newStubService()), pingerFunc(func() error { return ping }))
+		router := MakeHTTPHandler(context.Background(), e, log.NewNopLogger())
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+		var resp healthResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		if w.Code != c.code || len(resp.Health) != 2 || resp.Health[1].Service != "user-db" || resp.Health[1].Status != c.status {
+			t.Errorf("expected %d with the database %s, got %d: %+v", c.code, c.status, w.Code, resp)
+		}
+	}
+}
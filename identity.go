@@ -0,0 +1,737 @@
+package user
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/user/dbOperations"
+	mgo "gopkg.in/mgo.v2"
+)
+
+var (
+	// ErrAlreadyLinked is returned when linking a provider the user has
+	// already linked an account at.
+	ErrAlreadyLinked = errors.New("Identity already linked")
+	// ErrLastIdentity is returned when unlinking the identity a user was
+	// created from while it is their only one, as they have no password to
+	// log in with instead.
+	ErrLastIdentity = errors.New("Cannot unlink the only identity of the user")
+)
+
+// externalLoginCookie binds an external login to the browser that started
+// it, so a callback cannot be replayed in another browser.
+const externalLoginCookie = "external_login"
+
+// IdentityProvider is an upstream OAuth 2.0 or OpenID Connect provider
+// users can log in with.
+type IdentityProvider interface {
+	// Name identifies the provider in URLs and linked identities.
+	Name() string
+	// Title is what the login page calls the provider.
+	Title() string
+	// AuthCodeURL is where the user logs in, with an S256 PKCE challenge.
+	AuthCodeURL(ctx context.Context, redirectURI, state, nonce, challenge string) (string, error)
+	// Exchange redeems the code the user came back with.
+	Exchange(ctx context.Context, redirectURI, code, verifier, nonce string) (ExternalIdentity, error)
+}
+
+// ExternalIdentity is a user as an IdentityProvider knows them.
+type ExternalIdentity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Username      string
+	GivenName     string
+	FamilyName    string
+}
+
+// upstreamClient is used by UpstreamProviders without a Client.
+var upstreamClient = &http.Client{Timeout: 10 * time.Second}
+
+// UpstreamProvider is an IdentityProvider configured from JSON. With an
+// Issuer, the endpoints are discovered and the user is read from the ID
+// token, verified against the issuer's keys. Without one the endpoints
+// must be given and the user is read from UserInfoURL, as for plain
+// OAuth 2.0 providers; a numeric "id" and "login" stand in for "sub" and
+// "preferred_username" there.
+type UpstreamProvider struct {
+	ID           string       `json:"name"`
+	DisplayName  string       `json:"title"`
+	Issuer       string       `json:"issuer"`
+	AuthURL      string       `json:"authorization_endpoint"`
+	TokenURL     string       `json:"token_endpoint"`
+	UserInfoURL  string       `json:"userinfo_endpoint"`
+	ClientID     string       `json:"client_id"`
+	ClientSecret string       `json:"client_secret"`
+	Scopes       []string     `json:"scopes"`
+	Client       *http.Client `json:"-"`
+
+	mu      sync.Mutex
+	jwksURI string
+}
+
+// ParseIdentityProviders reads a JSON array of UpstreamProviders.
+func ParseIdentityProviders(data []byte) ([]IdentityProvider, error) {
+	var ups []*UpstreamProvider
+	if err := json.Unmarshal(data, &ups); err != nil {
+		return nil, err
+	}
+	providers := make([]IdentityProvider, 0, len(ups))
+	seen := map[string]bool{}
+	for _, up := range ups {
+		switch {
+		case up.ID == "" || url.PathEscape(up.ID) != up.ID:
+			return nil, fmt.Errorf("identity provider name %q is not usable in a URL", up.ID)
+		case seen[up.ID]:
+			return nil, fmt.Errorf("identity provider %q is configured twice", up.ID)
+		case up.ClientID == "":
+			return nil, fmt.Errorf("identity provider %q has no client_id", up.ID)
+		case up.Issuer == "" && (up.AuthURL == "" || up.TokenURL == "" || up.UserInfoURL == ""):
+			return nil, fmt.Errorf("identity provider %q needs an issuer, or its endpoints", up.ID)
+		}
+		seen[up.ID] = true
+		providers = append(providers, up)
+	}
+	return providers, nil
+}
+
+// Name implements IdentityProvider.
+func (up *UpstreamProvider) Name() string {
+	return up.ID
+}
+
+// Title implements IdentityProvider.
+func (up *UpstreamProvider) Title() string {
+	if up.DisplayName == "" {
+		return up.ID
+	}
+	return up.DisplayName
+}
+
+// AuthCodeURL implements IdentityProvider.
+func (up *UpstreamProvider) AuthCodeURL(ctx context.Context, redirectURI, state, nonce, challenge string) (string, error) {
+	if err := up.discover(ctx); err != nil {
+		return "", err
+	}
+	scopes := up.Scopes
+	if scopes == nil && up.Issuer != "" {
+		scopes = []string{scopeOpenID, "profile", "email"}
+	}
+	q := url.Values{
+		"response_type":         {responseTypeCode},
+		"client_id":             {up.ClientID},
+		"redirect_uri":          {redirectURI},
+		"scope":                 {strings.Join(scopes, " ")},
+		"state":                 {state},
+		"code_challenge":        {challenge},
+		"code_challenge_method": {challengeMethod},
+	}
+	if up.Issuer != "" {
+		q.Set("nonce", nonce)
+	}
+	return withQuery(up.AuthURL, q), nil
+}
+
+// Exchange implements IdentityProvider.
+func (up *UpstreamProvider) Exchange(ctx context.Context, redirectURI, code, verifier, nonce string) (ExternalIdentity, error) {
+	if err := up.discover(ctx); err != nil {
+		return ExternalIdentity{}, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest("POST", up.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return ExternalIdentity{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(up.ClientID), url.QueryEscape(up.ClientSecret))
+	var tokens struct {
+		AccessToken string `json:"access_token"`
+		IDToken     string `json:"id_token"`
+	}
+	if err := up.do(ctx, req, &tokens); err != nil {
+		return ExternalIdentity{}, err
+	}
+	if up.Issuer != "" {
+		return up.verifyIDToken(ctx, tokens.IDToken, nonce)
+	}
+
+	req, err = http.NewRequest("GET", up.UserInfoURL, nil)
+	if err != nil {
+		return ExternalIdentity{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	var claims upstreamClaims
+	if err := up.do(ctx, req, &claims); err != nil {
+		return ExternalIdentity{}, err
+	}
+	if claims.Subject == "" && claims.ID != nil {
+		claims.Subject = strings.Trim(string(claims.ID), `"`)
+	}
+	if claims.Username == "" {
+		claims.Username = claims.Login
+	}
+	if claims.Subject == "" {
+		return ExternalIdentity{}, errors.New("the user info has no subject")
+	}
+	return claims.identity(), nil
+}
+
+// discover reads the endpoints of an OpenID Connect provider once.
+func (up *UpstreamProvider) discover(ctx context.Context) error {
+	if up.Issuer == "" {
+		return nil
+	}
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	if up.jwksURI != "" {
+		return nil
+	}
+	req, err := http.NewRequest("GET", strings.TrimSuffix(up.Issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return err
+	}
+	var config discoveryResponse
+	if err := up.do(ctx, req, &config); err != nil {
+		return err
+	}
+	if config.Issuer != up.Issuer || config.JWKSURI == "" {
+		return fmt.Errorf("the discovery document of %s is for %q", up.Issuer, config.Issuer)
+	}
+	if up.AuthURL == "" {
+		up.AuthURL = config.AuthorizationEndpoint
+	}
+	if up.TokenURL == "" {
+		up.TokenURL = config.TokenEndpoint
+	}
+	up.jwksURI = config.JWKSURI
+	return nil
+}
+
+// verifyIDToken checks an ID token against the issuer's current keys,
+// which are fetched for every login so that rotated keys are picked up.
+func (up *UpstreamProvider) verifyIDToken(ctx context.Context, token, nonce string) (ExternalIdentity, error) {
+	req, err := http.NewRequest("GET", up.jwksURI, nil)
+	if err != nil {
+		return ExternalIdentity{}, err
+	}
+	var jwks jwksResponse
+	if err := up.do(ctx, req, &jwks); err != nil {
+		return ExternalIdentity{}, err
+	}
+	kid := jwtKeyID(token)
+	for _, k := range jwks.Keys {
+		if k.Kid != kid || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return ExternalIdentity{}, err
+		}
+		var claims upstreamClaims
+		if err := verifyJWT(key, "", token, &claims); err != nil {
+			return ExternalIdentity{}, err
+		}
+		switch {
+		case claims.Issuer != up.Issuer:
+			return ExternalIdentity{}, errors.New("the ID token is from another issuer")
+		case !contains(claims.Audience, up.ClientID):
+			return ExternalIdentity{}, errors.New("the ID token is for another client")
+		case time.Now().Unix() > claims.Expiry:
+			return ExternalIdentity{}, errors.New("the ID token has expired")
+		case subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1:
+			return ExternalIdentity{}, errors.New("the ID token is for another login")
+		case claims.Subject == "":
+			return ExternalIdentity{}, errors.New("the ID token has no subject")
+		}
+		return claims.identity(), nil
+	}
+	return ExternalIdentity{}, fmt.Errorf("no signing key %q", kid)
+}
+
+// do sends req and decodes the JSON response into v.
+func (up *UpstreamProvider) do(ctx context.Context, req *http.Request, v interface{}) error {
+	client := up.Client
+	if client == nil {
+		client = upstreamClient
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s", req.Method, req.URL.Path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// upstreamClaims are the claims read from an ID token or user info.
+type upstreamClaims struct {
+	Issuer        string          `json:"iss"`
+	Subject       string          `json:"sub"`
+	Audience      audience        `json:"aud"`
+	Expiry        int64           `json:"exp"`
+	Nonce         string          `json:"nonce"`
+	Email         string          `json:"email"`
+	EmailVerified interface{}     `json:"email_verified"`
+	Username      string          `json:"preferred_username"`
+	GivenName     string          `json:"given_name"`
+	FamilyName    string          `json:"family_name"`
+	ID            json.RawMessage `json:"id"`
+	Login         string          `json:"login"`
+}
+
+// identity returns the claims as an ExternalIdentity. Some providers send
+// email_verified as a string.
+func (c upstreamClaims) identity() ExternalIdentity {
+	verified, _ := c.EmailVerified.(bool)
+	if s, ok := c.EmailVerified.(string); ok {
+		verified, _ = strconv.ParseBool(s)
+	}
+	return ExternalIdentity{
+		Subject:       c.Subject,
+		Email:         c.Email,
+		EmailVerified: verified,
+		Username:      c.Username,
+		GivenName:     c.GivenName,
+		FamilyName:    c.FamilyName,
+	}
+}
+
+// audience is the aud claim, a string or an array of them.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var one string
+	if json.Unmarshal(b, &one) == nil {
+		*a = audience{one}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
+// IdentityStore keeps the links between users and their external
+// accounts, and the external logins in progress. *dbOperations.Mongo
+// implements it.
+type IdentityStore interface {
+	LinkIdentity(id *dbOperations.Identity) error
+	GetIdentity(provider, subject string) (dbOperations.Identity, error)
+	GetIdentities(userid string) ([]dbOperations.Identity, error)
+	UnlinkIdentity(userid, provider string) error
+	GetUsersWithEmail(email string) ([]dbOperations.User, error)
+	VerifyEmail(userid, email string) error
+	CreateExternalLogin(l *dbOperations.ExternalLogin) error
+	ConsumeExternalLogin(hash string) (dbOperations.ExternalLogin, error)
+}
+
+// externalIdentities logs users in through upstream providers, as an
+// alternative to their password on the login page of p.
+type externalIdentities struct {
+	p         *OIDCProvider
+	st        IdentityStore
+	providers map[string]IdentityProvider
+}
+
+// IdentityEndpoints lets users log in with their accounts at providers,
+// which are listed on the login page of p. A login is matched to a user by
+// the account linked before, then by a verified email address that only
+// one user has; otherwise a user is created from it. Users link further
+// accounts, and unlink them, with an access token of their own.
+func IdentityEndpoints(e Endpoints, p *OIDCProvider, st IdentityStore, providers ...IdentityProvider) Endpoints {
+	x := &externalIdentities{p: p, st: st, providers: map[string]IdentityProvider{}}
+	for _, ip := range providers {
+		x.providers[ip.Name()] = ip
+	}
+	p.upstreams = providers
+	e.ExternalLoginEndpoint = x.makeExternalLoginEndpoint()
+	e.ExternalCallbackEndpoint = x.makeExternalCallbackEndpoint()
+	e.IdentitiesGetEndpoint = x.makeIdentitiesGetEndpoint()
+	e.IdentityLinkEndpoint = x.makeIdentityLinkEndpoint()
+	e.IdentityDeleteEndpoint = x.makeIdentityDeleteEndpoint()
+	return e
+}
+
+// callbackURI is where a provider sends the user back to.
+func (x *externalIdentities) callbackURI(provider string) string {
+	return x.p.Issuer + "/oauth2/callback/" + provider
+}
+
+// begin stores a new external login and returns where the user logs in,
+// and the cookie binding the login to their browser.
+func (x *externalIdentities) begin(ctx context.Context, ip IdentityProvider, params url.Values, linkUserID string) (string, *http.Cookie, error) {
+	var secrets [4]string
+	for i := range secrets {
+		var err error
+		if secrets[i], err = randomToken(); err != nil {
+			return "", nil, err
+		}
+	}
+	state, browser, verifier, nonce := secrets[0], secrets[1], secrets[2], secrets[3]
+	err := x.st.CreateExternalLogin(&dbOperations.ExternalLogin{
+		Hash:        hashToken(state),
+		Provider:    ip.Name(),
+		BrowserHash: hashToken(browser),
+		Verifier:    verifier,
+		Nonce:       nonce,
+		Params:      params.Encode(),
+		LinkUserID:  linkUserID,
+		ExpiresAt:   time.Now().Add(oidcLoginTTL).UTC(),
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	uri, err := ip.AuthCodeURL(ctx, x.callbackURI(ip.Name()), state, nonce, base64.RawURLEncoding.EncodeToString(challenge[:]))
+	if err != nil {
+		return "", nil, err
+	}
+	path := "/oauth2/callback/"
+	if u, err := url.Parse(x.p.Issuer); err == nil {
+		path = u.Path + path
+	}
+	return uri, &http.Cookie{
+		Name:     externalLoginCookie,
+		Value:    browser,
+		Path:     path,
+		MaxAge:   int(oidcLoginTTL / time.Second),
+		Secure:   strings.HasPrefix(x.p.Issuer, "https:"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}, nil
+}
+
+// makeExternalLoginEndpoint returns the endpoint the login page sends
+// users to who log in with a provider. It carries on the authorization
+// request of the client.
+func (x *externalIdentities) makeExternalLoginEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(externalLoginRequest)
+		if _, _, err := x.p.validate(req.authorizeRequest); err != nil {
+			return nil, err
+		}
+		ip, ok := x.providers[req.Provider]
+		if !ok {
+			return nil, x.p.pageError("invalid_request", "The identity provider is not configured.")
+		}
+		uri, cookie, err := x.begin(ctx, ip, req.authorizeRequest.params(), "")
+		if err != nil {
+			return nil, err
+		}
+		return oidcRedirect{URL: uri, cookie: cookie}, nil
+	}
+}
+
+// makeExternalCallbackEndpoint returns the endpoint providers send users
+// back to. Logins continue the authorization flow as if the user had
+// logged in with their password; links show a confirmation page.
+func (x *externalIdentities) makeExternalCallbackEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(externalCallbackRequest)
+		expired := x.p.pageError("invalid_request", "The login has expired. Please start again from the application.")
+		l, err := x.st.ConsumeExternalLogin(hashToken(req.State))
+		if err == mgo.ErrNotFound {
+			return nil, expired
+		}
+		if err != nil {
+			return nil, err
+		}
+		ip, ok := x.providers[l.Provider]
+		if !ok || l.Provider != req.Provider || time.Now().After(l.ExpiresAt) ||
+			subtle.ConstantTimeCompare([]byte(hashToken(req.Browser)), []byte(l.BrowserHash)) != 1 {
+			return nil, expired
+		}
+		failed := func(cause string) error {
+			return x.p.pageError("access_denied", fmt.Sprintf("The login with %s failed: %s", ip.Title(), cause))
+		}
+		if l.LinkUserID != "" {
+			if req.Error != "" {
+				return nil, failed(req.Error)
+			}
+			ident, err := ip.Exchange(ctx, x.callbackURI(ip.Name()), req.Code, l.Verifier, l.Nonce)
+			if err != nil {
+				return nil, failed(err.Error())
+			}
+			err = x.link(l.LinkUserID, ip.Name(), ident, false)
+			if err == ErrAlreadyLinked {
+				return nil, x.p.pageError("invalid_request", "The account is already linked to a user.")
+			}
+			if err != nil {
+				return nil, err
+			}
+			page := x.p.page("linked", http.StatusOK, linkedPage{Provider: ip.Title()})
+			page.userID = l.LinkUserID
+			return page, nil
+		}
+
+		params, _ := url.ParseQuery(l.Params)
+		ar := authorizeRequestFrom(params)
+		client, scopes, err := x.p.validate(ar)
+		if err != nil {
+			return nil, err
+		}
+		if req.Error != "" {
+			return nil, x.p.redirectError(ar, "access_denied", fmt.Sprintf("The login with %s failed.", ip.Title()))
+		}
+		ident, err := ip.Exchange(ctx, x.callbackURI(ip.Name()), req.Code, l.Verifier, l.Nonce)
+		if err != nil {
+			return nil, failed(err.Error())
+		}
+		userID, err := x.resolve(ip.Name(), ident)
+		if err == nil {
+			err = x.p.refuseErased(userID)
+		}
+		switch err {
+		case nil:
+			return x.p.loggedIn(client, scopes, ar, userID)
+		case ErrUnauthorized:
+			return nil, x.p.pageError("access_denied", "The account cannot be used to log in.")
+		case errAmbiguousEmail:
+			return nil, x.p.pageError("access_denied", "Several users have the email address of the account. Log in with your password and link the account instead.")
+		}
+		return nil, err
+	}
+}
+
+var errAmbiguousEmail = errors.New("several users have the email address")
+
+// resolve returns the user an external identity logs in as: the one it
+// was linked to, the only user with its email address verified on both
+// sides, or a new user created from it. A user whose own address is not
+// verified can still link the identity explicitly, once logged in.
+func (x *externalIdentities) resolve(provider string, ident ExternalIdentity) (string, error) {
+	linked, err := x.st.GetIdentity(provider, ident.Subject)
+	if err == nil {
+		// Deleted users cannot log in, just as with their password.
+		if _, err := x.p.s.GetUser(linked.UserID); err == mgo.ErrNotFound {
+			return "", ErrUnauthorized
+		} else if err != nil {
+			return "", err
+		}
+		return linked.UserID, nil
+	}
+	if err != mgo.ErrNotFound {
+		return "", err
+	}
+	if ident.Email != "" && ident.EmailVerified {
+		all, err := x.st.GetUsersWithEmail(ident.Email)
+		if err != nil {
+			return "", err
+		}
+		var users []dbOperations.User
+		for _, u := range all {
+			if u.EmailVerified {
+				users = append(users, u)
+			}
+		}
+		switch len(users) {
+		case 0:
+		case 1:
+			return users[0].UserID, x.link(users[0].UserID, provider, ident, false)
+		default:
+			return "", errAmbiguousEmail
+		}
+	}
+
+	password, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	u := dbOperations.User{
+		Username:  usernameFor(provider, ident),
+		Password:  password,
+		FirstName: ident.GivenName,
+		LastName:  ident.FamilyName,
+	}
+	if ident.EmailVerified {
+		u.Email = ident.Email
+	}
+	created, err := x.p.s.PostUser(u)
+	if mgo.IsDup(err) {
+		suffix, _ := randomToken()
+		u.Username += "-" + strings.ToLower(suffix[:6])
+		created, err = x.p.s.PostUser(u)
+	}
+	if err != nil {
+		return "", err
+	}
+	return created.UserID, x.link(created.UserID, provider, ident, true)
+}
+
+// usernameFor proposes a username for a user created from ident.
+func usernameFor(provider string, ident ExternalIdentity) string {
+	switch {
+	case ident.Username != "":
+		return ident.Username
+	case ident.Email != "" && ident.EmailVerified:
+		return strings.SplitN(ident.Email, "@", 2)[0]
+	}
+	return provider + "-" + ident.Subject
+}
+
+// link links ident to a user, failing with ErrAlreadyLinked if it is
+// linked to another user or the user has linked another account at the
+// provider. The user's email address is then verified if it is the one
+// the provider vouches for.
+func (x *externalIdentities) link(userID, provider string, ident ExternalIdentity, created bool) error {
+	linked, err := x.st.GetIdentity(provider, ident.Subject)
+	if err == nil {
+		if linked.UserID != userID {
+			return ErrAlreadyLinked
+		}
+		return nil
+	}
+	if err != mgo.ErrNotFound {
+		return err
+	}
+	err = x.st.LinkIdentity(&dbOperations.Identity{
+		UserID:   userID,
+		Provider: provider,
+		Subject:  ident.Subject,
+		Email:    ident.Email,
+		LinkedAt: time.Now().UTC(),
+		Created:  created,
+	})
+	if mgo.IsDup(err) {
+		return ErrAlreadyLinked
+	}
+	if err != nil || !ident.EmailVerified {
+		return err
+	}
+	return x.st.VerifyEmail(userID, ident.Email)
+}
+
+// authorizeUser lets through the user a request is about, and admins if
+// admins is set.
+func authorizeUser(ctx context.Context, userID string, admins bool) error {
+	p, ok := PrincipalFrom(ctx)
+	if !ok {
+		return ErrUnauthorized
+	}
+	if p.ID != userID && !(admins && p.HasRole(RoleAdmin)) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+func (x *externalIdentities) makeIdentitiesGetEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(identityRequest)
+		if err := authorizeUser(ctx, req.UserID, true); err != nil {
+			return nil, err
+		}
+		ids, err := x.st.GetIdentities(req.UserID)
+		return EmbedStruct{identitiesResponse{Identities: ids}}, err
+	}
+}
+
+// makeIdentityLinkEndpoint returns the endpoint starting to link an
+// account to the user. Only the user can link their accounts, as they
+// must log in at the provider in the browser the response reaches.
+func (x *externalIdentities) makeIdentityLinkEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(identityRequest)
+		if err := authorizeUser(ctx, req.UserID, false); err != nil {
+			return nil, err
+		}
+		ip, ok := x.providers[req.Provider]
+		if !ok {
+			return nil, mgo.ErrNotFound
+		}
+		ids, err := x.st.GetIdentities(req.UserID)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			if id.Provider == req.Provider {
+				return nil, ErrAlreadyLinked
+			}
+		}
+		uri, cookie, err := x.begin(ctx, ip, nil, req.UserID)
+		if err != nil {
+			return nil, err
+		}
+		return linkResponse{URL: uri, cookie: cookie}, nil
+	}
+}
+
+func (x *externalIdentities) makeIdentityDeleteEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(identityRequest)
+		if err := authorizeUser(ctx, req.UserID, true); err != nil {
+			return nil, err
+		}
+		ids, err := x.st.GetIdentities(req.UserID)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			if id.Provider != req.Provider {
+				continue
+			}
+			if id.Created && len(ids) == 1 {
+				return nil, ErrLastIdentity
+			}
+			err := x.st.UnlinkIdentity(req.UserID, req.Provider)
+			return statusResponse{Status: err == nil}, err
+		}
+		return nil, mgo.ErrNotFound
+	}
+}
+
+type externalLoginRequest struct {
+	authorizeRequest
+	Provider string
+}
+
+type externalCallbackRequest struct {
+	Provider string
+	State    string
+	Code     string
+	Error    string
+	Browser  string
+}
+
+type identityRequest struct {
+	UserID   string
+	Provider string
+}
+
+type identitiesResponse struct {
+	Identities []dbOperations.Identity `json:"identity"`
+}
+
+// linkResponse is where the user links their account, with the cookie
+// the browser needs to come back.
+type linkResponse struct {
+	URL    string `json:"url"`
+	cookie *http.Cookie
+}
+
+// linkedPage is what the linked template is given.
+type linkedPage struct {
+	Provider string
+}
+
+// externalOption is a provider on the login page.
+type externalOption struct {
+	Action string
+	Title  string
+}
@@ -0,0 +1,510 @@
+package user
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+	"github.com/user/dbOperations"
+	mgo "gopkg.in/mgo.v2"
+)
+
+const (
+	testUpstreamIssuer = "https://corp.test"
+	testUpstreamClient = "user-service"
+	testUpstreamSecret = "upstream-secret"
+)
+
+// memIdentities is an in-memory IdentityStore, finding users by email in
+// the stub service.
+type memIdentities struct {
+	svc        *stubService
+	identities []dbOperations.Identity
+	logins     map[string]dbOperations.ExternalLogin
+}
+
+func newMemIdentities(svc *stubService) *memIdentities {
+	return &memIdentities{svc: svc, logins: map[string]dbOperations.ExternalLogin{}}
+}
+
+func (m *memIdentities) LinkIdentity(id *dbOperations.Identity) error {
+	for _, o := range m.identities {
+		if (o.Provider == id.Provider && o.Subject == id.Subject) || (o.UserID == id.UserID && o.Provider == id.Provider) {
+			return &mgo.LastError{Code: 11000}
+		}
+	}
+	m.identities = append(m.identities, *id)
+	return nil
+}
+
+func (m *memIdentities) GetIdentity(provider, subject string) (dbOperations.Identity, error) {
+	for _, id := range m.identities {
+		if id.Provider == provider && id.Subject == subject {
+			return id, nil
+		}
+	}
+	return dbOperations.Identity{}, mgo.ErrNotFound
+}
+
+func (m *memIdentities) GetIdentities(userid string) ([]dbOperations.Identity, error) {
+	ids := make([]dbOperations.Identity, 0)
+	for _, id := range m.identities {
+		if id.UserID == userid {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (m *memIdentities) UnlinkIdentity(userid, provider string) error {
+	for i, id := range m.identities {
+		if id.UserID == userid && id.Provider == provider {
+			m.identities = append(m.identities[:i], m.identities[i+1:]...)
+			return nil
+		}
+	}
+	return mgo.ErrNotFound
+}
+
+func (m *memIdentities) GetUsersWithEmail(email string) ([]dbOperations.User, error) {
+	users := make([]dbOperations.User, 0)
+	for _, u := range m.svc.users {
+		if strings.EqualFold(u.Email, email) {
+			users = append(users, u)
+		}
+	}
+	return users, nil
+}
+
+func (m *memIdentities) VerifyEmail(userid, email string) error {
+	u, ok := m.svc.users[userid]
+	if !ok {
+		return mgo.ErrNotFound
+	}
+	if email != "" && strings.EqualFold(u.Email, email) {
+		u.EmailVerified = true
+		m.svc.users[userid] = u
+	}
+	return nil
+}
+
+func (m *memIdentities) CreateExternalLogin(l *dbOperations.ExternalLogin) error {
+	m.logins[l.Hash] = *l
+	return nil
+}
+
+func (m *memIdentities) ConsumeExternalLogin(hash string) (dbOperations.ExternalLogin, error) {
+	l, ok := m.logins[hash]
+	if !ok {
+		return l, mgo.ErrNotFound
+	}
+	delete(m.logins, hash)
+	return l, nil
+}
+
+var (
+	upstreamKeyOnce sync.Once
+	upstreamKey     *rsa.PrivateKey
+)
+
+// upstreamAccounts are the users of the fake provider, by the login hint
+// the test appends to its authorization URL.
+var upstreamAccounts = map[string]map[string]interface{}{
+	"eve":      {"sub": "corp-1", "email": "eve@example.com", "email_verified": true, "given_name": "Eve"},
+	"mallory":  {"sub": "corp-2", "email": "eve@example.com", "email_verified": false, "preferred_username": "mallory"},
+	"newcomer": {"sub": "corp-3", "email": "newcomer@example.com", "email_verified": "true", "given_name": "Nico"},
+}
+
+// newFakeUpstream returns a provider backed by a local fake OpenID Connect
+// provider, which logs in the account named by login_hint right away. Its
+// codes carry what it needs to answer the token request.
+func newFakeUpstream() *UpstreamProvider {
+	upstreamKeyOnce.Do(func() {
+		var err error
+		if upstreamKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			panic(err)
+		}
+	})
+	jwk := jwkFor(&upstreamKey.PublicKey)
+	r := mux.NewRouter()
+	r.Methods("GET").Path("/.well-known/openid-configuration").HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		json.NewEncoder(w).Encode(discoveryResponse{
+			Issuer:                testUpstreamIssuer,
+			AuthorizationEndpoint: testUpstreamIssuer + "/authorize",
+			TokenEndpoint:         testUpstreamIssuer + "/token",
+			JWKSURI:               testUpstreamIssuer + "/jwks",
+		})
+	})
+	r.Methods("GET").Path("/jwks").HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		json.NewEncoder(w).Encode(jwksResponse{Keys: []jsonWebKey{jwk}})
+	})
+	r.Methods("GET").Path("/authorize").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("client_id") != testUpstreamClient || q.Get("code_challenge_method") != challengeMethod {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if q.Get("login_hint") == "" {
+			http.Redirect(w, r, withQuery(q.Get("redirect_uri"), url.Values{"error": {"access_denied"}, "state": {q.Get("state")}}), http.StatusFound)
+			return
+		}
+		code, _ := json.Marshal(q)
+		http.Redirect(w, r, withQuery(q.Get("redirect_uri"), url.Values{
+			"code":  {base64.RawURLEncoding.EncodeToString(code)},
+			"state": {q.Get("state")},
+		}), http.StatusFound)
+	})
+	r.Methods("POST").Path("/token").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		b, _ := base64.RawURLEncoding.DecodeString(r.PostFormValue("code"))
+		var q url.Values
+		json.Unmarshal(b, &q)
+		challenge := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if id != testUpstreamClient || secret != testUpstreamSecret || q.Get("redirect_uri") != r.PostFormValue("redirect_uri") ||
+			q.Get("code_challenge") != base64.RawURLEncoding.EncodeToString(challenge[:]) {
+			http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		claims := map[string]interface{}{
+			"iss":   testUpstreamIssuer,
+			"aud":   []string{testUpstreamClient},
+			"exp":   time.Now().Add(time.Minute).Unix(),
+			"nonce": q.Get("nonce"),
+		}
+		for k, v := range upstreamAccounts[q.Get("login_hint")] {
+			claims[k] = v
+		}
+		token, _ := signJWT(upstreamKey, jwk.Kid, "JWT", claims)
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "opaque", "token_type": "Bearer", "id_token": token})
+	})
+	return &UpstreamProvider{
+		ID:           "corp",
+		DisplayName:  "Corp",
+		Issuer:       testUpstreamIssuer,
+		ClientID:     testUpstreamClient,
+		ClientSecret: testUpstreamSecret,
+		Client:       &http.Client{Transport: routerTransport{r}},
+	}
+}
+
+// upstreamBrowser is a browser reaching both the service and the fake
+// provider, keeping cookies but not following redirects.
+type upstreamBrowser struct {
+	t      *testing.T
+	client *http.Client
+}
+
+func newUpstreamBrowser(t *testing.T, router *mux.Router, upstream *UpstreamProvider) *upstreamBrowser {
+	jar, _ := cookiejar.New(nil)
+	return &upstreamBrowser{t: t, client: &http.Client{
+		Jar: jar,
+		Transport: hostTransport{
+			"user.test": routerTransport{router},
+			"corp.test": upstream.Client.Transport,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}}
+}
+
+// hostTransport sends requests on by their host.
+type hostTransport map[string]http.RoundTripper
+
+func (t hostTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	return t[r.URL.Host].RoundTrip(r)
+}
+
+// follow sends the browser through the fake provider as account, and
+// returns the response to the callback.
+func (b *upstreamBrowser) follow(resp *http.Response, account string) *http.Response {
+	if resp.StatusCode != http.StatusFound || !strings.HasPrefix(resp.Header.Get("Location"), testUpstreamIssuer+"/authorize?") {
+		b.t.Fatalf("expected a redirect to the provider, got %d: %s", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	resp, err := b.client.Get(withQuery(resp.Header.Get("Location"), url.Values{"login_hint": {account}}))
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	resp, err = b.client.Get(resp.Header.Get("Location"))
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	return resp
+}
+
+// externalLogin carries on an authorization request with the provider.
+func (b *upstreamBrowser) externalLogin(authorize, account string) *http.Response {
+	u, _ := url.Parse(authorize)
+	resp, err := b.client.PostForm(testIssuer+"/oauth2/external/corp", u.Query())
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	return b.follow(resp, account)
+}
+
+func TestExternalLogin(t *testing.T) {
+	svc := newStubService()
+	eve := svc.users[testUserID]
+	eve.Email, eve.EmailVerified = "Eve@example.com", true
+	svc.users[testUserID] = eve
+	e, st := newTestEndpoints(svc)
+	router := MakeHTTPHandler(context.Background(), e, log.NewNopLogger())
+	rp := registerTestClient(t, router)
+	browser := newUpstreamBrowser(t, router, newFakeUpstream())
+	api := func(method, path, bearer string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		r.Header.Set("Authorization", "Bearer "+bearer)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	authorize := rp.authorizeURL("openid profile", "")
+	resp, _ := browser.client.Get(authorize)
+	if page := readBody(resp); !strings.Contains(page, "Continue with Corp") {
+		t.Errorf("expected the login page to offer the provider: %s", page)
+	}
+
+	// A verified email address links the account to the user having it.
+	resp = browser.externalLogin(authorize, "eve")
+	ticket := ticketField.FindStringSubmatch(readBody(resp))
+	if resp.StatusCode != http.StatusOK || ticket == nil {
+		t.Fatalf("expected the consent page, got %d", resp.StatusCode)
+	}
+	w := api("GET", "/customers/"+testUserID+"/identities", testAdminToken)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"subject":"corp-1"`) || !strings.Contains(w.Body.String(), `"created":false`) {
+		t.Errorf("expected the account to be linked to eve, got %d: %s", w.Code, w.Body)
+	}
+	u, _ := url.Parse(authorize)
+	form := u.Query()
+	form.Set("ticket", ticket[1])
+	form.Set("decision", "allow")
+	browser.client.PostForm(testIssuer+"/oauth2/authorize", form)
+
+	// Once linked, the account logs in as its user.
+	authorize = rp.authorizeURL("openid profile", "")
+	resp = browser.externalLogin(authorize, "eve")
+	location, _ := url.Parse(resp.Header.Get("Location"))
+	if resp.StatusCode != http.StatusFound || location.Query().Get("code") == "" {
+		t.Fatalf("expected a code, got %d: %s", resp.StatusCode, location)
+	}
+	if _, tokens := rp.exchange(location.Query().Get("code")); rp.verifyIDToken(tokens.IDToken)["sub"] != testUserID {
+		t.Error("expected the ID token to be eve's")
+	}
+
+	// The state is bound to the browser and only accepted once.
+	u, _ = url.Parse(rp.authorizeURL("openid", ""))
+	resp, _ = browser.client.PostForm(testIssuer+"/oauth2/external/corp", u.Query())
+	location, _ = url.Parse(resp.Header.Get("Location"))
+	callback := testIssuer + "/oauth2/callback/corp?code=x&state=" + url.QueryEscape(location.Query().Get("state"))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", callback, nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected a callback without the cookie to be refused, got %d", w.Code)
+	}
+	if resp, _ := browser.client.Get(callback); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected the state to be used up, got %d", resp.StatusCode)
+	}
+
+	// Refusing at the provider is passed on to the client.
+	resp = browser.externalLogin(rp.authorizeURL("openid", ""), "")
+	location, _ = url.Parse(resp.Header.Get("Location"))
+	if location.Query().Get("error") != "access_denied" || location.Query().Get("state") != "xyz" {
+		t.Errorf("expected access_denied, got %s", location)
+	}
+
+	// An unverified email address does not link, so a user is created.
+	resp = browser.externalLogin(rp.authorizeURL("openid", ""), "mallory")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the consent page, got %d: %s", resp.StatusCode, readBody(resp))
+	}
+	created, ok := svc.users["57a98d98e4b00679b4a830b1"]
+	if !ok || created.Username != "mallory" || created.Email != "" || created.Password == "" {
+		t.Errorf("unexpected user %+v", created)
+	}
+	// Having no password they know, the user keeps their only identity.
+	if w := api("DELETE", "/customers/"+created.UserID+"/identities/corp", testAdminToken); w.Code != http.StatusConflict {
+		t.Errorf("expected the only identity of a created user to stay, got %d", w.Code)
+	}
+
+	logins := 0
+	for _, entry := range st.entries {
+		if entry.Action == "oidc.login" && entry.Target == testUserID && entry.Outcome == outcomeSuccess {
+			logins++
+		}
+	}
+	if logins != 2 {
+		t.Errorf("expected 2 external logins by eve in the audit log, got %d", logins)
+	}
+}
+
+func TestExternalLoginUnverifiedLocalEmail(t *testing.T) {
+	svc := newStubService()
+	eve := svc.users[testUserID]
+	eve.Email = "eve@example.com"
+	svc.users[testUserID] = eve
+	e, _ := newTestEndpoints(svc)
+	router := MakeHTTPHandler(context.Background(), e, log.NewNopLogger())
+	rp := registerTestClient(t, router)
+	browser := newUpstreamBrowser(t, router, newFakeUpstream())
+
+	// Anyone could have put eve's address on an account, so an account at
+	// the provider having it gets a user of its own.
+	resp := browser.externalLogin(rp.authorizeURL("openid", ""), "eve")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the consent page, got %d: %s", resp.StatusCode, readBody(resp))
+	}
+	created, ok := svc.users["57a98d98e4b00679b4a830b1"]
+	if !ok || created.Email != "eve@example.com" || !created.EmailVerified {
+		t.Errorf("unexpected user %+v", created)
+	}
+	r := adminRequest("GET", "/customers/"+testUserID+"/identities")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if strings.Contains(w.Body.String(), "corp-1") {
+		t.Errorf("expected the account not to be linked to eve: %s", w.Body)
+	}
+}
+
+func TestLinkIdentity(t *testing.T) {
+	svc := newStubService()
+	eve := svc.users[testUserID]
+	eve.Email = "newcomer@example.com"
+	svc.users[testUserID] = eve
+	e, st := newTestEndpoints(svc)
+	router := MakeHTTPHandler(context.Background(), e, log.NewNopLogger())
+	upstream := newFakeUpstream()
+	browser := newUpstreamBrowser(t, router, upstream)
+	token := testAccessToken(testUserID)
+
+	api := func(method, path, bearer string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		r.Header.Set("Authorization", "Bearer "+bearer)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	if w := api("POST", "/customers/"+testUserID+"/identities/corp", testAdminToken); w.Code != http.StatusForbidden {
+		t.Errorf("expected only the user to link accounts, got %d", w.Code)
+	}
+	if w := api("POST", "/customers/"+testUserID+"/identities/other", token); w.Code != http.StatusNotFound {
+		t.Errorf("expected unknown providers not to be found, got %d", w.Code)
+	}
+	w := api("POST", "/customers/"+testUserID+"/identities/corp", token)
+	var link linkResponse
+	json.NewDecoder(w.Body).Decode(&link)
+	if w.Code != http.StatusOK || len(w.Result().Cookies()) != 1 {
+		t.Fatalf("expected a URL and a cookie, got %d", w.Code)
+	}
+	// The browser gets the cookie along with the URL.
+	callbackURL, _ := url.Parse(testIssuer + "/oauth2/callback/")
+	browser.client.Jar.SetCookies(callbackURL, w.Result().Cookies())
+	resp := browser.follow(&http.Response{StatusCode: http.StatusFound, Header: http.Header{"Location": {link.URL}}}, "newcomer")
+	if body := readBody(resp); resp.StatusCode != http.StatusOK || !strings.Contains(body, "Account linked") {
+		t.Fatalf("expected the linked page, got %d: %s", resp.StatusCode, body)
+	}
+	if !svc.users[testUserID].EmailVerified {
+		t.Error("expected the address the provider vouches for to be verified")
+	}
+	if w := api("POST", "/customers/"+testUserID+"/identities/corp", token); w.Code != http.StatusConflict {
+		t.Errorf("expected one account per provider, got %d", w.Code)
+	}
+
+	w = api("GET", "/customers/"+testUserID+"/identities", token)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"subject":"corp-3"`) {
+		t.Errorf("unexpected identities %d: %s", w.Code, w.Body)
+	}
+	if w := api("DELETE", "/customers/"+testUserID+"/identities/corp", testAccessToken("57a98d98e4b00679b4a830b1")); w.Code != http.StatusForbidden {
+		t.Errorf("expected other users not to unlink, got %d", w.Code)
+	}
+	if w := api("DELETE", "/customers/"+testUserID+"/identities/corp", token); w.Code != http.StatusOK {
+		t.Errorf("expected the account to be unlinked, got %d: %s", w.Code, w.Body)
+	}
+	if w := api("DELETE", "/customers/"+testUserID+"/identities/corp", token); w.Code != http.StatusNotFound {
+		t.Errorf("expected nothing left to unlink, got %d", w.Code)
+	}
+
+	actions := map[string]bool{}
+	for _, entry := range st.entries {
+		if entry.Target == testUserID && entry.Outcome == outcomeSuccess {
+			actions[entry.Action] = true
+		}
+	}
+	if !actions["identity.link"] || !actions["identity.unlink"] {
+		t.Errorf("expected the link and unlink in the audit log, got %v", actions)
+	}
+}
+
+func TestParseIdentityProviders(t *testing.T) {
+	providers, err := ParseIdentityProviders([]byte(`[
+		{"name": "corp", "issuer": "https://corp.test", "client_id": "c"},
+		{"name": "github", "title": "GitHub", "client_id": "c", "authorization_endpoint": "https://github.com/login/oauth/authorize",
+		 "token_endpoint": "https://github.com/login/oauth/access_token", "userinfo_endpoint": "https://api.github.com/user"}
+	]`))
+	if err != nil || len(providers) != 2 || providers[1].Title() != "GitHub" || providers[0].Title() != "corp" {
+		t.Errorf("unexpected providers %v: %v", providers, err)
+	}
+	for _, bad := range []string{
+		`[{"name": "a b", "issuer": "https://corp.test", "client_id": "c"}]`,
+		`[{"name": "corp", "issuer": "https://corp.test"}]`,
+		`[{"name": "corp", "client_id": "c", "authorization_endpoint": "https://corp.test/a"}]`,
+		`[{"name": "corp", "issuer": "https://corp.test", "client_id": "c"}, {"name": "corp", "issuer": "https://corp.test", "client_id": "c"}]`,
+	} {
+		if _, err := ParseIdentityProviders([]byte(bad)); err == nil {
+			t.Errorf("expected %s to be refused", bad)
+		}
+	}
+}
+
+func registerTestClient(t *testing.T, router *mux.Router) *relyingParty {
+	rp := &relyingParty{t: t, http: &http.Client{Transport: routerTransport{router}}}
+	rp.getJSON(testIssuer+"/.well-known/openid-configuration", &rp.config)
+	r := adminRequest("POST", "/oauth2/clients")
+	r.Body = httptest.NewRequest("POST", "/", strings.NewReader(`{"client_name": "Shop", "redirect_uris": ["`+testRedirectURI+`"]}`)).Body
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	var registered clientPostResponse
+	json.NewDecoder(w.Body).Decode(&registered)
+	rp.id, rp.secret = registered.ID, registered.Secret
+	return rp
+}
+
+// testAccessToken is an access token of the test provider for a user.
+func testAccessToken(userID string) string {
+	token, err := signJWT(testSigningKey(), jwkFor(&testSigningKey().PublicKey).Kid, jwtTypeAccessToken, accessClaims{
+		Issuer:  testIssuer,
+		Subject: userID,
+		Expiry:  time.Now().Add(time.Minute).Unix(),
+	})
+	if err != nil {
+		panic(err)
+	}
+	return token
+}
+
+func readBody(resp *http.Response) string {
+	var b strings.Builder
+	buf := make([]byte, 4096)
+	for {
+		n, err := resp.Body.Read(buf)
+		b.Write(buf[:n])
+		if err != nil {
+			break
+		}
+	}
+	resp.Body.Close()
+	return b.String()
+}
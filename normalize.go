@@ -0,0 +1,297 @@
+package user
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/user/dbOperations"
+)
+
+// The modes addresses are created in. A tenant's addresses are lenient
+// unless it asks for strict ones.
+const (
+	// AddressLenient stores addresses normalized as far as they can be,
+	// and as they were given where they cannot.
+	AddressLenient = "lenient"
+	// AddressStrict refuses addresses with problems.
+	AddressStrict = "strict"
+)
+
+// AddressModes are the modes addresses can be created in.
+var AddressModes = []string{AddressLenient, AddressStrict}
+
+// countriesJSON lists the ISO 3166 countries, the names they go by, and
+// the rules of the addresses in them.
+//
+//go:embed countries.json
+var countriesJSON []byte
+
+// Country is a country, and what its addresses must look like.
+type Country struct {
+	// Code is the ISO 3166-1 alpha-2 code addresses are stored with.
+	Code    string   `json:"code"`
+	Alpha3  string   `json:"alpha3"`
+	Name    string   `json:"name"`
+	Aliases []string `json:"aliases,omitempty"`
+	// Postcode is the pattern of the country's postcodes, written in
+	// capitals with their separator. Countries without one have no
+	// postcodes, or none checked.
+	Postcode string `json:"postcode,omitempty"`
+	// Split and Separator say where the separator goes in a postcode,
+	// counting from the end if Split is negative.
+	Split     int    `json:"split,omitempty"`
+	Separator string `json:"separator,omitempty"`
+	// Require lists the address fields that must be set, by their JSON
+	// names.
+	Require []string `json:"require"`
+
+	postcode *regexp.Regexp
+}
+
+// countries are the countries by code, and countryNames the codes by the
+// names, codes and aliases of the countries, as countryKey has them.
+var countries, countryNames = loadCountries()
+
+func loadCountries() (map[string]*Country, map[string]string) {
+	var list []*Country
+	if err := json.Unmarshal(countriesJSON, &list); err != nil {
+		panic("countries.json: " + err.Error())
+	}
+	byCode := make(map[string]*Country, len(list))
+	byName := map[string]string{}
+	for _, c := range list {
+		if c.Postcode != "" {
+			c.postcode = regexp.MustCompile("^(?:" + c.Postcode + ")$")
+		}
+		byCode[c.Code] = c
+		for _, name := range append([]string{c.Code, c.Alpha3, c.Name}, c.Aliases...) {
+			byName[countryKey(name)] = c.Code
+		}
+	}
+	return byCode, byName
+}
+
+// countryKey returns the name of a country as it is looked up: in
+// lowercase, without dots and with single spaces.
+func countryKey(name string) string {
+	return strings.Join(strings.Fields(strings.ToLower(strings.Replace(name, ".", "", -1))), " ")
+}
+
+// LookupCountry returns the country an ISO 3166 code or a name of it
+// stands for.
+func LookupCountry(name string) (*Country, bool) {
+	c, ok := countries[countryNames[countryKey(name)]]
+	return c, ok
+}
+
+// AddressProblem is what is wrong with a field of an address, by its JSON
+// name.
+type AddressProblem struct {
+	Field   string `json:"field"`
+	Problem string `json:"problem"`
+}
+
+// AddressError is an address refused for its problems.
+type AddressError []AddressProblem
+
+func (e AddressError) Error() string {
+	problems := make([]string, len(e))
+	for i, p := range e {
+		problems[i] = p.Field + " " + p.Problem
+	}
+	return "Invalid address: " + strings.Join(problems, "; ")
+}
+
+// NormalizeAddress returns a with its whitespace and casing tidied, its
+// country as an ISO 3166 code, its postcode in the country's format, and
+// its house number split off the street when it was written there. Fields
+// that cannot be normalized are kept as they were given, and returned as
+// problems along with the required fields that are missing.
+func NormalizeAddress(a dbOperations.Address) (dbOperations.Address, []AddressProblem) {
+	var problems []AddressProblem
+	for _, f := range []*string{&a.Street, &a.Number, &a.City, &a.PostCode, &a.Country, &a.ExtraInfo} {
+		*f = strings.Join(strings.Fields(*f), " ")
+	}
+	if a.Number == "" {
+		a.Street, a.Number = splitHouseNumber(a.Street)
+	}
+	a.Street, a.City = fixCase(a.Street), fixCase(a.City)
+	c, ok := LookupCountry(a.Country)
+	switch {
+	case a.Country == "":
+		problems = append(problems, AddressProblem{"country", "is required"})
+	case !ok:
+		problems = append(problems, AddressProblem{"country", "is not a known country"})
+	default:
+		a.Country = c.Code
+		if a.PostCode != "" && c.postcode != nil {
+			if postcode, ok := c.normalizePostcode(a.PostCode); ok {
+				a.PostCode = postcode
+			} else {
+				problems = append(problems, AddressProblem{"postcode", "is not a valid postcode of " + c.Name})
+			}
+		}
+	}
+	fields := map[string]string{"street": a.Street, "number": a.Number, "city": a.City, "postcode": a.PostCode}
+	if ok {
+		for _, f := range c.Require {
+			if fields[f] == "" {
+				problems = append(problems, AddressProblem{f, "is required in " + c.Name})
+			}
+		}
+	}
+	return a, problems
+}
+
+// normalizePostcode returns postcode in the format of c, and whether it
+// is one of c's. The code of c may lead it, as in "CH-8001".
+func (c *Country) normalizePostcode(postcode string) (string, bool) {
+	compact := strings.NewReplacer(" ", "", "-", "").Replace(strings.ToUpper(postcode))
+	for _, p := range []string{compact, strings.TrimPrefix(compact, c.Code)} {
+		at := c.Split
+		if at < 0 {
+			at += len(p)
+		}
+		if c.Separator != "" && at > 0 && at < len(p) {
+			p = p[:at] + c.Separator + p[at:]
+		}
+		if c.postcode.MatchString(p) {
+			return p, true
+		}
+	}
+	return postcode, false
+}
+
+// houseNumber matches a house number such as 12, 12a, 12-14 or 3/1.
+const houseNumber = `\d+[[:alpha:]]?(?:[-/]\d+[[:alpha:]]?)?`
+
+var (
+	leadingNumber  = regexp.MustCompile(`^(` + houseNumber + `),? (.+)$`)
+	trailingNumber = regexp.MustCompile(`^(.+?),? (` + houseNumber + `)$`)
+)
+
+// splitHouseNumber returns the street and house number of a street
+// written with its number before it, as in "221B Baker Street", or after
+// it, as in "Hauptstrasse 5".
+func splitHouseNumber(street string) (string, string) {
+	if m := leadingNumber.FindStringSubmatch(street); m != nil {
+		return m[2], m[1]
+	}
+	if m := trailingNumber.FindStringSubmatch(street); m != nil {
+		return m[1], m[2]
+	}
+	return street, ""
+}
+
+// lowerWords are the words of street and place names that stay in
+// lowercase unless they come first.
+var lowerWords = map[string]bool{
+	"de": true, "del": true, "der": true, "des": true, "di": true, "du": true,
+	"la": true, "le": true, "les": true, "van": true, "von": true, "am": true,
+	"an": true, "im": true, "of": true, "the": true, "and": true, "sur": true,
+}
+
+// fixCase capitalizes the words of s, and their parts after a hyphen or
+// a leading elision as in "O'Connell", if it is written all in lowercase or
+// all in capitals. Names in mixed case are left as they are written.
+func fixCase(s string) string {
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return s
+	}
+	words := strings.Split(strings.ToLower(s), " ")
+	for i, w := range words {
+		if i > 0 && lowerWords[w] {
+			continue
+		}
+		r := []rune(w)
+		start := true
+		for j := range r {
+			if start {
+				r[j] = unicode.ToUpper(r[j])
+			}
+			start = r[j] == '-' || (j == 1 && r[j] == '\'')
+		}
+		words[i] = string(r)
+	}
+	return strings.Join(words, " ")
+}
+
+// NormalizingStore normalizes the addresses created through it, and in
+// strict mode refuses those with problems as an AddressError. It stores
+// the phone numbers of the users created and updated through it in E.164,
+// and refuses those it cannot parse.
+type NormalizingStore struct {
+	UserStore
+	strict bool
+	region string
+}
+
+// NewNormalizingStore normalizes what is created in st as the tenant t
+// asks: its addresses strictly if its AddressValidation is AddressStrict,
+// and its phone numbers as national ones of its PhoneRegion unless they
+// are international.
+func NewNormalizingStore(st UserStore, t dbOperations.Tenant) *NormalizingStore {
+	return &NormalizingStore{UserStore: st, strict: t.AddressValidation == AddressStrict, region: t.PhoneRegion}
+}
+
+func (s *NormalizingStore) CreateUser(u *dbOperations.User) error {
+	if u.Phone != "" {
+		phone, err := ParsePhone(u.Phone, s.region)
+		if err != nil {
+			return err
+		}
+		u.Phone = phone
+	}
+	return s.UserStore.CreateUser(u)
+}
+
+// UpdateUser stores a changed phone number of u in E.164, leaving one kept
+// as it was alone even if it was stored before numbers were parsed.
+func (s *NormalizingStore) UpdateUser(u *dbOperations.User, version int64) error {
+	if u.Phone != "" {
+		cur, err := s.UserStore.GetUser(u.UserID)
+		if err != nil {
+			return err
+		}
+		if u.Phone != cur.Phone {
+			phone, err := ParsePhone(u.Phone, s.region)
+			if err != nil {
+				return err
+			}
+			u.Phone = phone
+		}
+	}
+	return s.UserStore.UpdateUser(u, version)
+}
+
+func (s *NormalizingStore) CreateAddress(a *dbOperations.Address, userid string) error {
+	normalized, problems := NormalizeAddress(*a)
+	if s.strict && len(problems) > 0 {
+		return AddressError(problems)
+	}
+	*a = normalized
+	return s.UserStore.CreateAddress(a, userid)
+}
+
+// MakeAddressValidateEndpoint returns an endpoint checking an address
+// without storing it, and suggesting it normalized.
+func MakeAddressValidateEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		a, problems := NormalizeAddress(request.(dbOperations.Address))
+		if problems == nil {
+			problems = []AddressProblem{}
+		}
+		return addressValidation{Valid: len(problems) == 0, Address: a, Problems: problems}, nil
+	}
+}
+
+type addressValidation struct {
+	Valid    bool                 `json:"valid"`
+	Address  dbOperations.Address `json:"address"`
+	Problems []AddressProblem     `json:"problems"`
+}
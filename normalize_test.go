@@ -0,0 +1,141 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/user/dbOperations"
+)
+
+func TestLookupCountry(t *testing.T) {
+	for name, code := range map[string]string{
+		"GB": "GB", "gbr": "GB", "UK": "GB", "U.K.": "GB", "United  Kingdom": "GB",
+		"Germany": "DE", "deutschland": "DE", "USA": "US", "Czechia": "CZ",
+		"Czech Republic": "CZ", "Schweiz": "CH",
+	} {
+		if c, ok := LookupCountry(name); !ok || c.Code != code {
+			t.Errorf("%s: expected %s, got %+v", name, code, c)
+		}
+	}
+	if c, ok := LookupCountry("Atlantis"); ok {
+		t.Errorf("expected no country, got %+v", c)
+	}
+}
+
+func TestNormalizeAddress(t *testing.T) {
+	for _, c := range []struct {
+		in, want dbOperations.Address
+		problems []string
+	}{
+		{
+			dbOperations.Address{Street: "221b  baker street", City: "LONDON", PostCode: "nw16xe", Country: "United Kingdom"},
+			dbOperations.Address{Street: "Baker Street", Number: "221b", City: "London", PostCode: "NW1 6XE", Country: "GB"},
+			nil,
+		},
+		{
+			dbOperations.Address{Street: "Hauptstraße 5a", City: "Frankfurt am Main", PostCode: "D-60311", Country: "deutschland"},
+			dbOperations.Address{Street: "Hauptstraße", Number: "5a", City: "Frankfurt am Main", PostCode: "D-60311", Country: "DE"},
+			[]string{"postcode"},
+		},
+		{
+			dbOperations.Address{Street: "Bahnhofstrasse", Number: "1", City: "zürich", PostCode: "CH-8001", Country: "CH"},
+			dbOperations.Address{Street: "Bahnhofstrasse", Number: "1", City: "Zürich", PostCode: "8001", Country: "CH"},
+			nil,
+		},
+		{
+			dbOperations.Address{Street: "1600 Amphitheatre Pkwy", City: "Mountain View", PostCode: "940431351", Country: "USA"},
+			dbOperations.Address{Street: "Amphitheatre Pkwy", Number: "1600", City: "Mountain View", PostCode: "94043-1351", Country: "US"},
+			nil,
+		},
+		{
+			dbOperations.Address{Street: "o'connell street upper", City: "dublin", Country: "IE"},
+			dbOperations.Address{Street: "O'Connell Street Upper", City: "Dublin", Country: "IE"},
+			nil,
+		},
+		{
+			dbOperations.Address{City: "Amsterdam", PostCode: "1012 jS", Country: "Holland"},
+			dbOperations.Address{City: "Amsterdam", PostCode: "1012 JS", Country: "NL"},
+			[]string{"street"},
+		},
+		{
+			dbOperations.Address{Street: "Main St", City: "Springfield", Country: "Atlantis"},
+			dbOperations.Address{Street: "Main St", City: "Springfield", Country: "Atlantis"},
+			[]string{"country"},
+		},
+	} {
+		got, problems := NormalizeAddress(c.in)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%+v: expected %+v, got %+v", c.in, c.want, got)
+		}
+		var fields []string
+		for _, p := range problems {
+			fields = append(fields, p.Field)
+		}
+		if strings.Join(fields, ",") != strings.Join(c.problems, ",") {
+			t.Errorf("%+v: expected problems with %v, got %+v", c.in, c.problems, problems)
+		}
+	}
+}
+
+func TestNormalizingStore(t *testing.T) {
+	st := newCountingStore()
+	u := dbOperations.User{Username: "eve"}
+	st.CreateUser(&u)
+	invalid := dbOperations.Address{Street: "Main St 1", City: "Bern", PostCode: "12", Country: "Switzerland"}
+
+	a := invalid
+	if err := NewNormalizingStore(st, dbOperations.Tenant{}).CreateAddress(&a, u.UserID); err != nil {
+		t.Fatal(err)
+	}
+	if stored := st.addresses[a.ID]; stored.Country != "CH" || stored.Number != "1" || stored.PostCode != "12" {
+		t.Errorf("expected the address to be stored as far as it was normalized, got %+v", stored)
+	}
+
+	a = invalid
+	err := NewNormalizingStore(st, dbOperations.Tenant{AddressValidation: AddressStrict}).CreateAddress(&a, u.UserID)
+	if problems, ok := err.(AddressError); !ok || len(problems) != 1 || problems[0].Field != "postcode" {
+		t.Errorf("expected the postcode to be refused, got %v", err)
+	}
+	if len(st.addresses) != 1 {
+		t.Errorf("expected the refused address not to be stored, got %+v", st.addresses)
+	}
+}
+
+func TestAddressValidateEndpoint(t *testing.T) {
+	router := newTestRouter()
+	do := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/addresses/validate", strings.NewReader(body)))
+		return w
+	}
+	w := do(`{"street": "10 downing street", "city": "London", "postcode": "sw1a2aa", "country": "UK"}`)
+	var resp addressValidation
+	json.NewDecoder(w.Body).Decode(&resp)
+	if w.Code != http.StatusOK || !resp.Valid || resp.Address.PostCode != "SW1A 2AA" || resp.Address.Number != "10" {
+		t.Errorf("expected a valid normalized address, got %d: %+v", w.Code, resp)
+	}
+	w = do(`{"street": "Main St", "postcode": "ABC", "country": "US"}`)
+	resp = addressValidation{}
+	json.NewDecoder(w.Body).Decode(&resp)
+	if resp.Valid || len(resp.Problems) != 2 {
+		t.Errorf("expected the postcode and city to be wrong, got %+v", resp)
+	}
+	if w := do(`{`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected malformed requests to be refused, got %d", w.Code)
+	}
+
+	e, _ := newTestEndpoints(newStubService())
+	e.AddressPostEndpoint = MakeAddressPostEndpoint(NewUserService(NewNormalizingStore(newCountingStore(), dbOperations.Tenant{AddressValidation: AddressStrict}), log.NewNopLogger()))
+	w = httptest.NewRecorder()
+	body := `{"userID": "` + testUserID + `", "street": "Main St", "country": "US"}`
+	MakeHTTPHandler(context.Background(), e, log.NewNopLogger()).ServeHTTP(w, httptest.NewRequest("POST", "/addresses", strings.NewReader(body)))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "city is required") {
+		t.Errorf("expected strict tenants to refuse invalid addresses, got %d: %s", w.Code, w.Body)
+	}
+}
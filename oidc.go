@@ -0,0 +1,951 @@
+package user
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/base64"
+	"encoding/hex"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/user/dbOperations"
+	mgo "gopkg.in/mgo.v2"
+)
+
+const (
+	// oidcCodeTTL is how long an authorization code can be exchanged.
+	oidcCodeTTL = time.Minute
+	// oidcLoginTTL is how long a user who has logged in has to consent.
+	oidcLoginTTL = 10 * time.Minute
+	// oidcTokenTTL is how long access and ID tokens are valid, unless the
+	// tenant says otherwise.
+	oidcTokenTTL = time.Hour
+)
+
+// Client authentication methods at the token endpoint.
+const (
+	authMethodNone  = "none"
+	authMethodBasic = "client_secret_basic"
+	authMethodPost  = "client_secret_post"
+)
+
+// Every authorization request must ask for the openid scope and a code,
+// and use PKCE with the S256 method.
+const (
+	scopeOpenID      = "openid"
+	challengeMethod  = "S256"
+	responseTypeCode = "code"
+)
+
+// oidcScopes are the supported scopes, in the order the consent screen
+// lists them, with how they are described there.
+var oidcScopes = []struct{ Name, Description string }{
+	{scopeOpenID, "Sign you in with your account"},
+	{"profile", "Your name, username, language and time zone"},
+	{"email", "Your email address"},
+	{"phone", "Your phone number"},
+	{"address", "Your postal address"},
+}
+
+// oidcTemplates are the default login, consent, linked and error pages.
+// They can be replaced through OIDCProvider.Templates, by templates
+// defining the same names.
+//
+//go:embed oidc.html
+var oidcTemplates string
+
+// OIDCStore keeps relying parties and their grants. *dbOperations.Mongo
+// implements it.
+type OIDCStore interface {
+	CreateOAuthClient(cl *dbOperations.OAuthClient) error
+	GetOAuthClients() ([]dbOperations.OAuthClient, error)
+	GetOAuthClient(id string) (dbOperations.OAuthClient, error)
+	DeleteOAuthClient(id string) error
+	CreateAuthCode(code *dbOperations.AuthCode) error
+	ConsumeAuthCode(hash string) (dbOperations.AuthCode, error)
+	GetConsent(userID, clientID string) (dbOperations.Consent, error)
+	SaveConsent(c dbOperations.Consent) error
+	GetAddressesForUser(userid string) ([]dbOperations.Address, error)
+	GetErasures(userid string) ([]dbOperations.Erasure, error)
+	// Users sign in only once they accepted the mandatory policies.
+	AcceptanceStore
+}
+
+// OIDCProvider is an OpenID Connect provider for the users of the
+// service. It implements the authorization code flow with PKCE, signing
+// ID and access tokens with Key.
+type OIDCProvider struct {
+	Issuer    string
+	Key       *rsa.PrivateKey
+	Templates *template.Template
+	// Tenant is the tenant whose users the provider signs in. It is put
+	// in the tokens, and tokens of other tenants are refused. It is empty
+	// for the default tenant, so tokens issued before there were tenants
+	// stay valid.
+	Tenant string
+	// TokenTTL is how long access and ID tokens are valid, oidcTokenTTL
+	// if 0.
+	TokenTTL  time.Duration
+	s         Service
+	st        OIDCStore
+	jwk       jsonWebKey
+	upstreams []IdentityProvider
+}
+
+// NewOIDCProvider returns a provider identifying itself as issuer, the
+// URL the service is reached at, with the default templates.
+func NewOIDCProvider(issuer string, key *rsa.PrivateKey, s Service, st OIDCStore) *OIDCProvider {
+	return &OIDCProvider{
+		Issuer:    strings.TrimSuffix(issuer, "/"),
+		Key:       key,
+		Templates: template.Must(template.New("oidc").Parse(oidcTemplates)),
+		s:         s,
+		st:        st,
+		jwk:       jwkFor(&key.PublicKey),
+	}
+}
+
+// OIDCEndpoints mounts the OpenID Connect endpoints, and the admin-only
+// endpoints registering relying parties.
+func OIDCEndpoints(e Endpoints, p *OIDCProvider) Endpoints {
+	admin := RequireRole(RoleAdmin)
+	e.OIDCDiscoveryEndpoint = p.makeDiscoveryEndpoint()
+	e.OIDCKeysEndpoint = p.makeKeysEndpoint()
+	e.OIDCAuthorizeEndpoint = p.makeAuthorizeEndpoint()
+	e.OIDCLoginEndpoint = p.makeLoginEndpoint()
+	e.OIDCTokenEndpoint = p.makeTokenEndpoint()
+	e.OIDCUserInfoEndpoint = p.makeUserInfoEndpoint()
+	e.OIDCClientPostEndpoint = admin(p.makeClientPostEndpoint())
+	e.OIDCClientsGetEndpoint = admin(p.makeClientsGetEndpoint())
+	e.OIDCClientDeleteEndpoint = admin(p.makeClientDeleteEndpoint())
+	return e
+}
+
+// Authenticate implements Authenticator for the access tokens the
+// provider issues, so relying parties can call the API on behalf of the
+// user. Other bearer tokens are left to the next Authenticator.
+func (p *OIDCProvider) Authenticate(authorization string) (Principal, bool, error) {
+	token, ok := credentials(authorization, "Bearer")
+	if !ok || strings.Count(token, ".") != 2 {
+		return Principal{}, false, nil
+	}
+	claims, err := p.verifyAccessToken(token)
+	if err != nil {
+		return Principal{}, false, ErrUnauthorized
+	}
+	if err := p.refuseErased(claims.Subject); err != nil {
+		return Principal{}, false, err
+	}
+	// The token lets its user act on their own records only.
+	return Principal{ID: claims.Subject, User: claims.Subject, Scopes: apiKeyScopes}, true, nil
+}
+
+// oauthError is an OAuth 2.0 error (RFC 6749 section 5.2). Errors in the
+// authorization flow are sent back to the client at redirectURI when it
+// is known to be the client's, and shown on page otherwise.
+type oauthError struct {
+	Status      int
+	Code        string
+	Description string
+	redirectURI string
+	state       string
+	issuer      string
+	page        *oidcPage
+}
+
+func (e oauthError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+// oidcPage is an HTML page of the authorization flow.
+type oidcPage struct {
+	tmpl   *template.Template
+	name   string
+	status int
+	data   interface{}
+	userID string
+}
+
+// oidcRedirect sends the browser back to the client, or on to an
+// identity provider with a cookie to come back with.
+type oidcRedirect struct {
+	URL    string
+	userID string
+	cookie *http.Cookie
+}
+
+// authorizePage is what the login and consent templates are given.
+type authorizePage struct {
+	Action   string
+	Client   string
+	Scopes   []string
+	Params   []oidcParam
+	Username string
+	Ticket   string
+	Error    string
+	External []externalOption
+	// Policies are the mandatory policy versions the user is yet to
+	// accept, listed on the consent page.
+	Policies []dbOperations.Policy
+}
+
+type oidcParam struct {
+	Name, Value string
+}
+
+// errorPage is what the error template is given.
+type errorPage struct {
+	Code        string
+	Description string
+}
+
+func (p *OIDCProvider) page(name string, status int, data interface{}) *oidcPage {
+	return &oidcPage{tmpl: p.Templates, name: name, status: status, data: data}
+}
+
+// pageError is an error shown to the user, for requests that cannot be
+// sent back to the client.
+func (p *OIDCProvider) pageError(code, description string) oauthError {
+	return oauthError{
+		Status:      http.StatusBadRequest,
+		Code:        code,
+		Description: description,
+		page:        p.page("error", http.StatusBadRequest, errorPage{code, description}),
+	}
+}
+
+// redirectError is an error sent back to the client.
+func (p *OIDCProvider) redirectError(req authorizeRequest, code, description string) oauthError {
+	return oauthError{
+		Status:      http.StatusFound,
+		Code:        code,
+		Description: description,
+		redirectURI: req.RedirectURI,
+		state:       req.State,
+		issuer:      p.Issuer,
+	}
+}
+
+// validate checks an authorization request and returns the client and
+// the scopes it asks for that are supported.
+func (p *OIDCProvider) validate(req authorizeRequest) (dbOperations.OAuthClient, []string, error) {
+	client, err := p.st.GetOAuthClient(req.ClientID)
+	if err == mgo.ErrNotFound || err == dbOperations.ErrInvalidHexID {
+		return client, nil, p.pageError("invalid_client", "The application is not registered.")
+	}
+	if err != nil {
+		return client, nil, err
+	}
+	if req.RedirectURI == "" || !contains(client.RedirectURIs, req.RedirectURI) {
+		return client, nil, p.pageError("invalid_request", "The redirect URI is not registered for the application.")
+	}
+	if req.ResponseType != responseTypeCode {
+		return client, nil, p.redirectError(req, "unsupported_response_type", "Only the code response type is supported.")
+	}
+	var scopes []string
+	for _, s := range oidcScopes {
+		if contains(strings.Fields(req.Scope), s.Name) {
+			scopes = append(scopes, s.Name)
+		}
+	}
+	if !contains(scopes, scopeOpenID) {
+		return client, nil, p.redirectError(req, "invalid_scope", "The openid scope is required.")
+	}
+	if req.CodeChallenge == "" || req.CodeChallengeMethod != challengeMethod {
+		return client, nil, p.redirectError(req, "invalid_request", "PKCE with the S256 method is required.")
+	}
+	if contains(strings.Fields(req.Prompt), "none") {
+		return client, nil, p.redirectError(req, "login_required", "The user must log in.")
+	}
+	return client, scopes, nil
+}
+
+func (p *OIDCProvider) authorizePage(client dbOperations.OAuthClient, scopes []string, req authorizeRequest) authorizePage {
+	page := authorizePage{
+		Action:   p.Issuer + "/oauth2/authorize",
+		Client:   client.Name,
+		Username: req.Username,
+	}
+	for _, name := range authorizeParams {
+		page.Params = append(page.Params, oidcParam{name, req.params().Get(name)})
+	}
+	for _, s := range oidcScopes {
+		if contains(scopes, s.Name) {
+			page.Scopes = append(page.Scopes, s.Description)
+		}
+	}
+	for _, ip := range p.upstreams {
+		page.External = append(page.External, externalOption{
+			Action: p.Issuer + "/oauth2/external/" + ip.Name(),
+			Title:  ip.Title(),
+		})
+	}
+	return page
+}
+
+// makeAuthorizeEndpoint returns the endpoint starting the authorization
+// flow, which asks the user to log in.
+func (p *OIDCProvider) makeAuthorizeEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(authorizeRequest)
+		client, scopes, err := p.validate(req)
+		if err != nil {
+			return nil, err
+		}
+		return p.page("login", http.StatusOK, p.authorizePage(client, scopes, req)), nil
+	}
+}
+
+// makeLoginEndpoint returns the endpoint the login and consent forms are
+// posted to.
+func (p *OIDCProvider) makeLoginEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(authorizeRequest)
+		client, scopes, err := p.validate(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if req.Ticket == "" {
+			u, err := p.login(req.Username, req.Password)
+			if err == ErrUnauthorized {
+				page := p.authorizePage(client, scopes, req)
+				page.Error = "The username or password is wrong."
+				return nil, oauthError{
+					Status:      http.StatusUnauthorized,
+					Code:        "access_denied",
+					Description: "login failed",
+					page:        p.page("login", http.StatusUnauthorized, page),
+				}
+			}
+			if err != nil {
+				return nil, err
+			}
+			return p.loggedIn(client, scopes, req, u.UserID)
+		}
+
+		var ticket loginTicket
+		err = verifyJWT(&p.Key.PublicKey, jwtTypeLogin, req.Ticket, &ticket)
+		if err != nil || ticket.Issuer != p.Issuer || ticket.Audience != client.ID || time.Now().Unix() > ticket.Expiry {
+			return nil, p.pageError("invalid_request", "The login has expired. Please start again from the application.")
+		}
+		if req.Decision != "allow" {
+			// The response only tells the audit log who refused.
+			return oidcRedirect{userID: ticket.Subject}, p.redirectError(req, "access_denied", "The user denied the request.")
+		}
+		err = checkLoginConsent(ctx, p.st, ticket.Subject, req.Accept, actorFor(ctx, request))
+		if missing, ok := err.(ConsentRequiredError); ok {
+			page := p.authorizePage(client, scopes, req)
+			page.Ticket = req.Ticket
+			page.Policies = missing.Policies
+			page.Error = "Accept the policies to continue."
+			consentPage := p.page("consent", http.StatusForbidden, page)
+			consentPage.userID = ticket.Subject
+			return consentPage, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		err = p.st.SaveConsent(dbOperations.Consent{
+			UserID:    ticket.Subject,
+			ClientID:  client.ID,
+			Scope:     scopes,
+			GrantedAt: time.Now().UTC(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return p.issueCode(client, scopes, req, ticket)
+	}
+}
+
+// loggedIn continues the authorization flow of a user who has just logged
+// in. Users who already consented to the scopes, and accepted the
+// mandatory policies, are sent back to the client; others are asked for
+// consent, carrying a signed login ticket instead of their password.
+func (p *OIDCProvider) loggedIn(client dbOperations.OAuthClient, scopes []string, req authorizeRequest, userID string) (interface{}, error) {
+	now := time.Now()
+	ticket := loginTicket{
+		Issuer:   p.Issuer,
+		Subject:  userID,
+		Audience: client.ID,
+		AuthTime: now.Unix(),
+		Expiry:   now.Add(oidcLoginTTL).Unix(),
+	}
+	consent, err := p.st.GetConsent(userID, client.ID)
+	if err != nil && err != mgo.ErrNotFound {
+		return nil, err
+	}
+	policies, err := p.st.GetPolicies()
+	if err != nil {
+		return nil, err
+	}
+	acceptances, err := p.st.GetAcceptances(userID)
+	if err != nil {
+		return nil, err
+	}
+	missing := requiredPolicies(policies, acceptances)
+	if len(missing) == 0 && covers(consent.Scope, scopes) && !contains(strings.Fields(req.Prompt), "consent") {
+		return p.issueCode(client, scopes, req, ticket)
+	}
+	page := p.authorizePage(client, scopes, req)
+	page.Policies = missing
+	if page.Ticket, err = signJWT(p.Key, p.jwk.Kid, jwtTypeLogin, ticket); err != nil {
+		return nil, err
+	}
+	consentPage := p.page("consent", http.StatusOK, page)
+	consentPage.userID = userID
+	return consentPage, nil
+}
+
+// issueCode sends the user of ticket back to the client with an
+// authorization code.
+func (p *OIDCProvider) issueCode(client dbOperations.OAuthClient, scopes []string, req authorizeRequest, ticket loginTicket) (interface{}, error) {
+	code, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	err = p.st.CreateAuthCode(&dbOperations.AuthCode{
+		Hash:            hashToken(code),
+		ClientID:        client.ID,
+		UserID:          ticket.Subject,
+		RedirectURI:     req.RedirectURI,
+		Scope:           scopes,
+		Nonce:           req.Nonce,
+		Challenge:       req.CodeChallenge,
+		ChallengeMethod: req.CodeChallengeMethod,
+		AuthTime:        time.Unix(ticket.AuthTime, 0).UTC(),
+		ExpiresAt:       time.Now().Add(oidcCodeTTL).UTC(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return oidcRedirect{
+		URL:    withQuery(req.RedirectURI, url.Values{"code": {code}, "state": {req.State}, "iss": {p.Issuer}}),
+		userID: ticket.Subject,
+	}, nil
+}
+
+// login checks a user's password, refusing users with a pending erasure
+// as the login endpoint does.
+func (p *OIDCProvider) login(username, password string) (dbOperations.User, error) {
+	u, err := p.s.Login(username, password)
+	if err == mgo.ErrNotFound {
+		err = ErrUnauthorized
+	}
+	if err != nil {
+		return u, err
+	}
+	return u, p.refuseErased(u.UserID)
+}
+
+// refuseErased fails with ErrUnauthorized for a user about to be erased
+// or erased already, so the tokens issued to them are revoked with it.
+func (p *OIDCProvider) refuseErased(userID string) error {
+	erasures, err := p.st.GetErasures(userID)
+	if err != nil {
+		return err
+	}
+	if len(erasures) > 0 && erasures[0].Status != dbOperations.ErasureCancelled {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+// location is where the error is sent back to the client.
+func (e oauthError) location() string {
+	q := url.Values{"error": {e.Code}, "error_description": {e.Description}, "iss": {e.issuer}}
+	if e.state != "" {
+		q.Set("state", e.state)
+	}
+	return withQuery(e.redirectURI, q)
+}
+
+// makeTokenEndpoint returns the endpoint exchanging authorization codes
+// for tokens.
+func (p *OIDCProvider) makeTokenEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(tokenRequest)
+		if req.GrantType != "authorization_code" {
+			return nil, oauthError{Status: http.StatusBadRequest, Code: "unsupported_grant_type", Description: "Only the authorization_code grant is supported."}
+		}
+		client, err := p.authenticateClient(req)
+		if err != nil {
+			return nil, err
+		}
+		invalidGrant := oauthError{Status: http.StatusBadRequest, Code: "invalid_grant", Description: "The code is invalid or expired."}
+		code, err := p.st.ConsumeAuthCode(hashToken(req.Code))
+		if err == mgo.ErrNotFound {
+			return nil, invalidGrant
+		}
+		if err != nil {
+			return nil, err
+		}
+		challenge := sha256.Sum256([]byte(req.CodeVerifier))
+		if code.ClientID != client.ID || code.RedirectURI != req.RedirectURI || time.Now().After(code.ExpiresAt) ||
+			base64.RawURLEncoding.EncodeToString(challenge[:]) != code.Challenge {
+			return nil, invalidGrant
+		}
+		u, err := p.userWithAddresses(code.UserID)
+		if err == mgo.ErrNotFound {
+			return nil, invalidGrant
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		now := time.Now()
+		jti, err := randomToken()
+		if err != nil {
+			return nil, err
+		}
+		access, err := signJWT(p.Key, p.jwk.Kid, jwtTypeAccessToken, accessClaims{
+			Issuer:   p.Issuer,
+			Subject:  u.UserID,
+			Audience: client.ID,
+			ClientID: client.ID,
+			Scope:    strings.Join(code.Scope, " "),
+			IssuedAt: now.Unix(),
+			Expiry:   now.Add(p.tokenTTL()).Unix(),
+			ID:       jti,
+			Tenant:   p.Tenant,
+		})
+		if err != nil {
+			return nil, err
+		}
+		claims := userClaims(u, code.Scope)
+		claims["iss"] = p.Issuer
+		claims["aud"] = client.ID
+		claims["azp"] = client.ID
+		claims["iat"] = now.Unix()
+		claims["exp"] = now.Add(p.tokenTTL()).Unix()
+		if p.Tenant != "" {
+			claims["tenant"] = p.Tenant
+		}
+		claims["auth_time"] = code.AuthTime.Unix()
+		claims["at_hash"] = halfHash(access)
+		if code.Nonce != "" {
+			claims["nonce"] = code.Nonce
+		}
+		id, err := signJWT(p.Key, p.jwk.Kid, jwtTypeIDToken, claims)
+		if err != nil {
+			return nil, err
+		}
+		return tokenResponse{
+			AccessToken: access,
+			TokenType:   "Bearer",
+			ExpiresIn:   int(p.tokenTTL() / time.Second),
+			IDToken:     id,
+			Scope:       strings.Join(code.Scope, " "),
+		}, nil
+	}
+}
+
+// authenticateClient checks the credentials a client sent to the token
+// endpoint. Public clients only send their id.
+func (p *OIDCProvider) authenticateClient(req tokenRequest) (dbOperations.OAuthClient, error) {
+	invalidClient := oauthError{Status: http.StatusUnauthorized, Code: "invalid_client", Description: "Client authentication failed."}
+	client, err := p.st.GetOAuthClient(req.ClientID)
+	if err == mgo.ErrNotFound || err == dbOperations.ErrInvalidHexID {
+		return client, invalidClient
+	}
+	if err != nil {
+		return client, err
+	}
+	if client.AuthMethod == authMethodNone {
+		return client, nil
+	}
+	if req.ClientSecret == "" || subtle.ConstantTimeCompare([]byte(hashToken(req.ClientSecret)), []byte(client.SecretHash)) != 1 {
+		return client, invalidClient
+	}
+	return client, nil
+}
+
+// makeUserInfoEndpoint returns the endpoint answering the claims an
+// access token's scopes grant about its user.
+func (p *OIDCProvider) makeUserInfoEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		invalidToken := oauthError{Status: http.StatusUnauthorized, Code: "invalid_token", Description: "The access token is invalid or expired."}
+		claims, err := p.verifyAccessToken(request.(userInfoRequest).Token)
+		if err != nil {
+			return nil, invalidToken
+		}
+		err = p.refuseErased(claims.Subject)
+		if err == ErrUnauthorized {
+			return nil, invalidToken
+		}
+		if err != nil {
+			return nil, err
+		}
+		u, err := p.userWithAddresses(claims.Subject)
+		if err == mgo.ErrNotFound {
+			return nil, invalidToken
+		}
+		if err != nil {
+			return nil, err
+		}
+		return userClaims(u, strings.Fields(claims.Scope)), nil
+	}
+}
+
+func (p *OIDCProvider) verifyAccessToken(token string) (accessClaims, error) {
+	var claims accessClaims
+	if err := verifyJWT(&p.Key.PublicKey, jwtTypeAccessToken, token, &claims); err != nil {
+		return claims, err
+	}
+	if claims.Issuer != p.Issuer || claims.Tenant != p.Tenant || time.Now().Unix() > claims.Expiry {
+		return claims, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+func (p *OIDCProvider) tokenTTL() time.Duration {
+	if p.TokenTTL > 0 {
+		return p.TokenTTL
+	}
+	return oidcTokenTTL
+}
+
+func (p *OIDCProvider) userWithAddresses(id string) (dbOperations.User, error) {
+	u, err := p.s.GetUser(id)
+	if err != nil {
+		return u, err
+	}
+	u.Addresses, err = p.st.GetAddressesForUser(id)
+	return u, err
+}
+
+// userClaims returns the standard claims about u that scopes grant.
+func userClaims(u dbOperations.User, scopes []string) map[string]interface{} {
+	claims := map[string]interface{}{"sub": u.UserID}
+	set := func(name, value string) {
+		if value != "" {
+			claims[name] = value
+		}
+	}
+	if contains(scopes, "profile") {
+		set("name", strings.TrimSpace(u.FirstName+" "+u.LastName))
+		set("given_name", u.FirstName)
+		set("family_name", u.LastName)
+		set("preferred_username", u.Username)
+		set("locale", u.Preferences.Locale)
+		set("zoneinfo", u.Preferences.Timezone)
+	}
+	if contains(scopes, "email") && u.Email != "" {
+		claims["email"] = u.Email
+		claims["email_verified"] = u.EmailVerified
+	}
+	if contains(scopes, "phone") && u.Phone != "" {
+		claims["phone_number"] = u.Phone
+		claims["phone_number_verified"] = u.PhoneVerified
+	}
+	if contains(scopes, "address") && len(u.Addresses) > 0 {
+		a := u.Addresses[0]
+		claims["address"] = addressClaim{
+			StreetAddress: strings.TrimSpace(a.Number + " " + a.Street),
+			Locality:      a.City,
+			PostalCode:    a.PostCode,
+			Country:       a.Country,
+		}
+	}
+	return claims
+}
+
+func (p *OIDCProvider) makeDiscoveryEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		var scopes []string
+		for _, s := range oidcScopes {
+			scopes = append(scopes, s.Name)
+		}
+		return discoveryResponse{
+			Issuer:                 p.Issuer,
+			AuthorizationEndpoint:  p.Issuer + "/oauth2/authorize",
+			TokenEndpoint:          p.Issuer + "/oauth2/token",
+			UserInfoEndpoint:       p.Issuer + "/oauth2/userinfo",
+			JWKSURI:                p.Issuer + "/oauth2/jwks",
+			ScopesSupported:        scopes,
+			ResponseTypesSupported: []string{responseTypeCode},
+			GrantTypesSupported:    []string{"authorization_code"},
+			SubjectTypesSupported:  []string{"public"},
+			SigningAlgsSupported:   []string{"RS256"},
+			AuthMethodsSupported:   []string{authMethodBasic, authMethodPost, authMethodNone},
+			ChallengeMethods:       []string{challengeMethod},
+			ClaimsSupported: []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "at_hash", "azp",
+				"name", "given_name", "family_name", "preferred_username", "locale", "zoneinfo", "email", "email_verified",
+				"phone_number", "phone_number_verified", "address"},
+			IssuerParameterSupported: true,
+		}, nil
+	}
+}
+
+func (p *OIDCProvider) makeKeysEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		return jwksResponse{Keys: []jsonWebKey{p.jwk}}, nil
+	}
+}
+
+// makeClientPostEndpoint returns an endpoint registering a relying party.
+// Confidential clients are given a secret, which is only returned here.
+func (p *OIDCProvider) makeClientPostEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(clientPostRequest)
+		if req.Name == "" || len(req.RedirectURIs) == 0 {
+			return nil, ErrInvalidRequest
+		}
+		for _, uri := range req.RedirectURIs {
+			if !validRedirectURI(uri) {
+				return nil, ErrInvalidRequest
+			}
+		}
+		if req.AuthMethod == "" {
+			req.AuthMethod = authMethodBasic
+		}
+		if req.AuthMethod != authMethodNone && req.AuthMethod != authMethodBasic && req.AuthMethod != authMethodPost {
+			return nil, ErrInvalidRequest
+		}
+		client := dbOperations.OAuthClient{
+			Name:         req.Name,
+			RedirectURIs: req.RedirectURIs,
+			AuthMethod:   req.AuthMethod,
+			CreatedAt:    time.Now().UTC(),
+			CreatedBy:    actorFor(ctx, request),
+		}
+		var secret string
+		if client.AuthMethod != authMethodNone {
+			var err error
+			if secret, err = randomToken(); err != nil {
+				return nil, err
+			}
+			client.SecretHash = hashToken(secret)
+		}
+		if err := p.st.CreateOAuthClient(&client); err != nil {
+			return nil, err
+		}
+		return clientPostResponse{OAuthClient: client, Secret: secret}, nil
+	}
+}
+
+func (p *OIDCProvider) makeClientsGetEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		clients, err := p.st.GetOAuthClients()
+		return EmbedStruct{clientsResponse{Clients: clients}}, err
+	}
+}
+
+func (p *OIDCProvider) makeClientDeleteEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		err := p.st.DeleteOAuthClient(request.(clientRequest).ID)
+		return statusResponse{Status: err == nil}, err
+	}
+}
+
+// validRedirectURI accepts absolute https URIs without a fragment, and
+// http ones on the local machine for development.
+func validRedirectURI(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil || u.Host == "" || u.Fragment != "" {
+		return false
+	}
+	switch u.Scheme {
+	case "https":
+		return true
+	case "http":
+		host := u.Hostname()
+		return host == "localhost" || host == "127.0.0.1" || host == "::1"
+	}
+	return false
+}
+
+// covers reports whether the granted scopes include all the wanted ones.
+func covers(granted, wanted []string) bool {
+	for _, s := range wanted {
+		if !contains(granted, s) {
+			return false
+		}
+	}
+	return true
+}
+
+func withQuery(uri string, q url.Values) string {
+	for k, v := range q {
+		if len(v) == 0 || v[0] == "" {
+			delete(q, k)
+		}
+	}
+	if strings.Contains(uri, "?") {
+		return uri + "&" + q.Encode()
+	}
+	return uri + "?" + q.Encode()
+}
+
+// randomToken returns 32 random bytes, base64url encoded.
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken is how codes and client secrets are stored.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// authorizeParams are the parameters of an authorization request that the
+// login and consent pages pass on.
+var authorizeParams = []string{"client_id", "redirect_uri", "response_type", "scope", "state", "nonce", "code_challenge", "code_challenge_method"}
+
+// authorizeRequestFrom reads the parameters of an authorization request.
+func authorizeRequestFrom(q url.Values) authorizeRequest {
+	return authorizeRequest{
+		ClientID:            q.Get("client_id"),
+		RedirectURI:         q.Get("redirect_uri"),
+		ResponseType:        q.Get("response_type"),
+		Scope:               q.Get("scope"),
+		State:               q.Get("state"),
+		Nonce:               q.Get("nonce"),
+		CodeChallenge:       q.Get("code_challenge"),
+		CodeChallengeMethod: q.Get("code_challenge_method"),
+		Prompt:              q.Get("prompt"),
+	}
+}
+
+// params returns the parameters of the authorization request, without
+// those of the login and consent forms.
+func (r authorizeRequest) params() url.Values {
+	q := url.Values{}
+	for name, value := range map[string]string{
+		"client_id":             r.ClientID,
+		"redirect_uri":          r.RedirectURI,
+		"response_type":         r.ResponseType,
+		"scope":                 r.Scope,
+		"state":                 r.State,
+		"nonce":                 r.Nonce,
+		"code_challenge":        r.CodeChallenge,
+		"code_challenge_method": r.CodeChallengeMethod,
+		"prompt":                r.Prompt,
+	} {
+		if value != "" {
+			q.Set(name, value)
+		}
+	}
+	return q
+}
+
+type authorizeRequest struct {
+	ClientID            string
+	RedirectURI         string
+	ResponseType        string
+	Scope               string
+	State               string
+	Nonce               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	Prompt              string
+	// Posted by the login and consent forms.
+	Username string
+	Password string
+	Ticket   string
+	Decision string
+	Accept   []policyRef
+}
+
+// loginTicket stands for a user who logged in, while they are asked for
+// consent.
+type loginTicket struct {
+	Issuer   string `json:"iss"`
+	Subject  string `json:"sub"`
+	Audience string `json:"aud"`
+	AuthTime int64  `json:"auth_time"`
+	Expiry   int64  `json:"exp"`
+}
+
+type accessClaims struct {
+	Issuer   string `json:"iss"`
+	Subject  string `json:"sub"`
+	Audience string `json:"aud"`
+	ClientID string `json:"client_id"`
+	Scope    string `json:"scope"`
+	IssuedAt int64  `json:"iat"`
+	Expiry   int64  `json:"exp"`
+	ID       string `json:"jti"`
+	Tenant   string `json:"tenant,omitempty"`
+}
+
+type addressClaim struct {
+	StreetAddress string `json:"street_address,omitempty"`
+	Locality      string `json:"locality,omitempty"`
+	PostalCode    string `json:"postal_code,omitempty"`
+	Country       string `json:"country,omitempty"`
+}
+
+type tokenRequest struct {
+	GrantType    string
+	Code         string
+	RedirectURI  string
+	ClientID     string
+	ClientSecret string
+	CodeVerifier string
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	IDToken     string `json:"id_token"`
+	Scope       string `json:"scope"`
+}
+
+type userInfoRequest struct {
+	Token string
+}
+
+type discoveryResponse struct {
+	Issuer                   string   `json:"issuer"`
+	AuthorizationEndpoint    string   `json:"authorization_endpoint"`
+	TokenEndpoint            string   `json:"token_endpoint"`
+	UserInfoEndpoint         string   `json:"userinfo_endpoint"`
+	JWKSURI                  string   `json:"jwks_uri"`
+	ScopesSupported          []string `json:"scopes_supported"`
+	ResponseTypesSupported   []string `json:"response_types_supported"`
+	GrantTypesSupported      []string `json:"grant_types_supported"`
+	SubjectTypesSupported    []string `json:"subject_types_supported"`
+	SigningAlgsSupported     []string `json:"id_token_signing_alg_values_supported"`
+	AuthMethodsSupported     []string `json:"token_endpoint_auth_methods_supported"`
+	ChallengeMethods         []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported          []string `json:"claims_supported"`
+	IssuerParameterSupported bool     `json:"authorization_response_iss_parameter_supported"`
+}
+
+type jwksResponse struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+type clientPostRequest struct {
+	Name         string   `json:"client_name"`
+	RedirectURIs []string `json:"redirect_uris"`
+	AuthMethod   string   `json:"token_endpoint_auth_method"`
+}
+
+type clientPostResponse struct {
+	dbOperations.OAuthClient
+	Secret string `json:"client_secret,omitempty"`
+}
+
+type clientRequest struct {
+	ID string
+}
+
+type clientsResponse struct {
+	Clients []dbOperations.OAuthClient `json:"client"`
+}
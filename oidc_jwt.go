@@ -0,0 +1,176 @@
+package user
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// ErrInvalidToken is returned for a JWT that is malformed, not signed by
+// this service or of the wrong type.
+var ErrInvalidToken = errors.New("Invalid token")
+
+// JWT types, so that a token issued for one purpose cannot be used for
+// another.
+const (
+	jwtTypeIDToken     = "JWT"
+	jwtTypeAccessToken = "at+jwt"
+	jwtTypeLogin       = "login+jwt"
+)
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+// signJWT returns claims as a compact JWT signed with RS256.
+func signJWT(key *rsa.PrivateKey, kid, typ string, claims interface{}) (string, error) {
+	header, err := json.Marshal(jwtHeader{Alg: "RS256", Typ: typ, Kid: kid})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// verifyJWT checks that token is an RS256 JWT of type typ signed with key,
+// and decodes its claims. An empty typ accepts any type, for tokens of
+// other issuers. Checking the claims is left to the caller.
+func verifyJWT(key *rsa.PublicKey, typ, token string, claims interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrInvalidToken
+	}
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil || header.Alg != "RS256" || (typ != "" && header.Typ != typ) {
+		return ErrInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return ErrInvalidToken
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) != nil {
+		return ErrInvalidToken
+	}
+	if decodeJWTPart(parts[1], claims) != nil {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// jwtKeyID returns the kid of the key token claims to be signed with.
+func jwtKeyID(token string) string {
+	var header jwtHeader
+	decodeJWTPart(strings.Split(token, ".")[0], &header)
+	return header.Kid
+}
+
+// jwtTenant returns the tenant claim of token, without verifying it.
+func jwtTenant(token string) string {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	var claims struct {
+		Tenant string `json:"tenant"`
+	}
+	decodeJWTPart(parts[1], &claims)
+	return claims.Tenant
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// ParseSigningKey reads an RSA private key in PEM, either PKCS #1 or
+// PKCS #8 encoded.
+func ParseSigningKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%T is not an RSA key", key)
+	}
+	return rsaKey, nil
+}
+
+// jsonWebKey is the public half of a signing key as published in the
+// JWKS (RFC 7517).
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// jwkFor returns the JWK of key, identified by its RFC 7638 thumbprint.
+func jwkFor(key *rsa.PublicKey) jsonWebKey {
+	k := jsonWebKey{
+		Kty: "RSA",
+		Use: "sig",
+		Alg: "RS256",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+	thumbprint := sha256.Sum256([]byte(fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, k.E, k.N)))
+	k.Kid = base64.RawURLEncoding.EncodeToString(thumbprint[:])
+	return k
+}
+
+// publicKey returns the RSA key k describes.
+func (k jsonWebKey) publicKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+	if k.Kty != "RSA" || len(n) == 0 || len(e) == 0 || len(e) > 4 {
+		return nil, fmt.Errorf("unsupported key %q", k.Kid)
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+}
+
+// halfHash is the left half of the SHA-256 of s, base64url encoded, as
+// the at_hash claim of an ID token.
+func halfHash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
+}
@@ -0,0 +1,468 @@
+package user
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+	"github.com/user/dbOperations"
+	mgo "gopkg.in/mgo.v2"
+)
+
+const (
+	testIssuer      = "http://user.test"
+	testRedirectURI = "https://rp.test/callback"
+)
+
+var (
+	testKeyOnce sync.Once
+	testKey     *rsa.PrivateKey
+)
+
+// testSigningKey is generated once, as generating keys is slow.
+func testSigningKey() *rsa.PrivateKey {
+	testKeyOnce.Do(func() {
+		var err error
+		if testKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			panic(err)
+		}
+	})
+	return testKey
+}
+
+// memOIDC is an in-memory OIDCStore, taking addresses from the stub
+// service and erasures and consents from the data subject store.
+type memOIDC struct {
+	svc     *stubService
+	ds      *memDataSubjects
+	clients []dbOperations.OAuthClient
+	codes   map[string]dbOperations.AuthCode
+}
+
+func newMemOIDC(svc *stubService, ds *memDataSubjects) *memOIDC {
+	return &memOIDC{
+		svc:   svc,
+		ds:    ds,
+		codes: map[string]dbOperations.AuthCode{},
+	}
+}
+
+func (m *memOIDC) CreateOAuthClient(cl *dbOperations.OAuthClient) error {
+	cl.ID = "57a98d98e4b00679b4a8c" + strings.Repeat("0", 2) + string(rune('0'+len(m.clients)))
+	m.clients = append(m.clients, *cl)
+	return nil
+}
+
+func (m *memOIDC) GetOAuthClients() ([]dbOperations.OAuthClient, error) {
+	return append([]dbOperations.OAuthClient{}, m.clients...), nil
+}
+
+func (m *memOIDC) GetOAuthClient(id string) (dbOperations.OAuthClient, error) {
+	for _, cl := range m.clients {
+		if cl.ID == id {
+			return cl, nil
+		}
+	}
+	return dbOperations.OAuthClient{}, mgo.ErrNotFound
+}
+
+func (m *memOIDC) DeleteOAuthClient(id string) error {
+	for i, cl := range m.clients {
+		if cl.ID == id {
+			m.clients = append(m.clients[:i], m.clients[i+1:]...)
+			return nil
+		}
+	}
+	return mgo.ErrNotFound
+}
+
+func (m *memOIDC) CreateAuthCode(code *dbOperations.AuthCode) error {
+	m.codes[code.Hash] = *code
+	return nil
+}
+
+func (m *memOIDC) ConsumeAuthCode(hash string) (dbOperations.AuthCode, error) {
+	code, ok := m.codes[hash]
+	if !ok {
+		return code, mgo.ErrNotFound
+	}
+	delete(m.codes, hash)
+	return code, nil
+}
+
+func (m *memOIDC) GetConsent(userID, clientID string) (dbOperations.Consent, error) {
+	c, ok := m.ds.consents[userID+" "+clientID]
+	if !ok {
+		return c, mgo.ErrNotFound
+	}
+	return c, nil
+}
+
+func (m *memOIDC) SaveConsent(c dbOperations.Consent) error {
+	m.ds.consents[c.UserID+" "+c.ClientID] = c
+	return nil
+}
+
+func (m *memOIDC) GetAddressesForUser(userid string) ([]dbOperations.Address, error) {
+	return m.svc.GetAddressesForUser(userid)
+}
+
+func (m *memOIDC) GetErasures(userid string) ([]dbOperations.Erasure, error) {
+	return m.ds.GetErasures(userid)
+}
+
+func (m *memOIDC) GetPolicies() ([]dbOperations.Policy, error) {
+	return m.svc.GetPolicies()
+}
+
+func (m *memOIDC) AddAcceptance(a *dbOperations.Acceptance) error {
+	return m.svc.AddAcceptance(a)
+}
+
+func (m *memOIDC) GetAcceptances(userid string) ([]dbOperations.Acceptance, error) {
+	return m.svc.GetAcceptances(userid)
+}
+
+func (m *memOIDC) AppendEvent(e *dbOperations.Event) error {
+	return m.svc.AppendEvent(e)
+}
+
+// routerTransport serves requests to any host with the router, so a
+// relying party can use the URLs of the discovery document in process.
+type routerTransport struct {
+	router *mux.Router
+}
+
+func (t routerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	w := httptest.NewRecorder()
+	r = r.WithContext(r.Context())
+	r.RequestURI = r.URL.RequestURI()
+	t.router.ServeHTTP(w, r)
+	return w.Result(), nil
+}
+
+// relyingParty is a minimal OpenID Connect client.
+type relyingParty struct {
+	t        *testing.T
+	http     *http.Client
+	config   discoveryResponse
+	id       string
+	secret   string
+	verifier string
+}
+
+func (rp *relyingParty) getJSON(uri string, v interface{}) {
+	resp, err := rp.http.Get(uri)
+	if err != nil {
+		rp.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	json.NewDecoder(resp.Body).Decode(v)
+}
+
+// authorizeURL starts a flow with a fresh PKCE verifier.
+func (rp *relyingParty) authorizeURL(scope, extra string) string {
+	rp.verifier, _ = randomToken()
+	challenge := sha256.Sum256([]byte(rp.verifier))
+	q := url.Values{
+		"client_id":             {rp.id},
+		"redirect_uri":          {testRedirectURI},
+		"response_type":         {"code"},
+		"scope":                 {scope},
+		"state":                 {"xyz"},
+		"nonce":                 {"n-0S6"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	return rp.config.AuthorizationEndpoint + "?" + q.Encode() + extra
+}
+
+func (rp *relyingParty) exchange(code string) (*http.Response, tokenResponse) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {testRedirectURI},
+		"code_verifier": {rp.verifier},
+	}
+	req, _ := http.NewRequest("POST", rp.config.TokenEndpoint, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(rp.id, rp.secret)
+	resp, err := rp.http.Do(req)
+	if err != nil {
+		rp.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var tokens tokenResponse
+	json.NewDecoder(resp.Body).Decode(&tokens)
+	return resp, tokens
+}
+
+// verifyIDToken checks an ID token against the published keys.
+func (rp *relyingParty) verifyIDToken(token string) map[string]interface{} {
+	var jwks jwksResponse
+	rp.getJSON(rp.config.JWKSURI, &jwks)
+	if len(jwks.Keys) != 1 {
+		rp.t.Fatalf("unexpected keys %+v", jwks)
+	}
+	key, err := jwks.Keys[0].publicKey()
+	if err != nil {
+		rp.t.Fatal(err)
+	}
+	var claims map[string]interface{}
+	if err := verifyJWT(key, jwtTypeIDToken, token, &claims); err != nil {
+		rp.t.Fatalf("ID token does not verify: %v", err)
+	}
+	return claims
+}
+
+var ticketField = regexp.MustCompile(`name="ticket" value="([^"]+)"`)
+
+func TestOIDCAuthorizationCodeFlow(t *testing.T) {
+	svc := newStubService()
+	e, st := newTestEndpoints(svc)
+	router := MakeHTTPHandler(context.Background(), e, log.NewNopLogger())
+	// The browser does not follow redirects, so the test sees the code.
+	browser := &http.Client{
+		Transport: routerTransport{router},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	rp := &relyingParty{t: t, http: &http.Client{Transport: routerTransport{router}}}
+	rp.getJSON(testIssuer+"/.well-known/openid-configuration", &rp.config)
+	if rp.config.Issuer != testIssuer || rp.config.TokenEndpoint != testIssuer+"/oauth2/token" {
+		t.Fatalf("unexpected discovery document %+v", rp.config)
+	}
+
+	r := adminRequest("POST", "/oauth2/clients")
+	r.Body = httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"client_name": "Shop", "redirect_uris": ["`+testRedirectURI+`"]}`)).Body
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	var registered clientPostResponse
+	json.NewDecoder(w.Body).Decode(&registered)
+	if w.Code != http.StatusCreated || registered.Secret == "" || registered.AuthMethod != authMethodBasic {
+		t.Fatalf("expected a confidential client, got %d: %+v", w.Code, registered)
+	}
+	rp.id, rp.secret = registered.ID, registered.Secret
+
+	post := func(form url.Values) *http.Response {
+		resp, err := browser.PostForm(rp.config.AuthorizationEndpoint, form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	body := func(resp *http.Response) string {
+		var buf bytes.Buffer
+		buf.ReadFrom(resp.Body)
+		resp.Body.Close()
+		return buf.String()
+	}
+	login := func(authorize, password string) *http.Response {
+		u, _ := url.Parse(authorize)
+		form := u.Query()
+		form.Set("username", "eve")
+		form.Set("password", password)
+		return post(form)
+	}
+
+	authorize := rp.authorizeURL("openid profile email address unknown", "")
+	resp, _ := browser.Get(authorize)
+	if page := body(resp); resp.StatusCode != http.StatusOK || !strings.Contains(page, "Shop") || resp.Header.Get("X-Frame-Options") != "DENY" {
+		t.Fatalf("expected the login page, got %d: %s", resp.StatusCode, page)
+	}
+	if resp := login(authorize, "wrong"); resp.StatusCode != http.StatusUnauthorized || !strings.Contains(body(resp), "password is wrong") {
+		t.Errorf("expected the login page again, got %d", resp.StatusCode)
+	}
+	resp = login(authorize, "secret")
+	page := body(resp)
+	ticket := ticketField.FindStringSubmatch(page)
+	if resp.StatusCode != http.StatusOK || ticket == nil || !strings.Contains(page, "Your postal address") {
+		t.Fatalf("expected the consent page, got %d: %s", resp.StatusCode, page)
+	}
+	u, _ := url.Parse(authorize)
+	form := u.Query()
+	form.Set("ticket", ticket[1])
+	form.Set("decision", "allow")
+	resp = post(form)
+	location, _ := url.Parse(resp.Header.Get("Location"))
+	code := location.Query().Get("code")
+	if resp.StatusCode != http.StatusFound || code == "" || location.Query().Get("state") != "xyz" || location.Query().Get("iss") != testIssuer {
+		t.Fatalf("expected a redirect with a code, got %d: %s", resp.StatusCode, location)
+	}
+
+	resp, tokens := rp.exchange(code)
+	if resp.StatusCode != http.StatusOK || tokens.TokenType != "Bearer" || tokens.Scope != "openid profile email address" {
+		t.Fatalf("unexpected token response %d: %+v", resp.StatusCode, tokens)
+	}
+	if resp.Header.Get("Cache-Control") != "no-store" {
+		t.Error("expected tokens not to be cached")
+	}
+	claims := rp.verifyIDToken(tokens.IDToken)
+	if claims["iss"] != testIssuer || claims["aud"] != rp.id || claims["sub"] != testUserID || claims["nonce"] != "n-0S6" ||
+		claims["given_name"] != "Eve" || claims["at_hash"] != halfHash(tokens.AccessToken) {
+		t.Errorf("unexpected ID token claims %v", claims)
+	}
+	if resp, _ := rp.exchange(code); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a code to be usable once, got %d", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest("GET", rp.config.UserInfoEndpoint, nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	resp, _ = rp.http.Do(req)
+	var info map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&info)
+	address, _ := info["address"].(map[string]interface{})
+	if resp.StatusCode != http.StatusOK || info["sub"] != testUserID || info["preferred_username"] != "eve" || address["locality"] != "Zurich" {
+		t.Errorf("unexpected userinfo %d: %v", resp.StatusCode, info)
+	}
+	req.Header.Set("Authorization", "Bearer "+tokens.IDToken)
+	if resp, _ := rp.http.Do(req); resp.StatusCode != http.StatusUnauthorized || !strings.Contains(resp.Header.Get("WWW-Authenticate"), "invalid_token") {
+		t.Errorf("expected an ID token not to be accepted as an access token, got %d", resp.StatusCode)
+	}
+	req, _ = http.NewRequest("GET", testIssuer+"/customers/"+testUserID, nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	if resp, _ := rp.http.Do(req); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the access token to authenticate API calls, got %d", resp.StatusCode)
+	}
+
+	// Having consented, the user goes straight back to the client.
+	authorize = rp.authorizeURL("openid profile", "")
+	resp = login(authorize, "secret")
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("expected the consent to be remembered, got %d", resp.StatusCode)
+	}
+	location, _ = url.Parse(resp.Header.Get("Location"))
+	rp.verifier = "not-the-verifier-used-for-the-challenge-at-all"
+	if resp, _ := rp.exchange(location.Query().Get("code")); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a wrong code verifier to be refused, got %d", resp.StatusCode)
+	}
+
+	authorize = rp.authorizeURL("openid", "&prompt=consent")
+	page = body(login(authorize, "secret"))
+	u, _ = url.Parse(authorize)
+	form = u.Query()
+	form.Set("ticket", ticketField.FindStringSubmatch(page)[1])
+	form.Set("decision", "deny")
+	location, _ = url.Parse(post(form).Header.Get("Location"))
+	if location.Query().Get("error") != "access_denied" || location.Query().Get("state") != "xyz" {
+		t.Errorf("expected access_denied, got %s", location)
+	}
+
+	logins := 0
+	for _, entry := range st.entries {
+		if entry.Action == "oidc.login" && entry.Target == testUserID && entry.Outcome == outcomeSuccess {
+			logins++
+		}
+	}
+	if logins != 3 {
+		t.Errorf("expected 3 successful logins in the audit log, got %d", logins)
+	}
+
+	// Erasing the user revokes their tokens and forgets their consents.
+	erasure := dbOperations.Erasure{UserID: testUserID, Status: dbOperations.ErasurePending}
+	st.CreateErasure(&erasure)
+	req, _ = http.NewRequest("GET", testIssuer+"/customers/"+testUserID, nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	if resp, _ := rp.http.Do(req); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the token of a user about to be erased to be refused, got %d", resp.StatusCode)
+	}
+	st.EraseUser(&erasure)
+	if resp, _ := rp.http.Do(req); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the token of an erased user to be refused, got %d", resp.StatusCode)
+	}
+	req, _ = http.NewRequest("GET", rp.config.UserInfoEndpoint, nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	if resp, _ := rp.http.Do(req); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected userinfo to refuse the token of an erased user, got %d", resp.StatusCode)
+	}
+	if consents, _ := st.GetConsents(testUserID); len(consents) != 0 {
+		t.Errorf("expected the consents to be erased, got %+v", consents)
+	}
+}
+
+func TestOIDCAuthorizeErrors(t *testing.T) {
+	svc := newStubService()
+	e, _ := newTestEndpoints(svc)
+	router := MakeHTTPHandler(context.Background(), e, log.NewNopLogger())
+	do := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	r := adminRequest("POST", "/oauth2/clients")
+	r.Body = httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"client_name": "SPA", "redirect_uris": ["http://localhost:3000/cb"], "token_endpoint_auth_method": "none"}`)).Body
+	var public clientPostResponse
+	json.NewDecoder(do(r).Body).Decode(&public)
+	if public.Secret != "" {
+		t.Errorf("expected no secret for a public client, got %q", public.Secret)
+	}
+	r = adminRequest("POST", "/oauth2/clients")
+	r.Body = httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"client_name": "Evil", "redirect_uris": ["http://evil.example.com/cb"]}`)).Body
+	if w := do(r); w.Code != http.StatusBadRequest {
+		t.Errorf("expected plain http redirect URIs off localhost to be refused, got %d", w.Code)
+	}
+
+	base := url.Values{
+		"client_id":             {public.ID},
+		"redirect_uri":          {"http://localhost:3000/cb"},
+		"response_type":         {"code"},
+		"scope":                 {"openid"},
+		"state":                 {"s"},
+		"code_challenge":        {"abc"},
+		"code_challenge_method": {"S256"},
+	}
+	for _, c := range []struct {
+		name, param, value string
+		status             int
+		error              string
+	}{
+		{"unknown client", "client_id", "57a98d98e4b00679b4a8ffff", http.StatusBadRequest, ""},
+		{"unregistered redirect", "redirect_uri", "https://evil.example.com/cb", http.StatusBadRequest, ""},
+		{"implicit flow", "response_type", "token", http.StatusFound, "unsupported_response_type"},
+		{"no openid scope", "scope", "profile", http.StatusFound, "invalid_scope"},
+		{"plain PKCE", "code_challenge_method", "plain", http.StatusFound, "invalid_request"},
+		{"no interaction", "prompt", "none", http.StatusFound, "login_required"},
+	} {
+		q := url.Values{}
+		for k, v := range base {
+			q[k] = v
+		}
+		q.Set(c.param, c.value)
+		w := do(httptest.NewRequest("GET", "/oauth2/authorize?"+q.Encode(), nil))
+		if w.Code != c.status {
+			t.Errorf("%s: expected %d, got %d", c.name, c.status, w.Code)
+			continue
+		}
+		if c.error == "" {
+			if strings.Contains(w.Header().Get("Location"), "evil") {
+				t.Errorf("%s: redirected to an unregistered URI", c.name)
+			}
+			continue
+		}
+		location, _ := url.Parse(w.Header().Get("Location"))
+		if !strings.HasPrefix(location.String(), "http://localhost:3000/cb?") || location.Query().Get("error") != c.error || location.Query().Get("state") != "s" {
+			t.Errorf("%s: unexpected redirect %s", c.name, location)
+		}
+	}
+
+	form := url.Values{"grant_type": {"password"}}
+	r = httptest.NewRequest("POST", "/oauth2/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if w := do(r); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "unsupported_grant_type") {
+		t.Errorf("expected unsupported_grant_type, got %d: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,17 @@
+package user
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openAPISpec describes the routes mounted by MakeHTTPHandler. It is
+// checked against the router by TestOpenAPISpecMatchesRouter.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+func serveOpenAPI(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
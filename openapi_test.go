@@ -0,0 +1,259 @@
+package user
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+// specSamples fills the path parameters of the spec with ids known to
+// stubService.
+var specSamples = map[string]string{
+	"{id}":        "57a98d98e4b00679b4a830af",
+	"{addressId}": "57a98d98e4b00679b4a830b0",
+	"{provider}":  "corp",
+	"{policy}":    "terms",
+}
+
+type openAPIDoc struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components map[string]map[string]interface{}     `json:"components"`
+}
+
+type openAPIOperation struct {
+	RequestBody struct {
+		Content map[string]struct {
+			Schema map[string]interface{} `json:"schema"`
+		} `json:"content"`
+	} `json:"requestBody"`
+	Responses map[string]map[string]interface{} `json:"responses"`
+	Security  []map[string][]string             `json:"security"`
+}
+
+func newTestRouter() *mux.Router {
+	e, _ := newTestEndpoints(newStubService())
+	return MakeHTTPHandler(context.Background(), e, log.NewNopLogger())
+}
+
+// TestOpenAPISpecMatchesRouter sends a request for every documented
+// operation through the router and checks the response against the
+// documented schema, then checks that every route is documented.
+func TestOpenAPISpecMatchesRouter(t *testing.T) {
+	var doc openAPIDoc
+	if err := json.Unmarshal(openAPISpec, &doc); err != nil {
+		t.Fatal(err)
+	}
+	routes := newTestRouter()
+	covered := make(map[*mux.Route]bool)
+
+	paths := make([]string, 0, len(doc.Paths))
+	for p := range doc.Paths {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		for method, raw := range doc.Paths[p] {
+			if method == "parameters" {
+				continue
+			}
+			var op openAPIOperation
+			if err := json.Unmarshal(raw, &op); err != nil {
+				t.Fatalf("%s %s: %v", method, p, err)
+			}
+			req := specRequest(doc, strings.ToUpper(method), p, op)
+			var match mux.RouteMatch
+			if !routes.Match(req, &match) {
+				t.Errorf("%s %s: documented but not routed", req.Method, p)
+				continue
+			}
+			covered[match.Route] = true
+
+			// Each operation gets a fresh service, as some of them delete.
+			router := newTestRouter()
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			resp, ok := op.Responses[strconv.Itoa(w.Code)]
+			if !ok {
+				t.Errorf("%s %s: undocumented status %d: %s", req.Method, p, w.Code, w.Body.String())
+				continue
+			}
+			schema := responseSchema(doc, resp, w.Header().Get("Content-Type"))
+			if schema == nil {
+				continue
+			}
+			var body interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Errorf("%s %s: invalid JSON response: %v", req.Method, p, err)
+				continue
+			}
+			for _, err := range validateSchema(doc, schema, body, "response") {
+				t.Errorf("%s %s: %v", req.Method, p, err)
+			}
+		}
+	}
+
+	routes.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		if !covered[route] {
+			tpl, _ := route.GetPathTemplate()
+			t.Errorf("route %s is not reachable by any documented operation", tpl)
+		}
+		return nil
+	})
+}
+
+func TestServeOpenAPI(t *testing.T) {
+	router := newTestRouter()
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/openapi.json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if !bytes.Equal(w.Body.Bytes(), openAPISpec) {
+		t.Error("served document differs from the embedded spec")
+	}
+}
+
+func specRequest(doc openAPIDoc, method, path string, op openAPIOperation) *http.Request {
+	for k, v := range specSamples {
+		path = strings.Replace(path, k, v, -1)
+	}
+	var body []byte
+	for _, ct := range []string{"application/json", "application/scim+json"} {
+		if c, ok := op.RequestBody.Content[ct]; ok {
+			body, _ = json.Marshal(sampleFor(doc, c.Schema, ""))
+		}
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	for _, sec := range op.Security {
+		if _, ok := sec["basicAuth"]; ok {
+			req.SetBasicAuth("eve", "secret")
+		}
+		if _, ok := sec["bearerAuth"]; ok {
+			req.Header.Set("Authorization", "Bearer "+testAdminToken)
+		}
+	}
+	return req
+}
+
+// sampleFor builds a value that satisfies schema, using known ids for
+// fields that reference other records.
+func sampleFor(doc openAPIDoc, schema map[string]interface{}, name string) interface{} {
+	schema = resolveRef(doc, schema)
+	switch schema["type"] {
+	case "object":
+		obj := make(map[string]interface{})
+		props, _ := schema["properties"].(map[string]interface{})
+		for k, v := range props {
+			obj[k] = sampleFor(doc, v.(map[string]interface{}), k)
+		}
+		return obj
+	case "array":
+		return []interface{}{}
+	case "boolean":
+		return true
+	case "integer":
+		return 1
+	}
+	switch name {
+	case "userID":
+		return specSamples["{id}"]
+	case "username":
+		return "newuser"
+	case "url":
+		return "https://example.com/hook"
+	}
+	return "sample"
+}
+
+// responseSchema returns the schema of the content type answered, or of
+// any if that one is not documented.
+func responseSchema(doc openAPIDoc, resp map[string]interface{}, contentType string) map[string]interface{} {
+	resp = resolveRef(doc, resp)
+	content, _ := resp["content"].(map[string]interface{})
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if c, ok := content[mediaType].(map[string]interface{}); ok {
+		if s, ok := c["schema"].(map[string]interface{}); ok {
+			return s
+		}
+	}
+	for _, c := range content {
+		if s, ok := c.(map[string]interface{})["schema"].(map[string]interface{}); ok {
+			return s
+		}
+	}
+	return nil
+}
+
+func resolveRef(doc openAPIDoc, schema map[string]interface{}) map[string]interface{} {
+	ref, ok := schema["$ref"].(string)
+	if !ok {
+		return schema
+	}
+	parts := strings.Split(strings.TrimPrefix(ref, "#/components/"), "/")
+	resolved, _ := doc.Components[parts[0]][parts[1]].(map[string]interface{})
+	return resolveRef(doc, resolved)
+}
+
+// validateSchema checks value against the subset of JSON schema used in
+// openapi.json: types, properties, required and items.
+func validateSchema(doc openAPIDoc, schema map[string]interface{}, value interface{}, at string) []error {
+	schema = resolveRef(doc, schema)
+	var errs []error
+	switch schema["type"] {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return []error{fmt.Errorf("%s: expected object, got %T", at, value)}
+		}
+		required, _ := schema["required"].([]interface{})
+		for _, r := range required {
+			if _, ok := obj[r.(string)]; !ok {
+				errs = append(errs, fmt.Errorf("%s: missing required property %q", at, r))
+			}
+		}
+		props, _ := schema["properties"].(map[string]interface{})
+		for k, v := range obj {
+			p, ok := props[k]
+			if !ok {
+				if len(props) > 0 {
+					errs = append(errs, fmt.Errorf("%s: undocumented property %q", at, k))
+				}
+				continue
+			}
+			errs = append(errs, validateSchema(doc, p.(map[string]interface{}), v, at+"."+k)...)
+		}
+	case "array":
+		arr, ok := value.([]interface{})
+		if !ok {
+			return []error{fmt.Errorf("%s: expected array, got %T", at, value)}
+		}
+		items, _ := schema["items"].(map[string]interface{})
+		for i, v := range arr {
+			errs = append(errs, validateSchema(doc, items, v, fmt.Sprintf("%s[%d]", at, i))...)
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			errs = append(errs, fmt.Errorf("%s: expected string, got %T", at, value))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			errs = append(errs, fmt.Errorf("%s: expected boolean, got %T", at, value))
+		}
+	case "integer":
+		if f, ok := value.(float64); !ok || f != float64(int64(f)) {
+			errs = append(errs, fmt.Errorf("%s: expected integer, got %v", at, value))
+		}
+	}
+	return errs
+}
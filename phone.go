@@ -0,0 +1,260 @@
+package user
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/user/dbOperations"
+)
+
+var (
+	// ErrInvalidPhone is returned for a phone number that is not one of a
+	// country in the numbering plans, or is national without a region to
+	// read it in.
+	ErrInvalidPhone = errors.New("Invalid phone number")
+)
+
+const (
+	// phoneCodeDigits is the length of the codes sent to verify a phone
+	// number.
+	phoneCodeDigits = 6
+	// phoneCodeTTL is how long a code can be confirmed.
+	phoneCodeTTL = 10 * time.Minute
+)
+
+// phonePlansJSON holds the numbering plans of the countries phone numbers
+// are accepted from, by ISO 3166 code.
+//
+//go:embed phoneplans.json
+var phonePlansJSON []byte
+
+// phonePlan is how the phone numbers of a country are written.
+type phonePlan struct {
+	// Code is the country calling code, which countries may share.
+	Code string `json:"code"`
+	// Trunk is the prefix of numbers dialled within the country, which is
+	// not part of the international number.
+	Trunk string `json:"trunk,omitempty"`
+	// National is the pattern of the national significant numbers, those
+	// following the calling code. Along with it they are at most 15
+	// digits long.
+	National string `json:"national"`
+
+	national *regexp.Regexp
+}
+
+// phonePlans are the numbering plans by country, and callingCodes the
+// countries by calling code.
+var phonePlans, callingCodes = loadPhonePlans()
+
+func loadPhonePlans() (map[string]*phonePlan, map[string][]*phonePlan) {
+	plans := map[string]*phonePlan{}
+	if err := json.Unmarshal(phonePlansJSON, &plans); err != nil {
+		panic("phoneplans.json: " + err.Error())
+	}
+	byCode := map[string][]*phonePlan{}
+	for _, p := range plans {
+		p.national = regexp.MustCompile("^(?:" + p.National + ")$")
+		byCode[p.Code] = append(byCode[p.Code], p)
+	}
+	return plans, byCode
+}
+
+// phonePunctuation is what phone numbers are written with besides their
+// digits. A trunk prefix written as "(0)" after the calling code is
+// dropped before it.
+var phonePunctuation = strings.NewReplacer("(0)", "", " ", "", "-", "", ".", "", "/", "", "(", "", ")", "")
+
+// ParsePhone returns number in E.164, as in "+41446681800". International
+// numbers start with + or 00, or are RFC 3966 URIs as in
+// "tel:+41-44-668-18-00"; any other number is read as a national one of
+// region, a country as LookupCountry knows it, with or without its trunk
+// prefix.
+func ParsePhone(number, region string) (string, error) {
+	s := strings.TrimSpace(number)
+	if len(s) > 4 && strings.EqualFold(s[:4], "tel:") {
+		s = s[4:]
+	}
+	s = phonePunctuation.Replace(s)
+	international := strings.HasPrefix(s, "+")
+	if international {
+		s = s[1:]
+	} else if strings.HasPrefix(s, "00") {
+		international, s = true, s[2:]
+	}
+	if s == "" || strings.TrimLeft(s, "0123456789") != "" {
+		return "", ErrInvalidPhone
+	}
+	if international {
+		for n := 1; n <= 3 && n < len(s); n++ {
+			for _, p := range callingCodes[s[:n]] {
+				if nsn, ok := p.match(s[n:]); ok {
+					return "+" + p.Code + nsn, nil
+				}
+			}
+		}
+		return "", ErrInvalidPhone
+	}
+	c, ok := LookupCountry(region)
+	if !ok || phonePlans[c.Code] == nil {
+		return "", ErrInvalidPhone
+	}
+	p := phonePlans[c.Code]
+	if nsn, ok := p.match(s); ok {
+		return "+" + p.Code + nsn, nil
+	}
+	return "", ErrInvalidPhone
+}
+
+// match returns the national significant number of digits in p, which
+// may be led by the trunk prefix, and whether it is one of p's.
+func (p *phonePlan) match(digits string) (string, bool) {
+	if p.Trunk != "" && strings.HasPrefix(digits, p.Trunk) && p.national.MatchString(digits[len(p.Trunk):]) {
+		digits = digits[len(p.Trunk):]
+	}
+	return digits, p.national.MatchString(digits)
+}
+
+// phoneRegion reports whether region is a country phone numbers can be
+// read in as national ones.
+func phoneRegion(region string) bool {
+	c, ok := LookupCountry(region)
+	return ok && phonePlans[c.Code] != nil
+}
+
+// SMSSender sends text messages to phone numbers in E.164.
+type SMSSender interface {
+	SendSMS(ctx context.Context, to, text string) error
+}
+
+// HTTPSMSSender posts each text message as JSON, {"to": ..., "text": ...},
+// to the URL of an SMS gateway. Any response other than 2xx counts as a
+// failure. Errors name neither the number nor the text, as they end up in
+// logs.
+type HTTPSMSSender struct {
+	URL    string
+	Client *http.Client
+}
+
+// SendSMS implements SMSSender.
+func (s HTTPSMSSender) SendSMS(ctx context.Context, to, text string) error {
+	body, err := json.Marshal(map[string]string{"to": to, "text": text})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.New("SMS gateway unreachable")
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("SMS gateway answered %s", resp.Status)
+	}
+	return nil
+}
+
+// PhoneStore keeps the codes sent to verify the phone numbers of users.
+// *dbOperations.Mongo implements it.
+type PhoneStore interface {
+	GetUser(id string) (dbOperations.User, error)
+	CreatePhoneVerification(userid, phone, codeHash string, expiresAt time.Time) error
+	ConfirmPhone(userid, codeHash string) (int64, error)
+	AppendEvent(e *dbOperations.Event) error
+}
+
+// LogSMSSender logs the text messages it is given instead of sending
+// them, for running the service locally. The log gets the number and the
+// code, so it is only ever used when asked for, never as a fallback.
+type LogSMSSender struct {
+	Logger log.Logger
+}
+
+// SendSMS implements SMSSender.
+func (s LogSMSSender) SendSMS(_ context.Context, to, text string) error {
+	return s.Logger.Log("sms", to, "text", text)
+}
+
+// PhoneVerificationEndpoints mounts the endpoints verifying the phone
+// number of a customer with a code sent to it by sender.
+func PhoneVerificationEndpoints(e Endpoints, st PhoneStore, sender SMSSender) Endpoints {
+	e.PhoneVerifyEndpoint = MakePhoneVerifyEndpoint(st, sender)
+	e.PhoneConfirmEndpoint = MakePhoneConfirmEndpoint(st)
+	return e
+}
+
+// MakePhoneVerifyEndpoint returns an endpoint sending a code to the phone
+// number of a customer, replacing any sent before. The number must be in
+// E.164, as numbers are stored since they are parsed.
+func MakePhoneVerifyEndpoint(st PhoneStore, sender SMSSender) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(phoneRequest)
+		u, err := st.GetUser(req.UserID)
+		if err != nil {
+			return nil, err
+		}
+		phone, err := ParsePhone(u.Phone, "")
+		if err != nil || phone != u.Phone {
+			return nil, ErrInvalidPhone
+		}
+		n, err := rand.Int(rand.Reader, new(big.Int).Exp(big.NewInt(10), big.NewInt(phoneCodeDigits), nil))
+		if err != nil {
+			return nil, err
+		}
+		code := fmt.Sprintf("%0*d", phoneCodeDigits, n.Int64())
+		if err := st.CreatePhoneVerification(u.UserID, phone, hashToken(code), time.Now().UTC().Add(phoneCodeTTL)); err != nil {
+			return nil, err
+		}
+		if err := sender.SendSMS(ctx, phone, "Your verification code is "+code); err != nil {
+			return nil, err
+		}
+		return statusResponse{Status: true}, nil
+	}
+}
+
+// MakePhoneConfirmEndpoint returns an endpoint marking the phone number of
+// a customer verified with the code sent to it, and answering with the
+// customer.
+func MakePhoneConfirmEndpoint(st PhoneStore) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(phoneRequest)
+		if _, err := st.ConfirmPhone(req.UserID, hashToken(req.Code)); err != nil {
+			return nil, err
+		}
+		u, err := st.GetUser(req.UserID)
+		if err != nil {
+			return nil, err
+		}
+		e, err := NewEvent(EventUserUpdated, u.UserID, u.EventPayload())
+		if err == nil {
+			e.Actor = actorFor(ctx, request)
+			err = st.AppendEvent(&e)
+		}
+		return u, err
+	}
+}
+
+type phoneRequest struct {
+	UserID string `json:"-"`
+	Code   string `json:"code"`
+}
@@ -0,0 +1,153 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/user/dbOperations"
+)
+
+func TestParsePhone(t *testing.T) {
+	for _, c := range []struct {
+		number, region, want string
+	}{
+		{"+41 44 668 18 00", "", "+41446681800"},
+		{"0041 (0)44 668 18 00", "", "+41446681800"},
+		{"tel:+1-212-555-0100", "", "+12125550100"},
+		{"044 668 18 00", "CH", "+41446681800"},
+		{"(212) 555-0100", "USA", "+12125550100"},
+		{"1 212 555 0100", "US", "+12125550100"},
+		{"020 7946 0958", "UK", "+442079460958"},
+		{"+44 020 7946 0958", "", "+442079460958"},
+		{"06 1 234 5678", "HU", "+3612345678"},
+		{"+39 06 6982 1234", "", "+390669821234"},
+		{"8 (912) 345-67-89", "RU", "+79123456789"},
+		{"+7 701 234 5678", "", "+77012345678"},
+	} {
+		if got, err := ParsePhone(c.number, c.region); err != nil || got != c.want {
+			t.Errorf("%q in %q: expected %s, got %q: %v", c.number, c.region, c.want, got, err)
+		}
+	}
+	for _, c := range []struct{ number, region string }{
+		{"", "CH"},
+		{"044 668 18 00", ""},
+		{"044 668 18 00", "Atlantis"},
+		{"+41 44 668", ""},
+		{"+999 1234 5678", ""},
+		{"call 044 668 18 00", "CH"},
+		{"+1 212 555 0100 ext 12", ""},
+	} {
+		if got, err := ParsePhone(c.number, c.region); err != ErrInvalidPhone {
+			t.Errorf("%q in %q: expected it to be refused, got %q: %v", c.number, c.region, got, err)
+		}
+	}
+}
+
+func TestNormalizingStorePhone(t *testing.T) {
+	st := NewNormalizingStore(newCountingStore(), dbOperations.Tenant{PhoneRegion: "CH"})
+	u := dbOperations.User{Username: "eve", Phone: "044 668 18 00"}
+	if err := st.CreateUser(&u); err != nil || u.Phone != "+41446681800" {
+		t.Errorf("expected the number to be stored in E.164, got %q: %v", u.Phone, err)
+	}
+	u = dbOperations.User{Username: "mallory", Phone: "12345"}
+	if err := st.CreateUser(&u); err != ErrInvalidPhone {
+		t.Errorf("expected an invalid number to be refused, got %v", err)
+	}
+
+	svc := NewUserService(NewNormalizingStore(newCountingStore(), dbOperations.Tenant{}), log.NewNopLogger())
+	if _, err := svc.Register("bob", "secret", "", "", "", "044 668 18 00"); err != ErrInvalidPhone {
+		t.Errorf("expected a national number to be refused without a phone region, got %v", err)
+	}
+	e, _ := newTestEndpoints(newStubService())
+	e.RegisterEndpoint = MakeRegisterEndpoint(svc)
+	w := httptest.NewRecorder()
+	MakeHTTPHandler(context.Background(), e, log.NewNopLogger()).ServeHTTP(w, httptest.NewRequest("POST", "/register", strings.NewReader(`{"username": "bob", "password": "secret", "phone": "not a number"}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected registering an invalid number to be refused, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestPhoneVerification(t *testing.T) {
+	svc := newStubService()
+	e, st := newTestEndpoints(svc)
+	router := MakeHTTPHandler(context.Background(), e, log.NewNopLogger())
+	do := func(path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/customers/"+testUserID+"/phone/"+path, strings.NewReader(body)))
+		return w
+	}
+
+	if w := do("verification", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("expected a customer without a phone number to be refused, got %d", w.Code)
+	}
+	u := svc.users[testUserID]
+	u.Phone = "+41446681800"
+	svc.users[testUserID] = u
+	if w := do("verification", ""); w.Code != http.StatusOK || len(svc.sms) != 1 || !strings.HasPrefix(svc.sms[0], "+41446681800: ") {
+		t.Fatalf("expected a code to be sent, got %d: %v", w.Code, svc.sms)
+	}
+	code := svc.sms[0][len(svc.sms[0])-phoneCodeDigits:]
+
+	if w := do("verification/confirm", `{"code": "wrong"}`); w.Code != http.StatusBadRequest || svc.users[testUserID].PhoneVerified {
+		t.Errorf("expected a wrong code to be refused, got %d", w.Code)
+	}
+	w := do("verification/confirm", `{"code": "`+code+`"}`)
+	var got dbOperations.User
+	json.NewDecoder(w.Body).Decode(&got)
+	if w.Code != http.StatusOK || !got.PhoneVerified {
+		t.Errorf("expected the phone number to be verified, got %d: %+v", w.Code, got)
+	}
+	if w := do("verification/confirm", `{"code": "`+code+`"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected a used code to be refused, got %d", w.Code)
+	}
+	if len(svc.events) != 1 || svc.events[0].Type != EventUserUpdated {
+		t.Errorf("expected an update event, got %+v", svc.events)
+	}
+	if last := st.entries[len(st.entries)-1]; last.Action != "user.phone.confirm" || last.Target != testUserID {
+		t.Errorf("expected the confirmation to be audited, got %+v", last)
+	}
+
+	u = svc.users[testUserID]
+	u.Phone = "+12125550100"
+	if err := svc.UpdateUser(&u, 0); err != nil || svc.users[testUserID].PhoneVerified {
+		t.Errorf("expected a new number to be unverified, got %+v: %v", svc.users[testUserID], err)
+	}
+}
+
+func TestHTTPSMSSender(t *testing.T) {
+	var got map[string]string
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	s := HTTPSMSSender{URL: srv.URL}
+	if err := s.SendSMS(context.Background(), "+41446681800", "Your verification code is 123456"); err != nil {
+		t.Fatal(err)
+	}
+	if got["to"] != "+41446681800" || got["text"] != "Your verification code is 123456" {
+		t.Errorf("unexpected message %v", got)
+	}
+	status = http.StatusBadGateway
+	err := s.SendSMS(context.Background(), "+41446681800", "Your verification code is 123456")
+	if err == nil || strings.Contains(err.Error(), "123456") || strings.Contains(err.Error(), "+41") {
+		t.Errorf("expected a failure naming neither number nor code, got %v", err)
+	}
+}
+
+func TestLogSMSSender(t *testing.T) {
+	var buf strings.Builder
+	s := LogSMSSender{Logger: log.NewLogfmtLogger(&buf)}
+	if err := s.SendSMS(context.Background(), "+41446681800", "Your verification code is 123456"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "+41446681800") || !strings.Contains(buf.String(), "123456") {
+		t.Errorf("expected the message in the log, got %q", buf.String())
+	}
+}
@@ -0,0 +1,426 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/user/dbOperations"
+	mgo "gopkg.in/mgo.v2"
+)
+
+var (
+	// ErrPolicyVersion is returned for the acceptance of a policy version
+	// that is not the latest one published, or of no published policy.
+	ErrPolicyVersion = errors.New("Not the current version of a policy")
+)
+
+// The channels acceptances are recorded on by the service itself.
+// Clients name their own when they post an acceptance.
+const (
+	ChannelRegister = "register"
+	ChannelLogin    = "login"
+	ChannelAPI      = "api"
+)
+
+var (
+	// policyName is what policy names and channels look like.
+	policyName = regexp.MustCompile(`^[a-z][a-z0-9-]{0,31}$`)
+	// policyVersion is what policy versions look like, as in "2024-05" or
+	// "3.1".
+	policyVersion = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,31}$`)
+)
+
+// ConsentRequiredError refuses a login or registration until the user
+// accepts the current versions of the mandatory policies it lists.
+type ConsentRequiredError struct {
+	Policies []dbOperations.Policy
+}
+
+func (e ConsentRequiredError) Error() string {
+	versions := make([]string, len(e.Policies))
+	for i, p := range e.Policies {
+		versions[i] = p.Name + ":" + p.Version
+	}
+	return "Consent required: accept " + strings.Join(versions, ", ")
+}
+
+// PolicyStore keeps the policies of the tenant and what users decided
+// about them. *dbOperations.Mongo implements it.
+type PolicyStore interface {
+	AcceptanceStore
+	GetUser(id string) (dbOperations.User, error)
+	CreatePolicy(p *dbOperations.Policy) error
+}
+
+// AcceptanceStore is what logins check the acceptances of users against,
+// and record those made as the user logs in to.
+type AcceptanceStore interface {
+	GetPolicies() ([]dbOperations.Policy, error)
+	AddAcceptance(a *dbOperations.Acceptance) error
+	GetAcceptances(userid string) ([]dbOperations.Acceptance, error)
+	AppendEvent(e *dbOperations.Event) error
+}
+
+// PolicyEndpoints mounts the endpoints publishing policies, which only
+// admins may use, and those recording the acceptances of customers. A
+// registration must accept the current version of every mandatory policy,
+// and a login must accept those published since the user last did.
+func PolicyEndpoints(e Endpoints, st PolicyStore) Endpoints {
+	e.RegisterEndpoint = requireRegisterConsent(st)(e.RegisterEndpoint)
+	e.LoginEndpoint = requireLoginConsent(st)(e.LoginEndpoint)
+	e.PoliciesGetEndpoint = MakePoliciesGetEndpoint(st)
+	e.PolicyPostEndpoint = RequireRole(RoleAdmin)(MakePolicyPostEndpoint(st))
+	e.ConsentsGetEndpoint = MakeConsentsGetEndpoint(st)
+	e.ConsentPostEndpoint = MakeConsentPostEndpoint(st)
+	e.ConsentDeleteEndpoint = MakeConsentDeleteEndpoint(st)
+	return e
+}
+
+// requireRegisterConsent refuses registrations that do not accept every
+// mandatory policy, and records the acceptances of those that go through.
+func requireRegisterConsent(st PolicyStore) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			req := request.(registerRequest)
+			policies, err := st.GetPolicies()
+			if err != nil {
+				return nil, err
+			}
+			if err := checkAccepted(policies, req.Accept); err != nil {
+				return nil, err
+			}
+			if missing := requiredPolicies(policies, acceptancesOf(req.Accept)); len(missing) > 0 {
+				return nil, ConsentRequiredError{missing}
+			}
+			response, err := next(ctx, request)
+			if err != nil {
+				return response, err
+			}
+			return response, recordAcceptances(st, newAcceptances(ctx, response.(postResponse).ID, ChannelRegister, req.Accept), actorFor(ctx, request))
+		}
+	}
+}
+
+// requireLoginConsent fails logins of users who have yet to accept a
+// mandatory policy version, unless the login accepts it.
+func requireLoginConsent(st PolicyStore) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			response, err := next(ctx, request)
+			if err != nil {
+				return response, err
+			}
+			req := request.(loginRequest)
+			u := response.(userResponse).User
+			if err := checkLoginConsent(ctx, st, u.UserID, req.Accept, actorFor(ctx, request)); err != nil {
+				return nil, err
+			}
+			return response, nil
+		}
+	}
+}
+
+// checkLoginConsent fails with ConsentRequiredError unless userid accepted
+// the current version of every mandatory policy, before or with accept,
+// and records the acceptances of accept. Every login goes through it: the
+// login endpoint, and the sign-in of the OpenID Connect provider, with a
+// password or an external identity.
+func checkLoginConsent(ctx context.Context, st AcceptanceStore, userid string, accept []policyRef, actor string) error {
+	policies, err := st.GetPolicies()
+	if err != nil {
+		return err
+	}
+	if err := checkAccepted(policies, accept); err != nil {
+		return err
+	}
+	acceptances, err := st.GetAcceptances(userid)
+	if err != nil {
+		return err
+	}
+	if missing := requiredPolicies(policies, append(acceptances, acceptancesOf(accept)...)); len(missing) > 0 {
+		return ConsentRequiredError{missing}
+	}
+	return recordAcceptances(st, newAcceptances(ctx, userid, ChannelLogin, accept), actor)
+}
+
+// MakePoliciesGetEndpoint returns an endpoint listing the current version
+// of every policy, or every version published if asked for all.
+func MakePoliciesGetEndpoint(st PolicyStore) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		policies, err := st.GetPolicies()
+		if err != nil {
+			return nil, err
+		}
+		if !request.(policiesRequest).All {
+			policies = currentPolicies(policies)
+		}
+		return policiesResponse{Policies: policies}, nil
+	}
+}
+
+// MakePolicyPostEndpoint returns an endpoint publishing a policy version,
+// which becomes the current one of its policy.
+func MakePolicyPostEndpoint(st PolicyStore) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		p := request.(dbOperations.Policy)
+		u, err := url.Parse(p.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, ErrInvalidRequest
+		}
+		if !policyName.MatchString(p.Name) || !policyVersion.MatchString(p.Version) {
+			return nil, ErrInvalidRequest
+		}
+		if p.Title == "" {
+			p.Title = p.Name
+		}
+		p.ID, p.Tenant = "", ""
+		p.PublishedAt = time.Now().UTC()
+		p.PublishedBy = actorFor(ctx, request)
+		if err := st.CreatePolicy(&p); err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+}
+
+// MakeConsentsGetEndpoint returns an endpoint returning every decision a
+// customer made about policies, and the mandatory versions they have yet
+// to accept.
+func MakeConsentsGetEndpoint(st PolicyStore) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		userid := request.(consentRequest).UserID
+		if _, err := st.GetUser(userid); err != nil {
+			return nil, err
+		}
+		return consentsFor(st, userid)
+	}
+}
+
+// MakeConsentPostEndpoint returns an endpoint recording that a customer
+// accepted the current versions of policies.
+func MakeConsentPostEndpoint(st PolicyStore) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(consentRequest)
+		if req.Channel == "" {
+			req.Channel = ChannelAPI
+		}
+		if len(req.Accept) == 0 || !policyName.MatchString(req.Channel) {
+			return nil, ErrInvalidRequest
+		}
+		if _, err := st.GetUser(req.UserID); err != nil {
+			return nil, err
+		}
+		policies, err := st.GetPolicies()
+		if err != nil {
+			return nil, err
+		}
+		if err := checkAccepted(policies, req.Accept); err != nil {
+			return nil, err
+		}
+		if err := recordAcceptances(st, newAcceptances(ctx, req.UserID, req.Channel, req.Accept), actorFor(ctx, request)); err != nil {
+			return nil, err
+		}
+		return consentsFor(st, req.UserID)
+	}
+}
+
+// MakeConsentDeleteEndpoint returns an endpoint withdrawing a customer's
+// acceptance of a policy. Withdrawing a mandatory policy keeps the
+// customer from logging in until they accept it again.
+func MakeConsentDeleteEndpoint(st PolicyStore) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(consentRequest)
+		if _, err := st.GetUser(req.UserID); err != nil {
+			return nil, err
+		}
+		acceptances, err := st.GetAcceptances(req.UserID)
+		if err != nil {
+			return nil, err
+		}
+		last, ok := latestAcceptances(acceptances)[req.Policy]
+		if !ok || last.Action != dbOperations.AcceptanceAccepted {
+			return nil, mgo.ErrNotFound
+		}
+		withdrawal := newAcceptances(ctx, req.UserID, ChannelAPI, []policyRef{{last.Policy, last.Version}})
+		withdrawal[0].Action = dbOperations.AcceptanceWithdrawn
+		if err := recordAcceptances(st, withdrawal, actorFor(ctx, request)); err != nil {
+			return nil, err
+		}
+		return consentsFor(st, req.UserID)
+	}
+}
+
+func consentsFor(st PolicyStore, userid string) (consentsResponse, error) {
+	policies, err := st.GetPolicies()
+	if err != nil {
+		return consentsResponse{}, err
+	}
+	acceptances, err := st.GetAcceptances(userid)
+	if err != nil {
+		return consentsResponse{}, err
+	}
+	return consentsResponse{Acceptances: acceptances, Required: requiredPolicies(policies, acceptances)}, nil
+}
+
+// checkAccepted returns ErrPolicyVersion unless every policy version in
+// accept is the current one of its policy.
+func checkAccepted(policies []dbOperations.Policy, accept []policyRef) error {
+	current := currentPolicies(policies)
+	for _, ref := range accept {
+		ok := false
+		for _, p := range current {
+			ok = ok || (p.Name == ref.Policy && p.Version == ref.Version)
+		}
+		if !ok {
+			return ErrPolicyVersion
+		}
+	}
+	return nil
+}
+
+// newAcceptances returns the acceptances by userid of the policy versions
+// in accept, made now by the caller of the request in ctx.
+func newAcceptances(ctx context.Context, userid, channel string, accept []policyRef) []dbOperations.Acceptance {
+	ri := RequestInfoFrom(ctx)
+	acceptances := make([]dbOperations.Acceptance, len(accept))
+	for i, ref := range accept {
+		acceptances[i] = dbOperations.Acceptance{
+			UserID:    userid,
+			Policy:    ref.Policy,
+			Version:   ref.Version,
+			Action:    dbOperations.AcceptanceAccepted,
+			At:        time.Now().UTC(),
+			IP:        ri.ClientIP,
+			UserAgent: ri.UserAgent,
+			Channel:   channel,
+		}
+	}
+	return acceptances
+}
+
+// recordAcceptances stores acceptances, each with the event announcing it.
+func recordAcceptances(st AcceptanceStore, acceptances []dbOperations.Acceptance, actor string) error {
+	for i := range acceptances {
+		a := &acceptances[i]
+		if err := st.AddAcceptance(a); err != nil {
+			return err
+		}
+		typ := EventPolicyAccepted
+		if a.Action == dbOperations.AcceptanceWithdrawn {
+			typ = EventPolicyWithdrawn
+		}
+		e, err := NewEvent(typ, a.UserID, a.EventPayload())
+		if err == nil {
+			e.Actor = actor
+			err = st.AppendEvent(&e)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// acceptancesOf returns accept as acceptances made now.
+func acceptancesOf(accept []policyRef) []dbOperations.Acceptance {
+	acceptances := make([]dbOperations.Acceptance, len(accept))
+	for i, ref := range accept {
+		acceptances[i] = dbOperations.Acceptance{Policy: ref.Policy, Version: ref.Version, Action: dbOperations.AcceptanceAccepted}
+	}
+	return acceptances
+}
+
+// currentPolicies returns the latest version of every policy, of policies
+// ordered by name and then oldest first.
+func currentPolicies(policies []dbOperations.Policy) []dbOperations.Policy {
+	current := make([]dbOperations.Policy, 0)
+	for i, p := range policies {
+		if i+1 == len(policies) || policies[i+1].Name != p.Name {
+			current = append(current, p)
+		}
+	}
+	return current
+}
+
+// latestAcceptances returns the last decision of acceptances, oldest
+// first, about every policy.
+func latestAcceptances(acceptances []dbOperations.Acceptance) map[string]dbOperations.Acceptance {
+	latest := make(map[string]dbOperations.Acceptance)
+	for _, a := range acceptances {
+		latest[a.Policy] = a
+	}
+	return latest
+}
+
+// requiredPolicies returns the current versions of the policies, ordered
+// by name and then oldest first, whose latest mandatory version has not
+// been accepted: the user's last decision about the policy is not the
+// acceptance of that version or a later one.
+func requiredPolicies(policies []dbOperations.Policy, acceptances []dbOperations.Acceptance) []dbOperations.Policy {
+	latest := latestAcceptances(acceptances)
+	required := make([]dbOperations.Policy, 0)
+	mandatory, accepted := false, false
+	for i, p := range policies {
+		if i == 0 || policies[i-1].Name != p.Name {
+			mandatory, accepted = false, false
+		}
+		if p.Mandatory {
+			mandatory, accepted = true, false
+		}
+		if a, ok := latest[p.Name]; ok && a.Action == dbOperations.AcceptanceAccepted && a.Version == p.Version {
+			accepted = true
+		}
+		if mandatory && !accepted && (i+1 == len(policies) || policies[i+1].Name != p.Name) {
+			required = append(required, p)
+		}
+	}
+	return required
+}
+
+// policyRef names a policy version a user accepts.
+type policyRef struct {
+	Policy  string `json:"policy"`
+	Version string `json:"version"`
+}
+
+// parsePolicyRefs reads policy versions written as policy:version.
+func parsePolicyRefs(values []string) ([]policyRef, error) {
+	var refs []policyRef
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			parts := strings.SplitN(strings.TrimSpace(s), ":", 2)
+			if len(parts) != 2 {
+				return nil, ErrInvalidRequest
+			}
+			refs = append(refs, policyRef{parts[0], parts[1]})
+		}
+	}
+	return refs, nil
+}
+
+type policiesRequest struct {
+	All bool
+}
+
+type policiesResponse struct {
+	Policies []dbOperations.Policy `json:"policies"`
+}
+
+type consentRequest struct {
+	UserID  string      `json:"-"`
+	Policy  string      `json:"-"`
+	Accept  []policyRef `json:"accept"`
+	Channel string      `json:"channel"`
+}
+
+type consentsResponse struct {
+	Acceptances []dbOperations.Acceptance `json:"acceptances"`
+	// Required are the current versions of the mandatory policies the
+	// customer has yet to accept.
+	Required []dbOperations.Policy `json:"required"`
+}
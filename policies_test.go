@@ -0,0 +1,267 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/user/dbOperations"
+)
+
+func TestRequiredPolicies(t *testing.T) {
+	policies := []dbOperations.Policy{
+		{Name: "marketing", Version: "1"},
+		{Name: "privacy", Version: "1", Mandatory: true},
+		{Name: "terms", Version: "1", Mandatory: true},
+		{Name: "terms", Version: "2", Mandatory: true},
+		{Name: "terms", Version: "2.1"},
+	}
+	accepted := func(policy, version string) dbOperations.Acceptance {
+		return dbOperations.Acceptance{Policy: policy, Version: version, Action: dbOperations.AcceptanceAccepted}
+	}
+	names := func(ps []dbOperations.Policy) []string {
+		names := []string{}
+		for _, p := range ps {
+			names = append(names, p.Name+":"+p.Version)
+		}
+		return names
+	}
+	for _, c := range []struct {
+		acceptances []dbOperations.Acceptance
+		want        []string
+	}{
+		{nil, []string{"privacy:1", "terms:2.1"}},
+		{[]dbOperations.Acceptance{accepted("privacy", "1"), accepted("terms", "1")}, []string{"terms:2.1"}},
+		{[]dbOperations.Acceptance{accepted("privacy", "1"), accepted("terms", "2")}, []string{}},
+		{[]dbOperations.Acceptance{accepted("privacy", "1"), accepted("terms", "2.1")}, []string{}},
+		{[]dbOperations.Acceptance{accepted("privacy", "1"), accepted("terms", "2"), {Policy: "privacy", Version: "1", Action: dbOperations.AcceptanceWithdrawn}}, []string{"privacy:1"}},
+	} {
+		if got := names(requiredPolicies(policies, c.acceptances)); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%+v: expected %v to be required, got %v", c.acceptances, c.want, got)
+		}
+	}
+	if got := names(currentPolicies(policies)); !reflect.DeepEqual(got, []string{"marketing:1", "privacy:1", "terms:2.1"}) {
+		t.Errorf("expected the latest version of every policy, got %v", got)
+	}
+}
+
+func TestParsePolicyRefs(t *testing.T) {
+	got, err := parsePolicyRefs([]string{"terms:2,privacy:2024-05", "marketing:1"})
+	want := []policyRef{{"terms", "2"}, {"privacy", "2024-05"}, {"marketing", "1"}}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v: %v", want, got, err)
+	}
+	if _, err := parsePolicyRefs([]string{"terms"}); err != ErrInvalidRequest {
+		t.Errorf("expected a policy without a version to be refused, got %v", err)
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	svc := newStubService()
+	e, st := newTestEndpoints(svc)
+	router := MakeHTTPHandler(context.Background(), e, log.NewNopLogger())
+	do := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	publish := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/policies", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+testAdminToken)
+		return do(r)
+	}
+	login := func(query string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/login"+query, nil)
+		r.SetBasicAuth("eve", "secret")
+		r.RemoteAddr = "203.0.113.7:1234"
+		return do(r)
+	}
+	consents := func() consentsResponse {
+		var got consentsResponse
+		json.NewDecoder(do(httptest.NewRequest("GET", "/customers/"+testUserID+"/consents", nil)).Body).Decode(&got)
+		return got
+	}
+
+	if w := do(httptest.NewRequest("POST", "/policies", strings.NewReader(`{"name": "terms", "version": "1", "url": "https://example.com/terms/1"}`))); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected publishing to need an admin, got %d", w.Code)
+	}
+	for _, body := range []string{
+		`{"name": "Terms", "version": "1", "url": "https://example.com/terms"}`,
+		`{"name": "terms", "version": "1 final", "url": "https://example.com/terms"}`,
+		`{"name": "terms", "version": "1", "url": "example.com/terms"}`,
+	} {
+		if w := publish(body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, w.Code)
+		}
+	}
+	if w := publish(`{"name": "terms", "version": "1", "url": "https://example.com/terms/1", "mandatory": true}`); w.Code != http.StatusOK {
+		t.Fatalf("expected the policy to be published, got %d: %s", w.Code, w.Body)
+	}
+	if w := publish(`{"name": "terms", "version": "1", "url": "https://example.com/terms/1"}`); w.Code != http.StatusConflict {
+		t.Errorf("expected a version to be published once, got %d", w.Code)
+	}
+	publish(`{"name": "marketing", "version": "1", "url": "https://example.com/marketing/1"}`)
+
+	register := func(body string) *httptest.ResponseRecorder {
+		return do(httptest.NewRequest("POST", "/register", strings.NewReader(body)))
+	}
+	if w := register(`{"username": "bob", "password": "secret"}`); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "terms:1") {
+		t.Errorf("expected a registration without consent to be refused, got %d: %s", w.Code, w.Body)
+	}
+	if w := register(`{"username": "bob", "password": "secret", "accept": [{"policy": "terms", "version": "0"}]}`); w.Code != http.StatusConflict {
+		t.Errorf("expected the acceptance of an unpublished version to be refused, got %d: %s", w.Code, w.Body)
+	}
+	if w := register(`{"username": "bob", "password": "secret", "accept": [{"policy": "terms", "version": "1"}, {"policy": "marketing", "version": "1"}]}`); w.Code != http.StatusOK {
+		t.Fatalf("expected the registration to succeed, got %d: %s", w.Code, w.Body)
+	}
+	if len(svc.acceptances) != 2 || svc.acceptances[0].Channel != ChannelRegister || svc.acceptances[0].UserID != "57a98d98e4b00679b4a830b1" {
+		t.Errorf("expected the acceptances to be recorded, got %+v", svc.acceptances)
+	}
+
+	if w := login(""); w.Code != http.StatusForbidden {
+		t.Errorf("expected a login without consent to the mandatory policy to be refused, got %d", w.Code)
+	}
+	if w := login("?accept=terms:1"); w.Code != http.StatusOK {
+		t.Fatalf("expected a login accepting the policy to succeed, got %d: %s", w.Code, w.Body)
+	}
+	got := consents()
+	if n := len(got.Acceptances); n != 1 || got.Acceptances[0].Channel != ChannelLogin || got.Acceptances[0].IP != "203.0.113.7" || len(got.Required) != 0 {
+		t.Errorf("expected the acceptance at login to be recorded, got %+v", got)
+	}
+	if w := login(""); w.Code != http.StatusOK {
+		t.Errorf("expected a login to succeed once the policy is accepted, got %d", w.Code)
+	}
+
+	publish(`{"name": "terms", "version": "2", "url": "https://example.com/terms/2", "mandatory": true}`)
+	if w := login(""); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "terms:2") {
+		t.Errorf("expected a new mandatory version to be accepted first, got %d: %s", w.Code, w.Body)
+	}
+	if got := consents(); len(got.Required) != 1 || got.Required[0].Version != "2" {
+		t.Errorf("expected the new version to be required, got %+v", got.Required)
+	}
+	r := httptest.NewRequest("POST", "/customers/"+testUserID+"/consents", strings.NewReader(`{"accept": [{"policy": "terms", "version": "1"}]}`))
+	if w := do(r); w.Code != http.StatusConflict {
+		t.Errorf("expected the acceptance of an old version to be refused, got %d", w.Code)
+	}
+	r = httptest.NewRequest("POST", "/customers/"+testUserID+"/consents", strings.NewReader(`{"accept": [{"policy": "terms", "version": "2"}], "channel": "checkout"}`))
+	if w := do(r); w.Code != http.StatusOK {
+		t.Fatalf("expected the acceptance to be recorded, got %d: %s", w.Code, w.Body)
+	}
+	if w := login(""); w.Code != http.StatusOK {
+		t.Errorf("expected a login to succeed once the new version is accepted, got %d", w.Code)
+	}
+
+	if w := do(httptest.NewRequest("DELETE", "/customers/"+testUserID+"/consents/marketing", nil)); w.Code != http.StatusNotFound {
+		t.Errorf("expected withdrawing a policy never accepted to fail, got %d", w.Code)
+	}
+	if w := do(httptest.NewRequest("DELETE", "/customers/"+testUserID+"/consents/terms", nil)); w.Code != http.StatusOK {
+		t.Fatalf("expected the withdrawal to be recorded, got %d: %s", w.Code, w.Body)
+	}
+	got = consents()
+	if last := got.Acceptances[len(got.Acceptances)-1]; last.Action != dbOperations.AcceptanceWithdrawn || last.Version != "2" || len(got.Required) != 1 {
+		t.Errorf("expected the withdrawal in the history, got %+v", got)
+	}
+	if w := login(""); w.Code != http.StatusForbidden {
+		t.Errorf("expected a login after withdrawing a mandatory policy to be refused, got %d", w.Code)
+	}
+
+	var current policiesResponse
+	json.NewDecoder(do(httptest.NewRequest("GET", "/policies", nil)).Body).Decode(&current)
+	var all policiesResponse
+	json.NewDecoder(do(httptest.NewRequest("GET", "/policies?all=true", nil)).Body).Decode(&all)
+	if len(current.Policies) != 2 || current.Policies[1].Version != "2" || len(all.Policies) != 3 {
+		t.Errorf("expected the current and all versions, got %+v and %+v", current, all)
+	}
+
+	var export exportResponse
+	json.NewDecoder(do(adminRequest("GET", "/customers/"+testUserID+"/export")).Body).Decode(&export)
+	if len(export.Acceptances) != len(got.Acceptances) {
+		t.Errorf("expected the consent history in the export, got %+v", export.Acceptances)
+	}
+	var accepted, withdrawn int
+	for _, ev := range svc.events {
+		if strings.Contains(string(ev.Payload), `"ip"`) {
+			t.Errorf("expected no IP in the payload, got %s", ev.Payload)
+		}
+		switch ev.Type {
+		case EventPolicyAccepted:
+			accepted++
+		case EventPolicyWithdrawn:
+			withdrawn++
+		}
+	}
+	if accepted != 4 || withdrawn != 1 {
+		t.Errorf("expected an event per decision, got %d acceptances and %d withdrawals", accepted, withdrawn)
+	}
+	audited := map[string]string{}
+	for _, entry := range st.entries {
+		audited[entry.Action] = entry.Target
+	}
+	if audited["policy.publish"] != "terms:2" || audited["user.consent.accept"] != testUserID || audited["user.consent.withdraw"] != testUserID {
+		t.Errorf("expected publications and decisions to be audited, got %v", audited)
+	}
+}
+
+func TestSignInRequiresConsent(t *testing.T) {
+	svc := newStubService()
+	svc.CreatePolicy(&dbOperations.Policy{Name: "terms", Version: "1", Title: "Terms", Mandatory: true})
+	e, _ := newTestEndpoints(svc)
+	router := MakeHTTPHandler(context.Background(), e, log.NewNopLogger())
+	rp := registerTestClient(t, router)
+	browser := newUpstreamBrowser(t, router, newFakeUpstream())
+	post := func(form url.Values) *http.Response {
+		resp, err := browser.client.PostForm(testIssuer+"/oauth2/authorize", form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	decide := func(authorize, ticket string, accept ...string) *http.Response {
+		u, _ := url.Parse(authorize)
+		form := u.Query()
+		form.Set("ticket", ticket)
+		form.Set("decision", "allow")
+		form["accept"] = accept
+		return post(form)
+	}
+
+	// Signing in with a password asks for the policy along with the scopes.
+	authorize := rp.authorizeURL("openid", "")
+	u, _ := url.Parse(authorize)
+	form := u.Query()
+	form.Set("username", "eve")
+	form.Set("password", "secret")
+	page := readBody(post(form))
+	ticket := ticketField.FindStringSubmatch(page)
+	if ticket == nil || !strings.Contains(page, `name="accept" value="terms:1"`) {
+		t.Fatalf("expected the consent page to ask for the policy: %s", page)
+	}
+	resp := decide(authorize, ticket[1])
+	if page := readBody(resp); resp.StatusCode != http.StatusForbidden || !strings.Contains(page, "Accept the policies") || !ticketField.MatchString(page) {
+		t.Fatalf("expected the consent page again without the policy accepted, got %d: %s", resp.StatusCode, page)
+	}
+	resp = decide(authorize, ticket[1], "terms:1")
+	if location, _ := url.Parse(resp.Header.Get("Location")); resp.StatusCode != http.StatusFound || location.Query().Get("code") == "" {
+		t.Fatalf("expected a code once the policy is accepted, got %d: %s", resp.StatusCode, location)
+	}
+	if len(svc.acceptances) != 1 || svc.acceptances[0].UserID != testUserID || svc.acceptances[0].Channel != ChannelLogin {
+		t.Errorf("expected the acceptance to be recorded, got %+v", svc.acceptances)
+	}
+
+	// So does signing in with an external identity.
+	authorize = rp.authorizeURL("openid", "")
+	page = readBody(browser.externalLogin(authorize, "mallory"))
+	ticket = ticketField.FindStringSubmatch(page)
+	if ticket == nil || !strings.Contains(page, `name="accept" value="terms:1"`) {
+		t.Fatalf("expected the consent page to ask for the policy: %s", page)
+	}
+	if resp := decide(authorize, ticket[1]); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected an external login without the policy accepted to be refused, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,316 @@
+package user
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"time"
+	// The time zones are embedded so that they are checked the same
+	// wherever the service runs.
+	_ "time/tzdata"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/user/dbOperations"
+)
+
+// The types a custom attribute can have.
+const (
+	AttributeString  = "string"
+	AttributeNumber  = "number"
+	AttributeInteger = "integer"
+	AttributeBoolean = "boolean"
+)
+
+// AttributeTypes are the types a custom attribute can have.
+var AttributeTypes = []string{AttributeString, AttributeNumber, AttributeInteger, AttributeBoolean}
+
+// AttributeDef is what the values of a custom attribute must be.
+type AttributeDef struct {
+	Type string `json:"type"`
+	// Enum lists the values a string can have, any if it is empty.
+	Enum []string `json:"enum,omitempty"`
+	// Pattern is a regular expression strings must match as a whole.
+	Pattern   string `json:"pattern,omitempty"`
+	MaxLength int    `json:"maxLength,omitempty"`
+	// Minimum and Maximum bound numbers and integers.
+	Minimum *float64 `json:"minimum,omitempty"`
+	Maximum *float64 `json:"maximum,omitempty"`
+	// Indexed attributes are indexed for looking users up by them.
+	Indexed bool `json:"indexed,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// AttributeSchema is the custom attributes users can have, by name.
+type AttributeSchema map[string]*AttributeDef
+
+// AttributeSchemas are the attribute schemas of the tenants, by tenant id.
+// The schema of "*" is that of the tenants without their own.
+type AttributeSchemas map[string]AttributeSchema
+
+// attributeName is what custom attribute names look like, so that they
+// can be stored and looked up as they are.
+var attributeName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]{0,63}$`)
+
+// ParseAttributeSchemas reads a JSON object of the attribute schemas of
+// the tenants, as in {"acme": {"shoeSize": {"type": "integer"}}}.
+func ParseAttributeSchemas(data []byte) (AttributeSchemas, error) {
+	var schemas AttributeSchemas
+	if err := json.Unmarshal(data, &schemas); err != nil {
+		return nil, err
+	}
+	for tenant, schema := range schemas {
+		for name, def := range schema {
+			if !attributeName.MatchString(name) || def == nil || !contains(AttributeTypes, def.Type) {
+				return nil, fmt.Errorf("attribute %q of tenant %q needs a name of letters, digits and underscores and one of the types %s", name, tenant, strings.Join(AttributeTypes, ", "))
+			}
+			if def.Pattern != "" {
+				var err error
+				if def.pattern, err = regexp.Compile("^(?:" + def.Pattern + ")$"); err != nil {
+					return nil, fmt.Errorf("attribute %q of tenant %q: %v", name, tenant, err)
+				}
+			}
+		}
+	}
+	return schemas, nil
+}
+
+// For returns the attribute schema of tenant.
+func (s AttributeSchemas) For(tenant string) AttributeSchema {
+	if schema, ok := s[tenant]; ok {
+		return schema
+	}
+	return s["*"]
+}
+
+// Indexed returns the names of the attributes indexed by any tenant.
+func (s AttributeSchemas) Indexed() []string {
+	var names []string
+	for _, schema := range s {
+		for name, def := range schema {
+			if def.Indexed && !contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// PreferencesError is preferences or custom attributes refused for what is
+// wrong with Field, named as in the API.
+type PreferencesError struct {
+	Field   string
+	Problem string
+}
+
+func (e PreferencesError) Error() string {
+	return "Invalid " + e.Field + ": " + e.Problem
+}
+
+// validate returns the problem with v as a value of d, if any. Numbers
+// are float64, as JSON decodes them.
+func (d *AttributeDef) validate(v interface{}) string {
+	switch d.Type {
+	case AttributeString:
+		s, ok := v.(string)
+		switch {
+		case !ok:
+			return "must be a string"
+		case len(d.Enum) > 0 && !contains(d.Enum, s):
+			return "must be one of " + strings.Join(d.Enum, ", ")
+		case d.MaxLength > 0 && len([]rune(s)) > d.MaxLength:
+			return fmt.Sprintf("must be at most %d characters long", d.MaxLength)
+		case d.pattern != nil && !d.pattern.MatchString(s):
+			return "must match " + d.Pattern
+		}
+	case AttributeNumber, AttributeInteger:
+		f, ok := v.(float64)
+		switch {
+		case !ok:
+			return "must be a number"
+		case d.Type == AttributeInteger && f != math.Trunc(f):
+			return "must be an integer"
+		case d.Minimum != nil && f < *d.Minimum:
+			return fmt.Sprintf("must be at least %v", *d.Minimum)
+		case d.Maximum != nil && f > *d.Maximum:
+			return fmt.Sprintf("must be at most %v", *d.Maximum)
+		}
+	case AttributeBoolean:
+		if _, ok := v.(bool); !ok {
+			return "must be true or false"
+		}
+	}
+	return ""
+}
+
+var (
+	// localeTag is what a BCP 47 language tag looks like: a language,
+	// then subtags such as its script and region.
+	localeTag = regexp.MustCompile(`^[a-zA-Z]{2,3}(?:-[a-zA-Z0-9]{1,8})*$`)
+	// currencyCode is what an ISO 4217 currency code looks like.
+	currencyCode = regexp.MustCompile(`^[A-Z]{3}$`)
+)
+
+// normalizePreferences writes the locale and currency of p in their usual
+// case, and returns what is wrong with p or attrs as schema has them.
+func normalizePreferences(p *dbOperations.Preferences, attrs map[string]interface{}, schema AttributeSchema) error {
+	if p.Locale != "" {
+		if !localeTag.MatchString(p.Locale) {
+			return PreferencesError{"locale", "must be a BCP 47 language tag, as in de-CH"}
+		}
+		tags := strings.Split(p.Locale, "-")
+		tags[0] = strings.ToLower(tags[0])
+		for i := 1; i < len(tags); i++ {
+			switch len(tags[i]) {
+			case 2:
+				tags[i] = strings.ToUpper(tags[i])
+			case 4:
+				tags[i] = strings.ToUpper(tags[i][:1]) + strings.ToLower(tags[i][1:])
+			}
+		}
+		p.Locale = strings.Join(tags, "-")
+	}
+	if p.Currency = strings.ToUpper(p.Currency); p.Currency != "" && !currencyCode.MatchString(p.Currency) {
+		return PreferencesError{"currency", "must be an ISO 4217 currency code, as in CHF"}
+	}
+	if p.Timezone != "" {
+		if _, err := time.LoadLocation(p.Timezone); err != nil || p.Timezone == "Local" {
+			return PreferencesError{"timezone", "must be an IANA time zone, as in Europe/Zurich"}
+		}
+	}
+	for name, v := range attrs {
+		def, ok := schema[name]
+		if !ok {
+			return PreferencesError{"attributes." + name, "is not an attribute of the tenant"}
+		}
+		if problem := def.validate(v); problem != "" {
+			return PreferencesError{"attributes." + name, problem}
+		}
+	}
+	return nil
+}
+
+// PreferencesStore keeps the preferences and custom attributes of users.
+// *dbOperations.Mongo implements it.
+type PreferencesStore interface {
+	GetUser(id string) (dbOperations.User, error)
+	UpdatePreferences(userid string, p dbOperations.Preferences, attributes map[string]interface{}, version int64) (int64, error)
+	AppendEvent(e *dbOperations.Event) error
+}
+
+// PreferencesEndpoints mounts the endpoints reading and changing the
+// preferences of customers, and their custom attributes as schema has
+// them.
+func PreferencesEndpoints(e Endpoints, st PreferencesStore, schema AttributeSchema) Endpoints {
+	e.PreferencesGetEndpoint = MakePreferencesGetEndpoint(st)
+	e.PreferencesPatchEndpoint = MakePreferencesPatchEndpoint(st, schema)
+	return e
+}
+
+// MakePreferencesGetEndpoint returns an endpoint returning the preferences
+// and custom attributes of a customer.
+func MakePreferencesGetEndpoint(st PreferencesStore) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		u, err := st.GetUser(request.(preferencesRequest).UserID)
+		if err != nil {
+			return nil, err
+		}
+		return preferencesFor(u), nil
+	}
+}
+
+// MakePreferencesPatchEndpoint returns an endpoint applying a JSON merge
+// patch (RFC 7396) to the preferences and custom attributes of a customer,
+// and answering with the result. Attributes patched to null are removed.
+// Without an If-Match the version read here guards against concurrent
+// changes.
+func MakePreferencesPatchEndpoint(st PreferencesStore, schema AttributeSchema) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(preferencesRequest)
+		u, err := st.GetUser(req.UserID)
+		if err != nil {
+			return nil, err
+		}
+		version, err := req.IfMatch.at(u.Version)
+		if err != nil {
+			return nil, err
+		}
+		cur := preferencesFor(u)
+		doc, err := json.Marshal(cur)
+		if err != nil {
+			return nil, err
+		}
+		var target interface{}
+		if err := json.Unmarshal(doc, &target); err != nil {
+			return nil, err
+		}
+		patched, err := json.Marshal(mergePatch(target, req.Patch))
+		if err != nil {
+			return nil, err
+		}
+		next := preferencesResponse{}
+		dec := json.NewDecoder(bytes.NewReader(patched))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&next); err != nil {
+			return nil, ErrInvalidRequest
+		}
+		if err := normalizePreferences(&next.Preferences, next.Attributes, schema); err != nil {
+			return nil, err
+		}
+		if next.version, err = st.UpdatePreferences(u.UserID, next.Preferences, next.Attributes, version); err != nil {
+			return nil, err
+		}
+		u.Preferences, u.Attributes, u.Version = next.Preferences, next.Attributes, next.version
+		e, err := NewEvent(EventUserUpdated, u.UserID, u.EventPayload())
+		if err == nil {
+			e.Actor = actorFor(ctx, request)
+			err = st.AppendEvent(&e)
+		}
+		return next, err
+	}
+}
+
+// mergePatch applies the JSON merge patch patch to target, both as
+// encoding/json decodes into interface{}.
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
+
+func preferencesFor(u dbOperations.User) preferencesResponse {
+	attrs := u.Attributes
+	if attrs == nil {
+		attrs = map[string]interface{}{}
+	}
+	return preferencesResponse{Preferences: u.Preferences, Attributes: attrs, version: u.Version}
+}
+
+type preferencesRequest struct {
+	UserID  string
+	Patch   interface{}
+	IfMatch ifMatch
+}
+
+type preferencesResponse struct {
+	Preferences dbOperations.Preferences `json:"preferences"`
+	Attributes  map[string]interface{}   `json:"attributes"`
+	version     int64
+}
@@ -0,0 +1,145 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/user/dbOperations"
+)
+
+func TestParseAttributeSchemas(t *testing.T) {
+	schemas, err := ParseAttributeSchemas([]byte(`{
+		"*": {"shoeSize": {"type": "integer", "indexed": true}},
+		"acme": {"badge": {"type": "string", "pattern": "[A-Z]{3}"}, "shoeSize": {"type": "number", "indexed": true}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := schemas.For("globex")["shoeSize"]; !ok {
+		t.Errorf("expected a tenant without a schema to get the default one, got %v", schemas.For("globex"))
+	}
+	if _, ok := schemas.For("acme")["badge"]; !ok {
+		t.Errorf("expected a tenant to get its own schema, got %v", schemas.For("acme"))
+	}
+	if got := schemas.Indexed(); !reflect.DeepEqual(got, []string{"shoeSize"}) {
+		t.Errorf("expected shoeSize to be indexed once, got %v", got)
+	}
+	if len(testAttributeSchemas.For(dbOperations.DefaultTenant)) != 4 {
+		t.Errorf("expected the test schema to parse, got %v", testAttributeSchemas)
+	}
+	for _, data := range []string{
+		`{"*": {"shoe size": {"type": "integer"}}}`,
+		`{"*": {"shoeSize": {"type": "float"}}}`,
+		`{"*": {"shoeSize": null}}`,
+		`{"*": {"badge": {"type": "string", "pattern": "[A-Z"}}}`,
+		`[]`,
+	} {
+		if _, err := ParseAttributeSchemas([]byte(data)); err == nil {
+			t.Errorf("expected %s to be refused", data)
+		}
+	}
+}
+
+func TestNormalizePreferences(t *testing.T) {
+	schema := testAttributeSchemas.For(dbOperations.DefaultTenant)
+	p := dbOperations.Preferences{Locale: "DE-latn-ch", Currency: "chf", Timezone: "Europe/Zurich"}
+	if err := normalizePreferences(&p, nil, schema); err != nil || p.Locale != "de-Latn-CH" || p.Currency != "CHF" {
+		t.Errorf("expected the preferences in their usual case, got %+v: %v", p, err)
+	}
+	for _, c := range []struct {
+		p     dbOperations.Preferences
+		attrs map[string]interface{}
+		field string
+	}{
+		{dbOperations.Preferences{Locale: "de_CH"}, nil, "locale"},
+		{dbOperations.Preferences{Currency: "Swiss francs"}, nil, "currency"},
+		{dbOperations.Preferences{Timezone: "Europe/Atlantis"}, nil, "timezone"},
+		{dbOperations.Preferences{Timezone: "Local"}, nil, "timezone"},
+		{dbOperations.Preferences{}, map[string]interface{}{"hatSize": 7.0}, "attributes.hatSize"},
+		{dbOperations.Preferences{}, map[string]interface{}{"shoeSize": "42"}, "attributes.shoeSize"},
+		{dbOperations.Preferences{}, map[string]interface{}{"shoeSize": 42.5}, "attributes.shoeSize"},
+		{dbOperations.Preferences{}, map[string]interface{}{"shoeSize": 60.0}, "attributes.shoeSize"},
+		{dbOperations.Preferences{}, map[string]interface{}{"loyaltyTier": "platinum"}, "attributes.loyaltyTier"},
+		{dbOperations.Preferences{}, map[string]interface{}{"memberNo": "M12345"}, "attributes.memberNo"},
+		{dbOperations.Preferences{}, map[string]interface{}{"newsletter": "yes"}, "attributes.newsletter"},
+	} {
+		err := normalizePreferences(&c.p, c.attrs, schema)
+		if pe, ok := err.(PreferencesError); !ok || pe.Field != c.field {
+			t.Errorf("%+v %v: expected %s to be refused, got %v", c.p, c.attrs, c.field, err)
+		}
+	}
+	attrs := map[string]interface{}{"shoeSize": 42.0, "loyaltyTier": "gold", "memberNo": "M123456", "newsletter": false}
+	if err := normalizePreferences(&dbOperations.Preferences{}, attrs, schema); err != nil {
+		t.Errorf("expected valid attributes to be kept, got %v", err)
+	}
+}
+
+func TestPreferences(t *testing.T) {
+	svc := newStubService()
+	e, st := newTestEndpoints(svc)
+	router := MakeHTTPHandler(context.Background(), e, log.NewNopLogger())
+	do := func(method, body, ifMatch string) (*httptest.ResponseRecorder, preferencesResponse) {
+		r := httptest.NewRequest(method, "/customers/"+testUserID+"/preferences", strings.NewReader(body))
+		if ifMatch != "" {
+			r.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		var got preferencesResponse
+		json.Unmarshal(w.Body.Bytes(), &got)
+		return w, got
+	}
+
+	w, got := do("GET", "", "")
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != `"3"` || got.Attributes == nil {
+		t.Fatalf("expected empty preferences, got %d %s: %s", w.Code, w.Header().Get("ETag"), w.Body)
+	}
+
+	w, got = do("PATCH", `{"preferences": {"locale": "de-ch", "currency": "chf", "marketing": {"email": true}}, "attributes": {"shoeSize": 42, "loyaltyTier": "gold"}}`, `"3"`)
+	want := dbOperations.Preferences{Locale: "de-CH", Currency: "CHF", Marketing: dbOperations.MarketingOptIns{Email: true}}
+	if w.Code != http.StatusOK || got.Preferences != want || got.Attributes["shoeSize"] != 42.0 || w.Header().Get("ETag") != `"4"` {
+		t.Fatalf("expected the patch to be applied, got %d %s: %s", w.Code, w.Header().Get("ETag"), w.Body)
+	}
+	if u := svc.users[testUserID]; u.Preferences != want || u.Attributes["loyaltyTier"] != "gold" {
+		t.Errorf("expected the preferences to be stored, got %+v %v", u.Preferences, u.Attributes)
+	}
+
+	w, got = do("PATCH", `{"preferences": {"locale": null, "marketing": {"sms": true}}, "attributes": {"loyaltyTier": null}}`, "")
+	want = dbOperations.Preferences{Currency: "CHF", Marketing: dbOperations.MarketingOptIns{Email: true, SMS: true}}
+	if w.Code != http.StatusOK || got.Preferences != want || !reflect.DeepEqual(got.Attributes, map[string]interface{}{"shoeSize": 42.0}) {
+		t.Errorf("expected the members patched to null to be removed, got %d: %s", w.Code, w.Body)
+	}
+
+	for _, c := range []struct {
+		body, ifMatch string
+		code          int
+	}{
+		{`{"attributes": {"shoeSize": 99}}`, "", http.StatusBadRequest},
+		{`{"attributes": {"hatSize": 7}}`, "", http.StatusBadRequest},
+		{`{"preferences": {"timezone": "Mars/Olympus"}}`, "", http.StatusBadRequest},
+		{`{"preferences": {"colour": "blue"}}`, "", http.StatusBadRequest},
+		{`"dark mode"`, "", http.StatusBadRequest},
+		{`{"preferences":`, "", http.StatusBadRequest},
+		{`{"preferences": {"currency": "EUR"}}`, `"4"`, http.StatusPreconditionFailed},
+	} {
+		if w, _ := do("PATCH", c.body, c.ifMatch); w.Code != c.code {
+			t.Errorf("%s: expected %d, got %d: %s", c.body, c.code, w.Code, w.Body)
+		}
+	}
+	if svc.users[testUserID].Preferences != want {
+		t.Errorf("expected refused patches to change nothing, got %+v", svc.users[testUserID].Preferences)
+	}
+
+	if len(svc.events) != 2 || svc.events[1].Type != EventUserUpdated {
+		t.Errorf("expected an update event per patch, got %+v", svc.events)
+	}
+	if last := st.entries[len(st.entries)-1]; last.Action != "user.preferences" || last.Target != testUserID {
+		t.Errorf("expected the patch to be audited, got %+v", last)
+	}
+}
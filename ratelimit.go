@@ -0,0 +1,336 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+)
+
+// ErrRateLimited is returned when a caller has used up its rate limit.
+var ErrRateLimited = errors.New("Too many requests")
+
+// The kinds of callers a RateLimitRule can be given for.
+const (
+	rateLimitIP     = "ip"
+	rateLimitUser   = "user"
+	rateLimitAPIKey = "apikey"
+)
+
+// RateLimitRule limits the calls to Route, or to every route together if
+// it is empty, by each caller matching Principal. Routes are named as the
+// router knows them, "GET /customers/{id}/export", or by their gRPC method.
+// Principal is "ip" for every call by its client address, "user" for users
+// and tokens, "apikey" for API keys, a principal id such as "apikey:<id>"
+// or "ip:<address>", or empty for every caller. Calls are counted by their
+// client address before they are authenticated, so that failed attempts
+// count too, and by their principal after. Each caller gets a token bucket of Burst calls, Limit
+// if zero, refilled at Limit calls per Period.
+type RateLimitRule struct {
+	Route     string
+	Principal string
+	Limit     int
+	Period    time.Duration
+	Burst     int
+}
+
+// capacity is the size of the rule's token buckets.
+func (r RateLimitRule) capacity() int {
+	if r.Burst > 0 {
+		return r.Burst
+	}
+	return r.Limit
+}
+
+// ParseRateLimits reads a JSON array of rules, with periods such as "1m".
+func ParseRateLimits(data []byte) ([]RateLimitRule, error) {
+	var raw []struct {
+		Route     string `json:"route"`
+		Principal string `json:"principal"`
+		Limit     int    `json:"limit"`
+		Period    string `json:"period"`
+		Burst     int    `json:"burst"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	rules := make([]RateLimitRule, 0, len(raw))
+	for _, r := range raw {
+		period, err := time.ParseDuration(r.Period)
+		if err != nil || period <= 0 || r.Limit <= 0 || r.Burst < 0 {
+			return nil, fmt.Errorf("rate limit %q for %q needs a positive limit and period", r.Route, r.Principal)
+		}
+		rules = append(rules, RateLimitRule{Route: r.Route, Principal: r.Principal, Limit: r.Limit, Period: period, Burst: r.Burst})
+	}
+	return rules, nil
+}
+
+// RateLimitStore keeps the token buckets. *dbOperations.Mongo implements
+// it for limits shared by all instances, MemoryRateLimits for a single
+// instance.
+type RateLimitStore interface {
+	// TakeToken takes a token from the bucket key, which holds up to
+	// capacity tokens and is refilled at rate tokens a second. It returns
+	// the tokens left, and whether one could be taken.
+	TakeToken(key string, capacity, rate float64, now time.Time) (float64, bool, error)
+}
+
+// memoryBucketLimit is the most buckets MemoryRateLimits holds. Once it
+// is reached the full buckets are dropped and, if that is not enough, the
+// least recently used half.
+const memoryBucketLimit = 10000
+
+// MemoryRateLimits is a RateLimitStore for a single instance.
+type MemoryRateLimits struct {
+	mu      sync.Mutex
+	buckets map[string]memoryBucket
+}
+
+type memoryBucket struct {
+	tokens   float64
+	updated  time.Time
+	capacity float64
+	rate     float64
+}
+
+// level is how many tokens the bucket holds at now.
+func (b memoryBucket) level(now time.Time) float64 {
+	elapsed := math.Max(now.Sub(b.updated).Seconds(), 0)
+	return math.Min(b.capacity, b.tokens+elapsed*b.rate)
+}
+
+// NewMemoryRateLimits returns an empty MemoryRateLimits.
+func NewMemoryRateLimits() *MemoryRateLimits {
+	return &MemoryRateLimits{buckets: map[string]memoryBucket{}}
+}
+
+// TakeToken implements RateLimitStore.
+func (m *MemoryRateLimits) TakeToken(key string, capacity, rate float64, now time.Time) (float64, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.buckets[key]
+	if !ok {
+		if len(m.buckets) >= memoryBucketLimit {
+			m.sweep(now)
+		}
+		b = memoryBucket{tokens: capacity, updated: now}
+	}
+	b.capacity, b.rate = capacity, rate
+	tokens := b.level(now)
+	if tokens < 1 {
+		return tokens, false, nil
+	}
+	b.tokens, b.updated = tokens-1, now
+	m.buckets[key] = b
+	return b.tokens, true, nil
+}
+
+// sweep drops the buckets that are full again, as they are the same as
+// no bucket. If most are still in use, as when calls come from ever new
+// addresses, it drops the least recently used half; their callers start
+// over with a full bucket.
+func (m *MemoryRateLimits) sweep(now time.Time) {
+	used := make([]time.Time, 0, len(m.buckets))
+	for key, b := range m.buckets {
+		if b.level(now) >= b.capacity {
+			delete(m.buckets, key)
+			continue
+		}
+		used = append(used, b.updated)
+	}
+	if len(used) <= memoryBucketLimit/2 {
+		return
+	}
+	sort.Slice(used, func(i, j int) bool { return used[i].Before(used[j]) })
+	cutoff := used[len(used)-memoryBucketLimit/2]
+	for key, b := range m.buckets {
+		if b.updated.Before(cutoff) {
+			delete(m.buckets, key)
+		}
+	}
+}
+
+// rateLimitStatus is the state of the tightest bucket a call was counted
+// in, for the RateLimit headers.
+type rateLimitStatus struct {
+	Limit      int
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// RateLimitEndpoints limits the calls to every endpoint by rules, counting
+// them in st. The rules for a route, and those for every route, apply
+// together; of the rules for the same route only the one most specific to
+// the caller applies. Calls are let through when st fails. It should be
+// applied after AuditEndpoints, so refused calls are not audited, and
+// before AuthenticateEndpoints; the rules for client addresses are left
+// to RateLimitClientEndpoints.
+func RateLimitEndpoints(e Endpoints, st RateLimitStore, rules []RateLimitRule, logger log.Logger) Endpoints {
+	if len(rules) == 0 {
+		return e
+	}
+	return e.wrap(rateLimit(st, rules, false, logger))
+}
+
+// RateLimitClientEndpoints limits the calls to every endpoint by the rules
+// for client addresses, counting them in st like RateLimitEndpoints. It
+// should be applied after AuthenticateEndpoints, so calls with bad
+// credentials are counted as well.
+func RateLimitClientEndpoints(e Endpoints, st RateLimitStore, rules []RateLimitRule, logger log.Logger) Endpoints {
+	if len(rules) == 0 {
+		return e
+	}
+	return e.wrap(rateLimit(st, rules, true, logger))
+}
+
+// byClient reports whether r counts calls by their client address.
+func (r RateLimitRule) byClient() bool {
+	return r.Principal == rateLimitIP || strings.HasPrefix(r.Principal, rateLimitIP+":")
+}
+
+// rateLimit counts calls by the rules for client addresses if byClient,
+// and by the others if not.
+func rateLimit(st RateLimitStore, rules []RateLimitRule, byClient bool, logger log.Logger) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			ri := RequestInfoFrom(ctx)
+			kind, caller := rateLimitIP, rateLimitIP+":"+ri.ClientIP
+			if p, ok := PrincipalFrom(ctx); ok && !byClient {
+				kind, caller = rateLimitUser, p.ID
+				if p.Scopes != nil {
+					kind = rateLimitAPIKey
+				}
+			}
+			applying := rules
+			if byClient {
+				applying = make([]RateLimitRule, 0, len(rules))
+				for _, r := range rules {
+					if r.byClient() {
+						applying = append(applying, r)
+					}
+				}
+			}
+			now := time.Now()
+			var tightest *rateLimitStatus
+			for _, r := range rulesFor(applying, ri.Route, kind, caller) {
+				if r.byClient() != byClient {
+					// Counted by RateLimitClientEndpoints.
+					continue
+				}
+				route := r.Route
+				if route == "" {
+					route = "*"
+				}
+				capacity := float64(r.capacity())
+				rate := float64(r.Limit) / r.Period.Seconds()
+				left, ok, err := st.TakeToken(route+" "+caller, capacity, rate, now)
+				if err != nil {
+					logger.Log("ratelimit", route, "caller", caller, "err", err)
+					continue
+				}
+				s := rateLimitStatus{
+					Limit:     r.capacity(),
+					Remaining: int(left),
+					Reset:     time.Duration((capacity - left) / rate * float64(time.Second)),
+				}
+				if !ok {
+					s.RetryAfter = time.Duration((1 - left) / rate * float64(time.Second))
+				}
+				if tightest == nil || s.tighter(*tightest) {
+					tightest = &s
+				}
+			}
+			if tightest == nil {
+				return next(ctx, request)
+			}
+			if h, ok := ctx.Value(rateLimitKey).(*rateLimitStatus); ok && (h.Limit == 0 || tightest.tighter(*h)) {
+				*h = *tightest
+			}
+			if tightest.refused() {
+				return nil, ErrRateLimited
+			}
+			return next(ctx, request)
+		}
+	}
+}
+
+// rulesFor returns the rules applying to a call of route by caller, of
+// the given kind: for each route, the rule naming the caller, else the
+// one for its kind, else the one for every caller.
+func rulesFor(rules []RateLimitRule, route, kind, caller string) []RateLimitRule {
+	type choice struct{ index, specificity int }
+	chosen := map[string]choice{}
+	for i, r := range rules {
+		if r.Route != "" && r.Route != route {
+			continue
+		}
+		specificity := 0
+		switch r.Principal {
+		case "":
+		case kind:
+			specificity = 1
+		case caller:
+			specificity = 2
+		default:
+			continue
+		}
+		if c, ok := chosen[r.Route]; !ok || specificity > c.specificity {
+			chosen[r.Route] = choice{i, specificity}
+		}
+	}
+	applying := make([]RateLimitRule, 0, len(chosen))
+	for i, r := range rules {
+		if c, ok := chosen[r.Route]; ok && c.index == i {
+			applying = append(applying, r)
+		}
+	}
+	return applying
+}
+
+// tighter reports whether s is closer to refusing calls than t: a refusing
+// bucket is, else the one with fewer calls left.
+func (s rateLimitStatus) tighter(t rateLimitStatus) bool {
+	if s.refused() != t.refused() {
+		return s.refused()
+	}
+	return s.Remaining < t.Remaining
+}
+
+func (s rateLimitStatus) refused() bool {
+	return s.RetryAfter > 0
+}
+
+// populateRateLimit is a RequestFunc making room for the rate limit
+// status of the call.
+func populateRateLimit(ctx context.Context, _ *http.Request) context.Context {
+	return context.WithValue(ctx, rateLimitKey, &rateLimitStatus{})
+}
+
+// writeRateLimit is a ServerResponseFunc setting the RateLimit headers.
+func writeRateLimit(ctx context.Context, w http.ResponseWriter) context.Context {
+	s, ok := ctx.Value(rateLimitKey).(*rateLimitStatus)
+	if !ok || s.Limit == 0 {
+		return ctx
+	}
+	seconds := func(d time.Duration) string {
+		return strconv.Itoa(int(math.Ceil(d.Seconds())))
+	}
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(s.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(s.Remaining))
+	w.Header().Set("RateLimit-Reset", seconds(s.Reset))
+	if s.RetryAfter > 0 {
+		w.Header().Set("Retry-After", seconds(s.RetryAfter))
+	}
+	return ctx
+}
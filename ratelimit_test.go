@@ -0,0 +1,202 @@
+package user
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/user/dbOperations"
+	"github.com/user/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newRateLimitedRouter(rules []RateLimitRule) (http.Handler, *memAPIKeys) {
+	keys := &memAPIKeys{}
+	e := APIKeyEndpoints(MakeEndpoints(newStubService()), keys, true)
+	e = RateLimitEndpoints(e, NewMemoryRateLimits(), rules, log.NewNopLogger())
+	e = AuthenticateEndpoints(e, Authenticators{testTokens, APIKeyAuthenticator{keys}})
+	e = RateLimitClientEndpoints(e, NewMemoryRateLimits(), rules, log.NewNopLogger())
+	return MakeHTTPHandler(context.Background(), e, log.NewNopLogger()), keys
+}
+
+func TestRateLimit(t *testing.T) {
+	router, keys := newRateLimitedRouter([]RateLimitRule{
+		{Route: "GET /customers", Limit: 2, Period: time.Minute},
+		{Route: "GET /customers", Principal: "apikey", Limit: 5, Period: time.Minute},
+		{Principal: "ip", Limit: 100, Period: time.Minute},
+	})
+	k, _ := createAPIKey(keys, dbOperations.APIKey{Name: "orders", Scopes: []string{ScopeCustomersRead}})
+	get := func(ip, authorization string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/customers/"+testUserID, nil)
+		r.RemoteAddr = ip + ":1234"
+		r.Header.Set("Authorization", authorization)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	for i, remaining := range []string{"1", "0"} {
+		w := get("10.0.0.1", "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected call %d to be let through, got %d", i+1, w.Code)
+		}
+		if w.Header().Get("RateLimit-Limit") != "2" || w.Header().Get("RateLimit-Remaining") != remaining {
+			t.Errorf("unexpected headers on call %d: %v", i+1, w.Header())
+		}
+	}
+	w := get("10.0.0.1", "")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected the third call to be refused, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "30" || w.Header().Get("RateLimit-Remaining") != "0" {
+		t.Errorf("unexpected headers on a refused call: %v", w.Header())
+	}
+
+	// Each address has its own bucket.
+	if w := get("10.0.0.2", ""); w.Code != http.StatusOK {
+		t.Errorf("expected another address to be let through, got %d", w.Code)
+	}
+	// The rule for API keys replaces the one for every caller.
+	for i := 0; i < 5; i++ {
+		if w := get("10.0.0.1", "ApiKey "+k.Key); w.Code != http.StatusOK {
+			t.Fatalf("expected key call %d to be let through, got %d", i+1, w.Code)
+		}
+	}
+	if w := get("10.0.0.1", "ApiKey "+k.Key); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected the key to be limited, got %d", w.Code)
+	}
+	// Routes without a rule of their own only count against the rule for
+	// every route.
+	r := httptest.NewRequest("GET", "/addresses", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "100" {
+		t.Errorf("expected the address list to be let through, got %d: %v", w.Code, w.Header())
+	}
+}
+
+func TestRateLimitBadCredentials(t *testing.T) {
+	router, _ := newRateLimitedRouter([]RateLimitRule{
+		{Route: "GET /customers", Principal: "ip", Limit: 2, Period: time.Minute},
+	})
+	for i, want := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+		r := httptest.NewRequest("GET", "/customers/"+testUserID, nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		r.Header.Set("Authorization", "ApiKey guessed")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("expected call %d with a bad key to get %d, got %d", i+1, want, w.Code)
+		}
+	}
+}
+
+func TestRateLimitGRPC(t *testing.T) {
+	e := RateLimitEndpoints(MakeEndpoints(newStubService()), NewMemoryRateLimits(), []RateLimitRule{
+		{Route: "/pb.User/Login", Limit: 1, Period: time.Hour},
+	}, log.NewNopLogger())
+	c := newGRPCEndpointsClient(t, e)
+	req := &pb.LoginRequest{Username: "eve", Password: "secret"}
+	if _, err := c.Login(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Login(context.Background(), req); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected ResourceExhausted, got %v", err)
+	}
+	if _, err := c.GetUser(context.Background(), &pb.GetRequest{Id: testUserID}); err != nil {
+		t.Errorf("expected other methods to be let through, got %v", err)
+	}
+}
+
+func TestRulesFor(t *testing.T) {
+	rules := []RateLimitRule{
+		{Route: "GET /customers", Limit: 1},
+		{Route: "GET /customers", Principal: "apikey", Limit: 2},
+		{Route: "GET /customers", Principal: "apikey:1", Limit: 3},
+		{Principal: "user", Limit: 4},
+		{Route: "POST /customers", Limit: 5},
+	}
+	for _, c := range []struct {
+		kind, caller string
+		limits       []int
+	}{
+		{"ip", "ip:10.0.0.1", []int{1}},
+		{"apikey", "apikey:2", []int{2}},
+		{"apikey", "apikey:1", []int{3}},
+		{"user", "57a98d98e4b00679b4a830af", []int{1, 4}},
+	} {
+		got := rulesFor(rules, "GET /customers", c.kind, c.caller)
+		if len(got) != len(c.limits) {
+			t.Errorf("expected %d rules for %s, got %v", len(c.limits), c.caller, got)
+			continue
+		}
+		for i, r := range got {
+			if r.Limit != c.limits[i] {
+				t.Errorf("expected limit %d for %s, got %d", c.limits[i], c.caller, r.Limit)
+			}
+		}
+	}
+}
+
+func TestParseRateLimits(t *testing.T) {
+	rules, err := ParseRateLimits([]byte(`[{"route": "POST /login", "principal": "ip", "limit": 10, "period": "1m", "burst": 20}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 1 || rules[0].Period != time.Minute || rules[0].capacity() != 20 {
+		t.Errorf("unexpected rules %+v", rules)
+	}
+	for _, data := range []string{
+		`[{"limit": 10}]`,
+		`[{"limit": 0, "period": "1m"}]`,
+		`[{"limit": 10, "period": "-1s"}]`,
+		`{}`,
+	} {
+		if _, err := ParseRateLimits([]byte(data)); err == nil {
+			t.Errorf("expected %s to be refused", data)
+		}
+	}
+}
+
+func TestMemoryRateLimits(t *testing.T) {
+	m := NewMemoryRateLimits()
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if _, ok, _ := m.TakeToken("k", 2, 1, now); !ok {
+			t.Fatalf("expected token %d", i+1)
+		}
+	}
+	if left, ok, _ := m.TakeToken("k", 2, 1, now); ok || left != 0 {
+		t.Errorf("expected the bucket to be empty, got %v", left)
+	}
+	if _, ok, _ := m.TakeToken("k", 2, 1, now.Add(time.Second)); !ok {
+		t.Error("expected the bucket to be refilled")
+	}
+	if left, _, _ := m.TakeToken("k", 2, 1, now.Add(time.Hour)); left != 1 {
+		t.Errorf("expected the bucket to hold no more than its capacity, got %v", left)
+	}
+}
+
+func TestMemoryRateLimitsEvict(t *testing.T) {
+	m := NewMemoryRateLimits()
+	now := time.Now()
+	// Buckets that refill slowly are never full again within the test.
+	for i := 0; i <= memoryBucketLimit; i++ {
+		m.TakeToken(strconv.Itoa(i), 2, 0.0001, now.Add(time.Duration(i)*time.Millisecond))
+	}
+	if len(m.buckets) > memoryBucketLimit/2+1 {
+		t.Errorf("expected the least recently used buckets to be dropped, %d left", len(m.buckets))
+	}
+	if _, ok := m.buckets[strconv.Itoa(memoryBucketLimit-1)]; !ok {
+		t.Error("expected a recently used bucket to be kept")
+	}
+	if _, ok := m.buckets["0"]; ok {
+		t.Error("expected the least recently used bucket to be dropped")
+	}
+}
@@ -0,0 +1,86 @@
+package user
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/user/dbOperations"
+)
+
+// DeletedStore keeps deleted users and addresses until they are purged.
+// *dbOperations.Mongo implements it.
+type DeletedStore interface {
+	GetDeletedUsers() ([]dbOperations.User, error)
+	GetDeletedAddresses() ([]dbOperations.Address, error)
+	RestoreUser(id string) error
+	RestoreAddress(id string) (userid string, err error)
+	PurgeDeleted(before time.Time) (int, error)
+}
+
+// RestoreEndpoints mounts the admin-only endpoints listing and restoring
+// deleted users and addresses.
+func RestoreEndpoints(e Endpoints, st DeletedStore) Endpoints {
+	admin := RequireRole(RoleAdmin)
+	e.DeletedUsersEndpoint = admin(MakeDeletedUsersEndpoint(st))
+	e.DeletedAddressesEndpoint = admin(MakeDeletedAddressesEndpoint(st))
+	e.RestoreUserEndpoint = admin(MakeRestoreUserEndpoint(st))
+	e.RestoreAddressEndpoint = admin(MakeRestoreAddressEndpoint(st))
+	return e
+}
+
+// MakeDeletedUsersEndpoint returns an endpoint listing deleted users.
+func MakeDeletedUsersEndpoint(st DeletedStore) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		usrs, err := st.GetDeletedUsers()
+		return EmbedStruct{usersResponse{Users: usrs}}, err
+	}
+}
+
+// MakeDeletedAddressesEndpoint returns an endpoint listing deleted
+// addresses.
+func MakeDeletedAddressesEndpoint(st DeletedStore) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		adds, err := st.GetDeletedAddresses()
+		return EmbedStruct{addressesResponse{Addresses: adds}}, err
+	}
+}
+
+// MakeRestoreUserEndpoint returns an endpoint restoring a deleted user.
+func MakeRestoreUserEndpoint(st DeletedStore) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(restoreRequest)
+		err := st.RestoreUser(req.ID)
+		return restoreResponse{Status: err == nil, UserID: req.ID}, err
+	}
+}
+
+// MakeRestoreAddressEndpoint returns an endpoint restoring a deleted
+// address to the user it was deleted from.
+func MakeRestoreAddressEndpoint(st DeletedStore) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(restoreRequest)
+		userid, err := st.RestoreAddress(req.ID)
+		return restoreResponse{Status: err == nil, UserID: userid}, err
+	}
+}
+
+// PurgeDeleted permanently removes users and addresses deleted longer than
+// retention ago.
+func PurgeDeleted(st DeletedStore, retention time.Duration, logger log.Logger) (int, error) {
+	n, err := st.PurgeDeleted(time.Now().Add(-retention))
+	if n > 0 {
+		logger.Log("purged", n, "retention", retention)
+	}
+	return n, err
+}
+
+type restoreRequest struct {
+	ID string
+}
+
+type restoreResponse struct {
+	Status bool   `json:"status"`
+	UserID string `json:"userID"`
+}
@@ -0,0 +1,66 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestRestore(t *testing.T) {
+	svc := newStubService()
+	e, st := newTestEndpoints(svc)
+	router := MakeHTTPHandler(context.Background(), e, log.NewNopLogger())
+	do := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	do(adminRequest("DELETE", "/customers/"+testUserID+"/addresses/57a98d98e4b00679b4a830b0"))
+	do(adminRequest("DELETE", "/customers/"+testUserID))
+
+	w := do(adminRequest("GET", "/deleted/customers"))
+	var users struct {
+		Embed usersResponse `json:"_embedded"`
+	}
+	json.NewDecoder(w.Body).Decode(&users)
+	if len(users.Embed.Users) != 1 || users.Embed.Users[0].DeletedBy != "admin" || users.Embed.Users[0].DeletedAt == nil {
+		t.Errorf("unexpected deleted users %+v", users.Embed.Users)
+	}
+	if w := do(httptest.NewRequest("GET", "/deleted/customers", nil)); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a token, got %d", w.Code)
+	}
+
+	if w := do(adminRequest("POST", "/addresses/57a98d98e4b00679b4a830b0/restore")); w.Code != http.StatusConflict {
+		t.Errorf("expected an address not to be restored before its user, got %d", w.Code)
+	}
+	if w := do(adminRequest("POST", "/customers/"+testUserID+"/restore")); w.Code != http.StatusOK {
+		t.Errorf("expected user restore to succeed, got %d: %s", w.Code, w.Body)
+	}
+	if _, ok := svc.users[testUserID]; !ok {
+		t.Error("expected the user to be back")
+	}
+	if w := do(adminRequest("POST", "/addresses/57a98d98e4b00679b4a830b0/restore")); w.Code != http.StatusOK {
+		t.Errorf("expected address restore to succeed, got %d: %s", w.Code, w.Body)
+	}
+	if w := do(adminRequest("POST", "/addresses/57a98d98e4b00679b4a830b0/restore")); w.Code != http.StatusNotFound {
+		t.Errorf("expected a second restore to find nothing, got %d", w.Code)
+	}
+	restored := st.entries[len(st.entries)-2]
+	if restored.Action != "address.restore" || restored.Target != testUserID || restored.AddressID != "57a98d98e4b00679b4a830b0" {
+		t.Errorf("expected the restore to be audited, got %+v", restored)
+	}
+
+	do(adminRequest("DELETE", "/customers/"+testUserID))
+	if n, _ := PurgeDeleted(svc, time.Hour, log.NewNopLogger()); n != 0 {
+		t.Errorf("expected nothing purged within retention, purged %d", n)
+	}
+	if n, _ := PurgeDeleted(svc, -time.Second, log.NewNopLogger()); n != 1 {
+		t.Errorf("expected the user to be purged, purged %d", n)
+	}
+}
@@ -0,0 +1,550 @@
+package user
+
+import (
+	"context"
+	"crypto/rand"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/user/dbOperations"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// SCIM schema and message URNs.
+const (
+	scimUserSchema  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimListSchema  = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimPatchSchema = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	scimErrorSchema = "urn:ietf:params:scim:api:messages:2.0:Error"
+	// scimMaxResults caps the page size of a list.
+	scimMaxResults = 100
+)
+
+// SCIMStore is what the SCIM endpoints need besides the Service.
+// *dbOperations.Mongo implements it.
+type SCIMStore interface {
+	UpdateUser(u *dbOperations.User, version int64) error
+	GetAddressesForUser(userid string) ([]dbOperations.Address, error)
+	AppendEvent(e *dbOperations.Event) error
+}
+
+// SCIMEndpoints mounts the SCIM 2.0 user provisioning endpoints. They are
+// open to provisioning clients and admins.
+func SCIMEndpoints(e Endpoints, s Service, st SCIMStore) Endpoints {
+	sc := scimUsers{s: s, st: st}
+	provisioner := RequireRole(RoleProvisioner, RoleAdmin)
+	e.SCIMUserPostEndpoint = provisioner(sc.makePostEndpoint())
+	e.SCIMUserGetEndpoint = provisioner(sc.makeGetEndpoint())
+	e.SCIMUsersGetEndpoint = provisioner(sc.makeListEndpoint())
+	e.SCIMUserPutEndpoint = provisioner(sc.makePutEndpoint())
+	e.SCIMUserPatchEndpoint = provisioner(sc.makePatchEndpoint())
+	e.SCIMUserDeleteEndpoint = provisioner(sc.makeDeleteEndpoint())
+	return e
+}
+
+// scimDiscovery holds the ServiceProviderConfig, ResourceTypes and Schemas
+// documents. Like openapi.json they are served as they are, without
+// authentication, so clients can discover the service before provisioning.
+//
+//go:embed scim.json
+var scimDiscovery []byte
+
+var scimDocuments struct {
+	ServiceProviderConfig json.RawMessage
+	ResourceTypes         []json.RawMessage
+	Schemas               []json.RawMessage
+}
+
+func init() {
+	if err := json.Unmarshal(scimDiscovery, &scimDocuments); err != nil {
+		panic("scim.json: " + err.Error())
+	}
+}
+
+func serveSCIMServiceProviderConfig(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/scim+json")
+	w.Write(scimDocuments.ServiceProviderConfig)
+}
+
+func serveSCIMResourceTypes(w http.ResponseWriter, _ *http.Request) {
+	serveSCIMList(w, scimDocuments.ResourceTypes)
+}
+
+func serveSCIMSchemas(w http.ResponseWriter, _ *http.Request) {
+	serveSCIMList(w, scimDocuments.Schemas)
+}
+
+func serveSCIMList(w http.ResponseWriter, resources []json.RawMessage) {
+	w.Header().Set("Content-Type", "application/scim+json")
+	json.NewEncoder(w).Encode(struct {
+		Schemas      []string          `json:"schemas"`
+		TotalResults int               `json:"totalResults"`
+		StartIndex   int               `json:"startIndex"`
+		ItemsPerPage int               `json:"itemsPerPage"`
+		Resources    []json.RawMessage `json:"Resources"`
+	}{[]string{scimListSchema}, len(resources), 1, len(resources), resources})
+}
+
+// scimError is an error in the form of a SCIM error response.
+type scimError struct {
+	Status int
+	Type   string
+	Detail string
+}
+
+func (e scimError) Error() string {
+	return e.Detail
+}
+
+// scimUser is the SCIM core user resource. Username, names, the primary
+// email and phone number and the addresses map onto dbOperations.User;
+// other attributes are ignored.
+type scimUser struct {
+	Schemas      []string         `json:"schemas"`
+	ID           string           `json:"id,omitempty"`
+	UserName     string           `json:"userName"`
+	Name         scimName         `json:"name"`
+	Emails       []scimMultiValue `json:"emails,omitempty"`
+	PhoneNumbers []scimMultiValue `json:"phoneNumbers,omitempty"`
+	Addresses    []scimAddress    `json:"addresses,omitempty"`
+	Password     string           `json:"password,omitempty"`
+	Active       *scimBool        `json:"active,omitempty"`
+	Meta         *scimMeta        `json:"meta,omitempty"`
+	version      int64
+}
+
+type scimName struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+type scimMultiValue struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+type scimAddress struct {
+	Type          string `json:"type,omitempty"`
+	StreetAddress string `json:"streetAddress,omitempty"`
+	Locality      string `json:"locality,omitempty"`
+	PostalCode    string `json:"postalCode,omitempty"`
+	Country       string `json:"country,omitempty"`
+}
+
+type scimMeta struct {
+	ResourceType string `json:"resourceType"`
+	Created      string `json:"created,omitempty"`
+	Location     string `json:"location"`
+	Version      string `json:"version"`
+}
+
+// scimBool is a boolean that also accepts "True" and "False" strings, as
+// some identity providers send them.
+type scimBool bool
+
+func (b *scimBool) UnmarshalJSON(data []byte) error {
+	v, err := strconv.ParseBool(strings.Trim(string(data), `"`))
+	if err != nil {
+		return scimError{Status: 400, Type: "invalidValue", Detail: "active must be a boolean"}
+	}
+	*b = scimBool(v)
+	return nil
+}
+
+// inactive reports whether the resource asks for the user to be deprovisioned.
+func (su scimUser) inactive() bool {
+	return su.Active != nil && !bool(*su.Active)
+}
+
+func scimUserFrom(u dbOperations.User) scimUser {
+	active := scimBool(true)
+	su := scimUser{
+		Schemas:  []string{scimUserSchema},
+		ID:       u.UserID,
+		UserName: u.Username,
+		Name: scimName{
+			Formatted:  strings.TrimSpace(u.FirstName + " " + u.LastName),
+			GivenName:  u.FirstName,
+			FamilyName: u.LastName,
+		},
+		Active: &active,
+		Meta: &scimMeta{
+			ResourceType: "User",
+			Location:     "/scim/v2/Users/" + u.UserID,
+			Version:      fmt.Sprintf(`W/"%d"`, u.Version),
+		},
+		version: u.Version,
+	}
+	if bson.IsObjectIdHex(u.UserID) {
+		su.Meta.Created = bson.ObjectIdHex(u.UserID).Time().UTC().Format("2006-01-02T15:04:05Z")
+	}
+	if u.Email != "" {
+		su.Emails = []scimMultiValue{{Value: u.Email, Type: "work", Primary: true}}
+	}
+	if u.Phone != "" {
+		su.PhoneNumbers = []scimMultiValue{{Value: u.Phone, Type: "work", Primary: true}}
+	}
+	for _, a := range u.Addresses {
+		su.Addresses = append(su.Addresses, scimAddressFrom(a))
+	}
+	return su
+}
+
+// scimAddressFrom returns a as a SCIM address. SCIM only knows the home
+// and work labels, and calls the others "other"; unlabelled addresses are
+// home addresses.
+func scimAddressFrom(a dbOperations.Address) scimAddress {
+	typ := a.Label
+	switch typ {
+	case "":
+		typ = AddressHome
+	case AddressHome, AddressWork:
+	default:
+		typ = "other"
+	}
+	return scimAddress{
+		Type:          typ,
+		StreetAddress: strings.TrimSpace(a.Number + " " + a.Street),
+		Locality:      a.City,
+		PostalCode:    a.PostCode,
+		Country:       a.Country,
+	}
+}
+
+// scimMatchKey returns what a is matched by when a user's addresses are
+// replaced.
+func scimMatchKey(a dbOperations.Address) scimAddress {
+	normalized, _ := NormalizeAddress(a)
+	return scimAddressFrom(normalized)
+}
+
+// user returns the dbOperations.User the resource describes. The street
+// address is kept whole in Street.
+func (su scimUser) user() dbOperations.User {
+	u := dbOperations.User{
+		UserID:    su.ID,
+		Username:  su.UserName,
+		FirstName: su.Name.GivenName,
+		LastName:  su.Name.FamilyName,
+		Email:     scimPrimary(su.Emails),
+		Phone:     scimPrimary(su.PhoneNumbers),
+		Password:  su.Password,
+	}
+	for _, a := range su.Addresses {
+		addr := dbOperations.Address{
+			Street:   a.StreetAddress,
+			City:     a.Locality,
+			PostCode: a.PostalCode,
+			Country:  a.Country,
+		}
+		if a.Type == AddressHome || a.Type == AddressWork {
+			addr.Label = a.Type
+		}
+		u.Addresses = append(u.Addresses, addr)
+	}
+	return u
+}
+
+// scimPrimary returns the primary value, or the first if none is primary.
+func scimPrimary(values []scimMultiValue) string {
+	for _, v := range values {
+		if v.Primary {
+			return v.Value
+		}
+	}
+	if len(values) > 0 {
+		return values[0].Value
+	}
+	return ""
+}
+
+// scimUsers implements the SCIM operations on top of the Service, so that
+// users provisioned over SCIM emit the same events as any other.
+type scimUsers struct {
+	s  Service
+	st SCIMStore
+}
+
+func (sc scimUsers) get(id string) (scimUser, error) {
+	u, err := sc.s.GetUser(id)
+	if err != nil {
+		return scimUser{}, err
+	}
+	if u.Addresses, err = sc.st.GetAddressesForUser(id); err != nil {
+		return scimUser{}, err
+	}
+	return scimUserFrom(u), nil
+}
+
+func (sc scimUsers) create(su scimUser) (scimUser, error) {
+	if su.UserName == "" {
+		return scimUser{}, scimError{Status: 400, Type: "invalidValue", Detail: "userName is required"}
+	}
+	u := su.user()
+	if u.Password == "" {
+		// Users provisioned without a password cannot log in with one.
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return scimUser{}, err
+		}
+		u.Password = hex.EncodeToString(b)
+	}
+	created, err := sc.s.PostUser(u)
+	if err != nil {
+		return scimUser{}, err
+	}
+	for _, a := range u.Addresses {
+		if _, err := sc.s.PostAddress(a, created.UserID); err != nil {
+			return scimUser{}, err
+		}
+	}
+	return sc.get(created.UserID)
+}
+
+// replace makes the user match su, if it is still at version or version
+// is 0. An inactive resource deletes the user.
+func (sc scimUsers) replace(id string, version int64, su scimUser, actor string) (scimUser, error) {
+	cur, err := sc.get(id)
+	if err != nil {
+		return scimUser{}, err
+	}
+	if su.inactive() {
+		if err := sc.s.DeleteUser(id, actor, version); err != nil {
+			return scimUser{}, err
+		}
+		cur.Active = su.Active
+		return cur, nil
+	}
+	if su.UserName == "" {
+		return scimUser{}, scimError{Status: 400, Type: "invalidValue", Detail: "userName is required"}
+	}
+	u := su.user()
+	u.UserID = id
+	if u.Password != "" {
+		SetPassword(&u, u.Password)
+	}
+	// Phone numbers are expected in RFC 3966 form, with their country
+	// code. A number kept as it was is left alone, even if it was stored
+	// before numbers were parsed.
+	if u.Phone != "" && u.Phone != scimPrimary(cur.PhoneNumbers) {
+		if u.Phone, err = ParsePhone(u.Phone, ""); err != nil {
+			return scimUser{}, scimError{Status: http.StatusBadRequest, Type: "invalidValue", Detail: err.Error()}
+		}
+	}
+	if err := sc.st.UpdateUser(&u, version); err != nil {
+		return scimUser{}, err
+	}
+	e, err := NewEvent(EventUserUpdated, id, u.EventPayload())
+	if err == nil {
+		e.Actor = actor
+		err = sc.st.AppendEvent(&e)
+	}
+	if err != nil {
+		return scimUser{}, err
+	}
+
+	// Addresses have no id in SCIM, so they are matched by content, as it
+	// is normalized.
+	existing, err := sc.st.GetAddressesForUser(id)
+	if err != nil {
+		return scimUser{}, err
+	}
+	keep := make(map[scimAddress]bool)
+	for _, a := range u.Addresses {
+		keep[scimMatchKey(a)] = true
+	}
+	for _, a := range existing {
+		if sa := scimMatchKey(a); keep[sa] {
+			delete(keep, sa)
+			continue
+		}
+		if err := sc.s.DeleteAddress(a.ID, id, actor, 0); err != nil {
+			return scimUser{}, err
+		}
+	}
+	for _, a := range u.Addresses {
+		if keep[scimMatchKey(a)] {
+			if _, err := sc.s.PostAddress(a, id); err != nil {
+				return scimUser{}, err
+			}
+		}
+	}
+	return sc.get(id)
+}
+
+// patch applies ops to the user and replaces it with the result. Without
+// an If-Match the version read here guards against concurrent changes.
+func (sc scimUsers) patch(id string, im ifMatch, ops []scimPatchOp, actor string) (scimUser, error) {
+	cur, err := sc.get(id)
+	if err != nil {
+		return scimUser{}, err
+	}
+	version, err := im.at(cur.version)
+	if err != nil {
+		return scimUser{}, err
+	}
+	res, err := scimToMap(cur)
+	if err != nil {
+		return scimUser{}, err
+	}
+	for _, op := range ops {
+		if err := op.apply(res); err != nil {
+			return scimUser{}, err
+		}
+	}
+	var patched scimUser
+	b, err := json.Marshal(res)
+	if err == nil {
+		err = json.Unmarshal(b, &patched)
+	}
+	if err != nil {
+		if _, ok := err.(scimError); ok {
+			return scimUser{}, err
+		}
+		return scimUser{}, scimError{Status: 400, Type: "invalidValue", Detail: err.Error()}
+	}
+	return sc.replace(id, version, patched, actor)
+}
+
+func (sc scimUsers) list(filter string, startIndex, count int) (scimListResponse, error) {
+	var f scimFilter
+	if filter != "" {
+		var err error
+		if f, err = parseSCIMFilter(filter); err != nil {
+			return scimListResponse{}, err
+		}
+	}
+	users, err := sc.s.GetUsers()
+	if err != nil {
+		return scimListResponse{}, err
+	}
+	matched := make([]scimUser, 0)
+	for _, u := range users {
+		su, err := sc.get(u.UserID)
+		if err != nil {
+			return scimListResponse{}, err
+		}
+		if f != nil {
+			res, err := scimToMap(su)
+			if err != nil {
+				return scimListResponse{}, err
+			}
+			if !f.match(res) {
+				continue
+			}
+		}
+		matched = append(matched, su)
+	}
+	resp := scimListResponse{
+		Schemas:      []string{scimListSchema},
+		TotalResults: len(matched),
+		StartIndex:   startIndex,
+		Resources:    make([]scimUser, 0),
+	}
+	if from := startIndex - 1; from < len(matched) {
+		to := from + count
+		if to > len(matched) {
+			to = len(matched)
+		}
+		resp.Resources = matched[from:to]
+	}
+	resp.ItemsPerPage = len(resp.Resources)
+	return resp, nil
+}
+
+func scimToMap(su scimUser) (map[string]interface{}, error) {
+	b, err := json.Marshal(su)
+	if err != nil {
+		return nil, err
+	}
+	var res map[string]interface{}
+	err = json.Unmarshal(b, &res)
+	return res, err
+}
+
+func (sc scimUsers) makePostEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		return sc.create(request.(scimUserRequest).User)
+	}
+}
+
+func (sc scimUsers) makeGetEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		return sc.get(request.(scimUserRequest).ID)
+	}
+}
+
+func (sc scimUsers) makeListEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(scimListRequest)
+		return sc.list(req.Filter, req.StartIndex, req.Count)
+	}
+}
+
+func (sc scimUsers) makePutEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(scimUserRequest)
+		var su scimUser
+		err := req.IfMatch.apply(func(version int64) (err error) {
+			su, err = sc.replace(req.ID, version, req.User, actorFor(ctx, request))
+			return err
+		})
+		return su, err
+	}
+}
+
+func (sc scimUsers) makePatchEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(scimPatchRequest)
+		for _, s := range req.Schemas {
+			if s != scimPatchSchema {
+				return nil, scimError{Status: 400, Type: "invalidSyntax", Detail: "unknown schema " + s}
+			}
+		}
+		return sc.patch(req.ID, req.IfMatch, req.Operations, actorFor(ctx, request))
+	}
+}
+
+func (sc scimUsers) makeDeleteEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(scimUserRequest)
+		return nil, req.IfMatch.apply(func(version int64) error {
+			return sc.s.DeleteUser(req.ID, actorFor(ctx, request), version)
+		})
+	}
+}
+
+type scimUserRequest struct {
+	ID      string
+	IfMatch ifMatch
+	User    scimUser
+}
+
+type scimListRequest struct {
+	Filter     string
+	StartIndex int
+	Count      int
+}
+
+type scimPatchRequest struct {
+	ID         string
+	IfMatch    ifMatch
+	Schemas    []string      `json:"schemas"`
+	Operations []scimPatchOp `json:"Operations"`
+}
+
+type scimListResponse struct {
+	Schemas      []string   `json:"schemas"`
+	TotalResults int        `json:"totalResults"`
+	StartIndex   int        `json:"startIndex"`
+	ItemsPerPage int        `json:"itemsPerPage"`
+	Resources    []scimUser `json:"Resources"`
+}
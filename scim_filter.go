@@ -0,0 +1,357 @@
+package user
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// scimFilter is a parsed SCIM filter expression (RFC 7644 section 3.4.2.2).
+// It matches resources in their generic JSON form.
+type scimFilter interface {
+	match(resource map[string]interface{}) bool
+}
+
+type scimAnd struct{ l, r scimFilter }
+
+func (f scimAnd) match(res map[string]interface{}) bool { return f.l.match(res) && f.r.match(res) }
+
+type scimOr struct{ l, r scimFilter }
+
+func (f scimOr) match(res map[string]interface{}) bool { return f.l.match(res) || f.r.match(res) }
+
+type scimNot struct{ f scimFilter }
+
+func (f scimNot) match(res map[string]interface{}) bool { return !f.f.match(res) }
+
+// scimCompare compares an attribute with a value. Operator pr has no value.
+type scimCompare struct {
+	path  string
+	op    string
+	value interface{}
+}
+
+func (f scimCompare) match(res map[string]interface{}) bool {
+	values := scimValues(res, f.path)
+	if f.op == "ne" {
+		return !scimCompare{f.path, "eq", f.value}.match(res)
+	}
+	if f.op == "pr" {
+		return len(values) > 0
+	}
+	if f.value == nil {
+		return f.op == "eq" && len(values) == 0
+	}
+	for _, v := range values {
+		if scimCompareValue(v, f.op, f.value) {
+			return true
+		}
+	}
+	return false
+}
+
+// scimValuePath matches resources with an element of a multi-valued
+// attribute that matches the filter in brackets, as in
+// emails[type eq "work"].
+type scimValuePath struct {
+	path   string
+	filter scimFilter
+}
+
+func (f scimValuePath) match(res map[string]interface{}) bool {
+	for _, v := range scimValues(res, f.path) {
+		if elem, ok := v.(map[string]interface{}); ok && f.filter.match(elem) {
+			return true
+		}
+	}
+	return false
+}
+
+// scimAttrPath strips the schema URN from a fully qualified attribute name.
+func scimAttrPath(path string) string {
+	if strings.HasPrefix(strings.ToLower(path), "urn:") {
+		if i := strings.LastIndex(path, ":"); i >= 0 {
+			return path[i+1:]
+		}
+	}
+	return path
+}
+
+// scimValues returns the values of the attribute at path in res, with
+// multi-valued attributes flattened. Attribute names are case insensitive.
+func scimValues(res map[string]interface{}, path string) []interface{} {
+	var values []interface{}
+	var walk func(v interface{}, parts []string)
+	walk = func(v interface{}, parts []string) {
+		switch v := v.(type) {
+		case nil:
+		case []interface{}:
+			for _, e := range v {
+				walk(e, parts)
+			}
+		case map[string]interface{}:
+			if len(parts) == 0 {
+				values = append(values, v)
+				return
+			}
+			if k, ok := scimKey(v, parts[0]); ok {
+				walk(v[k], parts[1:])
+			}
+		default:
+			if len(parts) == 0 && v != "" {
+				values = append(values, v)
+			}
+		}
+	}
+	walk(res, strings.Split(scimAttrPath(path), "."))
+	return values
+}
+
+// scimKey finds the key of obj that equals name, ignoring case.
+func scimKey(obj map[string]interface{}, name string) (string, bool) {
+	if _, ok := obj[name]; ok {
+		return name, true
+	}
+	for k := range obj {
+		if strings.EqualFold(k, name) {
+			return k, true
+		}
+	}
+	return name, false
+}
+
+// scimCompareValue applies op to an attribute value and a filter value.
+// Strings compare case insensitively. Complex values compare by their
+// "value" sub-attribute, as the RFC asks for multi-valued attributes.
+func scimCompareValue(v interface{}, op string, want interface{}) bool {
+	if obj, ok := v.(map[string]interface{}); ok {
+		k, ok := scimKey(obj, "value")
+		if !ok {
+			return false
+		}
+		v = obj[k]
+	}
+	switch want := want.(type) {
+	case string:
+		s, ok := v.(string)
+		if !ok {
+			return false
+		}
+		s, want = strings.ToLower(s), strings.ToLower(want)
+		switch op {
+		case "eq":
+			return s == want
+		case "co":
+			return strings.Contains(s, want)
+		case "sw":
+			return strings.HasPrefix(s, want)
+		case "ew":
+			return strings.HasSuffix(s, want)
+		case "gt":
+			return s > want
+		case "ge":
+			return s >= want
+		case "lt":
+			return s < want
+		case "le":
+			return s <= want
+		}
+	case float64:
+		f, ok := v.(float64)
+		if !ok {
+			return false
+		}
+		switch op {
+		case "eq":
+			return f == want
+		case "gt":
+			return f > want
+		case "ge":
+			return f >= want
+		case "lt":
+			return f < want
+		case "le":
+			return f <= want
+		}
+	case bool:
+		b, ok := v.(bool)
+		return ok && op == "eq" && b == want
+	}
+	return false
+}
+
+var scimOperators = map[string]bool{
+	"eq": true, "ne": true, "co": true, "sw": true, "ew": true,
+	"gt": true, "ge": true, "lt": true, "le": true, "pr": true,
+}
+
+// parseSCIMFilter parses a filter expression. Errors are SCIM errors of
+// type invalidFilter.
+func parseSCIMFilter(s string) (scimFilter, error) {
+	p := &scimFilterParser{}
+	if err := p.tokenize(s); err != nil {
+		return nil, err
+	}
+	f, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, p.errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return f, nil
+}
+
+type scimFilterParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *scimFilterParser) errorf(format string, args ...interface{}) error {
+	return scimError{Status: 400, Type: "invalidFilter", Detail: fmt.Sprintf(format, args...)}
+}
+
+// tokenize splits a filter into brackets, quoted strings and words.
+func (p *scimFilterParser) tokenize(s string) error {
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case c == ' ':
+			i++
+		case strings.IndexByte("()[]", c) >= 0:
+			p.tokens = append(p.tokens, s[i:i+1])
+			i++
+		case c == '"':
+			j := i + 1
+			for j < len(s) && s[j] != '"' {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(s) {
+				return p.errorf("unterminated string")
+			}
+			p.tokens = append(p.tokens, s[i:j+1])
+			i = j + 1
+		default:
+			j := i
+			for j < len(s) && strings.IndexByte(" ()[]\"", s[j]) < 0 {
+				j++
+			}
+			p.tokens = append(p.tokens, s[i:j])
+			i = j
+		}
+	}
+	return nil
+}
+
+func (p *scimFilterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *scimFilterParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *scimFilterParser) expect(t string) error {
+	if got := p.next(); got != t {
+		return p.errorf("expected %q, got %q", t, got)
+	}
+	return nil
+}
+
+func (p *scimFilterParser) or() (scimFilter, error) {
+	l, err := p.and()
+	for err == nil && strings.EqualFold(p.peek(), "or") {
+		p.next()
+		var r scimFilter
+		if r, err = p.and(); err == nil {
+			l = scimOr{l, r}
+		}
+	}
+	return l, err
+}
+
+func (p *scimFilterParser) and() (scimFilter, error) {
+	l, err := p.unary()
+	for err == nil && strings.EqualFold(p.peek(), "and") {
+		p.next()
+		var r scimFilter
+		if r, err = p.unary(); err == nil {
+			l = scimAnd{l, r}
+		}
+	}
+	return l, err
+}
+
+func (p *scimFilterParser) unary() (scimFilter, error) {
+	switch t := p.peek(); {
+	case strings.EqualFold(t, "not"):
+		p.next()
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		f, err := p.group()
+		return scimNot{f}, err
+	case t == "(":
+		p.next()
+		return p.group()
+	}
+	return p.attrExpr()
+}
+
+// group parses a parenthesised filter after its opening bracket.
+func (p *scimFilterParser) group() (scimFilter, error) {
+	f, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	return f, p.expect(")")
+}
+
+func (p *scimFilterParser) attrExpr() (scimFilter, error) {
+	path := p.next()
+	if path == "" || !unicode.IsLetter(rune(path[0])) {
+		return nil, p.errorf("expected an attribute, got %q", path)
+	}
+	if p.peek() == "[" {
+		p.next()
+		f, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return scimValuePath{path: path, filter: f}, p.expect("]")
+	}
+	op := strings.ToLower(p.next())
+	if !scimOperators[op] {
+		return nil, p.errorf("unknown operator %q", op)
+	}
+	if op == "pr" {
+		return scimCompare{path: path, op: op}, nil
+	}
+	raw := p.next()
+	var value interface{}
+	if err := json.Unmarshal([]byte(raw), &value); err != nil {
+		return nil, p.errorf("invalid value %s", raw)
+	}
+	switch value.(type) {
+	case nil, bool:
+		if op != "eq" && op != "ne" {
+			return nil, p.errorf("%s cannot compare with %s", op, raw)
+		}
+	case float64:
+		if op == "co" || op == "sw" || op == "ew" {
+			return nil, p.errorf("%s cannot compare with %s", op, raw)
+		}
+	case string:
+	default:
+		return nil, p.errorf("invalid value %s", raw)
+	}
+	return scimCompare{path: path, op: op, value: value}, nil
+}
@@ -0,0 +1,98 @@
+package user
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSCIMFilter(t *testing.T) {
+	var res map[string]interface{}
+	json.Unmarshal([]byte(`{
+		"userName": "Eve",
+		"name": {"givenName": "Eve", "familyName": "Smith"},
+		"emails": [{"value": "eve@example.com", "type": "work"}, {"value": "eve@home.org", "type": "home"}],
+		"active": true,
+		"meta": {"version": "W/\"3\""}
+	}`), &res)
+
+	for filter, want := range map[string]bool{
+		`userName eq "eve"`: true,
+		`USERNAME Eq "eve"`: true,
+		`urn:ietf:params:scim:schemas:core:2.0:User:userName eq "eve"`: true,
+		`userName ne "eve"`:                          false,
+		`name.familyName co "mit"`:                   true,
+		`emails co "home.org"`:                       true,
+		`emails[type eq "work" and value ew ".org"]`: false,
+		`emails[type eq "home" and value ew ".org"]`: true,
+		`emails.type eq "home"`:                      true,
+		`phoneNumbers pr`:                            false,
+		`not (phoneNumbers pr)`:                      true,
+		`active eq true`:                             true,
+		`phoneNumbers eq null`:                       true,
+		`userName gt "a" and (name.givenName sw "x" or active eq false)`: false,
+		`userName lt "f" and (name.givenName sw "e" or active eq false)`: true,
+	} {
+		f, err := parseSCIMFilter(filter)
+		if err != nil {
+			t.Errorf("%s: %v", filter, err)
+			continue
+		}
+		if got := f.match(res); got != want {
+			t.Errorf("%s: expected %v, got %v", filter, want, got)
+		}
+	}
+
+	for _, filter := range []string{
+		``,
+		`userName`,
+		`userName eq`,
+		`userName xx "eve"`,
+		`userName eq "eve`,
+		`userName co true`,
+		`(userName eq "eve"`,
+		`emails[type eq "work"`,
+		`userName eq "eve" extra`,
+	} {
+		_, err := parseSCIMFilter(filter)
+		if serr, ok := err.(scimError); !ok || serr.Type != "invalidFilter" {
+			t.Errorf("%q: expected an invalidFilter error, got %v", filter, err)
+		}
+	}
+}
+
+func TestSCIMPatchOp(t *testing.T) {
+	var res map[string]interface{}
+	json.Unmarshal([]byte(`{
+		"userName": "eve",
+		"emails": [{"value": "eve@example.com", "type": "work"}, {"value": "eve@home.org", "type": "home"}]
+	}`), &res)
+
+	ops := []scimPatchOp{
+		{Op: "Replace", Path: "emails[type eq \"work\"].value", Value: "eve@new.example.com"},
+		{Op: "remove", Path: "emails[type eq \"home\"]"},
+		{Op: "add", Path: "name.givenName", Value: "Eve"},
+		{Op: "add", Path: "emails", Value: map[string]interface{}{"value": "e@x.org"}},
+	}
+	for _, op := range ops {
+		if err := op.apply(res); err != nil {
+			t.Fatalf("%+v: %v", op, err)
+		}
+	}
+	b, _ := json.Marshal(res)
+	want := `{"emails":[{"type":"work","value":"eve@new.example.com"},{"value":"e@x.org"}],"name":{"givenName":"Eve"},"userName":"eve"}`
+	if string(b) != want {
+		t.Errorf("expected %s, got %s", want, b)
+	}
+
+	for _, op := range []scimPatchOp{
+		{Op: "move", Path: "userName"},
+		{Op: "remove"},
+		{Op: "replace", Value: "not an object"},
+		{Op: "replace", Path: "emails[type eq \"other\"].value", Value: "x"},
+		{Op: "replace", Path: "emails[type eq]", Value: "x"},
+	} {
+		if err := op.apply(res); err == nil {
+			t.Errorf("%+v: expected an error", op)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package user
+
+import (
+	"strings"
+)
+
+// scimPatchOp is one operation of a SCIM PATCH request (RFC 7644 section
+// 3.5.2).
+type scimPatchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// scimPath is a parsed PATCH path: attr, attr.sub, attr[filter] or
+// attr[filter].sub.
+type scimPath struct {
+	attr   string
+	filter scimFilter
+	sub    string
+}
+
+func parseSCIMPath(path string) (scimPath, error) {
+	var p scimPath
+	path = scimAttrPath(path)
+	if i := strings.IndexByte(path, '['); i >= 0 {
+		j := strings.LastIndexByte(path, ']')
+		if j < i {
+			return p, scimError{Status: 400, Type: "invalidPath", Detail: "unbalanced brackets in " + path}
+		}
+		f, err := parseSCIMFilter(path[i+1 : j])
+		if err != nil {
+			return p, scimError{Status: 400, Type: "invalidPath", Detail: err.Error()}
+		}
+		p.attr, p.filter = path[:i], f
+		p.sub = strings.TrimPrefix(path[j+1:], ".")
+		return p, nil
+	}
+	if i := strings.IndexByte(path, '.'); i >= 0 {
+		p.attr, p.sub = path[:i], path[i+1:]
+		return p, nil
+	}
+	p.attr = path
+	return p, nil
+}
+
+// apply carries out the operation on the resource in its generic JSON form.
+func (op scimPatchOp) apply(res map[string]interface{}) error {
+	kind := strings.ToLower(op.Op)
+	if kind != "add" && kind != "replace" && kind != "remove" {
+		return scimError{Status: 400, Type: "invalidSyntax", Detail: "unknown op " + op.Op}
+	}
+	if op.Path == "" {
+		if kind == "remove" {
+			return scimError{Status: 400, Type: "noTarget", Detail: "remove needs a path"}
+		}
+		values, ok := op.Value.(map[string]interface{})
+		if !ok {
+			return scimError{Status: 400, Type: "invalidValue", Detail: "value must be an object when there is no path"}
+		}
+		for k, v := range values {
+			if err := (scimPatchOp{Op: kind, Path: k, Value: v}).apply(res); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	p, err := parseSCIMPath(op.Path)
+	if err != nil {
+		return err
+	}
+	key, _ := scimKey(res, p.attr)
+	if p.filter == nil {
+		if p.sub == "" {
+			scimSet(res, key, kind, op.Value)
+			return nil
+		}
+		switch target := res[key].(type) {
+		case []interface{}:
+			for _, e := range target {
+				if elem, ok := e.(map[string]interface{}); ok {
+					scimSet(elem, p.sub, kind, op.Value)
+				}
+			}
+		case map[string]interface{}:
+			scimSet(target, p.sub, kind, op.Value)
+		default:
+			if kind != "remove" {
+				res[key] = map[string]interface{}{p.sub: op.Value}
+			}
+		}
+		return nil
+	}
+
+	elems, _ := res[key].([]interface{})
+	kept := make([]interface{}, 0, len(elems))
+	matched := false
+	for _, e := range elems {
+		elem, ok := e.(map[string]interface{})
+		if !ok || !p.filter.match(elem) {
+			kept = append(kept, e)
+			continue
+		}
+		matched = true
+		switch {
+		case p.sub != "":
+			scimSet(elem, p.sub, kind, op.Value)
+		case kind == "remove":
+			continue
+		default:
+			values, ok := op.Value.(map[string]interface{})
+			if !ok {
+				return scimError{Status: 400, Type: "invalidValue", Detail: "value must be an object for " + op.Path}
+			}
+			for k, v := range values {
+				scimSet(elem, k, "replace", v)
+			}
+		}
+		kept = append(kept, elem)
+	}
+	if !matched && kind != "remove" {
+		return scimError{Status: 400, Type: "noTarget", Detail: "nothing matches " + op.Path}
+	}
+	res[key] = kept
+	return nil
+}
+
+// scimSet adds, replaces or removes the attribute name of obj. Adding to a
+// multi-valued attribute appends to it.
+func scimSet(obj map[string]interface{}, name, kind string, value interface{}) {
+	key, _ := scimKey(obj, name)
+	switch kind {
+	case "remove":
+		delete(obj, key)
+	case "add":
+		if existing, ok := obj[key].([]interface{}); ok {
+			if values, ok := value.([]interface{}); ok {
+				obj[key] = append(existing, values...)
+			} else {
+				obj[key] = append(existing, value)
+			}
+			return
+		}
+		fallthrough
+	default:
+		obj[key] = value
+	}
+}
@@ -0,0 +1,196 @@
+package user
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func scimRequest(method, path, body string) *http.Request {
+	r := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	r.Header.Set("Authorization", "Bearer "+testSCIMToken)
+	r.Header.Set("Content-Type", "application/scim+json")
+	return r
+}
+
+func TestSCIMUsers(t *testing.T) {
+	svc := newStubService()
+	e, st := newTestEndpoints(svc)
+	router := MakeHTTPHandler(context.Background(), e, log.NewNopLogger())
+	do := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	decode := func(w *httptest.ResponseRecorder) (su scimUser) {
+		json.NewDecoder(w.Body).Decode(&su)
+		return su
+	}
+	scimType := func(w *httptest.ResponseRecorder) string {
+		var body struct {
+			ScimType string `json:"scimType"`
+		}
+		json.NewDecoder(w.Body).Decode(&body)
+		return body.ScimType
+	}
+
+	bob := `{
+		"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"],
+		"externalId": "00u1",
+		"userName": "bob",
+		"name": {"givenName": "Bob", "familyName": "Builder"},
+		"emails": [{"value": "bob@home.example.com", "type": "home"}, {"value": "bob@example.com", "type": "work", "primary": true}],
+		"addresses": [{"streetAddress": "1 Main St", "locality": "Springfield", "postalCode": "12345", "country": "US"}],
+		"active": "True"
+	}`
+	if w := do(httptest.NewRequest("POST", "/scim/v2/Users", bytes.NewBufferString(bob))); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a token, got %d", w.Code)
+	}
+	w := do(scimRequest("POST", "/scim/v2/Users", bob))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/scim+json" {
+		t.Errorf("expected a SCIM content type, got %q", ct)
+	}
+	created := decode(w)
+	if w.Header().Get("Location") != "/scim/v2/Users/"+created.ID || created.Meta.Version != w.Header().Get("ETag") {
+		t.Errorf("unexpected headers %v", w.Header())
+	}
+	u := svc.users[created.ID]
+	if u.Username != "bob" || u.LastName != "Builder" || u.Email != "bob@example.com" || u.Password == "" {
+		t.Errorf("unexpected user %+v", u)
+	}
+	if len(created.Addresses) != 1 || created.Addresses[0].StreetAddress != "1 Main St" || created.Addresses[0].Locality != "Springfield" {
+		t.Errorf("unexpected addresses %+v", created.Addresses)
+	}
+	if w := do(scimRequest("POST", "/scim/v2/Users", bob)); w.Code != http.StatusConflict || scimType(w) != "uniqueness" {
+		t.Errorf("expected 409 uniqueness for a taken userName, got %d", w.Code)
+	}
+
+	list := func(filter string) *httptest.ResponseRecorder {
+		return do(scimRequest("GET", "/scim/v2/Users?filter="+url.QueryEscape(filter), ""))
+	}
+	for filter, want := range map[string]int{
+		`userName eq "BOB"`: 1,
+		`emails[type eq "work" and value ew "@example.com"]`: 1,
+		`name.givenName sw "e" or not (userName pr)`:         1,
+		`addresses.locality eq "Springfield"`:                1,
+		`userName ne "nobody"`:                               2,
+	} {
+		var resp scimListResponse
+		json.NewDecoder(list(filter).Body).Decode(&resp)
+		if resp.TotalResults != want || len(resp.Resources) != want {
+			t.Errorf("%s: expected %d results, got %+v", filter, want, resp)
+		}
+	}
+	if w := list(`userName eq`); w.Code != http.StatusBadRequest || scimType(w) != "invalidFilter" {
+		t.Errorf("expected 400 invalidFilter, got %d", w.Code)
+	}
+	w = do(scimRequest("GET", "/scim/v2/Users?startIndex=2&count=1", ""))
+	var paged scimListResponse
+	json.NewDecoder(w.Body).Decode(&paged)
+	if paged.TotalResults != 2 || paged.StartIndex != 2 || paged.ItemsPerPage != 1 {
+		t.Errorf("unexpected page %+v", paged)
+	}
+
+	patch := `{
+		"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+		"Operations": [
+			{"op": "replace", "path": "emails[type eq \"work\"].value", "value": "bob@new.example.com"},
+			{"op": "replace", "value": {"name.familyName": "Smith"}},
+			{"op": "add", "path": "phoneNumbers", "value": [{"value": "tel:+1-212-555-0100", "type": "mobile"}]}
+		]
+	}`
+	r := scimRequest("PATCH", "/scim/v2/Users/"+created.ID, patch)
+	r.Header.Set("If-Match", `W/"42"`)
+	if w := do(r); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("expected 412 for a stale If-Match, got %d", w.Code)
+	}
+	r = scimRequest("PATCH", "/scim/v2/Users/"+created.ID, patch)
+	r.Header.Set("If-Match", created.Meta.Version)
+	w = do(r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	patched := decode(w)
+	if u := svc.users[created.ID]; u.Email != "bob@new.example.com" || u.LastName != "Smith" || u.Phone != "+12125550100" {
+		t.Errorf("unexpected patched user %+v", u)
+	}
+	if patched.Meta.Version == created.Meta.Version {
+		t.Error("expected the version to change")
+	}
+	if len(svc.events) != 1 || svc.events[0].Type != EventUserUpdated || svc.events[0].Actor != "scim" {
+		t.Errorf("expected a UserUpdated event, got %+v", svc.events)
+	}
+	bad := `{"Operations": [{"op": "replace", "path": "emails[type eq \"other\"].value", "value": "x"}]}`
+	if w := do(scimRequest("PATCH", "/scim/v2/Users/"+created.ID, bad)); w.Code != http.StatusBadRequest || scimType(w) != "noTarget" {
+		t.Errorf("expected 400 noTarget, got %d", w.Code)
+	}
+
+	put := `{
+		"userName": "bob",
+		"name": {"givenName": "Bob", "familyName": "Smith"},
+		"addresses": [{"streetAddress": "1 Main St", "locality": "Springfield", "postalCode": "12345", "country": "US"}, {"streetAddress": "2 Elm St", "locality": "Shelbyville"}]
+	}`
+	w = do(scimRequest("PUT", "/scim/v2/Users/"+created.ID, put))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	replaced := decode(w)
+	if len(replaced.Addresses) != 2 || len(replaced.Emails) != 0 || len(svc.deletedAddresses) != 0 {
+		t.Errorf("expected the unchanged address to be kept and one added, got %+v", replaced)
+	}
+
+	w = do(scimRequest("PATCH", "/scim/v2/Users/"+created.ID, `{"Operations": [{"op": "replace", "path": "active", "value": false}]}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if _, ok := svc.deletedUsers[created.ID]; !ok {
+		t.Error("expected active false to delete the user")
+	}
+
+	if w := do(scimRequest("DELETE", "/scim/v2/Users/"+testUserID, "")); w.Code != http.StatusNoContent {
+		t.Errorf("expected 204, got %d", w.Code)
+	}
+	if w := do(scimRequest("GET", "/scim/v2/Users/"+testUserID, "")); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a deleted user, got %d", w.Code)
+	}
+
+	actions := map[string]int{}
+	for _, entry := range st.entries {
+		if entry.Actor == "scim" && entry.Outcome == outcomeSuccess {
+			actions[entry.Action]++
+		}
+	}
+	if actions["user.create"] != 1 || actions["user.update"] != 3 || actions["user.delete"] != 1 {
+		t.Errorf("unexpected audit trail %v", actions)
+	}
+}
+
+func TestSCIMDiscovery(t *testing.T) {
+	router := newTestRouter()
+	for _, path := range []string{"/scim/v2/ServiceProviderConfig", "/scim/v2/ResourceTypes", "/scim/v2/Schemas"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/scim+json" {
+			t.Errorf("%s: expected 200, got %d", path, w.Code)
+		}
+	}
+	var config struct {
+		Filter struct {
+			Supported  bool `json:"supported"`
+			MaxResults int  `json:"maxResults"`
+		} `json:"filter"`
+	}
+	json.Unmarshal(scimDocuments.ServiceProviderConfig, &config)
+	if !config.Filter.Supported || config.Filter.MaxResults != scimMaxResults {
+		t.Errorf("unexpected filter config %+v", config.Filter)
+	}
+}
@@ -0,0 +1,370 @@
+package user
+
+import (
+	"bytes"
+	"context"
+	"html"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/user/dbOperations"
+)
+
+// searchFields are the fields customers are searched by, named as in the
+// API, and the values each has in a user.
+var searchFields = []struct {
+	name   string
+	field  string
+	values func(u dbOperations.User) []string
+}{
+	{"username", "username", func(u dbOperations.User) []string { return []string{u.Username} }},
+	{"email", "email", func(u dbOperations.User) []string { return []string{u.Email} }},
+	{"firstName", "firstname", func(u dbOperations.User) []string { return []string{u.FirstName} }},
+	{"lastName", "lastname", func(u dbOperations.User) []string { return []string{u.LastName} }},
+	{"phone", "phone", func(u dbOperations.User) []string { return []string{u.Phone} }},
+	{"postcode", "postcode", func(u dbOperations.User) []string {
+		postcodes := make([]string, len(u.Addresses))
+		for i, a := range u.Addresses {
+			postcodes[i] = a.PostCode
+		}
+		return postcodes
+	}},
+}
+
+// SearchQuery is what support staff look a customer up by.
+type SearchQuery struct {
+	// Text holds the words to find. Every word must match the start of a
+	// word of the customer, or nearly match one when misspelt.
+	Text string
+	// Fields limits the fields searched, named as in the API. All are
+	// searched when it is empty.
+	Fields []string
+	// Country, if set, only finds customers with an address in it.
+	Country string
+	// Limit is how many customers are found at most.
+	Limit int
+}
+
+// SearchHit is a customer found, how well it matched, and its matching
+// fields with the matches marked.
+type SearchHit struct {
+	dbOperations.User
+	Score float64 `json:"score"`
+	// Highlights are the values of the matching fields as HTML, with the
+	// matches in <em>.
+	Highlights map[string]string `json:"highlights"`
+}
+
+// Searcher finds customers, best matches first.
+type Searcher interface {
+	Search(q SearchQuery) ([]SearchHit, error)
+}
+
+// SearchStore finds the users that may match the words of a search.
+// *dbOperations.Mongo implements it.
+type SearchStore interface {
+	SearchUsers(words []string, limit int) ([]dbOperations.User, error)
+}
+
+// searchCandidates is how many candidates per customer asked for are
+// ranked by TextSearch.
+const searchCandidates = 10
+
+// TextSearch searches the text index of a SearchStore, and ranks the
+// candidates it finds.
+type TextSearch struct {
+	st SearchStore
+}
+
+// NewTextSearch returns a Searcher over st.
+func NewTextSearch(st SearchStore) *TextSearch {
+	return &TextSearch{st: st}
+}
+
+// Search implements Searcher.
+func (s *TextSearch) Search(q SearchQuery) ([]SearchHit, error) {
+	words := searchWords(q.Text)
+	users, err := s.st.SearchUsers(words, searchCandidates*q.Limit)
+	if err != nil {
+		return nil, err
+	}
+	var hits []SearchHit
+	for _, u := range users {
+		if hit, ok := matchUser(u, words, q); ok {
+			hits = append(hits, hit)
+		}
+	}
+	return rankHits(hits, q.Limit), nil
+}
+
+// UserExporter reads every live user with their addresses. BulkStore
+// implementations do.
+type UserExporter interface {
+	ExportUsers(fn func(dbOperations.User) error) error
+}
+
+// MemorySearch matches every user in memory, reading them all for each
+// search. It needs no index, and suits small stores and tests.
+type MemorySearch struct {
+	st UserExporter
+}
+
+// NewMemorySearch returns a Searcher over the users of st.
+func NewMemorySearch(st UserExporter) *MemorySearch {
+	return &MemorySearch{st: st}
+}
+
+// Search implements Searcher.
+func (s *MemorySearch) Search(q SearchQuery) ([]SearchHit, error) {
+	words := searchWords(q.Text)
+	var hits []SearchHit
+	err := s.st.ExportUsers(func(u dbOperations.User) error {
+		if hit, ok := matchUser(u, words, q); ok {
+			hits = append(hits, hit)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rankHits(hits, q.Limit), nil
+}
+
+// searchWords returns the words of a search text.
+func searchWords(text string) []string {
+	tokens := dbOperations.SearchTokens("", text)
+	words := make([]string, len(tokens))
+	for i, t := range tokens {
+		words[i] = t.Text
+	}
+	return words
+}
+
+// rankHits returns the best limit hits, best first, and in order of
+// username among equals.
+func rankHits(hits []SearchHit, limit int) []SearchHit {
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].Username < hits[j].Username
+	})
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+	if hits == nil {
+		hits = []SearchHit{}
+	}
+	return hits
+}
+
+// matchUser reports whether every word matches a field of u that q
+// searches, and how well. Each word counts by its best match, weighted by
+// the field it is in, and is highlighted wherever it matches.
+func matchUser(u dbOperations.User, words []string, q SearchQuery) (SearchHit, bool) {
+	if len(words) == 0 || (q.Country != "" && !hasCountry(u, q.Country)) {
+		return SearchHit{}, false
+	}
+	hit := SearchHit{User: u, Highlights: map[string]string{}}
+	spans := map[string][][2]int{}
+	values := map[string]string{}
+	for _, w := range words {
+		best := 0.0
+		for _, f := range searchFields {
+			if len(q.Fields) > 0 && !contains(q.Fields, f.name) {
+				continue
+			}
+			weight := float64(dbOperations.SearchWeight(f.field))
+			for _, v := range f.values(u) {
+				for _, t := range dbOperations.SearchTokens(f.field, v) {
+					score, n := matchWord(w, t.Text)
+					if score == 0 {
+						continue
+					}
+					if score*weight > best {
+						best = score * weight
+					}
+					// Of the postcodes, only the first matching is
+					// highlighted.
+					if matched, ok := values[f.name]; !ok || matched == v {
+						values[f.name] = v
+						spans[f.name] = append(spans[f.name], [2]int{t.Start, spanEnd(v, t, n)})
+					}
+				}
+			}
+		}
+		if best == 0 {
+			return SearchHit{}, false
+		}
+		hit.Score += best
+	}
+	for name, v := range values {
+		hit.Highlights[name] = highlight(v, spans[name])
+	}
+	return hit, true
+}
+
+// matchWord returns how well the search word w matches the word t of a
+// field, from 0 for not at all to 1 for the same word, and how many of
+// t's letters matched. t matches when it starts with w, and when w or a
+// prefix of t is at most one edit away from the other, or two for longer
+// words, without changing the first letters.
+func matchWord(w, t string) (float64, int) {
+	wr, tr := []rune(w), []rune(t)
+	switch {
+	case w == t:
+		return 1, len(tr)
+	case len(wr) >= dbOperations.SearchPrefix && strings.HasPrefix(t, w):
+		return 0.5 + 0.4*float64(len(wr))/float64(len(tr)), len(wr)
+	case len(wr) <= dbOperations.FuzzyPrefix || len(tr) < dbOperations.FuzzyPrefix ||
+		string(wr[:dbOperations.FuzzyPrefix]) != string(tr[:dbOperations.FuzzyPrefix]):
+		return 0, 0
+	}
+	typos := 1
+	if len(wr) >= 8 {
+		typos = 2
+	}
+	d, n := editDistance(wr, tr), len(tr)
+	if len(tr) > len(wr) {
+		if p := editDistance(wr, tr[:len(wr)]); p < d {
+			d, n = p, len(wr)
+		}
+	}
+	if d > typos {
+		return 0, 0
+	}
+	return 0.4 / float64(d), n
+}
+
+// editDistance returns how many letters must be inserted, deleted,
+// replaced or swapped with the next to turn a into b.
+func editDistance(a, b []rune) int {
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = d[i-1][j-1] + cost
+			if d[i-1][j]+1 < d[i][j] {
+				d[i][j] = d[i-1][j] + 1
+			}
+			if d[i][j-1]+1 < d[i][j] {
+				d[i][j] = d[i][j-1] + 1
+			}
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] && d[i-2][j-2]+1 < d[i][j] {
+				d[i][j] = d[i-2][j-2] + 1
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
+
+// spanEnd returns where the first n letters and digits of the token t of
+// v end in v.
+func spanEnd(v string, t dbOperations.SearchToken, n int) int {
+	for i, r := range v[t.Start:t.End] {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if n == 0 {
+				return t.Start + i
+			}
+			n--
+		}
+	}
+	return t.End
+}
+
+// highlight returns v as HTML with spans in <em>, overlapping ones
+// merged.
+func highlight(v string, spans [][2]int) string {
+	sort.Slice(spans, func(i, j int) bool { return spans[i][0] < spans[j][0] })
+	var merged [][2]int
+	for _, s := range spans {
+		if n := len(merged); n > 0 && s[0] <= merged[n-1][1] {
+			if s[1] > merged[n-1][1] {
+				merged[n-1][1] = s[1]
+			}
+			continue
+		}
+		merged = append(merged, s)
+	}
+	var b bytes.Buffer
+	at := 0
+	for _, s := range merged {
+		b.WriteString(html.EscapeString(v[at:s[0]]))
+		b.WriteString("<em>" + html.EscapeString(v[s[0]:s[1]]) + "</em>")
+		at = s[1]
+	}
+	b.WriteString(html.EscapeString(v[at:]))
+	return b.String()
+}
+
+// hasCountry reports whether u has an address in country, by any name or
+// code of it.
+func hasCountry(u dbOperations.User, country string) bool {
+	want, known := LookupCountry(country)
+	for _, a := range u.Addresses {
+		if c, ok := LookupCountry(a.Country); ok && known {
+			if c == want {
+				return true
+			}
+		} else if strings.EqualFold(strings.TrimSpace(a.Country), strings.TrimSpace(country)) {
+			return true
+		}
+	}
+	return false
+}
+
+// SearchEndpoints mounts the customer search, for support staff and
+// admins.
+func SearchEndpoints(e Endpoints, s Searcher) Endpoints {
+	e.SearchEndpoint = RequireRole(RoleSupport, RoleAdmin)(MakeSearchEndpoint(s))
+	return e
+}
+
+// MakeSearchEndpoint returns an endpoint searching customers.
+func MakeSearchEndpoint(s Searcher) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		hits, err := s.Search(request.(SearchQuery))
+		return EmbedStruct{searchResponse{Hits: hits}}, err
+	}
+}
+
+// searchFieldNames are the names of the fields a search can be limited
+// to.
+func searchFieldNames() []string {
+	names := make([]string, len(searchFields))
+	for i, f := range searchFields {
+		names[i] = f.name
+	}
+	return names
+}
+
+// validSearch reports whether q searches something, within the fields and
+// limit allowed.
+func validSearch(q SearchQuery) bool {
+	if len(searchWords(q.Text)) == 0 || utf8.RuneCountInString(q.Text) > 200 || q.Limit < 1 || q.Limit > 100 {
+		return false
+	}
+	for _, f := range q.Fields {
+		if !contains(searchFieldNames(), f) {
+			return false
+		}
+	}
+	return true
+}
+
+type searchResponse struct {
+	Hits []SearchHit `json:"customer"`
+}
@@ -0,0 +1,149 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/user/dbOperations"
+)
+
+// searchUsers is a UserExporter, and a SearchStore finding every user as
+// a candidate.
+type searchUsers []dbOperations.User
+
+func (us searchUsers) ExportUsers(fn func(dbOperations.User) error) error {
+	for _, u := range us {
+		if err := fn(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (us searchUsers) SearchUsers(words []string, limit int) ([]dbOperations.User, error) {
+	return us, nil
+}
+
+var testSearchUsers = searchUsers{
+	{UserID: "1", Username: "asmith", Email: "alice.smith@example.com", FirstName: "Alice", LastName: "Smith", Phone: "+44 7911 123456",
+		Addresses: []dbOperations.Address{{PostCode: "SW1A 1AA", Country: "UK"}}},
+	{UserID: "2", Username: "bsmithson", FirstName: "Bob", LastName: "Smithson", Phone: "0791 555",
+		Addresses: []dbOperations.Address{{PostCode: "10115", Country: "Germany"}}},
+	{UserID: "3", Username: "carol", Email: "carol@example.com", FirstName: "Carol", LastName: "O'Neil <admin>"},
+}
+
+func TestSearch(t *testing.T) {
+	for name, s := range map[string]Searcher{
+		"text":   NewTextSearch(testSearchUsers),
+		"memory": NewMemorySearch(testSearchUsers),
+	} {
+		for _, c := range []struct {
+			q     SearchQuery
+			found []string
+		}{
+			{SearchQuery{Text: "smith"}, []string{"asmith", "bsmithson"}},
+			{SearchQuery{Text: "smi"}, []string{"asmith", "bsmithson"}},
+			{SearchQuery{Text: "smiht"}, []string{"asmith", "bsmithson"}},
+			{SearchQuery{Text: "smtih"}, nil},
+			{SearchQuery{Text: "alice smith"}, []string{"asmith"}},
+			{SearchQuery{Text: "alice.smith@example.com"}, []string{"asmith"}},
+			{SearchQuery{Text: "sw1a1aa"}, []string{"asmith"}},
+			{SearchQuery{Text: "SW1A 1AA"}, []string{"asmith"}},
+			{SearchQuery{Text: "447911"}, []string{"asmith"}},
+			{SearchQuery{Text: "0791"}, []string{"bsmithson"}},
+			{SearchQuery{Text: "smith", Country: "germany"}, []string{"bsmithson"}},
+			{SearchQuery{Text: "example", Fields: []string{"email"}}, []string{"asmith", "carol"}},
+			{SearchQuery{Text: "example", Fields: []string{"lastName"}}, nil},
+			{SearchQuery{Text: "smith", Limit: 1}, []string{"asmith"}},
+			{SearchQuery{Text: "s"}, nil},
+		} {
+			if c.q.Limit == 0 {
+				c.q.Limit = 20
+			}
+			hits, err := s.Search(c.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var found []string
+			for _, h := range hits {
+				found = append(found, h.Username)
+			}
+			if len(found) != len(c.found) {
+				t.Errorf("%s %+v: expected %v, got %v", name, c.q, c.found, found)
+				continue
+			}
+			for i := range found {
+				if found[i] != c.found[i] {
+					t.Errorf("%s %+v: expected %v, got %v", name, c.q, c.found, found)
+				}
+			}
+		}
+	}
+}
+
+func TestSearchHighlights(t *testing.T) {
+	s := NewMemorySearch(testSearchUsers)
+	for _, c := range []struct {
+		text       string
+		highlights map[string]string
+	}{
+		{"smi ali", map[string]string{"email": "<em>ali</em>ce.<em>smi</em>th@example.com"}},
+		{"alice", map[string]string{"firstName": "<em>Alice</em>"}},
+		{"sw1a1", map[string]string{"postcode": "<em>SW1A 1</em>AA"}},
+		{"o neil", map[string]string{"lastName": "<em>O</em>&#39;<em>Neil</em> &lt;admin&gt;"}},
+		{"asmiht", map[string]string{"username": "<em>asmith</em>"}},
+	} {
+		hits, err := s.Search(SearchQuery{Text: c.text, Limit: 1})
+		if err != nil || len(hits) != 1 {
+			t.Fatalf("%s: expected a hit, got %v: %v", c.text, hits, err)
+		}
+		for field, want := range c.highlights {
+			if got := hits[0].Highlights[field]; got != want {
+				t.Errorf("%s: expected %s highlighted as %q, got %q", c.text, field, want, got)
+			}
+		}
+	}
+}
+
+func TestSearchEndpoint(t *testing.T) {
+	svc := newStubService()
+	e := SearchEndpoints(MakeEndpoints(svc), NewMemorySearch(svc))
+	e = AuthenticateEndpoints(e, testTokens)
+	router := MakeHTTPHandler(context.Background(), e, log.NewNopLogger())
+	do := func(path, authorization string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Authorization", authorization)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do("/customers/search?q=ev", "Bearer "+testSupportToken)
+	var resp struct {
+		Embedded searchResponse `json:"_embedded"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	if w.Code != http.StatusOK || len(resp.Embedded.Hits) != 1 || resp.Embedded.Hits[0].UserID != "57a98d98e4b00679b4a830af" {
+		t.Errorf("unexpected search %d: %+v", w.Code, resp)
+	}
+	for path, code := range map[string]int{
+		"/customers/search?q=ev&limit=0":         http.StatusBadRequest,
+		"/customers/search?q=ev&fields=street":   http.StatusBadRequest,
+		"/customers/search?q=+-+":                http.StatusBadRequest,
+		"/customers/search?q=ev&fields=username": http.StatusOK,
+	} {
+		if w := do(path, "Bearer "+testAdminToken); w.Code != code {
+			t.Errorf("%s: expected %d, got %d", path, code, w.Code)
+		}
+	}
+	if w := do("/customers/search?q=ev", "Bearer "+testSCIMToken); w.Code != http.StatusForbidden {
+		t.Errorf("expected other roles to be refused, got %d", w.Code)
+	}
+	if w := do("/customers/search?q=ev", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected anonymous callers to be refused, got %d", w.Code)
+	}
+}
@@ -1,7 +1,11 @@
 package user
 
 import (
+	"crypto/md5"
+	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -14,27 +18,62 @@ var (
 	ErrUnauthorized = errors.New("Unauthorized")
 )
 
+// The schemes a password hash can be in. Users imported with a legacy
+// scheme log in as before, and their password is moved to the service's
+// own scheme when they do.
+const (
+	// PasswordSHA256 is the service's own: the hex SHA-256 of the password
+	// followed by the salt.
+	PasswordSHA256 = "sha256"
+	// PasswordSHA1 is the hex SHA-1 of the password followed by the salt,
+	// if any.
+	PasswordSHA1 = "sha1"
+	// PasswordMD5 is the hex MD5 of the password followed by the salt, if
+	// any.
+	PasswordMD5 = "md5"
+)
+
 // Service is the user service, providing operations for users to login, register, and retrieve user information.
+// Deletions are soft and record who made them in by; they can be undone through the restore endpoints.
+// A non-zero version makes an update or deletion conditional on the user or address still being at that version.
+// Every change is followed by a domain event in the outbox, see RelayEvents.
 type Service interface {
 	Login(username, password string) (dbOperations.User, error)
 	Register(username, password, email, firstname, lastname, phone string) (dbOperations.User, error)
 	PostUser(u dbOperations.User) (dbOperations.User, error)
+	PutUser(u dbOperations.User, by string, version int64) (dbOperations.User, error)
 	GetUsers() ([]dbOperations.User, error)
 	GetUser(id string) (dbOperations.User, error)
 	PostAddress(u dbOperations.Address, userid string) (string, error)
 	GetAddresses() ([]dbOperations.Address, error)
 	GetAddress(id string) (dbOperations.Address, error)
-	DeleteAddress(addrid, userid string) error
-	DeleteUser(userid string) error
-	//Health() []Health // GET /health
+	DeleteAddress(addrid, userid, by string, version int64) error
+	DeleteUser(userid, by string, version int64) error
+}
+
+// UserStore is the database the service works on. It writes the events
+// of the users and addresses it creates and deletes along with them.
+type UserStore interface {
+	CreateUser(u *dbOperations.User) error
+	GetUser(id string) (dbOperations.User, error)
+	GetUserWithName(username string) (dbOperations.User, error)
+	GetUsers() ([]dbOperations.User, error)
+	UpdateUser(u *dbOperations.User, version int64) error
+	DeleteUser(id, by string, version int64) error
+	PopulateAddressesForUser(u *dbOperations.User) error
+	CreateAddress(a *dbOperations.Address, userid string) error
+	GetAddress(id string) (dbOperations.Address, error)
+	GetAddresses() ([]dbOperations.Address, error)
+	DeleteAddress(userid, addid, by string, version int64) error
+	AppendEvent(e *dbOperations.Event) error
 }
 
 type userService struct {
-	db     *dbOperations.Mongo
+	db     UserStore
 	logger log.Logger
 }
 
-func NewUserService(db *dbOperations.Mongo, logger log.Logger) Service {
+func NewUserService(db UserStore, logger log.Logger) Service {
 	return &userService{
 		db:     db,
 		logger: logger,
@@ -46,9 +85,16 @@ func (s *userService) Login(username, password string) (dbOperations.User, error
 	if err != nil {
 		return u, err
 	}
-	if u.Password != computeHashFor(password, u.Salt) {
+	if !checkPassword(u, password) {
 		return u, ErrUnauthorized
 	}
+	if u.PasswordScheme != "" {
+		SetPassword(&u, password)
+		if err := s.db.UpdateUser(&u, 0); err != nil {
+			// The legacy hash keeps working, so the login goes on.
+			s.logger.Log("password", "upgrade", "user", u.UserID, "err", err)
+		}
+	}
 	s.db.PopulateAddressesForUser(&u)
 	return u, nil
 }
@@ -62,10 +108,7 @@ func (s *userService) Register(username, password, email, firstname, lastname, p
 	u.Phone = phone
 	u.Password = computeHashFor(password, u.Salt)
 	err := s.db.CreateUser(&u)
-	if err != nil {
-		return u, err
-	}
-	return u, nil
+	return u, err
 }
 
 func (s *userService) PostUser(u dbOperations.User) (dbOperations.User, error) {
@@ -75,6 +118,32 @@ func (s *userService) PostUser(u dbOperations.User) (dbOperations.User, error) {
 	return u, err
 }
 
+// PutUser replaces the username, email, names and phone number of the user
+// u.UserID with those of u, and its password if u has one. It answers with
+// the user as it is afterwards.
+func (s *userService) PutUser(u dbOperations.User, by string, version int64) (dbOperations.User, error) {
+	cur, err := s.db.GetUser(u.UserID)
+	if err != nil {
+		return u, err
+	}
+	u.Tenant = cur.Tenant
+	if u.Password != "" {
+		SetPassword(&u, u.Password)
+	}
+	if err := s.db.UpdateUser(&u, version); err != nil {
+		return u, err
+	}
+	e, err := NewEvent(EventUserUpdated, u.UserID, u.EventPayload())
+	if err == nil {
+		e.Actor = by
+		err = s.db.AppendEvent(&e)
+	}
+	if err != nil {
+		return u, err
+	}
+	return s.db.GetUser(u.UserID)
+}
+
 func (s *userService) GetUsers() ([]dbOperations.User, error) {
 	usrs, err := s.db.GetUsers()
 	return usrs, err
@@ -100,14 +169,39 @@ func (s *userService) GetAddress(id string) (dbOperations.Address, error) {
 	return addr, err
 }
 
-func (s *userService) DeleteAddress(addrid, userid string) error {
-	err := s.db.DeleteAddress(addrid, userid)
-	return err
+func (s *userService) DeleteAddress(addrid, userid, by string, version int64) error {
+	return s.db.DeleteAddress(userid, addrid, by, version)
+}
+
+func (s *userService) DeleteUser(userid, by string, version int64) error {
+	return s.db.DeleteUser(userid, by, version)
+}
+
+// SetPassword gives u a new salt and the hash of password, in the
+// service's own scheme.
+func SetPassword(u *dbOperations.User, password string) {
+	u.NewSalt()
+	u.Password = computeHashFor(password, u.Salt)
+	u.PasswordScheme = ""
 }
 
-func (s *userService) DeleteUser(userid string) error {
-	err := s.db.DeleteUser(userid)
-	return err
+// checkPassword reports whether password is u's, whatever the scheme of
+// its hash.
+func checkPassword(u dbOperations.User, password string) bool {
+	var sum string
+	switch u.PasswordScheme {
+	case "", PasswordSHA256:
+		sum = computeHashFor(password, u.Salt)
+	case PasswordSHA1:
+		b := sha1.Sum([]byte(password + u.Salt))
+		sum = hex.EncodeToString(b[:])
+	case PasswordMD5:
+		b := md5.Sum([]byte(password + u.Salt))
+		sum = hex.EncodeToString(b[:])
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(sum), []byte(u.Password)) == 1
 }
 
 func computeHashFor(pass, salt string) string {
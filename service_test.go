@@ -0,0 +1,592 @@
+package user
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/user/dbOperations"
+	mgo "gopkg.in/mgo.v2"
+)
+
+const (
+	testAdminToken   = "test-admin-token"
+	testSCIMToken    = "test-scim-token"
+	testSupportToken = "test-support-token"
+	testErasureGrace = time.Hour
+)
+
+var testTokens = TokenAuthenticator{
+	testAdminToken:   {ID: "admin", Roles: []string{RoleAdmin}},
+	testSCIMToken:    {ID: "scim", Roles: []string{RoleProvisioner}},
+	testSupportToken: {ID: "support", Roles: []string{RoleSupport}},
+}
+
+// testAttributeSchemas are the custom attributes of the test customers.
+var testAttributeSchemas, _ = ParseAttributeSchemas([]byte(`{"*": {
+	"shoeSize": {"type": "integer", "minimum": 16, "maximum": 52, "indexed": true},
+	"loyaltyTier": {"type": "string", "enum": ["bronze", "silver", "gold"]},
+	"memberNo": {"type": "string", "pattern": "M[0-9]{6}"},
+	"newsletter": {"type": "boolean"}
+}}`))
+
+// newTestEndpoints wires the endpoints the way cmd/main.go does, around
+// svc and an in-memory store.
+func newTestEndpoints(svc *stubService) (Endpoints, *memDataSubjects) {
+	st := &memDataSubjects{memAuditLog: &memAuditLog{}, svc: svc, consents: map[string]dbOperations.Consent{}}
+	e := MakeEndpoints(svc)
+	e = DataSubjectEndpoints(e, st, testErasureGrace)
+	e = DefaultsEndpoints(e, svc)
+	e = PreferencesEndpoints(e, svc, testAttributeSchemas.For(dbOperations.DefaultTenant))
+	e = PolicyEndpoints(e, svc)
+	e = PhoneVerificationEndpoints(e, svc, svc)
+	e = RestoreEndpoints(e, svc)
+	e = BulkEndpoints(e, svc)
+	e = WebhookEndpoints(e, svc)
+	e = SCIMEndpoints(e, svc, svc)
+	e = TenantPolicyEndpoints(e, dbOperations.Tenant{ID: dbOperations.DefaultTenant})
+	provider := NewOIDCProvider(testIssuer, testSigningKey(), svc, newMemOIDC(svc, st))
+	e = OIDCEndpoints(e, provider)
+	e = IdentityEndpoints(e, provider, newMemIdentities(svc), newFakeUpstream())
+	keys := &memAPIKeys{}
+	e = APIKeyEndpoints(e, keys, true)
+	e = HealthEndpoints(e, pingerFunc(func() error { return nil }))
+	e = TenantEndpoints(e, newMemTenants(), nil)
+	e = SearchEndpoints(e, NewMemorySearch(svc))
+	e = AuditEndpoints(e, st, log.NewNopLogger())
+	e = AuthenticateEndpoints(e, Authenticators{provider, testTokens, APIKeyAuthenticator{keys}})
+	return e, st
+}
+
+// stubService is an in-memory Service, DeletedStore, WebhookStore and
+// SCIMStore used by the transport tests.
+type stubService struct {
+	*memWebhooks
+	*memOutbox
+	users            map[string]dbOperations.User
+	addresses        map[string]dbOperations.Address
+	deletedUsers     map[string]dbOperations.User
+	deletedAddresses map[string]dbOperations.Address
+	// phoneCodes are the hashes of the codes sent by user, and sms the
+	// messages sent.
+	phoneCodes map[string]string
+	sms        []string
+	// policies are kept by name and then oldest first, as Mongo returns
+	// them.
+	policies    []dbOperations.Policy
+	acceptances []dbOperations.Acceptance
+}
+
+func newStubService() *stubService {
+	return &stubService{
+		memWebhooks: &memWebhooks{},
+		memOutbox:   &memOutbox{},
+		users: map[string]dbOperations.User{
+			"57a98d98e4b00679b4a830af": {
+				UserID:    "57a98d98e4b00679b4a830af",
+				Username:  "eve",
+				Password:  "secret",
+				FirstName: "Eve",
+				Version:   3,
+				Addresses: []dbOperations.Address{{ID: "57a98d98e4b00679b4a830b0", City: "Zurich"}},
+			},
+		},
+		addresses: map[string]dbOperations.Address{
+			"57a98d98e4b00679b4a830b0": {ID: "57a98d98e4b00679b4a830b0", City: "Zurich", Version: 1},
+		},
+		deletedUsers:     map[string]dbOperations.User{},
+		deletedAddresses: map[string]dbOperations.Address{},
+		phoneCodes:       map[string]string{},
+	}
+}
+
+func (s *stubService) Login(username, password string) (dbOperations.User, error) {
+	for _, u := range s.users {
+		if u.Username == username {
+			if u.Password != password {
+				return dbOperations.User{}, ErrUnauthorized
+			}
+			return u, nil
+		}
+	}
+	return dbOperations.User{}, mgo.ErrNotFound
+}
+
+func (s *stubService) Register(username, password, email, firstname, lastname, phone string) (dbOperations.User, error) {
+	return s.PostUser(dbOperations.User{Username: username, Password: password, Email: email, FirstName: firstname, LastName: lastname, Phone: phone})
+}
+
+func (s *stubService) PostUser(u dbOperations.User) (dbOperations.User, error) {
+	for _, o := range s.users {
+		if o.Username == u.Username {
+			return u, &mgo.LastError{Code: 11000}
+		}
+	}
+	u.UserID, u.Version = "57a98d98e4b00679b4a830b1", 1
+	s.users[u.UserID] = u
+	return u, nil
+}
+
+func (s *stubService) GetUsers() ([]dbOperations.User, error) {
+	users := make([]dbOperations.User, 0)
+	for _, u := range s.users {
+		users = append(users, u)
+	}
+	return users, nil
+}
+
+func (s *stubService) GetUser(id string) (dbOperations.User, error) {
+	u, ok := s.users[id]
+	if !ok {
+		return u, mgo.ErrNotFound
+	}
+	return u, nil
+}
+
+func (s *stubService) PostAddress(a dbOperations.Address, userid string) (string, error) {
+	if _, ok := s.users[userid]; !ok {
+		return "", dbOperations.ErrInvalidHexID
+	}
+	a.ID = "57a98d98e4b00679b4a830b2"
+	for n := 0xc0; s.addresses[a.ID].ID != "" || s.deletedAddresses[a.ID].ID != ""; n++ {
+		a.ID = fmt.Sprintf("57a98d98e4b00679b4a830%02x", n)
+	}
+	s.addresses[a.ID] = a
+	u := s.users[userid]
+	u.Addresses = append(u.Addresses, a)
+	s.users[userid] = u
+	return a.ID, nil
+}
+
+func (s *stubService) GetAddresses() ([]dbOperations.Address, error) {
+	adds := make([]dbOperations.Address, 0)
+	for _, a := range s.addresses {
+		adds = append(adds, a)
+	}
+	return adds, nil
+}
+
+func (s *stubService) GetAddress(id string) (dbOperations.Address, error) {
+	a, ok := s.addresses[id]
+	if !ok {
+		return a, mgo.ErrNotFound
+	}
+	return a, nil
+}
+
+func (s *stubService) DeleteAddress(addrid, userid, by string, version int64) error {
+	a, ok := s.addresses[addrid]
+	if !ok {
+		return mgo.ErrNotFound
+	}
+	if version != 0 && version != a.Version {
+		return dbOperations.ErrVersionConflict
+	}
+	now := time.Now()
+	a.DeletedAt, a.DeletedBy, a.DeletedFrom = &now, by, userid
+	s.deletedAddresses[addrid] = a
+	delete(s.addresses, addrid)
+	if u, ok := s.users[userid]; ok {
+		kept := u.Addresses[:0:0]
+		for _, o := range u.Addresses {
+			if o.ID != addrid {
+				kept = append(kept, o)
+			}
+		}
+		u.Addresses = kept
+		s.users[userid] = u
+	}
+	return nil
+}
+
+func (s *stubService) DeleteUser(userid, by string, version int64) error {
+	u, ok := s.users[userid]
+	if !ok {
+		return mgo.ErrNotFound
+	}
+	if version != 0 && version != u.Version {
+		return dbOperations.ErrVersionConflict
+	}
+	now := time.Now()
+	u.DeletedAt, u.DeletedBy = &now, by
+	s.deletedUsers[userid] = u
+	delete(s.users, userid)
+	return nil
+}
+
+func (s *stubService) UpdateUser(u *dbOperations.User, version int64) error {
+	cur, ok := s.users[u.UserID]
+	if !ok {
+		return mgo.ErrNotFound
+	}
+	if version != 0 && version != cur.Version {
+		return dbOperations.ErrVersionConflict
+	}
+	if u.Phone != cur.Phone {
+		cur.PhoneVerified = false
+	}
+	cur.Username, cur.Email, cur.FirstName, cur.LastName, cur.Phone = u.Username, u.Email, u.FirstName, u.LastName, u.Phone
+	if u.Password != "" {
+		cur.Password, cur.Salt = u.Password, u.Salt
+	}
+	cur.Version++
+	s.users[u.UserID] = cur
+	u.Version = cur.Version
+	return nil
+}
+
+func (s *stubService) PutUser(u dbOperations.User, by string, version int64) (dbOperations.User, error) {
+	if err := s.UpdateUser(&u, version); err != nil {
+		return u, err
+	}
+	return s.GetUser(u.UserID)
+}
+
+func (s *stubService) SetDefaultAddresses(userid, shipping, billing string, version int64) (int64, error) {
+	u, ok := s.users[userid]
+	if !ok {
+		return 0, mgo.ErrNotFound
+	}
+	if version != 0 && version != u.Version {
+		return 0, dbOperations.ErrVersionConflict
+	}
+	for typ, id := range map[string]*string{dbOperations.AddressShipping: &shipping, dbOperations.AddressBilling: &billing} {
+		if *id == "" {
+			continue
+		}
+		var a dbOperations.Address
+		for _, o := range u.Addresses {
+			if o.ID == *id {
+				a = s.addresses[o.ID]
+			}
+		}
+		if a.ID == "" {
+			return 0, mgo.ErrNotFound
+		}
+		if !a.Serves(typ) {
+			return 0, dbOperations.ErrAddressType
+		}
+	}
+	if shipping != "" {
+		u.DefaultShipping = shipping
+	}
+	if billing != "" {
+		u.DefaultBilling = billing
+	}
+	u.Version++
+	s.users[userid] = u
+	return u.Version, nil
+}
+
+func (s *stubService) UpdatePreferences(userid string, p dbOperations.Preferences, attributes map[string]interface{}, version int64) (int64, error) {
+	u, ok := s.users[userid]
+	if !ok {
+		return 0, mgo.ErrNotFound
+	}
+	if version != 0 && version != u.Version {
+		return 0, dbOperations.ErrVersionConflict
+	}
+	u.Preferences, u.Attributes = p, attributes
+	u.Version++
+	s.users[userid] = u
+	return u.Version, nil
+}
+
+func (s *stubService) CreatePolicy(p *dbOperations.Policy) error {
+	for _, o := range s.policies {
+		if o.Name == p.Name && o.Version == p.Version {
+			return dbOperations.ErrPolicyExists
+		}
+	}
+	p.ID = fmt.Sprintf("57a98d98e4b00679b4a831%02x", len(s.policies))
+	s.policies = append(s.policies, *p)
+	sort.SliceStable(s.policies, func(i, j int) bool { return s.policies[i].Name < s.policies[j].Name })
+	return nil
+}
+
+func (s *stubService) GetPolicies() ([]dbOperations.Policy, error) {
+	return append([]dbOperations.Policy{}, s.policies...), nil
+}
+
+func (s *stubService) AddAcceptance(a *dbOperations.Acceptance) error {
+	a.ID = fmt.Sprintf("57a98d98e4b00679b4a832%02x", len(s.acceptances))
+	s.acceptances = append(s.acceptances, *a)
+	return nil
+}
+
+func (s *stubService) GetAcceptances(userid string) ([]dbOperations.Acceptance, error) {
+	acceptances := make([]dbOperations.Acceptance, 0)
+	for _, a := range s.acceptances {
+		if a.UserID == userid {
+			acceptances = append(acceptances, a)
+		}
+	}
+	return acceptances, nil
+}
+
+func (s *stubService) CreatePhoneVerification(userid, phone, codeHash string, expiresAt time.Time) error {
+	if _, ok := s.users[userid]; !ok {
+		return mgo.ErrNotFound
+	}
+	s.phoneCodes[userid] = codeHash
+	return nil
+}
+
+func (s *stubService) ConfirmPhone(userid, codeHash string) (int64, error) {
+	u, ok := s.users[userid]
+	if !ok || s.phoneCodes[userid] != codeHash {
+		return 0, dbOperations.ErrPhoneCode
+	}
+	delete(s.phoneCodes, userid)
+	u.PhoneVerified = true
+	u.Version++
+	s.users[userid] = u
+	return u.Version, nil
+}
+
+func (s *stubService) SendSMS(_ context.Context, to, text string) error {
+	s.sms = append(s.sms, to+": "+text)
+	return nil
+}
+
+func (s *stubService) GetAddressesForUser(userid string) ([]dbOperations.Address, error) {
+	u, ok := s.users[userid]
+	if !ok {
+		return nil, mgo.ErrNotFound
+	}
+	adds := make([]dbOperations.Address, 0)
+	for _, a := range u.Addresses {
+		if a, ok := s.addresses[a.ID]; ok {
+			adds = append(adds, a)
+		}
+	}
+	return adds, nil
+}
+
+func (s *stubService) GetDeletedUsers() ([]dbOperations.User, error) {
+	users := make([]dbOperations.User, 0)
+	for _, u := range s.deletedUsers {
+		users = append(users, u)
+	}
+	return users, nil
+}
+
+func (s *stubService) GetDeletedAddresses() ([]dbOperations.Address, error) {
+	adds := make([]dbOperations.Address, 0)
+	for _, a := range s.deletedAddresses {
+		adds = append(adds, a)
+	}
+	return adds, nil
+}
+
+func (s *stubService) RestoreUser(id string) error {
+	u, ok := s.deletedUsers[id]
+	if !ok {
+		return mgo.ErrNotFound
+	}
+	u.DeletedAt, u.DeletedBy = nil, ""
+	s.users[id] = u
+	delete(s.deletedUsers, id)
+	return nil
+}
+
+func (s *stubService) RestoreAddress(id string) (string, error) {
+	a, ok := s.deletedAddresses[id]
+	if !ok {
+		return "", mgo.ErrNotFound
+	}
+	if a.DeletedFrom == "" {
+		return "", dbOperations.ErrDeletedWithUser
+	}
+	if _, ok := s.deletedUsers[a.DeletedFrom]; ok {
+		return "", dbOperations.ErrUserDeleted
+	}
+	userid := a.DeletedFrom
+	a.DeletedAt, a.DeletedBy, a.DeletedFrom = nil, "", ""
+	s.addresses[id] = a
+	delete(s.deletedAddresses, id)
+	return userid, nil
+}
+
+func (s *stubService) PurgeDeleted(before time.Time) (int, error) {
+	n := 0
+	for id, u := range s.deletedUsers {
+		if u.DeletedAt.Before(before) {
+			delete(s.deletedUsers, id)
+			n++
+		}
+	}
+	for id, a := range s.deletedAddresses {
+		if a.DeletedAt.Before(before) {
+			delete(s.deletedAddresses, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// memAuditLog is an in-memory AuditLog.
+type memAuditLog struct {
+	mtx     sync.Mutex
+	entries []dbOperations.AuditEntry
+}
+
+func (l *memAuditLog) AppendAudit(e *dbOperations.AuditEntry) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	var prev *dbOperations.AuditEntry
+	if len(l.entries) > 0 {
+		prev = &l.entries[len(l.entries)-1]
+	}
+	e.Chain(prev)
+	l.entries = append(l.entries, *e)
+	return nil
+}
+
+func (l *memAuditLog) GetAudit(f dbOperations.AuditFilter) ([]dbOperations.AuditEntry, int, error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	matched := make([]dbOperations.AuditEntry, 0)
+	for i := len(l.entries) - 1; i >= 0; i-- {
+		e := l.entries[i]
+		if len(f.Subjects) > 0 && !contains(f.Subjects, e.Actor) && !contains(f.Subjects, e.Target) {
+			continue
+		}
+		if (f.Actor == "" || e.Actor == f.Actor) && (f.Target == "" || e.Target == f.Target) &&
+			(f.Action == "" || e.Action == f.Action) && (f.Outcome == "" || e.Outcome == f.Outcome) {
+			matched = append(matched, e)
+		}
+	}
+	total := len(matched)
+	if f.Skip > len(matched) {
+		f.Skip = len(matched)
+	}
+	matched = matched[f.Skip:]
+	if f.Limit > 0 && f.Limit < len(matched) {
+		matched = matched[:f.Limit]
+	}
+	return matched, total, nil
+}
+
+// memDataSubjects is an in-memory DataSubjectStore over a stubService.
+type memDataSubjects struct {
+	*memAuditLog
+	svc      *stubService
+	erasures []dbOperations.Erasure
+	// consents are those the OIDC provider saves, by user and client.
+	consents map[string]dbOperations.Consent
+}
+
+func (m *memDataSubjects) GetUserRecord(id string) (dbOperations.User, error) {
+	u, err := m.svc.GetUser(id)
+	if err != nil {
+		if du, ok := m.svc.deletedUsers[id]; ok {
+			return du, nil
+		}
+	}
+	return u, err
+}
+
+func (m *memDataSubjects) CreateErasure(e *dbOperations.Erasure) error {
+	e.ID = fmt.Sprintf("%024x", len(m.erasures)+1)
+	m.erasures = append(m.erasures, *e)
+	return nil
+}
+
+func (m *memDataSubjects) GetErasures(userid string) ([]dbOperations.Erasure, error) {
+	erasures := make([]dbOperations.Erasure, 0)
+	for i := len(m.erasures) - 1; i >= 0; i-- {
+		if m.erasures[i].UserID == userid {
+			erasures = append(erasures, m.erasures[i])
+		}
+	}
+	return erasures, nil
+}
+
+func (m *memDataSubjects) GetDueErasures(now time.Time) ([]dbOperations.Erasure, error) {
+	due := make([]dbOperations.Erasure, 0)
+	for _, e := range m.erasures {
+		if e.Status == dbOperations.ErasurePending && !e.EraseAfter.After(now) {
+			due = append(due, e)
+		}
+	}
+	return due, nil
+}
+
+func (m *memDataSubjects) CancelErasure(userid string) (dbOperations.Erasure, error) {
+	for i := range m.erasures {
+		if e := &m.erasures[i]; e.UserID == userid && e.Status == dbOperations.ErasurePending {
+			e.Status = dbOperations.ErasureCancelled
+			return *e, nil
+		}
+	}
+	return dbOperations.Erasure{}, mgo.ErrNotFound
+}
+
+func (m *memDataSubjects) GetAcceptances(userid string) ([]dbOperations.Acceptance, error) {
+	return m.svc.GetAcceptances(userid)
+}
+
+func (m *memDataSubjects) GetConsents(userID string) ([]dbOperations.Consent, error) {
+	consents := make([]dbOperations.Consent, 0)
+	for _, c := range m.consents {
+		if c.UserID == userID {
+			consents = append(consents, c)
+		}
+	}
+	sort.Slice(consents, func(i, j int) bool { return consents[i].GrantedAt.Before(consents[j].GrantedAt) })
+	return consents, nil
+}
+
+func (m *memDataSubjects) EraseUser(e *dbOperations.Erasure) error {
+	subjects := []string{e.UserID}
+	if u, err := m.GetUserRecord(e.UserID); err == nil {
+		subjects = append(subjects, u.Username)
+		e.AddressesRemoved = len(u.Addresses)
+		for _, a := range u.Addresses {
+			delete(m.svc.addresses, a.ID)
+			delete(m.svc.deletedAddresses, a.ID)
+		}
+		delete(m.svc.users, e.UserID)
+		delete(m.svc.deletedUsers, e.UserID)
+	}
+	for key, c := range m.consents {
+		if c.UserID == e.UserID {
+			delete(m.consents, key)
+		}
+	}
+	m.mtx.Lock()
+	var redacted []int
+	var entries []dbOperations.AuditEntry
+	for i, entry := range m.entries {
+		if contains(subjects, entry.Actor) || contains(subjects, entry.Target) {
+			entry.Redact(e.Pseudonym(), subjects...)
+			redacted = append(redacted, i)
+			entries = append(entries, entry)
+		}
+	}
+	m.mtx.Unlock()
+	if len(entries) > 0 {
+		record := dbOperations.NewAuditRedaction(e.Pseudonym(), entries)
+		m.AppendAudit(&record)
+		m.mtx.Lock()
+		for j, i := range redacted {
+			entries[j].RedactedIn = record.Seq
+			m.entries[i] = entries[j]
+		}
+		m.mtx.Unlock()
+		e.AuditEntriesAnonymised = len(entries)
+	}
+	now := time.Now()
+	e.CompletedAt = &now
+	e.Status = dbOperations.ErasureCompleted
+	for i := range m.erasures {
+		if m.erasures[i].ID == e.ID {
+			m.erasures[i] = *e
+		}
+	}
+	return nil
+}
@@ -0,0 +1,300 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/user/dbOperations"
+)
+
+// TenantHeader names the tenant a request is for. Without it the tenant is
+// told by the host the request arrived at, and then by the tenant claim of
+// the bearer token.
+const TenantHeader = "X-Tenant-ID"
+
+var (
+	// ErrWeakPassword is returned for a password the tenant's policy does
+	// not allow.
+	ErrWeakPassword = errors.New("Password does not meet the password policy")
+	// ErrUnknownTenant is returned for requests to a tenant that does not
+	// exist.
+	ErrUnknownTenant = errors.New("Unknown tenant")
+)
+
+// tenantID is what tenant ids look like, so that they fit in hosts and
+// headers.
+var tenantID = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// TenantStore keeps the tenants and their configuration.
+// *dbOperations.Mongo implements it.
+type TenantStore interface {
+	SaveTenant(t *dbOperations.Tenant) error
+	GetTenant(id string) (dbOperations.Tenant, error)
+	GetTenants() ([]dbOperations.Tenant, error)
+	DeleteTenant(id string) error
+}
+
+// TenantEndpoints mounts the admin-only endpoints managing tenants. They
+// belong in the default tenant's endpoints only. onChange, if set, is
+// called after every change, so that a TenantRouter can reload.
+func TenantEndpoints(e Endpoints, st TenantStore, onChange func()) Endpoints {
+	admin := RequireRole(RoleAdmin)
+	changed := func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			response, err := next(ctx, request)
+			if err == nil && onChange != nil {
+				onChange()
+			}
+			return response, err
+		}
+	}
+	e.TenantsGetEndpoint = admin(MakeTenantsGetEndpoint(st))
+	e.TenantGetEndpoint = admin(MakeTenantGetEndpoint(st))
+	e.TenantPutEndpoint = admin(changed(MakeTenantPutEndpoint(st)))
+	e.TenantDeleteEndpoint = admin(changed(MakeTenantDeleteEndpoint(st)))
+	return e
+}
+
+// MakeTenantsGetEndpoint returns an endpoint listing the tenants.
+func MakeTenantsGetEndpoint(st TenantStore) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		tenants, err := st.GetTenants()
+		return EmbedStruct{tenantsResponse{Tenants: tenants}}, err
+	}
+}
+
+// MakeTenantGetEndpoint returns an endpoint returning one tenant.
+func MakeTenantGetEndpoint(st TenantStore) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		return st.GetTenant(request.(tenantRequest).ID)
+	}
+}
+
+// MakeTenantPutEndpoint returns an endpoint creating a tenant or replacing
+// its configuration.
+func MakeTenantPutEndpoint(st TenantStore) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(tenantRequest)
+		t := req.Tenant
+		if !tenantID.MatchString(req.ID) || t.TokenLifetime < 0 || t.PasswordPolicy.MinLength < 0 ||
+			(t.AddressValidation != "" && !contains(AddressModes, t.AddressValidation)) ||
+			(t.PhoneRegion != "" && !phoneRegion(t.PhoneRegion)) {
+			return nil, ErrInvalidRequest
+		}
+		t.ID = req.ID
+		if c, ok := LookupCountry(t.PhoneRegion); ok {
+			t.PhoneRegion = c.Code
+		}
+		if err := st.SaveTenant(&t); err != nil {
+			return nil, err
+		}
+		return t, nil
+	}
+}
+
+// MakeTenantDeleteEndpoint returns an endpoint deleting a tenant that has
+// no users left.
+func MakeTenantDeleteEndpoint(st TenantStore) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		err := st.DeleteTenant(request.(tenantRequest).ID)
+		return statusResponse{Status: err == nil}, err
+	}
+}
+
+// TenantPolicyEndpoints enforces the password policy of t on the endpoints
+// where users choose a password: registration, creating and updating users
+// and provisioning them over SCIM. Imported users bring their password
+// hashes along, so their passwords cannot be checked.
+func TenantPolicyEndpoints(e Endpoints, t dbOperations.Tenant) Endpoints {
+	policy := requirePasswordPolicy(t.PasswordPolicy)
+	e.RegisterEndpoint = policy(e.RegisterEndpoint)
+	e.UserPostEndpoint = policy(e.UserPostEndpoint)
+	e.UserPutEndpoint = policy(e.UserPutEndpoint)
+	if e.SCIMUserPostEndpoint != nil {
+		e.SCIMUserPostEndpoint = policy(e.SCIMUserPostEndpoint)
+		e.SCIMUserPutEndpoint = policy(e.SCIMUserPutEndpoint)
+		e.SCIMUserPatchEndpoint = policy(e.SCIMUserPatchEndpoint)
+	}
+	return e
+}
+
+func requirePasswordPolicy(p dbOperations.PasswordPolicy) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			for _, password := range newPasswords(request) {
+				if p.Allows(password) {
+					continue
+				}
+				switch request.(type) {
+				case scimUserRequest, scimPatchRequest:
+					return nil, scimError{Status: http.StatusBadRequest, Type: "invalidValue", Detail: ErrWeakPassword.Error()}
+				}
+				return nil, ErrWeakPassword
+			}
+			return next(ctx, request)
+		}
+	}
+}
+
+// newPasswords returns the passwords request sets. Updates and SCIM
+// requests without one leave the password as it is, or give the user none they can log in
+// with.
+func newPasswords(request interface{}) []string {
+	switch req := request.(type) {
+	case registerRequest:
+		return []string{req.Password}
+	case dbOperations.User:
+		return []string{req.Password}
+	case userPutRequest:
+		if req.User.Password != "" {
+			return []string{req.User.Password}
+		}
+	case scimUserRequest:
+		if req.User.Password != "" {
+			return []string{req.User.Password}
+		}
+	case scimPatchRequest:
+		var passwords []string
+		for _, op := range req.Operations {
+			values := map[string]interface{}{op.Path: op.Value}
+			if op.Path == "" {
+				values, _ = op.Value.(map[string]interface{})
+			}
+			for path, v := range values {
+				if s, ok := v.(string); ok && strings.EqualFold(scimAttrPath(path), "password") {
+					passwords = append(passwords, s)
+				}
+			}
+		}
+		return passwords
+	}
+	return nil
+}
+
+// TenantRouter serves each request with the handler of its tenant. The
+// handlers are built on first use, and again when the tenant's
+// configuration changes.
+type TenantRouter struct {
+	st     TenantStore
+	build  func(dbOperations.Tenant) (http.Handler, error)
+	logger log.Logger
+
+	mu       sync.Mutex
+	tenants  map[string]dbOperations.Tenant
+	hosts    map[string]string
+	handlers map[string]tenantHandler
+}
+
+type tenantHandler struct {
+	tenant  dbOperations.Tenant
+	handler http.Handler
+}
+
+// NewTenantRouter returns a router serving the tenants in st with the
+// handlers build returns. It knows no tenants until it is reloaded.
+func NewTenantRouter(st TenantStore, build func(dbOperations.Tenant) (http.Handler, error), logger log.Logger) *TenantRouter {
+	return &TenantRouter{
+		st:       st,
+		build:    build,
+		logger:   logger,
+		tenants:  map[string]dbOperations.Tenant{},
+		hosts:    map[string]string{},
+		handlers: map[string]tenantHandler{},
+	}
+}
+
+// Reload reads the tenants and their configuration from the store.
+// Handlers of tenants that changed are rebuilt on their next request.
+func (tr *TenantRouter) Reload() error {
+	tenants, err := tr.st.GetTenants()
+	if err != nil {
+		return err
+	}
+	byID := make(map[string]dbOperations.Tenant, len(tenants))
+	hosts := map[string]string{}
+	for _, t := range tenants {
+		byID[t.ID] = t
+		for _, h := range t.Hosts {
+			hosts[h] = t.ID
+		}
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.tenants, tr.hosts = byID, hosts
+	for id := range tr.handlers {
+		if _, ok := byID[id]; !ok {
+			delete(tr.handlers, id)
+		}
+	}
+	return nil
+}
+
+func (tr *TenantRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h, err := tr.handler(tr.tenantOf(r))
+	if err != nil {
+		encodeError(r.Context(), err, w)
+		return
+	}
+	h.ServeHTTP(w, r)
+}
+
+// tenantOf tells the tenant of r by its header, its host, or the tenant
+// claim of its bearer token, in that order. The claim is not verified
+// here; the tenant's own authenticators refuse tokens of other tenants.
+func (tr *TenantRouter) tenantOf(r *http.Request) string {
+	if id := r.Header.Get(TenantHeader); id != "" {
+		return id
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	tr.mu.Lock()
+	id, ok := tr.hosts[strings.ToLower(host)]
+	tr.mu.Unlock()
+	if ok {
+		return id
+	}
+	if token, ok := credentials(r.Header.Get("Authorization"), "Bearer"); ok {
+		if id := jwtTenant(token); id != "" {
+			return id
+		}
+	}
+	return dbOperations.DefaultTenant
+}
+
+func (tr *TenantRouter) handler(id string) (http.Handler, error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	t, ok := tr.tenants[id]
+	if !ok {
+		return nil, ErrUnknownTenant
+	}
+	if th, ok := tr.handlers[id]; ok && reflect.DeepEqual(th.tenant, t) {
+		return th.handler, nil
+	}
+	h, err := tr.build(t)
+	if err != nil {
+		tr.logger.Log("tenant", id, "err", err)
+		return nil, err
+	}
+	tr.handlers[id] = tenantHandler{tenant: t, handler: h}
+	return h, nil
+}
+
+type tenantRequest struct {
+	ID     string
+	Tenant dbOperations.Tenant
+}
+
+type tenantsResponse struct {
+	Tenants []dbOperations.Tenant `json:"tenant"`
+}
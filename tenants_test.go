@@ -0,0 +1,240 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/user/dbOperations"
+	mgo "gopkg.in/mgo.v2"
+)
+
+// memTenants is an in-memory TenantStore.
+type memTenants struct {
+	tenants map[string]dbOperations.Tenant
+}
+
+func newMemTenants() *memTenants {
+	return &memTenants{tenants: map[string]dbOperations.Tenant{
+		dbOperations.DefaultTenant: {ID: dbOperations.DefaultTenant, Name: "Default"},
+	}}
+}
+
+func (m *memTenants) SaveTenant(t *dbOperations.Tenant) error {
+	for _, o := range m.tenants {
+		for _, h := range t.Hosts {
+			if o.ID != t.ID && contains(o.Hosts, h) {
+				return dbOperations.ErrHostTaken
+			}
+		}
+	}
+	t.UpdatedAt = time.Now()
+	m.tenants[t.ID] = *t
+	return nil
+}
+
+func (m *memTenants) GetTenant(id string) (dbOperations.Tenant, error) {
+	if t, ok := m.tenants[id]; ok {
+		return t, nil
+	}
+	return dbOperations.Tenant{}, mgo.ErrNotFound
+}
+
+func (m *memTenants) GetTenants() ([]dbOperations.Tenant, error) {
+	tenants := []dbOperations.Tenant{m.tenants[dbOperations.DefaultTenant]}
+	for id, t := range m.tenants {
+		if id != dbOperations.DefaultTenant {
+			tenants = append(tenants, t)
+		}
+	}
+	return tenants, nil
+}
+
+func (m *memTenants) DeleteTenant(id string) error {
+	if _, ok := m.tenants[id]; !ok {
+		return mgo.ErrNotFound
+	}
+	delete(m.tenants, id)
+	return nil
+}
+
+func TestTenantEndpoints(t *testing.T) {
+	st := newMemTenants()
+	changes := 0
+	e := TenantEndpoints(Endpoints{}, st, func() { changes++ })
+	e = AuthenticateEndpoints(e, testTokens)
+	router := MakeHTTPHandler(context.Background(), e, log.NewNopLogger())
+	do := func(method, path, authorization, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", authorization)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	admin := "Bearer " + testAdminToken
+
+	w := do("PUT", "/tenants/acme", admin, `{"name": "Acme", "hosts": ["shop.acme.test"], "passwordPolicy": {"minLength": 10}, "tokenLifetime": 300, "phoneRegion": "uk"}`)
+	var saved dbOperations.Tenant
+	json.NewDecoder(w.Body).Decode(&saved)
+	if w.Code != http.StatusOK || saved.ID != "acme" || saved.PasswordPolicy.MinLength != 10 || saved.TokenLifetime != 300 || saved.PhoneRegion != "GB" {
+		t.Fatalf("unexpected tenant %d: %+v", w.Code, saved)
+	}
+	if w := do("PUT", "/tenants/globex", admin, `{"name": "Globex", "hosts": ["shop.acme.test"]}`); w.Code != http.StatusConflict {
+		t.Errorf("expected a taken host to be refused, got %d", w.Code)
+	}
+	for _, path := range []string{"/tenants/Acme", "/tenants/-acme", "/tenants/acme_shop"} {
+		if w := do("PUT", path, admin, `{"name": "Acme"}`); w.Code != http.StatusBadRequest {
+			t.Errorf("expected %s to be refused, got %d", path, w.Code)
+		}
+	}
+	if w := do("PUT", "/tenants/acme", admin, `{"name": "Acme", "tokenLifetime": -1}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected a negative token lifetime to be refused, got %d", w.Code)
+	}
+	if w := do("PUT", "/tenants/acme", admin, `{"name": "Acme", "phoneRegion": "Atlantis"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected an unknown phone region to be refused, got %d", w.Code)
+	}
+	if w := do("GET", "/tenants", "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected anonymous callers to be refused, got %d", w.Code)
+	}
+	w = do("GET", "/tenants", admin, "")
+	var list struct {
+		Embedded tenantsResponse `json:"_embedded"`
+	}
+	json.NewDecoder(w.Body).Decode(&list)
+	if w.Code != http.StatusOK || len(list.Embedded.Tenants) != 2 || list.Embedded.Tenants[0].ID != dbOperations.DefaultTenant {
+		t.Errorf("unexpected tenants %d: %+v", w.Code, list)
+	}
+	if w := do("DELETE", "/tenants/acme", admin, ""); w.Code != http.StatusOK {
+		t.Errorf("expected the tenant to be deleted, got %d", w.Code)
+	}
+	if w := do("GET", "/tenants/acme", admin, ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected the deleted tenant to be gone, got %d", w.Code)
+	}
+	if changes != 2 {
+		t.Errorf("expected 2 changes to be reported, got %d", changes)
+	}
+}
+
+func TestTenantPasswordPolicy(t *testing.T) {
+	tenant := dbOperations.Tenant{ID: "acme", PasswordPolicy: dbOperations.PasswordPolicy{MinLength: 8, RequireDigit: true}}
+	svc := newStubService()
+	e := TenantPolicyEndpoints(SCIMEndpoints(MakeEndpoints(svc), svc, svc), tenant)
+	e = AuthenticateEndpoints(e, testTokens)
+	router := MakeHTTPHandler(context.Background(), e, log.NewNopLogger())
+	do := func(method, path, authorization, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", authorization)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := do("POST", "/register", "", `{"username": "weak", "password": "password"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected a password without a digit to be refused, got %d", w.Code)
+	}
+	if w := do("POST", "/register", "", `{"username": "strong", "password": "passw0rd"}`); w.Code != http.StatusOK {
+		t.Errorf("expected a password meeting the policy to be accepted, got %d", w.Code)
+	}
+	scim := "Bearer " + testSCIMToken
+	for _, body := range []string{
+		`{"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"], "Operations": [{"op": "replace", "path": "password", "value": "s3cret"}]}`,
+		`{"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"], "Operations": [{"op": "replace", "value": {"password": "s3cret"}}]}`,
+	} {
+		w := do("PATCH", "/scim/v2/Users/"+testUserID, scim, body)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalidValue") {
+			t.Errorf("expected a short password to be refused over SCIM, got %d: %s", w.Code, w.Body)
+		}
+	}
+}
+
+func TestTenantRouter(t *testing.T) {
+	st := newMemTenants()
+	st.SaveTenant(&dbOperations.Tenant{ID: "acme", Hosts: []string{"shop.acme.test"}})
+	builds := map[string]int{}
+	router := NewTenantRouter(st, func(tenant dbOperations.Tenant) (http.Handler, error) {
+		builds[tenant.ID]++
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(tenant.ID))
+		}), nil
+	}, log.NewNopLogger())
+	if err := router.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	p := NewOIDCProvider(testIssuer, testSigningKey(), nil, nil)
+	token, _ := signJWT(p.Key, p.jwk.Kid, jwtTypeAccessToken, accessClaims{Tenant: "acme"})
+
+	for _, c := range []struct {
+		host, header, authorization string
+		code                        int
+		tenant                      string
+	}{
+		{"user.test", "", "", http.StatusOK, dbOperations.DefaultTenant},
+		{"user.test", "acme", "", http.StatusOK, "acme"},
+		{"SHOP.acme.test:8080", "", "", http.StatusOK, "acme"},
+		{"shop.acme.test", "default", "", http.StatusOK, dbOperations.DefaultTenant},
+		{"user.test", "", "Bearer " + token, http.StatusOK, "acme"},
+		{"user.test", "", "Bearer " + testAdminToken, http.StatusOK, dbOperations.DefaultTenant},
+		{"user.test", "globex", "", http.StatusNotFound, ""},
+	} {
+		r := httptest.NewRequest("GET", "/customers", nil)
+		r.Host = c.host
+		if c.header != "" {
+			r.Header.Set(TenantHeader, c.header)
+		}
+		r.Header.Set("Authorization", c.authorization)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != c.code || (c.tenant != "" && w.Body.String() != c.tenant) {
+			t.Errorf("%+v: got %d %s", c, w.Code, w.Body)
+		}
+	}
+	if builds["acme"] != 1 || builds[dbOperations.DefaultTenant] != 1 {
+		t.Errorf("expected each handler to be built once, got %v", builds)
+	}
+
+	// A changed tenant gets a new handler, a deleted one none.
+	st.SaveTenant(&dbOperations.Tenant{ID: "acme", Name: "Acme"})
+	st.DeleteTenant(dbOperations.DefaultTenant)
+	st.tenants[dbOperations.DefaultTenant] = dbOperations.Tenant{ID: dbOperations.DefaultTenant, Name: "Default"}
+	router.Reload()
+	for _, id := range []string{"acme", dbOperations.DefaultTenant} {
+		r := httptest.NewRequest("GET", "/customers", nil)
+		r.Header.Set(TenantHeader, id)
+		router.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	if builds["acme"] != 2 || builds[dbOperations.DefaultTenant] != 1 {
+		t.Errorf("expected only the changed tenant to be rebuilt, got %v", builds)
+	}
+}
+
+func TestOIDCTokenTenant(t *testing.T) {
+	key := testSigningKey()
+	svc := newStubService()
+	st := newMemOIDC(svc, &memDataSubjects{memAuditLog: &memAuditLog{}, svc: svc})
+	acme := NewOIDCProvider(testIssuer, key, svc, st)
+	acme.Tenant = "acme"
+	def := NewOIDCProvider(testIssuer, key, svc, st)
+	token, err := signJWT(key, acme.jwk.Kid, jwtTypeAccessToken, accessClaims{
+		Issuer:  testIssuer,
+		Subject: testUserID,
+		Expiry:  time.Now().Add(time.Minute).Unix(),
+		Tenant:  "acme",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, ok, err := acme.Authenticate("Bearer " + token); !ok || err != nil || p.ID != testUserID {
+		t.Errorf("expected the tenant's token to be accepted, got %+v %v", p, err)
+	}
+	if _, _, err := def.Authenticate("Bearer " + token); err != ErrUnauthorized {
+		t.Errorf("expected another tenant's token to be refused, got %v", err)
+	}
+	if jwtTenant(token) != "acme" || jwtTenant("not.a.token") != "" {
+		t.Error("expected the tenant claim to be read")
+	}
+}
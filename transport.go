@@ -1,15 +1,22 @@
 package user
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	httptransport "github.com/go-kit/kit/transport/http"
 	"github.com/gorilla/mux"
 	"github.com/user/dbOperations"
+	mgo "gopkg.in/mgo.v2"
 
 	"context"
 )
@@ -24,6 +31,8 @@ func MakeHTTPHandler(ctx context.Context, e Endpoints, logger log.Logger) *mux.R
 	options := []httptransport.ServerOption{
 		httptransport.ServerErrorLogger(logger),
 		httptransport.ServerErrorEncoder(encodeError),
+		httptransport.ServerBefore(populateRequestInfo, populateIfNoneMatch, populateRateLimit),
+		httptransport.ServerAfter(writeRateLimit),
 	}
 
 	r.Methods("GET").Path("/login").Handler(httptransport.NewServer(
@@ -38,6 +47,339 @@ func MakeHTTPHandler(ctx context.Context, e Endpoints, logger log.Logger) *mux.R
 		encodeResponse,
 		options...,
 	))
+	if e.ExportEndpoint != nil {
+		r.Methods("GET").Path("/customers/{id}/export").Handler(httptransport.NewServer(
+			e.ExportEndpoint,
+			decodeDataSubjectRequest,
+			encodeExportResponse,
+			options...,
+		))
+		r.Methods("POST").Path("/customers/{id}/erasure").Handler(httptransport.NewServer(
+			e.ErasurePostEndpoint,
+			decodeDataSubjectRequest,
+			encodeErasureResponse,
+			options...,
+		))
+		r.Methods("GET").Path("/customers/{id}/erasure").Handler(httptransport.NewServer(
+			e.ErasureGetEndpoint,
+			decodeDataSubjectRequest,
+			encodeResponse,
+			options...,
+		))
+		r.Methods("DELETE").Path("/customers/{id}/erasure").Handler(httptransport.NewServer(
+			e.ErasureDeleteEndpoint,
+			decodeDataSubjectRequest,
+			encodeResponse,
+			options...,
+		))
+	}
+	if e.RestoreUserEndpoint != nil {
+		r.Methods("GET").Path("/deleted/customers").Handler(httptransport.NewServer(
+			e.DeletedUsersEndpoint,
+			decodeNoRequest,
+			encodeResponse,
+			options...,
+		))
+		r.Methods("GET").Path("/deleted/addresses").Handler(httptransport.NewServer(
+			e.DeletedAddressesEndpoint,
+			decodeNoRequest,
+			encodeResponse,
+			options...,
+		))
+		r.Methods("POST").Path("/customers/{id}/restore").Handler(httptransport.NewServer(
+			e.RestoreUserEndpoint,
+			decodeRestoreRequest,
+			encodeResponse,
+			options...,
+		))
+		r.Methods("POST").Path("/addresses/{id}/restore").Handler(httptransport.NewServer(
+			e.RestoreAddressEndpoint,
+			decodeRestoreRequest,
+			encodeResponse,
+			options...,
+		))
+	}
+	if e.BulkImportEndpoint != nil {
+		r.Methods("POST").Path("/bulk/customers").Handler(httptransport.NewServer(
+			e.BulkImportEndpoint,
+			decodeBulkImportRequest,
+			encodeResponse,
+			options...,
+		))
+		r.Methods("GET").Path("/bulk/customers").Handler(httptransport.NewServer(
+			e.BulkExportEndpoint,
+			decodeBulkExportRequest,
+			encodeBulkExportResponse,
+			options...,
+		))
+	}
+	if e.WebhookPostEndpoint != nil {
+		r.Methods("POST").Path("/webhooks").Handler(httptransport.NewServer(
+			e.WebhookPostEndpoint,
+			decodeWebhookPostRequest,
+			encodeCreatedResponse,
+			options...,
+		))
+		r.Methods("GET").Path("/webhooks").Handler(httptransport.NewServer(
+			e.WebhooksGetEndpoint,
+			decodeNoRequest,
+			encodeResponse,
+			options...,
+		))
+		r.Methods("GET").Path("/webhooks/dead-letters").Handler(httptransport.NewServer(
+			e.DeadLettersEndpoint,
+			decodeNoRequest,
+			encodeResponse,
+			options...,
+		))
+		r.Methods("GET").Path("/webhooks/{id}/deliveries").Handler(httptransport.NewServer(
+			e.WebhookDeliveriesEndpoint,
+			decodeWebhookRequest,
+			encodeResponse,
+			options...,
+		))
+		r.Methods("DELETE").Path("/webhooks/{id}").Handler(httptransport.NewServer(
+			e.WebhookDeleteEndpoint,
+			decodeWebhookRequest,
+			encodeResponse,
+			options...,
+		))
+	}
+	if e.SCIMUserPostEndpoint != nil {
+		scimOptions := append(options, httptransport.ServerErrorEncoder(encodeSCIMError))
+		r.Methods("POST").Path("/scim/v2/Users").Handler(httptransport.NewServer(
+			e.SCIMUserPostEndpoint,
+			decodeSCIMUserRequest,
+			encodeSCIMCreated,
+			scimOptions...,
+		))
+		r.Methods("GET").Path("/scim/v2/Users").Handler(httptransport.NewServer(
+			e.SCIMUsersGetEndpoint,
+			decodeSCIMListRequest,
+			encodeSCIMResponse,
+			scimOptions...,
+		))
+		r.Methods("GET").Path("/scim/v2/Users/{id}").Handler(httptransport.NewServer(
+			e.SCIMUserGetEndpoint,
+			decodeSCIMUserRequest,
+			encodeSCIMResponse,
+			scimOptions...,
+		))
+		r.Methods("PUT").Path("/scim/v2/Users/{id}").Handler(httptransport.NewServer(
+			e.SCIMUserPutEndpoint,
+			decodeSCIMUserRequest,
+			encodeSCIMResponse,
+			scimOptions...,
+		))
+		r.Methods("PATCH").Path("/scim/v2/Users/{id}").Handler(httptransport.NewServer(
+			e.SCIMUserPatchEndpoint,
+			decodeSCIMPatchRequest,
+			encodeSCIMResponse,
+			scimOptions...,
+		))
+		r.Methods("DELETE").Path("/scim/v2/Users/{id}").Handler(httptransport.NewServer(
+			e.SCIMUserDeleteEndpoint,
+			decodeSCIMUserRequest,
+			encodeSCIMNoContent,
+			scimOptions...,
+		))
+		r.Methods("GET").Path("/scim/v2/ServiceProviderConfig").HandlerFunc(serveSCIMServiceProviderConfig)
+		r.Methods("GET").Path("/scim/v2/ResourceTypes").HandlerFunc(serveSCIMResourceTypes)
+		r.Methods("GET").Path("/scim/v2/Schemas").HandlerFunc(serveSCIMSchemas)
+	}
+	if e.OIDCDiscoveryEndpoint != nil {
+		pageOptions := append(options, httptransport.ServerErrorEncoder(encodeOIDCPageError))
+		oauthOptions := append(options, httptransport.ServerErrorEncoder(encodeOAuthError))
+		r.Methods("GET").Path("/.well-known/openid-configuration").Handler(httptransport.NewServer(
+			e.OIDCDiscoveryEndpoint,
+			decodeNoRequest,
+			encodeResponse,
+			options...,
+		))
+		r.Methods("GET").Path("/oauth2/jwks").Handler(httptransport.NewServer(
+			e.OIDCKeysEndpoint,
+			decodeNoRequest,
+			encodeResponse,
+			options...,
+		))
+		r.Methods("GET").Path("/oauth2/authorize").Handler(httptransport.NewServer(
+			e.OIDCAuthorizeEndpoint,
+			decodeAuthorizeRequest,
+			encodeOIDCPage,
+			pageOptions...,
+		))
+		r.Methods("POST").Path("/oauth2/authorize").Handler(httptransport.NewServer(
+			e.OIDCLoginEndpoint,
+			decodeAuthorizeRequest,
+			encodeOIDCPage,
+			pageOptions...,
+		))
+		r.Methods("POST").Path("/oauth2/token").Handler(httptransport.NewServer(
+			e.OIDCTokenEndpoint,
+			decodeTokenRequest,
+			encodeOAuthResponse,
+			oauthOptions...,
+		))
+		r.Methods("GET", "POST").Path("/oauth2/userinfo").Handler(httptransport.NewServer(
+			e.OIDCUserInfoEndpoint,
+			decodeUserInfoRequest,
+			encodeOAuthResponse,
+			oauthOptions...,
+		))
+		r.Methods("POST").Path("/oauth2/clients").Handler(httptransport.NewServer(
+			e.OIDCClientPostEndpoint,
+			decodeClientPostRequest,
+			encodeCreatedResponse,
+			options...,
+		))
+		r.Methods("GET").Path("/oauth2/clients").Handler(httptransport.NewServer(
+			e.OIDCClientsGetEndpoint,
+			decodeNoRequest,
+			encodeResponse,
+			options...,
+		))
+		r.Methods("DELETE").Path("/oauth2/clients/{id}").Handler(httptransport.NewServer(
+			e.OIDCClientDeleteEndpoint,
+			decodeClientRequest,
+			encodeResponse,
+			options...,
+		))
+	}
+	if e.ExternalLoginEndpoint != nil {
+		pageOptions := append(options, httptransport.ServerErrorEncoder(encodeOIDCPageError))
+		r.Methods("POST").Path("/oauth2/external/{provider}").Handler(httptransport.NewServer(
+			e.ExternalLoginEndpoint,
+			decodeExternalLoginRequest,
+			encodeOIDCPage,
+			pageOptions...,
+		))
+		r.Methods("GET").Path("/oauth2/callback/{provider}").Handler(httptransport.NewServer(
+			e.ExternalCallbackEndpoint,
+			decodeExternalCallbackRequest,
+			encodeOIDCPage,
+			pageOptions...,
+		))
+		r.Methods("GET").Path("/customers/{id}/identities").Handler(httptransport.NewServer(
+			e.IdentitiesGetEndpoint,
+			decodeIdentityRequest,
+			encodeResponse,
+			options...,
+		))
+		r.Methods("POST").Path("/customers/{id}/identities/{provider}").Handler(httptransport.NewServer(
+			e.IdentityLinkEndpoint,
+			decodeIdentityRequest,
+			encodeLinkResponse,
+			options...,
+		))
+		r.Methods("DELETE").Path("/customers/{id}/identities/{provider}").Handler(httptransport.NewServer(
+			e.IdentityDeleteEndpoint,
+			decodeIdentityRequest,
+			encodeResponse,
+			options...,
+		))
+	}
+	if e.APIKeyPostEndpoint != nil {
+		r.Methods("POST").Path("/apikeys").Handler(httptransport.NewServer(
+			e.APIKeyPostEndpoint,
+			decodeAPIKeyPostRequest,
+			encodeCreatedResponse,
+			options...,
+		))
+		r.Methods("GET").Path("/apikeys").Handler(httptransport.NewServer(
+			e.APIKeysGetEndpoint,
+			decodeNoRequest,
+			encodeResponse,
+			options...,
+		))
+		r.Methods("POST").Path("/apikeys/{id}/rotate").Handler(httptransport.NewServer(
+			e.APIKeyRotateEndpoint,
+			decodeAPIKeyRotateRequest,
+			encodeCreatedResponse,
+			options...,
+		))
+		r.Methods("DELETE").Path("/apikeys/{id}").Handler(httptransport.NewServer(
+			e.APIKeyDeleteEndpoint,
+			decodeAPIKeyRequest,
+			encodeResponse,
+			options...,
+		))
+	}
+	if e.SearchEndpoint != nil {
+		r.Methods("GET").Path("/customers/search").Handler(httptransport.NewServer(
+			e.SearchEndpoint,
+			decodeSearchRequest,
+			encodeResponse,
+			options...,
+		))
+	}
+	if e.DefaultsPutEndpoint != nil {
+		r.Methods("PUT").Path("/customers/{id}/defaults").Handler(httptransport.NewServer(
+			e.DefaultsPutEndpoint,
+			decodeDefaultsPutRequest,
+			encodeResponse,
+			options...,
+		))
+	}
+	if e.PhoneVerifyEndpoint != nil {
+		r.Methods("POST").Path("/customers/{id}/phone/verification").Handler(httptransport.NewServer(
+			e.PhoneVerifyEndpoint,
+			decodePhoneRequest,
+			encodeResponse,
+			options...,
+		))
+		r.Methods("POST").Path("/customers/{id}/phone/verification/confirm").Handler(httptransport.NewServer(
+			e.PhoneConfirmEndpoint,
+			decodePhoneRequest,
+			encodeResponse,
+			options...,
+		))
+	}
+	if e.PreferencesGetEndpoint != nil {
+		r.Methods("GET").Path("/customers/{id}/preferences").Handler(httptransport.NewServer(
+			e.PreferencesGetEndpoint,
+			decodePreferencesRequest,
+			encodeResponse,
+			options...,
+		))
+		r.Methods("PATCH").Path("/customers/{id}/preferences").Handler(httptransport.NewServer(
+			e.PreferencesPatchEndpoint,
+			decodePreferencesRequest,
+			encodeResponse,
+			options...,
+		))
+	}
+	if e.PoliciesGetEndpoint != nil {
+		r.Methods("GET").Path("/policies").Handler(httptransport.NewServer(
+			e.PoliciesGetEndpoint,
+			decodePoliciesRequest,
+			encodeResponse,
+			options...,
+		))
+		r.Methods("POST").Path("/policies").Handler(httptransport.NewServer(
+			e.PolicyPostEndpoint,
+			decodePolicyPostRequest,
+			encodeResponse,
+			options...,
+		))
+		r.Methods("GET").Path("/customers/{id}/consents").Handler(httptransport.NewServer(
+			e.ConsentsGetEndpoint,
+			decodeConsentRequest,
+			encodeResponse,
+			options...,
+		))
+		r.Methods("POST").Path("/customers/{id}/consents").Handler(httptransport.NewServer(
+			e.ConsentPostEndpoint,
+			decodeConsentRequest,
+			encodeResponse,
+			options...,
+		))
+		r.Methods("DELETE").Path("/customers/{id}/consents/{policy}").Handler(httptransport.NewServer(
+			e.ConsentDeleteEndpoint,
+			decodeConsentRequest,
+			encodeResponse,
+			options...,
+		))
+	}
 	r.Methods("GET").PathPrefix("/customers").Handler(httptransport.NewServer(
 		e.UserGetEndpoint,
 		decodeGetRequest,
@@ -56,12 +398,67 @@ func MakeHTTPHandler(ctx context.Context, e Endpoints, logger log.Logger) *mux.R
 		encodeResponse,
 		options...,
 	))
+	r.Methods("PUT").Path("/customers/{id}").Handler(httptransport.NewServer(
+		e.UserPutEndpoint,
+		decodeUserPutRequest,
+		encodeResponse,
+		options...,
+	))
 	r.Methods("POST").Path("/addresses").Handler(httptransport.NewServer(
 		e.AddressPostEndpoint,
 		decodeAddressRequest,
 		encodeResponse,
 		options...,
 	))
+	r.Methods("POST").Path("/addresses/validate").Handler(httptransport.NewServer(
+		e.AddressValidateEndpoint,
+		decodeAddressValidateRequest,
+		encodeResponse,
+		options...,
+	))
+	if e.AuditGetEndpoint != nil {
+		r.Methods("GET").Path("/audit").Handler(httptransport.NewServer(
+			e.AuditGetEndpoint,
+			decodeAuditGetRequest,
+			encodeResponse,
+			options...,
+		))
+	}
+	if e.TenantsGetEndpoint != nil {
+		r.Methods("GET").Path("/tenants").Handler(httptransport.NewServer(
+			e.TenantsGetEndpoint,
+			decodeNoRequest,
+			encodeResponse,
+			options...,
+		))
+		r.Methods("GET").Path("/tenants/{id}").Handler(httptransport.NewServer(
+			e.TenantGetEndpoint,
+			decodeTenantRequest,
+			encodeResponse,
+			options...,
+		))
+		r.Methods("PUT").Path("/tenants/{id}").Handler(httptransport.NewServer(
+			e.TenantPutEndpoint,
+			decodeTenantPutRequest,
+			encodeResponse,
+			options...,
+		))
+		r.Methods("DELETE").Path("/tenants/{id}").Handler(httptransport.NewServer(
+			e.TenantDeleteEndpoint,
+			decodeTenantRequest,
+			encodeResponse,
+			options...,
+		))
+	}
+	if e.HealthEndpoint != nil {
+		r.Methods("GET").Path("/health").Handler(httptransport.NewServer(
+			e.HealthEndpoint,
+			decodeHealthRequest,
+			encodeHealthResponse,
+			options...,
+		))
+	}
+	r.Methods("GET").Path("/openapi.json").HandlerFunc(serveOpenAPI)
 	r.Methods("DELETE").PathPrefix("/").Handler(httptransport.NewServer(
 		e.DeleteEndpoint,
 		decodeDeleteRequest,
@@ -71,12 +468,9 @@ func MakeHTTPHandler(ctx context.Context, e Endpoints, logger log.Logger) *mux.R
 	return r
 }
 
-func encodeError(_ context.Context, err error, w http.ResponseWriter) {
-	code := http.StatusInternalServerError
-	switch err {
-	case ErrUnauthorized:
-		code = http.StatusUnauthorized
-	}
+func encodeError(ctx context.Context, err error, w http.ResponseWriter) {
+	writeRateLimit(ctx, w)
+	code := statusOf(err).HTTP
 	w.WriteHeader(code)
 	w.Header().Set("Content-Type", "application/hal+json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -86,15 +480,22 @@ func encodeError(_ context.Context, err error, w http.ResponseWriter) {
 	})
 }
 
+// decodeLoginRequest reads the credentials from basic auth, and the policy
+// versions accepted from the accept parameters, as in accept=terms:2.
 func decodeLoginRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	u, p, ok := r.BasicAuth()
 	if !ok {
 		return loginRequest{}, ErrUnauthorized
 	}
+	accept, err := parsePolicyRefs(r.URL.Query()["accept"])
+	if err != nil {
+		return nil, err
+	}
 
 	return loginRequest{
 		Username: u,
 		Password: p,
+		Accept:   accept,
 	}, nil
 }
 
@@ -107,10 +508,25 @@ func decodeRegisterRequest(_ context.Context, r *http.Request) (interface{}, err
 	return reg, nil
 }
 
+// decodeDeleteRequest accepts /customers/{id}, /customers/{id}/addresses/{addrid}
+// and the older /{id}/{addrid} form. An If-Match header makes the delete
+// conditional on the version the client last read.
 func decodeDeleteRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	d := deleteRequest{}
+	var err error
+	if d.IfMatch, err = parseIfMatch(r.Header.Get("If-Match")); err != nil {
+		return d, err
+	}
 	u := strings.Split(r.URL.Path, "/")
-	if len(u) == 3 {
+	switch {
+	case len(u) == 3 && u[1] == "customers":
+		d.UserID = u[2]
+		return d, nil
+	case len(u) == 5 && u[1] == "customers" && u[3] == "addresses":
+		d.UserID = u[2]
+		d.AddID = u[4]
+		return d, nil
+	case len(u) == 3:
 		d.UserID = u[1]
 		d.AddID = u[2]
 		return d, nil
@@ -132,12 +548,41 @@ func decodeGetRequest(_ context.Context, r *http.Request) (interface{}, error) {
 
 func decodeUserRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	defer r.Body.Close()
-	u := dbOperations.User{}
+	// User hides password and email from JSON, so they are read separately.
+	u := struct {
+		dbOperations.User
+		Password string `json:"password"`
+		Email    string `json:"email"`
+	}{}
 	err := json.NewDecoder(r.Body).Decode(&u)
 	if err != nil {
 		return nil, err
 	}
-	return u, nil
+	u.User.Password = u.Password
+	u.User.Email = u.Email
+	return u.User, nil
+}
+
+// decodeUserPutRequest reads the user as decodeUserRequest does, its id
+// from the path and the versions the update is conditional on from
+// If-Match. A user keeps its password unless one is sent, but must keep a
+// username.
+func decodeUserPutRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+	req := userPutRequest{}
+	var err error
+	if req.IfMatch, err = parseIfMatch(r.Header.Get("If-Match")); err != nil {
+		return nil, err
+	}
+	u, err := decodeUserRequest(ctx, r)
+	if err != nil {
+		return nil, ErrInvalidRequest
+	}
+	req.User = u.(dbOperations.User)
+	if req.User.Username == "" {
+		return nil, ErrInvalidRequest
+	}
+	req.User.UserID = mux.Vars(r)["id"]
+	return req, nil
 }
 
 func decodeAddressRequest(_ context.Context, r *http.Request) (interface{}, error) {
@@ -147,10 +592,619 @@ func decodeAddressRequest(_ context.Context, r *http.Request) (interface{}, erro
 	if err != nil {
 		return nil, err
 	}
+	if !validAddress(&a.Address) {
+		return nil, ErrInvalidRequest
+	}
+	return a, nil
+}
+
+func decodeAddressValidateRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	a := dbOperations.Address{}
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		return nil, ErrInvalidRequest
+	}
 	return a, nil
 }
 
-func encodeResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+// decodeDefaultsPutRequest reads the ids of the default addresses from the
+// body, and the version of the customer from If-Match.
+func decodeDefaultsPutRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	req := defaultsRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, ErrInvalidRequest
+	}
+	req.UserID = mux.Vars(r)["id"]
+	var err error
+	if req.IfMatch, err = parseIfMatch(r.Header.Get("If-Match")); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// decodePhoneRequest reads the customer from the path, and the code being
+// confirmed from the body if there is one.
+func decodePhoneRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	req := phoneRequest{UserID: mux.Vars(r)["id"]}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		return nil, ErrInvalidRequest
+	}
+	return req, nil
+}
+
+// decodePoliciesRequest reads whether every version is asked for, with
+// all=true.
+func decodePoliciesRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return policiesRequest{All: r.URL.Query().Get("all") == "true"}, nil
+}
+
+func decodePolicyPostRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	p := dbOperations.Policy{}
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		return nil, ErrInvalidRequest
+	}
+	return p, nil
+}
+
+// decodeConsentRequest reads the customer and policy from the path, and
+// the policy versions accepted and the channel from the body of a POST.
+func decodeConsentRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	req := consentRequest{UserID: mux.Vars(r)["id"], Policy: mux.Vars(r)["policy"]}
+	if r.Method != "POST" {
+		return req, nil
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, ErrInvalidRequest
+	}
+	return req, nil
+}
+
+// decodePreferencesRequest reads the customer from the path, and for a
+// PATCH the merge patch from the body and the version of the customer
+// from If-Match.
+func decodePreferencesRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	req := preferencesRequest{UserID: mux.Vars(r)["id"]}
+	if r.Method != "PATCH" {
+		return req, nil
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req.Patch); err != nil {
+		return nil, ErrInvalidRequest
+	}
+	var err error
+	if req.IfMatch, err = parseIfMatch(r.Header.Get("If-Match")); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// decodeAuditGetRequest reads the filter and page from the query string:
+// actor, target, action, outcome, since and until (RFC 3339), page and size.
+func decodeAuditGetRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	q := r.URL.Query()
+	a := auditGetRequest{Size: 20}
+	a.Actor = q.Get("actor")
+	a.Target = q.Get("target")
+	a.Action = q.Get("action")
+	a.Outcome = q.Get("outcome")
+	var err error
+	if v := q.Get("since"); v != "" {
+		if a.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, ErrInvalidRequest
+		}
+	}
+	if v := q.Get("until"); v != "" {
+		if a.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, ErrInvalidRequest
+		}
+	}
+	if v := q.Get("page"); v != "" {
+		if a.Page, err = strconv.Atoi(v); err != nil || a.Page < 0 {
+			return nil, ErrInvalidRequest
+		}
+	}
+	if v := q.Get("size"); v != "" {
+		if a.Size, err = strconv.Atoi(v); err != nil || a.Size < 1 || a.Size > 100 {
+			return nil, ErrInvalidRequest
+		}
+	}
+	return a, nil
+}
+
+// decodeSearchRequest reads the search from the query string: q, fields
+// (comma separated), country and limit.
+func decodeSearchRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	q := r.URL.Query()
+	s := SearchQuery{Text: q.Get("q"), Country: q.Get("country"), Limit: 20}
+	if v := q.Get("fields"); v != "" {
+		s.Fields = strings.Split(v, ",")
+	}
+	if v := q.Get("limit"); v != "" {
+		var err error
+		if s.Limit, err = strconv.Atoi(v); err != nil {
+			return nil, ErrInvalidRequest
+		}
+	}
+	if !validSearch(s) {
+		return nil, ErrInvalidRequest
+	}
+	return s, nil
+}
+
+func decodeNoRequest(_ context.Context, _ *http.Request) (interface{}, error) {
+	return struct{}{}, nil
+}
+
+func decodeRestoreRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return restoreRequest{ID: mux.Vars(r)["id"]}, nil
+}
+
+// decodeBulkImportRequest takes the format from the format parameter, or
+// else from the Content-Type. The body is read as the users are imported.
+func decodeBulkImportRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	q := r.URL.Query()
+	req := bulkImportRequest{Format: q.Get("format"), DryRun: q.Get("dryRun") == "true", Body: r.Body}
+	if req.Format == "" {
+		req.Format = bulkFormatOf(r.Header.Get("Content-Type"))
+	}
+	var err error
+	if req.Columns, err = ParseColumns(q.Get("columns")); err != nil {
+		return nil, ErrInvalidRequest
+	}
+	if v := q.Get("skip"); v != "" {
+		if req.Skip, err = strconv.Atoi(v); err != nil || req.Skip < 0 {
+			return nil, ErrInvalidRequest
+		}
+	}
+	return req, nil
+}
+
+// decodeBulkExportRequest takes the format from the format parameter, or
+// else from the Accept header, and defaults to NDJSON.
+func decodeBulkExportRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	q := r.URL.Query()
+	req := bulkExportRequest{Format: q.Get("format"), Passwords: q.Get("passwords") == "true"}
+	if req.Format == "" {
+		req.Format = bulkFormatOf(r.Header.Get("Accept"))
+	}
+	if req.Format == "" {
+		req.Format = FormatNDJSON
+	}
+	return req, nil
+}
+
+// bulkFormatOf returns the format of a media type, or "" if it is none.
+func bulkFormatOf(mediaType string) string {
+	mediaType = strings.TrimSpace(strings.Split(mediaType, ";")[0])
+	for format, ct := range bulkContentTypes {
+		if ct == mediaType {
+			return format
+		}
+	}
+	return ""
+}
+
+func decodeWebhookPostRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	w := webhookPostRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&w); err != nil {
+		return nil, ErrInvalidRequest
+	}
+	return w, nil
+}
+
+func decodeWebhookRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return webhookRequest{ID: mux.Vars(r)["id"]}, nil
+}
+
+func decodeAPIKeyPostRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	k := apiKeyPostRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&k); err != nil {
+		return nil, ErrInvalidRequest
+	}
+	return k, nil
+}
+
+// decodeAPIKeyRotateRequest reads the optional grace period and expiry of
+// a rotation; an empty body keeps the defaults.
+func decodeAPIKeyRotateRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	k := apiKeyRotateRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&k); err != nil && err != io.EOF {
+		return nil, ErrInvalidRequest
+	}
+	k.ID = mux.Vars(r)["id"]
+	return k, nil
+}
+
+func decodeHealthRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return healthRequest{}, nil
+}
+
+func decodeAPIKeyRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return apiKeyRequest{ID: mux.Vars(r)["id"]}, nil
+}
+
+func decodeTenantRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return tenantRequest{ID: mux.Vars(r)["id"]}, nil
+}
+
+func decodeTenantPutRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	req := tenantRequest{ID: mux.Vars(r)["id"]}
+	if err := json.NewDecoder(r.Body).Decode(&req.Tenant); err != nil {
+		return nil, ErrInvalidRequest
+	}
+	return req, nil
+}
+
+// decodeSCIMUserRequest reads the user id from the path, the version from
+// If-Match and, for POST and PUT, the user resource from the body.
+func decodeSCIMUserRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	req := scimUserRequest{ID: mux.Vars(r)["id"]}
+	var err error
+	if req.IfMatch, err = parseIfMatch(r.Header.Get("If-Match")); err != nil {
+		return nil, err
+	}
+	if r.Method == "POST" || r.Method == "PUT" {
+		defer r.Body.Close()
+		if err := json.NewDecoder(r.Body).Decode(&req.User); err != nil {
+			return nil, scimSyntaxError(err)
+		}
+	}
+	return req, nil
+}
+
+func decodeSCIMPatchRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	req := scimPatchRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, scimSyntaxError(err)
+	}
+	req.ID = mux.Vars(r)["id"]
+	var err error
+	if req.IfMatch, err = parseIfMatch(r.Header.Get("If-Match")); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// decodeSCIMListRequest reads filter, startIndex (1 based, default 1) and
+// count (default and at most scimMaxResults) from the query string.
+func decodeSCIMListRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	q := r.URL.Query()
+	req := scimListRequest{Filter: q.Get("filter"), StartIndex: 1, Count: scimMaxResults}
+	var err error
+	if v := q.Get("startIndex"); v != "" {
+		if req.StartIndex, err = strconv.Atoi(v); err != nil {
+			return nil, scimError{Status: 400, Type: "invalidValue", Detail: "startIndex must be an integer"}
+		}
+		if req.StartIndex < 1 {
+			req.StartIndex = 1
+		}
+	}
+	if v := q.Get("count"); v != "" {
+		if req.Count, err = strconv.Atoi(v); err != nil {
+			return nil, scimError{Status: 400, Type: "invalidValue", Detail: "count must be an integer"}
+		}
+		if req.Count < 0 {
+			req.Count = 0
+		}
+		if req.Count > scimMaxResults {
+			req.Count = scimMaxResults
+		}
+	}
+	return req, nil
+}
+
+func scimSyntaxError(err error) error {
+	if serr, ok := err.(scimError); ok {
+		return serr
+	}
+	return scimError{Status: 400, Type: "invalidSyntax", Detail: err.Error()}
+}
+
+// decodeAuthorizeRequest reads an authorization request from the query
+// string, or from the login and consent forms.
+func decodeAuthorizeRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, ErrInvalidRequest
+	}
+	req := authorizeRequestFrom(r.Form)
+	req.Username = r.PostForm.Get("username")
+	req.Password = r.PostForm.Get("password")
+	req.Ticket = r.PostForm.Get("ticket")
+	req.Decision = r.PostForm.Get("decision")
+	accept, err := parsePolicyRefs(r.PostForm["accept"])
+	if err != nil {
+		return nil, err
+	}
+	req.Accept = accept
+	return req, nil
+}
+
+// decodeExternalLoginRequest reads the authorization request the login
+// page passes on to an identity provider.
+func decodeExternalLoginRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, ErrInvalidRequest
+	}
+	return externalLoginRequest{
+		authorizeRequest: authorizeRequestFrom(r.Form),
+		Provider:         mux.Vars(r)["provider"],
+	}, nil
+}
+
+// decodeExternalCallbackRequest reads the response of an identity
+// provider, and the cookie of the browser it reached.
+func decodeExternalCallbackRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	q := r.URL.Query()
+	req := externalCallbackRequest{
+		Provider: mux.Vars(r)["provider"],
+		State:    q.Get("state"),
+		Code:     q.Get("code"),
+		Error:    q.Get("error"),
+	}
+	if c, err := r.Cookie(externalLoginCookie); err == nil {
+		req.Browser = c.Value
+	}
+	return req, nil
+}
+
+func decodeIdentityRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return identityRequest{UserID: mux.Vars(r)["id"], Provider: mux.Vars(r)["provider"]}, nil
+}
+
+// decodeTokenRequest reads a token request. Client credentials may come
+// in the form or, form encoded, as Basic auth.
+func decodeTokenRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, oauthError{Status: http.StatusBadRequest, Code: "invalid_request", Description: err.Error()}
+	}
+	req := tokenRequest{
+		GrantType:    r.PostForm.Get("grant_type"),
+		Code:         r.PostForm.Get("code"),
+		RedirectURI:  r.PostForm.Get("redirect_uri"),
+		ClientID:     r.PostForm.Get("client_id"),
+		ClientSecret: r.PostForm.Get("client_secret"),
+		CodeVerifier: r.PostForm.Get("code_verifier"),
+	}
+	if id, secret, ok := r.BasicAuth(); ok {
+		var err error
+		if req.ClientID, err = url.QueryUnescape(id); err == nil {
+			req.ClientSecret, err = url.QueryUnescape(secret)
+		}
+		if err != nil {
+			return nil, oauthError{Status: http.StatusUnauthorized, Code: "invalid_client", Description: "Malformed client credentials."}
+		}
+	}
+	return req, nil
+}
+
+// decodeUserInfoRequest reads the access token from the Authorization
+// header, or from the form of a POST.
+func decodeUserInfoRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	if token, ok := credentials(r.Header.Get("Authorization"), "Bearer"); ok {
+		return userInfoRequest{Token: token}, nil
+	}
+	return userInfoRequest{Token: r.PostFormValue("access_token")}, nil
+}
+
+func decodeClientPostRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	req := clientPostRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, ErrInvalidRequest
+	}
+	return req, nil
+}
+
+func decodeClientRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return clientRequest{ID: mux.Vars(r)["id"]}, nil
+}
+
+func decodeDataSubjectRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return dataSubjectRequest{UserID: mux.Vars(r)["id"]}, nil
+}
+
+// encodeExportResponse offers the export as a file download.
+func encodeExportResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	resp := response.(exportResponse)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="customer-%s.json"`, resp.User.ID))
+	return encodeResponse(ctx, w, response)
+}
+
+// encodeErasureResponse answers 202 Accepted while the erasure waits for
+// its grace period.
+func encodeErasureResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	if response.(dbOperations.Erasure).Status == dbOperations.ErasurePending {
+		w.WriteHeader(http.StatusAccepted)
+	}
+	return json.NewEncoder(w).Encode(response)
+}
+
+// encodeHealthResponse answers 503 Service Unavailable unless the service
+// and all its dependencies are OK.
+func encodeHealthResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	if !response.(healthResponse).healthy() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	return json.NewEncoder(w).Encode(response)
+}
+
+// encodeBulkExportResponse streams the export as a file download. An error
+// half way through can only cut the download short.
+func encodeBulkExportResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	resp := response.(bulkExportResponse)
+	w.Header().Set("Content-Type", bulkContentTypes[resp.Format])
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="customers.%s"`, resp.Format))
+	return resp.write(w)
+}
+
+// encodeCreatedResponse answers 201 Created with the new resource.
+func encodeCreatedResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	return json.NewEncoder(w).Encode(response)
+}
+
+// encodeSCIMResponse writes SCIM resources as application/scim+json, with
+// a user's version as its ETag.
+func encodeSCIMResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	w.Header().Set("Content-Type", "application/scim+json")
+	if su, ok := response.(scimUser); ok && su.Meta != nil {
+		w.Header().Set("ETag", su.Meta.Version)
+	}
+	return json.NewEncoder(w).Encode(response)
+}
+
+// encodeSCIMCreated answers 201 Created with the location of the new user.
+func encodeSCIMCreated(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	w.Header().Set("Location", response.(scimUser).Meta.Location)
+	w.Header().Set("Content-Type", "application/scim+json")
+	w.Header().Set("ETag", response.(scimUser).Meta.Version)
+	w.WriteHeader(http.StatusCreated)
+	return json.NewEncoder(w).Encode(response)
+}
+
+func encodeSCIMNoContent(_ context.Context, w http.ResponseWriter, _ interface{}) error {
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// encodeSCIMError writes errors in the SCIM error format (RFC 7644
+// section 3.12).
+func encodeSCIMError(ctx context.Context, err error, w http.ResponseWriter) {
+	writeRateLimit(ctx, w)
+	serr, ok := err.(scimError)
+	if !ok {
+		serr = scimError{Status: statusOf(err).HTTP, Detail: err.Error()}
+		switch {
+		case err == ErrInvalidRequest, err == ErrInvalidPhone:
+			serr.Type = "invalidValue"
+		case err == dbOperations.ErrInvalidHexID:
+			serr.Status = http.StatusNotFound
+		case err == ErrRateLimited:
+			serr.Type = "tooMany"
+		case mgo.IsDup(err):
+			serr.Type = "uniqueness"
+		}
+	}
+	w.Header().Set("Content-Type", "application/scim+json")
+	w.WriteHeader(serr.Status)
+	body := map[string]interface{}{
+		"schemas": []string{scimErrorSchema},
+		"status":  strconv.Itoa(serr.Status),
+		"detail":  serr.Detail,
+	}
+	if serr.Type != "" {
+		body["scimType"] = serr.Type
+	}
+	json.NewEncoder(w).Encode(body)
+}
+
+// encodeOIDCPage renders a page of the authorization flow, or redirects
+// back to the client.
+func encodeOIDCPage(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	switch resp := response.(type) {
+	case oidcRedirect:
+		if resp.cookie != nil {
+			http.SetCookie(w, resp.cookie)
+		}
+		w.Header().Set("Location", resp.URL)
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusFound)
+		return nil
+	case *oidcPage:
+		return renderOIDCPage(w, resp)
+	}
+	return fmt.Errorf("unexpected response %T", response)
+}
+
+// renderOIDCPage writes a page that may not be framed, so it cannot be
+// used for clickjacking.
+func renderOIDCPage(w http.ResponseWriter, page *oidcPage) error {
+	var buf bytes.Buffer
+	if err := page.tmpl.ExecuteTemplate(&buf, page.name, page.data); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+	w.WriteHeader(page.status)
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// encodeOIDCPageError shows errors of the authorization flow to the user,
+// or sends them back to the client.
+func encodeOIDCPageError(ctx context.Context, err error, w http.ResponseWriter) {
+	oerr, ok := err.(oauthError)
+	switch {
+	case ok && oerr.page != nil:
+		renderOIDCPage(w, oerr.page)
+	case ok && oerr.redirectURI != "":
+		encodeOIDCPage(ctx, w, oidcRedirect{URL: oerr.location()})
+	default:
+		encodeError(ctx, err, w)
+	}
+}
+
+// encodeLinkResponse sets the cookie the browser needs to come back from
+// linking an account.
+func encodeLinkResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	http.SetCookie(w, response.(linkResponse).cookie)
+	w.Header().Set("Cache-Control", "no-store")
+	return encodeResponse(ctx, w, response)
+}
+
+// encodeOAuthResponse writes token and userinfo responses, which must
+// not be cached.
+func encodeOAuthResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	return json.NewEncoder(w).Encode(response)
+}
+
+// encodeOAuthError writes errors in the OAuth 2.0 format (RFC 6749
+// section 5.2, RFC 6750 section 3).
+func encodeOAuthError(ctx context.Context, err error, w http.ResponseWriter) {
+	oerr, ok := err.(oauthError)
+	if err == ErrUnauthorized {
+		oerr, ok = oauthError{Status: http.StatusUnauthorized, Code: "invalid_token", Description: "The access token is invalid or expired."}, true
+	}
+	if !ok {
+		encodeError(ctx, err, w)
+		return
+	}
+	switch oerr.Code {
+	case "invalid_token":
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="invalid_token", error_description=%q`, oerr.Description))
+	case "invalid_client":
+		w.Header().Set("WWW-Authenticate", "Basic")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(oerr.Status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":             oerr.Code,
+		"error_description": oerr.Description,
+	})
+}
+
+func encodeResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	if writeETag(ctx, w, response) {
+		return nil
+	}
 	// All of our response objects are JSON serializable, so we just do that.
 	w.Header().Set("Content-Type", "application/json")
 	return json.NewEncoder(w).Encode(response)
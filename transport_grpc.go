@@ -0,0 +1,357 @@
+package user
+
+import (
+	"context"
+
+	"github.com/go-kit/kit/log"
+	grpctransport "github.com/go-kit/kit/transport/grpc"
+	"github.com/user/dbOperations"
+	"github.com/user/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+type grpcServer struct {
+	pb.UnimplementedUserServer
+	login       grpctransport.Handler
+	register    grpctransport.Handler
+	getUser     grpctransport.Handler
+	postUser    grpctransport.Handler
+	getAddress  grpctransport.Handler
+	postAddress grpctransport.Handler
+	delete      grpctransport.Handler
+}
+
+// MakeGRPCServer makes the endpoints available as a gRPC UserServer.
+func MakeGRPCServer(e Endpoints, logger log.Logger) pb.UserServer {
+	options := []grpctransport.ServerOption{
+		grpctransport.ServerErrorLogger(logger),
+		grpctransport.ServerBefore(populateGRPCRequestInfo),
+	}
+	return &grpcServer{
+		login: grpctransport.NewServer(
+			e.LoginEndpoint,
+			decodeGRPCLoginRequest,
+			encodeGRPCLoginResponse,
+			options...,
+		),
+		register: grpctransport.NewServer(
+			e.RegisterEndpoint,
+			decodeGRPCRegisterRequest,
+			encodeGRPCPostResponse,
+			options...,
+		),
+		getUser: grpctransport.NewServer(
+			e.UserGetEndpoint,
+			decodeGRPCGetRequest,
+			encodeGRPCGetUserResponse,
+			options...,
+		),
+		postUser: grpctransport.NewServer(
+			e.UserPostEndpoint,
+			decodeGRPCUserRequest,
+			encodeGRPCPostResponse,
+			options...,
+		),
+		getAddress: grpctransport.NewServer(
+			e.AddressGetEndpoint,
+			decodeGRPCGetRequest,
+			encodeGRPCGetAddressResponse,
+			options...,
+		),
+		postAddress: grpctransport.NewServer(
+			e.AddressPostEndpoint,
+			decodeGRPCAddressRequest,
+			encodeGRPCPostResponse,
+			options...,
+		),
+		delete: grpctransport.NewServer(
+			e.DeleteEndpoint,
+			decodeGRPCDeleteRequest,
+			encodeGRPCStatusResponse,
+			options...,
+		),
+	}
+}
+
+func (s *grpcServer) Login(ctx context.Context, req *pb.LoginRequest) (*pb.LoginReply, error) {
+	_, rep, err := s.login.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return rep.(*pb.LoginReply), nil
+}
+
+func (s *grpcServer) Register(ctx context.Context, req *pb.RegisterRequest) (*pb.PostReply, error) {
+	_, rep, err := s.register.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return rep.(*pb.PostReply), nil
+}
+
+func (s *grpcServer) GetUser(ctx context.Context, req *pb.GetRequest) (*pb.GetUserReply, error) {
+	_, rep, err := s.getUser.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return rep.(*pb.GetUserReply), nil
+}
+
+func (s *grpcServer) PostUser(ctx context.Context, req *pb.UserRecord) (*pb.PostReply, error) {
+	_, rep, err := s.postUser.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return rep.(*pb.PostReply), nil
+}
+
+func (s *grpcServer) GetAddress(ctx context.Context, req *pb.GetRequest) (*pb.GetAddressReply, error) {
+	_, rep, err := s.getAddress.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return rep.(*pb.GetAddressReply), nil
+}
+
+func (s *grpcServer) PostAddress(ctx context.Context, req *pb.PostAddressRequest) (*pb.PostReply, error) {
+	_, rep, err := s.postAddress.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return rep.(*pb.PostReply), nil
+}
+
+func (s *grpcServer) Delete(ctx context.Context, req *pb.DeleteRequest) (*pb.StatusReply, error) {
+	_, rep, err := s.delete.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return rep.(*pb.StatusReply), nil
+}
+
+// grpcError maps service and storage errors onto gRPC status codes, the
+// same way encodeError maps them onto HTTP status codes, see statusOf.
+func grpcError(err error) error {
+	return status.Error(statusOf(err).GRPC, err.Error())
+}
+
+// UnaryServerInterceptor returns an interceptor storing the client
+// address of every call for the transport to put in its RequestInfo.
+func (ps TrustedProxies) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		ip := ps.clientIP(peerAddr(ctx), md.Get("x-forwarded-for"))
+		return handler(context.WithValue(ctx, clientIPKey, ip), req)
+	}
+}
+
+func peerAddr(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		return p.Addr.String()
+	}
+	return ""
+}
+
+// populateGRPCRequestInfo is a ServerRequestFunc storing the caller's
+// RequestInfo, read from the peer and the request metadata. The client
+// address is the peer's, or the one TrustedProxies found.
+func populateGRPCRequestInfo(ctx context.Context, md metadata.MD) context.Context {
+	ip, ok := ctx.Value(clientIPKey).(string)
+	if !ok {
+		ip = TrustedProxies(nil).clientIP(peerAddr(ctx), nil)
+	}
+	ri := RequestInfo{ClientIP: ip}
+	get := func(key string) string {
+		if v := md.Get(key); len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	ri.UserAgent = get("user-agent")
+	ri.RequestID = get("x-request-id")
+	ri.Authorization = get("authorization")
+	ri.Route, _ = grpc.Method(ctx)
+	return withRequestInfo(ctx, ri)
+}
+
+func decodeGRPCLoginRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*pb.LoginRequest)
+	if req.Username == "" {
+		return loginRequest{}, ErrUnauthorized
+	}
+	return loginRequest{
+		Username: req.Username,
+		Password: req.Password,
+		Accept:   policyRefsFromGRPC(req.Accept),
+	}, nil
+}
+
+func decodeGRPCRegisterRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*pb.RegisterRequest)
+	return registerRequest{
+		Username:  req.Username,
+		Password:  req.Password,
+		Email:     req.Email,
+		FirstName: req.FirstName,
+		LastName:  req.LastName,
+		Phone:     req.Phone,
+		Accept:    policyRefsFromGRPC(req.Accept),
+	}, nil
+}
+
+// policyRefsFromGRPC returns the policy versions a request accepts.
+func policyRefsFromGRPC(accept []*pb.PolicyVersion) []policyRef {
+	var refs []policyRef
+	for _, v := range accept {
+		refs = append(refs, policyRef{v.Policy, v.Version})
+	}
+	return refs
+}
+
+func decodeGRPCGetRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*pb.GetRequest)
+	return GetRequest{
+		ID:   req.Id,
+		Attr: req.Attr,
+	}, nil
+}
+
+func decodeGRPCUserRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*pb.UserRecord)
+	u := dbOperations.User{
+		Username:  req.Username,
+		Password:  req.Password,
+		Email:     req.Email,
+		FirstName: req.FirstName,
+		LastName:  req.LastName,
+		Phone:     req.Phone,
+		Addresses: make([]dbOperations.Address, 0),
+	}
+	for _, a := range req.Addresses {
+		u.Addresses = append(u.Addresses, addressFromPB(a))
+	}
+	return u, nil
+}
+
+func decodeGRPCAddressRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*pb.PostAddressRequest)
+	if req.Address == nil {
+		return nil, ErrInvalidRequest
+	}
+	return addressPostRequest{
+		Address: addressFromPB(req.Address),
+		UserID:  req.UserId,
+	}, nil
+}
+
+func decodeGRPCDeleteRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*pb.DeleteRequest)
+	if req.UserId == "" {
+		return nil, ErrInvalidRequest
+	}
+	return deleteRequest{
+		UserID: req.UserId,
+		AddID:  req.AddressId,
+	}, nil
+}
+
+func encodeGRPCLoginResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(userResponse)
+	return &pb.LoginReply{User: userToPB(resp.User)}, nil
+}
+
+func encodeGRPCPostResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(postResponse)
+	return &pb.PostReply{Id: resp.ID}, nil
+}
+
+func encodeGRPCStatusResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(statusResponse)
+	return &pb.StatusReply{Status: resp.Status}, nil
+}
+
+// encodeGRPCGetUserResponse unwraps the three shapes UserGetEndpoint can
+// return: a single user, an embedded user list or embedded addresses.
+func encodeGRPCGetUserResponse(_ context.Context, response interface{}) (interface{}, error) {
+	switch resp := response.(type) {
+	case dbOperations.User:
+		return &pb.GetUserReply{Result: &pb.GetUserReply_User{User: userToPB(resp)}}, nil
+	case EmbedStruct:
+		switch embed := resp.Embed.(type) {
+		case usersResponse:
+			users := &pb.UserList{}
+			for _, u := range embed.Users {
+				users.Users = append(users.Users, userToPB(u))
+			}
+			return &pb.GetUserReply{Result: &pb.GetUserReply_Users{Users: users}}, nil
+		case addressesResponse:
+			return &pb.GetUserReply{Result: &pb.GetUserReply_Addresses{Addresses: addressListToPB(embed.Addresses)}}, nil
+		}
+	}
+	return nil, ErrInvalidRequest
+}
+
+// encodeGRPCGetAddressResponse unwraps the two shapes AddressGetEndpoint
+// can return: a single address or embedded addresses.
+func encodeGRPCGetAddressResponse(_ context.Context, response interface{}) (interface{}, error) {
+	switch resp := response.(type) {
+	case dbOperations.Address:
+		return &pb.GetAddressReply{Result: &pb.GetAddressReply_Address{Address: addressToPB(resp)}}, nil
+	case EmbedStruct:
+		if embed, ok := resp.Embed.(addressesResponse); ok {
+			return &pb.GetAddressReply{Result: &pb.GetAddressReply_Addresses{Addresses: addressListToPB(embed.Addresses)}}, nil
+		}
+	}
+	return nil, ErrInvalidRequest
+}
+
+// userToPB converts a user to its protobuf form. Password and salt are
+// never sent over the wire.
+func userToPB(u dbOperations.User) *pb.UserRecord {
+	p := &pb.UserRecord{
+		Id:        u.UserID,
+		Username:  u.Username,
+		FirstName: u.FirstName,
+		LastName:  u.LastName,
+		Phone:     u.Phone,
+	}
+	for _, a := range u.Addresses {
+		p.Addresses = append(p.Addresses, addressToPB(a))
+	}
+	return p
+}
+
+func addressToPB(a dbOperations.Address) *pb.Address {
+	return &pb.Address{
+		Id:        a.ID,
+		Country:   a.Country,
+		City:      a.City,
+		Street:    a.Street,
+		Number:    a.Number,
+		Postcode:  a.PostCode,
+		ExtraInfo: a.ExtraInfo,
+	}
+}
+
+func addressListToPB(adds []dbOperations.Address) *pb.AddressList {
+	l := &pb.AddressList{}
+	for _, a := range adds {
+		l.Addresses = append(l.Addresses, addressToPB(a))
+	}
+	return l
+}
+
+func addressFromPB(a *pb.Address) dbOperations.Address {
+	return dbOperations.Address{
+		ID:        a.Id,
+		Country:   a.Country,
+		City:      a.City,
+		Street:    a.Street,
+		Number:    a.Number,
+		PostCode:  a.Postcode,
+		ExtraInfo: a.ExtraInfo,
+	}
+}
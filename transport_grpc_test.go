@@ -0,0 +1,200 @@
+package user
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/user/dbOperations"
+	"github.com/user/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func newGRPCTestClient(t *testing.T, svc Service) pb.UserClient {
+	return newGRPCEndpointsClient(t, MakeEndpoints(svc))
+}
+
+func newGRPCEndpointsClient(t *testing.T, e Endpoints) pb.UserClient {
+	ln := bufconn.Listen(1024 * 1024)
+	s := grpc.NewServer()
+	pb.RegisterUserServer(s, MakeGRPCServer(e, log.NewNopLogger()))
+	go s.Serve(ln)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return ln.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewUserClient(conn)
+}
+
+func TestGRPCLogin(t *testing.T) {
+	c := newGRPCTestClient(t, newStubService())
+	rep, err := c.Login(context.Background(), &pb.LoginRequest{Username: "eve", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.User.Username != "eve" || len(rep.User.Addresses) != 1 {
+		t.Errorf("unexpected user %v", rep.User)
+	}
+	if rep.User.Password != "" {
+		t.Error("password must not be sent")
+	}
+	_, err = c.Login(context.Background(), &pb.LoginRequest{Username: "eve", Password: "wrong"})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected Unauthenticated, got %v", err)
+	}
+}
+
+func TestGRPCRegister(t *testing.T) {
+	c := newGRPCTestClient(t, newStubService())
+	rep, err := c.Register(context.Background(), &pb.RegisterRequest{Username: "mallory", Password: "pass"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Id == "" {
+		t.Error("expected id")
+	}
+	_, err = c.Register(context.Background(), &pb.RegisterRequest{Username: "eve", Password: "pass"})
+	if status.Code(err) != codes.AlreadyExists {
+		t.Errorf("expected AlreadyExists, got %v", err)
+	}
+}
+
+func TestGRPCConsent(t *testing.T) {
+	svc := newStubService()
+	svc.CreatePolicy(&dbOperations.Policy{Name: "terms", Version: "1", Mandatory: true})
+	e, _ := newTestEndpoints(svc)
+	c := newGRPCEndpointsClient(t, e)
+	accept := []*pb.PolicyVersion{{Policy: "terms", Version: "1"}}
+
+	_, err := c.Register(context.Background(), &pb.RegisterRequest{Username: "mallory", Password: "pass"})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected a registration without the policy to be refused, got %v", err)
+	}
+	if _, err := c.Register(context.Background(), &pb.RegisterRequest{Username: "mallory", Password: "pass", Accept: accept}); err != nil {
+		t.Errorf("expected the registration to go through, got %v", err)
+	}
+	_, err = c.Login(context.Background(), &pb.LoginRequest{Username: "eve", Password: "secret"})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected a login without the policy to be refused, got %v", err)
+	}
+	if _, err := c.Login(context.Background(), &pb.LoginRequest{Username: "eve", Password: "secret", Accept: accept}); err != nil {
+		t.Errorf("expected the login to go through, got %v", err)
+	}
+	if len(svc.acceptances) != 2 {
+		t.Errorf("expected both acceptances recorded, got %+v", svc.acceptances)
+	}
+}
+
+func TestGRPCGetUser(t *testing.T) {
+	svc := newStubService()
+	eve := svc.users["57a98d98e4b00679b4a830af"]
+	eve.Email = "eve@example.com"
+	svc.users[eve.UserID] = eve
+	c := newGRPCTestClient(t, svc)
+	rep, err := c.GetUser(context.Background(), &pb.GetRequest{Id: "57a98d98e4b00679b4a830af"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.GetUser().GetFirstName() != "Eve" || rep.GetUser().GetEmail() != "" || rep.GetUser().GetPassword() != "" {
+		t.Errorf("unexpected reply %v", rep)
+	}
+	rep, err = c.GetUser(context.Background(), &pb.GetRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.GetUsers().GetUsers()) != 1 {
+		t.Errorf("expected one user, got %v", rep)
+	}
+	rep, err = c.GetUser(context.Background(), &pb.GetRequest{Id: "57a98d98e4b00679b4a830af", Attr: "addresses"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.GetAddresses().GetAddresses()) != 1 {
+		t.Errorf("expected one address, got %v", rep)
+	}
+	_, err = c.GetUser(context.Background(), &pb.GetRequest{Id: "57a98d98e4b00679b4a830ff"})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound, got %v", err)
+	}
+}
+
+func TestGRPCAddresses(t *testing.T) {
+	c := newGRPCTestClient(t, newStubService())
+	post, err := c.PostAddress(context.Background(), &pb.PostAddressRequest{
+		Address: &pb.Address{City: "Bern", Postcode: "3000"},
+		UserId:  "57a98d98e4b00679b4a830af",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep, err := c.GetAddress(context.Background(), &pb.GetRequest{Id: post.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.GetAddress().GetPostcode() != "3000" {
+		t.Errorf("unexpected address %v", rep)
+	}
+	rep, err = c.GetAddress(context.Background(), &pb.GetRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.GetAddresses().GetAddresses()) != 2 {
+		t.Errorf("expected two addresses, got %v", rep)
+	}
+	_, err = c.PostAddress(context.Background(), &pb.PostAddressRequest{UserId: "57a98d98e4b00679b4a830af"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument, got %v", err)
+	}
+}
+
+func TestGRPCDelete(t *testing.T) {
+	c := newGRPCTestClient(t, newStubService())
+	rep, err := c.Delete(context.Background(), &pb.DeleteRequest{UserId: "57a98d98e4b00679b4a830af", AddressId: "57a98d98e4b00679b4a830b0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rep.Status {
+		t.Error("expected address to be deleted")
+	}
+	rep, err = c.Delete(context.Background(), &pb.DeleteRequest{UserId: "57a98d98e4b00679b4a830af"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rep.Status {
+		t.Error("expected user to be deleted")
+	}
+	_, err = c.Delete(context.Background(), &pb.DeleteRequest{UserId: "57a98d98e4b00679b4a830af"})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound, got %v", err)
+	}
+}
+
+func TestGRPCError(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		code codes.Code
+	}{
+		{ErrWeakPassword, codes.InvalidArgument},
+		{dbOperations.ErrAddressType, codes.InvalidArgument},
+		{AddressError{{Field: "postcode", Problem: "is not a postcode of CH"}}, codes.InvalidArgument},
+		{dbOperations.ErrPhoneCode, codes.InvalidArgument},
+		{PreferencesError{Field: "locale", Problem: "is not a language tag"}, codes.InvalidArgument},
+	} {
+		if got := status.Code(grpcError(c.err)); got != c.code {
+			t.Errorf("expected %v for %q, got %v", c.code, c.err, got)
+		}
+	}
+}
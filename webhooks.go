@@ -0,0 +1,338 @@
+package user
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/user/dbOperations"
+	mgo "gopkg.in/mgo.v2"
+)
+
+var (
+	// ErrWebhookSignature is returned by VerifyWebhook for a delivery that
+	// was not signed with the subscription's secret.
+	ErrWebhookSignature = errors.New("Invalid webhook signature")
+	// ErrWebhookExpired is returned by VerifyWebhook for a delivery whose
+	// timestamp is too far from now, which may be a replay.
+	ErrWebhookExpired = errors.New("Webhook timestamp out of tolerance")
+)
+
+const (
+	// WebhookTolerance is how far a delivery's timestamp may be from the
+	// receiver's clock before VerifyWebhook rejects it.
+	WebhookTolerance = 5 * time.Minute
+	// webhookMaxAttempts is how often a delivery is tried before it becomes
+	// a dead letter. With retryDelay's backoff that spans about half an hour.
+	webhookMaxAttempts = 12
+	// deliveryLogSize is how many deliveries the log endpoints return.
+	deliveryLogSize = 100
+)
+
+// eventTypes are the event types a subscription can filter on.
+var eventTypes = []string{EventUserRegistered, EventUserUpdated, EventAddressAdded, EventAddressRemoved, EventUserDeleted, EventUserRestored, EventAddressRestored, EventPolicyAccepted, EventPolicyWithdrawn}
+
+// WebhookStore keeps webhook subscriptions and their deliveries.
+// *dbOperations.Mongo implements it.
+type WebhookStore interface {
+	CreateSubscription(sub *dbOperations.Subscription) error
+	GetSubscriptions() ([]dbOperations.Subscription, error)
+	GetSubscription(id string) (dbOperations.Subscription, error)
+	SubscriptionsFor(typ string) ([]dbOperations.Subscription, error)
+	DeleteSubscription(id string) error
+	EnqueueDelivery(d *dbOperations.Delivery) error
+	ClaimDeliveries(now time.Time, lease time.Duration, limit int) ([]dbOperations.Delivery, error)
+	RecordDeliveryAttempt(id string, a dbOperations.DeliveryAttempt, status string, next time.Time) error
+	DeleteDelivery(id string) error
+	GetDeliveries(subscriptionID string, limit int) ([]dbOperations.Delivery, error)
+	GetDeadDeliveries(limit int) ([]dbOperations.Delivery, error)
+}
+
+// WebhookEndpoints mounts the admin-only endpoints managing webhook
+// subscriptions and inspecting their deliveries.
+func WebhookEndpoints(e Endpoints, st WebhookStore) Endpoints {
+	admin := RequireRole(RoleAdmin)
+	e.WebhookPostEndpoint = admin(MakeWebhookPostEndpoint(st))
+	e.WebhooksGetEndpoint = admin(MakeWebhooksGetEndpoint(st))
+	e.WebhookDeleteEndpoint = admin(MakeWebhookDeleteEndpoint(st))
+	e.WebhookDeliveriesEndpoint = admin(MakeWebhookDeliveriesEndpoint(st))
+	e.DeadLettersEndpoint = admin(MakeDeadLettersEndpoint(st))
+	return e
+}
+
+// MakeWebhookPostEndpoint returns an endpoint creating a subscription. A
+// secret is generated unless one is given; either way it is only returned
+// here.
+func MakeWebhookPostEndpoint(st WebhookStore) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(webhookPostRequest)
+		u, err := url.Parse(req.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, ErrInvalidRequest
+		}
+		for _, typ := range req.Events {
+			if !contains(eventTypes, typ) {
+				return nil, ErrInvalidRequest
+			}
+		}
+		if req.Secret == "" {
+			if req.Secret, err = newWebhookSecret(); err != nil {
+				return nil, err
+			}
+		}
+		sub := dbOperations.Subscription{
+			URL:       req.URL,
+			Events:    req.Events,
+			Secret:    req.Secret,
+			CreatedAt: time.Now().UTC(),
+			CreatedBy: actorFor(ctx, request),
+		}
+		if err := st.CreateSubscription(&sub); err != nil {
+			return nil, err
+		}
+		return webhookPostResponse{Subscription: sub, Secret: sub.Secret}, nil
+	}
+}
+
+// MakeWebhooksGetEndpoint returns an endpoint listing subscriptions.
+func MakeWebhooksGetEndpoint(st WebhookStore) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		subs, err := st.GetSubscriptions()
+		return EmbedStruct{webhooksResponse{Subscriptions: subs}}, err
+	}
+}
+
+// MakeWebhookDeleteEndpoint returns an endpoint deleting a subscription.
+func MakeWebhookDeleteEndpoint(st WebhookStore) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		err := st.DeleteSubscription(request.(webhookRequest).ID)
+		return statusResponse{Status: err == nil}, err
+	}
+}
+
+// MakeWebhookDeliveriesEndpoint returns an endpoint listing the latest
+// deliveries to a subscription with all their attempts.
+func MakeWebhookDeliveriesEndpoint(st WebhookStore) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		id := request.(webhookRequest).ID
+		if _, err := st.GetSubscription(id); err != nil {
+			return nil, err
+		}
+		deliveries, err := st.GetDeliveries(id, deliveryLogSize)
+		return EmbedStruct{deliveriesResponse{Deliveries: deliveries}}, err
+	}
+}
+
+// MakeDeadLettersEndpoint returns an endpoint listing the latest
+// deliveries that ran out of attempts.
+func MakeDeadLettersEndpoint(st WebhookStore) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		deliveries, err := st.GetDeadDeliveries(deliveryLogSize)
+		return EmbedStruct{deliveriesResponse{Deliveries: deliveries}}, err
+	}
+}
+
+// WebhookPublisher is a Publisher queueing each event for delivery to the
+// subscriptions that want it. DeliverWebhooks then delivers them.
+type WebhookPublisher struct {
+	Store WebhookStore
+}
+
+// Publish implements Publisher. Events are only queued for subscriptions
+// of the event's tenant, and publishing an event again does not queue it
+// twice for the same subscription.
+func (p WebhookPublisher) Publish(ctx context.Context, e dbOperations.Event) error {
+	subs, err := p.Store.SubscriptionsFor(e.Type)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	for _, sub := range subs {
+		if sub.Tenant != e.Tenant {
+			// Tenants only hear of their own users.
+			continue
+		}
+		err := p.Store.EnqueueDelivery(&dbOperations.Delivery{
+			Tenant:         sub.Tenant,
+			SubscriptionID: sub.ID,
+			EventID:        e.ID,
+			EventType:      e.Type,
+			UserID:         e.UserID,
+			Payload:        payload,
+			CreatedAt:      time.Now().UTC(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Publishers publishes every event to each of its Publishers in turn.
+type Publishers []Publisher
+
+// Publish implements Publisher. It stops at the first failure, so the
+// event is published to all of them again when it is retried.
+func (ps Publishers) Publish(ctx context.Context, e dbOperations.Event) error {
+	for _, p := range ps {
+		if err := p.Publish(ctx, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeliverWebhooks posts the deliveries that are due to their subscribers
+// and returns how many were delivered. Each is signed with the
+// subscription's secret, see VerifyWebhook. Failed deliveries are retried
+// with exponential backoff, and kept as dead letters once they run out of
+// attempts. Deliveries to a subscription that has since been deleted are
+// dropped.
+func DeliverWebhooks(ctx context.Context, st WebhookStore, client *http.Client, logger log.Logger) (int, error) {
+	now := time.Now()
+	deliveries, err := st.ClaimDeliveries(now, relayLease, relayBatch)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, d := range deliveries {
+		a := dbOperations.DeliveryAttempt{Time: time.Now().UTC()}
+		sub, err := st.GetSubscription(d.SubscriptionID)
+		if err == mgo.ErrNotFound {
+			if err := st.DeleteDelivery(d.ID); err != nil && err != mgo.ErrNotFound {
+				return n, err
+			}
+			continue
+		}
+		if err == nil {
+			a.StatusCode, err = postWebhook(ctx, client, sub, d)
+		}
+		a.DurationMs = int64(time.Since(a.Time) / time.Millisecond)
+		status, next := dbOperations.DeliveryDelivered, time.Time{}
+		if err != nil {
+			a.Error = err.Error()
+			status, next = dbOperations.DeliveryPending, now.Add(retryDelay(len(d.Attempts)))
+			if len(d.Attempts)+1 >= webhookMaxAttempts {
+				status = dbOperations.DeliveryDead
+			}
+			logger.Log("webhook", d.SubscriptionID, "delivery", d.ID, "attempts", len(d.Attempts)+1, "status", status, "err", err)
+		} else {
+			n++
+		}
+		// The delivery is gone if its subscription was deleted meanwhile.
+		if err := st.RecordDeliveryAttempt(d.ID, a, status, next); err != nil && err != mgo.ErrNotFound {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// postWebhook makes one attempt at a delivery and returns the receiver's
+// status code.
+func postWebhook(ctx context.Context, client *http.Client, sub dbOperations.Subscription, d dbOperations.Delivery) (int, error) {
+	req, err := http.NewRequest("POST", sub.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-ID", d.ID)
+	req.Header.Set("X-Webhook-Event", d.EventType)
+	req.Header.Set("X-Webhook-Timestamp", ts)
+	req.Header.Set("X-Webhook-Signature", SignWebhook(sub.Secret, ts, d.Payload))
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// SignWebhook returns the X-Webhook-Signature of a delivery: the hex
+// HMAC-SHA256 of the timestamp, a dot and the body, keyed with the secret.
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook checks a delivery's X-Webhook-Timestamp and
+// X-Webhook-Signature headers as a receiver would. Deliveries stamped more
+// than WebhookTolerance away from now are rejected, so a captured delivery
+// cannot be replayed later.
+func VerifyWebhook(secret, timestamp, signature string, body []byte, now time.Time) error {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrWebhookSignature
+	}
+	if d := now.Sub(time.Unix(ts, 0)); d > WebhookTolerance || d < -WebhookTolerance {
+		return ErrWebhookExpired
+	}
+	if !hmac.Equal([]byte(signature), []byte(SignWebhook(secret, timestamp, body))) {
+		return ErrWebhookSignature
+	}
+	return nil
+}
+
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func contains(ss []string, s string) bool {
+	for _, o := range ss {
+		if o == s {
+			return true
+		}
+	}
+	return false
+}
+
+type webhookPostRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret"`
+}
+
+type webhookPostResponse struct {
+	dbOperations.Subscription
+	Secret string `json:"secret"`
+}
+
+type webhookRequest struct {
+	ID string
+}
+
+type webhooksResponse struct {
+	Subscriptions []dbOperations.Subscription `json:"webhook"`
+}
+
+type deliveriesResponse struct {
+	Deliveries []dbOperations.Delivery `json:"delivery"`
+}
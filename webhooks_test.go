@@ -0,0 +1,284 @@
+package user
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/user/dbOperations"
+	mgo "gopkg.in/mgo.v2"
+)
+
+// memWebhooks is an in-memory WebhookStore.
+type memWebhooks struct {
+	subs       []dbOperations.Subscription
+	deliveries []dbOperations.Delivery
+	queued     int
+}
+
+func (m *memWebhooks) CreateSubscription(sub *dbOperations.Subscription) error {
+	sub.ID = fmt.Sprintf("57a98d98e4b00679b4a8%04d", len(m.subs))
+	m.subs = append(m.subs, *sub)
+	return nil
+}
+
+func (m *memWebhooks) GetSubscriptions() ([]dbOperations.Subscription, error) {
+	return append([]dbOperations.Subscription{}, m.subs...), nil
+}
+
+func (m *memWebhooks) GetSubscription(id string) (dbOperations.Subscription, error) {
+	for _, sub := range m.subs {
+		if sub.ID == id {
+			return sub, nil
+		}
+	}
+	return dbOperations.Subscription{}, mgo.ErrNotFound
+}
+
+func (m *memWebhooks) SubscriptionsFor(typ string) ([]dbOperations.Subscription, error) {
+	subs := make([]dbOperations.Subscription, 0)
+	for _, sub := range m.subs {
+		if len(sub.Events) == 0 || contains(sub.Events, typ) {
+			subs = append(subs, sub)
+		}
+	}
+	return subs, nil
+}
+
+func (m *memWebhooks) DeleteSubscription(id string) error {
+	for i, sub := range m.subs {
+		if sub.ID == id {
+			m.subs = append(m.subs[:i], m.subs[i+1:]...)
+			deliveries := m.deliveries[:0]
+			for _, d := range m.deliveries {
+				if d.SubscriptionID != id {
+					deliveries = append(deliveries, d)
+				}
+			}
+			m.deliveries = deliveries
+			return nil
+		}
+	}
+	return mgo.ErrNotFound
+}
+
+func (m *memWebhooks) EnqueueDelivery(d *dbOperations.Delivery) error {
+	for _, o := range m.deliveries {
+		if o.SubscriptionID == d.SubscriptionID && o.EventID == d.EventID {
+			return nil
+		}
+	}
+	d.ID = strconv.Itoa(m.queued)
+	m.queued++
+	d.Status, d.NextAttempt = dbOperations.DeliveryPending, d.CreatedAt
+	m.deliveries = append(m.deliveries, *d)
+	return nil
+}
+
+func (m *memWebhooks) ClaimDeliveries(now time.Time, lease time.Duration, limit int) ([]dbOperations.Delivery, error) {
+	deliveries := make([]dbOperations.Delivery, 0)
+	for i, d := range m.deliveries {
+		if d.Status == dbOperations.DeliveryPending && !d.NextAttempt.After(now) && len(deliveries) < limit {
+			m.deliveries[i].NextAttempt = now.Add(lease)
+			deliveries = append(deliveries, d)
+		}
+	}
+	return deliveries, nil
+}
+
+func (m *memWebhooks) RecordDeliveryAttempt(id string, a dbOperations.DeliveryAttempt, status string, next time.Time) error {
+	for i := range m.deliveries {
+		if m.deliveries[i].ID == id {
+			m.deliveries[i].Attempts = append(m.deliveries[i].Attempts, a)
+			m.deliveries[i].Status, m.deliveries[i].NextAttempt = status, next
+			return nil
+		}
+	}
+	return mgo.ErrNotFound
+}
+
+func (m *memWebhooks) DeleteDelivery(id string) error {
+	for i, d := range m.deliveries {
+		if d.ID == id {
+			m.deliveries = append(m.deliveries[:i], m.deliveries[i+1:]...)
+			return nil
+		}
+	}
+	return mgo.ErrNotFound
+}
+
+func (m *memWebhooks) GetDeliveries(subscriptionID string, limit int) ([]dbOperations.Delivery, error) {
+	return m.find(func(d dbOperations.Delivery) bool { return d.SubscriptionID == subscriptionID }, limit), nil
+}
+
+func (m *memWebhooks) GetDeadDeliveries(limit int) ([]dbOperations.Delivery, error) {
+	return m.find(func(d dbOperations.Delivery) bool { return d.Status == dbOperations.DeliveryDead }, limit), nil
+}
+
+func (m *memWebhooks) find(match func(dbOperations.Delivery) bool, limit int) []dbOperations.Delivery {
+	deliveries := make([]dbOperations.Delivery, 0)
+	for i := len(m.deliveries) - 1; i >= 0 && len(deliveries) < limit; i-- {
+		if match(m.deliveries[i]) {
+			deliveries = append(deliveries, m.deliveries[i])
+		}
+	}
+	return deliveries
+}
+
+func TestWebhooks(t *testing.T) {
+	svc := newStubService()
+	e, _ := newTestEndpoints(svc)
+	router := MakeHTTPHandler(context.Background(), e, log.NewNopLogger())
+	do := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	var received []dbOperations.Event
+	var secret string
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := VerifyWebhook(secret, r.Header.Get("X-Webhook-Timestamp"), r.Header.Get("X-Webhook-Signature"), body, time.Now()); err != nil {
+			t.Errorf("delivery does not verify: %v", err)
+		}
+		var e dbOperations.Event
+		json.Unmarshal(body, &e)
+		received = append(received, e)
+	}))
+	defer receiver.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	post := func(body string) *httptest.ResponseRecorder {
+		r := adminRequest("POST", "/webhooks")
+		r.Body = ioutil.NopCloser(bytes.NewBufferString(body))
+		return do(r)
+	}
+	if w := post(`{"url": "ftp://example.com"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a non-HTTP URL, got %d", w.Code)
+	}
+	if w := post(`{"url": "http://example.com", "events": ["UserExploded"]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown event type, got %d", w.Code)
+	}
+	w := post(`{"url": "` + receiver.URL + `", "events": ["UserDeleted"]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	var created webhookPostResponse
+	json.NewDecoder(w.Body).Decode(&created)
+	secret = created.Secret
+	if len(secret) != 64 || created.CreatedBy != "admin" {
+		t.Errorf("unexpected subscription %+v", created)
+	}
+	post(`{"url": "` + broken.URL + `", "secret": "s3cret"}`)
+
+	w = do(adminRequest("GET", "/webhooks"))
+	if bytes.Contains(w.Body.Bytes(), []byte(secret)) {
+		t.Error("expected secrets not to be listed")
+	}
+
+	pub := WebhookPublisher{Store: svc}
+	for _, typ := range []string{EventUserRegistered, EventUserDeleted} {
+		ev, _ := NewEvent(typ, testUserID, nil)
+		ev.ID = typ
+		pub.Publish(context.Background(), ev)
+		pub.Publish(context.Background(), ev)
+	}
+	if len(svc.deliveries) != 3 || svc.deliveries[0].UserID != testUserID {
+		t.Fatalf("expected each event queued once per matching subscription, got %+v", svc.deliveries)
+	}
+
+	if n, err := DeliverWebhooks(context.Background(), svc, nil, log.NewNopLogger()); n != 1 || err != nil {
+		t.Errorf("expected one delivery to succeed, got %d: %v", n, err)
+	}
+	if len(received) != 1 || received[0].Type != EventUserDeleted || received[0].UserID != testUserID {
+		t.Errorf("unexpected deliveries %+v", received)
+	}
+	for i := 1; i < webhookMaxAttempts; i++ {
+		for j := range svc.deliveries {
+			svc.deliveries[j].NextAttempt = time.Time{}
+		}
+		DeliverWebhooks(context.Background(), svc, nil, log.NewNopLogger())
+	}
+
+	w = do(adminRequest("GET", "/webhooks/dead-letters"))
+	var dead struct {
+		Embed deliveriesResponse `json:"_embedded"`
+	}
+	json.NewDecoder(w.Body).Decode(&dead)
+	if len(dead.Embed.Deliveries) != 2 || len(dead.Embed.Deliveries[0].Attempts) != webhookMaxAttempts {
+		t.Errorf("expected both deliveries to the broken receiver to be dead, got %+v", dead.Embed.Deliveries)
+	}
+
+	w = do(adminRequest("GET", "/webhooks/"+created.ID+"/deliveries"))
+	var history struct {
+		Embed deliveriesResponse `json:"_embedded"`
+	}
+	json.NewDecoder(w.Body).Decode(&history)
+	if len(history.Embed.Deliveries) != 1 || history.Embed.Deliveries[0].Status != dbOperations.DeliveryDelivered || history.Embed.Deliveries[0].Attempts[0].StatusCode != http.StatusOK {
+		t.Errorf("unexpected delivery log %+v", history.Embed.Deliveries)
+	}
+
+	if w := do(adminRequest("DELETE", "/webhooks/"+created.ID)); w.Code != http.StatusOK {
+		t.Errorf("expected the subscription to be deleted, got %d", w.Code)
+	}
+	if w := do(adminRequest("GET", "/webhooks/"+created.ID+"/deliveries")); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a deleted subscription, got %d", w.Code)
+	}
+	if w := do(httptest.NewRequest("GET", "/webhooks", nil)); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a token, got %d", w.Code)
+	}
+}
+
+func TestDeliverWebhooksDropsDeletedSubscriptions(t *testing.T) {
+	received := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received++
+	}))
+	defer receiver.Close()
+	st := &memWebhooks{}
+	sub := dbOperations.Subscription{URL: receiver.URL, Secret: "s3cret"}
+	st.CreateSubscription(&sub)
+	st.EnqueueDelivery(&dbOperations.Delivery{SubscriptionID: sub.ID, EventID: "e1"})
+	st.DeleteSubscription(sub.ID)
+	// A publisher that looked the subscription up before it was deleted
+	// may still queue a delivery to it.
+	st.EnqueueDelivery(&dbOperations.Delivery{SubscriptionID: sub.ID, EventID: "e2"})
+
+	if n, err := DeliverWebhooks(context.Background(), st, nil, log.NewNopLogger()); n != 0 || err != nil {
+		t.Errorf("expected nothing delivered, got %d: %v", n, err)
+	}
+	if received != 0 || len(st.deliveries) != 0 {
+		t.Errorf("expected the deliveries to be dropped, got %d posts and %+v", received, st.deliveries)
+	}
+}
+
+func TestVerifyWebhook(t *testing.T) {
+	body := []byte(`{"type":"UserDeleted"}`)
+	now := time.Now()
+	ts := strconv.FormatInt(now.Unix(), 10)
+	sig := SignWebhook("secret", ts, body)
+	if err := VerifyWebhook("secret", ts, sig, body, now); err != nil {
+		t.Error(err)
+	}
+	if err := VerifyWebhook("other", ts, sig, body, now); err != ErrWebhookSignature {
+		t.Errorf("expected ErrWebhookSignature for another secret, got %v", err)
+	}
+	if err := VerifyWebhook("secret", ts, sig, []byte(`{}`), now); err != ErrWebhookSignature {
+		t.Errorf("expected ErrWebhookSignature for another body, got %v", err)
+	}
+	if err := VerifyWebhook("secret", ts, sig, body, now.Add(WebhookTolerance+time.Second)); err != ErrWebhookExpired {
+		t.Errorf("expected ErrWebhookExpired for a replay, got %v", err)
+	}
+}